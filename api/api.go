@@ -18,12 +18,16 @@ package api
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,10 +40,14 @@ import (
 	apiTypes "github.com/mudler/edgevpn/api/types"
 
 	"github.com/labstack/echo/v4"
+	edgevpnmetrics "github.com/mudler/edgevpn/pkg/metrics"
 	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/operations"
 	"github.com/mudler/edgevpn/pkg/protocol"
 	"github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/trustzone"
 	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/vpn"
 )
 
 //go:embed public
@@ -55,35 +63,134 @@ func getFileSystem() http.FileSystem {
 }
 
 const (
-	MachineURL    = "/api/machines"
-	UsersURL      = "/api/users"
-	ServiceURL    = "/api/services"
-	BlockchainURL = "/api/blockchain"
-	LedgerURL     = "/api/ledger"
-	SummaryURL    = "/api/summary"
-	FileURL       = "/api/files"
-	NodesURL      = "/api/nodes"
-	DNSURL        = "/api/dns"
-	MetricsURL    = "/api/metrics"
-	PeerstoreURL  = "/api/peerstore"
-	PeerGateURL   = "/api/peergate"
+	MachineURL     = "/api/machines"
+	UsersURL       = "/api/users"
+	ServiceURL     = "/api/services"
+	BlockchainURL  = "/api/blockchain"
+	LedgerURL      = "/api/ledger"
+	SummaryURL     = "/api/summary"
+	FileURL        = "/api/files"
+	NodesURL       = "/api/nodes"
+	DNSURL         = "/api/dns"
+	MetricsURL     = "/api/metrics"
+	PeerstoreURL   = "/api/peerstore"
+	PeerGateURL    = "/api/peergate"
+	FleetURL       = "/api/fleet"
+	StreamsURL     = "/api/services/streams"
+	CompressionURL = "/api/services/compression"
+	QueryURL       = "/api/services/query"
+	PipelineURL    = "/api/vpn/pipeline"
+	DeviceURL      = "/api/vpn/device"
+	OperationsURL  = "/api/operations"
+	StatusURL      = "/api/status"
+	QuarantineURL  = "/api/quarantine"
+	SafeModeURL    = "/api/safemode"
+	ResyncURL      = "/api/ledger/resync"
+	ProtectedURL   = "/api/protected"
+	PinsURL        = "/api/pins"
+	ResourcesURL   = "/api/resources"
+	ProfilesURL    = "/api/profiles"
+	TransfersURL   = "/api/files/transfers"
+	ProgressURL    = "/api/files/progress"
+	ReceiveURL     = "/api/files/receive"
+	EventsURL      = "/api/events"
+	PrometheusURL  = "/metrics"
+	FirewallURL    = "/api/firewall"
+	// NetworksURL is the prefix of the APIs of the networks, when
+	// the node joins several networks
+	NetworksURL     = "/networks"
+	NetworksListURL = "/api/networks"
 )
 
+// DownloadDir is the directory the files received with the API are saved
+// in, the paths given to the API being relative to it. Files can't be
+// received with the API when empty.
+var DownloadDir string
+
+// router is where the API routes of a node are registered: the
+// server, or the group of the network of the node
+type router interface {
+	GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	PUT(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	DELETE(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+}
+
 func API(ctx context.Context, l string, defaultInterval, timeout time.Duration, e *node.Node, bwc metrics.Reporter, debugMode bool) error {
+	ec, err := newServer(l, bwc, debugMode)
+	if err != nil {
+		return err
+	}
+	nodeAPI(ctx, ec, defaultInterval, timeout, e)
+	ec.GET("/*", echo.WrapHandler(http.StripPrefix("/", http.FileServer(getFileSystem()))))
+	return serve(ctx, ec, l)
+}
 
-	ledger, _ := e.Ledger()
+// NetworksAPI serves the API of the nodes of several networks, by network
+// name. The API and the web UI of each node are the same as the ones of a
+// single node, under NetworksURL/<name> (e.g. /networks/<name>/api/machines).
+// The root redirects to the web UI of the first network, and ServiceURL lists
+// the services of all the networks. The metrics are the ones of the process,
+// shared by the networks.
+func NetworksAPI(ctx context.Context, l string, defaultInterval, timeout time.Duration, nodes map[string]*node.Node, bwc metrics.Reporter, debugMode bool) error {
+	ec, err := newServer(l, bwc, debugMode)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name, e := range nodes {
+		names = append(names, name)
+		prefix := NetworkURL(name)
+		g := ec.Group(prefix)
+		nodeAPI(ctx, g, defaultInterval, timeout, e)
+		// The web UI uses relative URLs, so its root needs the trailing slash
+		ec.GET(prefix, func(c echo.Context) error {
+			return c.Redirect(http.StatusMovedPermanently, prefix+"/")
+		})
+		g.GET("/*", echo.WrapHandler(http.StripPrefix(prefix+"/", http.FileServer(getFileSystem()))))
+	}
+	sort.Strings(names)
+	ec.GET(NetworksListURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, names)
+	})
+	// The services of all the networks, each with the network it is announced on
+	ec.GET(ServiceURL, func(c echo.Context) error {
+		networks := []services.Network{}
+		for _, name := range names {
+			ledger, err := nodes[name].Ledger()
+			if err != nil {
+				return err
+			}
+			networks = append(networks, services.Network{Name: name, Ledger: ledger, Node: nodes[name]})
+		}
+		return c.JSON(http.StatusOK, services.ListServices(networks...))
+	})
+	if len(names) > 0 {
+		ec.GET("/", func(c echo.Context) error {
+			return c.Redirect(http.StatusFound, NetworkURL(names[0])+"/")
+		})
+	}
+	return serve(ctx, ec, l)
+}
+
+// NetworkURL returns the prefix of the API of the network
+func NetworkURL(name string) string {
+	return fmt.Sprintf("%s/%s", NetworksURL, url.PathEscape(name))
+}
 
+// newServer returns the API server listening on l, with the
+// debug and the metrics endpoints of the process
+func newServer(l string, bwc metrics.Reporter, debugMode bool) (*echo.Echo, error) {
 	ec := echo.New()
 
 	if strings.HasPrefix(l, "unix://") {
 		unixListener, err := net.Listen("unix", strings.ReplaceAll(l, "unix://", ""))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		ec.Listener = unixListener
 	}
 
-	assetHandler := http.FileServer(getFileSystem())
 	if debugMode {
 		ec.GET("/debug/pprof/*", echo.WrapHandler(http.DefaultServeMux))
 	}
@@ -105,6 +212,30 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 			return c.JSON(http.StatusOK, bwc.GetBandwidthForProtocol(p2pprotocol.ID(c.Param("protocol"))))
 		})
 	}
+	ec.GET(filepath.Join(MetricsURL, "latency"), func(c echo.Context) error {
+		if c.QueryParam("format") == "prometheus" {
+			c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4")
+			return edgevpnmetrics.WriteText(c.Response())
+		}
+		return c.JSON(http.StatusOK, edgevpnmetrics.Histograms())
+	})
+	ec.GET(filepath.Join(MetricsURL, "counters"), func(c echo.Context) error {
+		return c.JSON(http.StatusOK, edgevpnmetrics.Counters())
+	})
+	ec.GET(filepath.Join(MetricsURL, "gauges"), func(c echo.Context) error {
+		return c.JSON(http.StatusOK, edgevpnmetrics.Gauges())
+	})
+	ec.GET(PrometheusURL, func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4")
+		return edgevpnmetrics.WriteText(c.Response())
+	})
+	return ec, nil
+}
+
+// nodeAPI registers the API of the node
+func nodeAPI(ctx context.Context, ec router, defaultInterval, timeout time.Duration, e *node.Node) {
+	ledger, _ := e.Ledger()
+
 	// Get data from ledger
 	ec.GET(FileURL, func(c echo.Context) error {
 		list := []*types.File{}
@@ -242,16 +373,245 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 	})
 
 	ec.GET(ServiceURL, func(c echo.Context) error {
-		list := []*types.Service{}
-		for _, v := range ledger.CurrentData()[protocol.ServicesLedgerKey] {
-			srvc := &types.Service{}
-			v.Unmarshal(srvc)
-			list = append(list, srvc)
+		return c.JSON(http.StatusOK, services.ListServices(services.Network{Name: e.NetworkName(), Ledger: ledger, Node: e}))
+	})
+
+	ec.GET(QuarantineURL, func(c echo.Context) error {
+		list := []types.QuarantinedPeer{}
+		if q := e.Quarantine(); q != nil {
+			list = q.List()
 		}
 		return c.JSON(http.StatusOK, list)
 	})
 
-	ec.GET("/*", echo.WrapHandler(http.StripPrefix("/", assetHandler)))
+	protected := func() []types.ProtectedPeer {
+		list := e.Protected()
+		if list == nil {
+			list = []types.ProtectedPeer{}
+		}
+		return list
+	}
+
+	ec.GET(ProtectedURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, protected())
+	})
+
+	ec.PUT(fmt.Sprintf("%s/:peer", ProtectedURL), func(c echo.Context) error {
+		p, err := peer.Decode(c.Param("peer"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		e.Protect(p, node.ProtectAPI)
+		return c.JSON(http.StatusOK, protected())
+	})
+
+	ec.DELETE(fmt.Sprintf("%s/:peer", ProtectedURL), func(c echo.Context) error {
+		p, err := peer.Decode(c.Param("peer"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		e.Unprotect(p, node.ProtectAPI)
+		return c.JSON(http.StatusOK, protected())
+	})
+
+	firewallRules := func() []types.FirewallRule {
+		return trustzone.PublishedFirewallRules(ledger.CurrentData()[protocol.FirewallLedgerKey])
+	}
+
+	ec.GET(FirewallURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, firewallRules())
+	})
+
+	ec.PUT(fmt.Sprintf("%s/:id", FirewallURL), func(c echo.Context) error {
+		r := types.FirewallRule{
+			ID:          c.Param("id"),
+			Peer:        c.QueryParam("peer"),
+			Action:      c.QueryParam("action"),
+			Destination: c.QueryParam("destination"),
+			Protocol:    c.QueryParam("protocol"),
+		}
+		if port := c.QueryParam("port"); port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			r.Port = p
+		}
+		if err := vpn.ValidateFirewallRule(r); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		r.Serial = trustzone.NextFirewallSerial(ledger.CurrentData()[protocol.FirewallLedgerKey], r.ID)
+		signed, err := trustzone.SignFirewallRule(r, e.Host().Peerstore().PrivKey(e.Host().ID()))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		ledger.Add(protocol.FirewallLedgerKey, map[string]interface{}{r.ID: signed})
+		return c.JSON(http.StatusOK, firewallRules())
+	})
+
+	// The rules are revoked with a signed tombstone, as the nodes keep
+	// enforcing the rules deleted from the ledger
+	ec.DELETE(fmt.Sprintf("%s/:id", FirewallURL), func(c echo.Context) error {
+		var r types.FirewallRule
+		for _, rule := range firewallRules() {
+			if rule.ID == c.Param("id") {
+				r = rule
+			}
+		}
+		if r.ID == "" {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no firewall rule '%s'", c.Param("id")))
+		}
+		r.Revoked = true
+		r.Serial = trustzone.NextFirewallSerial(ledger.CurrentData()[protocol.FirewallLedgerKey], r.ID)
+		signed, err := trustzone.SignFirewallRule(r, e.Host().Peerstore().PrivKey(e.Host().ID()))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		ledger.Add(protocol.FirewallLedgerKey, map[string]interface{}{r.ID: signed})
+		return c.JSON(http.StatusOK, firewallRules())
+	})
+
+	ec.GET(PinsURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, e.Pinned())
+	})
+
+	ec.GET(ResourcesURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, e.ResourceUsage())
+	})
+
+	ec.PUT(fmt.Sprintf("%s/:peer", PinsURL), func(c echo.Context) error {
+		p, k, err := node.DecodePin(c.Param("peer"), c.QueryParam("key"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		e.Pin(p, k)
+		return c.JSON(http.StatusOK, e.Pinned())
+	})
+
+	ec.DELETE(fmt.Sprintf("%s/:peer", PinsURL), func(c echo.Context) error {
+		p, err := peer.Decode(c.Param("peer"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		e.Unpin(p)
+		return c.JSON(http.StatusOK, e.Pinned())
+	})
+
+	ec.PUT(fmt.Sprintf("%s/:state", SafeModeURL), func(c echo.Context) error {
+		switch c.Param("state") {
+		case "enable":
+			e.SetSafeMode(true)
+		case "disable":
+			e.SetSafeMode(false)
+		}
+		return c.JSON(http.StatusOK, e.Status().SafeMode)
+	})
+
+	ec.GET(StatusURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, e.Status())
+	})
+
+	ec.GET(StreamsURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, services.ServiceStreams())
+	})
+
+	ec.GET(CompressionURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, services.CompressionRatios())
+	})
+
+	ec.GET(fmt.Sprintf("%s/:peer", QueryURL), func(c echo.Context) error {
+		p, err := peer.Decode(c.Param("peer"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+		defer cancel()
+		list, err := services.QueryServices(ctx, e.Host(), p)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	ec.GET(TransfersURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, services.DefaultTransferLimiter.Stats())
+	})
+
+	ec.GET(ProgressURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, services.FileProgress())
+	})
+
+	ec.PUT(fmt.Sprintf("%s/:file", ReceiveURL), func(c echo.Context) error {
+		if DownloadDir == "" {
+			return echo.NewHTTPError(http.StatusForbidden, "no download directory configured")
+		}
+		path := c.QueryParam("path")
+		if path == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "missing path")
+		}
+		if !filepath.IsLocal(path) {
+			return echo.NewHTTPError(http.StatusBadRequest, "path must be relative to the download directory")
+		}
+		file := c.Param("file")
+		err := services.StartReceiveFile(ctx, ledger, e, e.Logger(), defaultInterval, file, filepath.Join(DownloadDir, path))
+		if errors.Is(err, services.ErrReceiving) {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, services.FileProgress())
+	})
+
+	ec.GET(PipelineURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, vpn.InterfacePipelineStats(e.InterfaceStatus().Name))
+	})
+	ec.GET(DeviceURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, vpn.InterfaceDeviceStats(e.InterfaceStatus().Name))
+	})
+
+	ec.GET(EventsURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, e.RecentEvents())
+	})
+
+	ec.GET(OperationsURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, operations.List())
+	})
+
+	ec.DELETE(fmt.Sprintf("%s/:id", OperationsURL), func(c echo.Context) error {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if !operations.Cancel(id) {
+			return echo.NewHTTPError(http.StatusNotFound, "operation not found")
+		}
+		return c.JSON(http.StatusOK, operations.List())
+	})
+
+	ec.GET(FleetURL, func(c echo.Context) error {
+		list := services.FleetStatus(ledger)
+		if list == nil {
+			list = []types.NodeHealth{}
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	ec.GET(ProfilesURL, func(c echo.Context) error {
+		list := services.Profiles(ledger)
+		if list == nil {
+			list = []types.Profile{}
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	ec.GET(fmt.Sprintf("%s/:peer", ProfilesURL), func(c echo.Context) error {
+		p, err := services.PeerProfile(ledger, c.Param("peer"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return c.JSON(http.StatusOK, p)
+	})
 
 	ec.GET(BlockchainURL, func(c echo.Context) error {
 		return c.JSON(http.StatusOK, ledger.LastBlock())
@@ -267,6 +627,23 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		return c.JSON(http.StatusOK, ledger.CurrentData()[bucket][key])
 	})
 
+	ec.GET(ResyncURL, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, ledger.ResyncStatus())
+	})
+
+	ec.POST(ResyncURL, func(c echo.Context) error {
+		if err := ledger.Resync(context.Background(), timeout); err != nil {
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return c.JSON(http.StatusOK, ledger.ResyncStatus())
+	})
+
+	ec.GET(fmt.Sprintf("%s/:bucket/:key/history", LedgerURL), func(c echo.Context) error {
+		bucket := c.Param("bucket")
+		key := c.Param("key")
+		return c.JSON(http.StatusOK, ledger.History(bucket, key))
+	})
+
 	ec.GET(fmt.Sprintf("%s/:bucket", LedgerURL), func(c echo.Context) error {
 		bucket := c.Param("bucket")
 		return c.JSON(http.StatusOK, ledger.CurrentData()[bucket])
@@ -334,7 +711,10 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		ledger.AnnounceDeleteBucketKey(context.Background(), defaultInterval, timeout, bucket, key)
 		return c.JSON(http.StatusOK, announcing)
 	})
+}
 
+// serve starts the API server, and shuts it down with the context
+func serve(ctx context.Context, ec *echo.Echo, l string) error {
 	ec.HideBanner = true
 
 	if err := ec.Start(l); err != nil && err != http.ErrServerClosed {
@@ -17,6 +17,9 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"time"
@@ -27,6 +30,8 @@ import (
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	"github.com/mudler/edgevpn/pkg/logger"
 	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -55,6 +60,7 @@ var _ = Describe("API", func() {
 			e2.Start(ctx)
 
 			go func() {
+				defer GinkgoRecover()
 				err := API(ctx, fmt.Sprintf("unix://%s", socket), 10*time.Second, 20*time.Second, e, nil, false)
 				Expect(err).ToNot(HaveOccurred())
 			}()
@@ -77,4 +83,132 @@ var _ = Describe("API", func() {
 			}, 10*time.Second, 1*time.Second).Should(Equal("bar"))
 		})
 	})
+
+	Context("Receives files", func() {
+		It("saves them only in the download directory", func() {
+			d, _ := ioutil.TempDir("", "xxx")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, _ := node.New(node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil), node.WithStore(&blockchain.MemoryStore{}), node.Logger(logger.New(log.LevelFatal)))
+			e.Start(ctx)
+
+			go func() {
+				defer GinkgoRecover()
+				err := API(ctx, fmt.Sprintf("unix://%s", socket), 10*time.Second, 20*time.Second, e, nil, false)
+				Expect(err).ToNot(HaveOccurred())
+			}()
+
+			web := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			}}}
+			receive := func(path string) (int, error) {
+				req, err := http.NewRequest(http.MethodPut, "http://edgevpn"+ReceiveURL+"/file?path="+url.QueryEscape(path), nil)
+				if err != nil {
+					return 0, err
+				}
+				resp, err := web.Do(req)
+				if err != nil {
+					return 0, err
+				}
+				resp.Body.Close()
+				return resp.StatusCode, nil
+			}
+
+			Eventually(func() (int, error) { return receive("file") }, 10*time.Second, 1*time.Second).Should(Equal(http.StatusForbidden))
+
+			DownloadDir = d
+			defer func() { DownloadDir = "" }()
+			Expect(receive("../file")).To(Equal(http.StatusBadRequest))
+			Expect(receive(filepath.Join(d, "file"))).To(Equal(http.StatusBadRequest))
+			Expect(receive("file")).To(Equal(http.StatusOK))
+			Expect(receive("file")).To(Equal(http.StatusConflict))
+		})
+	})
+
+	Context("Rolls up the fleet", func() {
+		It("returns the health summaries published by the nodes", func() {
+			d, _ := ioutil.TempDir("", "xxx")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, _ := node.New(append(services.Fleet(time.Second),
+				node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil),
+				node.WithStore(&blockchain.MemoryStore{}),
+				node.Logger(logger.New(log.LevelFatal)),
+			)...)
+			e.Start(ctx)
+
+			go func() {
+				defer GinkgoRecover()
+				err := API(ctx, fmt.Sprintf("unix://%s", socket), 10*time.Second, 20*time.Second, e, nil, false)
+				Expect(err).ToNot(HaveOccurred())
+			}()
+
+			c := client.NewClient(client.WithHost("unix://" + socket))
+			Eventually(func() ([]types.NodeHealth, error) {
+				return c.Fleet()
+			}, 20*time.Second, 1*time.Second).Should(ConsistOf(HaveField("PeerID", e.Host().ID().String())))
+		})
+	})
+
+	Context("Serves several networks", func() {
+		It("namespaces the API of each network", func() {
+			d, _ := ioutil.TempDir("", "xxx")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+
+			nodes := map[string]*node.Node{}
+			for _, name := range []string{"office", "lab"} {
+				token := node.GenerateNewConnectionData().Base64()
+				e, _ := node.New(node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+				e.Start(ctx)
+				nodes[name] = e
+			}
+
+			go func() {
+				defer GinkgoRecover()
+				err := NetworksAPI(ctx, fmt.Sprintf("unix://%s", socket), 10*time.Second, 20*time.Second, nodes, nil, false)
+				Expect(err).ToNot(HaveOccurred())
+			}()
+
+			Eventually(func() ([]string, error) {
+				return client.NewClient(client.WithHost("unix://" + socket)).Networks()
+			}, 10*time.Second, 1*time.Second).Should(Equal([]string{"lab", "office"}))
+
+			office := client.NewClient(client.WithHost("unix://"+socket), client.WithNetwork("office"))
+			lab := client.NewClient(client.WithHost("unix://"+socket), client.WithNetwork("lab"))
+			Expect(office.Put("b", "f", "bar")).To(Succeed())
+			Eventually(office.GetBuckets, 10*time.Second, 1*time.Second).Should(ContainElement("b"))
+			Consistently(lab.GetBuckets, 2*time.Second, 500*time.Millisecond).ShouldNot(ContainElement("b"))
+
+			_, err := client.NewClient(client.WithHost("unix://"+socket), client.WithNetwork("home")).GetBuckets()
+			Expect(err).To(HaveOccurred())
+
+			// The web UI is served for each network
+			web := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			}}}
+			for _, url := range []string{"http://edgevpn/", "http://edgevpn/networks/lab", "http://edgevpn/networks/office/"} {
+				resp, err := web.Get(url)
+				Expect(err).ToNot(HaveOccurred())
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK), url)
+				Expect(string(body)).To(ContainSubstring("EdgeVPN"), url)
+			}
+		})
+	})
 })
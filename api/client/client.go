@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,6 +33,7 @@ import (
 type (
 	Client struct {
 		host       string
+		network    string
 		httpClient *http.Client
 	}
 )
@@ -54,6 +56,15 @@ func WithHost(host string) func(c *Client) error {
 	}
 }
 
+// WithNetwork sends the requests to the API of the network, on the
+// nodes joining several networks
+func WithNetwork(name string) func(c *Client) error {
+	return func(c *Client) error {
+		c.network = name
+		return nil
+	}
+}
+
 func WithTimeout(d time.Duration) func(c *Client) error {
 	return func(c *Client) error {
 		c.httpClient.Timeout = d
@@ -82,6 +93,9 @@ func NewClient(o ...Option) *Client {
 
 func (c *Client) do(method, endpoint string, params map[string]string) (*http.Response, error) {
 	baseURL := fmt.Sprintf("%s%s", c.host, endpoint)
+	if c.network != "" && endpoint != api.NetworksListURL {
+		baseURL = fmt.Sprintf("%s%s%s", c.host, api.NetworkURL(c.network), endpoint)
+	}
 
 	req, err := http.NewRequest(method, baseURL, nil)
 	if err != nil {
@@ -96,6 +110,23 @@ func (c *Client) do(method, endpoint string, params map[string]string) (*http.Re
 	return c.httpClient.Do(req)
 }
 
+// Networks returns the names of the networks joined by the node
+func (c *Client) Networks() (data []string, err error) {
+	res, err := c.do(http.MethodGet, api.NetworksListURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return data, err
+	}
+	if err = json.Unmarshal(body, &data); err != nil {
+		return data, err
+	}
+	return
+}
+
 // Get methods (Services, Users, Files, Ledger, Blockchain, Machines)
 func (c *Client) Services() (resp []types.Service, err error) {
 	res, err := c.do(http.MethodGet, api.ServiceURL, nil)
@@ -209,6 +240,319 @@ func (c *Client) Machines() (resp []types.Machine, err error) {
 	return
 }
 
+func (c *Client) Fleet() (resp []types.NodeHealth, err error) {
+	res, err := c.do(http.MethodGet, api.FleetURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) Profiles() (resp []types.Profile, err error) {
+	res, err := c.do(http.MethodGet, api.ProfilesURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// Profile returns the profile published by the peer
+func (c *Client) Profile(peerID string) (resp types.Profile, err error) {
+	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s", api.ProfilesURL, peerID), nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// Transfers returns the file transfers running and queued on the node
+func (c *Client) Transfers() (resp types.FileTransfers, err error) {
+	res, err := c.do(http.MethodGet, api.TransfersURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// FileProgress returns the progress of the files received by the node
+func (c *Client) FileProgress() (resp []types.FileProgress, err error) {
+	return c.fileProgress(http.MethodGet, api.ProgressURL, nil)
+}
+
+// ReceiveFile makes the node receive the file to path in the background,
+// its progress is returned by FileProgress
+func (c *Client) ReceiveFile(file, path string) (resp []types.FileProgress, err error) {
+	return c.fileProgress(http.MethodPut, fmt.Sprintf("%s/%s", api.ReceiveURL, file), map[string]string{"path": path})
+}
+
+func (c *Client) fileProgress(method, url string, params map[string]string) (resp []types.FileProgress, err error) {
+	res, err := c.do(method, url, params)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("file request failed: %s", string(body))
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) Events() (resp []types.Event, err error) {
+	res, err := c.do(http.MethodGet, api.EventsURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) Quarantine() (resp []types.QuarantinedPeer, err error) {
+	res, err := c.do(http.MethodGet, api.QuarantineURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) Status() (resp types.NodeStatus, err error) {
+	res, err := c.do(http.MethodGet, api.StatusURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) Resources() (resp []types.ResourceUsage, err error) {
+	res, err := c.do(http.MethodGet, api.ResourcesURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) ServiceStreams() (resp []types.StreamStat, err error) {
+	res, err := c.do(http.MethodGet, api.StreamsURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// ServiceCompression returns the compression ratios of the services
+func (c *Client) ServiceCompression() (resp []types.CompressionStat, err error) {
+	res, err := c.do(http.MethodGet, api.CompressionURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// QueryServices asks the peer which services it exposes, through the node
+func (c *Client) QueryServices(peer string) (resp []types.ExposedService, err error) {
+	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s", api.QueryURL, peer), nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("query failed: %s", string(body))
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// CounterMetrics returns the counters of the node, like the DHT bandwidth
+func (c *Client) CounterMetrics() (resp []types.Counter, err error) {
+	res, err := c.do(http.MethodGet, api.MetricsURL+"/counters", nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// LatencyMetrics returns the latency histograms of the node
+func (c *Client) LatencyMetrics() (resp []types.LatencyHistogram, err error) {
+	res, err := c.do(http.MethodGet, api.MetricsURL+"/latency", nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// VPNPipeline returns the counters of the VPN read pipeline
+func (c *Client) VPNPipeline() (resp types.PipelineStat, err error) {
+	res, err := c.do(http.MethodGet, api.PipelineURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// VPNDevice returns the counters of the writes to the VPN interface
+func (c *Client) VPNDevice() (resp types.DeviceWriteStat, err error) {
+	res, err := c.do(http.MethodGet, api.DeviceURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// Operations returns the operations in flight, like the dials and the DHT queries
+func (c *Client) Operations() (resp []types.Operation, err error) {
+	return c.operations(http.MethodGet, api.OperationsURL)
+}
+
+// CancelOperation cancels the operation in flight with the given ID
+func (c *Client) CancelOperation(id uint64) (resp []types.Operation, err error) {
+	return c.operations(http.MethodDelete, fmt.Sprintf("%s/%d", api.OperationsURL, id))
+}
+
+func (c *Client) operations(method, url string) (resp []types.Operation, err error) {
+	res, err := c.do(method, url, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("operations request failed: %s", string(body))
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
 func (c *Client) GetBucket(b string) (resp map[string]blockchain.Data, err error) {
 	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s", api.LedgerURL, b), nil)
 	if err != nil {
@@ -275,6 +619,168 @@ func (c *Client) GetBucketKey(b, k string) (resp blockchain.Data, err error) {
 	return
 }
 
+// GetBucketKeyHistory returns the retained versions of the key
+func (c *Client) GetBucketKeyHistory(b, k string) (resp []blockchain.Version, err error) {
+	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s/%s/history", api.LedgerURL, b, k), nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// Resync drops the ledger state of the node and syncs it again from the peers
+func (c *Client) Resync() (resp blockchain.ResyncStatus, err error) {
+	return c.resync(http.MethodPost)
+}
+
+// ResyncStatus returns the progress of the last ledger resync
+func (c *Client) ResyncStatus() (resp blockchain.ResyncStatus, err error) {
+	return c.resync(http.MethodGet)
+}
+
+func (c *Client) resync(method string) (resp blockchain.ResyncStatus, err error) {
+	res, err := c.do(method, api.ResyncURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("resync failed: %s", string(body))
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// SetSafeMode toggles manually the safe mode of the node
+func (c *Client) Protected() (resp []types.ProtectedPeer, err error) {
+	return c.protected(http.MethodGet, api.ProtectedURL)
+}
+
+func (c *Client) Protect(peerID string) (resp []types.ProtectedPeer, err error) {
+	return c.protected(http.MethodPut, fmt.Sprintf("%s/%s", api.ProtectedURL, peerID))
+}
+
+func (c *Client) Unprotect(peerID string) (resp []types.ProtectedPeer, err error) {
+	return c.protected(http.MethodDelete, fmt.Sprintf("%s/%s", api.ProtectedURL, peerID))
+}
+
+func (c *Client) protected(method, url string) (resp []types.ProtectedPeer, err error) {
+	res, err := c.do(method, url, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// FirewallRules returns the firewall rules published in the ledger
+func (c *Client) FirewallRules() (resp []types.FirewallRule, err error) {
+	return c.firewall(http.MethodGet, api.FirewallURL, nil)
+}
+
+// AddFirewallRule signs the rule with the node key and publishes it,
+// replacing the rule with the same ID
+func (c *Client) AddFirewallRule(r types.FirewallRule) (resp []types.FirewallRule, err error) {
+	params := map[string]string{"peer": r.Peer, "action": r.Action, "destination": r.Destination, "protocol": r.Protocol}
+	if r.Port != 0 {
+		params["port"] = strconv.Itoa(r.Port)
+	}
+	return c.firewall(http.MethodPut, fmt.Sprintf("%s/%s", api.FirewallURL, r.ID), params)
+}
+
+// RevokeFirewallRule removes the rule from the ledger
+func (c *Client) RevokeFirewallRule(id string) (resp []types.FirewallRule, err error) {
+	return c.firewall(http.MethodDelete, fmt.Sprintf("%s/%s", api.FirewallURL, id), nil)
+}
+
+func (c *Client) firewall(method, url string, params map[string]string) (resp []types.FirewallRule, err error) {
+	res, err := c.do(method, url, params)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("firewall request failed: %s", string(body))
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) Pins() (resp []types.PinnedKey, err error) {
+	return c.pins(http.MethodGet, api.PinsURL, nil)
+}
+
+func (c *Client) Pin(peerID, key string) (resp []types.PinnedKey, err error) {
+	return c.pins(http.MethodPut, fmt.Sprintf("%s/%s", api.PinsURL, peerID), map[string]string{"key": key})
+}
+
+func (c *Client) Unpin(peerID string) (resp []types.PinnedKey, err error) {
+	return c.pins(http.MethodDelete, fmt.Sprintf("%s/%s", api.PinsURL, peerID), nil)
+}
+
+func (c *Client) pins(method, url string, params map[string]string) (resp []types.PinnedKey, err error) {
+	res, err := c.do(method, url, params)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) SetSafeMode(enabled bool) (resp types.SafeMode, err error) {
+	state := "disable"
+	if enabled {
+		state = "enable"
+	}
+	res, err := c.do(http.MethodPut, fmt.Sprintf("%s/%s", api.SafeModeURL, state), nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
 func (c *Client) Put(b, k string, v interface{}) (err error) {
 	s := struct{ State string }{}
 
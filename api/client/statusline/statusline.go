@@ -0,0 +1,175 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package statusline renders a compact, live view of a node from its API
+package statusline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mudler/edgevpn/api/client"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// DefaultEvents is the number of recent events shown
+const DefaultEvents = 5
+
+// clearScreen moves the cursor home and clears the terminal
+const clearScreen = "\033[H\033[2J"
+
+// Snapshot is the state of the node captured at a refresh
+type Snapshot struct {
+	Time     time.Time
+	Summary  types.Summary
+	Status   types.NodeStatus
+	Pipeline types.PipelineStat
+	Device   types.DeviceWriteStat
+	Events   []types.Event
+}
+
+// Collect captures the state of the node behind the client
+func Collect(c *client.Client) (s Snapshot, err error) {
+	s.Time = time.Now()
+	if s.Summary, err = c.Summary(); err != nil {
+		return
+	}
+	if s.Status, err = c.Status(); err != nil {
+		return
+	}
+	if s.Pipeline, err = c.VPNPipeline(); err != nil {
+		return
+	}
+	if s.Device, err = c.VPNDevice(); err != nil {
+		return
+	}
+	s.Events, err = c.Events()
+	return
+}
+
+// Render writes the status of the node. The throughput is computed against
+// prev, and shown only when a previous snapshot is given.
+func Render(w io.Writer, prev *Snapshot, cur Snapshot, events int) {
+	line := func(label, format string, args ...interface{}) {
+		fmt.Fprintf(w, "%-10s %s\n", label, fmt.Sprintf(format, args...))
+	}
+
+	line("Node", "%s (%s)", cur.Summary.NodeID, cur.Status.Phase)
+	line("Peers", "%d connected, %d nodes in the ledger", cur.Summary.Peers, cur.Summary.OnChainNodes)
+	line("Discovery", "%s", discovery(cur.Status))
+	line("VPN", "%s", vpn(prev, cur))
+	line("Ledger", "block %d, %d machines, %d services, %d files, %d users",
+		cur.Summary.BlockChain, cur.Summary.Machines, cur.Summary.Services, cur.Summary.Files, cur.Summary.Users)
+	for _, d := range cur.Status.Diagnostics {
+		line("Warning", "%s", d)
+	}
+
+	list := cur.Events
+	if events >= 0 && len(list) > events {
+		list = list[len(list)-events:]
+	}
+	if len(list) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Recent events")
+	for i := len(list) - 1; i >= 0; i-- {
+		fmt.Fprintf(w, "  %s %s\n", list[i].Time.Local().Format("15:04:05"), event(list[i]))
+	}
+}
+
+func discovery(s types.NodeStatus) string {
+	if s.DHT.Mode == "" {
+		return "DHT not started"
+	}
+	str := "DHT " + s.DHT.Mode
+	if s.DHT.Setting != "" {
+		str += " (" + s.DHT.Setting + ")"
+	}
+	if s.DHT.Reachability != "" {
+		str += ", reachability " + strings.ToLower(s.DHT.Reachability)
+	}
+	return str
+}
+
+func vpn(prev *Snapshot, cur Snapshot) string {
+	iface := "down"
+	if cur.Status.Interface.Up {
+		iface = fmt.Sprintf("up %s %s", cur.Status.Interface.Name, cur.Status.Interface.Address)
+	}
+	if cur.Status.SafeMode.Enabled {
+		iface += ", safe mode"
+	}
+
+	out, in := "-", "-"
+	if prev != nil {
+		if d := cur.Time.Sub(prev.Time).Seconds(); d > 0 {
+			out = fmt.Sprintf("%.0f", rate(prev.Pipeline.Frames, cur.Pipeline.Frames, d))
+			in = fmt.Sprintf("%.0f", rate(prev.Device.Frames, cur.Device.Frames, d))
+		}
+	}
+	return fmt.Sprintf("%s, out %s frames/s, in %s frames/s, %d dropped",
+		iface, out, in, cur.Pipeline.Dropped+cur.Device.Errors)
+}
+
+// rate returns the per-second increase of a counter, 0 if it was reset
+func rate(prev, cur uint64, seconds float64) float64 {
+	if cur < prev {
+		return 0
+	}
+	return float64(cur-prev) / seconds
+}
+
+func event(ev types.Event) string {
+	keys := make([]string, 0, len(ev.Data))
+	for k := range ev.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	str := ev.Type
+	for _, k := range keys {
+		str += fmt.Sprintf(" %s=%s", k, ev.Data[k])
+	}
+	return str
+}
+
+// Watch renders the status of the node every interval until the context is
+// done. On a terminal the status is refreshed in place, otherwise each
+// refresh is appended to the output.
+func Watch(ctx context.Context, c *client.Client, w io.Writer, interval time.Duration, tty bool) error {
+	var prev *Snapshot
+	for {
+		if tty {
+			fmt.Fprint(w, clearScreen)
+		} else if prev != nil {
+			fmt.Fprintln(w)
+		}
+
+		s, err := Collect(c)
+		if err != nil {
+			fmt.Fprintf(w, "%s: could not reach the node: %s\n", time.Now().Format("15:04:05"), err.Error())
+		} else {
+			Render(w, prev, s, DefaultEvents)
+			prev = &s
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statusline_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/api"
+	"github.com/mudler/edgevpn/api/client"
+	. "github.com/mudler/edgevpn/api/client/statusline"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Statusline", func() {
+	start := time.Date(2022, 1, 1, 10, 0, 0, 0, time.Local)
+	captured := Snapshot{
+		Time:    start,
+		Summary: types.Summary{NodeID: "12D3KooW", Peers: 3, OnChainNodes: 4, BlockChain: 42, Machines: 2, Services: 1},
+		Status: types.NodeStatus{
+			Phase:       "running",
+			DHT:         types.DHTStatus{Setting: "auto", Mode: "server", Reachability: "Public"},
+			Interface:   types.InterfaceStatus{Up: true, Name: "edgevpn0", Address: "10.1.0.1/24"},
+			Diagnostics: []string{"no relay reachable"},
+		},
+		Pipeline: types.PipelineStat{Frames: 1000, Dropped: 2},
+		Device:   types.DeviceWriteStat{Frames: 500, Errors: 1},
+		Events: []types.Event{
+			{Type: types.EventPeerConnected, Time: start.Add(-2 * time.Second), Data: map[string]string{"peer": "a", "address": "/ip4/1.2.3.4"}},
+			{Type: types.EventLedgerChanged, Time: start.Add(-time.Second), Data: map[string]string{"index": "42"}},
+		},
+	}
+
+	It("renders a snapshot", func() {
+		var b bytes.Buffer
+		Render(&b, nil, captured, DefaultEvents)
+		Expect(b.String()).To(Equal(`Node       12D3KooW (running)
+Peers      3 connected, 4 nodes in the ledger
+Discovery  DHT server (auto), reachability public
+VPN        up edgevpn0 10.1.0.1/24, out - frames/s, in - frames/s, 3 dropped
+Ledger     block 42, 2 machines, 1 services, 0 files, 0 users
+Warning    no relay reachable
+Recent events
+  09:59:59 ledger.changed index=42
+  09:59:58 peer.connected address=/ip4/1.2.3.4 peer=a
+`))
+	})
+
+	It("computes the throughput against the previous snapshot", func() {
+		cur := captured
+		cur.Time = start.Add(2 * time.Second)
+		cur.Pipeline.Frames += 200
+		cur.Device.Frames += 100
+		cur.Status.Interface = types.InterfaceStatus{}
+		cur.Status.DHT = types.DHTStatus{}
+
+		var b bytes.Buffer
+		Render(&b, &captured, cur, 1)
+		Expect(b.String()).To(ContainSubstring("VPN        down, out 100 frames/s, in 50 frames/s"))
+		Expect(b.String()).To(ContainSubstring("Discovery  DHT not started"))
+		Expect(b.String()).To(ContainSubstring("ledger.changed"))
+		Expect(b.String()).ToNot(ContainSubstring("peer.connected"))
+	})
+
+	Context("watching a node", func() {
+		var srv *httptest.Server
+
+		BeforeEach(func() {
+			replies := map[string]interface{}{
+				api.SummaryURL:  captured.Summary,
+				api.StatusURL:   captured.Status,
+				api.PipelineURL: captured.Pipeline,
+				api.DeviceURL:   captured.Device,
+				api.EventsURL:   captured.Events,
+			}
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(replies[r.URL.Path])
+			}))
+			DeferCleanup(srv.Close)
+		})
+
+		watch := func(tty bool) string {
+			ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+			defer cancel()
+			var b bytes.Buffer
+			Expect(Watch(ctx, client.NewClient(client.WithHost(srv.URL)), &b, 100*time.Millisecond, tty)).To(Succeed())
+			return b.String()
+		}
+
+		It("refreshes in place on a terminal", func() {
+			out := watch(true)
+			Expect(strings.Count(out, "\033[H\033[2J")).To(BeNumerically(">=", 2))
+			Expect(out).To(ContainSubstring("Peers      3 connected"))
+		})
+
+		It("prints plain output otherwise", func() {
+			out := watch(false)
+			Expect(out).ToNot(ContainSubstring("\033"))
+			Expect(strings.Count(out, "Peers      3 connected")).To(BeNumerically(">=", 2))
+		})
+	})
+})
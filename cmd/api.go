@@ -45,6 +45,11 @@ A simple UI interface is available to display network data.`,
 				Value: "127.0.0.1:8080",
 				Usage: "Listening address. To listen to a socket, prefix with unix://, e.g. unix:///socket.path",
 			},
+			&cli.StringFlag{
+				Name:    "download-dir",
+				Usage:   "Directory the files received with the API are saved in. Files can't be received with the API if not set",
+				EnvVars: []string{"APIDOWNLOADDIR"},
+			},
 		),
 		Action: func(c *cli.Context) error {
 			o, _, ll := cliToOpts(c)
@@ -67,13 +72,14 @@ A simple UI interface is available to display network data.`,
 			displayStart(ll)
 
 			ctx := context.Background()
-			go handleStopSignals()
+			go handleStopSignals(e)
 
 			// Start the node to the network, using our ledger
 			if err := e.Start(ctx); err != nil {
 				return err
 			}
 
+			api.DownloadDir = c.String("download-dir")
 			return api.API(ctx, c.String("listen"), 5*time.Second, 20*time.Second, e, bwc, c.Bool("debug"))
 		},
 	}
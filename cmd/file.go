@@ -16,8 +16,10 @@ package cmd
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/services"
 	"github.com/urfave/cli/v2"
@@ -43,6 +45,29 @@ func cliNamePath(c *cli.Context) (name, path string, err error) {
 	return name, path, nil
 }
 
+// fileTransferFlags limit the file transfers of the node
+var fileTransferFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:    "file-max-inbound",
+		Usage:   "Maximum files received at once, the others are queued (0 for no limit)",
+		EnvVars: []string{"EDGEVPNFILEMAXINBOUND"},
+	},
+	&cli.IntFlag{
+		Name:    "file-max-outbound",
+		Usage:   "Maximum files served to the peers at once, the others are queued (0 for no limit)",
+		EnvVars: []string{"EDGEVPNFILEMAXOUTBOUND"},
+	},
+	&cli.Int64Flag{
+		Name:    "file-bandwidth",
+		Usage:   "Bandwidth limit of each file transfer, in bytes per second (0 for no limit)",
+		EnvVars: []string{"EDGEVPNFILEBANDWIDTH"},
+	},
+}
+
+func setTransferLimits(c *cli.Context) {
+	services.DefaultTransferLimiter.SetLimits(c.Int("file-max-inbound"), c.Int("file-max-outbound"), c.Int64("file-bandwidth"))
+}
+
 func FileSend() *cli.Command {
 	return &cli.Command{
 		Name:        "file-send",
@@ -50,7 +75,7 @@ func FileSend() *cli.Command {
 		Usage:       "Serve a file to the network",
 		Description: `Serve a file to the network without connecting over VPN`,
 		UsageText:   "edgevpn file-send unique-id /src/path",
-		Flags: append(CommonFlags,
+		Flags: append(append(CommonFlags, fileTransferFlags...),
 			&cli.StringFlag{
 				Name:     "name",
 				Required: true,
@@ -62,6 +87,10 @@ This is also the ID used to refer when receiving it.`,
 				Usage:    `File to serve`,
 				Required: true,
 			},
+			&cli.StringFlag{
+				Name:  "recipient",
+				Usage: `Peer ID to encrypt the file to: only the recipient can receive and decrypt it`,
+			},
 		),
 		Action: func(c *cli.Context) error {
 			name, path, err := cliNamePath(c)
@@ -69,6 +98,7 @@ This is also the ID used to refer when receiving it.`,
 				return err
 			}
 			o, _, ll := cliToOpts(c)
+			setTransferLimits(c)
 
 			// Needed to unblock connections with low activity
 			o = append(o,
@@ -77,7 +107,14 @@ This is also the ID used to refer when receiving it.`,
 					time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
 					time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second)...)
 
-			opts, err := services.ShareFile(ll, time.Duration(c.Int("ledger-announce-interval"))*time.Second, name, path)
+			var recipient peer.ID
+			if r := c.String("recipient"); r != "" {
+				if recipient, err = peer.Decode(r); err != nil {
+					return fmt.Errorf("invalid recipient: %w", err)
+				}
+			}
+
+			opts, err := services.ShareFileTo(ll, time.Duration(c.Int("ledger-announce-interval"))*time.Second, name, path, recipient)
 			if err != nil {
 				return err
 			}
@@ -89,7 +126,7 @@ This is also the ID used to refer when receiving it.`,
 			}
 
 			displayStart(ll)
-			go handleStopSignals()
+			go handleStopSignals(e)
 
 			// Start the node to the network, using our ledger
 			if err := e.Start(context.Background()); err != nil {
@@ -110,7 +147,7 @@ func FileReceive() *cli.Command {
 		Usage:       "Receive a file which is served from the network",
 		Description: `Receive a file from the network without connecting over VPN`,
 		UsageText:   "edgevpn file-receive unique-id /dst/path",
-		Flags: append(CommonFlags,
+		Flags: append(append(CommonFlags, fileTransferFlags...),
 			&cli.StringFlag{
 				Name:  "name",
 				Usage: `Unique name of the file to be received over the network.`,
@@ -126,6 +163,7 @@ func FileReceive() *cli.Command {
 				return err
 			}
 			o, _, ll := cliToOpts(c)
+			setTransferLimits(c)
 			// Needed to unblock connections with low activity
 			o = append(o,
 				services.Alive(
@@ -138,7 +176,7 @@ func FileReceive() *cli.Command {
 			}
 
 			displayStart(ll)
-			go handleStopSignals()
+			go handleStopSignals(e)
 
 			// Start the node to the network, using our ledger
 			if err := e.Start(context.Background()); err != nil {
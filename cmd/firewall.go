@@ -0,0 +1,130 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mudler/edgevpn/api/client"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/urfave/cli/v2"
+)
+
+func Firewall() *cli.Command {
+	apiAddress := &cli.StringFlag{
+		Name:    "api-address",
+		Usage:   "Address of the node API (host:port, http://host:port or unix://path)",
+		EnvVars: []string{"APILISTEN"},
+		Value:   "127.0.0.1:8080",
+	}
+	network := &cli.StringFlag{
+		Name:  "network",
+		Usage: "Network of the node, on the nodes joining several networks (see --networks)",
+	}
+	apiClient := func(c *cli.Context) *client.Client {
+		host := c.String("api-address")
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return client.NewClient(client.WithHost(host), client.WithNetwork(c.String("network")))
+	}
+	output := func(rules []types.FirewallRule, err error) error {
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rules)
+	}
+
+	return &cli.Command{
+		Name:  "firewall",
+		Usage: "Manages the VPN firewall rules published in the ledger",
+		Description: `Lists, adds and revokes the firewall rules through the API of a running node (see --api and the api command).
+The rules are signed with the key of the node, and enforced by the nodes only when it is one of their ACL admins (see --acl-admin).
+The rules of a peer restrict the destinations it can reach over the VPN, the ones of the '*' peer apply to all the peers.`,
+		UsageText: "edgevpn firewall list|add|revoke",
+		Subcommands: cli.Commands{
+			{
+				Name:  "list",
+				Usage: "Prints the rules published in the ledger",
+				Flags: []cli.Flag{apiAddress, network},
+				Action: func(c *cli.Context) error {
+					return output(apiClient(c).FirewallRules())
+				},
+			},
+			{
+				Name:      "add",
+				Usage:     "Signs and publishes a rule, replacing the one with the same ID",
+				UsageText: "edgevpn firewall add --peer <peer-id|*> --action allow|deny [--destination 10.1.0.5] [--port 443] [--protocol tcp] <id>",
+				Flags: []cli.Flag{
+					apiAddress,
+					network,
+					&cli.StringFlag{
+						Name:     "peer",
+						Usage:    "Peer ID the rule applies to, or * for any peer",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "action",
+						Usage:    "allow or deny",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "destination",
+						Usage: "Destination address or network in CIDR notation (any if empty)",
+					},
+					&cli.IntFlag{
+						Name:  "port",
+						Usage: "Destination port (any if 0)",
+					},
+					&cli.StringFlag{
+						Name:  "protocol",
+						Usage: "tcp, udp or icmp (any if empty)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					id := c.Args().Get(0)
+					if id == "" {
+						return fmt.Errorf("an ID for the rule needs to be provided")
+					}
+					return output(apiClient(c).AddFirewallRule(types.FirewallRule{
+						ID:          id,
+						Peer:        c.String("peer"),
+						Action:      c.String("action"),
+						Destination: c.String("destination"),
+						Port:        c.Int("port"),
+						Protocol:    c.String("protocol"),
+					}))
+				},
+			},
+			{
+				Name:      "revoke",
+				Usage:     "Removes a rule from the ledger",
+				UsageText: "edgevpn firewall revoke <id>",
+				Flags:     []cli.Flag{apiAddress, network},
+				Action: func(c *cli.Context) error {
+					id := c.Args().Get(0)
+					if id == "" {
+						return fmt.Errorf("the ID of the rule needs to be provided")
+					}
+					return output(apiClient(c).RevokeFirewallRule(id))
+				},
+			},
+		},
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/mudler/edgevpn/pkg/node"
 	edgevpn "github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/store"
 	"github.com/mudler/edgevpn/pkg/vpn"
 	"github.com/urfave/cli/v2"
 )
@@ -73,6 +74,11 @@ func MainFlags() []cli.Flag {
 			Usage:   "API listening port",
 			EnvVars: []string{"APILISTEN"},
 		},
+		&cli.StringFlag{
+			Name:    "api-download-dir",
+			Usage:   "Directory the files received with the API are saved in. Files can't be received with the API if not set",
+			EnvVars: []string{"APIDOWNLOADDIR"},
+		},
 		&cli.BoolFlag{
 			Name:    "dhcp",
 			Usage:   "Enables p2p ip negotiation (experimental)",
@@ -95,6 +101,21 @@ func MainFlags() []cli.Flag {
 			EnvVars: []string{"ADDRESS"},
 			Value:   "10.1.0.1/24",
 		},
+		&cli.BoolFlag{
+			Name:    "ipv6",
+			Usage:   "Assign an IPv6 address to the interface alongside the IPv4 one, derived from the peer ID",
+			EnvVars: []string{"IPV6"},
+		},
+		&cli.StringFlag{
+			Name:    "ipv6-prefix",
+			Usage:   "IPv6 prefix (at most a /64) to derive the IPv6 address in. Defaults to the unique local prefix of the network. Enables IPv6",
+			EnvVars: []string{"IPV6PREFIX"},
+		},
+		&cli.StringFlag{
+			Name:    "address6",
+			Usage:   "Static IPv6 address of the interface, instead of the derived one (e.g. fd00::1/64). Enables IPv6",
+			EnvVars: []string{"ADDRESS6"},
+		},
 		&cli.StringFlag{
 			Name:    "dns",
 			Usage:   "DNS listening address. Empty to disable dns server",
@@ -118,6 +139,45 @@ func MainFlags() []cli.Flag {
 			EnvVars: []string{"EGRESSANNOUNCE"},
 			Value:   200,
 		},
+		&cli.BoolFlag{
+			Name:    "fleet",
+			Usage:   "Publishes a node health summary to the ledger for fleet rollups",
+			EnvVars: []string{"FLEET"},
+		},
+		&cli.IntFlag{
+			Name:    "fleet-announce-time",
+			Usage:   "Fleet health summary announce time (s)",
+			EnvVars: []string{"FLEETANNOUNCE"},
+			Value:   60,
+		},
+		&cli.BoolFlag{
+			Name:    "profile",
+			Usage:   "Publishes the signed profile of the node (version, OS/arch, capabilities, services) to the ledger",
+			EnvVars: []string{"EDGEVPNPROFILE"},
+			Value:   true,
+		},
+		&cli.StringSliceFlag{
+			Name:    "profile-capability",
+			Usage:   "Capability advertised in the profile of the node, e.g. egress",
+			EnvVars: []string{"EDGEVPNPROFILECAPABILITY"},
+		},
+		&cli.IntFlag{
+			Name:    "profile-announce-time",
+			Usage:   "Profile announce time (s)",
+			EnvVars: []string{"EDGEVPNPROFILEANNOUNCE"},
+			Value:   60,
+		},
+		&cli.IntFlag{
+			Name:    "ledger-reaper-interval",
+			Usage:   "Interval (s) between the scans removing from the ledger the entries of the nodes offline (see aliveness-healthcheck-max-interval), 0 to disable",
+			EnvVars: []string{"EDGEVPNLEDGERREAPERINTERVAL"},
+			Value:   60,
+		},
+		&cli.StringSliceFlag{
+			Name:    "ledger-reaper-pin",
+			Usage:   "Ledger entry (bucket/key) never removed by the reaper, e.g. machines/10.1.0.1",
+			EnvVars: []string{"EDGEVPNLEDGERREAPERPIN"},
+		},
 		&cli.IntFlag{
 			Name:    "dns-cache-size",
 			Usage:   "DNS LRU cache size",
@@ -135,11 +195,31 @@ func MainFlags() []cli.Flag {
 			Usage:   "Sends all packets to this node",
 			EnvVars: []string{"ROUTER"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "advertise-routes",
+			Usage:   "Networks, in CIDR notation, to forward the traffic of the other nodes to. 0.0.0.0/0 makes the node an exit node. Can be specified multiple times",
+			EnvVars: []string{"EDGEVPNADVERTISEROUTES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "accept-routes",
+			Usage:   "Route the networks advertised by the other nodes inside these ones, in CIDR notation, through them. 0.0.0.0/0 accepts all the routes of the --exit-node peers. Can be specified multiple times",
+			EnvVars: []string{"EDGEVPNACCEPTROUTES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "exit-node",
+			Usage:   "Peer ID of a node whose routes are accepted by the default networks of --accept-routes (0.0.0.0/0, ::/0). Can be specified multiple times",
+			EnvVars: []string{"EDGEVPNEXITNODES"},
+		},
 		&cli.StringFlag{
 			Name:    "interface",
 			Usage:   "Interface name",
 			Value:   "edgevpn0",
 			EnvVars: []string{"IFACE"},
+		},
+		&cli.StringFlag{
+			Name:    "networks",
+			Usage:   "YAML file listing the networks to join from this process, each with its own interface. Replaces the config, token, address and interface of the node",
+			EnvVars: []string{"EDGEVPNNETWORKS"},
 		}}, CommonFlags...)
 }
 
@@ -156,15 +236,12 @@ func Main() func(c *cli.Context) error {
 
 			os.Exit(0)
 		}
-		o, vpnOpts, ll := cliToOpts(c)
+		if c.String("networks") != "" {
+			return runNetworks(c)
+		}
 
-		// Egress and DHCP needs the Alive service
-		// DHCP needs alive services enabled to all nodes, also those with a static IP.
-		o = append(o,
-			services.Alive(
-				time.Duration(c.Int("aliveness-healthcheck-interval"))*time.Second,
-				time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
-				time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second)...)
+		o, vpnOpts, ll := cliToOpts(c)
+		o = append(o, nodeServices(c)...)
 
 		if c.Bool("dhcp") {
 			// Adds DHCP server
@@ -172,15 +249,11 @@ func Main() func(c *cli.Context) error {
 			if err != nil {
 				return err
 			}
-			nodeOpts, vO := vpn.DHCP(ll, 15*time.Minute, c.String("lease-dir"), address.String())
+			nodeOpts, vO := vpn.DHCP(ll, 15*time.Minute, store.NewFilesystem(c.String("lease-dir")), address.String())
 			o = append(o, nodeOpts...)
 			vpnOpts = append(vpnOpts, vO...)
 		}
 
-		if c.Bool("egress") {
-			o = append(o, services.Egress(time.Duration(c.Int("egress-announce-time"))*time.Second)...)
-		}
-
 		dns := c.String("dns")
 		if dns != "" {
 			// Adds DNS Server
@@ -216,9 +289,41 @@ func Main() func(c *cli.Context) error {
 		}
 
 		if c.Bool("api") {
+			api.DownloadDir = c.String("api-download-dir")
 			go api.API(ctx, c.String("api-listen"), 5*time.Second, 20*time.Second, e, bwc, c.Bool("debug"))
 		}
-		go handleStopSignals()
+		go handleStopSignals(e)
 		return e.Start(ctx)
 	}
 }
+
+// nodeServices returns the services of the node enabled from the CLI
+func nodeServices(c *cli.Context) []node.Option {
+	// Egress and DHCP needs the Alive service
+	// DHCP needs alive services enabled to all nodes, also those with a static IP.
+	o := services.Alive(
+		time.Duration(c.Int("aliveness-healthcheck-interval"))*time.Second,
+		time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
+		time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second)
+
+	if c.Int("ledger-reaper-interval") > 0 {
+		o = append(o,
+			services.Reap(
+				time.Duration(c.Int("ledger-reaper-interval"))*time.Second,
+				time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second,
+				c.StringSlice("ledger-reaper-pin")...)...)
+	}
+
+	if c.Bool("egress") {
+		o = append(o, services.Egress(time.Duration(c.Int("egress-announce-time"))*time.Second)...)
+	}
+
+	if c.Bool("fleet") {
+		o = append(o, services.Fleet(time.Duration(c.Int("fleet-announce-time"))*time.Second)...)
+	}
+
+	if c.Bool("profile") {
+		o = append(o, services.Profile(time.Duration(c.Int("profile-announce-time"))*time.Second, c.StringSlice("profile-capability")...)...)
+	}
+	return o
+}
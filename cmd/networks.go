@@ -0,0 +1,196 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"github.com/mudler/edgevpn/api"
+	"github.com/mudler/edgevpn/pkg/config"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/store"
+	"github.com/mudler/edgevpn/pkg/vpn"
+	"github.com/urfave/cli/v2"
+)
+
+// runNetworks joins the networks listed in the --networks file. Each network
+// has its own node, ledger and interface, and all of them are served by the
+// same API.
+func runNetworks(c *cli.Context) error {
+	if c.Bool("dhcp") || c.String("dns") != "" {
+		return errors.New("DHCP and DNS are not supported joining several networks")
+	}
+	if err := checkNetworksFlags(c); err != nil {
+		return err
+	}
+
+	networks, err := config.LoadNetworks(c.String("networks"))
+	if err != nil {
+		return err
+	}
+
+	nc, ll := cliConfig(c)
+	bwc := metrics.NewBandwidthCounter()
+	nodes, err := networkNodes(c, nc, ll, networks, func(n config.Network, vpnOpts []vpn.Option) ([]node.Option, error) {
+		o := nodeServices(c)
+		if c.Bool("api") {
+			o = append(o, node.WithLibp2pAdditionalOptions(libp2p.BandwidthReporter(bwc)))
+		}
+		opts, err := vpn.Register(vpnOpts...)
+		return append(o, opts...), err
+	})
+	if err != nil {
+		return err
+	}
+
+	displayStart(ll)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if c.Bool("transient-conn") {
+		ctx = network.WithAllowLimitedConn(ctx, "accept")
+	}
+
+	if c.Bool("api") {
+		api.DownloadDir = c.String("api-download-dir")
+		go api.NetworksAPI(ctx, c.String("api-listen"), 5*time.Second, 20*time.Second, nodes, bwc, c.Bool("debug"))
+	}
+
+	all := []*node.Node{}
+	for _, e := range nodes {
+		all = append(all, e)
+	}
+	go handleStopSignals(all...)
+
+	// The nodes run until one of them stops
+	errs := make(chan error, len(nodes))
+	for name, e := range nodes {
+		go func(name string, e *node.Node) {
+			if err := e.Start(ctx); err != nil {
+				errs <- fmt.Errorf("network '%s': %w", name, err)
+				return
+			}
+			errs <- nil
+		}(name, e)
+	}
+	return <-errs
+}
+
+// checkNetworksFlags refuses the flags which are set per network in the networks file
+func checkNetworksFlags(c *cli.Context) error {
+	// Each network has its own admins and routes
+	for _, f := range []string{"acl-admin", "acl-policy", "firewall-deny-by-default", "advertise-routes", "accept-routes", "exit-node"} {
+		if c.IsSet(f) {
+			return fmt.Errorf("--%s is set per network in the networks file joining several networks", f)
+		}
+	}
+	return nil
+}
+
+// connectNetworks binds to a service looked up in all the networks listed in
+// the --networks file, each joined by its own node
+func connectNetworks(c *cli.Context, name, address string) error {
+	if err := checkNetworksFlags(c); err != nil {
+		return err
+	}
+	networks, err := config.LoadNetworks(c.String("networks"))
+	if err != nil {
+		return err
+	}
+
+	nc, ll := cliConfig(c)
+	nodes, err := networkNodes(c, nc, ll, networks, func(config.Network, []vpn.Option) ([]node.Option, error) {
+		// Needed to unblock connections with low activity
+		return services.Alive(
+			time.Duration(c.Int("aliveness-healthcheck-interval"))*time.Second,
+			time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
+			time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	displayStart(ll)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	all := []*node.Node{}
+	joined := []services.Network{}
+	for _, n := range networks {
+		e := nodes[n.Name]
+		if err := e.Start(ctx); err != nil {
+			return fmt.Errorf("network '%s': %w", n.Name, err)
+		}
+		ledger, err := e.Ledger()
+		if err != nil {
+			return fmt.Errorf("network '%s': %w", n.Name, err)
+		}
+		all = append(all, e)
+		joined = append(joined, services.Network{Name: n.Name, Ledger: ledger, Node: e})
+	}
+	go handleStopSignals(all...)
+
+	return services.ConnectNetworks(ctx, time.Duration(c.Int("ledger-announce-interval"))*time.Second, name, address, joined, cliServiceOptions(c)...)
+}
+
+// networkNodes returns the nodes joining the networks, by network name. Each
+// node gets the options of its network, followed by the ones returned by opts.
+// The nodes don't share a libp2p host: the host carries the identity of the
+// node, gates the connections with the PeerGuardian, blacklist and private
+// network handshake of its network, and serves the fixed protocol IDs of the
+// ledger, VPN and services, so a connection admitted by one network would
+// carry the streams of the others.
+func networkNodes(c *cli.Context, nc *config.Config, ll *logger.Logger, networks []config.Network, opts func(config.Network, []vpn.Option) ([]node.Option, error)) (map[string]*node.Node, error) {
+	nodes := map[string]*node.Node{}
+	for _, n := range networks {
+		netConfig := nc.ForNetwork(n)
+		// A peer in more of the networks would see the same ID from
+		// different hosts, so each network has its own identity
+		if c.Bool("privkey-cache") {
+			privkey, err := node.CachedPrivKey(store.NewFilesystem(filepath.Join(c.String("privkey-cache-dir"), n.Name)))
+			if err != nil {
+				return nil, err
+			}
+			netConfig.Privkey = privkey
+		}
+
+		o, vpnOpts, err := netConfig.ToOpts(ll)
+		if err != nil {
+			return nil, fmt.Errorf("network '%s': %w", n.Name, err)
+		}
+		extra, err := opts(n, vpnOpts)
+		if err != nil {
+			return nil, fmt.Errorf("network '%s': %w", n.Name, err)
+		}
+
+		e, err := node.New(append(o, extra...)...)
+		if err != nil {
+			return nil, fmt.Errorf("network '%s': %w", n.Name, err)
+		}
+		nodes[n.Name] = e
+	}
+	return nodes, nil
+}
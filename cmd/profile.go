@@ -0,0 +1,92 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/urfave/cli/v2"
+)
+
+func Profile() *cli.Command {
+	return &cli.Command{
+		Name:  "profile",
+		Usage: "Prints the profile published by a peer",
+		Description: `Joins the network and prints the signed profile (version, OS/arch, capabilities and services) the peer published to the ledger.
+Without a peer ID, prints the profiles of all the peers. Profiles whose signature doesn't verify are ignored.`,
+		UsageText: "edgevpn profile [peer-id]",
+		Flags: append(CommonFlags,
+			&cli.IntFlag{
+				Name:  "wait",
+				Usage: `Seconds to wait for the profile to show up in the ledger`,
+				Value: 60,
+			},
+		),
+		Action: func(c *cli.Context) error {
+			id := c.Args().Get(0)
+			if id != "" {
+				if _, err := peer.Decode(id); err != nil {
+					return fmt.Errorf("a valid peer ID needs to be provided: %w", err)
+				}
+			}
+			o, _, ll := cliToOpts(c)
+
+			e, err := node.New(o...)
+			if err != nil {
+				return err
+			}
+			displayStart(ll)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Int("wait"))*time.Second)
+			defer cancel()
+			if err := e.Start(ctx); err != nil {
+				return err
+			}
+			ledger, err := e.Ledger()
+			if err != nil {
+				return err
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			for {
+				if id == "" {
+					if list := services.Profiles(ledger); len(list) > 0 {
+						return enc.Encode(list)
+					}
+					err = fmt.Errorf("no profile published")
+				} else {
+					var p types.Profile
+					if p, err = services.PeerProfile(ledger, id); err == nil {
+						return enc.Encode(p)
+					}
+				}
+				ll.Debugf("waiting for the profiles: %s", err.Error())
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(5 * time.Second):
+				}
+			}
+		},
+	}
+}
@@ -72,7 +72,7 @@ func Proxy() *cli.Command {
 
 			displayStart(ll)
 
-			go handleStopSignals()
+			go handleStopSignals(e)
 
 			ctx := context.Background()
 			// Start the node to the network, using our ledger
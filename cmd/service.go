@@ -16,10 +16,13 @@ package cmd
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
 	"github.com/urfave/cli/v2"
 )
 
@@ -43,6 +46,64 @@ func cliNameAddress(c *cli.Context) (name, address string, err error) {
 	return name, address, nil
 }
 
+// serviceTimeoutFlags set the timeouts of the connections proxied to a service
+var serviceTimeoutFlags = []cli.Flag{
+	&cli.DurationFlag{
+		Name:  "read-timeout",
+		Usage: `Close a connection waiting for data for longer than this, with no data flowing the other way either (e.g. '30s', 0 to disable)`,
+	},
+	&cli.DurationFlag{
+		Name:  "write-timeout",
+		Usage: `Close a connection whose ends don't take data for longer than this (e.g. '10s', 0 to disable)`,
+	},
+	&cli.DurationFlag{
+		Name:  "idle-timeout",
+		Usage: `Close a connection with no data flowing either way for longer than this (e.g. '5m', 0 to disable)`,
+	},
+}
+
+func cliServiceOptions(c *cli.Context) (opts []services.ServiceOption) {
+	timeouts := types.ServiceTimeouts{
+		Read:  c.Duration("read-timeout"),
+		Write: c.Duration("write-timeout"),
+		Idle:  c.Duration("idle-timeout"),
+	}
+	if timeouts != (types.ServiceTimeouts{}) {
+		opts = append(opts, services.WithTimeouts(timeouts))
+	}
+	if c.Bool("compress") {
+		opts = append(opts, services.Compression)
+	}
+	if c.Bool("udp") {
+		opts = append(opts, services.UDP)
+	}
+	if c.String("network") != "" {
+		opts = append(opts, services.WithNetwork(c.String("network")))
+	}
+	if c.String("ambiguous") != "" {
+		opts = append(opts, services.WithAmbiguityPolicy(c.String("ambiguous")))
+	}
+
+	conditions := []func() bool{}
+	if c.String("condition-file") != "" {
+		conditions = append(conditions, services.FileCondition(c.String("condition-file")))
+	}
+	if c.String("condition-url") != "" {
+		conditions = append(conditions, services.HTTPCondition(c.String("condition-url"), 5*time.Second))
+	}
+	if len(conditions) > 0 {
+		opts = append(opts, services.WithCondition(func() bool {
+			for _, f := range conditions {
+				if !f() {
+					return false
+				}
+			}
+			return true
+		}))
+	}
+	return
+}
+
 func ServiceAdd() *cli.Command {
 	return &cli.Command{
 		Name:    "service-add",
@@ -51,7 +112,7 @@ func ServiceAdd() *cli.Command {
 		Description: `Expose a local or a remote endpoint connection as a service in the VPN. 
 		The host will act as a proxy between the service and the connection`,
 		UsageText: "edgevpn service-add unique-id ip:port",
-		Flags: append(CommonFlags,
+		Flags: append(append(CommonFlags, serviceTimeoutFlags...),
 			&cli.StringFlag{
 				Name:  "name",
 				Usage: `Unique name of the service to be server over the network.`,
@@ -61,6 +122,26 @@ func ServiceAdd() *cli.Command {
 				Usage: `Remote address that the service is running to. That can be a remote webserver, a local SSH server, etc.
 For example, '192.168.1.1:80', or '127.0.0.1:22'.`,
 			},
+			&cli.BoolFlag{
+				Name:  "compress",
+				Usage: `Compress the service traffic with the peers which enable it too. Useful for services which compress well (e.g. logs)`,
+			},
+			&cli.BoolFlag{
+				Name:  "udp",
+				Usage: `Forward the UDP datagrams of the service (e.g. DNS, WireGuard or game servers) instead of TCP connections`,
+			},
+			&cli.StringFlag{
+				Name:  "condition-file",
+				Usage: `Expose the service only while the file exists (e.g. a leader lock written by another process)`,
+			},
+			&cli.StringFlag{
+				Name:  "condition-url",
+				Usage: `Expose the service only while a GET to the URL replies with a 2xx status (e.g. a health endpoint)`,
+			},
+			&cli.StringSliceFlag{
+				Name:  "query-allow",
+				Usage: `Peer IDs allowed to ask this node which services it exposes (see service-query). By default, any peer of the network`,
+			},
 		),
 		Action: func(c *cli.Context) error {
 			name, address, err := cliNameAddress(c)
@@ -76,7 +157,8 @@ For example, '192.168.1.1:80', or '127.0.0.1:22'.`,
 					time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
 					time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second)...)
 
-			o = append(o, services.RegisterService(ll, time.Duration(c.Int("ledger-announce-interval"))*time.Second, name, address)...)
+			o = append(o, services.RegisterService(ll, time.Duration(c.Int("ledger-announce-interval"))*time.Second, name, address, cliServiceOptions(c)...)...)
+			o = append(o, services.ServiceQuery(c.StringSlice("query-allow")...)...)
 
 			e, err := node.New(o...)
 			if err != nil {
@@ -84,13 +166,30 @@ For example, '192.168.1.1:80', or '127.0.0.1:22'.`,
 			}
 
 			displayStart(ll)
-			go handleStopSignals()
 
 			// Join the node to the network, using our ledger
 			if err := e.Start(context.Background()); err != nil {
 				return err
 			}
 
+			ledger, err := e.Ledger()
+			if err != nil {
+				return err
+			}
+
+			// Retract the service on shutdown, so peers don't keep connecting to it
+			e.OnShutdown("retract", func(ctx context.Context) error {
+				ll.Infof("Retracting service '%s'", name)
+				services.RetractServices(ctx, ledger, e.Host().ID().String(), time.Second, 10*time.Second, name)
+				// Leave the time to broadcast the removal
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+				}
+				return nil
+			})
+			go handleStopSignals(e)
+
 			for {
 				time.Sleep(2 * time.Second)
 			}
@@ -107,7 +206,7 @@ func ServiceConnect() *cli.Command {
 Creates a local listener which connects over the service in the network without creating a VPN.
 `,
 		UsageText: "edgevpn service-connect unique-id (ip):port",
-		Flags: append(CommonFlags,
+		Flags: append(append(CommonFlags, serviceTimeoutFlags...),
 			&cli.StringFlag{
 				Name:  "name",
 				Usage: `Unique name of the service in the network.`,
@@ -117,12 +216,37 @@ Creates a local listener which connects over the service in the network without
 				Usage: `Address where to bind locally. E.g. ':8080'. A proxy will be created
 to the service over the network`,
 			},
+			&cli.BoolFlag{
+				Name:  "compress",
+				Usage: `Compress the service traffic, if the service enables it too`,
+			},
+			&cli.BoolFlag{
+				Name:  "udp",
+				Usage: `Bind a UDP port, for services exposed with --udp`,
+			},
+			&cli.StringFlag{
+				Name:  "network",
+				Usage: `Look up the service only in the network with this name (see --network-name, or the names of the --networks)`,
+			},
+			&cli.StringFlag{
+				Name:  "ambiguous",
+				Usage: `How to resolve a service announced on more than one of the --networks: 'error' or 'first'`,
+				Value: services.AmbiguousError,
+			},
+			&cli.StringFlag{
+				Name:    "networks",
+				Usage:   `YAML file listing the networks to look up the service in, each joined by its own node (see the networks of the main command)`,
+				EnvVars: []string{"EDGEVPNNETWORKS"},
+			},
 		),
 		Action: func(c *cli.Context) error {
 			name, address, err := cliNameAddress(c)
 			if err != nil {
 				return err
 			}
+			if c.String("networks") != "" {
+				return connectNetworks(c, name, address)
+			}
 			o, _, ll := cliToOpts(c)
 
 			// Needed to unblock connections with low activity
@@ -139,6 +263,7 @@ to the service over the network`,
 							time.Duration(c.Int("ledger-announce-interval"))*time.Second,
 							name,
 							address,
+							cliServiceOptions(c)...,
 						),
 					),
 				)...,
@@ -147,10 +272,68 @@ to the service over the network`,
 				return err
 			}
 			displayStart(ll)
-			go handleStopSignals()
+			go handleStopSignals(e)
 
 			// starts the node
 			return e.Start(context.Background())
 		},
 	}
 }
+
+func ServiceQuery() *cli.Command {
+	return &cli.Command{
+		Name:    "service-query",
+		Aliases: []string{"sq"},
+		Usage:   "Asks a peer which services it exposes",
+		Description: `Connects to the peer and prints the services it currently exposes, as reported by the peer itself.
+Useful to check the services announced in the ledger against the ones actually exposed.`,
+		UsageText: "edgevpn service-query peer-id",
+		Flags: append(CommonFlags,
+			&cli.IntFlag{
+				Name:  "wait",
+				Usage: `Seconds to wait for the peer to be reachable`,
+				Value: 60,
+			},
+		),
+		Action: func(c *cli.Context) error {
+			p, err := peer.Decode(c.Args().Get(0))
+			if err != nil {
+				return fmt.Errorf("a valid peer ID needs to be provided: %w", err)
+			}
+			o, _, ll := cliToOpts(c)
+			o = append(o,
+				services.Alive(
+					time.Duration(c.Int("aliveness-healthcheck-interval"))*time.Second,
+					time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
+					time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second)...)
+
+			e, err := node.New(o...)
+			if err != nil {
+				return err
+			}
+			displayStart(ll)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.Int("wait"))*time.Second)
+			defer cancel()
+			if err := e.Start(ctx); err != nil {
+				return err
+			}
+
+			for {
+				list, err := services.QueryServices(ctx, e.Host(), p)
+				if err == nil {
+					for _, s := range list {
+						fmt.Printf("%s\texposed: %t\ttimeouts: read %s, write %s, idle %s\n", s.Name, s.Exposed, s.Timeouts.Read, s.Timeouts.Write, s.Timeouts.Idle)
+					}
+					return nil
+				}
+				ll.Debugf("query to %s failed, retrying: %s", p.String(), err.Error())
+				select {
+				case <-ctx.Done():
+					return fmt.Errorf("could not query %s: %w", p.String(), err)
+				case <-time.After(5 * time.Second):
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mudler/edgevpn/api/client"
+	"github.com/mudler/edgevpn/api/client/statusline"
+	"github.com/urfave/cli/v2"
+)
+
+func Status() *cli.Command {
+	return &cli.Command{
+		Name:  "status",
+		Usage: "Shows the status of a running node",
+		Description: `Queries the API of a running node (see --api and the api command) and prints its peers, discovery state, VPN throughput, ledger size and recent events.
+With --watch, the status is refreshed in place until interrupted. When the output is not a terminal, each refresh is printed after the previous one.`,
+		UsageText: "edgevpn status [--watch]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "api-address",
+				Usage:   "Address of the node API (host:port, http://host:port or unix://path)",
+				EnvVars: []string{"APILISTEN"},
+				Value:   "127.0.0.1:8080",
+			},
+			&cli.StringFlag{
+				Name:  "network",
+				Usage: "Network to query, on the nodes joining several networks (see --networks)",
+			},
+			&cli.BoolFlag{
+				Name:  "watch",
+				Usage: "Refresh the status until interrupted",
+			},
+			&cli.DurationFlag{
+				Name:  "interval",
+				Usage: "Refresh interval with --watch",
+				Value: 2 * time.Second,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			host := c.String("api-address")
+			if !strings.Contains(host, "://") {
+				host = "http://" + host
+			}
+			cl := client.NewClient(client.WithHost(host), client.WithNetwork(c.String("network")))
+
+			if !c.Bool("watch") {
+				s, err := statusline.Collect(cl)
+				if err != nil {
+					return err
+				}
+				statusline.Render(os.Stdout, nil, s, statusline.DefaultEvents)
+				return nil
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return statusline.Watch(ctx, cl, os.Stdout, c.Duration("interval"), isTerminal(os.Stdout))
+		},
+	}
+}
+
+// isTerminal returns true if the file is a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
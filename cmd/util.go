@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"os/signal"
@@ -26,15 +27,17 @@ import (
 	"time"
 
 	"github.com/ipfs/go-log"
-	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/mudler/edgevpn/internal"
 	"github.com/mudler/edgevpn/pkg/config"
+	"github.com/mudler/edgevpn/pkg/discovery"
 	"github.com/multiformats/go-multiaddr"
 
 	"github.com/mudler/edgevpn/pkg/logger"
 	node "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/store"
+	"github.com/mudler/edgevpn/pkg/utils"
 	"github.com/mudler/edgevpn/pkg/vpn"
 	"github.com/urfave/cli/v2"
 )
@@ -75,12 +78,256 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		EnvVars: []string{"EDGEVPNCHANNELBUFFERSIZE"},
 		Value:   0,
 	},
+	&cli.StringFlag{
+		Name:    "backpressure-timeout",
+		Usage:   "How long to hold back reading from the interface while the peers are congested, before dropping packets",
+		EnvVars: []string{"EDGEVPNBACKPRESSURETIMEOUT"},
+		Value:   "1s",
+	},
+	&cli.IntFlag{
+		Name:    "batch-size",
+		Usage:   "Maximum number of frames queued for the same peer sent in one batch. 1 sends them one at a time",
+		EnvVars: []string{"EDGEVPNBATCHSIZE"},
+		Value:   64,
+	},
+	&cli.StringFlag{
+		Name:    "compression",
+		Usage:   "Compress the batches of frames sent to the peers supporting it (none, s2, zstd)",
+		EnvVars: []string{"EDGEVPNCOMPRESSION"},
+		Value:   "none",
+	},
+	&cli.BoolFlag{
+		Name:    "offload",
+		Usage:   "Enable the checksum and TCP segmentation offloads of the interface, reading up to 64KiB of a TCP flow per read (Linux only)",
+		EnvVars: []string{"EDGEVPNOFFLOAD"},
+	},
+	&cli.StringFlag{
+		Name:    "stream-reopen-interval",
+		Usage:   "Initial backoff interval before reopening a failed VPN stream to a peer",
+		EnvVars: []string{"EDGEVPNSTREAMREOPENINTERVAL"},
+		Value:   "1s",
+	},
+	&cli.StringFlag{
+		Name:    "stream-reopen-max-interval",
+		Usage:   "Max backoff interval before reopening a failed VPN stream to a peer",
+		EnvVars: []string{"EDGEVPNSTREAMREOPENMAXINTERVAL"},
+		Value:   "30s",
+	},
+	&cli.IntFlag{
+		Name:    "stream-reopen-max-attempts",
+		Usage:   "Consecutive failures opening a VPN stream before dropping the peer route (0 for unlimited)",
+		EnvVars: []string{"EDGEVPNSTREAMREOPENMAXATTEMPTS"},
+		Value:   10,
+	},
+	&cli.IntFlag{
+		Name:    "write-retries",
+		Usage:   "Times a transient error writing a packet to the interface is retried",
+		EnvVars: []string{"EDGEVPNWRITERETRIES"},
+		Value:   3,
+	},
+	&cli.StringFlag{
+		Name:    "write-retry-interval",
+		Usage:   "Interval between the attempts of writing a packet to the interface",
+		EnvVars: []string{"EDGEVPNWRITERETRYINTERVAL"},
+		Value:   "10ms",
+	},
+	&cli.IntFlag{
+		Name:    "write-max-failures",
+		Usage:   "Packets in a row failing to be written after which the interface is marked down, until a packet is written again (0 to never mark it down)",
+		EnvVars: []string{"EDGEVPNWRITEMAXFAILURES"},
+		Value:   100,
+	},
+	&cli.StringSliceFlag{
+		Name:    "acl-admin",
+		Usage:   "Peer ID trusted to sign the ledger write permissions policy. Enables the write permissions",
+		EnvVars: []string{"EDGEVPNACLADMINS"},
+	},
+	&cli.StringFlag{
+		Name:    "acl-policy",
+		Usage:   "YAML file with the ledger write permissions policy to sign and announce (admins only)",
+		EnvVars: []string{"EDGEVPNACLPOLICY"},
+	},
+	&cli.BoolFlag{
+		Name:    "firewall-deny-by-default",
+		Usage:   "Drop the VPN packets matching no firewall rule signed by the ACL admins (see the firewall command)",
+		EnvVars: []string{"EDGEVPNFIREWALLDENYBYDEFAULT"},
+	},
+	&cli.StringFlag{
+		Name:    "flow-log-collector",
+		Usage:   "Ship VPN and service flow logs as JSON lines to the collector (udp://host:port, tcp://host:port, http(s)://url or file:///path)",
+		EnvVars: []string{"EDGEVPNFLOWLOGCOLLECTOR"},
+	},
+	&cli.IntFlag{
+		Name:    "flow-log-rate-limit",
+		Usage:   "Max flow logs shipped per second, the exceeding ones are dropped (0 for unlimited)",
+		EnvVars: []string{"EDGEVPNFLOWLOGRATELIMIT"},
+		Value:   100,
+	},
+	&cli.IntFlag{
+		Name:    "flow-log-max-size",
+		Usage:   "Megabytes a flow log file can reach before it is rotated (0 for no limit)",
+		EnvVars: []string{"EDGEVPNFLOWLOGMAXSIZE"},
+		Value:   100,
+	},
+	&cli.IntFlag{
+		Name:    "flow-log-max-age",
+		Usage:   "Hours a flow log file is written to before it is rotated (0 for no limit)",
+		EnvVars: []string{"EDGEVPNFLOWLOGMAXAGE"},
+	},
+	&cli.IntFlag{
+		Name:    "flow-log-max-files",
+		Usage:   "Number of rotated flow log files retained",
+		EnvVars: []string{"EDGEVPNFLOWLOGMAXFILES"},
+		Value:   5,
+	},
+	&cli.StringFlag{
+		Name:    "events-broker",
+		Usage:   "Publish the node events (peer connections, discovery cycles, ledger changes) to the broker (mqtt://[user:password@]host:port/topic-prefix)",
+		EnvVars: []string{"EDGEVPNEVENTSBROKER"},
+	},
+	&cli.BoolFlag{
+		Name:    "quarantine",
+		Usage:   "Disconnect and block for a cooldown the peers which keep sending malformed data",
+		EnvVars: []string{"EDGEVPNQUARANTINE"},
+	},
+	&cli.IntFlag{
+		Name:    "quarantine-threshold",
+		Usage:   "Protocol violations within the quarantine window which trigger the quarantine of a peer",
+		EnvVars: []string{"EDGEVPNQUARANTINETHRESHOLD"},
+		Value:   10,
+	},
+	&cli.StringFlag{
+		Name:    "quarantine-window",
+		Usage:   "Time window in which protocol violations are counted",
+		EnvVars: []string{"EDGEVPNQUARANTINEWINDOW"},
+		Value:   "1m",
+	},
+	&cli.StringFlag{
+		Name:    "quarantine-cooldown",
+		Usage:   "Time a peer stays in quarantine",
+		EnvVars: []string{"EDGEVPNQUARANTINECOOLDOWN"},
+		Value:   "10m",
+	},
 	&cli.IntFlag{
 		Name:    "discovery-interval",
 		Usage:   "DHT discovery interval time",
 		EnvVars: []string{"EDGEVPNDHTINTERVAL"},
 		Value:   720,
 	},
+	&cli.IntFlag{
+		Name:    "discovery-min-interval",
+		Usage:   "Enables the adaptive DHT discovery interval, which shrinks down to N seconds when peers churn and grows up to the discovery interval when stable (0 to disable)",
+		EnvVars: []string{"EDGEVPNDHTMININTERVAL"},
+	},
+	&cli.IntFlag{
+		Name:    "discovery-max-peers",
+		Usage:   "Max peers to connect to for each DHT discovery cycle, picked randomly (0 for unlimited)",
+		EnvVars: []string{"EDGEVPNDHTMAXPEERS"},
+	},
+	&cli.IntFlag{
+		Name:    "discovery-max-connections",
+		Usage:   "Max new connections to establish on each DHT discovery cycle (0 for unlimited)",
+		EnvVars: []string{"EDGEVPNDHTMAXCONNECTIONS"},
+	},
+	&cli.IntFlag{
+		Name:    "discovery-dial-concurrency",
+		Usage:   "Max peers dialed at once by the DHT discovery (0 dials the discovered peers one at a time)",
+		EnvVars: []string{"EDGEVPNDHTDIALCONCURRENCY"},
+	},
+	&cli.IntFlag{
+		Name:    "discovery-local-peers",
+		Usage:   "Slow down the DHT discovery while at least this many peers found with mDNS are connected (0 to disable)",
+		EnvVars: []string{"EDGEVPNDISCOVERYLOCALPEERS"},
+	},
+	&cli.IntFlag{
+		Name:    "discovery-local-scale",
+		Usage:   "Factor the DHT discovery interval is stretched by while enough local peers are connected",
+		Value:   discovery.DefaultLocalScaleFactor,
+		EnvVars: []string{"EDGEVPNDISCOVERYLOCALSCALE"},
+	},
+	&cli.StringFlag{
+		Name:    "discovery-protocol-prefix",
+		Usage:   "Run a private DHT with this protocol prefix (e.g. /mynetwork) instead of joining the public IPFS one. Requires explicit bootstrap peers",
+		EnvVars: []string{"EDGEVPNDHTPROTOCOLPREFIX"},
+	},
+	&cli.BoolFlag{
+		Name:    "private-network",
+		Usage:   "Run a private DHT with a protocol prefix derived from the token, and refuse the peers not proving the knowledge of the current OTP rendezvous. Requires explicit bootstrap peers",
+		EnvVars: []string{"EDGEVPNPRIVATENETWORK"},
+	},
+	&cli.StringFlag{
+		Name:    "discovery-dht-mode",
+		Usage:   "Mode of the DHT: auto (server while publicly reachable, client otherwise), server or client",
+		EnvVars: []string{"EDGEVPNDHTMODE"},
+		Value:   "auto",
+	},
+	&cli.Int64Flag{
+		Name:    "discovery-bandwidth-budget",
+		Usage:   "Max bytes sent and received by the DHT within the bandwidth window, over which the discovery is skipped (0 for unlimited)",
+		EnvVars: []string{"EDGEVPNDHTBANDWIDTHBUDGET"},
+	},
+	&cli.IntFlag{
+		Name:    "discovery-bandwidth-window",
+		Usage:   "Window of the DHT bandwidth budget, in seconds",
+		Value:   int(discovery.DefaultBandwidthWindow.Seconds()),
+		EnvVars: []string{"EDGEVPNDHTBANDWIDTHWINDOW"},
+	},
+	&cli.IntFlag{
+		Name:    "discovery-diagnose-after",
+		Usage:   "Warn that the OTP parameters may be misconfigured after this many DHT discovery rounds in a row finding no peer, while the DHT is healthy (0 to disable)",
+		EnvVars: []string{"EDGEVPNDHTDIAGNOSEAFTER"},
+		Value:   10,
+	},
+	&cli.IntFlag{
+		Name:    "discovery-otp-window-tolerance",
+		Usage:   "Also announce and search on the rendezvous of this many OTP intervals before and after the current one, for nodes without a synchronized clock",
+		EnvVars: []string{"EDGEVPNDHTOTPWINDOWTOLERANCE"},
+	},
+	&cli.StringFlag{
+		Name:    "insecure-fixed-rendezvous",
+		Usage:   "INSECURE, for tests only: meet the other nodes on this fixed rendezvous instead of the OTP one",
+		EnvVars: []string{"EDGEVPNINSECUREFIXEDRENDEZVOUS"},
+		Hidden:  true,
+	},
+	&cli.IntFlag{
+		Name:    "discovery-canary-timeout",
+		Usage:   "Wait up to N seconds to find a peer on the DHT before announcing (0 to disable)",
+		EnvVars: []string{"EDGEVPNDHTCANARYTIMEOUT"},
+	},
+	&cli.IntFlag{
+		Name:    "discovery-dial-backoff",
+		Usage:   "Skip peers failing to dial for N seconds, doubling on each failure, when the libp2p dial backoff can't be queried",
+		EnvVars: []string{"EDGEVPNDHTDIALBACKOFF"},
+		Value:   60,
+	},
+	&cli.IntFlag{
+		Name:    "discovery-max-queries",
+		Usage:   "Max concurrent peer searches on the DHT, excess ones are queued. 0 means no limit",
+		EnvVars: []string{"EDGEVPNDHTMAXQUERIES"},
+		Value:   4,
+	},
+	&cli.StringFlag{
+		Name:    "discovery-bootstrap-policy",
+		Usage:   "What to do when no bootstrap peer is reachable: log a warning (warn), retry with backoff up to the timeout (retry), dial the peers of the fallback URL and the rendezvous servers (fallback), or refuse to start after the timeout (fail)",
+		EnvVars: []string{"EDGEVPNBOOTSTRAPPOLICY"},
+		Value:   "warn",
+	},
+	&cli.IntFlag{
+		Name:    "discovery-bootstrap-timeout",
+		Usage:   "Seconds to retry the bootstrap peers for, with the retry and fail policies. 0 retries indefinitely with retry",
+		EnvVars: []string{"EDGEVPNBOOTSTRAPTIMEOUT"},
+		Value:   60,
+	},
+	&cli.StringFlag{
+		Name:    "discovery-bootstrap-fallback-url",
+		Usage:   "URL listing fallback bootstrap peers, one multiaddress per line, for the fallback policy",
+		EnvVars: []string{"EDGEVPNBOOTSTRAPFALLBACKURL"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "discovery-bootstrap-dns",
+		Usage:   "Domain whose dnsaddr TXT records list bootstrap peers, resolved again on every discovery cycle. Can be specified multiple times",
+		EnvVars: []string{"EDGEVPNBOOTSTRAPDNS"},
+	},
 	&cli.IntFlag{
 		Name:    "ledger-announce-interval",
 		Usage:   "Ledger announce interval time",
@@ -139,6 +386,42 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		Usage:   "Specify a ledger state directory",
 		EnvVars: []string{"EDGEVPNLEDGERSTATE"},
 	},
+	&cli.StringSliceFlag{
+		Name:    "ledger-history",
+		Usage:   "Retain the last versions of the keys of a bucket, in the form bucket=depth (e.g. dns=10)",
+		EnvVars: []string{"EDGEVPNLEDGERHISTORY"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "ledger-scope",
+		Usage:   "Gossip a bucket only among the nodes scoping it the same way, in the form bucket=scope (e.g. jobs=workers). Can be specified multiple times",
+		EnvVars: []string{"EDGEVPNLEDGERSCOPES"},
+	},
+	&cli.IntFlag{
+		Name:    "shutdown-timeout",
+		Usage:   "Seconds the node has to shut down, shared among the shutdown phases",
+		EnvVars: []string{"EDGEVPNSHUTDOWNTIMEOUT"},
+		Value:   30,
+	},
+	&cli.StringSliceFlag{
+		Name:    "shutdown-phase-timeout",
+		Usage:   "Override the seconds of a shutdown phase, in the form phase=seconds (e.g. services=10)",
+		EnvVars: []string{"EDGEVPNSHUTDOWNPHASETIMEOUT"},
+	},
+	&cli.IntFlag{
+		Name:    "ledger-batch-window",
+		Usage:   "Milliseconds to coalesce the ledger updates into a single message. 0 sends each update right away",
+		EnvVars: []string{"EDGEVPNLEDGERBATCHWINDOW"},
+	},
+	&cli.IntFlag{
+		Name:    "ledger-compression-level",
+		Usage:   "Gzip level of the ledger messages, from -2 (huffman only) to 9 (best compression). 0 uses the default level",
+		EnvVars: []string{"EDGEVPNLEDGERCOMPRESSIONLEVEL"},
+	},
+	&cli.BoolFlag{
+		Name:    "ledger-clear-keys",
+		Usage:   "Encrypt only the values of the ledger, leaving buckets and keys in cleartext. All the nodes must agree on it",
+		EnvVars: []string{"EDGEVPNLEDGERCLEARKEYS"},
+	},
 	&cli.BoolFlag{
 		Name:    "mdns",
 		Usage:   "Enable mDNS for peer discovery",
@@ -156,6 +439,41 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		Usage: "Number of concurrent requests to serve",
 		Value: runtime.NumCPU(),
 	},
+	&cli.StringSliceFlag{
+		Name:    "uplink",
+		Usage:   "Local source address to distribute the outbound connections across, in the form address=weight (e.g. 192.168.1.10=3). Can be specified multiple times",
+		EnvVars: []string{"EDGEVPNUPLINKS"},
+	},
+	&cli.StringFlag{
+		Name:    "source-ports",
+		Usage:   "Local port range the outbound TCP connections originate from, in the form min-max (e.g. 40000-40100), for egress firewall rules",
+		EnvVars: []string{"EDGEVPNSOURCEPORTS"},
+	},
+	&cli.StringFlag{
+		Name:    "tor-proxy",
+		Usage:   "SOCKS address of a Tor daemon to dial the onion addresses through (e.g. 127.0.0.1:9050)",
+		EnvVars: []string{"EDGEVPNTORPROXY"},
+	},
+	&cli.BoolFlag{
+		Name:    "tor-only",
+		Usage:   "Dial all the connections through the Tor proxy, disabling the transports and the local discovery which can't go through it",
+		EnvVars: []string{"EDGEVPNTORONLY"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "onion-address",
+		Usage:   "Onion address of a hidden service forwarding to the node, to announce, in the form /onion3/<service id>:<port>. The node listens on 127.0.0.1 on the same port. Can be specified multiple times",
+		EnvVars: []string{"EDGEVPNONIONADDRESSES"},
+	},
+	&cli.StringSliceFlag{
+		Name:    "pin",
+		Usage:   "Pin the public key a peer must present to connect, in the form <peer ID>=<base64 public key>. Can be specified multiple times",
+		EnvVars: []string{"EDGEVPNPINS"},
+	},
+	&cli.IntFlag{
+		Name:    "max-inbound-per-ip",
+		Usage:   "Maximum concurrent inbound connections from each remote IP, refused before the handshake. 0 means no limit",
+		EnvVars: []string{"EDGEVPNMAXINBOUNDPERIP"},
+	},
 	&cli.BoolFlag{
 		Name:    "holepunch",
 		Usage:   "Automatically try holepunching when possible",
@@ -186,6 +504,12 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		EnvVars: []string{"EDGEVPNLOWPROFILE"},
 		Value:   true,
 	},
+	&cli.BoolFlag{
+		Name:    "safe-mode-detection",
+		Usage:   "Stop forwarding VPN traffic when a misconfiguration is detected (network conflicts, duplicate addresses)",
+		EnvVars: []string{"EDGEVPNSAFEMODEDETECTION"},
+		Value:   true,
+	},
 	&cli.IntFlag{
 		Name:    "aliveness-healthcheck-interval",
 		Usage:   "Healthcheck interval",
@@ -221,6 +545,61 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		Usage:   "List of discovery peers to use",
 		EnvVars: []string{"EDGEVPNBOOTSTRAPPEERS"},
 	},
+	&cli.StringSliceFlag{
+		Name:    "discovery-rendezvous-servers",
+		Usage:   "List of rendezvous servers (multiaddresses with the peer ID) to search peers on when none is found on the DHT",
+		EnvVars: []string{"EDGEVPNRENDEZVOUSSERVERS"},
+	},
+	&cli.BoolFlag{
+		Name:    "rendezvous-server",
+		Usage:   "Serve as rendezvous server for the other nodes (see --discovery-rendezvous-servers)",
+		EnvVars: []string{"EDGEVPNRENDEZVOUSSERVER"},
+	},
+	&cli.BoolFlag{
+		Name:    "peer-cache",
+		Usage:   "Persist the peers met in the ledger state directory, and dial them on start while the DHT bootstraps",
+		EnvVars: []string{"EDGEVPNPEERCACHE"},
+		Value:   true,
+	},
+	&cli.BoolFlag{
+		Name:    "peer-exchange",
+		Usage:   "Share the connected peers with the other nodes, and dial the ones they share, to speed up discovery",
+		EnvVars: []string{"EDGEVPNPEEREXCHANGE"},
+	},
+	&cli.IntFlag{
+		Name:    "peer-exchange-interval",
+		Usage:   "Seconds between the peer exchanges",
+		EnvVars: []string{"EDGEVPNPEEREXCHANGEINTERVAL"},
+		Value:   60,
+	},
+	&cli.IntFlag{
+		Name:    "peer-exchange-sample-size",
+		Usage:   "Max peers shared with each peer exchange",
+		EnvVars: []string{"EDGEVPNPEEREXCHANGESAMPLESIZE"},
+		Value:   10,
+	},
+	&cli.BoolFlag{
+		Name:    "peer-exchange-bootstrap",
+		Usage:   "Share the reachable public bootstrap peers with the peer exchange, and dial the ones learned from the other nodes when the configured ones are down",
+		EnvVars: []string{"EDGEVPNPEEREXCHANGEBOOTSTRAP"},
+	},
+	&cli.IntFlag{
+		Name:    "peer-exchange-bootstrap-max",
+		Usage:   "Max bootstrap peers learned from the peer exchange",
+		EnvVars: []string{"EDGEVPNPEEREXCHANGEBOOTSTRAPMAX"},
+		Value:   discovery.DefaultLearnedBootstrapMax,
+	},
+	&cli.IntFlag{
+		Name:    "peer-exchange-bootstrap-sources",
+		Usage:   "Number of nodes which must share a bootstrap peer before it is dialed",
+		EnvVars: []string{"EDGEVPNPEEREXCHANGEBOOTSTRAPSOURCES"},
+		Value:   discovery.DefaultLearnedBootstrapMinSources,
+	},
+	&cli.BoolFlag{
+		Name:    "discovery-ipfs-bootstrap",
+		Usage:   "Use also the bootstrap peers of the local IPFS config ($IPFS_PATH/config or ~/.ipfs/config)",
+		EnvVars: []string{"EDGEVPNIPFSBOOTSTRAP"},
+	},
 	&cli.IntFlag{
 		Name:    "connection-high-water",
 		Usage:   "max number of connection allowed",
@@ -248,6 +627,11 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		Usage:   "Specify an edgevpn token in place of a config file",
 		EnvVars: []string{"EDGEVPNTOKEN"},
 	},
+	&cli.StringFlag{
+		Name:    "network-name",
+		Usage:   "A local name for the network, to scope the services lookups",
+		EnvVars: []string{"EDGEVPNNETWORKNAME"},
+	},
 	&cli.BoolFlag{
 		Name:    "limit-enable",
 		Usage:   "Enable resource management",
@@ -260,7 +644,7 @@ var CommonFlags []cli.Flag = []cli.Flag{
 	},
 	&cli.StringFlag{
 		Name:    "limit-scope",
-		Usage:   "Specify a limit scope",
+		Usage:   "Specify the scope the limit-config flags apply to (system, transient or peer)",
 		EnvVars: []string{"LIMITSCOPE"},
 		Value:   "system",
 	},
@@ -306,6 +690,11 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		EnvVars: []string{"LIMITCONFIGFD"},
 		Value:   30,
 	},
+	&cli.Int64Flag{
+		Name:    "limit-config-memory",
+		Usage:   "Max memory (bytes) resource limit configuration",
+		EnvVars: []string{"LIMITCONFIGMEMORY"},
+	},
 	&cli.BoolFlag{
 		Name:    "peerguard",
 		Usage:   "Enable peerguard. (Experimental)",
@@ -322,6 +711,12 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		EnvVars: []string{"EDGEVPNPRIVKEYCACHEDIR"},
 		Value:   stateDir(),
 	},
+	&cli.StringFlag{
+		Name:    "privkey-permissions",
+		Usage:   "What to do when the cached privkey is accessible by other users: refuse to start (refuse), restrict its permissions (fix) or log a warning (warn)",
+		EnvVars: []string{"EDGEVPNPRIVKEYPERMISSIONS"},
+		Value:   node.KeyPermissionsRefuse,
+	},
 	&cli.StringSliceFlag{
 		Name:    "static-peertable",
 		Usage:   "List of static peers to use (in `ip:peerid` format)",
@@ -394,38 +789,176 @@ func stringsToMultiAddr(peers []string) []multiaddr.Multiaddr {
 func ConfigFromContext(c *cli.Context) *config.Config {
 	var limitConfig *rcmgr.PartialLimitConfig
 
+	// The limits of the scope are overridden only if set explicitly
+	scopeLimits := rcmgr.ResourceLimits{}
+	for flag, l := range map[string]*rcmgr.LimitVal{
+		"limit-config-streams":          &scopeLimits.Streams,
+		"limit-config-streams-inbound":  &scopeLimits.StreamsInbound,
+		"limit-config-streams-outbound": &scopeLimits.StreamsOutbound,
+		"limit-config-conn":             &scopeLimits.Conns,
+		"limit-config-conn-inbound":     &scopeLimits.ConnsInbound,
+		"limit-config-conn-outbound":    &scopeLimits.ConnsOutbound,
+		"limit-config-fd":               &scopeLimits.FD,
+	} {
+		if c.IsSet(flag) {
+			*l = rcmgr.LimitVal(c.Int(flag))
+		}
+	}
+	if c.IsSet("limit-config-memory") {
+		scopeLimits.Memory = rcmgr.LimitVal64(c.Int64("limit-config-memory"))
+	}
+
 	autorelayInterval, err := time.ParseDuration(c.String("autorelay-discovery-interval"))
 	if err != nil {
 		autorelayInterval = 0
 	}
 
+	streamReopenInterval, err := time.ParseDuration(c.String("stream-reopen-interval"))
+	if err != nil {
+		streamReopenInterval = 0
+	}
+
+	streamReopenMaxInterval, err := time.ParseDuration(c.String("stream-reopen-max-interval"))
+	if err != nil {
+		streamReopenMaxInterval = 0
+	}
+
+	writeRetryInterval, err := time.ParseDuration(c.String("write-retry-interval"))
+	if err != nil {
+		writeRetryInterval = 0
+	}
+
+	quarantineWindow, err := time.ParseDuration(c.String("quarantine-window"))
+	if err != nil {
+		quarantineWindow = time.Minute
+	}
+
+	quarantineCooldown, err := time.ParseDuration(c.String("quarantine-cooldown"))
+	if err != nil {
+		quarantineCooldown = 10 * time.Minute
+	}
+
+	ledgerHistory := map[string]int{}
+	for _, h := range c.StringSlice("ledger-history") {
+		bucket, depth, found := strings.Cut(h, "=")
+		if !found {
+			continue
+		}
+		if d, err := strconv.Atoi(depth); err == nil {
+			ledgerHistory[bucket] = d
+		}
+	}
+
+	ledgerScopes := map[string]string{}
+	for _, s := range c.StringSlice("ledger-scope") {
+		if bucket, scope, found := strings.Cut(s, "="); found {
+			ledgerScopes[bucket] = scope
+		}
+	}
+
+	shutdownPhases := map[string]time.Duration{}
+	for _, p := range c.StringSlice("shutdown-phase-timeout") {
+		phase, secs, found := strings.Cut(p, "=")
+		if !found {
+			continue
+		}
+		if d, err := strconv.Atoi(secs); err == nil {
+			shutdownPhases[phase] = time.Duration(d) * time.Second
+		}
+	}
+
+	uplinks := map[string]int{}
+	for _, u := range c.StringSlice("uplink") {
+		address, weight, found := strings.Cut(u, "=")
+		uplinks[address] = 1
+		if w, err := strconv.Atoi(weight); found && err == nil {
+			uplinks[address] = w
+		}
+	}
+
 	// Authproviders are supposed to be passed as a json object
 	pa := c.String("peergate-auth")
 	d := map[string]map[string]interface{}{}
 	json.Unmarshal([]byte(pa), &d)
 
 	return &config.Config{
-		NetworkConfig:     c.String("config"),
-		NetworkToken:      c.String("token"),
-		Address:           c.String("address"),
-		Router:            c.String("router"),
-		Interface:         c.String("interface"),
-		Libp2pLogLevel:    c.String("libp2p-log-level"),
-		LogLevel:          c.String("log-level"),
-		LowProfile:        c.Bool("low-profile"),
-		Blacklist:         c.StringSlice("blacklist"),
-		Concurrency:       c.Int("concurrency"),
-		FrameTimeout:      c.String("timeout"),
-		ChannelBufferSize: c.Int("channel-buffer-size"),
-		InterfaceMTU:      c.Int("mtu"),
-		PacketMTU:         c.Int("packet-mtu"),
-		BootstrapIface:    c.Bool("bootstrap-iface"),
-		Whitelist:         stringsToMultiAddr(c.StringSlice("whitelist")),
+		NetworkConfig:       c.String("config"),
+		NetworkToken:        c.String("token"),
+		NetworkName:         c.String("network-name"),
+		Address:             c.String("address"),
+		Router:              c.String("router"),
+		AdvertiseRoutes:     c.StringSlice("advertise-routes"),
+		AcceptRoutes:        c.StringSlice("accept-routes"),
+		ExitNodes:           c.StringSlice("exit-node"),
+		Interface:           c.String("interface"),
+		Libp2pLogLevel:      c.String("libp2p-log-level"),
+		LogLevel:            c.String("log-level"),
+		LowProfile:          c.Bool("low-profile"),
+		SafeModeDetection:   c.Bool("safe-mode-detection"),
+		Blacklist:           c.StringSlice("blacklist"),
+		Concurrency:         c.Int("concurrency"),
+		FrameTimeout:        c.String("timeout"),
+		ChannelBufferSize:   c.Int("channel-buffer-size"),
+		BackpressureTimeout: c.String("backpressure-timeout"),
+		BatchSize:           c.Int("batch-size"),
+		Compression:         c.String("compression"),
+		Offload:             c.Bool("offload"),
+		InterfaceMTU:        c.Int("mtu"),
+		PacketMTU:           c.Int("packet-mtu"),
+		BootstrapIface:      c.Bool("bootstrap-iface"),
+		Whitelist:           stringsToMultiAddr(c.StringSlice("whitelist")),
+		IPv6: config.IPv6{
+			Enable:  c.Bool("ipv6"),
+			Prefix:  c.String("ipv6-prefix"),
+			Address: c.String("address6"),
+		},
+		StreamReopen: config.StreamReopen{
+			Interval:    streamReopenInterval,
+			MaxInterval: streamReopenMaxInterval,
+			MaxAttempts: c.Int("stream-reopen-max-attempts"),
+		},
+		DeviceWrite: config.DeviceWrite{
+			Retries:       c.Int("write-retries"),
+			RetryInterval: writeRetryInterval,
+			MaxFailures:   c.Int("write-max-failures"),
+		},
+		ACL: config.ACL{
+			Admins:                c.StringSlice("acl-admin"),
+			PolicyFile:            c.String("acl-policy"),
+			FirewallDenyByDefault: c.Bool("firewall-deny-by-default"),
+		},
+		Events: config.Events{
+			Broker: c.String("events-broker"),
+		},
+		FlowLog: config.FlowLog{
+			Collector: c.String("flow-log-collector"),
+			RateLimit: c.Int("flow-log-rate-limit"),
+			Rotation: utils.Rotation{
+				MaxSize:  int64(c.Int("flow-log-max-size")) << 20,
+				MaxAge:   time.Duration(c.Int("flow-log-max-age")) * time.Hour,
+				MaxFiles: c.Int("flow-log-max-files"),
+			},
+		},
+		Quarantine: config.Quarantine{
+			Enable:    c.Bool("quarantine"),
+			Threshold: c.Int("quarantine-threshold"),
+			Window:    quarantineWindow,
+			Cooldown:  quarantineCooldown,
+		},
 		Ledger: config.Ledger{
 			StateDir:         c.String("ledger-state"),
+			ClearKeys:        c.Bool("ledger-clear-keys"),
+			BatchWindow:      time.Duration(c.Int("ledger-batch-window")) * time.Millisecond,
+			CompressionLevel: c.Int("ledger-compression-level"),
+			History:          ledgerHistory,
+			Scopes:           ledgerScopes,
 			AnnounceInterval: time.Duration(c.Int("ledger-announce-interval")) * time.Second,
 			SyncInterval:     time.Duration(c.Int("ledger-synchronization-interval")) * time.Second,
 		},
+		Shutdown: config.Shutdown{
+			Timeout: time.Duration(c.Int("shutdown-timeout")) * time.Second,
+			Phases:  shutdownPhases,
+		},
 		NAT: config.NAT{
 			Service:           c.Bool("natservice"),
 			Map:               c.Bool("natmap"),
@@ -435,10 +968,41 @@ func ConfigFromContext(c *cli.Context) *config.Config {
 			RateLimitInterval: time.Duration(c.Int("nat-ratelimit-interval")) * time.Second,
 		},
 		Discovery: config.Discovery{
-			BootstrapPeers: c.StringSlice("discovery-bootstrap-peers"),
-			DHT:            c.Bool("dht"),
-			MDNS:           c.Bool("mdns"),
-			Interval:       time.Duration(c.Int("discovery-interval")) * time.Second,
+			BootstrapPeers:               c.StringSlice("discovery-bootstrap-peers"),
+			DHT:                          c.Bool("dht"),
+			MDNS:                         c.Bool("mdns"),
+			Interval:                     time.Duration(c.Int("discovery-interval")) * time.Second,
+			MinInterval:                  time.Duration(c.Int("discovery-min-interval")) * time.Second,
+			MaxPeers:                     c.Int("discovery-max-peers"),
+			MaxConnections:               c.Int("discovery-max-connections"),
+			DialConcurrency:              c.Int("discovery-dial-concurrency"),
+			LocalPeers:                   c.Int("discovery-local-peers"),
+			LocalScaleFactor:             c.Int("discovery-local-scale"),
+			ProtocolPrefix:               c.String("discovery-protocol-prefix"),
+			PrivateNetwork:               c.Bool("private-network"),
+			BandwidthBudget:              c.Int64("discovery-bandwidth-budget"),
+			BandwidthWindow:              time.Duration(c.Int("discovery-bandwidth-window")) * time.Second,
+			DiagnoseAfter:                c.Int("discovery-diagnose-after"),
+			OTPWindowTolerance:           c.Int("discovery-otp-window-tolerance"),
+			DHTMode:                      c.String("discovery-dht-mode"),
+			InsecureFixedRendezvous:      c.String("insecure-fixed-rendezvous"),
+			CanaryTimeout:                time.Duration(c.Int("discovery-canary-timeout")) * time.Second,
+			DialBackoff:                  time.Duration(c.Int("discovery-dial-backoff")) * time.Second,
+			IPFSBootstrap:                c.Bool("discovery-ipfs-bootstrap"),
+			RendezvousServers:            c.StringSlice("discovery-rendezvous-servers"),
+			RendezvousServer:             c.Bool("rendezvous-server"),
+			MaxQueries:                   c.Int("discovery-max-queries"),
+			BootstrapPolicy:              c.String("discovery-bootstrap-policy"),
+			BootstrapTimeout:             time.Duration(c.Int("discovery-bootstrap-timeout")) * time.Second,
+			BootstrapFallbackURL:         c.String("discovery-bootstrap-fallback-url"),
+			BootstrapDNS:                 c.StringSlice("discovery-bootstrap-dns"),
+			PeerCache:                    c.Bool("peer-cache"),
+			PeerExchange:                 c.Bool("peer-exchange"),
+			PeerExchangeInterval:         time.Duration(c.Int("peer-exchange-interval")) * time.Second,
+			PeerExchangeSampleSize:       c.Int("peer-exchange-sample-size"),
+			PeerExchangeBootstrap:        c.Bool("peer-exchange-bootstrap"),
+			PeerExchangeBootstrapMax:     c.Int("peer-exchange-bootstrap-max"),
+			PeerExchangeBootstrapSources: c.Int("peer-exchange-bootstrap-sources"),
 		},
 		Connection: config.Connection{
 			AutoRelay:                  c.Bool("autorelay"),
@@ -449,11 +1013,19 @@ func ConfigFromContext(c *cli.Context) *config.Config {
 			OnlyStaticRelays:           c.Bool("autorelay-static-only"),
 			HighWater:                  c.Int("connection-high-water"),
 			LowWater:                   c.Int("connection-low-water"),
+			Uplinks:                    uplinks,
+			SourcePorts:                c.String("source-ports"),
+			TorProxy:                   c.String("tor-proxy"),
+			TorOnly:                    c.Bool("tor-only"),
+			OnionAddresses:             c.StringSlice("onion-address"),
+			PinnedKeys:                 c.StringSlice("pin"),
+			MaxInboundPerIP:            c.Int("max-inbound-per-ip"),
 		},
 		Limit: config.ResourceLimit{
 			Enable:      c.Bool("limit-enable"),
 			FileLimit:   c.String("limit-file"),
 			Scope:       c.String("limit-scope"),
+			ScopeLimits: scopeLimits,
 			MaxConns:    c.Int("max-connections"), // Turn to 0 to use other way of limiting. Files take precedence
 			LimitConfig: limitConfig,
 		},
@@ -469,6 +1041,18 @@ func ConfigFromContext(c *cli.Context) *config.Config {
 }
 
 func cliToOpts(c *cli.Context) ([]node.Option, []vpn.Option, *logger.Logger) {
+	nc, llger := cliConfig(c)
+	nodeOpts, vpnOpts, err := nc.ToOpts(llger)
+	if err != nil {
+		llger.Fatal(err.Error())
+	}
+
+	return nodeOpts, vpnOpts, llger
+}
+
+// cliConfig returns the config of the node from the CLI, with the
+// cached private key and the static peer table
+func cliConfig(c *cli.Context) (*config.Config, *logger.Logger) {
 	nc := ConfigFromContext(c)
 
 	lvl, err := log.LevelFromString(nc.LogLevel)
@@ -485,30 +1069,16 @@ func cliToOpts(c *cli.Context) ([]node.Option, []vpn.Option, *logger.Logger) {
 
 	// Check if we have any privkey identity cached already
 	if c.Bool("privkey-cache") {
-		keyFile := filepath.Join(c.String("privkey-cache-dir"), "privkey")
-		dat, err := os.ReadFile(keyFile)
-		if err == nil && len(dat) > 0 {
-			llger.Info("Reading key from", keyFile)
-
-			nc.Privkey = dat
-		} else {
-			// generate, write
-			llger.Info("Generating private key and saving it locally for later use in", keyFile)
-
-			privkey, err := node.GenPrivKey(0)
-			checkErr(err)
-
-			r, err := crypto.MarshalPrivateKey(privkey)
-			checkErr(err)
-
-			err = os.MkdirAll(c.String("privkey-cache-dir"), 0600)
-			checkErr(err)
-
-			err = os.WriteFile(keyFile, r, 0600)
-			checkErr(err)
-
-			nc.Privkey = r
+		llger.Info("Using the private key cached in", c.String("privkey-cache-dir"))
+		keyFile := filepath.Join(c.String("privkey-cache-dir"), node.PrivKeyName)
+		if err := node.CheckKeyPermissions(keyFile, c.String("privkey-permissions"), llger); err != nil {
+			llger.Fatal(err.Error())
 		}
+		privkey, err := node.CachedPrivKey(store.NewFilesystem(c.String("privkey-cache-dir")))
+		if err != nil {
+			llger.Fatal(err.Error())
+		}
+		nc.Privkey = privkey
 	}
 
 	for _, pt := range c.StringSlice("static-peertable") {
@@ -523,19 +1093,18 @@ func cliToOpts(c *cli.Context) ([]node.Option, []vpn.Option, *logger.Logger) {
 		nc.Connection.PeerTable[dat[0]] = peer.ID(dat[1])
 	}
 
-	nodeOpts, vpnOpts, err := nc.ToOpts(llger)
-	if err != nil {
-		llger.Fatal(err.Error())
-	}
-
-	return nodeOpts, vpnOpts, llger
+	return nc, llger
 }
 
-func handleStopSignals() {
+// handleStopSignals exits on SIGINT/SIGTERM, after shutting down the nodes
+func handleStopSignals(nodes ...*node.Node) {
 	s := make(chan os.Signal, 10)
 	signal.Notify(s, os.Interrupt, syscall.SIGTERM)
 
 	for range s {
+		for _, e := range nodes {
+			e.Shutdown()
+		}
 		os.Exit(0)
 	}
 }
@@ -39,6 +39,10 @@ func main() {
 			cmd.API(),
 			cmd.ServiceAdd(),
 			cmd.ServiceConnect(),
+			cmd.ServiceQuery(),
+			cmd.Profile(),
+			cmd.Status(),
+			cmd.Firewall(),
 			cmd.FileReceive(),
 			cmd.Proxy(),
 			cmd.FileSend(),
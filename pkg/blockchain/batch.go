@@ -0,0 +1,105 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import "encoding/json"
+
+type batchOp struct {
+	bucket, key string
+	value       interface{}
+	delete      bool
+}
+
+// Batch is a group of writes to the ledger applied with a single block,
+// so the peers see either all of them or none
+type Batch struct {
+	ops []batchOp
+}
+
+// NewBatch returns an empty Batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put sets the key of the bucket to value
+func (b *Batch) Put(bucket, key string, value interface{}) *Batch {
+	b.ops = append(b.ops, batchOp{bucket: bucket, key: key, value: value})
+	return b
+}
+
+// Delete removes the key from the bucket
+func (b *Batch) Delete(bucket, key string) *Batch {
+	b.ops = append(b.ops, batchOp{bucket: bucket, key: key, delete: true})
+	return b
+}
+
+// Len returns the number of writes in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes the batch to the ledger in a single block.
+// Writes are applied in order, the last one wins on the same key.
+// Nothing is written if any of the values is refused by a validator.
+// The writes of scoped buckets are committed to their ledger, in a block
+// of their own.
+func (l *Ledger) Commit(b *Batch) {
+	if b.Len() == 0 {
+		return
+	}
+	for _, op := range b.ops {
+		if op.delete {
+			continue
+		}
+		dat, _ := json.Marshal(op.value)
+		if err := l.Validate(op.bucket, op.key, Data(string(dat))); err != nil {
+			l.rejected(err)
+			return
+		}
+	}
+
+	b, scoped := l.split(b)
+	for s, sb := range scoped {
+		s.Commit(sb)
+	}
+	if b.Len() == 0 {
+		return
+	}
+
+	l.Lock()
+	current := buckets(l.blockchain.Last().Storage).copy()
+	written := map[string]map[string]Data{}
+	removed := map[string][]string{}
+	for _, op := range b.ops {
+		if op.delete {
+			delete(current[op.bucket], op.key)
+			delete(l.owned[op.bucket], op.key)
+			delete(written[op.bucket], op.key)
+			removed[op.bucket] = append(removed[op.bucket], op.key)
+			continue
+		}
+		if _, exists := current[op.bucket]; !exists {
+			current[op.bucket] = make(map[string]Data)
+		}
+		if _, exists := written[op.bucket]; !exists {
+			written[op.bucket] = make(map[string]Data)
+		}
+		dat, _ := json.Marshal(op.value)
+		current[op.bucket][op.key] = Data(string(dat))
+		written[op.bucket][op.key] = current[op.bucket][op.key]
+		l.owns(op.bucket, op.key)
+	}
+	l.Unlock()
+	l.writeData(current, l.sign(written, removed))
+}
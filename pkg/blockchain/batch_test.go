@@ -0,0 +1,68 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+)
+
+// countingWrite counts the blocks written by a ledger
+type countingWrite struct {
+	lastWrite
+	blocks int
+}
+
+func (w *countingWrite) Write(b []byte) (int, error) {
+	w.blocks++
+	return w.lastWrite.Write(b)
+}
+
+var _ = Describe("Ledger batch", func() {
+	It("writes all the changes with a single block", func() {
+		w := &countingWrite{}
+		l := New(w, &MemoryStore{})
+		l.Add("services", map[string]interface{}{"old": "1"})
+		w.blocks = 0
+
+		l.Commit(NewBatch().
+			Put("services", "a", "1").
+			Put("services", "b", "2").
+			Put("dns", "c", "3").
+			Delete("services", "old"))
+		Expect(w.blocks).To(Equal(1))
+
+		remote := New(&lastWrite{}, &MemoryStore{})
+		_, exists := remote.GetKey("services", "a")
+		Expect(exists).To(BeFalse())
+
+		Expect(remote.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+		for _, k := range [][]string{{"services", "a"}, {"services", "b"}, {"dns", "c"}} {
+			_, exists := remote.GetKey(k[0], k[1])
+			Expect(exists).To(BeTrue(), k[1])
+		}
+		_, exists = remote.GetKey("services", "old")
+		Expect(exists).To(BeFalse())
+	})
+
+	It("does not write empty batches", func() {
+		w := &countingWrite{}
+		l := New(w, &MemoryStore{})
+		l.Commit(NewBatch())
+		Expect(w.blocks).To(Equal(0))
+	})
+})
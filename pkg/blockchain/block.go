@@ -29,6 +29,9 @@ type Block struct {
 	Storage   map[string]map[string]Data
 	Hash      string
 	PrevHash  string
+	// Signatures are the signatures of the entries by their authors.
+	// They are not part of the checksum, as each one is verified on its own.
+	Signatures map[string]map[string]Signature `json:",omitempty"`
 }
 
 // Blockchain is a series of validated Blocks
@@ -60,6 +63,14 @@ func (b Block) Checksum() string {
 	return hex.EncodeToString(hashed)
 }
 
+// blockTimeLayout is the layout of the block timestamps
+const blockTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// Time returns the time the block was created at
+func (b Block) Time() (time.Time, error) {
+	return time.Parse(blockTimeLayout, b.Timestamp)
+}
+
 // create a new block using previous block's hash
 func (oldBlock Block) NewBlock(s map[string]map[string]Data) Block {
 	var newBlock Block
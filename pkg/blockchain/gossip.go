@@ -0,0 +1,92 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// gossip holds the settings of the messages carrying the local blocks
+type gossip struct {
+	window time.Duration
+	level  int
+	// pending is the timer of the message of the blocks written in the window
+	pending *time.Timer
+}
+
+// SetBatchWindow coalesces the blocks written within the window into a
+// single message, carrying the last one. As every block holds the whole
+// ledger data, the peers apply it regardless of their own settings.
+// A window of 0 sends each block as soon as it is written.
+func (l *Ledger) SetBatchWindow(d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	l.gossip.window = d
+}
+
+// SetCompressionLevel sets the gzip level of the messages, from
+// gzip.HuffmanOnly to gzip.BestCompression. The messages are always
+// gzip streams, so the peers can read them with any level.
+func (l *Ledger) SetCompressionLevel(level int) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("invalid compression level %d", level)
+	}
+	l.Lock()
+	defer l.Unlock()
+	// Offset by one, so the zero value is the default compression
+	l.gossip.level = level - gzip.DefaultCompression
+	return nil
+}
+
+func (g *gossip) compress(b []byte) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, g.level+gzip.DefaultCompression)
+	gz.Write(b)
+	gz.Close()
+	return &buf
+}
+
+// send writes the last block to the channel, with the ledger locked
+func (l *Ledger) send() {
+	bytes, err := json.Marshal(l.blockchain.Last())
+	if err != nil {
+		l.log().Error(err)
+	}
+
+	l.channel.Write(l.gossip.compress(bytes).Bytes())
+}
+
+// broadcast sends the last block, or schedules it at the end of the
+// batch window
+func (l *Ledger) broadcast() {
+	l.Lock()
+	defer l.Unlock()
+	if l.gossip.window <= 0 {
+		l.send()
+		return
+	}
+	if l.gossip.pending != nil {
+		return
+	}
+	l.gossip.pending = time.AfterFunc(l.gossip.window, func() {
+		l.Lock()
+		defer l.Unlock()
+		l.gossip.pending = nil
+		l.send()
+	})
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+)
+
+// messages collects the messages written by a ledger from any goroutine
+type messages struct {
+	sync.Mutex
+	data [][]byte
+}
+
+func (w *messages) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.data = append(w.data, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (w *messages) all() [][]byte {
+	w.Lock()
+	defer w.Unlock()
+	return append([][]byte{}, w.data...)
+}
+
+var _ = Describe("Ledger gossip", func() {
+	It("sends each block right away without a batch window", func() {
+		w := &messages{}
+		l := New(w, &MemoryStore{})
+		for i := 0; i < 3; i++ {
+			l.Add("services", map[string]interface{}{fmt.Sprint(i): i})
+		}
+		Expect(w.all()).To(HaveLen(3))
+	})
+
+	It("coalesces the blocks written within the batch window", func() {
+		w := &messages{}
+		l := New(w, &MemoryStore{})
+		l.SetBatchWindow(200 * time.Millisecond)
+
+		l.Add("services", map[string]interface{}{"a": "1"})
+		l.Add("services", map[string]interface{}{"b": "2"})
+		l.Delete("services", "a")
+		l.Add("dns", map[string]interface{}{"c": "3"})
+		Expect(w.all()).To(BeEmpty())
+
+		Eventually(w.all, 2*time.Second).Should(HaveLen(1))
+		Consistently(w.all, 400*time.Millisecond).Should(HaveLen(1))
+
+		// A peer applies the whole window with the single message
+		remote := New(&lastWrite{}, &MemoryStore{})
+		Expect(remote.Update(nil, &hub.Message{Message: string(w.all()[0]), AuthorID: "remote"}, nil)).To(Succeed())
+		Expect(remote.Index()).To(Equal(l.Index()))
+		_, exists := remote.GetKey("services", "a")
+		Expect(exists).To(BeFalse())
+		for _, k := range [][]string{{"services", "b"}, {"dns", "c"}} {
+			_, exists := remote.GetKey(k[0], k[1])
+			Expect(exists).To(BeTrue(), k[1])
+		}
+
+		// The next write opens a new window
+		l.Add("services", map[string]interface{}{"d": "4"})
+		Eventually(w.all, 2*time.Second).Should(HaveLen(2))
+	})
+
+	It("sends messages readable with any compression level", func() {
+		for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression, gzip.HuffmanOnly} {
+			w := &messages{}
+			l := New(w, &MemoryStore{})
+			Expect(l.SetCompressionLevel(level)).To(Succeed())
+			l.Add("services", map[string]interface{}{"a": "1"})
+
+			remote := New(&lastWrite{}, &MemoryStore{})
+			Expect(remote.Update(nil, &hub.Message{Message: string(w.all()[0]), AuthorID: "remote"}, nil)).To(Succeed())
+			_, exists := remote.GetKey("services", "a")
+			Expect(exists).To(BeTrue(), fmt.Sprint(level))
+		}
+		Expect(New(&lastWrite{}, &MemoryStore{}).SetCompressionLevel(10)).ToNot(Succeed())
+	})
+})
+
+// BenchmarkGossip measures the bytes sent for a burst of 100 updates
+func BenchmarkGossip(b *testing.B) {
+	for _, window := range []time.Duration{0, 10 * time.Millisecond} {
+		b.Run(fmt.Sprint("window=", window), func(b *testing.B) {
+			var sent int
+			for i := 0; i < b.N; i++ {
+				w := &messages{}
+				l := New(w, &MemoryStore{})
+				l.SetBatchWindow(window)
+				for k := 0; k < 100; k++ {
+					l.Add("services", map[string]interface{}{fmt.Sprint(k): k})
+				}
+				if window > 0 {
+					time.Sleep(2 * window)
+				}
+				for _, m := range w.all() {
+					sent += len(m)
+				}
+			}
+			b.ReportMetric(float64(sent)/float64(b.N), "bytes/op")
+		})
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+// Version is a retained value of a ledger key
+type Version struct {
+	Value Data
+	// Timestamp of the block which carried the change
+	Timestamp string
+	// Author is the peer which wrote the block
+	Author string
+	// Deleted is true if the key was removed
+	Deleted bool
+}
+
+// history retains the last versions of the keys of the buckets
+// which have a depth set
+type history struct {
+	depth    map[string]int
+	versions map[string]map[string][]Version
+}
+
+func (h *history) record(author string, current map[string]map[string]Data, block Block) {
+	for bucket, depth := range h.depth {
+		if depth <= 0 {
+			continue
+		}
+		for k, v := range block.Storage[bucket] {
+			if old, exists := current[bucket][k]; !exists || old != v {
+				h.add(bucket, k, depth, Version{Value: v, Timestamp: block.Timestamp, Author: author})
+			}
+		}
+		for k := range current[bucket] {
+			if _, exists := block.Storage[bucket][k]; !exists {
+				h.add(bucket, k, depth, Version{Timestamp: block.Timestamp, Author: author, Deleted: true})
+			}
+		}
+	}
+}
+
+func (h *history) add(bucket, key string, depth int, v Version) {
+	if h.versions == nil {
+		h.versions = make(map[string]map[string][]Version)
+	}
+	if _, exists := h.versions[bucket]; !exists {
+		h.versions[bucket] = make(map[string][]Version)
+	}
+	versions := append(h.versions[bucket][key], v)
+	// Prune the versions beyond the depth
+	if len(versions) > depth {
+		versions = append([]Version{}, versions[len(versions)-depth:]...)
+	}
+	h.versions[bucket][key] = versions
+}
+
+// SetHistoryDepth sets how many versions of the keys of the bucket are retained.
+// A depth of 0 disables the history for the bucket.
+func (l *Ledger) SetHistoryDepth(bucket string, depth int) {
+	l.Lock()
+	defer l.Unlock()
+	if l.history.depth == nil {
+		l.history.depth = make(map[string]int)
+	}
+	l.history.depth[bucket] = depth
+	if versions, exists := l.history.versions[bucket]; exists {
+		for k, v := range versions {
+			if depth <= 0 {
+				delete(versions, k)
+			} else if len(v) > depth {
+				versions[k] = append([]Version{}, v[len(v)-depth:]...)
+			}
+		}
+	}
+}
+
+// SetAuthor sets the author recorded in the history for the local writes
+func (l *Ledger) SetAuthor(id string) {
+	l.Lock()
+	defer l.Unlock()
+	l.author = id
+}
+
+// History returns the retained versions of the key, the oldest first
+func (l *Ledger) History(bucket, key string) []Version {
+	if s, ok := l.scoped(bucket); ok {
+		return s.History(bucket, key)
+	}
+	l.Lock()
+	defer l.Unlock()
+	return append([]Version{}, l.history.versions[bucket][key]...)
+}
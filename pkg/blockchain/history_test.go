@@ -0,0 +1,92 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"io"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+)
+
+// lastWrite keeps the last block written by a ledger
+type lastWrite struct{ data []byte }
+
+func (w *lastWrite) Write(b []byte) (int, error) {
+	w.data = append([]byte{}, b...)
+	return len(b), nil
+}
+
+var _ = Describe("Ledger history", func() {
+	values := func(versions []Version) (res []string) {
+		for _, v := range versions {
+			var s string
+			v.Value.Unmarshal(&s)
+			res = append(res, s)
+		}
+		return
+	}
+
+	It("does not retain history by default", func() {
+		l := New(io.Discard, &MemoryStore{})
+		l.Add("dns", map[string]interface{}{"foo": "1"})
+		l.Add("dns", map[string]interface{}{"foo": "2"})
+		Expect(l.History("dns", "foo")).To(BeEmpty())
+	})
+
+	It("retains the last versions of a key and prunes the older ones", func() {
+		l := New(io.Discard, &MemoryStore{})
+		l.SetAuthor("me")
+		l.SetHistoryDepth("dns", 3)
+
+		for _, v := range []string{"1", "2", "3", "4"} {
+			l.Add("dns", map[string]interface{}{"foo": v})
+		}
+		// Unchanged keys and other buckets are not recorded
+		l.Add("dns", map[string]interface{}{"bar": "1"})
+		l.Add("other", map[string]interface{}{"foo": "1"})
+
+		h := l.History("dns", "foo")
+		Expect(values(h)).To(Equal([]string{"2", "3", "4"}))
+		Expect(h[0].Author).To(Equal("me"))
+		Expect(h[0].Timestamp).ToNot(BeEmpty())
+		Expect(l.History("dns", "bar")).To(HaveLen(1))
+		Expect(l.History("other", "foo")).To(BeEmpty())
+
+		l.Delete("dns", "foo")
+		h = l.History("dns", "foo")
+		Expect(h).To(HaveLen(3))
+		Expect(h[2].Deleted).To(BeTrue())
+
+		l.SetHistoryDepth("dns", 1)
+		Expect(l.History("dns", "foo")).To(HaveLen(1))
+	})
+
+	It("records the author of the blocks received from other peers", func() {
+		w := &lastWrite{}
+		remote := New(w, &MemoryStore{})
+		remote.Add("dns", map[string]interface{}{"foo": "1"})
+
+		l := New(io.Discard, &MemoryStore{})
+		l.SetHistoryDepth("dns", 2)
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+
+		h := l.History("dns", "foo")
+		Expect(values(h)).To(Equal([]string{"1"}))
+		Expect(h[0].Author).To(Equal("remote"))
+	})
+})
@@ -18,13 +18,15 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"sync"
 	"time"
 
+	"github.com/ipfs/go-log"
 	"github.com/mudler/edgevpn/pkg/hub"
+	"github.com/mudler/edgevpn/pkg/metrics"
 	"github.com/mudler/edgevpn/pkg/utils"
 
 	"github.com/pkg/errors"
@@ -34,7 +36,52 @@ type Ledger struct {
 	sync.Mutex
 	blockchain Store
 
-	channel io.Writer
+	channel    io.Writer
+	authorizer WriteAuthorizer
+	validators map[string]Validator
+	logger     log.StandardLogger
+	onChange   ChangeHandler
+
+	author  string
+	signer  Signer
+	history history
+
+	// owned are the keys written by the node
+	owned  map[string]map[string]bool
+	resync resync
+	gossip gossip
+	// scopes are the ledgers of the buckets gossiped on their own topic
+	scopes map[string]*Ledger
+}
+
+// WriteAuthorizer is consulted for each incoming block. It receives the peer which
+// relayed the block, the current block and the incoming one, and returns
+// an error if the changes are not allowed.
+type WriteAuthorizer func(relayer string, current, incoming Block) error
+
+// ChangeHandler is called with the author and the block each time a
+// new block is added to the ledger. It is called with the ledger locked,
+// and must not block.
+type ChangeHandler func(author string, b Block)
+
+// OnChange sets the handler of the ledger changes
+func (l *Ledger) OnChange(h ChangeHandler) {
+	l.Lock()
+	defer l.Unlock()
+	l.onChange = h
+}
+
+func (l *Ledger) changed(author string, b Block) {
+	if l.onChange != nil {
+		l.onChange(author, b)
+	}
+}
+
+// SetWriteAuthorizer sets the authorizer of the incoming blocks
+func (l *Ledger) SetWriteAuthorizer(a WriteAuthorizer) {
+	l.Lock()
+	defer l.Unlock()
+	l.authorizer = a
 }
 
 type Store interface {
@@ -55,7 +102,7 @@ func New(w io.Writer, s Store) *Ledger {
 func (l *Ledger) newGenesis() {
 	t := time.Now()
 	genesisBlock := Block{}
-	genesisBlock = Block{0, t.String(), map[string]map[string]Data{}, genesisBlock.Checksum(), ""}
+	genesisBlock = Block{Timestamp: t.String(), Storage: map[string]map[string]Data{}, Hash: genesisBlock.Checksum()}
 	l.blockchain.Add(genesisBlock)
 }
 
@@ -69,14 +116,7 @@ func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 			select {
 			case <-t.C:
 				l.Lock()
-
-				bytes, err := json.Marshal(l.blockchain.Last())
-				if err != nil {
-					log.Println(err)
-				}
-
-				l.channel.Write(compress(bytes).Bytes())
-
+				l.send()
 				l.Unlock()
 			case <-ctx.Done():
 				return
@@ -85,14 +125,6 @@ func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 	}()
 }
 
-func compress(b []byte) *bytes.Buffer {
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	gz.Write(b)
-	gz.Close()
-	return &buf
-}
-
 func deCompress(b []byte) (*bytes.Buffer, error) {
 	r, err := gzip.NewReader(bytes.NewReader(b))
 	if err != nil {
@@ -113,21 +145,39 @@ func (l *Ledger) Update(f *Ledger, h *hub.Message, c chan *hub.Message) (err err
 
 	b, err := deCompress([]byte(h.Message))
 	if err != nil {
-		err = errors.Wrap(err, "failed decompressing")
+		err = fmt.Errorf("%w: failed decompressing: %s", hub.ErrMalformedMessage, err.Error())
 		return
 	}
 
 	err = json.Unmarshal(b.Bytes(), block)
 	if err != nil {
-		err = errors.Wrap(err, "failed unmarshalling blockchain data")
+		err = fmt.Errorf("%w: failed unmarshalling blockchain data: %s", hub.ErrMalformedMessage, err.Error())
 		return
 	}
 
 	l.Lock()
+	defer l.Unlock()
 	if block.Index > l.blockchain.Len() {
+		if l.authorizer != nil {
+			if err = l.authorizer(h.AuthorID, l.last(), *block); err != nil {
+				return errors.Wrapf(err, "rejected block from %s", h.AuthorID)
+			}
+		}
+		if errs := l.validateChanges(l.last().Storage, block.Storage); len(errs) > 0 {
+			for _, err := range errs {
+				l.rejected(errors.Wrapf(err, "block from %s", h.AuthorID))
+			}
+			block.Hash = block.Checksum()
+		}
+		block.Signatures = signatures(block.Storage, l.last(), block.Signatures)
+		l.history.record(h.AuthorID, l.last().Storage, *block)
 		l.blockchain.Add(*block)
+		if t, err := block.Time(); err == nil && time.Since(t) >= 0 {
+			metrics.BlockPropagation.Since(t)
+		}
+		l.changed(h.AuthorID, *block)
+		l.synced(*block)
 	}
-	l.Unlock()
 
 	return
 }
@@ -214,11 +264,14 @@ func (l *Ledger) Persist(ctx context.Context, interval, timeout time.Duration, b
 
 // GetKey retrieve the current key from the blockchain
 func (l *Ledger) GetKey(b, s string) (value Data, exists bool) {
+	if scoped, ok := l.scoped(b); ok {
+		return scoped.GetKey(b, s)
+	}
 	l.Lock()
 	defer l.Unlock()
 
-	if l.blockchain.Len() > 0 {
-		last := l.blockchain.Last()
+	if l.len() > 0 {
+		last := l.last()
 		if _, exists = last.Storage[b]; !exists {
 			return
 		}
@@ -232,10 +285,13 @@ func (l *Ledger) GetKey(b, s string) (value Data, exists bool) {
 
 // Exists returns true if there is one element with a matching value
 func (l *Ledger) Exists(b string, f func(Data) bool) (exists bool) {
+	if s, ok := l.scoped(b); ok {
+		return s.Exists(b, f)
+	}
 	l.Lock()
 	defer l.Unlock()
-	if l.blockchain.Len() > 0 {
-		for _, bv := range l.blockchain.Last().Storage[b] {
+	if l.len() > 0 {
+		for _, bv := range l.last().Storage[b] {
 			if f(bv) {
 				exists = true
 				return
@@ -249,16 +305,17 @@ func (l *Ledger) Exists(b string, f func(Data) bool) (exists bool) {
 // CurrentData returns the current ledger data (locking)
 func (l *Ledger) CurrentData() map[string]map[string]Data {
 	l.Lock()
-	defer l.Unlock()
+	data := buckets(l.last().Storage).copy()
+	l.Unlock()
 
-	return buckets(l.blockchain.Last().Storage).copy()
+	return l.scopedData(data)
 }
 
 // LastBlock returns the last block in the blockchain
 func (l *Ledger) LastBlock() Block {
 	l.Lock()
 	defer l.Unlock()
-	return l.blockchain.Last()
+	return l.last()
 }
 
 type bucket map[string]Data
@@ -281,24 +338,43 @@ func (b buckets) copy() map[string]map[string]Data {
 	return copy
 }
 
-// Add data to the blockchain
+// Add data to the blockchain. Nothing is written if any of the
+// values is refused by the validator of the bucket.
 func (l *Ledger) Add(b string, s map[string]interface{}) {
+	if scoped, ok := l.scoped(b); ok {
+		scoped.Add(b, s)
+		return
+	}
+	values := map[string]Data{}
+	for k, v := range s {
+		dat, _ := json.Marshal(v)
+		values[k] = Data(string(dat))
+		if err := l.Validate(b, k, values[k]); err != nil {
+			l.rejected(err)
+			return
+		}
+	}
+
 	l.Lock()
 	current := buckets(l.blockchain.Last().Storage).copy()
 
-	for s, k := range s {
+	for s, dat := range values {
 		if _, exists := current[b]; !exists {
 			current[b] = make(map[string]Data)
 		}
-		dat, _ := json.Marshal(k)
-		current[b][s] = Data(string(dat))
+		current[b][s] = dat
+		l.owns(b, s)
 	}
 	l.Unlock()
-	l.writeData(current)
+	l.writeData(current, l.sign(map[string]map[string]Data{b: values}, nil))
 }
 
 // Delete data from the ledger (locking)
 func (l *Ledger) Delete(b string, k string) {
+	if s, ok := l.scoped(b); ok {
+		s.Delete(b, k)
+		return
+	}
 	l.Lock()
 	new := make(map[string]map[string]Data)
 	for bb, kk := range l.blockchain.Last().Storage {
@@ -312,17 +388,26 @@ func (l *Ledger) Delete(b string, k string) {
 			}
 		}
 	}
+	delete(l.owned[b], k)
 	l.Unlock()
-	l.writeData(new)
+	l.writeData(new, l.sign(nil, map[string][]string{b: {k}}))
 }
 
 // DeleteBucket deletes a bucket from the ledger (locking)
 func (l *Ledger) DeleteBucket(b string) {
+	if s, ok := l.scoped(b); ok {
+		s.DeleteBucket(b)
+		return
+	}
 	l.Lock()
 	new := make(map[string]map[string]Data)
+	removed := map[string][]string{}
 	for bb, kk := range l.blockchain.Last().Storage {
 		// Copy all except the specified bucket
 		if bb == b {
+			for k := range kk {
+				removed[b] = append(removed[b], k)
+			}
 			continue
 		}
 		if _, exists := new[bb]; !exists {
@@ -332,8 +417,9 @@ func (l *Ledger) DeleteBucket(b string) {
 			new[bb][kkk] = v
 		}
 	}
+	delete(l.owned, b)
 	l.Unlock()
-	l.writeData(new)
+	l.writeData(new, l.sign(nil, removed))
 }
 
 // String returns the blockchain as string
@@ -347,19 +433,17 @@ func (l *Ledger) Index() int {
 	return l.blockchain.Len()
 }
 
-func (l *Ledger) writeData(s map[string]map[string]Data) {
+func (l *Ledger) writeData(s map[string]map[string]Data, signed map[string]map[string]Signature) {
 	newBlock := l.blockchain.Last().NewBlock(s)
+	newBlock.Signatures = signatures(s, l.blockchain.Last(), signed)
 
 	if newBlock.IsValid(l.blockchain.Last()) {
 		l.Lock()
+		l.history.record(l.author, l.blockchain.Last().Storage, newBlock)
 		l.blockchain.Add(newBlock)
+		l.changed(l.author, newBlock)
 		l.Unlock()
 	}
 
-	bytes, err := json.Marshal(l.blockchain.Last())
-	if err != nil {
-		log.Println(err)
-	}
-
-	l.channel.Write(compress(bytes).Bytes())
+	l.broadcast()
 }
@@ -0,0 +1,254 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// States of a ledger resync
+const (
+	ResyncIdle    = "idle"
+	ResyncSyncing = "syncing"
+	ResyncDone    = "done"
+	ResyncFailed  = "failed"
+)
+
+// ErrResyncInProgress is returned when a resync is requested while another is running
+var ErrResyncInProgress = errors.New("resync already in progress")
+
+// ResyncStatus reports the progress of a ledger resync
+type ResyncStatus struct {
+	State             string
+	Started, Finished string
+	// PreviousIndex is the index of the ledger before the resync,
+	// Index is the one adopted from the peers
+	PreviousIndex, Index int
+	// Preserved is the number of entries written by the node kept across the resync
+	Preserved int
+	Error     string
+}
+
+// resync holds the state of the ledger before a resync, which is used
+// to serve reads until the first block is received from the peers
+type resync struct {
+	status ResyncStatus
+	stale  *Block
+	owned  map[string]map[string]Data
+	done   chan struct{}
+}
+
+// owns records the keys written by the node (lock must be held)
+func (l *Ledger) owns(b string, keys ...string) {
+	if l.owned == nil {
+		l.owned = make(map[string]map[string]bool)
+	}
+	if _, exists := l.owned[b]; !exists {
+		l.owned[b] = make(map[string]bool)
+	}
+	for _, k := range keys {
+		l.owned[b][k] = true
+	}
+}
+
+// last returns the block reads are served from (lock must be held)
+func (l *Ledger) last() Block {
+	if l.resync.stale != nil {
+		return *l.resync.stale
+	}
+	return l.blockchain.Last()
+}
+
+func (l *Ledger) len() int {
+	if l.resync.stale != nil {
+		return l.resync.stale.Index
+	}
+	return l.blockchain.Len()
+}
+
+// Resync drops the local state of the ledger and adopts the next block received
+// from the peers, as a recovery from a stale or diverged ledger. The entries written
+// by the node are preserved, and re-announced once synced. Until a block is received
+// reads are served from the previous state, and if none is received within the timeout
+// the previous state is restored. Resync returns immediately, see ResyncStatus for the progress.
+func (l *Ledger) Resync(ctx context.Context, timeout time.Duration) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.resync.stale != nil {
+		return ErrResyncInProgress
+	}
+
+	stale := l.blockchain.Last()
+	owned := map[string]map[string]Data{}
+	preserved := 0
+	for b, keys := range l.owned {
+		for k := range keys {
+			v, exists := stale.Storage[b][k]
+			if !exists {
+				continue
+			}
+			if _, exists := owned[b]; !exists {
+				owned[b] = make(map[string]Data)
+			}
+			owned[b][k] = v
+			preserved++
+		}
+	}
+
+	// Restart from a genesis block, so any block from the peers is newer
+	genesis := Block{Timestamp: time.Now().UTC().String(), Storage: buckets(owned).copy()}
+	genesis.Hash = genesis.Checksum()
+	genesis.Signatures = signatures(genesis.Storage, stale, nil)
+	l.blockchain.Add(genesis)
+
+	done := make(chan struct{})
+	l.resync = resync{
+		stale: &stale,
+		owned: owned,
+		done:  done,
+		status: ResyncStatus{
+			State:         ResyncSyncing,
+			Started:       time.Now().UTC().Format(time.RFC3339),
+			PreviousIndex: stale.Index,
+			Preserved:     preserved,
+		},
+	}
+
+	go func() {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-done:
+		case <-t.C:
+			l.restore("no block received from peers")
+		case <-ctx.Done():
+			l.restore("resync cancelled")
+		}
+	}()
+	return nil
+}
+
+// ResyncStatus returns the status of the last resync
+func (l *Ledger) ResyncStatus() ResyncStatus {
+	l.Lock()
+	defer l.Unlock()
+	if l.resync.status.State == "" {
+		return ResyncStatus{State: ResyncIdle}
+	}
+	return l.resync.status
+}
+
+// synced completes the resync once a block from the peers is adopted (lock must be held)
+func (l *Ledger) synced(b Block) {
+	if l.resync.stale == nil {
+		return
+	}
+	close(l.resync.done)
+	l.resync.stale = nil
+	l.resync.status.State = ResyncDone
+	l.resync.status.Index = b.Index
+	l.resync.status.Finished = time.Now().UTC().Format(time.RFC3339)
+
+	// Re-announce the entries of the node missing or differing in the adopted block
+	missing := map[string]map[string]Data{}
+	for bucket, keys := range l.resync.owned {
+		for k, v := range keys {
+			if current, exists := b.Storage[bucket][k]; exists && current == v {
+				continue
+			}
+			if _, exists := missing[bucket]; !exists {
+				missing[bucket] = make(map[string]Data)
+			}
+			missing[bucket][k] = v
+		}
+	}
+	go func() {
+		for bucket, keys := range missing {
+			l.addRaw(bucket, keys)
+		}
+	}()
+}
+
+// restore puts back the state before the resync, if it did not complete
+func (l *Ledger) restore(reason string) {
+	l.Lock()
+	if l.resync.stale == nil {
+		l.Unlock()
+		return
+	}
+	stale := *l.resync.stale
+	// Keep what the node wrote in the meantime
+	last := l.blockchain.Last()
+	current := last.Storage
+	l.resync.stale = nil
+	l.resync.status.State = ResyncFailed
+	l.resync.status.Error = reason
+	l.resync.status.Finished = time.Now().UTC().Format(time.RFC3339)
+	l.blockchain.Add(stale)
+	l.Unlock()
+
+	merged := buckets(stale.Storage).copy()
+	changed := false
+	for b, keys := range l.ownedSnapshot() {
+		for k := range keys {
+			v, exists := current[b][k]
+			if !exists || merged[b][k] == v {
+				continue
+			}
+			if _, exists := merged[b]; !exists {
+				merged[b] = make(map[string]Data)
+			}
+			merged[b][k] = v
+			changed = true
+		}
+	}
+	if changed {
+		l.writeData(merged, last.Signatures)
+	}
+}
+
+// addRaw adds already encoded data to the blockchain
+func (l *Ledger) addRaw(b string, s map[string]Data) {
+	for k, v := range s {
+		if err := l.Validate(b, k, v); err != nil {
+			l.rejected(err)
+			return
+		}
+	}
+	l.Lock()
+	current := buckets(l.blockchain.Last().Storage).copy()
+	if _, exists := current[b]; !exists {
+		current[b] = make(map[string]Data)
+	}
+	for k, v := range s {
+		current[b][k] = v
+	}
+	l.Unlock()
+	l.writeData(current, l.sign(map[string]map[string]Data{b: s}, nil))
+}
+
+func (l *Ledger) ownedSnapshot() map[string]map[string]bool {
+	l.Lock()
+	defer l.Unlock()
+	res := map[string]map[string]bool{}
+	for b, keys := range l.owned {
+		res[b] = map[string]bool{}
+		for k := range keys {
+			res[b][k] = true
+		}
+	}
+	return res
+}
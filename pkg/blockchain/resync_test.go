@@ -0,0 +1,85 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"context"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+)
+
+var _ = Describe("Ledger resync", func() {
+	get := func(l *Ledger, b, k string) (s string) {
+		v, _ := l.GetKey(b, k)
+		v.Unmarshal(&s)
+		return
+	}
+
+	// peerBlock returns a block written by another peer, with its data
+	peerBlock := func(data map[string]string) *hub.Message {
+		w := &lastWrite{}
+		remote := New(w, &MemoryStore{})
+		for k, v := range data {
+			remote.Add("machines", map[string]interface{}{k: v})
+		}
+		return &hub.Message{Message: string(w.data), AuthorID: "remote"}
+	}
+
+	var l *Ledger
+	BeforeEach(func() {
+		l = New(io.Discard, &MemoryStore{})
+		l.Add("machines", map[string]interface{}{"own": "mine"})
+		// A stale entry learnt from a peer
+		Expect(l.Update(nil, peerBlock(map[string]string{"own": "mine", "stale": "old"}), nil)).To(Succeed())
+		Expect(get(l, "machines", "stale")).To(Equal("old"))
+		Expect(l.ResyncStatus().State).To(Equal(ResyncIdle))
+	})
+
+	It("adopts the state from the peers and re-announces the own entries", func() {
+		previous := l.Index()
+		Expect(l.Resync(context.Background(), time.Minute)).To(Succeed())
+		Expect(l.Resync(context.Background(), time.Minute)).To(MatchError(ErrResyncInProgress))
+
+		status := l.ResyncStatus()
+		Expect(status.State).To(Equal(ResyncSyncing))
+		Expect(status.PreviousIndex).To(Equal(previous))
+		Expect(status.Preserved).To(Equal(1))
+
+		// Reads are served from the previous state until synced
+		Expect(get(l, "machines", "stale")).To(Equal("old"))
+
+		Expect(l.Update(nil, peerBlock(map[string]string{"fresh": "new"}), nil)).To(Succeed())
+		Expect(l.ResyncStatus().State).To(Equal(ResyncDone))
+		Expect(get(l, "machines", "fresh")).To(Equal("new"))
+		Expect(get(l, "machines", "stale")).To(BeEmpty())
+		Eventually(func() string { return get(l, "machines", "own") }).Should(Equal("mine"))
+	})
+
+	It("restores the previous state if no peer answers", func() {
+		Expect(l.Resync(context.Background(), 100*time.Millisecond)).To(Succeed())
+		l.Add("machines", map[string]interface{}{"written": "meanwhile"})
+
+		Eventually(func() string { return l.ResyncStatus().State }).Should(Equal(ResyncFailed))
+		Expect(l.ResyncStatus().Error).ToNot(BeEmpty())
+		Expect(get(l, "machines", "stale")).To(Equal("old"))
+		Expect(get(l, "machines", "own")).To(Equal("mine"))
+		Expect(get(l, "machines", "written")).To(Equal("meanwhile"))
+	})
+})
@@ -0,0 +1,71 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+// SetScope moves the bucket to the scoped ledger, which is gossiped on its own
+// topic: the reads and writes of the bucket go to it, so its updates only reach
+// the peers which scope the bucket the same way.
+func (l *Ledger) SetScope(bucket string, scoped *Ledger) {
+	l.Lock()
+	defer l.Unlock()
+	if l.scopes == nil {
+		l.scopes = make(map[string]*Ledger)
+	}
+	l.scopes[bucket] = scoped
+}
+
+// scoped returns the ledger of the bucket, if it is scoped
+func (l *Ledger) scoped(bucket string) (*Ledger, bool) {
+	l.Lock()
+	defer l.Unlock()
+	s, ok := l.scopes[bucket]
+	return s, ok
+}
+
+// scopedData replaces the scoped buckets of data with the ones of their ledger
+func (l *Ledger) scopedData(data map[string]map[string]Data) map[string]map[string]Data {
+	l.Lock()
+	scopes := make(map[string]*Ledger, len(l.scopes))
+	for b, s := range l.scopes {
+		scopes[b] = s
+	}
+	l.Unlock()
+
+	for b, s := range scopes {
+		delete(data, b)
+		if v, exists := s.CurrentData()[b]; exists {
+			data[b] = v
+		}
+	}
+	return data
+}
+
+// split returns the writes of the batch for each scoped ledger,
+// leaving the ones of the unscoped buckets in the batch
+func (l *Ledger) split(b *Batch) (*Batch, map[*Ledger]*Batch) {
+	local := NewBatch()
+	scoped := map[*Ledger]*Batch{}
+	for _, op := range b.ops {
+		s, ok := l.scoped(op.bucket)
+		if !ok {
+			local.ops = append(local.ops, op)
+			continue
+		}
+		if _, exists := scoped[s]; !exists {
+			scoped[s] = NewBatch()
+		}
+		scoped[s].ops = append(scoped[s].ops, op)
+	}
+	return local, scoped
+}
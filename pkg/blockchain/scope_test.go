@@ -0,0 +1,73 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+)
+
+var _ = Describe("Ledger scopes", func() {
+	It("writes the scoped buckets to their ledger", func() {
+		w, sw := &messages{}, &messages{}
+		l := New(w, &MemoryStore{})
+		scoped := New(sw, &MemoryStore{})
+		l.SetScope("jobs", scoped)
+
+		l.Add("jobs", map[string]interface{}{"build": "queued"})
+		l.Add("services", map[string]interface{}{"web": "up"})
+		Expect(w.all()).To(HaveLen(1))
+		Expect(sw.all()).To(HaveLen(1))
+
+		_, exists := l.GetKey("jobs", "build")
+		Expect(exists).To(BeTrue())
+		Expect(l.Exists("jobs", func(Data) bool { return true })).To(BeTrue())
+		Expect(l.CurrentData()).To(HaveKey("jobs"))
+		Expect(l.LastBlock().Storage).ToNot(HaveKey("jobs"))
+		Expect(scoped.CurrentData()).ToNot(HaveKey("services"))
+
+		// A peer outside the scope only gets the other buckets
+		remote := New(&lastWrite{}, &MemoryStore{})
+		Expect(remote.Update(nil, &hub.Message{Message: string(w.all()[0]), AuthorID: "remote"}, nil)).To(Succeed())
+		Expect(remote.CurrentData()).To(HaveKey("services"))
+		Expect(remote.CurrentData()).ToNot(HaveKey("jobs"))
+
+		l.Delete("jobs", "build")
+		_, exists = scoped.GetKey("jobs", "build")
+		Expect(exists).To(BeFalse())
+	})
+
+	It("commits the writes of the batch to the ledger of their bucket", func() {
+		w, sw := &messages{}, &messages{}
+		l := New(w, &MemoryStore{})
+		scoped := New(sw, &MemoryStore{})
+		l.SetScope("jobs", scoped)
+
+		l.Commit(NewBatch().Put("jobs", "build", "queued").Put("services", "web", "up"))
+		Expect(l.LastBlock().Storage).To(HaveKey("services"))
+		Expect(l.LastBlock().Storage).ToNot(HaveKey("jobs"))
+		Expect(scoped.LastBlock().Storage).To(HaveKey("jobs"))
+
+		// The validators of the scoped ledger refuse the whole batch
+		scoped.SetValidator("jobs", func(string, []byte) error { return errors.New("invalid job") })
+		index := l.Index()
+		l.Commit(NewBatch().Put("jobs", "test", "queued").Put("services", "db", "up"))
+		Expect(l.Index()).To(Equal(index))
+	})
+})
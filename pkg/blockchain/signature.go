@@ -0,0 +1,134 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// tombstoneTTL is how long the signatures of the removed entries are kept
+const tombstoneTTL = 24 * time.Hour
+
+// Signer signs the entries written by the node, so the peers can tell who
+// wrote them whichever peer relays the blocks
+type Signer func(dat []byte) ([]byte, error)
+
+// Signature is the signature of a ledger entry by the peer which wrote it.
+// Deleted signatures are the tombstones of the removed entries.
+type Signature struct {
+	Author    string
+	Timestamp int64
+	Signature []byte
+	Deleted   bool `json:",omitempty"`
+}
+
+// Digest returns the bytes signed for the value of the key of the bucket
+func (s Signature) Digest(bucket, key string, value Data) []byte {
+	dat, _ := json.Marshal([]interface{}{s.Author, s.Timestamp, s.Deleted, bucket, key, value})
+	return dat
+}
+
+// SetSigner sets the signer of the entries written by the node
+func (l *Ledger) SetSigner(s Signer) {
+	l.Lock()
+	defer l.Unlock()
+	l.signer = s
+}
+
+// sign returns the signatures of the entries written by the node, if it
+// has a signer. Tombstones are returned for the removed keys.
+func (l *Ledger) sign(written map[string]map[string]Data, removed map[string][]string) map[string]map[string]Signature {
+	l.Lock()
+	signer, author := l.signer, l.author
+	l.Unlock()
+	if signer == nil {
+		return nil
+	}
+
+	res := map[string]map[string]Signature{}
+	add := func(b, k string, v Data, deleted bool) {
+		s := Signature{Author: author, Timestamp: time.Now().UnixNano(), Deleted: deleted}
+		sig, err := signer(s.Digest(b, k, v))
+		if err != nil {
+			l.log().Warnf("failed signing ledger entry %s/%s: %s", b, k, err.Error())
+			return
+		}
+		s.Signature = sig
+		if _, exists := res[b]; !exists {
+			res[b] = map[string]Signature{}
+		}
+		res[b][k] = s
+	}
+	for b, keys := range written {
+		for k, v := range keys {
+			add(b, k, v, false)
+		}
+	}
+	for b, keys := range removed {
+		for _, k := range keys {
+			if _, rewritten := written[b][k]; rewritten {
+				continue
+			}
+			add(b, k, "", true)
+		}
+	}
+	return res
+}
+
+// signatures returns the signatures of the entries of the storage: the ones
+// of the entries unchanged since the previous block are kept, the others
+// are taken from fresh. The recent tombstones of the removed entries are kept.
+func signatures(storage map[string]map[string]Data, prev Block, fresh map[string]map[string]Signature) map[string]map[string]Signature {
+	res := map[string]map[string]Signature{}
+	set := func(b, k string, s Signature) {
+		if _, exists := res[b]; !exists {
+			res[b] = map[string]Signature{}
+		}
+		res[b][k] = s
+	}
+
+	for b, keys := range storage {
+		for k, v := range keys {
+			if s, ok := prev.Signatures[b][k]; ok && !s.Deleted {
+				if pv, exists := prev.Storage[b][k]; exists && pv == v {
+					set(b, k, s)
+					continue
+				}
+			}
+			if s, ok := fresh[b][k]; ok && !s.Deleted {
+				set(b, k, s)
+			}
+		}
+	}
+
+	expired := time.Now().Add(-tombstoneTTL).UnixNano()
+	for _, sigs := range []map[string]map[string]Signature{fresh, prev.Signatures} {
+		for b, keys := range sigs {
+			for k, s := range keys {
+				if _, exists := storage[b][k]; exists || !s.Deleted || s.Timestamp < expired {
+					continue
+				}
+				if _, exists := res[b][k]; !exists {
+					set(b, k, s)
+				}
+			}
+		}
+	}
+
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"io"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+)
+
+var _ = Describe("Ledger signatures", func() {
+	// sign "signs" with the digest itself, to check what is signed
+	sign := func(dat []byte) ([]byte, error) { return dat, nil }
+
+	It("signs the entries written by the node", func() {
+		l := New(io.Discard, &MemoryStore{})
+		l.SetAuthor("peerA")
+		l.SetSigner(sign)
+
+		l.Add("routes", map[string]interface{}{"a": "1", "b": "2"})
+		s, ok := l.LastBlock().Signatures["routes"]["a"]
+		Expect(ok).To(BeTrue())
+		Expect(s.Author).To(Equal("peerA"))
+		Expect(s.Signature).To(Equal(s.Digest("routes", "a", l.LastBlock().Storage["routes"]["a"])))
+
+		// Unchanged entries keep their signatures
+		l.Add("routes", map[string]interface{}{"b": "3"})
+		Expect(l.LastBlock().Signatures["routes"]["a"]).To(Equal(s))
+
+		// Removed entries leave a tombstone, until written again
+		l.Delete("routes", "a")
+		Expect(l.LastBlock().Signatures["routes"]["a"].Deleted).To(BeTrue())
+		l.Add("routes", map[string]interface{}{"a": "4"})
+		Expect(l.LastBlock().Signatures["routes"]["a"].Deleted).To(BeFalse())
+
+		l.DeleteBucket("routes")
+		Expect(l.LastBlock().Signatures["routes"]).To(HaveLen(2))
+	})
+
+	It("keeps the signatures of the blocks received", func() {
+		w := &lastWrite{}
+		remote := New(w, &MemoryStore{})
+		remote.SetAuthor("peerA")
+		remote.SetSigner(sign)
+		remote.Add("routes", map[string]interface{}{"a": "1"})
+
+		l := New(io.Discard, &MemoryStore{})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "peerB"}, nil)).To(Succeed())
+		Expect(l.LastBlock().Signatures).To(Equal(remote.LastBlock().Signatures))
+
+		// Entries reverted by a validator keep the local signature
+		l.SetValidator("routes", func(string, []byte) error { return io.EOF })
+		remote.Add("routes", map[string]interface{}{"a": "2"})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "peerB"}, nil)).To(Succeed())
+		Expect(l.LastBlock().Storage["routes"]["a"]).To(Equal(Data(`"1"`)))
+		Expect(l.LastBlock().Signatures["routes"]["a"].Digest("routes", "a", `"1"`)).To(Equal(l.LastBlock().Signatures["routes"]["a"].Signature))
+	})
+
+	It("does not sign without a signer", func() {
+		l := New(io.Discard, &MemoryStore{})
+		l.Add("routes", map[string]interface{}{"a": "1"})
+		Expect(l.LastBlock().Signatures).To(BeNil())
+	})
+})
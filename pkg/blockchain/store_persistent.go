@@ -0,0 +1,77 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/mudler/edgevpn/pkg/store"
+)
+
+// ledgerNamespace is the namespace of the blockchain in the store. Blocks are
+// kept at the root, with the same layout of DiskStore.
+const ledgerNamespace = ""
+
+// PersistentStore keeps the blockchain in a store.Store,
+// caching the last block in memory
+type PersistentStore struct {
+	sync.Mutex
+	store store.Store
+	last  *Block
+}
+
+func NewPersistentStore(s store.Store) *PersistentStore {
+	return &PersistentStore{store: s}
+}
+
+func (m *PersistentStore) Add(b Block) {
+	m.Lock()
+	defer m.Unlock()
+	bb, _ := json.Marshal(b)
+	m.store.Put(ledgerNamespace, fmt.Sprint(b.Index), bb)
+	m.store.Put(ledgerNamespace, "index", []byte(fmt.Sprint(b.Index)))
+	m.last = &b
+}
+
+func (m *PersistentStore) Len() int {
+	return m.Last().Index
+}
+
+func (m *PersistentStore) Last() Block {
+	m.Lock()
+	defer m.Unlock()
+	if m.last != nil {
+		return *m.last
+	}
+
+	b := &Block{}
+	index, err := m.store.Get(ledgerNamespace, "index")
+	if err != nil {
+		return *b
+	}
+	if _, err := strconv.Atoi(string(index)); err != nil {
+		return *b
+	}
+	dat, err := m.store.Get(ledgerNamespace, string(index))
+	if err != nil {
+		return *b
+	}
+	if err := json.Unmarshal(dat, b); err == nil {
+		m.last = b
+	}
+	return *b
+}
@@ -0,0 +1,37 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/store"
+)
+
+var _ = Describe("PersistentStore", func() {
+	It("restores the last block from the store", func() {
+		s := store.NewMemory()
+
+		p := NewPersistentStore(s)
+		Expect(p.Len()).To(Equal(0))
+		p.Add(Block{Index: 1, Hash: "foo"})
+		p.Add(Block{Index: 2, Hash: "bar"})
+
+		restored := NewPersistentStore(s)
+		Expect(restored.Len()).To(Equal(2))
+		Expect(restored.Last().Hash).To(Equal("bar"))
+	})
+})
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-log"
+)
+
+var defaultLogger log.StandardLogger = log.Logger("ledger")
+
+// Validator checks the value written to a key of a bucket, and returns
+// an error if it is not acceptable
+type Validator func(key string, value []byte) error
+
+// SetValidator sets the validator of the values written to the bucket,
+// both by the node and by the other peers. The invalid values of the
+// blocks of the other peers are dropped. A nil validator removes it.
+func (l *Ledger) SetValidator(bucket string, v Validator) {
+	l.Lock()
+	defer l.Unlock()
+	if l.validators == nil {
+		l.validators = map[string]Validator{}
+	}
+	if v == nil {
+		delete(l.validators, bucket)
+		return
+	}
+	l.validators[bucket] = v
+}
+
+func (l *Ledger) validator(bucket string) Validator {
+	l.Lock()
+	defer l.Unlock()
+	return l.validators[bucket]
+}
+
+// Validate checks the value against the validator of the bucket, if any
+func (l *Ledger) Validate(bucket, key string, value Data) error {
+	if s, ok := l.scoped(bucket); ok {
+		return s.Validate(bucket, key, value)
+	}
+	if v := l.validator(bucket); v != nil {
+		if err := v(key, []byte(value)); err != nil {
+			return fmt.Errorf("invalid value for %s/%s: %w", bucket, key, err)
+		}
+	}
+	return nil
+}
+
+// validateChanges validates the values of incoming which are new or differ
+// from current, with the ledger locked. The invalid values are replaced by
+// the current ones, or dropped if new, rather than refusing the block: the
+// next blocks carry them too, and the validators are local to the node.
+// It returns the errors of the values replaced or dropped.
+func (l *Ledger) validateChanges(current, incoming map[string]map[string]Data) (errs []error) {
+	for b, keys := range incoming {
+		v := l.validators[b]
+		if v == nil {
+			continue
+		}
+		for k, value := range keys {
+			old, exists := current[b][k]
+			if exists && old == value {
+				continue
+			}
+			if err := v(k, []byte(value)); err != nil {
+				errs = append(errs, fmt.Errorf("invalid value for %s/%s: %w", b, k, err))
+				if exists {
+					keys[k] = old
+				} else {
+					delete(keys, k)
+				}
+			}
+		}
+	}
+	return
+}
+
+// SetLogger sets the logger of the ledger. It must be set before the ledger is used.
+func (l *Ledger) SetLogger(logger log.StandardLogger) {
+	l.logger = logger
+}
+
+func (l *Ledger) log() log.StandardLogger {
+	if l.logger == nil {
+		return defaultLogger
+	}
+	return l.logger
+}
+
+// rejected logs a write refused by a validator
+func (l *Ledger) rejected(err error) {
+	l.log().Warnf("rejected ledger write: %s", err.Error())
+}
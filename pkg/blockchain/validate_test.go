@@ -0,0 +1,136 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+)
+
+var _ = Describe("Ledger validators", func() {
+	// cidr accepts the keys which are CIDRs mapped to a peer
+	cidr := func(key string, value []byte) error {
+		if _, _, err := net.ParseCIDR(key); err != nil {
+			return err
+		}
+		var peer string
+		if err := json.Unmarshal(value, &peer); err != nil || peer == "" {
+			return fmt.Errorf("no peer for %s", key)
+		}
+		return nil
+	}
+
+	It("accepts the valid local writes", func() {
+		l := New(io.Discard, &MemoryStore{})
+		l.SetValidator("routes", cidr)
+		l.Add("routes", map[string]interface{}{"10.1.0.0/16": "peer"})
+		l.Commit(NewBatch().Put("routes", "10.2.0.0/16", "peer").Put("other", "key", ""))
+		Expect(l.CurrentData()["routes"]).To(HaveKey("10.1.0.0/16"))
+		Expect(l.CurrentData()["routes"]).To(HaveKey("10.2.0.0/16"))
+		Expect(l.CurrentData()["other"]).To(HaveKey("key"))
+	})
+
+	It("rejects the invalid local writes", func() {
+		l := New(io.Discard, &MemoryStore{})
+		l.SetValidator("routes", cidr)
+		index := l.Index()
+		l.Add("routes", map[string]interface{}{"10.1.0.0/16": "peer", "nonsense": "peer"})
+		l.Commit(NewBatch().Put("other", "key", "").Put("routes", "10.2.0.0/16", ""))
+		Expect(l.Index()).To(Equal(index))
+		Expect(l.CurrentData()).To(BeEmpty())
+		Expect(l.Validate("routes", "10.3.0.0/16", Data(`"peer"`))).To(Succeed())
+		Expect(l.Validate("routes", "10.3.0.0/16", Data(`""`))).ToNot(Succeed())
+	})
+
+	It("validates the blocks received from other peers", func() {
+		w := &lastWrite{}
+		remote := New(w, &MemoryStore{})
+		l := New(io.Discard, &MemoryStore{})
+		l.SetValidator("routes", cidr)
+
+		remote.Add("routes", map[string]interface{}{"10.1.0.0/16": "peer"})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+		Expect(l.CurrentData()["routes"]).To(HaveKey("10.1.0.0/16"))
+
+		// The invalid values are dropped, and the rest of the block is kept
+		remote.Add("routes", map[string]interface{}{"nonsense": "peer"})
+		remote.Add("other", map[string]interface{}{"key": "value"})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+		Expect(l.CurrentData()["routes"]).ToNot(HaveKey("nonsense"))
+		Expect(l.CurrentData()["other"]).To(HaveKey("key"))
+
+		// The next blocks carrying them are still accepted
+		remote.Add("routes", map[string]interface{}{"10.2.0.0/16": "peer"})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+		Expect(l.CurrentData()["routes"]).To(HaveKey("10.2.0.0/16"))
+		Expect(l.CurrentData()["routes"]).ToNot(HaveKey("nonsense"))
+		last := l.LastBlock()
+		Expect(last.Checksum()).To(Equal(last.Hash))
+	})
+
+	It("keeps the current values replaced by invalid ones", func() {
+		w := &lastWrite{}
+		remote := New(w, &MemoryStore{})
+		l := New(io.Discard, &MemoryStore{})
+		l.SetValidator("routes", cidr)
+
+		remote.Add("routes", map[string]interface{}{"10.1.0.0/16": "peer"})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+
+		remote.Add("routes", map[string]interface{}{"10.1.0.0/16": ""})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+		v, exists := l.GetKey("routes", "10.1.0.0/16")
+		Expect(exists).To(BeTrue())
+		Expect(v).To(Equal(Data(`"peer"`)))
+	})
+
+	It("does not validate the values which did not change", func() {
+		w := &lastWrite{}
+		remote := New(w, &MemoryStore{})
+		l := New(io.Discard, &MemoryStore{})
+
+		remote.Add("routes", map[string]interface{}{"legacy": "peer"})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+
+		l.SetValidator("routes", cidr)
+		remote.Add("routes", map[string]interface{}{"10.1.0.0/16": "peer"})
+		Expect(l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)).To(Succeed())
+		Expect(l.CurrentData()["routes"]).To(HaveKey("10.1.0.0/16"))
+	})
+
+	It("flags as malformed only the blocks which can't be decoded", func() {
+		l := New(io.Discard, &MemoryStore{})
+		err := l.Update(nil, &hub.Message{Message: "garbage", AuthorID: "remote"}, nil)
+		Expect(errors.Is(err, hub.ErrMalformedMessage)).To(BeTrue())
+
+		w := &lastWrite{}
+		remote := New(w, &MemoryStore{})
+		remote.Add("routes", map[string]interface{}{"10.1.0.0/16": "peer"})
+		l.SetWriteAuthorizer(func(string, Block, Block) error {
+			return fmt.Errorf("not allowed")
+		})
+		err = l.Update(nil, &hub.Message{Message: string(w.data), AuthorID: "remote"}, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(err, hub.ErrMalformedMessage)).To(BeFalse())
+	})
+})
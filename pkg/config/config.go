@@ -16,6 +16,7 @@ package config
 import (
 	"fmt"
 	"math/bits"
+	"net"
 	"os"
 	"runtime"
 	"strings"
@@ -32,33 +33,54 @@ import (
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	"github.com/mudler/edgevpn/pkg/crypto"
 	"github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/events"
+	"github.com/mudler/edgevpn/pkg/flow"
 	"github.com/mudler/edgevpn/pkg/logger"
 	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/store"
 	"github.com/mudler/edgevpn/pkg/trustzone"
 	"github.com/mudler/edgevpn/pkg/trustzone/authprovider/ecdsa"
+	"github.com/mudler/edgevpn/pkg/utils"
 	"github.com/mudler/edgevpn/pkg/vpn"
 	"github.com/mudler/water"
 	"github.com/multiformats/go-multiaddr"
-	"github.com/peterbourgon/diskv"
+	"gopkg.in/yaml.v2"
 )
 
 // Config is the config struct for the node and the default EdgeVPN services
 // It is used to generate opts for the node and the services before start.
 type Config struct {
 	NetworkConfig, NetworkToken                string
+	NetworkName                                string
 	Address                                    string
+	IPv6                                       IPv6
 	Router                                     string
+	AdvertiseRoutes, AcceptRoutes              []string
+	ExitNodes                                  []string
 	Interface                                  string
 	Libp2pLogLevel, LogLevel                   string
 	LowProfile, BootstrapIface                 bool
+	SafeModeDetection                          bool
 	Blacklist                                  []string
 	Concurrency                                int
 	FrameTimeout                               string
+	BackpressureTimeout                        string
 	ChannelBufferSize, InterfaceMTU, PacketMTU int
+	BatchSize                                  int
+	Compression                                string
+	Offload                                    bool
+	StreamReopen                               StreamReopen
+	DeviceWrite                                DeviceWrite
+	Quarantine                                 Quarantine
+	FlowLog                                    FlowLog
+	Events                                     Events
+	ACL                                        ACL
 	NAT                                        NAT
 	Connection                                 Connection
 	Discovery                                  Discovery
 	Ledger                                     Ledger
+	Shutdown                                   Shutdown
 	Limit                                      ResourceLimit
 	Privkey                                    []byte
 	// PeerGuard (experimental)
@@ -84,16 +106,104 @@ type ResourceLimit struct {
 	FileLimit   string
 	LimitConfig *rcmgr.PartialLimitConfig
 	Scope       string
+	// ScopeLimits override the limits of Scope (system, transient or peer)
+	ScopeLimits rcmgr.ResourceLimits
 	MaxConns    int
 	StaticMin   int64
 	StaticMax   int64
 	Enable      bool
 }
 
+// StreamReopen is the configuration of the backoff used
+// when reopening VPN streams towards peers
+type StreamReopen struct {
+	Interval, MaxInterval time.Duration
+	MaxAttempts           int
+}
+
+// IPv6 is the configuration of the IPv6 address of the
+// interface, alongside the IPv4 one
+type IPv6 struct {
+	Enable bool
+	// Prefix is the prefix the address is derived from the peer ID in,
+	// by default the unique local prefix of the network
+	Prefix string
+	// Address is a static IPv6 address, in CIDR notation
+	Address string
+}
+
+// DeviceWrite is the handling of the errors writing the frames received
+// from the peers to the interface
+type DeviceWrite struct {
+	Retries       int
+	RetryInterval time.Duration
+	MaxFailures   int
+}
+
+// Quarantine is the configuration of the quarantine of
+// peers sending malformed data
+type Quarantine struct {
+	Enable           bool
+	Threshold        int
+	Window, Cooldown time.Duration
+}
+
+// ACL is the configuration of the ledger write permissions
+type ACL struct {
+	// Admins are the peer IDs trusted to sign the ACL policy.
+	// Empty disables the write permissions
+	Admins []string `yaml:"admins"`
+	// PolicyFile is a YAML policy which is signed and announced by this node (admins only)
+	PolicyFile string `yaml:"policy"`
+	// FirewallDenyByDefault drops the VPN packets matching no firewall rule.
+	// The firewall rules are enforced when Admins are set.
+	FirewallDenyByDefault bool `yaml:"firewall_deny_by_default"`
+}
+
+// FlowLog is the configuration of the flow logs exporter
+type FlowLog struct {
+	// Collector is the address to ship the flow logs to
+	// (udp://, tcp://, http(s):// or file://). Empty disables flow logs
+	Collector string
+	// RateLimit is the max number of flow logs shipped per second
+	RateLimit int
+
+	// Rotation limits the files written by a file:// collector
+	Rotation utils.Rotation
+}
+
+// Events is the configuration of the node events exporter
+type Events struct {
+	// Broker is the address to publish the events to (mqtt://),
+	// the path being the topic prefix. Empty disables the events
+	Broker string
+}
+
 // Ledger is the ledger configuration structure
 type Ledger struct {
 	AnnounceInterval, SyncInterval time.Duration
 	StateDir                       string
+
+	// History is the number of versions retained for the keys of each bucket
+	History map[string]int
+
+	// Scopes maps the buckets to the scope they are gossiped in
+	Scopes map[string]string
+
+	// ClearKeys leaves the buckets and keys of the exchanged blocks in cleartext
+	ClearKeys bool
+
+	// BatchWindow coalesces the blocks written within the window into one message
+	BatchWindow time.Duration
+	// CompressionLevel is the gzip level of the messages, the default one is used when 0
+	CompressionLevel int
+}
+
+// Shutdown bounds the time the node takes to shut down
+type Shutdown struct {
+	Timeout time.Duration
+	// Phases overrides the budget of single shutdown phases
+	Phases map[string]time.Duration
 }
 
 // Discovery allows to enable/disable discovery and
@@ -102,6 +212,74 @@ type Discovery struct {
 	DHT, MDNS      bool
 	BootstrapPeers []string
 	Interval       time.Duration
+	MaxPeers       int
+	CanaryTimeout  time.Duration
+	// MinInterval enables the adaptive discovery interval,
+	// varying between MinInterval and Interval
+	MinInterval time.Duration
+	// DialBackoff is the initial time peers failing to dial are skipped for
+	DialBackoff time.Duration
+	// IPFSBootstrap adds the bootstrap peers of the local IPFS config
+	IPFSBootstrap bool
+	// RendezvousServers are searched for peers when none is found on the DHT
+	RendezvousServers []string
+	// RendezvousServer serves the rendezvous protocol to the other nodes
+	RendezvousServer bool
+	// MaxQueries limits the concurrent peer searches on the DHT, 0 means no limit
+	MaxQueries int
+	// MaxConnections caps the new connections of each discovery cycle, 0 means no limit
+	MaxConnections int
+	// DialConcurrency bounds the peers dialed at once, 0 dials them one at a time
+	DialConcurrency int
+	// LocalPeers is the number of peers found with mDNS above which the DHT
+	// discovery interval is stretched by LocalScaleFactor, 0 disables it
+	LocalPeers, LocalScaleFactor int
+	// ProtocolPrefix makes the nodes run a private DHT with this protocol prefix
+	ProtocolPrefix string
+	// PrivateNetwork runs a private DHT with a prefix derived from the token,
+	// and refuses the peers not proving the knowledge of the OTP rendezvous
+	PrivateNetwork bool
+	// BandwidthBudget caps the bytes of the DHT streams within BandwidthWindow,
+	// over which the discovery is skipped. 0 means no limit
+	BandwidthBudget int64
+	BandwidthWindow time.Duration
+	// BootstrapPolicy is applied when no bootstrap peer is reachable:
+	// warn, retry, fallback or fail
+	BootstrapPolicy      string
+	BootstrapTimeout     time.Duration
+	BootstrapFallbackURL string
+	// BootstrapDNS are domains whose dnsaddr records list bootstrap
+	// peers, resolved again on every discovery cycle
+	BootstrapDNS []string
+
+	// DiagnoseAfter is the number of discovery rounds finding no peer, with a
+	// healthy DHT, after which the node warns of misconfigured OTP parameters
+	DiagnoseAfter int
+	// OTPWindowTolerance is the number of OTP intervals before and after the
+	// current one to also announce and search on, to tolerate clock skew
+	OTPWindowTolerance int
+	// DHTMode is the mode of the DHT: auto, server or client
+	DHTMode string
+	// InsecureFixedRendezvous replaces the OTP rendezvous, for tests only
+	InsecureFixedRendezvous string
+	// PeerCache persists the peers met in the ledger state directory,
+	// to dial them on start
+	PeerCache bool
+
+	// PeerExchange shares the connected peers with the other nodes, and dials theirs
+	PeerExchange bool
+	// PeerExchangeInterval is the time between the exchanges
+	PeerExchangeInterval time.Duration
+	// PeerExchangeSampleSize caps the peers shared with each exchange
+	PeerExchangeSampleSize int
+	// PeerExchangeBootstrap swaps the reachable bootstrap peers with the
+	// other nodes, and dials the learned ones along with the configured ones
+	PeerExchangeBootstrap bool
+	// PeerExchangeBootstrapMax caps the learned bootstrap peers
+	PeerExchangeBootstrapMax int
+	// PeerExchangeBootstrapSources is how many nodes must share a
+	// bootstrap peer before it is dialed
+	PeerExchangeBootstrapSources int
 }
 
 // Connection is the configuration section
@@ -120,6 +298,32 @@ type Connection struct {
 
 	LowWater  int
 	HighWater int
+
+	// Uplinks maps the local source addresses to distribute
+	// the outbound connections across, to their weight
+	Uplinks map[string]int
+
+	// SourcePorts is the range of local ports the outbound TCP connections
+	// originate from, in the form min-max
+	SourcePorts string
+
+	// TorProxy is the SOCKS address of a Tor daemon to dial the onion addresses through
+	TorProxy string
+
+	// TorOnly dials all the connections through the Tor proxy
+	TorOnly bool
+
+	// OnionAddresses are the addresses of the hidden services
+	// forwarding to the node, announced to the other peers
+	OnionAddresses []string
+
+	// PinnedKeys are the public keys the peers must present
+	// to connect, in the form <peer ID>=<base64 public key>
+	PinnedKeys []string
+
+	// MaxInboundPerIP caps the concurrent inbound connections
+	// from each remote IP, 0 means no limit
+	MaxInboundPerIP int
 }
 
 // NAT is the structure relative to NAT configuration settings
@@ -150,6 +354,15 @@ func peers2List(peers []string) discovery.AddrList {
 	return addrsList
 }
 
+func containsAddr(al discovery.AddrList, a multiaddr.Multiaddr) bool {
+	for _, aa := range al {
+		if aa.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
+
 func peers2AddrInfo(peers []string) []peer.AddrInfo {
 	addrsList := []peer.AddrInfo{}
 	for _, p := range peers {
@@ -178,6 +391,10 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 	logLevel := c.LogLevel
 	libp2plogLevel := c.Libp2pLogLevel
 	dhtE, mDNS := c.Discovery.DHT, c.Discovery.MDNS
+	if c.Connection.TorOnly {
+		// mDNS would announce the node on the local network
+		mDNS = false
+	}
 
 	ledgerState := c.Ledger.StateDir
 
@@ -199,6 +416,23 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 
 	addrsList := peers2List(peers)
 
+	if c.Discovery.IPFSBootstrap {
+		ipfsPeers, err := discovery.IPFSBootstrapPeers(discovery.IPFSConfigPath())
+		if err != nil {
+			llger.Warnf("could not read bootstrap peers from the IPFS config: %s", err.Error())
+		} else {
+			// Merge with the default peers if none were specified
+			if len(addrsList) == 0 {
+				addrsList = append(addrsList, dht.DefaultBootstrapPeers...)
+			}
+			for _, p := range ipfsPeers {
+				if !containsAddr(addrsList, p) {
+					addrsList = append(addrsList, p)
+				}
+			}
+		}
+	}
+
 	dhtOpts := []dht.Option{}
 
 	if c.LowProfile {
@@ -209,10 +443,34 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 
 	opts := []node.Option{
 		node.WithDiscoveryInterval(c.Discovery.Interval),
+		node.WithAdaptiveDiscoveryInterval(c.Discovery.MinInterval),
+		node.WithDiscoveryMaxPeers(c.Discovery.MaxPeers),
+		node.WithDiscoveryMaxConnections(c.Discovery.MaxConnections),
+		node.WithDiscoveryDialConcurrency(c.Discovery.DialConcurrency),
+		node.WithDiscoveryLocalPeers(c.Discovery.LocalPeers, c.Discovery.LocalScaleFactor),
+		node.WithDiscoveryProtocolPrefix(c.Discovery.ProtocolPrefix),
+		node.WithPrivateNetwork(c.Discovery.PrivateNetwork),
+		node.WithDiscoveryBandwidthBudget(c.Discovery.BandwidthBudget, c.Discovery.BandwidthWindow),
+		node.WithDiscoveryDiagnoseAfter(c.Discovery.DiagnoseAfter),
+		node.WithDiscoveryOTPWindowTolerance(c.Discovery.OTPWindowTolerance),
+		node.WithDiscoveryDHTMode(c.Discovery.DHTMode),
+		node.WithInsecureFixedRendezvous(c.Discovery.InsecureFixedRendezvous),
+		node.WithDiscoveryCanary(c.Discovery.CanaryTimeout),
+		node.WithDiscoveryDialBackoff(c.Discovery.DialBackoff),
+		node.WithDiscoveryPeerCache(c.Discovery.PeerCache),
+		node.WithDiscoveryMaxQueries(c.Discovery.MaxQueries),
+		node.WithDiscoveryBootstrapPolicy(c.Discovery.BootstrapPolicy, c.Discovery.BootstrapTimeout, c.Discovery.BootstrapFallbackURL),
 		node.WithLedgerAnnounceTime(c.Ledger.AnnounceInterval),
 		node.WithLedgerInterval(c.Ledger.SyncInterval),
+		node.WithLedgerHistory(c.Ledger.History),
+		node.WithLedgerClearKeys(c.Ledger.ClearKeys),
+		node.WithLedgerBatchWindow(c.Ledger.BatchWindow),
+		node.WithLedgerCompressionLevel(c.Ledger.CompressionLevel),
+		node.WithShutdownTimeout(c.Shutdown.Timeout, c.Shutdown.Phases),
 		node.Logger(llger),
+		node.WithNetworkName(c.NetworkName),
 		node.WithDiscoveryBootstrapPeers(addrsList),
+		node.WithDiscoveryRendezvousServers(peers2List(c.Discovery.RendezvousServers)),
 		node.WithBlacklist(c.Blacklist...),
 		node.LibP2PLogLevel(libp2plvl),
 		node.WithInterfaceAddress(address),
@@ -221,10 +479,22 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 		node.FromYaml(mDNS, dhtE, config, d, m),
 	}
 
+	if len(c.Discovery.BootstrapDNS) > 0 {
+		p, err := discovery.NewDNSProvider(c.Discovery.BootstrapDNS...)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, node.WithDiscoveryProviders(p))
+	}
+
 	for ip, peer := range c.Connection.PeerTable {
 		opts = append(opts, node.WithStaticPeer(ip, peer))
 	}
 
+	for bucket, scope := range c.Ledger.Scopes {
+		opts = append(opts, node.WithLedgerScope(scope, bucket))
+	}
+
 	if len(c.Privkey) > 0 {
 		opts = append(opts, node.WithPrivKey(c.Privkey))
 	}
@@ -232,16 +502,34 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 	vpnOpts := []vpn.Option{
 		vpn.WithConcurrency(c.Concurrency),
 		vpn.WithInterfaceAddress(address),
+		vpn.WithIPv6(c.IPv6.Enable),
+		vpn.WithIPv6Prefix(c.IPv6.Prefix),
+		vpn.WithInterfaceAddress6(c.IPv6.Address),
 		vpn.WithLedgerAnnounceTime(c.Ledger.AnnounceInterval),
 		vpn.Logger(llger),
 		vpn.WithTimeout(c.FrameTimeout),
 		vpn.WithInterfaceType(water.TUN),
 		vpn.NetLinkBootstrap(c.BootstrapIface),
 		vpn.WithChannelBufferSize(c.ChannelBufferSize),
+		vpn.WithBackpressureTimeout(c.BackpressureTimeout),
+		vpn.WithBatchSize(c.BatchSize),
+		vpn.WithCompression(c.Compression),
+		vpn.WithOffload(c.Offload),
 		vpn.WithInterfaceMTU(c.InterfaceMTU),
 		vpn.WithPacketMTU(c.PacketMTU),
 		vpn.WithRouterAddress(router),
+		vpn.WithAdvertisedRoutes(c.AdvertiseRoutes...),
+		vpn.WithAcceptedRoutes(c.AcceptRoutes...),
+		vpn.WithExitNodes(c.ExitNodes...),
 		vpn.WithInterfaceName(iface),
+		vpn.WithStreamReopenBackoff(c.StreamReopen.Interval, c.StreamReopen.MaxInterval),
+		vpn.WithStreamReopenMaxAttempts(c.StreamReopen.MaxAttempts),
+		vpn.WithWriteRetries(c.DeviceWrite.Retries, c.DeviceWrite.RetryInterval),
+		vpn.WithWriteMaxFailures(c.DeviceWrite.MaxFailures),
+	}
+
+	if c.SafeModeDetection {
+		vpnOpts = append(vpnOpts, vpn.SafeModeDetection)
 	}
 
 	libp2pOpts := []libp2p.Option{libp2p.UserAgent("edgevpn")}
@@ -295,6 +583,7 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 		llger.Info("go-libp2p resource manager protection enabled")
 
 		var limiter rcmgr.Limiter
+		var limits rcmgr.ConcreteLimitConfig
 
 		if c.Limit.FileLimit != "" {
 			limitFile, err := os.Open(c.Limit.FileLimit)
@@ -389,10 +678,7 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 			}
 
 			// Create our limits by using our cfg and replacing the default values with values from `scaledDefaultLimits`
-			limits := cfg.Build(scaledDefaultLimits)
-
-			// The resource manager expects a limiter, se we create one from our limits.
-			limiter = rcmgr.NewFixedLimiter(limits)
+			limits = cfg.Build(scaledDefaultLimits)
 
 		} else if c.Limit.MaxConns != 0 {
 			min := int64(1 << 30)
@@ -405,10 +691,8 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 			}
 			maxconns := int(c.Limit.MaxConns)
 
-			defaultLimits := rcmgr.DefaultLimits.Scale(min+max/2, logScale(2*maxconns))
+			limits = rcmgr.DefaultLimits.Scale(min+max/2, logScale(2*maxconns))
 			llger.Infof("max connections: %d", c.Limit.MaxConns)
-
-			limiter = rcmgr.NewFixedLimiter(defaultLimits)
 		} else {
 			llger.Infof("max connections: defaults limits")
 
@@ -416,7 +700,17 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 			def := &defaults
 
 			libp2p.SetDefaultServiceLimits(def)
-			limiter = rcmgr.NewFixedLimiter(def.AutoScale())
+			limits = def.AutoScale()
+		}
+
+		if limiter == nil {
+			// Override the scaled limits with the configured ones
+			partial, err := c.Limit.PartialLimitConfig()
+			if err != nil {
+				return opts, vpnOpts, err
+			}
+			// The resource manager expects a limiter, se we create one from our limits.
+			limiter = rcmgr.NewFixedLimiter(partial.Build(limits))
 		}
 
 		rc, err := rcmgr.NewResourceManager(limiter, rcmgr.WithAllowlistedMultiaddrs(c.Whitelist))
@@ -428,7 +722,39 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 	}
 
 	if c.Connection.HolePunch {
-		libp2pOpts = append(libp2pOpts, libp2p.EnableHolePunching())
+		opts = append(opts, node.EnableHolePunching)
+	}
+
+	for a, w := range c.Connection.Uplinks {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid uplink address '%s'", a)
+		}
+		opts = append(opts, node.WithUplinks(node.Uplink{Address: ip, Weight: w}))
+	}
+
+	if c.Connection.SourcePorts != "" {
+		r, err := node.ParsePortRange(c.Connection.SourcePorts)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, node.WithSourcePorts(r.Min, r.Max))
+	}
+
+	if c.Connection.TorProxy != "" || c.Connection.TorOnly {
+		opts = append(opts, node.WithTorProxy(c.Connection.TorProxy, c.Connection.TorOnly))
+	}
+
+	if len(c.Connection.OnionAddresses) > 0 {
+		opts = append(opts, node.WithOnionAddresses(c.Connection.OnionAddresses...))
+	}
+
+	if len(c.Connection.PinnedKeys) > 0 {
+		opts = append(opts, node.WithPinnedKeys(c.Connection.PinnedKeys...))
+	}
+
+	if c.Connection.MaxInboundPerIP > 0 {
+		opts = append(opts, node.WithMaxInboundPerIP(c.Connection.MaxInboundPerIP))
 	}
 
 	if c.NAT.Service {
@@ -442,14 +768,83 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 	opts = append(opts, node.WithLibp2pOptions(libp2pOpts...))
 
 	if ledgerState != "" {
-		opts = append(opts, node.WithStore(blockchain.NewDiskStore(diskv.New(diskv.Options{
-			BasePath:     ledgerState,
-			CacheSizeMax: uint64(50), // 50MB
-		}))))
+		state := store.NewFilesystem(ledgerState)
+		opts = append(opts, node.WithStore(blockchain.NewPersistentStore(state)), node.WithStateStore(state))
 	} else {
 		opts = append(opts, node.WithStore(&blockchain.MemoryStore{}))
 	}
 
+	if c.Discovery.RendezvousServer {
+		rendezvous := discovery.NewRendezvousServer()
+		opts = append(opts, node.WithStreamHandler(protocol.RendezvousProtocol,
+			func(*node.Node, *blockchain.Ledger) func(stream network.Stream) { return rendezvous.Handle }))
+	}
+
+	if c.Discovery.PeerExchange {
+		pex := &discovery.PeerExchange{
+			Interval:   c.Discovery.PeerExchangeInterval,
+			SampleSize: c.Discovery.PeerExchangeSampleSize,
+		}
+		if c.Discovery.PeerExchangeBootstrap {
+			pex.Bootstrap = discovery.NewLearnedBootstrap()
+			if c.Discovery.PeerExchangeBootstrapMax > 0 {
+				pex.Bootstrap.Max = c.Discovery.PeerExchangeBootstrapMax
+			}
+			if c.Discovery.PeerExchangeBootstrapSources > 0 {
+				pex.Bootstrap.MinSources = c.Discovery.PeerExchangeBootstrapSources
+			}
+		}
+		opts = append(opts, node.DiscoveryService(pex))
+	}
+
+	admins := []peer.ID{}
+	for _, a := range c.ACL.Admins {
+		id, err := peer.Decode(a)
+		if err != nil {
+			return opts, vpnOpts, fmt.Errorf("invalid ACL admin '%s': %w", a, err)
+		}
+		admins = append(admins, id)
+	}
+	if len(admins) > 0 {
+		opts = append(opts, node.WithLedgerAuthorizer(trustzone.NewACL(admins...).Authorize))
+	}
+	if len(admins) > 0 || c.ACL.FirewallDenyByDefault {
+		vpnOpts = append(vpnOpts, vpn.WithFirewall(c.ACL.FirewallDenyByDefault, admins...))
+	}
+
+	if c.ACL.PolicyFile != "" {
+		dat, err := os.ReadFile(c.ACL.PolicyFile)
+		if err != nil {
+			return opts, vpnOpts, err
+		}
+		policy := trustzone.Policy{}
+		if err := yaml.Unmarshal(dat, &policy); err != nil {
+			return opts, vpnOpts, fmt.Errorf("invalid ACL policy: %w", err)
+		}
+		opts = append(opts, node.WithNetworkService(trustzone.ACLPolicyNetworkService(c.Ledger.AnnounceInterval, policy)))
+	}
+
+	if c.FlowLog.Collector != "" {
+		fe, err := flow.NewExporter(c.FlowLog.Collector, c.FlowLog.RateLimit, llger)
+		if err != nil {
+			return opts, vpnOpts, err
+		}
+		fe.SetRotation(c.FlowLog.Rotation)
+		opts = append(opts, node.WithFlowExporter(fe))
+	}
+
+	if c.Events.Broker != "" {
+		sink, err := events.NewSinkFromURL(c.Events.Broker, llger)
+		if err != nil {
+			return opts, vpnOpts, err
+		}
+		opts = append(opts, node.WithEventSink(sink))
+	}
+
+	if c.Quarantine.Enable {
+		opts = append(opts, node.WithQuarantine(node.NewQuarantine(c.Quarantine.Threshold, c.Quarantine.Window, c.Quarantine.Cooldown)))
+	}
+
 	if c.PeerGuard.Enable {
 		pg := trustzone.NewPeerGater(c.PeerGuard.Relaxed)
 		dur := c.PeerGuard.SyncInterval
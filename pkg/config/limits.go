@@ -0,0 +1,131 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+// Resource manager scopes which can be limited with ScopeLimits
+const (
+	LimitScopeSystem    = "system"
+	LimitScopeTransient = "transient"
+	LimitScopePeer      = "peer"
+)
+
+// PartialLimitConfig returns the limits overriding the scaled ones of the
+// resource manager: LimitConfig, with the ScopeLimits of Scope on top
+func (r ResourceLimit) PartialLimitConfig() (*rcmgr.PartialLimitConfig, error) {
+	cfg := rcmgr.PartialLimitConfig{}
+	if r.LimitConfig != nil {
+		cfg = *r.LimitConfig
+	}
+
+	if !r.ScopeLimits.IsDefault() {
+		switch r.Scope {
+		case LimitScopeSystem, "":
+			cfg.System = mergeLimits(cfg.System, r.ScopeLimits)
+		case LimitScopeTransient:
+			cfg.Transient = mergeLimits(cfg.Transient, r.ScopeLimits)
+		case LimitScopePeer:
+			cfg.PeerDefault = mergeLimits(cfg.PeerDefault, r.ScopeLimits)
+		default:
+			return nil, fmt.Errorf("invalid limit scope '%s', expected one of system, transient or peer", r.Scope)
+		}
+	}
+
+	if err := ValidateLimits(cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// mergeLimits returns the limits in l, overridden by the ones set in o
+func mergeLimits(l, o rcmgr.ResourceLimits) rcmgr.ResourceLimits {
+	o.Apply(l)
+	return o
+}
+
+// ValidateLimits checks the limits of the system, transient and peer scopes
+// for values which can't be satisfied
+func ValidateLimits(cfg rcmgr.PartialLimitConfig) error {
+	scopes := []struct {
+		name   string
+		limits rcmgr.ResourceLimits
+	}{
+		{LimitScopeSystem, cfg.System},
+		{LimitScopeTransient, cfg.Transient},
+		{LimitScopePeer, cfg.PeerDefault},
+	}
+	for _, s := range scopes {
+		if err := validateScopeLimits(s.limits); err != nil {
+			return fmt.Errorf("invalid %s limits: %w", s.name, err)
+		}
+	}
+
+	for _, s := range scopes[1:] {
+		for _, l := range []struct {
+			name          string
+			scope, system rcmgr.LimitVal
+		}{
+			{"connections", s.limits.Conns, cfg.System.Conns},
+			{"streams", s.limits.Streams, cfg.System.Streams},
+			{"file descriptors", s.limits.FD, cfg.System.FD},
+		} {
+			if l.scope > 0 && l.system > 0 && l.scope > l.system {
+				return fmt.Errorf("invalid %s limits: %d %s exceed the system limit of %d", s.name, l.scope, l.name, l.system)
+			}
+		}
+	}
+	return nil
+}
+
+func validateScopeLimits(l rcmgr.ResourceLimits) error {
+	for _, v := range []struct {
+		name string
+		val  rcmgr.LimitVal
+	}{
+		{"streams", l.Streams},
+		{"inbound streams", l.StreamsInbound},
+		{"outbound streams", l.StreamsOutbound},
+		{"connections", l.Conns},
+		{"inbound connections", l.ConnsInbound},
+		{"outbound connections", l.ConnsOutbound},
+		{"file descriptors", l.FD},
+	} {
+		if v.val < rcmgr.BlockAllLimit {
+			return fmt.Errorf("%s: invalid value %d", v.name, v.val)
+		}
+	}
+	if l.Memory < rcmgr.BlockAllLimit64 {
+		return fmt.Errorf("memory: invalid value %d", l.Memory)
+	}
+
+	for _, v := range []struct {
+		name             string
+		directed, totals rcmgr.LimitVal
+	}{
+		{"inbound streams", l.StreamsInbound, l.Streams},
+		{"outbound streams", l.StreamsOutbound, l.Streams},
+		{"inbound connections", l.ConnsInbound, l.Conns},
+		{"outbound connections", l.ConnsOutbound, l.Conns},
+	} {
+		if v.directed > 0 && v.totals > 0 && v.directed > v.totals {
+			return fmt.Errorf("%d %s exceed the total of %d", v.directed, v.name, v.totals)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"context"
+
+	"github.com/ipfs/go-log"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/config"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+)
+
+var _ = Describe("Resource limits", func() {
+	It("overrides the limits of the scope", func() {
+		l := ResourceLimit{Scope: LimitScopePeer, ScopeLimits: rcmgr.ResourceLimits{ConnsInbound: 4}}
+		cfg, err := l.PartialLimitConfig()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.PeerDefault.ConnsInbound).To(Equal(rcmgr.LimitVal(4)))
+		Expect(cfg.System.IsDefault()).To(BeTrue())
+	})
+
+	It("rejects invalid limits", func() {
+		for _, l := range []ResourceLimit{
+			{Scope: "foo", ScopeLimits: rcmgr.ResourceLimits{Conns: 10}},
+			{Scope: LimitScopeSystem, ScopeLimits: rcmgr.ResourceLimits{Conns: 10, ConnsInbound: 20}},
+			{Scope: LimitScopeSystem, ScopeLimits: rcmgr.ResourceLimits{Streams: -5}},
+			{
+				Scope:       LimitScopePeer,
+				ScopeLimits: rcmgr.ResourceLimits{Conns: 100},
+				LimitConfig: &rcmgr.PartialLimitConfig{System: rcmgr.ResourceLimits{Conns: 10}},
+			},
+		} {
+			_, err := l.PartialLimitConfig()
+			Expect(err).To(HaveOccurred(), "%+v", l)
+		}
+	})
+
+	It("applies the limits to the resource manager of the host", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		c := Config{
+			NetworkToken: node.GenerateNewConnectionData(25).Base64(),
+			LogLevel:     "fatal",
+			Limit: ResourceLimit{
+				Enable:      true,
+				Scope:       LimitScopeSystem,
+				ScopeLimits: rcmgr.ResourceLimits{Conns: 42, ConnsInbound: 21},
+			},
+		}
+		opts, _, err := c.ToOpts(logger.New(log.LevelFatal))
+		Expect(err).ToNot(HaveOccurred())
+
+		e, err := node.New(opts...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		defer e.Host().Close()
+
+		usage := e.ResourceUsage()
+		Expect(usage).ToNot(BeEmpty())
+		Expect(usage[0].Scope).To(Equal("system"))
+		Expect(usage[0].Limit).ToNot(BeNil())
+		Expect(usage[0].Limit.Conns).To(Equal(42))
+		Expect(usage[0].Limit.ConnsInbound).To(Equal(21))
+	})
+})
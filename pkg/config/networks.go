@@ -0,0 +1,141 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// maxInterfaceName is the longest name of an interface on Linux
+const maxInterfaceName = 15
+
+var networkName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Network is one of the networks joined by a node joining several networks
+// from the same process. Its settings replace the ones of the node.
+type Network struct {
+	// Name is the local name of the network, which namespaces its API,
+	// its ledger state and its interface
+	Name string `yaml:"name"`
+	// Config is the path to the config of the network, or Token its token
+	Config string `yaml:"config"`
+	Token  string `yaml:"token"`
+	// Address is the VPN address of the node in the network, in CIDR notation
+	Address string `yaml:"address"`
+	// Interface is the name of the VPN interface of the network,
+	// by default NetworkInterface(Name)
+	Interface string `yaml:"interface"`
+	// Router sends all the packets of the network to this node
+	Router string `yaml:"router"`
+	// ACL is the configuration of the write permissions and of the
+	// firewall of the network
+	ACL ACL `yaml:"acl"`
+	// AdvertiseRoutes, AcceptRoutes and ExitNodes are the routes of the
+	// network, see the ones of Config
+	AdvertiseRoutes []string `yaml:"advertise_routes"`
+	AcceptRoutes    []string `yaml:"accept_routes"`
+	ExitNodes       []string `yaml:"exit_nodes"`
+}
+
+// NetworkInterface returns the default name of the interface of the network
+func NetworkInterface(name string) string {
+	iface := "edgevpn-" + name
+	if len(iface) > maxInterfaceName {
+		iface = iface[:maxInterfaceName]
+	}
+	return iface
+}
+
+// LoadNetworks reads the networks from the YAML file at path, e.g.:
+//
+//	networks:
+//	- name: office
+//	  config: /etc/edgevpn/office.yaml
+//	  address: 10.1.0.1/24
+//	  acl:
+//	    admins: [<peer ID>]
+//	    firewall_deny_by_default: true
+//	  accept_routes: [192.168.0.0/16]
+//	- name: lab
+//	  token: <token>
+//	  address: 10.2.0.1/24
+func LoadNetworks(path string) ([]Network, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := struct {
+		Networks []Network `yaml:"networks"`
+	}{}
+	if err := yaml.Unmarshal(dat, &file); err != nil {
+		return nil, fmt.Errorf("invalid networks file: %w", err)
+	}
+	if len(file.Networks) == 0 {
+		return nil, fmt.Errorf("no networks in %s", path)
+	}
+
+	names, interfaces := map[string]bool{}, map[string]string{}
+	for i, n := range file.Networks {
+		if !networkName.MatchString(n.Name) {
+			return nil, fmt.Errorf("invalid network name '%s': use letters, digits, '-' and '_'", n.Name)
+		}
+		if names[n.Name] {
+			return nil, fmt.Errorf("network '%s' is listed more than once", n.Name)
+		}
+		names[n.Name] = true
+		if (n.Config == "") == (n.Token == "") {
+			return nil, fmt.Errorf("network '%s' needs either a config or a token", n.Name)
+		}
+		if _, _, err := net.ParseCIDR(n.Address); err != nil {
+			return nil, fmt.Errorf("network '%s' needs an address in CIDR notation: %w", n.Name, err)
+		}
+		if n.Interface == "" {
+			file.Networks[i].Interface = NetworkInterface(n.Name)
+		}
+		iface := file.Networks[i].Interface
+		if other, ok := interfaces[iface]; ok {
+			return nil, fmt.Errorf("networks '%s' and '%s' use the same interface '%s', set the interface of one of them", other, n.Name, iface)
+		}
+		interfaces[iface] = n.Name
+	}
+	return file.Networks, nil
+}
+
+// ForNetwork returns the config of the node in the network. The settings of
+// the network replace the ones of the node, the ACL and the routes included,
+// and the ledger state is kept in a directory of the network. The settings
+// which can't be the same in more networks (the static peer table, the IPv6
+// address and the onion addresses, which bind fixed local ports) are dropped.
+func (c Config) ForNetwork(n Network) Config {
+	c.NetworkConfig, c.NetworkToken = n.Config, n.Token
+	c.NetworkName = n.Name
+	c.Address = n.Address
+	c.Interface = n.Interface
+	c.Router = n.Router
+	c.ACL = n.ACL
+	c.AdvertiseRoutes, c.AcceptRoutes, c.ExitNodes = n.AdvertiseRoutes, n.AcceptRoutes, n.ExitNodes
+	if c.Ledger.StateDir != "" {
+		c.Ledger.StateDir = filepath.Join(c.Ledger.StateDir, n.Name)
+	}
+	c.Connection.PeerTable = nil
+	c.Connection.OnionAddresses = nil
+	c.IPv6.Prefix, c.IPv6.Address = "", ""
+	return c
+}
@@ -0,0 +1,126 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/config"
+)
+
+var _ = Describe("Networks", func() {
+	networksFile := func(content string) string {
+		f := filepath.Join(GinkgoT().TempDir(), "networks.yaml")
+		Expect(os.WriteFile(f, []byte(content), 0600)).To(Succeed())
+		return f
+	}
+
+	It("loads the networks, with the default interfaces", func() {
+		networks, err := LoadNetworks(networksFile(`
+networks:
+- name: office
+  config: /etc/edgevpn/office.yaml
+  address: 10.1.0.1/24
+- name: lab
+  token: abc
+  address: 10.2.0.1/24
+  interface: lab0
+- name: a-network-with-a-long-name
+  token: def
+  address: 10.3.0.1/24
+`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(networks).To(Equal([]Network{
+			{Name: "office", Config: "/etc/edgevpn/office.yaml", Address: "10.1.0.1/24", Interface: "edgevpn-office"},
+			{Name: "lab", Token: "abc", Address: "10.2.0.1/24", Interface: "lab0"},
+			{Name: "a-network-with-a-long-name", Token: "def", Address: "10.3.0.1/24", Interface: "edgevpn-a-netwo"},
+		}))
+	})
+
+	It("rejects the invalid networks", func() {
+		for _, content := range []string{
+			`networks: []`,
+			"networks:\n- name: of/fice\n  token: abc\n  address: 10.1.0.1/24",
+			"networks:\n- name: office\n  address: 10.1.0.1/24",
+			"networks:\n- name: office\n  token: abc\n  config: office.yaml\n  address: 10.1.0.1/24",
+			"networks:\n- name: office\n  token: abc\n  address: 10.1.0.1",
+			"networks:\n- name: office\n  token: abc\n  address: 10.1.0.1/24\n- name: office\n  token: def\n  address: 10.2.0.1/24",
+			"networks:\n- name: office\n  token: abc\n  address: 10.1.0.1/24\n  interface: vpn0\n- name: lab\n  token: def\n  address: 10.2.0.1/24\n  interface: vpn0",
+		} {
+			_, err := LoadNetworks(networksFile(content))
+			Expect(err).To(HaveOccurred(), content)
+		}
+	})
+
+	It("loads the ACL and the routes of the networks", func() {
+		networks, err := LoadNetworks(networksFile(`
+networks:
+- name: office
+  token: abc
+  address: 10.1.0.1/24
+  acl:
+    admins: [admin]
+    policy: office-policy.yaml
+    firewall_deny_by_default: true
+  advertise_routes: [192.168.1.0/24]
+  accept_routes: [0.0.0.0/0]
+  exit_nodes: [exit]
+`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(networks).To(HaveLen(1))
+		Expect(networks[0].ACL).To(Equal(ACL{Admins: []string{"admin"}, PolicyFile: "office-policy.yaml", FirewallDenyByDefault: true}))
+		Expect(networks[0].AdvertiseRoutes).To(Equal([]string{"192.168.1.0/24"}))
+		Expect(networks[0].AcceptRoutes).To(Equal([]string{"0.0.0.0/0"}))
+		Expect(networks[0].ExitNodes).To(Equal([]string{"exit"}))
+	})
+
+	It("returns the config of the node in the network", func() {
+		c := Config{
+			NetworkToken:    "token",
+			Address:         "10.1.0.1/24",
+			Interface:       "edgevpn0",
+			Router:          "10.1.0.254",
+			AdvertiseRoutes: []string{"0.0.0.0/0"},
+			AcceptRoutes:    []string{"192.168.0.0/16"},
+			ACL:             ACL{Admins: []string{"admin"}, FirewallDenyByDefault: true},
+			Ledger:          Ledger{StateDir: "/var/lib/edgevpn"},
+			Connection:      Connection{PeerTable: map[string]peer.ID{"10.1.0.2": "peer"}},
+			IPv6:            IPv6{Enable: true, Address: "fd00::1/64"},
+		}
+		nc := c.ForNetwork(Network{Name: "lab", Config: "lab.yaml", Address: "10.2.0.1/24", Interface: "edgevpn-lab", AcceptRoutes: []string{"10.0.0.0/8"}})
+		Expect(nc.NetworkConfig).To(Equal("lab.yaml"))
+		Expect(nc.NetworkToken).To(BeEmpty())
+		Expect(nc.NetworkName).To(Equal("lab"))
+		Expect(nc.Address).To(Equal("10.2.0.1/24"))
+		Expect(nc.Interface).To(Equal("edgevpn-lab"))
+		Expect(nc.Router).To(BeEmpty())
+		Expect(nc.Ledger.StateDir).To(Equal("/var/lib/edgevpn/lab"))
+		Expect(nc.Connection.PeerTable).To(BeNil())
+		Expect(nc.IPv6.Enable).To(BeTrue())
+		Expect(nc.IPv6.Address).To(BeEmpty())
+		// The ACL and the routes are the ones of the network
+		Expect(nc.ACL).To(Equal(ACL{}))
+		Expect(nc.AdvertiseRoutes).To(BeEmpty())
+		Expect(nc.AcceptRoutes).To(Equal([]string{"10.0.0.0/8"}))
+
+		// The config of the node is left as it is
+		Expect(c.Ledger.StateDir).To(Equal("/var/lib/edgevpn"))
+		Expect(c.Connection.PeerTable).To(HaveLen(1))
+	})
+})
@@ -32,3 +32,20 @@ func TOTP(f func() hash.Hash, digits int, t int, key string) string {
 	}
 	return cfg.TOTP()
 }
+
+// TOTPAt returns the TOTP of the time window offset by the given number
+// of intervals from the current one
+func TOTPAt(f func() hash.Hash, digits int, t int, key string, offset int) string {
+	cfg := otp.Config{
+		Hash:   f,
+		Digits: digits,
+		TimeStep: func() uint64 {
+			return uint64(int64(otp.TimeWindow(t)()) + int64(offset))
+		},
+		Key: key,
+		Format: func(hash []byte, nb int) string {
+			return base64.StdEncoding.EncodeToString(hash)[:nb]
+		},
+	}
+	return cfg.TOTP()
+}
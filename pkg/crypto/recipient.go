@@ -0,0 +1,279 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Files encrypted to a recipient are sealed with AES-GCM, with a key agreed
+// with X25519 between an ephemeral key and the Ed25519 key of the recipient.
+// The stream starts with the ephemeral public key and carries chunks of up
+// to recipientChunkSize bytes, each prefixed by its sealed length. The nonce
+// of a chunk is its index, with the last byte set on the final chunk so that
+// truncated streams are detected.
+const (
+	recipientChunkSize = 64 << 10
+	recipientInfo      = "edgevpn recipient encryption v1"
+)
+
+// ErrNotRecipient is returned when decrypting a stream encrypted to another peer
+var ErrNotRecipient = errors.New("not encrypted for this peer")
+
+// curve25519P is the prime of the field of Curve25519, 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// x25519Public converts an Ed25519 public key to its X25519 counterpart,
+// the birational map from Edwards to Montgomery: u = (1 + y) / (1 - y)
+func x25519Public(pub p2pcrypto.PubKey) (*ecdh.PublicKey, error) {
+	if pub.Type() != p2pcrypto.Ed25519 {
+		return nil, fmt.Errorf("unsupported key type %s, only Ed25519 keys can be encrypted to", pub.Type())
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+
+	// The point is stored as y, little endian, with the sign of x in the top bit
+	le := make([]byte, len(raw))
+	for i := range raw {
+		le[len(raw)-1-i] = raw[i]
+	}
+	le[0] &= 0x7f
+	y := new(big.Int).SetBytes(le)
+
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return ecdh.X25519().NewPublicKey(out)
+}
+
+// x25519Private converts an Ed25519 private key to its X25519 counterpart,
+// the clamped hash of the seed which is the Ed25519 scalar
+func x25519Private(priv p2pcrypto.PrivKey) (*ecdh.PrivateKey, error) {
+	if priv.Type() != p2pcrypto.Ed25519 {
+		return nil, fmt.Errorf("unsupported key type %s, only Ed25519 keys can decrypt", priv.Type())
+	}
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < ed25519.SeedSize {
+		return nil, errors.New("invalid Ed25519 private key")
+	}
+	h := sha512.Sum512(raw[:ed25519.SeedSize])
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+func recipientCipher(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(recipientInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(size int, index uint64, last bool) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-9:size-1], index)
+	if last {
+		nonce[size-1] = 1
+	}
+	return nonce
+}
+
+type recipientWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+}
+
+// EncryptTo returns a writer encrypting what is written to it so that only
+// the owner of the recipient key can decrypt it. It must be closed to write
+// the final chunk.
+func EncryptTo(w io.Writer, recipient p2pcrypto.PubKey) (io.WriteCloser, error) {
+	pub, err := x25519Public(recipient)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := recipientCipher(shared, ephemeral.PublicKey().Bytes(), pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(ephemeral.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+	return &recipientWriter{w: w, aead: aead, buf: make([]byte, 0, recipientChunkSize)}, nil
+}
+
+func (r *recipientWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if len(r.buf) == recipientChunkSize {
+			if err := r.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(r.buf[len(r.buf):recipientChunkSize], p)
+		r.buf = r.buf[:len(r.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (r *recipientWriter) flush(last bool) error {
+	sealed := r.aead.Seal(nil, chunkNonce(r.aead.NonceSize(), r.index, last), r.buf, nil)
+	r.index++
+	r.buf = r.buf[:0]
+	if err := binary.Write(r.w, binary.BigEndian, uint32(len(sealed))); err != nil {
+		return err
+	}
+	_, err := r.w.Write(sealed)
+	return err
+}
+
+// Close writes the final chunk
+func (r *recipientWriter) Close() error {
+	return r.flush(true)
+}
+
+type recipientReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+	done  bool
+}
+
+// DecryptFor returns a reader decrypting a stream encrypted with EncryptTo
+// to the public key of priv. It fails with ErrNotRecipient if the stream was
+// encrypted to another key, and the reads fail if it was tampered with or
+// truncated.
+func DecryptFor(r io.Reader, priv p2pcrypto.PrivKey) (io.Reader, error) {
+	key, err := x25519Private(priv)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral := make([]byte, 32)
+	if _, err := io.ReadFull(r, ephemeral); err != nil {
+		return nil, fmt.Errorf("reading the encryption header: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(pub)
+	if err != nil {
+		return nil, ErrNotRecipient
+	}
+	aead, err := recipientCipher(shared, ephemeral, key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	rr := &recipientReader{r: r, aead: aead}
+	// The first chunk tells right away if the key is the one of the recipient
+	if err := rr.next(); err != nil {
+		if errors.Is(err, errInvalidChunk) {
+			return nil, ErrNotRecipient
+		}
+		return nil, err
+	}
+	return rr, nil
+}
+
+var errInvalidChunk = errors.New("invalid encrypted chunk")
+
+func (r *recipientReader) next() error {
+	var size uint32
+	if err := binary.Read(r.r, binary.BigEndian, &size); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if size > recipientChunkSize+uint32(r.aead.Overhead()) {
+		return errInvalidChunk
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	for _, last := range []bool{false, true} {
+		if plain, err := r.aead.Open(nil, chunkNonce(r.aead.NonceSize(), r.index, last), sealed, nil); err == nil {
+			r.index++
+			r.buf = plain
+			r.done = last
+			return nil
+		}
+	}
+	return errInvalidChunk
+}
+
+func (r *recipientReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
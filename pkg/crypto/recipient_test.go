@@ -0,0 +1,98 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+
+	p2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/crypto"
+)
+
+var _ = Describe("Recipient encryption", func() {
+	newKey := func() p2pcrypto.PrivKey {
+		key, _, err := p2pcrypto.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		return key
+	}
+
+	encrypt := func(plain []byte, to p2pcrypto.PubKey) []byte {
+		buf := &bytes.Buffer{}
+		w, err := EncryptTo(buf, to)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = w.Write(plain)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	decrypt := func(sealed []byte, key p2pcrypto.PrivKey) ([]byte, error) {
+		r, err := DecryptFor(bytes.NewReader(sealed), key)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	It("decrypts what was encrypted to the key", func() {
+		key := newKey()
+		for _, size := range []int{0, 1, 64 << 10, 200<<10 + 3} {
+			plain := make([]byte, size)
+			rand.Read(plain)
+
+			sealed := encrypt(plain, key.GetPublic())
+			if size > 0 {
+				Expect(bytes.Contains(sealed, plain)).To(BeFalse())
+			}
+
+			got, err := decrypt(sealed, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(got).To(Equal(plain))
+		}
+	})
+
+	It("rejects the other keys", func() {
+		sealed := encrypt([]byte("secret"), newKey().GetPublic())
+		_, err := decrypt(sealed, newKey())
+		Expect(err).To(MatchError(ErrNotRecipient))
+	})
+
+	It("detects tampering and truncation", func() {
+		key := newKey()
+		plain := make([]byte, 150<<10)
+		rand.Read(plain)
+		sealed := encrypt(plain, key.GetPublic())
+
+		tampered := append([]byte{}, sealed...)
+		tampered[len(tampered)-10] ^= 1
+		_, err := decrypt(tampered, key)
+		Expect(err).To(HaveOccurred())
+
+		// Cut after the first two chunks
+		_, err = decrypt(sealed[:32+2*(4+(64<<10)+16)], key)
+		Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+	})
+
+	It("supports only Ed25519 keys", func() {
+		_, pub, err := p2pcrypto.GenerateSecp256k1Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = EncryptTo(&bytes.Buffer{}, pub)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,122 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// churn (distinct peers connecting or disconnecting per connected peer) within an interval
+	// above which the interval shrinks, and below which it grows
+	highChurn = 0.2
+	lowChurn  = 0.05
+)
+
+// AdaptiveInterval is a backoff.BackOff which adapts the discovery interval
+// to the peer churn: the interval is halved while peers connect and disconnect
+// often, and doubled while the topology is stable, within Min and Max.
+// The churn counts the distinct peers connecting or disconnecting within an
+// interval, so a peer opening several connections, or reconnecting repeatedly,
+// counts once.
+type AdaptiveInterval struct {
+	sync.Mutex
+	Min, Max time.Duration
+
+	current time.Duration
+	// conns are the connections of each connected peer
+	conns map[peer.ID]int
+	// churned are the peers which connected or disconnected within the interval
+	churned map[peer.ID]struct{}
+}
+
+// NewAdaptiveInterval returns a new AdaptiveInterval starting from min
+func NewAdaptiveInterval(min, max time.Duration) *AdaptiveInterval {
+	if max < min {
+		max = min
+	}
+	return &AdaptiveInterval{Min: min, Max: max, current: min, conns: map[peer.ID]int{}, churned: map[peer.ID]struct{}{}}
+}
+
+// Connected records a new connection of the peer
+func (a *AdaptiveInterval) Connected(p peer.ID) {
+	a.Lock()
+	defer a.Unlock()
+	if a.conns[p] == 0 {
+		a.churned[p] = struct{}{}
+	}
+	a.conns[p]++
+}
+
+// Disconnected records a closed connection of the peer
+func (a *AdaptiveInterval) Disconnected(p peer.ID) {
+	a.Lock()
+	defer a.Unlock()
+	if a.conns[p] == 0 {
+		return
+	}
+	a.conns[p]--
+	if a.conns[p] == 0 {
+		delete(a.conns, p)
+		a.churned[p] = struct{}{}
+	}
+}
+
+// Notifiee returns a network.Notifiee feeding the connection events of a host
+func (a *AdaptiveInterval) Notifiee() network.Notifiee {
+	return &network.NotifyBundle{
+		ConnectedF:    func(_ network.Network, c network.Conn) { a.Connected(c.RemotePeer()) },
+		DisconnectedF: func(_ network.Network, c network.Conn) { a.Disconnected(c.RemotePeer()) },
+	}
+}
+
+// NextBackOff returns the next interval, based on the churn since the last call
+func (a *AdaptiveInterval) NextBackOff() time.Duration {
+	a.Lock()
+	defer a.Unlock()
+
+	peers := len(a.conns)
+	if peers == 0 {
+		peers = 1
+	}
+	churn := float64(len(a.churned)) / float64(peers)
+	clear(a.churned)
+
+	switch {
+	case churn >= highChurn:
+		a.current /= 2
+	case churn <= lowChurn:
+		a.current *= 2
+	}
+
+	if a.current < a.Min {
+		a.current = a.Min
+	}
+	if a.current > a.Max {
+		a.current = a.Max
+	}
+	return a.current
+}
+
+// Reset restarts from the min interval
+func (a *AdaptiveInterval) Reset() {
+	a.Lock()
+	defer a.Unlock()
+	a.current = a.Min
+	clear(a.churned)
+}
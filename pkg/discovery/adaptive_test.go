@@ -0,0 +1,109 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+)
+
+var _ = Describe("Adaptive interval", func() {
+	id := func(i int) peer.ID { return peer.ID(fmt.Sprintf("peer%d", i)) }
+
+	It("grows while the network is stable", func() {
+		a := NewAdaptiveInterval(time.Second, 4*time.Second)
+		for i := 0; i < 10; i++ {
+			a.Connected(id(i))
+		}
+		// first interval sees the initial connections
+		Expect(a.NextBackOff()).To(Equal(time.Second))
+		Expect(a.NextBackOff()).To(Equal(2 * time.Second))
+		Expect(a.NextBackOff()).To(Equal(4 * time.Second))
+		Expect(a.NextBackOff()).To(Equal(4 * time.Second))
+	})
+
+	It("shrinks while peers churn", func() {
+		a := NewAdaptiveInterval(time.Second, 8*time.Second)
+		for i := 0; i < 20; i++ {
+			a.Connected(id(i))
+		}
+		a.NextBackOff()
+		Expect(a.NextBackOff()).To(Equal(2 * time.Second))
+		Expect(a.NextBackOff()).To(Equal(4 * time.Second))
+
+		// 5 out of 20 peers reconnect
+		for i := 0; i < 5; i++ {
+			a.Disconnected(id(i))
+			a.Connected(id(i))
+		}
+		Expect(a.NextBackOff()).To(Equal(2 * time.Second))
+
+		// few events are tolerated
+		for i := 0; i < 2; i++ {
+			a.Disconnected(id(i))
+			a.Connected(id(i))
+		}
+		Expect(a.NextBackOff()).To(Equal(2 * time.Second))
+
+		for i := 0; i < 10; i++ {
+			a.Disconnected(id(i))
+			a.Connected(id(i))
+		}
+		Expect(a.NextBackOff()).To(Equal(time.Second))
+		for i := 0; i < 10; i++ {
+			a.Disconnected(id(i))
+			a.Connected(id(i))
+		}
+		Expect(a.NextBackOff()).To(Equal(time.Second))
+	})
+
+	It("restarts from the min interval on reset", func() {
+		a := NewAdaptiveInterval(time.Second, 8*time.Second)
+		a.NextBackOff()
+		a.NextBackOff()
+		a.Reset()
+		a.Connected(id(0))
+		Expect(a.NextBackOff()).To(Equal(time.Second))
+	})
+
+	It("counts the distinct peers churning", func() {
+		a := NewAdaptiveInterval(time.Second, 8*time.Second)
+		for i := 0; i < 20; i++ {
+			a.Connected(id(i))
+		}
+		a.NextBackOff()
+		Expect(a.NextBackOff()).To(Equal(2 * time.Second))
+
+		// a peer opening more connections, and closing them, is not churn
+		for i := 0; i < 10; i++ {
+			a.Connected(id(0))
+			a.Disconnected(id(0))
+		}
+		Expect(a.NextBackOff()).To(Equal(4 * time.Second))
+
+		// a peer reconnecting repeatedly counts once
+		for i := 0; i < 10; i++ {
+			a.Disconnected(id(1))
+			a.Connected(id(1))
+		}
+		Expect(a.NextBackOff()).To(Equal(8 * time.Second))
+	})
+})
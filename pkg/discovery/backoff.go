@@ -0,0 +1,108 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+)
+
+// swarmBackoff is implemented by networks exposing the libp2p dial backoff (e.g. the swarm)
+type swarmBackoff interface {
+	Backoff() *swarm.DialBackoff
+}
+
+type suppressed struct {
+	failures int
+	until    time.Time
+}
+
+// DialBackoff skips dialing peers which are known to be failing.
+// It follows the libp2p dial backoff when the network exposes it, and falls back
+// to its own suppression cache otherwise: after a failed dial the peer is skipped
+// for an interval which doubles on each failure, up to max.
+type DialBackoff struct {
+	sync.Mutex
+	interval, max time.Duration
+	peers         map[peer.ID]*suppressed
+}
+
+// NewDialBackoff returns a new DialBackoff
+func NewDialBackoff(interval, max time.Duration) *DialBackoff {
+	if max < interval {
+		max = interval
+	}
+	return &DialBackoff{interval: interval, max: max, peers: make(map[peer.ID]*suppressed)}
+}
+
+// Skip returns true if dialing the peer would fail right away because it is backed off
+func (b *DialBackoff) Skip(n network.Network, p peer.AddrInfo) bool {
+	if s, ok := n.(swarmBackoff); ok {
+		// Dial if at least one address is not in backoff
+		for _, a := range p.Addrs {
+			if !s.Backoff().Backoff(p.ID, a) {
+				return false
+			}
+		}
+		return len(p.Addrs) > 0
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	s, exists := b.peers[p.ID]
+	return exists && time.Now().Before(s.until)
+}
+
+// Failure records a failed dial to the peer
+func (b *DialBackoff) Failure(p peer.ID) {
+	b.Lock()
+	defer b.Unlock()
+	s, exists := b.peers[p]
+	if !exists {
+		s = &suppressed{}
+		b.peers[p] = s
+	}
+	s.failures++
+
+	wait := b.interval
+	for i := 1; i < s.failures && wait < b.max; i++ {
+		wait *= 2
+	}
+	if wait > b.max {
+		wait = b.max
+	}
+	s.until = time.Now().Add(wait)
+}
+
+// Success resets the failures of the peer
+func (b *DialBackoff) Success(p peer.ID) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.peers, p)
+}
+
+// cleanup drops the peers which have not been failing for a while
+func (b *DialBackoff) cleanup() {
+	b.Lock()
+	defer b.Unlock()
+	for p, s := range b.peers {
+		if time.Since(s.until) > b.max {
+			delete(b.peers, p)
+		}
+	}
+}
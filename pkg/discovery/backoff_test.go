@@ -0,0 +1,66 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	ma "github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+)
+
+var _ = Describe("DialBackoff", func() {
+	p := peer.ID("remote")
+	addr := ma.StringCast("/ip4/192.0.2.1/tcp/4001")
+	other := ma.StringCast("/ip4/192.0.2.2/tcp/4001")
+
+	It("follows the libp2p dial backoff", func() {
+		h, err := libp2p.New(libp2p.NoListenAddrs)
+		Expect(err).ToNot(HaveOccurred())
+		defer h.Close()
+
+		b := NewDialBackoff(time.Minute, time.Hour)
+		Expect(b.Skip(h.Network(), peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{addr}})).To(BeFalse())
+
+		h.Network().(*swarm.Swarm).Backoff().AddBackoff(p, addr)
+		Expect(b.Skip(h.Network(), peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{addr}})).To(BeTrue())
+		Expect(b.Skip(h.Network(), peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{addr, other}})).To(BeFalse())
+	})
+
+	It("suppresses failing peers when the libp2p backoff is not available", func() {
+		b := NewDialBackoff(time.Minute, time.Hour)
+		info := peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{addr}}
+		Expect(b.Skip(nil, info)).To(BeFalse())
+
+		b.Failure(p)
+		Expect(b.Skip(nil, info)).To(BeTrue())
+
+		b.Success(p)
+		Expect(b.Skip(nil, info)).To(BeFalse())
+	})
+
+	It("expires the suppression", func() {
+		b := NewDialBackoff(10*time.Millisecond, 20*time.Millisecond)
+		info := peer.AddrInfo{ID: p}
+		b.Failure(p)
+		Expect(b.Skip(nil, info)).To(BeTrue())
+		Eventually(func() bool { return b.Skip(nil, info) }, time.Second, 5*time.Millisecond).Should(BeFalse())
+	})
+})
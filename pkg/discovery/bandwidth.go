@@ -0,0 +1,132 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/mudler/edgevpn/pkg/metrics"
+)
+
+// DefaultBandwidthWindow is the window of the DHT bandwidth budget
+const DefaultBandwidthWindow = time.Hour
+
+// BandwidthBudget accounts the bytes of the DHT streams within a window,
+// and reports when they exceed the budget. A 0 budget is never exceeded.
+type BandwidthBudget struct {
+	sync.Mutex
+	Budget int64
+	Window time.Duration
+
+	start time.Time
+	used  int64
+}
+
+// Add accounts n bytes in the current window
+func (b *BandwidthBudget) Add(n int) {
+	b.Lock()
+	defer b.Unlock()
+	b.roll(time.Now())
+	b.used += int64(n)
+}
+
+// Used returns the bytes accounted in the current window
+func (b *BandwidthBudget) Used() int64 {
+	b.Lock()
+	defer b.Unlock()
+	b.roll(time.Now())
+	return b.used
+}
+
+// Exceeded returns true when the bytes of the current window exceed the budget
+func (b *BandwidthBudget) Exceeded() bool {
+	if b.Budget <= 0 {
+		return false
+	}
+	return b.Used() > b.Budget
+}
+
+// roll starts a new window once the current one is over
+func (b *BandwidthBudget) roll(now time.Time) {
+	window := b.Window
+	if window <= 0 {
+		window = DefaultBandwidthWindow
+	}
+	if now.Sub(b.start) >= window {
+		b.start = now
+		b.used = 0
+	}
+}
+
+// BandwidthUsed returns the bytes of the DHT streams in the current window
+// of the bandwidth budget
+func (d *DHT) BandwidthUsed() int64 {
+	return d.bandwidth.Used()
+}
+
+// bandwidthHost is handed to the DHT to account the bytes of its streams
+type bandwidthHost struct {
+	host.Host
+	budget *BandwidthBudget
+}
+
+func (h *bandwidthHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return &bandwidthStream{Stream: s, budget: h.budget}, nil
+}
+
+func (h *bandwidthHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, func(s network.Stream) {
+		handler(&bandwidthStream{Stream: s, budget: h.budget})
+	})
+}
+
+func (h *bandwidthHost) SetStreamHandlerMatch(pid protocol.ID, m func(protocol.ID) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, m, func(s network.Stream) {
+		handler(&bandwidthStream{Stream: s, budget: h.budget})
+	})
+}
+
+type bandwidthStream struct {
+	network.Stream
+	budget *BandwidthBudget
+}
+
+func (s *bandwidthStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		metrics.DHTBytesReceived.Add(uint64(n))
+		s.budget.Add(n)
+	}
+	return n, err
+}
+
+func (s *bandwidthStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	if n > 0 {
+		metrics.DHTBytesSent.Add(uint64(n))
+		s.budget.Add(n)
+	}
+	return n, err
+}
@@ -0,0 +1,83 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/metrics"
+)
+
+var _ = Describe("DHT bandwidth", func() {
+	It("is exceeded over the budget until the next window", func() {
+		b := &BandwidthBudget{Budget: 100, Window: 200 * time.Millisecond}
+		b.Add(60)
+		Expect(b.Exceeded()).To(BeFalse())
+		b.Add(60)
+		Expect(b.Used()).To(Equal(int64(120)))
+		Expect(b.Exceeded()).To(BeTrue())
+		Eventually(b.Exceeded, time.Second, 20*time.Millisecond).Should(BeFalse())
+		Expect(b.Used()).To(BeZero())
+	})
+
+	It("is never exceeded without budget", func() {
+		b := &BandwidthBudget{}
+		b.Add(1 << 30)
+		Expect(b.Exceeded()).To(BeFalse())
+	})
+
+	It("throttles the discovery over the budget", func() {
+		run := func(d *DHT, h host.Host) {
+			ctx, cancel := context.WithCancel(context.Background())
+			DeferCleanup(cancel)
+			d.ProtocolPrefix = "/bandwidth"
+			d.FixedRendezvous = "bandwidth"
+			d.RefreshDiscoveryTime = 500 * time.Millisecond
+			Expect(d.Run(logger.New(log.LevelFatal), ctx, h)).To(Succeed())
+			DeferCleanup(d.Close)
+		}
+		newHost := func() host.Host {
+			h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(h.Close)
+			return h
+		}
+
+		bootstrap := newHost()
+		run(NewDHT(dht.Mode(dht.ModeServer)), bootstrap)
+		addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: bootstrap.ID(), Addrs: bootstrap.Addrs()})
+		Expect(err).ToNot(HaveOccurred())
+
+		sent, throttled := metrics.DHTBytesSent.Value(), metrics.DHTThrottled.Value()
+		d := NewDHT(dht.Mode(dht.ModeServer))
+		d.BootstrapPeers = addrs
+		d.BandwidthBudget = 1
+		run(d, newHost())
+
+		Eventually(d.BandwidthUsed, 10*time.Second).Should(BeNumerically(">", 1))
+		Expect(metrics.DHTBytesSent.Value()).To(BeNumerically(">", sent))
+		Eventually(metrics.DHTThrottled.Value, 10*time.Second).Should(BeNumerically(">", throttled))
+	})
+})
@@ -0,0 +1,213 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/utils"
+	maddr "github.com/multiformats/go-multiaddr"
+)
+
+// Policies applied when none of the bootstrap peers is reachable
+const (
+	// BootstrapWarn logs a warning and goes on with the discovery
+	BootstrapWarn = "warn"
+	// BootstrapRetry retries with backoff, up to BootstrapTimeout
+	BootstrapRetry = "retry"
+	// BootstrapFallback dials the peers listed at BootstrapFallbackURL
+	// and the rendezvous servers instead
+	BootstrapFallback = "fallback"
+	// BootstrapFail retries with backoff, and fails after BootstrapTimeout
+	BootstrapFail = "fail"
+)
+
+const (
+	defaultBootstrapTimeout  = time.Minute
+	maxBootstrapRetryBackoff = 30 * time.Second
+)
+
+// ConnectBootstrap connects to the bootstrap peers, applying the
+// BootstrapPolicy if none of them is reachable. It returns an error
+// only with BootstrapFail.
+func (d *DHT) ConnectBootstrap(c log.StandardLogger, ctx context.Context, h host.Host) error {
+	d.refreshProviders(c, ctx)
+	peers := d.bootstrapCandidates()
+	if len(peers) == 0 || d.bootstrapPeers(c, ctx, h, peers) > 0 {
+		return nil
+	}
+
+	switch d.BootstrapPolicy {
+	case "", BootstrapWarn:
+	case BootstrapRetry, BootstrapFail:
+		if d.retryBootstrap(c, ctx, h) {
+			return nil
+		}
+		if d.BootstrapPolicy == BootstrapFail {
+			return fmt.Errorf("none of the %d bootstrap peers is reachable", len(peers))
+		}
+	case BootstrapFallback:
+		if d.fallbackBootstrap(c, ctx, h) > 0 {
+			c.Info("Connected to the fallback bootstrap peers")
+			return nil
+		}
+	default:
+		return fmt.Errorf("invalid bootstrap policy '%s'", d.BootstrapPolicy)
+	}
+
+	if len(h.Network().Peers()) == 0 {
+		c.Warnf("None of the %d bootstrap peers is reachable and the node has no peers: it is isolated from the network. Check the connectivity or the bootstrap peers (see --discovery-bootstrap-policy)", len(peers))
+	} else {
+		c.Warnf("None of the %d bootstrap peers is reachable", len(peers))
+	}
+	return nil
+}
+
+// retryBootstrap dials the bootstrap peers with backoff until one of
+// them is reachable, and returns false if none is within the timeout
+func (d *DHT) retryBootstrap(c log.StandardLogger, ctx context.Context, h host.Host) bool {
+	timeout := d.BootstrapTimeout
+	if timeout == 0 && d.BootstrapPolicy == BootstrapFail {
+		timeout = defaultBootstrapTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	t := utils.NewBackoffTicker(utils.BackoffInitialInterval(time.Second), utils.BackoffMaxInterval(maxBootstrapRetryBackoff))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+			d.refreshProviders(c, ctx)
+			if d.bootstrapPeers(c, ctx, h, d.bootstrapCandidates()) > 0 {
+				return true
+			}
+			c.Debug("Bootstrap peers unreachable, retrying")
+		}
+	}
+}
+
+// fallbackBootstrap dials the secondary bootstrap peers,
+// and returns how many of them the host is connected to
+func (d *DHT) fallbackBootstrap(c log.StandardLogger, ctx context.Context, h host.Host) int {
+	peers := append(AddrList{}, d.RendezvousServers...)
+	if d.BootstrapFallbackURL != "" {
+		fetched, err := FetchBootstrapPeers(ctx, d.BootstrapFallbackURL)
+		if err != nil {
+			c.Warnf("Failed fetching the fallback bootstrap peers: %s", err.Error())
+		}
+		peers = append(peers, fetched...)
+	}
+	return d.bootstrapPeers(c, ctx, h, peers)
+}
+
+// bootstrapCandidates returns the configured bootstrap peers, followed
+// by the ones of the providers and the learned ones which are not configured
+func (d *DHT) bootstrapCandidates() AddrList {
+	peers := d.knownBootstrapPeers()
+	if d.LearnedBootstrap == nil {
+		return peers
+	}
+	known := map[peer.ID]bool{}
+	for _, a := range peers {
+		if info, err := peer.AddrInfoFromP2pAddr(a); err == nil {
+			known[info.ID] = true
+		}
+	}
+	for _, a := range d.LearnedBootstrap.Peers() {
+		if info, err := peer.AddrInfoFromP2pAddr(a); err == nil && !known[info.ID] {
+			peers = append(peers, a)
+		}
+	}
+	return peers
+}
+
+// knownBootstrapPeers returns the configured bootstrap peers, followed
+// by the ones of the providers which are not configured
+func (d *DHT) knownBootstrapPeers() AddrList {
+	peers := append(AddrList{}, d.BootstrapPeers...)
+	configured := map[peer.ID]bool{}
+	for _, a := range d.BootstrapPeers {
+		if info, err := peer.AddrInfoFromP2pAddr(a); err == nil {
+			configured[info.ID] = true
+		}
+	}
+	for _, a := range d.providedPeers() {
+		if info, err := peer.AddrInfoFromP2pAddr(a); err == nil && !configured[info.ID] {
+			peers = append(peers, a)
+		}
+	}
+	return peers
+}
+
+// ReachableBootstrapPeers returns the bootstrap peers, configured or
+// provided, which the host is connected to. The learned ones are left out,
+// so they are never shared again with the other members.
+func (d *DHT) ReachableBootstrapPeers(h host.Host) AddrList {
+	peers := AddrList{}
+	for _, a := range d.knownBootstrapPeers() {
+		if info, err := peer.AddrInfoFromP2pAddr(a); err == nil && h.Network().Connectedness(info.ID) == network.Connected {
+			peers = append(peers, a)
+		}
+	}
+	return peers
+}
+
+// FetchBootstrapPeers returns the multiaddresses listed at the URL,
+// one per line. Empty lines and lines starting with # are skipped.
+func FetchBootstrapPeers(ctx context.Context, url string) (AddrList, error) {
+	tCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(tCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("'%s' replied with status %d", url, resp.StatusCode)
+	}
+
+	peers := AddrList{}
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		a, err := maddr.NewMultiaddr(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap peer '%s': %w", line, err)
+		}
+		peers = append(peers, a)
+	}
+	return peers, s.Err()
+}
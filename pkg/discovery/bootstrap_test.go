@@ -0,0 +1,190 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/metrics"
+)
+
+var _ = Describe("Bootstrap", func() {
+	l := logger.New(log.LevelFatal)
+	ctx := context.Background()
+
+	freePort := func() int {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+		return ln.Addr().(*net.TCPAddr).Port
+	}
+
+	newHost := func(opts ...libp2p.Option) host.Host {
+		h, err := libp2p.New(append([]libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")}, opts...)...)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+		return h
+	}
+
+	p2pAddr := func(h host.Host) ma.Multiaddr {
+		addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+		Expect(err).ToNot(HaveOccurred())
+		return addrs[0]
+	}
+
+	// unreachable returns the address of a peer which is not listening, on a free port
+	unreachable := func() (crypto.PrivKey, int, ma.Multiaddr) {
+		key, _, err := crypto.GenerateEd25519Key(nil)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		port := freePort()
+		a, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/p2p/%s", port, id))
+		Expect(err).ToNot(HaveOccurred())
+		return key, port, a
+	}
+
+	It("goes on when no bootstrap peer is reachable", func() {
+		_, _, a := unreachable()
+		d := NewDHT()
+		d.BootstrapPeers = AddrList{a}
+		Expect(d.ConnectBootstrap(l, ctx, newHost())).To(Succeed())
+	})
+
+	It("calls the hooks with the outcome of dialing the bootstrap peers", func() {
+		_, _, a := unreachable()
+		up := newHost()
+		d := NewDHT()
+		d.BootstrapPeers = AddrList{p2pAddr(up), a}
+
+		connected, failed := []peer.ID{}, []peer.ID{}
+		dials := metrics.DialLatency.Snapshot().Count
+		d.OnPeerConnected = func(p peer.AddrInfo) { connected = append(connected, p.ID) }
+		d.OnPeerConnectFailed = func(p peer.AddrInfo, err error) {
+			Expect(err).To(HaveOccurred())
+			failed = append(failed, p.ID)
+		}
+
+		Expect(d.ConnectBootstrap(l, ctx, newHost())).To(Succeed())
+		info, err := peer.AddrInfoFromP2pAddr(a)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(connected).To(Equal([]peer.ID{up.ID()}))
+		Expect(failed).To(Equal([]peer.ID{info.ID}))
+		Expect(metrics.DialLatency.Snapshot().Count).To(Equal(dials + 2))
+	})
+
+	It("dials the bootstrap peers within the dial concurrency", func() {
+		_, _, a := unreachable()
+		up, other := newHost(), newHost()
+		d := NewDHT()
+		d.DialConcurrency = 1
+		d.BootstrapPeers = AddrList{p2pAddr(up), a, p2pAddr(other)}
+
+		failed := 0
+		dials := metrics.DialLatency.Snapshot().Count
+		d.OnPeerConnectFailed = func(peer.AddrInfo, error) { failed++ }
+
+		h := newHost()
+		Expect(d.ConnectBootstrap(l, ctx, h)).To(Succeed())
+		Expect(h.Network().Connectedness(up.ID())).To(Equal(network.Connected))
+		Expect(h.Network().Connectedness(other.ID())).To(Equal(network.Connected))
+		Expect(failed).To(Equal(1))
+		Expect(metrics.DialLatency.Snapshot().Count).To(Equal(dials + 3))
+	})
+
+	It("retries until a bootstrap peer is reachable", func() {
+		key, port, a := unreachable()
+		d := NewDHT()
+		d.BootstrapPeers = AddrList{a}
+		d.BootstrapPolicy = BootstrapRetry
+		d.BootstrapTimeout = time.Minute
+
+		var late host.Host
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(2 * time.Second)
+			late = newHost(libp2p.Identity(key), libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port)))
+		}()
+
+		h := newHost()
+		Expect(d.ConnectBootstrap(l, ctx, h)).To(Succeed())
+		Expect(h.Network().Connectedness(late.ID())).To(Equal(network.Connected))
+	})
+
+	It("fails after the timeout", func() {
+		_, _, a := unreachable()
+		d := NewDHT()
+		d.BootstrapPeers = AddrList{a}
+		d.BootstrapPolicy = BootstrapFail
+		d.BootstrapTimeout = 2 * time.Second
+
+		start := time.Now()
+		Expect(d.ConnectBootstrap(l, ctx, newHost())).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", 2*time.Second))
+	})
+
+	It("falls back to the secondary bootstrap peers", func() {
+		_, _, a := unreachable()
+		fallback := newHost()
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "# fallback peers\n\n%s\n", p2pAddr(fallback))
+		}))
+		defer srv.Close()
+
+		peers, err := FetchBootstrapPeers(ctx, srv.URL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(peers).To(HaveLen(1))
+
+		d := NewDHT()
+		d.BootstrapPeers = AddrList{a}
+		d.BootstrapPolicy = BootstrapFallback
+		d.BootstrapFallbackURL = srv.URL
+
+		h := newHost()
+		Expect(d.ConnectBootstrap(l, ctx, h)).To(Succeed())
+		Expect(h.Network().Connectedness(fallback.ID())).To(Equal(network.Connected))
+	})
+
+	It("falls back to the rendezvous servers", func() {
+		_, _, a := unreachable()
+		server := newHost()
+
+		d := NewDHT()
+		d.BootstrapPeers = AddrList{a}
+		d.BootstrapPolicy = BootstrapFallback
+		d.RendezvousServers = AddrList{p2pAddr(server)}
+
+		h := newHost()
+		Expect(d.ConnectBootstrap(l, ctx, h)).To(Succeed())
+		Expect(h.Network().Connectedness(server.ID())).To(Equal(network.Connected))
+	})
+})
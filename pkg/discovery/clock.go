@@ -0,0 +1,60 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import "time"
+
+// DefaultClockCheckInterval is how often the clock is checked for jumps
+const DefaultClockCheckInterval = 10 * time.Second
+
+// monotonicStart is the reference of the system monotonic clock
+var monotonicStart = time.Now()
+
+// ClockJumpDetector detects the steps of the wall clock, such as the ones of
+// an NTP step or of a VM resuming from suspend, by comparing the wall time
+// elapsed between two checks with the monotonic time, which doesn't step.
+type ClockJumpDetector struct {
+	// Threshold is the smallest difference between the two reported as a jump
+	Threshold time.Duration
+	// Wall and Monotonic read the clocks, the system ones when nil
+	Wall      func() time.Time
+	Monotonic func() time.Duration
+
+	started bool
+	wall    time.Time
+	mono    time.Duration
+}
+
+func (c *ClockJumpDetector) read() (time.Time, time.Duration) {
+	wall, mono := time.Now().Round(0), time.Since(monotonicStart)
+	if c.Wall != nil {
+		wall = c.Wall()
+	}
+	if c.Monotonic != nil {
+		mono = c.Monotonic()
+	}
+	return wall, mono
+}
+
+// Check reads the clocks and returns how much the wall clock jumped since the
+// previous check, negative when it went backwards. ok is true when the jump
+// exceeds the Threshold. The first check only takes the readings.
+func (c *ClockJumpDetector) Check() (jump time.Duration, ok bool) {
+	wall, mono := c.read()
+	if c.started {
+		jump = wall.Sub(c.wall) - (mono - c.mono)
+	}
+	c.started, c.wall, c.mono = true, wall, mono
+	return jump, c.Threshold > 0 && (jump > c.Threshold || -jump > c.Threshold)
+}
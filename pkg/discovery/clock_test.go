@@ -0,0 +1,133 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+)
+
+var _ = Describe("Clock jumps", func() {
+	// stepped is a wall clock which can be stepped away from the system one
+	stepped := func(step *atomic.Int64) func() time.Time {
+		return func() time.Time { return time.Now().Round(0).Add(time.Duration(step.Load())) }
+	}
+
+	It("detects the steps of the wall clock", func() {
+		var wall time.Time
+		var mono time.Duration
+		c := &ClockJumpDetector{
+			Threshold: time.Minute,
+			Wall:      func() time.Time { return wall },
+			Monotonic: func() time.Duration { return mono },
+		}
+		wall = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		_, ok := c.Check()
+		Expect(ok).To(BeFalse())
+
+		// Both clocks move together
+		wall, mono = wall.Add(time.Hour), mono+time.Hour
+		jump, ok := c.Check()
+		Expect(ok).To(BeFalse())
+		Expect(jump).To(BeZero())
+
+		// Resume from suspend: the monotonic clock stood still
+		wall, mono = wall.Add(2*time.Hour), mono+time.Second
+		jump, ok = c.Check()
+		Expect(ok).To(BeTrue())
+		Expect(jump).To(Equal(2*time.Hour - time.Second))
+
+		// Within the threshold
+		wall, mono = wall.Add(30*time.Second), mono+time.Second
+		_, ok = c.Check()
+		Expect(ok).To(BeFalse())
+
+		// Stepped backwards
+		wall, mono = wall.Add(-time.Hour), mono+time.Second
+		jump, ok = c.Check()
+		Expect(ok).To(BeTrue())
+		Expect(jump).To(Equal(-time.Hour - time.Second))
+	})
+
+	It("uses the system clocks by default", func() {
+		c := &ClockJumpDetector{Threshold: time.Second}
+		c.Check()
+		time.Sleep(100 * time.Millisecond)
+		jump, ok := c.Check()
+		Expect(ok).To(BeFalse())
+		Expect(jump.Abs()).To(BeNumerically("<", 50*time.Millisecond))
+
+		var step atomic.Int64
+		c.Wall = stepped(&step)
+		c.Check()
+		step.Store(int64(time.Hour))
+		jump, ok = c.Check()
+		Expect(ok).To(BeTrue())
+		Expect(jump).To(BeNumerically("~", time.Hour, time.Second))
+	})
+
+	It("announces right away when the clock jumps", func() {
+		run := func(d *DHT, h host.Host) {
+			ctx, cancel := context.WithCancel(context.Background())
+			DeferCleanup(cancel)
+			d.ProtocolPrefix = "/clock"
+			Expect(d.Run(logger.New(log.LevelFatal), ctx, h)).To(Succeed())
+			DeferCleanup(d.Close)
+		}
+		newHost := func() host.Host {
+			h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(h.Close)
+			return h
+		}
+
+		bootstrap := newHost()
+		b := NewDHT(dht.Mode(dht.ModeServer))
+		b.FixedRendezvous = "clock"
+		run(b, bootstrap)
+		addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: bootstrap.ID(), Addrs: bootstrap.Addrs()})
+		Expect(err).ToNot(HaveOccurred())
+
+		var step, announces atomic.Int64
+		d := NewDHT(dht.Mode(dht.ModeServer))
+		d.BootstrapPeers = addrs
+		d.OTPKey = "key"
+		d.OTPInterval = 9000
+		d.RefreshDiscoveryTime = time.Hour
+		d.ClockCheckInterval = 50 * time.Millisecond
+		d.ClockJump.Wall = stepped(&step)
+		d.OnAnnounce = func(string) { announces.Add(1) }
+		run(d, newHost())
+
+		Eventually(announces.Load, 10*time.Second).Should(BeNumerically(">", 0))
+		n := announces.Load()
+		Consistently(announces.Load, 500*time.Millisecond).Should(Equal(n))
+
+		// The node resumes 3 hours later, past the OTP interval
+		step.Store(int64(3 * time.Hour))
+		Eventually(announces.Load, 10*time.Second).Should(BeNumerically(">", n))
+	})
+})
@@ -16,36 +16,178 @@ package discovery
 import (
 	"context"
 	"crypto/sha256"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	internalCrypto "github.com/mudler/edgevpn/pkg/crypto"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	"github.com/mudler/edgevpn/pkg/operations"
 	"github.com/mudler/edgevpn/pkg/utils"
 
+	backoff "github.com/cenkalti/backoff/v4"
 	"github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/routing"
 	discovery "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 )
 
+// maxDialBackoffFactor caps how much the dial backoff grows
+const maxDialBackoffFactor = 32
+
 type DHT struct {
-	OTPKey               string
-	OTPInterval          int
-	KeyLength            int
-	RendezvousString     string
+	OTPKey string
+	// OTPKeys are additional OTP keys accepted while rotating tokens.
+	// Peers announce and search on the rendezvous derived from every key,
+	// so nodes with the old and the new key can still meet during the overlap.
+	OTPKeys     []string
+	OTPInterval int
+	// OTPWindowTolerance, when set to N, makes the node announce and search
+	// also on the rendezvous of the N OTP intervals before and after the
+	// current one, so peers whose clocks are skewed still meet
+	OTPWindowTolerance int
+	KeyLength          int
+	RendezvousString   string
+	// FixedRendezvous, when set, is used as the only rendezvous regardless of
+	// the OTP keys. Anyone knowing it can find the nodes: it is INSECURE and
+	// meant only to make multi-node tests deterministic.
+	FixedRendezvous      string
 	BootstrapPeers       AddrList
 	rendezvousHistory    Ring
 	RefreshDiscoveryTime time.Duration
+	// AdaptiveRefresh adapts the discovery interval to the peer churn,
+	// between RefreshDiscoveryMinTime and RefreshDiscoveryTime
+	AdaptiveRefresh         bool
+	RefreshDiscoveryMinTime time.Duration
+	// MaxPeersPerCycle caps the peers dialed for each rendezvous on every
+	// discovery cycle. When more are found, a random sample is taken so
+	// nodes don't all pile up on the same peers. 0 means no limit.
+	MaxPeersPerCycle int
+	// MaxConnectionsPerDiscovery caps the new connections established on
+	// every discovery cycle: dialing stops once it is reached. 0 means no limit.
+	MaxConnectionsPerDiscovery int
+	// DialConcurrency bounds the peers dialed at once, both while
+	// bootstrapping and on every discovery cycle. 0 dials the discovered
+	// peers one at a time and the bootstrap peers all at once.
+	DialConcurrency int
+	// ProtocolPrefix, when set, replaces the /ipfs prefix of the DHT
+	// protocol, so that the nodes run a private DHT apart from the public
+	// IPFS one. The bootstrap peers must then be set explicitly.
+	ProtocolPrefix string
+	// BandwidthBudget, when set, caps the bytes of the DHT streams within
+	// BandwidthWindow (DefaultBandwidthWindow when 0): the discovery cycles
+	// are skipped while it is exceeded. The DHT keeps refreshing its
+	// routing table and answering the other nodes.
+	BandwidthBudget int64
+	BandwidthWindow time.Duration
+	// LocalPeers, when set, returns the peers connected on the local network
+	// (see MDNS.LocalPeers). While they are at least LocalPeersThreshold,
+	// the discovery interval is stretched by LocalScaleFactor
+	// (DefaultLocalScaleFactor when 0). A 0 threshold disables it.
+	LocalPeers          func() int
+	LocalPeersThreshold int
+	LocalScaleFactor    int
+	// CanaryTimeout enables a search-only probe before the first announce:
+	// the node waits up to CanaryTimeout to find at least one peer
+	// on the rendezvous before advertising itself. 0 disables it.
+	CanaryTimeout time.Duration
+	// DialBackoff is the initial time peers failing to dial are skipped for,
+	// when the libp2p dial backoff can't be queried
+	DialBackoff time.Duration
+	// RendezvousServers are queried for peers on the rendezvous when none
+	// is found on the DHT. The node registers on them on every discovery cycle.
+	RendezvousServers AddrList
+	// BootstrapPolicy is what to do when none of the bootstrap peers is
+	// reachable (BootstrapWarn, BootstrapRetry, BootstrapFallback or
+	// BootstrapFail). Empty means BootstrapWarn.
+	BootstrapPolicy string
+	// BootstrapTimeout bounds the retries of the BootstrapRetry and
+	// BootstrapFail policies. 0 means retrying until the context is done
+	// with BootstrapRetry, and defaultBootstrapTimeout with BootstrapFail.
+	BootstrapTimeout time.Duration
+	// BootstrapFallbackURL lists secondary bootstrap peers, one multiaddress
+	// per line, dialed along with the rendezvous servers with BootstrapFallback
+	BootstrapFallbackURL string
+	// LearnedBootstrap, when set, holds the bootstrap peers learned from the
+	// peer exchange, dialed on every cycle along with the BootstrapPeers
+	LearnedBootstrap *LearnedBootstrap
+	// PeerCache, when set, persists the peers met on the rendezvous: they
+	// are dialed on start, while the DHT bootstraps, and the last rendezvous
+	// peers were found on is searched on the first discovery cycle
+	PeerCache *PeerCache
+	// Providers supply more bootstrap peers, asked for on every discovery
+	// cycle and dialed along with the BootstrapPeers
+	Providers   []Provider
+	providersMu sync.Mutex
+	provided    []AddrList
+	// FindPeersLimiter bounds the concurrent searches on the DHT.
+	// When nil, DefaultFindPeersLimiter is used.
+	FindPeersLimiter *QueryLimiter
+	// OnCycle, when set, is called at the end of the discovery cycle of
+	// each rendezvous, with the peers found and the ones newly connected
+	OnCycle func(rendezvous string, found, connected int)
+	// OnConnect, when set, is called with the peers found on the
+	// rendezvous which the host is connected to
+	OnConnect func(peer.ID)
+	// OnPeerConnected and OnPeerConnectFailed, when set, are called after
+	// dialing a bootstrap, cached or found peer, and OnAnnounce after the node
+	// advertised itself on a rendezvous. They are called from the discovery
+	// cycle once all its dials are done, never concurrently, and the cycle
+	// waits for them to return: slow work must be handed off.
+	OnPeerConnected     func(peer.AddrInfo)
+	OnPeerConnectFailed func(peer.AddrInfo, error)
+	OnAnnounce          func(rendezvous string)
+	// DiagnoseAfter is the number of discovery rounds in a row finding no
+	// peer, with a healthy DHT, after which the node warns that the OTP
+	// parameters may be misconfigured. 0 disables the diagnosis.
+	DiagnoseAfter int
+	// ClockJump detects the steps of the wall clock (NTP steps, resume from
+	// suspend), checked every ClockCheckInterval (DefaultClockCheckInterval
+	// when 0). On a jump larger than its Threshold, one OTP interval when 0,
+	// the OTP rendezvous are recomputed and announced right away instead of
+	// waiting for the next discovery cycle.
+	ClockJump          ClockJumpDetector
+	ClockCheckInterval time.Duration
+	// DHTMode is the mode the DHT runs in (DHTModeAuto, DHTModeServer or
+	// DHTModeClient). Auto switches between server mode, while the node is
+	// publicly reachable as told by AutoNAT, and client mode. When empty,
+	// the mode of the DHT options is kept, auto by default.
+	DHTMode string
 	*dht.IpfsDHT
 	dhtOptions []dht.Option
+	canaryDone chan struct{}
+	backoff    *DialBackoff
+	history    *DialHistory
+	rendezvous *RendezvousClient
+	diagnosis  RendezvousDiagnosis
+	hooks      sync.Mutex
+	tracker    peerTracker
+	bandwidth  BandwidthBudget
+	mode       modeController
 }
 
 func NewDHT(d ...dht.Option) *DHT {
-	return &DHT{dhtOptions: d, rendezvousHistory: Ring{Length: 2}}
+	return &DHT{dhtOptions: d, rendezvousHistory: Ring{Length: 2}, canaryDone: make(chan struct{}), DialBackoff: time.Minute}
+}
+
+// CanaryDone returns a channel which is closed once the canary
+// phase is over, either successfully or by timeout.
+func (d *DHT) CanaryDone() <-chan struct{} {
+	return d.canaryDone
+}
+
+// Close stops the DHT, if it was started
+func (d *DHT) Close() error {
+	if d.IpfsDHT == nil {
+		return nil
+	}
+	return d.IpfsDHT.Close()
 }
 
 func (d *DHT) Option(ctx context.Context) func(c *libp2p.Config) error {
@@ -55,14 +197,50 @@ func (d *DHT) Option(ctx context.Context) func(c *libp2p.Config) error {
 	})
 }
 func (d *DHT) Rendezvous() string {
+	if d.FixedRendezvous != "" {
+		return d.FixedRendezvous
+	}
 	if d.OTPKey != "" {
-		totp := internalCrypto.TOTP(sha256.New, d.KeyLength, d.OTPInterval, d.OTPKey)
-		rv := internalCrypto.MD5(totp)
-		return rv
+		return d.otpRendezvous(d.OTPKey)
 	}
 	return d.RendezvousString
 }
 
+func (d *DHT) otpRendezvous(key string) string {
+	totp := internalCrypto.TOTP(sha256.New, d.KeyLength, d.OTPInterval, key)
+	return internalCrypto.MD5(totp)
+}
+
+// otpWindows returns the rendezvous of the key on the current OTP interval,
+// followed by the ones of the adjacent intervals within OTPWindowTolerance
+func (d *DHT) otpWindows(key string) []string {
+	rvs := []string{d.otpRendezvous(key)}
+	for i := 1; i <= d.OTPWindowTolerance; i++ {
+		for _, offset := range []int{-i, i} {
+			totp := internalCrypto.TOTPAt(sha256.New, d.KeyLength, d.OTPInterval, key, offset)
+			rvs = append(rvs, internalCrypto.MD5(totp))
+		}
+	}
+	return rvs
+}
+
+// Rendezvouses returns the current rendezvous points for the primary
+// and all the additional OTP keys, including the adjacent OTP intervals
+// within OTPWindowTolerance
+func (d *DHT) Rendezvouses() []string {
+	if d.OTPKey == "" || d.FixedRendezvous != "" {
+		return []string{d.Rendezvous()}
+	}
+	rvs := d.otpWindows(d.OTPKey)
+	for _, k := range d.OTPKeys {
+		if k == "" || k == d.OTPKey {
+			continue
+		}
+		rvs = append(rvs, d.otpWindows(k)...)
+	}
+	return rvs
+}
+
 func (d *DHT) startDHT(ctx context.Context, h host.Host) (*dht.IpfsDHT, error) {
 	if d.IpfsDHT == nil {
 		// Start a DHT, for use in peer discovery. We can't just make a new DHT
@@ -70,7 +248,21 @@ func (d *DHT) startDHT(ctx context.Context, h host.Host) (*dht.IpfsDHT, error) {
 		// DHT, so that the bootstrapping node of the DHT can go down without
 		// inhibiting future peer discovery.
 
-		kad, err := dht.New(ctx, h, d.dhtOptions...)
+		opts := d.dhtOptions
+		if d.ProtocolPrefix != "" {
+			// Applied last, it takes precedence over a prefix set with NewDHT
+			opts = append(append([]dht.Option{}, opts...), dht.ProtocolPrefix(protocol.ID(d.ProtocolPrefix)))
+		}
+		if d.DHTMode != "" {
+			m, err := ParseDHTMode(d.DHTMode)
+			if err != nil {
+				return d.IpfsDHT, err
+			}
+			opts = append(append([]dht.Option{}, opts...), dht.Mode(m))
+		}
+		d.bandwidth.Budget = d.BandwidthBudget
+		d.bandwidth.Window = d.BandwidthWindow
+		kad, err := dht.New(ctx, &bandwidthHost{Host: h, budget: &d.bandwidth}, opts...)
 		if err != nil {
 			return d.IpfsDHT, err
 		}
@@ -81,16 +273,63 @@ func (d *DHT) startDHT(ctx context.Context, h host.Host) (*dht.IpfsDHT, error) {
 }
 
 func (d *DHT) announceRendezvous(c log.StandardLogger, ctx context.Context, host host.Host, kademliaDHT *dht.IpfsDHT) {
-	d.bootstrapPeers(c, ctx, host)
-	rv := d.Rendezvous()
-	d.rendezvousHistory.Add(rv)
+	if err := d.ConnectBootstrap(c, ctx, host); err != nil {
+		c.Error(err.Error())
+	}
+	rvs := d.Rendezvouses()
+	// Keep the previous rendezvous of each key around during OTP transitions.
+	// The windows of the keys shift by one at each transition, so one more
+	// per key is enough and the older ones are dropped.
+	windows := 1
+	if d.OTPKey != "" && d.FixedRendezvous == "" && d.OTPWindowTolerance > 0 {
+		windows = 2*d.OTPWindowTolerance + 1
+	}
+	d.rendezvousHistory.Length = len(rvs) + len(rvs)/windows
+	for _, rv := range rvs {
+		if !contains(d.rendezvousHistory.Data, rv) {
+			d.rendezvousHistory.Add(rv)
+		}
+	}
 
 	c.Debugf("The following rendezvous points are being used: %+v", d.rendezvousHistory.Data)
+	found := 0
 	for _, r := range d.rendezvousHistory.Data {
 		c.Debugf("Announcing with rendezvous: %s", r)
-		d.announceAndConnect(c, ctx, kademliaDHT, host, r)
+		n, _ := d.announceAndConnect(c, ctx, kademliaDHT, host, r)
+		found += n
+		if n > 0 && d.PeerCache != nil {
+			if err := d.PeerCache.RecordRendezvous(r); err != nil {
+				c.Debugf("Failed caching the rendezvous: %s", err.Error())
+			}
+		}
 	}
 	c.Debug("Announcing to rendezvous done")
+
+	d.tracker.refresh()
+
+	if d.diagnosis.Record(found, kademliaDHT.RoutingTable().Size()) {
+		c.Warn(d.diagnosis.Warning())
+	}
+}
+
+// Diagnosis returns the warning of the discovery self-diagnosis, empty if none
+func (d *DHT) Diagnosis() string {
+	if d.FixedRendezvous != "" {
+		return fixedRendezvousWarning
+	}
+	return d.diagnosis.Warning()
+}
+
+const fixedRendezvousWarning = "INSECURE: discovery uses a fixed rendezvous instead of the OTP one, " +
+	"anyone knowing it can find the nodes. It is meant only for tests, never use it in production"
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
 }
 
 func (d *DHT) Run(c log.StandardLogger, ctx context.Context, host host.Host) error {
@@ -98,9 +337,24 @@ func (d *DHT) Run(c log.StandardLogger, ctx context.Context, host host.Host) err
 		d.KeyLength = 12
 	}
 
-	if len(d.BootstrapPeers) == 0 {
+	// A private DHT can't be bootstrapped from the public IPFS peers
+	if len(d.BootstrapPeers) == 0 && d.ProtocolPrefix == "" {
 		d.BootstrapPeers = dht.DefaultBootstrapPeers
+	} else if len(d.BootstrapPeers) == 0 {
+		c.Warnf("The private DHT %s has no bootstrap peers, set them to reach the other nodes", d.ProtocolPrefix)
 	}
+
+	d.backoff = NewDialBackoff(d.DialBackoff, maxDialBackoffFactor*d.DialBackoff)
+	d.history = NewDialHistory()
+	d.diagnosis.Threshold = d.DiagnoseAfter
+	if d.FixedRendezvous != "" {
+		c.Warn(fixedRendezvousWarning)
+	}
+	if len(d.RendezvousServers) > 0 {
+		d.rendezvous = &RendezvousClient{Servers: d.RendezvousServers}
+	}
+	d.tracker.start(host.Network(), d.bootstrapIDs()...)
+
 	// Start a DHT, for use in peer discovery. We can't just make a new DHT
 	// client because we want each peer to maintain its own local copy of the
 	// DHT, so that the bootstrapping node of the DHT can go down without
@@ -109,6 +363,15 @@ func (d *DHT) Run(c log.StandardLogger, ctx context.Context, host host.Host) err
 	if err != nil {
 		return err
 	}
+	if err := d.mode.start(c, ctx, host, d.DHTMode == DHTModeAuto); err != nil {
+		return err
+	}
+
+	// Rejoin the peers met before the restart while bootstrapping
+	if d.PeerCache != nil {
+		d.restoreRendezvous(c)
+		go d.dialCached(c, ctx, host)
+	}
 
 	// Bootstrap the DHT. In the default configuration, this spawns a Background
 	// thread that will refresh the peer table every five minutes.
@@ -117,63 +380,253 @@ func (d *DHT) Run(c log.StandardLogger, ctx context.Context, host host.Host) err
 		return err
 	}
 
+	// With the fail policy, not reaching the bootstrap peers is fatal
+	if d.BootstrapPolicy == BootstrapFail {
+		if err := d.ConnectBootstrap(c, ctx, host); err != nil {
+			return err
+		}
+	}
+
 	go d.runBackground(c, ctx, host, kademliaDHT)
 
 	return nil
 }
 
 func (d *DHT) runBackground(c log.StandardLogger, ctx context.Context, host host.Host, kademliaDHT *dht.IpfsDHT) {
+	if d.CanaryTimeout > 0 {
+		if d.canary(c, ctx, host, kademliaDHT) {
+			c.Info("Canary discovery succeeded, announcing")
+		} else {
+			c.Warn("Canary discovery found no peers within timeout, announcing anyway")
+		}
+	}
+	close(d.canaryDone)
+
 	d.announceRendezvous(c, ctx, host, kademliaDHT)
-	t := utils.NewBackoffTicker(utils.BackoffMaxInterval(d.RefreshDiscoveryTime))
-	defer t.Stop()
+
+	var b backoff.BackOff
+	if d.AdaptiveRefresh {
+		a := NewAdaptiveInterval(d.RefreshDiscoveryMinTime, d.RefreshDiscoveryTime)
+		for _, p := range host.Network().Peers() {
+			a.conns[p] = len(host.Network().ConnsToPeer(p))
+		}
+		n := a.Notifiee()
+		host.Network().Notify(n)
+		defer host.Network().StopNotify(n)
+		b = a
+	} else {
+		b = utils.NewBackoff(utils.BackoffMaxInterval(d.RefreshDiscoveryTime))
+	}
+	// The local mesh shrinks as peers disconnect: a stretched interval
+	// is then cut short, not to wait for it to end
+	var local *LocalScaling
+	var disconnected chan struct{}
+	if d.LocalPeersThreshold > 0 && d.LocalPeers != nil {
+		local = &LocalScaling{BackOff: b, LocalPeers: d.LocalPeers, Threshold: d.LocalPeersThreshold, Factor: d.LocalScaleFactor}
+		b = local
+		disconnected = make(chan struct{}, 1)
+		n := &network.NotifyBundle{
+			DisconnectedF: func(network.Network, network.Conn) {
+				select {
+				case disconnected <- struct{}{}:
+				default:
+				}
+			},
+		}
+		host.Network().Notify(n)
+		defer host.Network().StopNotify(n)
+	}
+	t := backoff.NewTicker(b)
+	defer func() { t.Stop() }()
+
+	// The OTP rendezvous follow the wall clock: check it for jumps
+	var clock <-chan time.Time
+	if d.OTPKey != "" && d.FixedRendezvous == "" {
+		if d.ClockJump.Threshold == 0 {
+			d.ClockJump.Threshold = time.Duration(d.OTPInterval) * time.Second
+		}
+		interval := d.ClockCheckInterval
+		if interval == 0 {
+			interval = DefaultClockCheckInterval
+		}
+		d.ClockJump.Check()
+		ct := time.NewTicker(interval)
+		defer ct.Stop()
+		clock = ct.C
+	}
+
 	for {
 		select {
 		case <-t.C:
-			// We announce ourselves to the rendezvous point for all the peers.
-			// We have a safeguard of 1 hour to avoid blocking the main loop
-			// in case of network issues.
-			// The TTL of DHT is by default no longer than 3 hours, so we should
-			// be safe by having an entry less than that.
-			safeTimeout, cancel := context.WithTimeout(ctx, time.Hour)
-
-			endChan := make(chan struct{})
-			go func() {
-				d.announceRendezvous(c, safeTimeout, host, kademliaDHT)
-				endChan <- struct{}{}
-			}()
-
-			select {
-			case <-endChan:
-				cancel()
-			case <-safeTimeout.Done():
-				c.Error("Timeout while announcing rendezvous")
-				cancel()
+			if d.bandwidth.Exceeded() {
+				metrics.DHTThrottled.Add(1)
+				c.Warnf("DHT bandwidth budget exceeded (%d bytes of %d), skipping the discovery", d.bandwidth.Used(), d.BandwidthBudget)
+				continue
+			}
+			d.announceWithTimeout(c, ctx, host, kademliaDHT)
+		case <-disconnected:
+			if !local.Shrunk() {
+				continue
+			}
+			c.Debug("The local mesh shrank, resuming the DHT discovery interval")
+			// The new ticker announces right away
+			t.Stop()
+			t = backoff.NewTicker(b)
+		case <-clock:
+			jump, ok := d.ClockJump.Check()
+			if !ok {
+				continue
 			}
+			c.Warnf("The clock jumped by %s, announcing on the new rendezvous", jump)
+			// The rendezvous of the previous intervals are stale
+			d.rendezvousHistory.Data = nil
+			d.announceWithTimeout(c, ctx, host, kademliaDHT)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (d *DHT) bootstrapPeers(c log.StandardLogger, ctx context.Context, host host.Host) {
+func (d *DHT) announceWithTimeout(c log.StandardLogger, ctx context.Context, host host.Host, kademliaDHT *dht.IpfsDHT) {
+	// We announce ourselves to the rendezvous point for all the peers.
+	// We have a safeguard of 1 hour to avoid blocking the main loop
+	// in case of network issues.
+	// The TTL of DHT is by default no longer than 3 hours, so we should
+	// be safe by having an entry less than that.
+	safeTimeout, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+
+	endChan := make(chan struct{})
+	go func() {
+		d.announceRendezvous(c, safeTimeout, host, kademliaDHT)
+		endChan <- struct{}{}
+	}()
+
+	select {
+	case <-endChan:
+	case <-safeTimeout.Done():
+		c.Error("Timeout while announcing rendezvous")
+	}
+}
+
+// canary searches the rendezvous points without announcing, and returns
+// true as soon as another peer is found. It gives up after CanaryTimeout.
+func (d *DHT) canary(c log.StandardLogger, ctx context.Context, host host.Host, kademliaDHT *dht.IpfsDHT) bool {
+	tCtx, cancel := context.WithTimeout(ctx, d.CanaryTimeout)
+	defer cancel()
+
+	routingDiscovery := discovery.NewRoutingDiscovery(kademliaDHT)
+	for {
+		d.bootstrapPeers(c, tCtx, host, d.bootstrapCandidates())
+		for _, rv := range d.Rendezvouses() {
+			peerChan, err := d.findPeers(tCtx, routingDiscovery, rv)
+			if err != nil {
+				c.Debugf("Canary search failed: %s", err.Error())
+				continue
+			}
+			for p := range peerChan {
+				if p.ID != host.ID() && len(p.Addrs) != 0 {
+					c.Debug("Canary found peer:", p)
+					return true
+				}
+			}
+		}
+
+		select {
+		case <-tCtx.Done():
+			return false
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// bootstrapPeers connects to the given bootstrap peers, and returns
+// how many of them the host is connected to
+func (d *DHT) bootstrapPeers(c log.StandardLogger, ctx context.Context, host host.Host, peers AddrList) int {
 	// Let's connect to the bootstrap nodes first. They will tell us about the
 	// other nodes in the network.
 	var wg sync.WaitGroup
-	for _, peerAddr := range d.BootstrapPeers {
-		peerinfo, _ := peer.AddrInfoFromP2pAddr(peerAddr)
+	var connected int32
+	// The peers are dialed concurrently, the hooks are called afterwards
+	// from the discovery loop
+	dials := make([]error, len(peers))
+	infos := make([]*peer.AddrInfo, len(peers))
+	var slots chan struct{}
+	if d.DialConcurrency > 0 {
+		slots = make(chan struct{}, d.DialConcurrency)
+	}
+	for i, peerAddr := range peers {
+		peerinfo, err := peer.AddrInfoFromP2pAddr(peerAddr)
+		if err != nil {
+			c.Debugf("Invalid bootstrap peer '%s': %s", peerAddr, err.Error())
+			continue
+		}
+		if slots != nil {
+			slots <- struct{}{}
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
 			if host.Network().Connectedness(peerinfo.ID) != network.Connected {
-				if err := host.Connect(ctx, *peerinfo); err != nil {
+				dialCtx, op := operations.Start(ctx, operations.Dial, peerinfo.ID.String())
+				start := time.Now()
+				err := host.Connect(dialCtx, *peerinfo)
+				metrics.DialLatency.Since(start)
+				op.Done()
+				if err != nil {
 					c.Debug(err.Error())
-				} else {
-					c.Debug("Connection established with bootstrap node:", *peerinfo)
+					metrics.BootstrapFailures.Add(1)
+					dials[i] = err
+					infos[i] = peerinfo
+					return
 				}
+				c.Debug("Connection established with bootstrap node:", *peerinfo)
+				infos[i] = peerinfo
 			}
+			atomic.AddInt32(&connected, 1)
 		}()
 	}
 	wg.Wait()
+	for i, p := range infos {
+		if p != nil {
+			d.dialed(*p, dials[i])
+		}
+	}
+	return int(connected)
+}
+
+// announced calls the hook after announcing on the rendezvous
+func (d *DHT) announced(rv string) {
+	d.hooks.Lock()
+	defer d.hooks.Unlock()
+	if d.OnAnnounce != nil {
+		d.OnAnnounce(rv)
+	}
+}
+
+// dialOutcome is the outcome of dialing a peer, reported to the hooks
+// once all the dials are done
+type dialOutcome struct {
+	peer peer.AddrInfo
+	err  error
+}
+
+// dialed calls the hooks with the outcome of dialing the peer
+func (d *DHT) dialed(p peer.AddrInfo, err error) {
+	d.hooks.Lock()
+	defer d.hooks.Unlock()
+	if err != nil {
+		if d.OnPeerConnectFailed != nil {
+			d.OnPeerConnectFailed(p, err)
+		}
+		return
+	}
+	if d.OnPeerConnected != nil {
+		d.OnPeerConnected(p)
+	}
 }
 
 func (d *DHT) FindClosePeers(ll log.StandardLogger, onlyStaticRelays bool, static ...string) func(ctx context.Context, numPeers int) <-chan peer.AddrInfo {
@@ -222,46 +675,276 @@ func (d *DHT) FindClosePeers(ll log.StandardLogger, onlyStaticRelays bool, stati
 	}
 }
 
-func (d *DHT) announceAndConnect(l log.StandardLogger, ctx context.Context, kademliaDHT *dht.IpfsDHT, host host.Host, rv string) error {
+// announceAndConnect announces the host on the rendezvous and connects to the
+// other peers found on it, returning how many were found
+func (d *DHT) announceAndConnect(l log.StandardLogger, ctx context.Context, kademliaDHT *dht.IpfsDHT, host host.Host, rv string) (int, error) {
 	l.Debug("Announcing ourselves...")
 
 	tCtx, c := context.WithTimeout(ctx, time.Second*120)
 	defer c()
 	routingDiscovery := discovery.NewRoutingDiscovery(kademliaDHT)
-	routingDiscovery.Advertise(tCtx, rv)
-	l.Debug("Successfully announced!")
+	aCtx, op := operations.Start(tCtx, operations.Query, "advertise")
+	_, err := routingDiscovery.Advertise(aCtx, rv)
+	op.Done()
+	if err != nil {
+		l.Debugf("Failed announcing on the DHT: %s", err.Error())
+	} else {
+		l.Debug("Successfully announced!")
+		d.announced(rv)
+	}
 	// Now, look for others who have announced
 	// This is like your friend telling you the location to meet you.
 	l.Debug("Searching for other peers...")
 
 	fCtx, cf := context.WithTimeout(ctx, time.Second*120)
 	defer cf()
-	peerChan, err := routingDiscovery.FindPeers(fCtx, rv)
-	if err != nil {
-		return err
+	start := time.Now()
+	peerChan, err := d.findPeers(fCtx, routingDiscovery, rv)
+	if err != nil && d.rendezvous == nil {
+		return 0, err
 	}
 
-	for p := range peerChan {
-		// Don't dial ourselves or peers without address
-		if p.ID == host.ID() || len(p.Addrs) == 0 {
-			continue
+	found := []peer.AddrInfo{}
+	if err == nil {
+		for p := range peerChan {
+			// Don't dial ourselves or peers without address
+			if p.ID == host.ID() || len(p.Addrs) == 0 {
+				continue
+			}
+			found = append(found, p)
 		}
+		metrics.DHTQueryLatency.Since(start)
+	} else {
+		l.Debugf("Failed searching on the DHT: %s", err.Error())
+	}
 
-		if host.Network().Connectedness(p.ID) != network.Connected {
+	if d.rendezvous != nil {
+		found = d.rendezvousFallback(l, ctx, host, rv, found)
+	}
+
+	if d.MaxPeersPerCycle > 0 && len(found) > d.MaxPeersPerCycle {
+		l.Debugf("Found %d peers, connecting to a sample of %d", len(found), d.MaxPeersPerCycle)
+	}
+
+	d.backoff.cleanup()
+	var (
+		wg        sync.WaitGroup
+		m         sync.Mutex
+		connected int
+		dialing   int
+		dials     []dialOutcome
+	)
+	done := sync.NewCond(&m)
+	slots := make(chan struct{}, max(d.DialConcurrency, 1))
+	// Dial the peers which connected reliably in the previous cycles first,
+	// and keep them in the sample
+	for _, p := range d.history.Sample(found, d.MaxPeersPerCycle) {
+		if host.Network().Connectedness(p.ID) == network.Connected {
+			l.Debug("Known peer (already connected):", p)
+			d.connected(p.ID)
+			d.cache(l, host, p)
+			continue
+		}
+		if d.backoff.Skip(host.Network(), p) {
+			continue
+		}
+		if !d.reserveDial(done, &connected, &dialing) {
+			l.Debug("Reached the connections limit of the discovery cycle")
+			break
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
 			l.Debug("Found peer:", p)
 			timeoutCtx, cancel := context.WithTimeout(ctx, time.Second*120)
 			defer cancel()
-			if err := host.Connect(timeoutCtx, p); err != nil {
+			dialCtx, op := operations.Start(timeoutCtx, operations.Dial, p.ID.String())
+			start := time.Now()
+			err := host.Connect(dialCtx, p)
+			metrics.DialLatency.Since(start)
+			op.Done()
+			if err != nil {
+				d.backoff.Failure(p.ID)
+				d.history.Record(p.ID, false)
 				l.Debugf("Failed connecting to '%s', error: '%s'", p, err.Error())
 			} else {
+				d.backoff.Success(p.ID)
+				d.history.Record(p.ID, true)
 				l.Debug("Connected to:", p)
+				d.connected(p.ID)
+				d.cache(l, host, p)
 			}
-		} else {
-			l.Debug("Known peer (already connected):", p)
-		}
+			m.Lock()
+			dialing--
+			if err == nil {
+				connected++
+			}
+			dials = append(dials, dialOutcome{peer: p, err: err})
+			done.Broadcast()
+			m.Unlock()
+		}()
+	}
+	wg.Wait()
+	for _, o := range dials {
+		d.dialed(o.peer, o.err)
 	}
 
 	l.Debug("Finished searching for peers.")
+	if d.OnCycle != nil {
+		d.OnCycle(rv, len(found), connected)
+	}
 
-	return nil
+	return len(found), nil
+}
+
+// reserveDial reserves a dial within MaxConnectionsPerDiscovery, counting
+// the dials in flight as if they succeeded. When the limit is taken by
+// in-flight dials, it waits for them to complete. It returns false once
+// the limit is reached.
+func (d *DHT) reserveDial(done *sync.Cond, connected, dialing *int) bool {
+	done.L.Lock()
+	defer done.L.Unlock()
+	if d.MaxConnectionsPerDiscovery > 0 {
+		for *dialing > 0 && *connected+*dialing >= d.MaxConnectionsPerDiscovery {
+			done.Wait()
+		}
+		if *connected >= d.MaxConnectionsPerDiscovery {
+			return false
+		}
+	}
+	*dialing++
+	return true
+}
+
+func (d *DHT) connected(p peer.ID) {
+	d.tracker.add(p)
+	if d.OnConnect != nil {
+		d.OnConnect(p)
+	}
+}
+
+// cache records the peer met on the rendezvous in the PeerCache, with the
+// addresses the host knows for it
+func (d *DHT) cache(l log.StandardLogger, host host.Host, p peer.AddrInfo) {
+	if d.PeerCache == nil {
+		return
+	}
+	if addrs := host.Peerstore().Addrs(p.ID); len(addrs) > 0 {
+		p.Addrs = addrs
+	}
+	if err := d.PeerCache.Record(p); err != nil {
+		l.Debugf("Failed caching the peer '%s': %s", p.ID, err.Error())
+	}
+}
+
+// restoreRendezvous adds the last rendezvous peers were found on to the ones
+// searched on the first cycle, if it is at most two OTP intervals old:
+// the peers still announce on their previous rendezvous
+func (d *DHT) restoreRendezvous(c log.StandardLogger) {
+	if d.OTPKey == "" || d.FixedRendezvous != "" || d.OTPInterval <= 0 {
+		return
+	}
+	if rv, ok := d.PeerCache.Rendezvous(2 * time.Duration(d.OTPInterval) * time.Second); ok {
+		c.Debugf("Searching also the cached rendezvous %s", rv)
+		d.rendezvousHistory.Add(rv)
+	}
+}
+
+// dialCached dials the peers of the PeerCache at once, or DialConcurrency
+// at a time, and returns how many the host is connected to
+func (d *DHT) dialCached(c log.StandardLogger, ctx context.Context, host host.Host) int {
+	peers, err := d.PeerCache.Peers()
+	if err != nil {
+		c.Warnf("Failed reading the peer cache: %s", err.Error())
+		return 0
+	}
+	if len(peers) == 0 {
+		return 0
+	}
+	c.Infof("Dialing %d cached peers", len(peers))
+
+	var wg sync.WaitGroup
+	var connected int32
+	// The hooks are called once all the peers are dialed
+	dials := make([]*dialOutcome, len(peers))
+	var slots chan struct{}
+	if d.DialConcurrency > 0 {
+		slots = make(chan struct{}, d.DialConcurrency)
+	}
+	for i, p := range peers {
+		if p.ID == host.ID() {
+			continue
+		}
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			if host.Network().Connectedness(p.ID) != network.Connected {
+				timeoutCtx, cancel := context.WithTimeout(ctx, cachedPeerDialLimit)
+				defer cancel()
+				dialCtx, op := operations.Start(timeoutCtx, operations.Dial, p.ID.String())
+				start := time.Now()
+				err := host.Connect(dialCtx, p)
+				metrics.DialLatency.Since(start)
+				op.Done()
+				dials[i] = &dialOutcome{peer: p, err: err}
+				if err != nil {
+					c.Debugf("Failed connecting to the cached peer '%s': %s", p.ID, err.Error())
+					return
+				}
+			}
+			c.Debug("Connected to cached peer:", p.ID)
+			d.connected(p.ID)
+			d.cache(c, host, p)
+			atomic.AddInt32(&connected, 1)
+		}()
+	}
+	wg.Wait()
+	for _, o := range dials {
+		if o != nil {
+			d.dialed(o.peer, o.err)
+		}
+	}
+	c.Infof("Connected to %d cached peers out of %d", connected, len(peers))
+	return int(connected)
+}
+
+// rendezvousFallback registers on the rendezvous servers, and searches
+// peers on them if none was found on the DHT
+func (d *DHT) rendezvousFallback(l log.StandardLogger, ctx context.Context, host host.Host, rv string, found []peer.AddrInfo) []peer.AddrInfo {
+	rCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if err := d.rendezvous.Register(rCtx, host, rv, 2*d.RefreshDiscoveryTime); err != nil {
+		l.Debugf("Failed registering on the rendezvous servers: %s", err.Error())
+	}
+	if len(found) > 0 {
+		return found
+	}
+
+	l.Debug("No peers found on the DHT, searching on the rendezvous servers")
+	peers, err := d.rendezvous.Discover(rCtx, host, rv)
+	if err != nil {
+		l.Debugf("Failed searching on the rendezvous servers: %s", err.Error())
+	}
+	return peers
+}
+
+// SamplePeers returns a random subset of n peers from the given ones.
+// If n is 0 or there are not enough peers, all of them are returned.
+func SamplePeers(peers []peer.AddrInfo, n int) []peer.AddrInfo {
+	if n <= 0 || len(peers) <= n {
+		return peers
+	}
+	sample := make([]peer.AddrInfo, len(peers))
+	copy(sample, peers)
+	rand.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+	return sample[:n]
 }
@@ -0,0 +1,184 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/crypto"
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+)
+
+var _ = Describe("DHT", func() {
+	Context("OTP key rotation", func() {
+		It("meets peers on both the old and the new key during the overlap", func() {
+			old := NewDHT()
+			old.OTPKey = "old"
+			old.OTPInterval = 9000
+			old.KeyLength = 12
+
+			new := NewDHT()
+			new.OTPKey = "new"
+			new.OTPInterval = 9000
+			new.KeyLength = 12
+
+			migrating := NewDHT()
+			migrating.OTPKey = "new"
+			migrating.OTPKeys = []string{"old"}
+			migrating.OTPInterval = 9000
+			migrating.KeyLength = 12
+
+			Expect(old.Rendezvous()).ToNot(Equal(new.Rendezvous()))
+			Expect(migrating.Rendezvouses()).To(ConsistOf(old.Rendezvous(), new.Rendezvous()))
+			Expect(migrating.Rendezvous()).To(Equal(new.Rendezvous()))
+		})
+
+		It("ignores additional keys with a static rendezvous", func() {
+			d := NewDHT()
+			d.RendezvousString = "static"
+			d.OTPKeys = []string{"old"}
+			Expect(d.Rendezvouses()).To(Equal([]string{"static"}))
+		})
+	})
+	Context("OTP window tolerance", func() {
+		// skewed returns the rendezvous of a peer whose clock is offset intervals away
+		skewed := func(d *DHT, offset int) string {
+			return crypto.MD5(crypto.TOTPAt(sha256.New, d.KeyLength, d.OTPInterval, d.OTPKey, offset))
+		}
+
+		It("announces on the adjacent intervals", func() {
+			d := NewDHT()
+			d.OTPKey = "key"
+			d.OTPInterval = 9000
+			d.KeyLength = 12
+			Expect(d.Rendezvouses()).To(Equal([]string{d.Rendezvous()}))
+			Expect(skewed(d, 0)).To(Equal(d.Rendezvous()))
+
+			d.OTPWindowTolerance = 1
+			Expect(d.Rendezvouses()).To(HaveLen(3))
+			Expect(d.Rendezvouses()[0]).To(Equal(d.Rendezvous()))
+			Expect(d.Rendezvouses()).To(ContainElements(skewed(d, -1), skewed(d, 1)))
+			Expect(d.Rendezvouses()).ToNot(ContainElement(skewed(d, 2)))
+
+			d.OTPKeys = []string{"old"}
+			Expect(d.Rendezvouses()).To(HaveLen(6))
+		})
+
+		It("is skipped with a static rendezvous", func() {
+			d := NewDHT()
+			d.RendezvousString = "static"
+			d.OTPWindowTolerance = 2
+			Expect(d.Rendezvouses()).To(Equal([]string{"static"}))
+		})
+	})
+	Context("fixed rendezvous", func() {
+		It("uses the fixed rendezvous regardless of the OTP", func() {
+			d := NewDHT()
+			d.OTPKey = "key"
+			d.OTPKeys = []string{"old"}
+			d.OTPInterval = 1
+			d.KeyLength = 12
+			otp := d.Rendezvous()
+			Expect(d.Diagnosis()).To(BeEmpty())
+
+			d.FixedRendezvous = "fixture"
+			Expect(d.Rendezvous()).To(Equal("fixture"))
+			Expect(d.Rendezvouses()).To(Equal([]string{"fixture"}))
+			Expect(d.Diagnosis()).To(ContainSubstring("INSECURE"))
+
+			// The OTP rendezvous moves on, the fixed one doesn't
+			Eventually(func() string {
+				d.FixedRendezvous = ""
+				defer func() { d.FixedRendezvous = "fixture" }()
+				return d.Rendezvous()
+			}, 5*time.Second, 100*time.Millisecond).ShouldNot(Equal(otp))
+			Expect(d.Rendezvous()).To(Equal("fixture"))
+		})
+	})
+
+	Context("private DHT", func() {
+		run := func(d *DHT) []protocol.ID {
+			h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(h.Close)
+			ctx, cancel := context.WithCancel(context.Background())
+			DeferCleanup(cancel)
+			Expect(d.Run(logger.New(log.LevelFatal), ctx, h)).To(Succeed())
+			DeferCleanup(d.Close)
+			return h.Mux().Protocols()
+		}
+
+		It("speaks the DHT protocol with the prefix", func() {
+			d := NewDHT(dht.Mode(dht.ModeServer))
+			d.ProtocolPrefix = "/private"
+			protocols := run(d)
+			Expect(protocols).To(ContainElement(protocol.ID("/private/kad/1.0.0")))
+			Expect(protocols).ToNot(ContainElement(protocol.ID("/ipfs/kad/1.0.0")))
+			Expect(d.BootstrapPeers).To(BeEmpty())
+		})
+
+		It("takes precedence over the prefix of the DHT options", func() {
+			d := NewDHT(dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/other"))
+			d.ProtocolPrefix = "/private"
+			protocols := run(d)
+			Expect(protocols).To(ContainElement(protocol.ID("/private/kad/1.0.0")))
+			Expect(protocols).ToNot(ContainElement(protocol.ID("/other/kad/1.0.0")))
+		})
+
+		It("keeps the prefix of the DHT options when unset", func() {
+			Expect(run(NewDHT(dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/other")))).To(ContainElement(protocol.ID("/other/kad/1.0.0")))
+		})
+	})
+
+	Context("peer sampling", func() {
+		peers := []peer.AddrInfo{}
+		for i := 0; i < 100; i++ {
+			peers = append(peers, peer.AddrInfo{ID: peer.ID(fmt.Sprint(i))})
+		}
+
+		It("returns all the peers when under the limit", func() {
+			Expect(SamplePeers(peers, 0)).To(Equal(peers))
+			Expect(SamplePeers(peers, 200)).To(Equal(peers))
+		})
+
+		It("picks a random subset", func() {
+			seen := map[peer.ID]bool{}
+			samples := map[peer.ID]bool{}
+			for i := 0; i < 20; i++ {
+				s := SamplePeers(peers, 5)
+				Expect(len(s)).To(Equal(5))
+				samples[s[0].ID] = true
+				for _, p := range s {
+					Expect(peers).To(ContainElement(p))
+					seen[p.ID] = true
+				}
+			}
+			// A deterministic selection would always return the first 5 peers
+			Expect(len(seen)).To(BeNumerically(">", 5))
+			Expect(len(samples)).To(BeNumerically(">", 1))
+		})
+	})
+})
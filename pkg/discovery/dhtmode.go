@@ -0,0 +1,126 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-log"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// The modes the DHT can run in
+const (
+	// DHTModeAuto runs the DHT in server mode while the node is publicly
+	// reachable, and in client mode otherwise
+	DHTModeAuto   = "auto"
+	DHTModeServer = "server"
+	DHTModeClient = "client"
+)
+
+// ParseDHTMode returns the DHT option of the mode
+func ParseDHTMode(mode string) (dht.ModeOpt, error) {
+	switch mode {
+	case DHTModeAuto:
+		return dht.ModeAuto, nil
+	case DHTModeServer:
+		return dht.ModeServer, nil
+	case DHTModeClient:
+		return dht.ModeClient, nil
+	}
+	return 0, fmt.Errorf("invalid DHT mode '%s', expected %s, %s or %s", mode, DHTModeAuto, DHTModeServer, DHTModeClient)
+}
+
+// modeController follows the reachability of the node told by AutoNAT.
+// In auto mode the DHT switches between server and client mode on the same
+// events: the controller keeps track of it for the status and the logs.
+type modeController struct {
+	sync.Mutex
+	reachability network.Reachability
+}
+
+func (m *modeController) start(c log.StandardLogger, ctx context.Context, h host.Host, auto bool) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				r := e.(event.EvtLocalReachabilityChanged).Reachability
+				m.Lock()
+				m.reachability = r
+				m.Unlock()
+				if auto {
+					mode := DHTModeClient
+					if r == network.ReachabilityPublic {
+						mode = DHTModeServer
+					}
+					c.Infof("Reachability is now %s, running the DHT in %s mode", r, mode)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *modeController) Reachability() network.Reachability {
+	m.Lock()
+	defer m.Unlock()
+	return m.reachability
+}
+
+// ModeStatus returns the mode the DHT is set to and the one it is currently
+// running in, along with the reachability of the node
+func (d *DHT) ModeStatus() types.DHTStatus {
+	s := types.DHTStatus{
+		Setting:      d.DHTMode,
+		Reachability: d.mode.Reachability().String(),
+	}
+	if d.IpfsDHT != nil {
+		s.Mode = DHTModeClient
+		if serverMode(d.IpfsDHT.Mode(), d.mode.Reachability()) {
+			s.Mode = DHTModeServer
+		}
+	}
+	return s
+}
+
+// serverMode tells if the DHT runs in server mode. The automatic modes
+// switch on the reachability as the DHT does.
+func serverMode(m dht.ModeOpt, r network.Reachability) bool {
+	switch m {
+	case dht.ModeServer:
+		return true
+	case dht.ModeAuto:
+		return r == network.ReachabilityPublic
+	case dht.ModeAutoServer:
+		return r != network.ReachabilityPrivate
+	}
+	return false
+}
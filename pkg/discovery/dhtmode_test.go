@@ -0,0 +1,121 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("DHT mode", func() {
+	run := func(d *DHT) host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		d.ProtocolPrefix = "/mode"
+		Expect(d.Run(logger.New(log.LevelFatal), ctx, h)).To(Succeed())
+		DeferCleanup(d.Close)
+		return h
+	}
+
+	// reachability returns a function simulating AutoNAT telling the reachability of the host
+	reachability := func(h host.Host) func(network.Reachability) {
+		em, err := h.EventBus().Emitter(new(event.EvtLocalReachabilityChanged), eventbus.Stateful)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(em.Close)
+		return func(r network.Reachability) {
+			Expect(em.Emit(event.EvtLocalReachabilityChanged{Reachability: r})).To(Succeed())
+		}
+	}
+
+	// serving tells if the DHT of the host answers the queries of the other peers
+	serving := func(h host.Host) func() bool {
+		return func() bool {
+			for _, p := range h.Mux().Protocols() {
+				if p == protocol.ID("/mode/kad/1.0.0") {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	It("parses the modes", func() {
+		for mode, opt := range map[string]dht.ModeOpt{DHTModeAuto: dht.ModeAuto, DHTModeServer: dht.ModeServer, DHTModeClient: dht.ModeClient} {
+			Expect(ParseDHTMode(mode)).To(Equal(opt))
+		}
+		_, err := ParseDHTMode("relay")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("switches mode as the reachability changes", func() {
+		d := NewDHT()
+		d.DHTMode = DHTModeAuto
+		h := run(d)
+		set := reachability(h)
+		Expect(d.ModeStatus()).To(Equal(types.DHTStatus{Setting: DHTModeAuto, Mode: DHTModeClient, Reachability: "Unknown"}))
+		Expect(serving(h)()).To(BeFalse())
+
+		set(network.ReachabilityPublic)
+		Eventually(serving(h), 5*time.Second).Should(BeTrue())
+		Eventually(d.ModeStatus, 5*time.Second).Should(Equal(types.DHTStatus{Setting: DHTModeAuto, Mode: DHTModeServer, Reachability: "Public"}))
+
+		set(network.ReachabilityPrivate)
+		Eventually(serving(h), 5*time.Second).Should(BeFalse())
+		Eventually(d.ModeStatus, 5*time.Second).Should(Equal(types.DHTStatus{Setting: DHTModeAuto, Mode: DHTModeClient, Reachability: "Private"}))
+
+		set(network.ReachabilityPublic)
+		Eventually(serving(h), 5*time.Second).Should(BeTrue())
+		Eventually(d.ModeStatus, 5*time.Second).Should(Equal(types.DHTStatus{Setting: DHTModeAuto, Mode: DHTModeServer, Reachability: "Public"}))
+	})
+
+	It("keeps a static mode regardless of the reachability", func() {
+		d := NewDHT(dht.Mode(dht.ModeServer))
+		d.DHTMode = DHTModeClient
+		h := run(d)
+		set := reachability(h)
+		Expect(d.ModeStatus().Mode).To(Equal(DHTModeClient))
+
+		set(network.ReachabilityPublic)
+		Eventually(func() string { return d.ModeStatus().Reachability }, 5*time.Second).Should(Equal("Public"))
+		Consistently(serving(h), time.Second).Should(BeFalse())
+		Expect(d.ModeStatus().Mode).To(Equal(DHTModeClient))
+	})
+
+	It("rejects an invalid mode", func() {
+		d := NewDHT()
+		d.DHTMode = "relay"
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		defer h.Close()
+		Expect(d.Run(logger.New(log.LevelFatal), context.Background(), h)).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,66 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RendezvousDiagnosis counts the discovery rounds which found no peer on the
+// rendezvous while the DHT itself is healthy. Nodes generated with different
+// OTP parameters (key, interval or length), or with clocks out of sync,
+// compute different rendezvous and never meet, without any error.
+// After Threshold of such rounds in a row it raises a warning with the
+// likely causes, which is cleared as soon as a peer is found.
+type RendezvousDiagnosis struct {
+	sync.Mutex
+	Threshold int
+
+	empty   int
+	warning string
+}
+
+// Record records a discovery round, with the peers found on the rendezvous
+// and the ones in the DHT routing table. Rounds with an empty routing table
+// point to a connectivity issue instead, and are not counted.
+// It returns true when the warning is raised.
+func (r *RendezvousDiagnosis) Record(found, dhtPeers int) bool {
+	r.Lock()
+	defer r.Unlock()
+	if found > 0 {
+		r.empty = 0
+		r.warning = ""
+		return false
+	}
+	if dhtPeers == 0 || r.Threshold <= 0 {
+		return false
+	}
+	r.empty++
+	if r.empty < r.Threshold || r.warning != "" {
+		return false
+	}
+	r.warning = fmt.Sprintf(
+		"no peer found on the rendezvous for %d discovery cycles, while the DHT has %d peers: "+
+			"the nodes may not share the same OTP parameters. Check that all the nodes use the same "+
+			"token (otp.dht key, interval and length) and have their clocks in sync", r.empty, dhtPeers)
+	return true
+}
+
+// Warning returns the current warning, empty if none
+func (r *RendezvousDiagnosis) Warning() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.warning
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+)
+
+var _ = Describe("Rendezvous diagnosis", func() {
+	It("warns on persistent rounds without peers", func() {
+		d := &RendezvousDiagnosis{Threshold: 3}
+		Expect(d.Record(0, 20)).To(BeFalse())
+		Expect(d.Record(0, 20)).To(BeFalse())
+		Expect(d.Warning()).To(BeEmpty())
+
+		Expect(d.Record(0, 20)).To(BeTrue())
+		Expect(d.Warning()).To(ContainSubstring("OTP parameters"))
+		Expect(d.Warning()).To(ContainSubstring("clocks"))
+
+		// The warning is raised once
+		Expect(d.Record(0, 20)).To(BeFalse())
+		Expect(d.Warning()).ToNot(BeEmpty())
+	})
+
+	It("clears the warning once a peer is found", func() {
+		d := &RendezvousDiagnosis{Threshold: 1}
+		Expect(d.Record(0, 20)).To(BeTrue())
+		Expect(d.Record(1, 20)).To(BeFalse())
+		Expect(d.Warning()).To(BeEmpty())
+
+		// The count starts over
+		d.Threshold = 2
+		Expect(d.Record(0, 20)).To(BeFalse())
+		Expect(d.Record(0, 20)).To(BeTrue())
+	})
+
+	It("does not count the rounds with an empty DHT", func() {
+		d := &RendezvousDiagnosis{Threshold: 2}
+		Expect(d.Record(0, 20)).To(BeFalse())
+		for i := 0; i < 5; i++ {
+			Expect(d.Record(0, 0)).To(BeFalse())
+		}
+		Expect(d.Record(0, 20)).To(BeTrue())
+	})
+
+	It("is disabled without threshold", func() {
+		d := &RendezvousDiagnosis{}
+		for i := 0; i < 5; i++ {
+			Expect(d.Record(0, 20)).To(BeFalse())
+		}
+		Expect(d.Warning()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,145 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// dialHistoryLength is the number of dial outcomes retained per peer
+	dialHistoryLength = 8
+	// dialHistoryPeers caps the number of peers the history is retained for
+	dialHistoryPeers = 1024
+)
+
+type dialRecord struct {
+	outcomes []bool
+	last     time.Time
+}
+
+func (r *dialRecord) score() float64 {
+	ok := 0
+	for _, o := range r.outcomes {
+		if o {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(r.outcomes))
+}
+
+// DialHistory retains the outcome of the last dials to each peer,
+// to order the dial attempts of a discovery cycle by reliability
+type DialHistory struct {
+	sync.Mutex
+	peers map[peer.ID]*dialRecord
+}
+
+// NewDialHistory returns a new DialHistory
+func NewDialHistory() *DialHistory {
+	return &DialHistory{peers: make(map[peer.ID]*dialRecord)}
+}
+
+// Record records the outcome of a dial to the peer
+func (h *DialHistory) Record(p peer.ID, success bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	r, exists := h.peers[p]
+	if !exists {
+		if len(h.peers) >= dialHistoryPeers {
+			h.evict()
+		}
+		r = &dialRecord{}
+		h.peers[p] = r
+	}
+	r.outcomes = append(r.outcomes, success)
+	if len(r.outcomes) > dialHistoryLength {
+		r.outcomes = r.outcomes[len(r.outcomes)-dialHistoryLength:]
+	}
+	r.last = time.Now()
+}
+
+// evict drops the peer dialed least recently
+func (h *DialHistory) evict() {
+	var oldest peer.ID
+	var t time.Time
+	for p, r := range h.peers {
+		if t.IsZero() || r.last.Before(t) {
+			oldest, t = p, r.last
+		}
+	}
+	delete(h.peers, oldest)
+}
+
+// Score returns the ratio of the successful dials to the peer,
+// and false if the peer was never dialed
+func (h *DialHistory) Score(p peer.ID) (float64, bool) {
+	h.Lock()
+	defer h.Unlock()
+	r, exists := h.peers[p]
+	if !exists {
+		return 0, false
+	}
+	return r.score(), true
+}
+
+// Order returns the peers in the order they should be dialed: the known ones
+// by decreasing reliability, interleaved with the unknown ones (in their
+// original order) so that new peers are still dialed early.
+func (h *DialHistory) Order(peers []peer.AddrInfo) []peer.AddrInfo {
+	type scored struct {
+		peer.AddrInfo
+		score float64
+	}
+	known, unknown := []scored{}, []peer.AddrInfo{}
+	for _, p := range peers {
+		if s, ok := h.Score(p.ID); ok {
+			known = append(known, scored{p, s})
+		} else {
+			unknown = append(unknown, p)
+		}
+	}
+	sort.SliceStable(known, func(i, j int) bool { return known[i].score > known[j].score })
+
+	ordered := make([]peer.AddrInfo, 0, len(peers))
+	for i := 0; i < len(known) || i < len(unknown); i++ {
+		if i < len(known) {
+			ordered = append(ordered, known[i].AddrInfo)
+		}
+		if i < len(unknown) {
+			ordered = append(ordered, unknown[i])
+		}
+	}
+	return ordered
+}
+
+// Sample returns n of the peers in the order they should be dialed, picked
+// by Order: the most reliable known peers and the unknown ones, chosen at
+// random among the peers with the same reliability.
+// If n is 0 or there are not enough peers, all of them are returned.
+func (h *DialHistory) Sample(peers []peer.AddrInfo, n int) []peer.AddrInfo {
+	if n <= 0 || len(peers) <= n {
+		return h.Order(peers)
+	}
+	shuffled := make([]peer.AddrInfo, len(peers))
+	copy(shuffled, peers)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	return h.Order(shuffled)[:n]
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+)
+
+var _ = Describe("DialHistory", func() {
+	ids := func(peers []peer.AddrInfo) []peer.ID {
+		res := []peer.ID{}
+		for _, p := range peers {
+			res = append(res, p.ID)
+		}
+		return res
+	}
+
+	It("dials the reliable peers first", func() {
+		h := NewDialHistory()
+		for i := 0; i < 3; i++ {
+			h.Record("good", true)
+			h.Record("bad", false)
+		}
+		h.Record("flaky", true)
+		h.Record("flaky", false)
+
+		Expect(ids(h.Order([]peer.AddrInfo{{ID: "bad"}, {ID: "flaky"}, {ID: "good"}}))).To(Equal([]peer.ID{"good", "flaky", "bad"}))
+	})
+
+	It("interleaves the unknown peers", func() {
+		h := NewDialHistory()
+		h.Record("good", true)
+		h.Record("bad", false)
+
+		Expect(ids(h.Order([]peer.AddrInfo{{ID: "new1"}, {ID: "bad"}, {ID: "new2"}, {ID: "good"}, {ID: "new3"}}))).
+			To(Equal([]peer.ID{"good", "new1", "bad", "new2", "new3"}))
+	})
+
+	It("scores the recent dials only", func() {
+		h := NewDialHistory()
+		_, known := h.Score("peer")
+		Expect(known).To(BeFalse())
+
+		for i := 0; i < 20; i++ {
+			h.Record("peer", false)
+		}
+		for i := 0; i < 8; i++ {
+			h.Record("peer", true)
+		}
+		score, known := h.Score("peer")
+		Expect(known).To(BeTrue())
+		Expect(score).To(Equal(1.0))
+	})
+
+	It("keeps the reliable peers in the sample", func() {
+		h := NewDialHistory()
+		peers := []peer.AddrInfo{}
+		for i := 0; i < 20; i++ {
+			id := peer.ID(fmt.Sprintf("peer%d", i))
+			peers = append(peers, peer.AddrInfo{ID: id})
+			h.Record(id, i < 2)
+		}
+		peers = append(peers, peer.AddrInfo{ID: "new"})
+
+		for i := 0; i < 10; i++ {
+			sample := ids(h.Sample(peers, 4))
+			Expect(sample).To(HaveLen(4))
+			Expect(sample).To(ContainElements(peer.ID("peer0"), peer.ID("peer1"), peer.ID("new")))
+		}
+		Expect(ids(h.Sample(peers[:3], 4))).To(Equal([]peer.ID{"peer0", "peer1", "peer2"}))
+	})
+})
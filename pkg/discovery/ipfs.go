@@ -0,0 +1,56 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	maddr "github.com/multiformats/go-multiaddr"
+)
+
+// IPFSConfigPath returns the location of the IPFS config of the user,
+// honoring $IPFS_PATH as IPFS does
+func IPFSConfigPath() string {
+	if p := os.Getenv("IPFS_PATH"); p != "" {
+		return filepath.Join(p, "config")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ipfs", "config")
+}
+
+// IPFSBootstrapPeers returns the bootstrap peers listed in the IPFS config at path.
+// Invalid addresses are skipped.
+func IPFSBootstrapPeers(path string) (AddrList, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := struct {
+		Bootstrap []string
+	}{}
+	if err := json.Unmarshal(dat, &cfg); err != nil {
+		return nil, err
+	}
+
+	al := AddrList{}
+	for _, b := range cfg.Bootstrap {
+		if a, err := maddr.NewMultiaddr(b); err == nil {
+			al = append(al, a)
+		}
+	}
+	return al, nil
+}
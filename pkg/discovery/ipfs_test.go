@@ -0,0 +1,79 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+)
+
+const sampleIPFSConfig = `{
+  "Identity": {
+    "PeerID": "12D3KooWQe3bCt4J9SJ5wXNjd1NFGNbSG6ioVgzfjCmcVHQdypH8"
+  },
+  "Bootstrap": [
+    "/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+    "/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
+    "not-an-address"
+  ],
+  "Addresses": {
+    "Swarm": ["/ip4/0.0.0.0/tcp/4001"]
+  }
+}`
+
+var _ = Describe("IPFS config", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "ipfs")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("reads the bootstrap peers", func() {
+		path := filepath.Join(dir, "config")
+		Expect(os.WriteFile(path, []byte(sampleIPFSConfig), 0600)).To(Succeed())
+
+		peers, err := IPFSBootstrapPeers(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(peers).To(HaveLen(2))
+		Expect(peers[0].String()).To(Equal("/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"))
+		Expect(peers[1].String()).To(Equal("/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ"))
+	})
+
+	It("fails on missing or malformed configs", func() {
+		_, err := IPFSBootstrapPeers(filepath.Join(dir, "missing"))
+		Expect(err).To(HaveOccurred())
+
+		path := filepath.Join(dir, "config")
+		Expect(os.WriteFile(path, []byte("{ not json"), 0600)).To(Succeed())
+		_, err = IPFSBootstrapPeers(path)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("honors IPFS_PATH", func() {
+		os.Setenv("IPFS_PATH", dir)
+		defer os.Unsetenv("IPFS_PATH")
+		Expect(IPFSConfigPath()).To(Equal(filepath.Join(dir, "config")))
+	})
+})
@@ -0,0 +1,211 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	maddr "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Defaults of the learned bootstrap peers
+const (
+	DefaultLearnedBootstrapMax        = 20
+	DefaultLearnedBootstrapPerMember  = 5
+	DefaultLearnedBootstrapMinSources = 2
+	DefaultLearnedBootstrapTTL        = 24 * time.Hour
+)
+
+// LearnedBootstrap keeps the bootstrap peers shared by the members of the
+// peer exchange. They are dialed along with the configured bootstrap peers,
+// so the node can still reach the network if those go down.
+// A learned peer is trusted only once MinSources members shared it.
+type LearnedBootstrap struct {
+	// Max caps the learned peers: the ones shared by the fewest members are dropped first
+	Max int
+	// PerMember caps the peers taken from each member at each exchange
+	PerMember int
+	// MinSources is how many members must share a peer before it is dialed
+	MinSources int
+	// TTL is how long a member sharing a peer is remembered
+	TTL time.Duration
+	// Private accepts the peers with private addresses too, for
+	// networks without public bootstrap peers
+	Private bool
+	// Shared, when set, returns the bootstrap peers of the node, to share with the members
+	Shared func() AddrList
+
+	sync.Mutex
+	learned map[peer.ID]*learnedPeer
+}
+
+type learnedPeer struct {
+	addrs   []maddr.Multiaddr
+	sources map[peer.ID]time.Time
+}
+
+// NewLearnedBootstrap returns a LearnedBootstrap with the default limits
+func NewLearnedBootstrap() *LearnedBootstrap {
+	return &LearnedBootstrap{
+		Max:        DefaultLearnedBootstrapMax,
+		PerMember:  DefaultLearnedBootstrapPerMember,
+		MinSources: DefaultLearnedBootstrapMinSources,
+		TTL:        DefaultLearnedBootstrapTTL,
+	}
+}
+
+// accepts returns true if the address can be shared and learned
+func (b *LearnedBootstrap) accepts(a maddr.Multiaddr) bool {
+	return b.Private || manet.IsPublicAddr(a)
+}
+
+// filter returns the peers with the addresses which can be shared, in
+// the order they are listed, up to max (if > 0). Invalid entries are skipped.
+func (b *LearnedBootstrap) filter(peers AddrList, max int) (res []peer.AddrInfo) {
+	index := map[peer.ID]int{}
+	for _, a := range peers {
+		info, err := peer.AddrInfoFromP2pAddr(a)
+		if err != nil {
+			continue
+		}
+		for _, addr := range info.Addrs {
+			if !b.accepts(addr) {
+				continue
+			}
+			i, ok := index[info.ID]
+			if !ok {
+				if max > 0 && len(res) >= max {
+					break
+				}
+				i = len(res)
+				index[info.ID] = i
+				res = append(res, peer.AddrInfo{ID: info.ID})
+			}
+			res[i].Addrs = append(res[i].Addrs, addr)
+		}
+	}
+	return
+}
+
+// share returns the bootstrap peers of the node which can be shared
+func (b *LearnedBootstrap) share() (res []string) {
+	if b.Shared == nil {
+		return
+	}
+	for _, info := range b.filter(b.Shared(), 0) {
+		addrs, _ := peer.AddrInfoToP2pAddrs(&info)
+		for _, a := range addrs {
+			res = append(res, a.String())
+		}
+	}
+	return
+}
+
+// Learn records the bootstrap peers shared by a member, and returns how many were taken
+func (b *LearnedBootstrap) Learn(from peer.ID, peers AddrList) int {
+	b.Lock()
+	defer b.Unlock()
+	if b.learned == nil {
+		b.learned = make(map[peer.ID]*learnedPeer)
+	}
+	b.expire()
+
+	taken := 0
+	for _, info := range b.filter(peers, b.PerMember) {
+		if info.ID == from {
+			// A member can't vouch for itself
+			continue
+		}
+		lp, ok := b.learned[info.ID]
+		if !ok {
+			lp = &learnedPeer{sources: make(map[peer.ID]time.Time)}
+			b.learned[info.ID] = lp
+		}
+		lp.sources[from] = time.Now()
+		for _, a := range info.Addrs {
+			if !containsAddr(lp.addrs, a) {
+				lp.addrs = append(lp.addrs, a)
+			}
+		}
+		taken++
+	}
+
+	if b.Max > 0 && len(b.learned) > b.Max {
+		for _, id := range b.ranked()[b.Max:] {
+			delete(b.learned, id)
+		}
+	}
+	return taken
+}
+
+// Peers returns the learned peers shared by at least MinSources members,
+// the ones shared by the most members first
+func (b *LearnedBootstrap) Peers() AddrList {
+	b.Lock()
+	defer b.Unlock()
+	b.expire()
+
+	res := AddrList{}
+	for _, id := range b.ranked() {
+		lp := b.learned[id]
+		if len(lp.sources) < b.MinSources {
+			continue
+		}
+		addrs, _ := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: id, Addrs: lp.addrs})
+		res = append(res, addrs...)
+	}
+	return res
+}
+
+// ranked returns the learned peers sorted by the number of members sharing them
+func (b *LearnedBootstrap) ranked() []peer.ID {
+	ids := make([]peer.ID, 0, len(b.learned))
+	for id := range b.learned {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		si, sj := len(b.learned[ids[i]].sources), len(b.learned[ids[j]].sources)
+		if si != sj {
+			return si > sj
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// expire forgets the members which didn't share a peer within the TTL
+func (b *LearnedBootstrap) expire() {
+	if b.TTL <= 0 {
+		return
+	}
+	for id, lp := range b.learned {
+		prune(lp.sources, b.TTL)
+		if len(lp.sources) == 0 {
+			delete(b.learned, id)
+		}
+	}
+}
+
+func containsAddr(addrs []maddr.Multiaddr, a maddr.Multiaddr) bool {
+	for _, e := range addrs {
+		if e.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	discovery "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+
+	"github.com/mudler/edgevpn/pkg/operations"
+)
+
+// DefaultFindPeersLimiter is shared by all the DHT discoveries of the process,
+// bounding the DHT queries of nodes joining several networks too
+var DefaultFindPeersLimiter = NewQueryLimiter(0)
+
+// QueryLimiter limits the concurrent queries. Queries exceeding the limit are
+// queued and served in arrival order, so no rendezvous starves the others.
+type QueryLimiter struct {
+	sync.Mutex
+	limit, active int
+	queue         []chan struct{}
+}
+
+// NewQueryLimiter returns a QueryLimiter allowing limit concurrent queries.
+// 0 means no limit.
+func NewQueryLimiter(limit int) *QueryLimiter {
+	return &QueryLimiter{limit: limit}
+}
+
+// SetLimit changes the concurrent queries allowed, 0 means no limit
+func (q *QueryLimiter) SetLimit(limit int) {
+	q.Lock()
+	q.limit = limit
+	q.Unlock()
+	q.wake()
+}
+
+// Active returns the queries currently running
+func (q *QueryLimiter) Active() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.active
+}
+
+// Queued returns the queries waiting for a slot
+func (q *QueryLimiter) Queued() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.queue)
+}
+
+// Limit returns the concurrent queries allowed, 0 means no limit
+func (q *QueryLimiter) Limit() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.limit
+}
+
+// Acquire waits for a free slot, or for ctx to be done
+func (q *QueryLimiter) Acquire(ctx context.Context) error {
+	q.Lock()
+	if len(q.queue) == 0 && (q.limit <= 0 || q.active < q.limit) {
+		q.active++
+		q.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	q.queue = append(q.queue, ready)
+	q.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		q.Lock()
+		for i, c := range q.queue {
+			if c == ready {
+				q.queue = append(q.queue[:i], q.queue[i+1:]...)
+				q.Unlock()
+				return ctx.Err()
+			}
+		}
+		q.Unlock()
+		// The slot was handed over meanwhile, give it back
+		q.Release()
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken with Acquire
+func (q *QueryLimiter) Release() {
+	q.Lock()
+	q.active--
+	q.Unlock()
+	q.wake()
+}
+
+// wake hands the free slots over to the queued queries, in order
+func (q *QueryLimiter) wake() {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.queue) > 0 && (q.limit <= 0 || q.active < q.limit) {
+		q.active++
+		close(q.queue[0])
+		q.queue = q.queue[1:]
+	}
+}
+
+// findPeers runs FindPeers on the rendezvous within the query limit.
+// The slot is held until all the peers are consumed, or ctx is done.
+func (d *DHT) findPeers(ctx context.Context, r *discovery.RoutingDiscovery, rv string) (<-chan peer.AddrInfo, error) {
+	limiter := d.FindPeersLimiter
+	if limiter == nil {
+		limiter = DefaultFindPeersLimiter
+	}
+
+	if err := limiter.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	ctx, op := operations.Start(ctx, operations.Query, "find-peers")
+	found, err := r.FindPeers(ctx, rv)
+	if err != nil {
+		op.Done()
+		limiter.Release()
+		return nil, err
+	}
+
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer limiter.Release()
+		defer op.Done()
+		defer close(out)
+		for p := range found {
+			select {
+			case out <- p:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+)
+
+var _ = Describe("QueryLimiter", func() {
+	ctx := context.Background()
+
+	It("caps the concurrent queries", func() {
+		q := NewQueryLimiter(3)
+
+		var mu sync.Mutex
+		active, max := 0, 0
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(q.Acquire(ctx)).To(Succeed())
+				mu.Lock()
+				active++
+				if active > max {
+					max = active
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				active--
+				mu.Unlock()
+				q.Release()
+			}()
+		}
+		wg.Wait()
+		Expect(max).To(Equal(3))
+		Expect(q.Active()).To(Equal(0))
+	})
+
+	It("serves the queued queries in order", func() {
+		q := NewQueryLimiter(1)
+		Expect(q.Acquire(ctx)).To(Succeed())
+
+		var mu sync.Mutex
+		order := []int{}
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(q.Acquire(ctx)).To(Succeed())
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+				q.Release()
+			}(i)
+			// Let the query queue up before the next one
+			time.Sleep(20 * time.Millisecond)
+		}
+		q.Release()
+		wg.Wait()
+		Expect(order).To(Equal([]int{0, 1, 2, 3, 4}))
+	})
+
+	It("gives up waiting when the context is done", func() {
+		q := NewQueryLimiter(1)
+		Expect(q.Acquire(ctx)).To(Succeed())
+
+		tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		Expect(q.Acquire(tctx)).ToNot(Succeed())
+
+		q.Release()
+		Expect(q.Active()).To(Equal(0))
+		Expect(q.Acquire(ctx)).To(Succeed())
+	})
+
+	It("does not limit by default", func() {
+		q := NewQueryLimiter(0)
+		for i := 0; i < 100; i++ {
+			Expect(q.Acquire(ctx)).To(Succeed())
+		}
+		Expect(q.Active()).To(Equal(100))
+	})
+})
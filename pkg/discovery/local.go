@@ -0,0 +1,71 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// DefaultLocalScaleFactor is the factor the DHT discovery interval is
+// stretched by while enough peers are found on the local network
+const DefaultLocalScaleFactor = 4
+
+// LocalScaling is a backoff.BackOff stretching the DHT discovery interval
+// by Factor while at least Threshold peers are connected on the local
+// network, and going back to the interval of the wrapped BackOff as soon
+// as the local mesh is too small.
+// The stretch is decided when an interval starts: Shrunk tells when the
+// local mesh shrank during a stretched interval, to start a new one.
+type LocalScaling struct {
+	backoff.BackOff
+	LocalPeers func() int
+	Threshold  int
+	Factor     int
+
+	mu        sync.Mutex
+	stretched bool
+}
+
+// Local returns true when enough peers are connected on the local network
+func (l *LocalScaling) Local() bool {
+	return l.Threshold > 0 && l.LocalPeers != nil && l.LocalPeers() >= l.Threshold
+}
+
+// NextBackOff returns the next interval of the wrapped BackOff, stretched
+// while the local mesh is large enough
+func (l *LocalScaling) NextBackOff() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := l.BackOff.NextBackOff()
+	l.stretched = next != backoff.Stop && l.Local()
+	if !l.stretched {
+		return next
+	}
+	factor := l.Factor
+	if factor <= 0 {
+		factor = DefaultLocalScaleFactor
+	}
+	return next * time.Duration(factor)
+}
+
+// Shrunk returns true when the last interval was stretched, but the local
+// mesh is now too small
+func (l *LocalScaling) Shrunk() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stretched && !l.Local()
+}
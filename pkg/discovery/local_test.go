@@ -0,0 +1,89 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+)
+
+var _ = Describe("Local scaling", func() {
+	local := 0
+	var l *LocalScaling
+
+	BeforeEach(func() {
+		local = 0
+		l = &LocalScaling{
+			BackOff:    backoff.NewConstantBackOff(time.Second),
+			LocalPeers: func() int { return local },
+			Threshold:  3,
+			Factor:     4,
+		}
+	})
+
+	It("slows down the DHT while the local mesh is large enough", func() {
+		Expect(l.NextBackOff()).To(Equal(time.Second))
+		local = 3
+		Expect(l.Local()).To(BeTrue())
+		Expect(l.NextBackOff()).To(Equal(4 * time.Second))
+		local = 10
+		Expect(l.NextBackOff()).To(Equal(4 * time.Second))
+	})
+
+	It("scales the DHT back up when the local mesh shrinks", func() {
+		local = 5
+		Expect(l.NextBackOff()).To(Equal(4 * time.Second))
+		local = 2
+		Expect(l.Local()).To(BeFalse())
+		Expect(l.NextBackOff()).To(Equal(time.Second))
+	})
+
+	It("tells when the local mesh shrank during a stretched interval", func() {
+		Expect(l.NextBackOff()).To(Equal(time.Second))
+		local = 0
+		Expect(l.Shrunk()).To(BeFalse())
+
+		local = 5
+		Expect(l.NextBackOff()).To(Equal(4 * time.Second))
+		Expect(l.Shrunk()).To(BeFalse())
+		local = 2
+		Expect(l.Shrunk()).To(BeTrue())
+
+		Expect(l.NextBackOff()).To(Equal(time.Second))
+		Expect(l.Shrunk()).To(BeFalse())
+	})
+
+	It("uses the default factor", func() {
+		local = 3
+		l.Factor = 0
+		Expect(l.NextBackOff()).To(Equal(DefaultLocalScaleFactor * time.Second))
+	})
+
+	It("is disabled without threshold", func() {
+		local = 100
+		l.Threshold = 0
+		Expect(l.NextBackOff()).To(Equal(time.Second))
+	})
+
+	It("keeps the stop of the wrapped backoff", func() {
+		local = 3
+		l.BackOff = &backoff.StopBackOff{}
+		Expect(l.NextBackOff()).To(Equal(backoff.Stop))
+	})
+})
@@ -15,23 +15,34 @@ package discovery
 
 import (
 	"context"
+	"sync"
 
 	"github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p"
 
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 )
 
 type MDNS struct {
 	DiscoveryServiceTag string
+	// OnConnect, when set, is called with the peers found and connected
+	OnConnect func(peer.ID)
+
+	service mdns.Service
+	host    host.Host
+	peers   map[peer.ID]struct{}
+	sync.Mutex
 }
 
 // discoveryNotifee gets notified when we find a new peer via mDNS discovery
 type discoveryNotifee struct {
-	h host.Host
-	c log.StandardLogger
+	h         host.Host
+	c         log.StandardLogger
+	onConnect func(peer.ID)
+	m         *MDNS
 }
 
 // HandlePeerFound connects to peers discovered via mDNS. Once they're connected,
@@ -42,6 +53,11 @@ func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
 	err := n.h.Connect(context.Background(), pi)
 	if err != nil {
 		n.c.Debugf("mDNS: error connecting to peer %s: %s\n", pi.ID.String(), err)
+		return
+	}
+	n.m.found(pi.ID)
+	if n.onConnect != nil {
+		n.onConnect(pi.ID)
 	}
 }
 
@@ -52,6 +68,43 @@ func (d *MDNS) Option(ctx context.Context) func(c *libp2p.Config) error {
 func (d *MDNS) Run(l log.StandardLogger, ctx context.Context, host host.Host) error {
 	// setup mDNS discovery to find local peers
 
-	disc := mdns.NewMdnsService(host, d.DiscoveryServiceTag, &discoveryNotifee{h: host, c: l})
+	d.Lock()
+	d.host = host
+	d.Unlock()
+	disc := mdns.NewMdnsService(host, d.DiscoveryServiceTag, &discoveryNotifee{h: host, c: l, onConnect: d.OnConnect, m: d})
+	d.service = disc
 	return disc.Start()
 }
+
+// Close stops the mDNS service, if it was started
+func (d *MDNS) Close() error {
+	if d.service == nil {
+		return nil
+	}
+	return d.service.Close()
+}
+
+func (d *MDNS) found(p peer.ID) {
+	d.Lock()
+	defer d.Unlock()
+	if d.peers == nil {
+		d.peers = map[peer.ID]struct{}{}
+	}
+	d.peers[p] = struct{}{}
+}
+
+// LocalPeers returns the number of peers found on the local network
+// which are still connected
+func (d *MDNS) LocalPeers() int {
+	d.Lock()
+	defer d.Unlock()
+	if d.host == nil {
+		return 0
+	}
+	for p := range d.peers {
+		if d.host.Network().Connectedness(p) != network.Connected {
+			delete(d.peers, p)
+		}
+	}
+	return len(d.peers)
+}
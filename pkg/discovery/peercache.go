@@ -0,0 +1,173 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/store"
+	maddr "github.com/multiformats/go-multiaddr"
+)
+
+// Defaults of the peer cache
+const (
+	DefaultPeerCacheMax = 50
+	DefaultPeerCacheTTL = 7 * 24 * time.Hour
+)
+
+const (
+	peerCacheNamespace  = "peers"
+	discoveryNamespace  = "discovery"
+	rendezvousCacheKey  = "rendezvous"
+	maxCachedPeerAddrs  = 10
+	cachedPeerDialLimit = 30 * time.Second
+)
+
+// PeerCache persists the peers met on the rendezvous, with their addresses,
+// and the last rendezvous peers were found on. On restart the DHT dials them
+// while bootstrapping, so the node rejoins the network without waiting
+// for the rendezvous to be searched.
+type PeerCache struct {
+	// Max caps the cached peers: the ones seen least recently are dropped first
+	Max int
+	// TTL is how long a peer not seen again is kept
+	TTL time.Duration
+
+	store store.Store
+	sync.Mutex
+}
+
+type cachedPeer struct {
+	Addrs    []string
+	LastSeen time.Time
+}
+
+type cachedRendezvous struct {
+	Rendezvous string
+	Time       time.Time
+}
+
+// NewPeerCache returns a PeerCache persisted in s, with the default limits
+func NewPeerCache(s store.Store) *PeerCache {
+	return &PeerCache{Max: DefaultPeerCacheMax, TTL: DefaultPeerCacheTTL, store: s}
+}
+
+// Record caches the peer with its addresses, as seen now
+func (c *PeerCache) Record(p peer.AddrInfo) error {
+	if len(p.Addrs) == 0 {
+		return nil
+	}
+	cp := cachedPeer{LastSeen: time.Now()}
+	for _, a := range p.Addrs {
+		if len(cp.Addrs) == maxCachedPeerAddrs {
+			break
+		}
+		cp.Addrs = append(cp.Addrs, a.String())
+	}
+	dat, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if err := c.store.Put(peerCacheNamespace, p.ID.String(), dat); err != nil {
+		return err
+	}
+	if c.Max <= 0 {
+		return nil
+	}
+	peers, err := c.load()
+	if err != nil {
+		return err
+	}
+	for _, p := range peers[min(c.Max, len(peers)):] {
+		c.store.Delete(peerCacheNamespace, p.ID.String())
+	}
+	return nil
+}
+
+// Peers returns the cached peers, the ones seen most recently first.
+// The peers expired or with invalid entries are dropped.
+func (c *PeerCache) Peers() ([]peer.AddrInfo, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.load()
+}
+
+func (c *PeerCache) load() ([]peer.AddrInfo, error) {
+	keys, err := c.store.List(peerCacheNamespace)
+	if err != nil {
+		return nil, err
+	}
+	type entry struct {
+		info     peer.AddrInfo
+		lastSeen time.Time
+	}
+	entries := []entry{}
+	for _, k := range keys {
+		dat, err := c.store.Get(peerCacheNamespace, k)
+		if err != nil {
+			continue
+		}
+		cp := cachedPeer{}
+		id, err := peer.Decode(k)
+		if err != nil || json.Unmarshal(dat, &cp) != nil || (c.TTL > 0 && time.Since(cp.LastSeen) > c.TTL) {
+			c.store.Delete(peerCacheNamespace, k)
+			continue
+		}
+		info := peer.AddrInfo{ID: id}
+		for _, a := range cp.Addrs {
+			if ma, err := maddr.NewMultiaddr(a); err == nil {
+				info.Addrs = append(info.Addrs, ma)
+			}
+		}
+		if len(info.Addrs) > 0 {
+			entries = append(entries, entry{info: info, lastSeen: cp.LastSeen})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].lastSeen.After(entries[j].lastSeen) })
+	res := make([]peer.AddrInfo, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, e.info)
+	}
+	return res, nil
+}
+
+// RecordRendezvous caches the rendezvous peers were found on
+func (c *PeerCache) RecordRendezvous(rv string) error {
+	dat, err := json.Marshal(cachedRendezvous{Rendezvous: rv, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	return c.store.Put(discoveryNamespace, rendezvousCacheKey, dat)
+}
+
+// Rendezvous returns the last rendezvous peers were found on, if
+// recorded within maxAge
+func (c *PeerCache) Rendezvous(maxAge time.Duration) (string, bool) {
+	dat, err := c.store.Get(discoveryNamespace, rendezvousCacheKey)
+	if err != nil {
+		return "", false
+	}
+	rv := cachedRendezvous{}
+	if err := json.Unmarshal(dat, &rv); err != nil || rv.Rendezvous == "" || time.Since(rv.Time) > maxAge {
+		return "", false
+	}
+	return rv.Rendezvous, true
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	maddr "github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/store"
+)
+
+var _ = Describe("PeerCache", func() {
+	newPeer := func(addr string) peer.AddrInfo {
+		key, _, err := crypto.GenerateEd25519Key(nil)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		return peer.AddrInfo{ID: id, Addrs: []maddr.Multiaddr{maddr.StringCast(addr)}}
+	}
+
+	It("persists the peers, the ones seen most recently first", func() {
+		s := store.NewFilesystem(GinkgoT().TempDir())
+		a, b := newPeer("/ip4/10.0.0.1/tcp/4001"), newPeer("/ip4/10.0.0.2/tcp/4001")
+		c := NewPeerCache(s)
+		Expect(c.Record(a)).To(Succeed())
+		time.Sleep(10 * time.Millisecond)
+		Expect(c.Record(b)).To(Succeed())
+
+		// A new cache on the same store, as after a restart
+		peers, err := NewPeerCache(s).Peers()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(peers).To(Equal([]peer.AddrInfo{b, a}))
+	})
+
+	It("drops the peers seen least recently over the limit", func() {
+		c := NewPeerCache(store.NewMemory())
+		c.Max = 2
+		a, b, d := newPeer("/ip4/10.0.0.1/tcp/4001"), newPeer("/ip4/10.0.0.2/tcp/4001"), newPeer("/ip4/10.0.0.3/tcp/4001")
+		for _, p := range []peer.AddrInfo{a, b, d} {
+			Expect(c.Record(p)).To(Succeed())
+			time.Sleep(10 * time.Millisecond)
+		}
+		peers, err := c.Peers()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(peers).To(Equal([]peer.AddrInfo{d, b}))
+	})
+
+	It("expires the peers not seen within the TTL", func() {
+		c := NewPeerCache(store.NewMemory())
+		c.TTL = 50 * time.Millisecond
+		Expect(c.Record(newPeer("/ip4/10.0.0.1/tcp/4001"))).To(Succeed())
+		Expect(c.Peers()).To(HaveLen(1))
+		time.Sleep(100 * time.Millisecond)
+		Expect(c.Peers()).To(BeEmpty())
+	})
+
+	It("returns the last rendezvous within its age", func() {
+		c := NewPeerCache(store.NewMemory())
+		_, ok := c.Rendezvous(time.Minute)
+		Expect(ok).To(BeFalse())
+
+		Expect(c.RecordRendezvous("rv")).To(Succeed())
+		rv, ok := c.Rendezvous(time.Minute)
+		Expect(ok).To(BeTrue())
+		Expect(rv).To(Equal("rv"))
+
+		time.Sleep(10 * time.Millisecond)
+		_, ok = c.Rendezvous(time.Millisecond)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("dials the cached peers on start", func() {
+		other, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(other.Close)
+
+		c := NewPeerCache(store.NewMemory())
+		Expect(c.Record(peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()})).To(Succeed())
+
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+
+		connected := make(chan peer.ID, 1)
+		d := NewDHT(dht.Mode(dht.ModeServer))
+		// A private DHT without bootstrap peers, reachable only from the cache
+		d.ProtocolPrefix = "/cached"
+		d.RefreshDiscoveryTime = time.Hour
+		d.PeerCache = c
+		d.OnConnect = func(p peer.ID) {
+			select {
+			case connected <- p:
+			default:
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		Expect(d.Run(logger.New(log.LevelFatal), ctx, h)).To(Succeed())
+		DeferCleanup(d.Close)
+
+		Eventually(connected, 10*time.Second).Should(Receive(Equal(other.ID())))
+		Expect(h.Network().Connectedness(other.ID())).To(Equal(network.Connected))
+	})
+
+	It("calls the hooks once all the cached peers are dialed", func() {
+		c := NewPeerCache(store.NewMemory())
+		peers := []peer.ID{}
+		for i := 0; i < 2; i++ {
+			other, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(other.Close)
+			Expect(c.Record(peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()})).To(Succeed())
+			peers = append(peers, other.ID())
+		}
+
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+
+		// Each hook sees all the peers dialed, as the dials don't wait for it
+		hooked := make(chan int, 2)
+		d := NewDHT(dht.Mode(dht.ModeServer))
+		d.ProtocolPrefix = "/cached"
+		d.RefreshDiscoveryTime = time.Hour
+		d.DialConcurrency = 1
+		d.PeerCache = c
+		d.OnPeerConnected = func(peer.AddrInfo) {
+			dialed := 0
+			for _, p := range peers {
+				if h.Network().Connectedness(p) == network.Connected {
+					dialed++
+				}
+			}
+			hooked <- dialed
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		Expect(d.Run(logger.New(log.LevelFatal), ctx, h)).To(Succeed())
+		DeferCleanup(d.Close)
+
+		Eventually(hooked, 10*time.Second).Should(Receive(Equal(2)))
+		Eventually(hooked, 10*time.Second).Should(Receive(Equal(2)))
+	})
+})
@@ -0,0 +1,379 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	maddr "github.com/multiformats/go-multiaddr"
+)
+
+// PeerExchange periodically swaps with a random connected member a sample of
+// the other members each side is connected to, and dials the new ones.
+// Members are the peers speaking the peer exchange protocol of the network
+// and accepted by Members, and the dials go through the connection gater of
+// the host.
+type PeerExchange struct {
+	// Interval between the exchanges. A peer asking for exchanges
+	// more often than half of it is refused.
+	Interval time.Duration
+	// SampleSize caps the peers shared with each exchange
+	SampleSize int
+	// OnConnect, when set, is called with the exchanged peers connected
+	OnConnect func(peer.ID)
+	// Bootstrap, when set, swaps the bootstrap peers with the members too
+	Bootstrap *LearnedBootstrap
+	// Network, when set, namespaces the protocols so that only the nodes
+	// of the same network exchange with each other
+	Network string
+	// Members, when set, restricts the exchanges to the peers it accepts
+	Members func(peer.ID) bool
+
+	sync.Mutex
+	served          map[peer.ID]time.Time
+	servedBootstrap map[peer.ID]time.Time
+	tried           map[peer.ID]time.Time
+}
+
+const (
+	// pexMaxMessageSize caps the messages read from the members
+	pexMaxMessageSize = 64 * 1024
+	// pexMaxAddrs caps the addresses dialed for each exchanged peer
+	pexMaxAddrs = 16
+	// pexMaxBootstrap caps the bootstrap addresses read from each member
+	pexMaxBootstrap = 64
+)
+
+type pexPeer struct {
+	ID    string
+	Addrs []string
+}
+
+func (d *PeerExchange) protocolID(p protocol.Protocol) protocol.Protocol {
+	if d.Network == "" {
+		return p
+	}
+	return protocol.Protocol(string(p) + "/" + d.Network)
+}
+
+// member returns true if the peer is accepted by Members
+func (d *PeerExchange) member(p peer.ID) bool {
+	return d.Members == nil || d.Members(p)
+}
+
+// decode reads a message from the member, up to pexMaxMessageSize
+func decode(s network.Stream, v interface{}) error {
+	return json.NewDecoder(io.LimitReader(s, pexMaxMessageSize)).Decode(v)
+}
+
+func (d *PeerExchange) Option(ctx context.Context) func(c *libp2p.Config) error {
+	return func(*libp2p.Config) error { return nil }
+}
+
+// Run serves the peer exchange protocol and starts the exchanges
+func (d *PeerExchange) Run(l log.StandardLogger, ctx context.Context, h host.Host) error {
+	if d.Interval <= 0 {
+		d.Interval = time.Minute
+	}
+	if d.SampleSize <= 0 {
+		d.SampleSize = 10
+	}
+	d.Lock()
+	d.served = make(map[peer.ID]time.Time)
+	d.servedBootstrap = make(map[peer.ID]time.Time)
+	d.tried = make(map[peer.ID]time.Time)
+	d.Unlock()
+
+	h.SetStreamHandler(d.protocolID(protocol.PeerExchangeProtocol).ID(), func(s network.Stream) {
+		d.handle(l, ctx, h, s)
+	})
+	if d.Bootstrap != nil {
+		h.SetStreamHandler(d.protocolID(protocol.PeerExchangeBootstrapProtocol).ID(), func(s network.Stream) {
+			d.handleBootstrap(l, h, s)
+		})
+	}
+	go func() {
+		t := time.NewTicker(d.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := d.Exchange(l, ctx, h); err != nil {
+					l.Debugf("peer exchange: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// members returns the connected peers speaking the peer exchange protocol
+// of the network, and accepted by Members
+func (d *PeerExchange) members(h host.Host) (res []peer.ID) {
+	pid := d.protocolID(protocol.PeerExchangeProtocol).ID()
+	for _, p := range h.Network().Peers() {
+		if !d.member(p) {
+			continue
+		}
+		if s, err := h.Peerstore().SupportsProtocols(p, pid); err == nil && len(s) > 0 {
+			res = append(res, p)
+		}
+	}
+	return
+}
+
+// sample returns up to SampleSize random members, except the one exchanging with us
+func (d *PeerExchange) sample(h host.Host, except peer.ID) []pexPeer {
+	peers := d.members(h)
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+
+	res := []pexPeer{}
+	for _, p := range peers {
+		if len(res) >= d.SampleSize {
+			break
+		}
+		if p == except {
+			continue
+		}
+		addrs := h.Peerstore().Addrs(p)
+		if len(addrs) == 0 {
+			for _, c := range h.Network().ConnsToPeer(p) {
+				addrs = append(addrs, c.RemoteMultiaddr())
+			}
+		}
+		pp := pexPeer{ID: p.String()}
+		for _, a := range addrs {
+			pp.Addrs = append(pp.Addrs, a.String())
+		}
+		if len(pp.Addrs) > 0 {
+			res = append(res, pp)
+		}
+	}
+	return res
+}
+
+func (d *PeerExchange) handle(l log.StandardLogger, ctx context.Context, h host.Host, s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+
+	if !d.member(remote) || !d.allow(d.served, remote) {
+		s.Reset()
+		return
+	}
+
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	received := []pexPeer{}
+	if err := decode(s, &received); err != nil {
+		s.Reset()
+		return
+	}
+	if err := json.NewEncoder(s).Encode(d.sample(h, remote)); err != nil {
+		s.Reset()
+		return
+	}
+	go d.dial(l, ctx, h, received)
+}
+
+// Exchange swaps the samples with a random member, and dials the peers received
+func (d *PeerExchange) Exchange(l log.StandardLogger, ctx context.Context, h host.Host) error {
+	peers := d.members(h)
+	if len(peers) == 0 {
+		return nil
+	}
+	remote := peers[rand.Intn(len(peers))]
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	s, err := h.NewStream(tctx, remote, d.protocolID(protocol.PeerExchangeProtocol).ID())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := json.NewEncoder(s).Encode(d.sample(h, remote)); err != nil {
+		s.Reset()
+		return err
+	}
+	received := []pexPeer{}
+	if err := decode(s, &received); err != nil {
+		s.Reset()
+		return err
+	}
+	d.dial(l, ctx, h, received)
+
+	if d.Bootstrap != nil {
+		if err := d.ExchangeBootstrap(l, ctx, h, remote); err != nil {
+			l.Debugf("bootstrap peer exchange: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// allow returns true if the member didn't exchange within half of the interval
+func (d *PeerExchange) allow(served map[peer.ID]time.Time, remote peer.ID) bool {
+	d.Lock()
+	defer d.Unlock()
+	prune(served, d.Interval/2)
+	if last, ok := served[remote]; ok && time.Since(last) < d.Interval/2 {
+		return false
+	}
+	served[remote] = time.Now()
+	return true
+}
+
+func (d *PeerExchange) handleBootstrap(l log.StandardLogger, h host.Host, s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	if !d.member(remote) || !d.allow(d.servedBootstrap, remote) {
+		s.Reset()
+		return
+	}
+
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	received := []string{}
+	if err := decode(s, &received); err != nil {
+		s.Reset()
+		return
+	}
+	if err := json.NewEncoder(s).Encode(d.Bootstrap.share()); err != nil {
+		s.Reset()
+		return
+	}
+	d.learn(l, h, remote, received)
+}
+
+// ExchangeBootstrap swaps the bootstrap peers with a member, and learns the ones received
+func (d *PeerExchange) ExchangeBootstrap(l log.StandardLogger, ctx context.Context, h host.Host, remote peer.ID) error {
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	s, err := h.NewStream(tctx, remote, d.protocolID(protocol.PeerExchangeBootstrapProtocol).ID())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := json.NewEncoder(s).Encode(d.Bootstrap.share()); err != nil {
+		s.Reset()
+		return err
+	}
+	received := []string{}
+	if err := decode(s, &received); err != nil {
+		s.Reset()
+		return err
+	}
+	d.learn(l, h, remote, received)
+	return nil
+}
+
+// learn records the bootstrap peers shared by a member. Only the members
+// verified by Members are counted as sources, so that peers which just speak
+// the protocol can't reach MinSources.
+func (d *PeerExchange) learn(l log.StandardLogger, h host.Host, remote peer.ID, received []string) {
+	if d.Members == nil || !d.Members(remote) {
+		return
+	}
+	if len(received) > pexMaxBootstrap {
+		received = received[:pexMaxBootstrap]
+	}
+	peers := AddrList{}
+	for _, a := range received {
+		ma, err := maddr.NewMultiaddr(a)
+		if err != nil {
+			continue
+		}
+		if info, err := peer.AddrInfoFromP2pAddr(ma); err == nil && info.ID != h.ID() {
+			peers = append(peers, ma)
+		}
+	}
+	if n := d.Bootstrap.Learn(remote, peers); n > 0 {
+		l.Debugf("learned %d bootstrap peers from %s", n, remote)
+	}
+}
+
+// prune drops the entries older than d
+func prune(m map[peer.ID]time.Time, d time.Duration) {
+	for p, t := range m {
+		if time.Since(t) >= d {
+			delete(m, p)
+		}
+	}
+}
+
+// dial connects to the received peers which are not connected yet, and were
+// not tried within the last interval. At most SampleSize peers are dialed.
+func (d *PeerExchange) dial(l log.StandardLogger, ctx context.Context, h host.Host, peers []pexPeer) {
+	if len(peers) > d.SampleSize {
+		peers = peers[:d.SampleSize]
+	}
+	d.Lock()
+	prune(d.tried, d.Interval)
+	d.Unlock()
+
+	for _, pp := range peers {
+		id, err := peer.Decode(pp.ID)
+		if err != nil || id == h.ID() || h.Network().Connectedness(id) == network.Connected {
+			continue
+		}
+		d.Lock()
+		last, tried := d.tried[id]
+		if tried && time.Since(last) < d.Interval {
+			d.Unlock()
+			continue
+		}
+		d.tried[id] = time.Now()
+		d.Unlock()
+
+		info := peer.AddrInfo{ID: id}
+		addrs := pp.Addrs
+		if len(addrs) > pexMaxAddrs {
+			addrs = addrs[:pexMaxAddrs]
+		}
+		for _, a := range addrs {
+			if ma, err := maddr.NewMultiaddr(a); err == nil {
+				info.Addrs = append(info.Addrs, ma)
+			}
+		}
+		if len(info.Addrs) == 0 {
+			continue
+		}
+
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		h.Peerstore().AddAddrs(id, info.Addrs, peerstore.TempAddrTTL)
+		err = h.Connect(tctx, info)
+		cancel()
+		if err != nil {
+			l.Debugf("peer exchange: could not connect to %s: %s", id, err.Error())
+			continue
+		}
+		if d.OnConnect != nil {
+			d.OnConnect(id)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/conngater"
+	ma "github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+var _ = Describe("Peer exchange", func() {
+	l := logger.New(log.LevelFatal)
+
+	newHost := func(opts ...libp2p.Option) host.Host {
+		h, err := libp2p.New(append([]libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")}, opts...)...)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+		return h
+	}
+
+	// run starts the peer exchange on a new host
+	run := func(pex *PeerExchange, opts ...libp2p.Option) host.Host {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		h := newHost(opts...)
+		Expect(pex.Run(l, ctx, h)).To(Succeed())
+		return h
+	}
+
+	member := func(sampleSize int, opts ...libp2p.Option) (host.Host, *PeerExchange) {
+		pex := &PeerExchange{Interval: time.Hour, SampleSize: sampleSize}
+		return run(pex, opts...), pex
+	}
+
+	connect := func(a, b host.Host) {
+		Expect(a.Connect(context.Background(), peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()})).To(Succeed())
+		// Wait for identify to report the protocols of the other peer
+		Eventually(func() []string {
+			s, _ := a.Peerstore().SupportsProtocols(b.ID(), protocol.PeerExchangeProtocol.ID())
+			res := []string{}
+			for _, p := range s {
+				res = append(res, string(p))
+			}
+			return res
+		}, 5*time.Second).ShouldNot(BeEmpty())
+	}
+
+	connected := func(a, b host.Host) bool {
+		return a.Network().Connectedness(b.ID()) == network.Connected
+	}
+
+	It("dials the members connected to the exchanging peer", func() {
+		a, pex := member(10)
+		b, _ := member(10)
+		c, _ := member(10)
+		outsider := newHost()
+
+		connect(a, b)
+		connect(b, c)
+		Expect(b.Connect(context.Background(), peer.AddrInfo{ID: outsider.ID(), Addrs: outsider.Addrs()})).To(Succeed())
+		Expect(connected(a, c)).To(BeFalse())
+
+		Expect(pex.Exchange(l, context.Background(), a)).To(Succeed())
+		Expect(connected(a, c)).To(BeTrue())
+		// Only the members are shared
+		Expect(connected(a, outsider)).To(BeFalse())
+	})
+
+	It("refuses exchanges more frequent than the interval", func() {
+		a, pex := member(10)
+		b, _ := member(10)
+		connect(a, b)
+
+		Expect(pex.Exchange(l, context.Background(), a)).To(Succeed())
+		Expect(pex.Exchange(l, context.Background(), a)).ToNot(Succeed())
+	})
+
+	It("shares at most the sample size", func() {
+		a, pex := member(10)
+		b, _ := member(1)
+		connect(a, b)
+		for i := 0; i < 3; i++ {
+			c, _ := member(10)
+			connect(b, c)
+		}
+
+		Expect(pex.Exchange(l, context.Background(), a)).To(Succeed())
+		Expect(a.Network().Peers()).To(HaveLen(2))
+	})
+
+	It("dials through the connection gater", func() {
+		gater, err := conngater.NewBasicConnectionGater(nil)
+		Expect(err).ToNot(HaveOccurred())
+		a, pex := member(10, libp2p.ConnectionGater(gater))
+		b, _ := member(10)
+		c, _ := member(10)
+		Expect(gater.BlockPeer(c.ID())).To(Succeed())
+
+		connect(a, b)
+		connect(b, c)
+		Expect(pex.Exchange(l, context.Background(), a)).To(Succeed())
+		Expect(connected(a, c)).To(BeFalse())
+	})
+
+	It("exchanges only with the peers accepted by Members", func() {
+		refused := map[peer.ID]bool{}
+		pex := &PeerExchange{Interval: time.Hour, SampleSize: 10, Members: func(p peer.ID) bool { return !refused[p] }}
+		a := run(pex)
+		b, other := member(10)
+		c, _ := member(10)
+		refused[b.ID()] = true
+
+		connect(b, a)
+		connect(b, c)
+		Eventually(func() error {
+			_, err := a.Peerstore().SupportsProtocols(b.ID(), protocol.PeerExchangeProtocol.ID())
+			return err
+		}, 5*time.Second).ShouldNot(HaveOccurred())
+
+		// b is not a member: a doesn't exchange with it, nor serves it
+		Expect(pex.Exchange(l, context.Background(), a)).To(Succeed())
+		Expect(connected(a, c)).To(BeFalse())
+		Expect(c.Close()).To(Succeed())
+		Eventually(func() bool { return connected(b, c) }, 5*time.Second).Should(BeFalse())
+		Expect(other.Exchange(l, context.Background(), b)).ToNot(Succeed())
+	})
+
+	It("exchanges only within the same network", func() {
+		pex := &PeerExchange{Interval: time.Hour, SampleSize: 10, Network: "office"}
+		a := run(pex)
+		b := run(&PeerExchange{Interval: time.Hour, SampleSize: 10, Network: "lab"})
+		c, _ := member(10)
+
+		Expect(a.Connect(context.Background(), peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()})).To(Succeed())
+		Expect(b.Connect(context.Background(), peer.AddrInfo{ID: c.ID(), Addrs: c.Addrs()})).To(Succeed())
+		Eventually(func() error {
+			p, err := a.Peerstore().GetProtocols(b.ID())
+			if err == nil && len(p) == 0 {
+				err = errors.New("no protocols")
+			}
+			return err
+		}, 5*time.Second).ShouldNot(HaveOccurred())
+
+		Expect(pex.Exchange(l, context.Background(), a)).To(Succeed())
+		Expect(connected(a, c)).To(BeFalse())
+	})
+
+	Context("bootstrap peers", func() {
+		addr := func(id peer.ID, a string) ma.Multiaddr {
+			addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{ma.StringCast(a)}})
+			Expect(err).ToNot(HaveOccurred())
+			return addrs[0]
+		}
+		ids := func(n int) []peer.ID {
+			res := []peer.ID{}
+			for i := 0; i < n; i++ {
+				res = append(res, newHost().ID())
+			}
+			return res
+		}
+
+		It("trusts the peers shared by enough members", func() {
+			p := ids(6)
+			b := NewLearnedBootstrap()
+			b.MinSources = 2
+			b.PerMember = 2
+
+			shared := AddrList{addr(p[0], "/ip4/1.2.3.4/tcp/4001"), addr(p[1], "/ip4/1.2.3.5/tcp/4001"), addr(p[2], "/ip4/1.2.3.6/tcp/4001")}
+			Expect(b.Learn(p[3], shared)).To(Equal(2))
+			Expect(b.Peers()).To(BeEmpty())
+
+			Expect(b.Learn(p[4], shared)).To(Equal(2))
+			Expect(b.Peers()).To(ConsistOf(shared[0], shared[1]))
+
+			// Members can't vouch for themselves, nor share private addresses
+			Expect(b.Learn(p[5], AddrList{addr(p[5], "/ip4/1.2.3.7/tcp/4001"), addr(p[2], "/ip4/192.168.1.1/tcp/4001")})).To(Equal(0))
+		})
+
+		It("keeps at most Max peers, the most shared first", func() {
+			p := ids(5)
+			b := NewLearnedBootstrap()
+			b.MinSources = 1
+			b.Max = 2
+
+			Expect(b.Learn(p[3], AddrList{addr(p[0], "/ip4/1.2.3.4/tcp/4001"), addr(p[1], "/ip4/1.2.3.5/tcp/4001")})).To(Equal(2))
+			Expect(b.Learn(p[4], AddrList{addr(p[1], "/ip4/1.2.3.5/tcp/4001"), addr(p[2], "/ip4/1.2.3.6/tcp/4001")})).To(Equal(2))
+			Expect(b.Peers()).To(HaveLen(2))
+			Expect(b.Peers()[0]).To(Equal(addr(p[1], "/ip4/1.2.3.5/tcp/4001")))
+		})
+
+		It("learns the bootstrap peers of the members, and dials them", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			bootstrap := newHost()
+			shared := AddrList{}
+			for _, a := range bootstrap.Addrs() {
+				shared = append(shared, addr(bootstrap.ID(), a.String()))
+			}
+
+			learned := &LearnedBootstrap{MinSources: 1, Private: true}
+			a := newHost()
+			pex := &PeerExchange{Interval: time.Hour, SampleSize: 10, Bootstrap: learned, Members: func(peer.ID) bool { return true }}
+			Expect(pex.Run(l, ctx, a)).To(Succeed())
+
+			b := newHost()
+			other := &PeerExchange{Interval: time.Hour, SampleSize: 10,
+				Bootstrap: &LearnedBootstrap{Private: true, Shared: func() AddrList { return shared }}}
+			Expect(other.Run(l, ctx, b)).To(Succeed())
+
+			connect(a, b)
+			Expect(pex.ExchangeBootstrap(l, ctx, a, b.ID())).To(Succeed())
+			Expect(learned.Peers()).ToNot(BeEmpty())
+			// The exchanges are rate limited
+			Expect(pex.ExchangeBootstrap(l, ctx, a, b.ID())).ToNot(Succeed())
+
+			// The configured bootstrap peer is down: the learned one is dialed
+			d := NewDHT()
+			d.BootstrapPeers = AddrList{addr(newHost().ID(), "/ip4/127.0.0.1/tcp/1")}
+			d.LearnedBootstrap = learned
+			Expect(d.ConnectBootstrap(l, ctx, a)).To(Succeed())
+			Expect(connected(a, bootstrap)).To(BeTrue())
+			// The learned peers are not shared again
+			Expect(d.ReachableBootstrapPeers(a)).To(BeEmpty())
+		})
+
+		It("learns only from the verified members", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			bootstrap := newHost()
+			shared := AddrList{}
+			for _, a := range bootstrap.Addrs() {
+				shared = append(shared, addr(bootstrap.ID(), a.String()))
+			}
+
+			learned := &LearnedBootstrap{MinSources: 1, Private: true}
+			a := newHost()
+			pex := &PeerExchange{Interval: time.Hour, SampleSize: 10, Bootstrap: learned}
+			Expect(pex.Run(l, ctx, a)).To(Succeed())
+
+			b := newHost()
+			other := &PeerExchange{Interval: time.Hour, SampleSize: 10,
+				Bootstrap: &LearnedBootstrap{Private: true, Shared: func() AddrList { return shared }}}
+			Expect(other.Run(l, ctx, b)).To(Succeed())
+
+			connect(a, b)
+			Expect(pex.ExchangeBootstrap(l, ctx, a, b.ID())).To(Succeed())
+			Expect(learned.Peers()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,168 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
+	maddr "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+)
+
+// providerTimeout bounds each query of the bootstrap peers to a provider
+const providerTimeout = 30 * time.Second
+
+// maxDNSAddrDepth bounds the dnsaddr records pointing to other dnsaddr records
+const maxDNSAddrDepth = 4
+
+// Provider supplies bootstrap peers to the DHT, in addition to the
+// BootstrapPeers. The peers are asked for on every discovery cycle,
+// so that the bootstrap infrastructure can change at runtime.
+type Provider interface {
+	BootstrapPeers(ctx context.Context) (AddrList, error)
+}
+
+// ProviderFunc adapts a function to a Provider
+type ProviderFunc func(ctx context.Context) (AddrList, error)
+
+func (f ProviderFunc) BootstrapPeers(ctx context.Context) (AddrList, error) {
+	return f(ctx)
+}
+
+// HTTPProvider fetches the bootstrap peers listed at an URL,
+// one multiaddress per line (see FetchBootstrapPeers)
+type HTTPProvider string
+
+func (u HTTPProvider) BootstrapPeers(ctx context.Context) (AddrList, error) {
+	return FetchBootstrapPeers(ctx, string(u))
+}
+
+// DNSProvider resolves the bootstrap peers from the dnsaddr TXT records
+// of domains, e.g. "dnsaddr=/ip4/1.2.3.4/tcp/4001/p2p/<peer ID>" on
+// _dnsaddr.bootstrap.example.org. The records can point to other domains.
+type DNSProvider struct {
+	Addrs AddrList
+	// Resolver, when set, replaces the system resolver
+	Resolver *madns.Resolver
+}
+
+// NewDNSProvider returns a DNSProvider for the domains, either
+// names (bootstrap.example.org) or /dnsaddr multiaddresses
+func NewDNSProvider(domains ...string) (*DNSProvider, error) {
+	p := &DNSProvider{}
+	for _, d := range domains {
+		if !strings.HasPrefix(d, "/") {
+			d = "/dnsaddr/" + d
+		}
+		a, err := maddr.NewMultiaddr(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap domain '%s': %w", d, err)
+		}
+		p.Addrs = append(p.Addrs, a)
+	}
+	return p, nil
+}
+
+func (p *DNSProvider) BootstrapPeers(ctx context.Context) (AddrList, error) {
+	r := p.Resolver
+	if r == nil {
+		r = madns.DefaultResolver
+	}
+
+	peers := AddrList{}
+	var errs []string
+	for _, a := range p.Addrs {
+		resolved, err := resolveDNSAddr(ctx, r, a, maxDNSAddrDepth)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		peers = append(peers, resolved...)
+	}
+	if len(peers) == 0 && len(errs) > 0 {
+		return nil, fmt.Errorf("resolving the bootstrap domains: %s", strings.Join(errs, ", "))
+	}
+	return peers, nil
+}
+
+// resolveDNSAddr resolves the dnsaddr components of a, recursively, and
+// returns the resolved addresses carrying a peer ID
+func resolveDNSAddr(ctx context.Context, r *madns.Resolver, a maddr.Multiaddr, depth int) (AddrList, error) {
+	if _, err := a.ValueForProtocol(maddr.P_DNSADDR); err != nil {
+		if _, err := peer.AddrInfoFromP2pAddr(a); err != nil {
+			return nil, nil
+		}
+		return AddrList{a}, nil
+	}
+	if depth == 0 {
+		return nil, fmt.Errorf("too many nested dnsaddr records resolving %s", a)
+	}
+
+	resolved, err := r.Resolve(ctx, a)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", a, err)
+	}
+	peers := AddrList{}
+	for _, ra := range resolved {
+		p, err := resolveDNSAddr(ctx, r, ra, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p...)
+	}
+	return peers, nil
+}
+
+// refreshProviders asks the providers for their bootstrap peers.
+// The last peers of a provider failing are kept.
+func (d *DHT) refreshProviders(c log.StandardLogger, ctx context.Context) {
+	if len(d.Providers) == 0 {
+		return
+	}
+	provided := make([]AddrList, len(d.Providers))
+	d.providersMu.Lock()
+	copy(provided, d.provided)
+	d.providersMu.Unlock()
+
+	for i, p := range d.Providers {
+		tCtx, cancel := context.WithTimeout(ctx, providerTimeout)
+		peers, err := p.BootstrapPeers(tCtx)
+		cancel()
+		if err != nil {
+			c.Warnf("Failed getting the bootstrap peers of %T: %s", p, err.Error())
+			continue
+		}
+		provided[i] = peers
+	}
+
+	d.providersMu.Lock()
+	d.provided = provided
+	d.providersMu.Unlock()
+}
+
+// providedPeers returns the last bootstrap peers of the providers
+func (d *DHT) providedPeers() AddrList {
+	d.providersMu.Lock()
+	defer d.providersMu.Unlock()
+	peers := AddrList{}
+	for _, p := range d.provided {
+		peers = append(peers, p...)
+	}
+	return peers
+}
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+)
+
+var _ = Describe("Bootstrap providers", func() {
+	l := logger.New(log.LevelFatal)
+	ctx := context.Background()
+
+	newHost := func() host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+		return h
+	}
+
+	p2pAddr := func(h host.Host) ma.Multiaddr {
+		addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+		Expect(err).ToNot(HaveOccurred())
+		return addrs[0]
+	}
+
+	It("resolves the dnsaddr records", func() {
+		a, b := newHost(), newHost()
+		r, err := madns.NewResolver(madns.WithDefaultResolver(&madns.MockResolver{
+			TXT: map[string][]string{
+				"_dnsaddr.bootstrap.example.org": {
+					"dnsaddr=" + p2pAddr(a).String(),
+					"dnsaddr=/dnsaddr/eu.bootstrap.example.org",
+				},
+				"_dnsaddr.eu.bootstrap.example.org": {"dnsaddr=" + p2pAddr(b).String()},
+				"_dnsaddr.other.example.org":        {"dnsaddr=/ip4/127.0.0.1/tcp/4001"},
+			},
+		}))
+		Expect(err).ToNot(HaveOccurred())
+
+		p, err := NewDNSProvider("bootstrap.example.org", "/dnsaddr/other.example.org")
+		Expect(err).ToNot(HaveOccurred())
+		p.Resolver = r
+
+		// The addresses without a peer ID are skipped
+		peers, err := p.BootstrapPeers(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(peers).To(ConsistOf(p2pAddr(a), p2pAddr(b)))
+
+		_, err = NewDNSProvider("/foo/bar")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("asks the providers for the bootstrap peers on every cycle", func() {
+		first, second := newHost(), newHost()
+		calls := int32(0)
+		d := NewDHT()
+		d.Providers = []Provider{ProviderFunc(func(context.Context) (AddrList, error) {
+			switch atomic.AddInt32(&calls, 1) {
+			case 1:
+				return AddrList{p2pAddr(first)}, nil
+			case 2:
+				return AddrList{p2pAddr(second)}, nil
+			default:
+				return nil, errors.New("unavailable")
+			}
+		})}
+
+		h := newHost()
+		Expect(d.ConnectBootstrap(l, ctx, h)).To(Succeed())
+		Expect(h.Network().Connectedness(first.ID())).To(Equal(network.Connected))
+
+		// The bootstrap infrastructure is rotated
+		Expect(d.ConnectBootstrap(l, ctx, h)).To(Succeed())
+		Expect(h.Network().Connectedness(second.ID())).To(Equal(network.Connected))
+		Expect(d.ReachableBootstrapPeers(h)).To(Equal(AddrList{p2pAddr(second)}))
+
+		// The last peers are kept while the provider fails
+		Expect(d.ConnectBootstrap(l, ctx, h)).To(Succeed())
+		Expect(d.ReachableBootstrapPeers(h)).To(Equal(AddrList{p2pAddr(second)}))
+	})
+})
@@ -0,0 +1,127 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// peerTracker tracks the peers connected through the discovery, and
+// signals the callers waiting for a minimum number of them
+type peerTracker struct {
+	sync.Mutex
+	network  network.Network
+	excluded map[peer.ID]bool
+	peers    map[peer.ID]struct{}
+	waiters  []readyWaiter
+}
+
+type readyWaiter struct {
+	min int
+	ch  chan struct{}
+}
+
+// start tracks the connections of the network, ignoring the excluded peers
+func (t *peerTracker) start(n network.Network, excluded ...peer.ID) {
+	t.Lock()
+	defer t.Unlock()
+	t.network = n
+	t.excluded = map[peer.ID]bool{}
+	for _, p := range excluded {
+		t.excluded[p] = true
+	}
+}
+
+// add records a peer connected through the discovery
+func (t *peerTracker) add(p peer.ID) {
+	t.Lock()
+	defer t.Unlock()
+	if t.excluded[p] {
+		return
+	}
+	if t.peers == nil {
+		t.peers = map[peer.ID]struct{}{}
+	}
+	t.peers[p] = struct{}{}
+	t.notify()
+}
+
+// refresh forgets the peers which disconnected, and signals the waiters
+func (t *peerTracker) refresh() {
+	t.Lock()
+	defer t.Unlock()
+	t.notify()
+}
+
+func (t *peerTracker) count() int {
+	if t.network != nil {
+		for p := range t.peers {
+			if t.network.Connectedness(p) != network.Connected {
+				delete(t.peers, p)
+			}
+		}
+	}
+	return len(t.peers)
+}
+
+func (t *peerTracker) notify() {
+	n := t.count()
+	waiting := t.waiters[:0]
+	for _, w := range t.waiters {
+		if n >= w.min {
+			close(w.ch)
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	t.waiters = waiting
+}
+
+// ConnectedPeers returns the number of peers connected through the
+// discovery, bootstrap peers excluded, which are still connected
+func (d *DHT) ConnectedPeers() int {
+	d.tracker.Lock()
+	defer d.tracker.Unlock()
+	return d.tracker.count()
+}
+
+// Ready returns a channel which is closed once at least min peers, bootstrap
+// peers excluded, are connected through the discovery. Peers which failed
+// to dial are never counted.
+func (d *DHT) Ready(min int) <-chan struct{} {
+	d.tracker.Lock()
+	defer d.tracker.Unlock()
+	ch := make(chan struct{})
+	if d.tracker.count() >= min {
+		close(ch)
+		return ch
+	}
+	d.tracker.waiters = append(d.tracker.waiters, readyWaiter{min: min, ch: ch})
+	return ch
+}
+
+// bootstrapIDs returns the IDs of the bootstrap peers and of the rendezvous
+// servers, which don't count as connected through the discovery
+func (d *DHT) bootstrapIDs() []peer.ID {
+	ids := []peer.ID{}
+	for _, a := range append(append(append(AddrList{}, d.BootstrapPeers...), d.providedPeers()...), d.RendezvousServers...) {
+		if info, err := peer.AddrInfoFromP2pAddr(a); err == nil {
+			ids = append(ids, info.ID)
+		}
+	}
+	return ids
+}
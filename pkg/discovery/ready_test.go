@@ -0,0 +1,95 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+)
+
+var _ = Describe("Readiness", func() {
+	l := logger.New(log.LevelFatal)
+
+	newHost := func() host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+		return h
+	}
+
+	p2pAddr := func(h host.Host) ma.Multiaddr {
+		addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+		Expect(err).ToNot(HaveOccurred())
+		return addrs[0]
+	}
+
+	run := func(h host.Host, bootstrap ...ma.Multiaddr) *DHT {
+		ctx, cancel := context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+		d := NewDHT(dht.Mode(dht.ModeServer))
+		d.ProtocolPrefix = "/readiness"
+		d.FixedRendezvous = "readiness"
+		d.RefreshDiscoveryTime = time.Second
+		d.BootstrapPeers = bootstrap
+		Expect(d.Run(l, ctx, h)).To(Succeed())
+		DeferCleanup(d.Close)
+		return d
+	}
+
+	It("is ready once the peers found on the rendezvous are connected", func() {
+		bootstrap := newHost()
+		run(bootstrap)
+		first := run(newHost(), p2pAddr(bootstrap))
+		second := run(newHost(), p2pAddr(bootstrap))
+
+		Eventually(second.Ready(1), 30*time.Second).Should(BeClosed())
+		Expect(second.ConnectedPeers()).To(Equal(1))
+		Eventually(first.Ready(1), 30*time.Second).Should(BeClosed())
+		// The bootstrap peer is not counted
+		Expect(first.ConnectedPeers()).To(Equal(1))
+		Expect(first.Ready(0)).To(BeClosed())
+	})
+
+	It("is not ready when the bootstrap peers are unreachable", func() {
+		key, _, err := crypto.GenerateEd25519Key(nil)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+		unreachable, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/p2p/%s", port, id))
+		Expect(err).ToNot(HaveOccurred())
+
+		d := run(newHost(), unreachable)
+		Consistently(d.Ready(1), 3*time.Second).ShouldNot(BeClosed())
+		Expect(d.ConnectedPeers()).To(BeZero())
+	})
+})
@@ -0,0 +1,280 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	maddr "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	rendezvousRegister = "register"
+	rendezvousDiscover = "discover"
+
+	// MaxRendezvousTTL caps the time a registration is kept by the servers
+	MaxRendezvousTTL = 72 * time.Hour
+	// maxRendezvousPeers caps the peers returned by a discovery
+	maxRendezvousPeers = 100
+	// maxRendezvousRegistrations caps the peers registered in a namespace
+	maxRendezvousRegistrations = 1000
+	// maxRendezvousNamespaces caps the namespaces kept by a server
+	maxRendezvousNamespaces = 1000
+	// maxRendezvousNamespaceLength caps the length of a namespace
+	maxRendezvousNamespaceLength = 256
+	// maxRendezvousAddrs caps the addresses kept for a registration
+	maxRendezvousAddrs = 32
+	// rendezvousMaxRequestSize caps the size of a request read by a server
+	rendezvousMaxRequestSize = 16 << 10
+	// rendezvousTimeout bounds the time a server spends on a request
+	rendezvousTimeout = 30 * time.Second
+)
+
+var (
+	errRendezvousNamespace = errors.New("invalid namespace")
+	errRendezvousFull      = errors.New("too many registrations")
+)
+
+type rendezvousRequest struct {
+	Type      string
+	Namespace string
+	Addrs     []string
+	TTL       time.Duration
+}
+
+type rendezvousPeer struct {
+	ID    string
+	Addrs []string
+}
+
+type rendezvousResponse struct {
+	Error string
+	Peers []rendezvousPeer
+}
+
+type registration struct {
+	addrs   []string
+	expires time.Time
+}
+
+// RendezvousServer keeps the peers registered under a namespace (the rendezvous
+// string) and returns them to the peers discovering the namespace.
+// It is meant as a discovery fallback for networks where the DHT is slow or unreachable.
+type RendezvousServer struct {
+	sync.Mutex
+	namespaces map[string]map[peer.ID]registration
+}
+
+// NewRendezvousServer returns a new RendezvousServer
+func NewRendezvousServer() *RendezvousServer {
+	return &RendezvousServer{namespaces: make(map[string]map[peer.ID]registration)}
+}
+
+// Handle serves a rendezvous request on the stream
+func (s *RendezvousServer) Handle(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(rendezvousTimeout))
+
+	req := &rendezvousRequest{}
+	if err := json.NewDecoder(io.LimitReader(stream, rendezvousMaxRequestSize)).Decode(req); err != nil {
+		stream.Reset()
+		return
+	}
+
+	resp := rendezvousResponse{}
+	switch req.Type {
+	case rendezvousRegister:
+		if err := s.register(req.Namespace, stream.Conn().RemotePeer(), req.Addrs, req.TTL); err != nil {
+			resp.Error = err.Error()
+		}
+	case rendezvousDiscover:
+		resp.Peers = s.discover(req.Namespace, stream.Conn().RemotePeer())
+	default:
+		resp.Error = "invalid request type"
+	}
+	json.NewEncoder(stream).Encode(resp)
+}
+
+func (s *RendezvousServer) register(ns string, p peer.ID, addrs []string, ttl time.Duration) error {
+	if ns == "" || len(ns) > maxRendezvousNamespaceLength {
+		return errRendezvousNamespace
+	}
+	if ttl <= 0 || ttl > MaxRendezvousTTL {
+		ttl = MaxRendezvousTTL
+	}
+	if len(addrs) > maxRendezvousAddrs {
+		addrs = addrs[:maxRendezvousAddrs]
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if _, exists := s.namespaces[ns]; !exists {
+		if len(s.namespaces) >= maxRendezvousNamespaces {
+			s.prune()
+		}
+		if len(s.namespaces) >= maxRendezvousNamespaces {
+			return errRendezvousFull
+		}
+		s.namespaces[ns] = make(map[peer.ID]registration)
+	}
+	if _, exists := s.namespaces[ns][p]; !exists && len(s.namespaces[ns]) >= maxRendezvousRegistrations {
+		s.pruneNamespace(ns, time.Now())
+		if len(s.namespaces[ns]) >= maxRendezvousRegistrations {
+			return errRendezvousFull
+		}
+	}
+	s.namespaces[ns][p] = registration{addrs: addrs, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// prune drops the expired registrations and the namespaces left empty
+func (s *RendezvousServer) prune() {
+	now := time.Now()
+	for ns := range s.namespaces {
+		s.pruneNamespace(ns, now)
+	}
+}
+
+func (s *RendezvousServer) pruneNamespace(ns string, now time.Time) {
+	for p, r := range s.namespaces[ns] {
+		if now.After(r.expires) {
+			delete(s.namespaces[ns], p)
+		}
+	}
+	if len(s.namespaces[ns]) == 0 {
+		delete(s.namespaces, ns)
+	}
+}
+
+func (s *RendezvousServer) discover(ns string, self peer.ID) (peers []rendezvousPeer) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for p, r := range s.namespaces[ns] {
+		if now.After(r.expires) {
+			delete(s.namespaces[ns], p)
+			continue
+		}
+		if p == self || len(peers) >= maxRendezvousPeers {
+			continue
+		}
+		peers = append(peers, rendezvousPeer{ID: p.String(), Addrs: r.addrs})
+	}
+	if len(s.namespaces[ns]) == 0 {
+		delete(s.namespaces, ns)
+	}
+	return
+}
+
+// RendezvousClient registers and discovers peers on a set of rendezvous servers
+type RendezvousClient struct {
+	Servers AddrList
+}
+
+func (r *RendezvousClient) request(ctx context.Context, h host.Host, server maddr.Multiaddr, req rendezvousRequest) (*rendezvousResponse, error) {
+	info, err := peer.AddrInfoFromP2pAddr(server)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Connect(ctx, *info); err != nil {
+		return nil, err
+	}
+	s, err := h.NewStream(ctx, info.ID, protocol.RendezvousProtocol.ID())
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	resp := &rendezvousResponse{}
+	if err := json.NewDecoder(s).Decode(resp); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Register registers the host under the namespace on all the servers, for ttl.
+// It returns the last error, if the registration failed on every server.
+func (r *RendezvousClient) Register(ctx context.Context, h host.Host, ns string, ttl time.Duration) (err error) {
+	addrs := []string{}
+	for _, a := range h.Addrs() {
+		addrs = append(addrs, a.String())
+	}
+
+	registered := false
+	for _, s := range r.Servers {
+		if _, e := r.request(ctx, h, s, rendezvousRequest{Type: rendezvousRegister, Namespace: ns, Addrs: addrs, TTL: ttl}); e != nil {
+			err = e
+			continue
+		}
+		registered = true
+	}
+	if registered {
+		return nil
+	}
+	return
+}
+
+// Discover returns the peers registered under the namespace on the servers
+func (r *RendezvousClient) Discover(ctx context.Context, h host.Host, ns string) (found []peer.AddrInfo, err error) {
+	seen := map[peer.ID]bool{}
+	for _, s := range r.Servers {
+		resp, e := r.request(ctx, h, s, rendezvousRequest{Type: rendezvousDiscover, Namespace: ns})
+		if e != nil {
+			err = e
+			continue
+		}
+		for _, p := range resp.Peers {
+			id, e := peer.Decode(p.ID)
+			if e != nil || id == h.ID() || seen[id] {
+				continue
+			}
+			info := peer.AddrInfo{ID: id}
+			for _, a := range p.Addrs {
+				if ma, e := maddr.NewMultiaddr(a); e == nil {
+					info.Addrs = append(info.Addrs, ma)
+				}
+			}
+			if len(info.Addrs) == 0 {
+				continue
+			}
+			seen[id] = true
+			found = append(found, info)
+		}
+	}
+	if len(found) > 0 {
+		err = nil
+	}
+	return
+}
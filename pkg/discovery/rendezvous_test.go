@@ -0,0 +1,125 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+var _ = Describe("Rendezvous", func() {
+	var server, a, b host.Host
+	var client *RendezvousClient
+	ctx := context.Background()
+
+	newHost := func() host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+		return h
+	}
+
+	ids := func(peers []peer.AddrInfo) (res []peer.ID) {
+		for _, p := range peers {
+			res = append(res, p.ID)
+		}
+		return
+	}
+
+	BeforeEach(func() {
+		server, a, b = newHost(), newHost(), newHost()
+		server.SetStreamHandler(protocol.RendezvousProtocol.ID(), NewRendezvousServer().Handle)
+
+		addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()})
+		Expect(err).ToNot(HaveOccurred())
+		client = &RendezvousClient{Servers: AddrList(addrs[:1])}
+	})
+
+	It("discovers the peers registered on the same rendezvous", func() {
+		Expect(client.Register(ctx, a, "rv", time.Minute)).To(Succeed())
+		Expect(client.Register(ctx, b, "rv", time.Minute)).To(Succeed())
+
+		found, err := client.Discover(ctx, a, "rv")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids(found)).To(Equal([]peer.ID{b.ID()}))
+		Expect(found[0].Addrs).To(Equal(b.Addrs()))
+
+		found, err = client.Discover(ctx, b, "other")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeEmpty())
+	})
+
+	It("expires the registrations", func() {
+		Expect(client.Register(ctx, a, "rv", 100*time.Millisecond)).To(Succeed())
+		Eventually(func() []peer.AddrInfo {
+			found, _ := client.Discover(ctx, b, "rv")
+			return found
+		}, 5*time.Second, 50*time.Millisecond).Should(BeEmpty())
+	})
+
+	It("fails when no server is reachable", func() {
+		unreachable := ma.StringCast("/ip4/127.0.0.1/tcp/1/p2p/" + b.ID().String())
+		c := &RendezvousClient{Servers: AddrList{unreachable}}
+		tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		Expect(c.Register(tctx, a, "rv", time.Minute)).ToNot(Succeed())
+
+		// Other servers are still used
+		c.Servers = append(c.Servers, client.Servers...)
+		Expect(c.Register(tctx, a, "rv", time.Minute)).To(Succeed())
+		found, err := c.Discover(tctx, b, "rv")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids(found)).To(Equal([]peer.ID{a.ID()}))
+	})
+
+	It("bounds the namespaces kept by the server", func() {
+		Expect(client.Register(ctx, a, strings.Repeat("n", 257), time.Minute)).ToNot(Succeed())
+
+		for i := 0; i < 1000; i++ {
+			Expect(client.Register(ctx, a, fmt.Sprintf("rv%d", i), time.Minute)).To(Succeed())
+		}
+		Expect(client.Register(ctx, b, "full", time.Minute)).ToNot(Succeed())
+
+		// Registering again in a kept namespace still works
+		Expect(client.Register(ctx, b, "rv0", time.Minute)).To(Succeed())
+		found, err := client.Discover(ctx, a, "rv0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids(found)).To(Equal([]peer.ID{b.ID()}))
+	})
+
+	It("resets the streams sending oversized requests", func() {
+		Expect(a.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()})).To(Succeed())
+		s, err := a.NewStream(ctx, server.ID(), protocol.RendezvousProtocol.ID())
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Close()
+
+		s.Write([]byte(`{"Type":"register","Namespace":"` + strings.Repeat("n", 32<<10) + `"}`))
+		s.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = io.ReadAll(s)
+		Expect(err).To(HaveOccurred())
+	})
+})
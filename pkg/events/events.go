@@ -0,0 +1,132 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// Publisher publishes payloads on a topic of an external broker
+type Publisher interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Close() error
+}
+
+// Sink ships the node events to a Publisher, on the topic
+// <prefix>/<event type> (dots in the type become slashes).
+// Events are dropped while the broker is lagging behind, so a slow
+// broker never stalls the node.
+type Sink struct {
+	publisher Publisher
+	prefix    string
+	logger    log.StandardLogger
+	events    chan types.Event
+
+	dropped uint64
+}
+
+// NewSink returns a sink publishing the events with the given topic prefix
+func NewSink(p Publisher, prefix string, l log.StandardLogger) *Sink {
+	return &Sink{
+		publisher: p,
+		prefix:    strings.Trim(prefix, "/"),
+		logger:    l,
+		events:    make(chan types.Event, 1000),
+	}
+}
+
+// NewSinkFromURL returns a sink to the broker at the given URL. The path
+// of the URL is the topic prefix. Supported brokers are mqtt://host:port
+// (with optional user:password).
+func NewSinkFromURL(broker string, l log.StandardLogger) (*Sink, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = "edgevpn"
+	}
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		if _, hasPassword := u.User.Password(); hasPassword && u.User.Username() == "" {
+			return nil, fmt.Errorf("event broker '%s' has a password without a username", u.Redacted())
+		}
+		return NewSink(NewMQTT(u), prefix, l), nil
+	default:
+		return nil, fmt.Errorf("unsupported event broker '%s'", broker)
+	}
+}
+
+// Emit enqueues an event. It never blocks, and returns
+// false if the event was dropped.
+func (s *Sink) Emit(ev types.Event) bool {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	select {
+	case s.events <- ev:
+		return true
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+}
+
+// Dropped returns the number of events dropped so far
+func (s *Sink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Topic returns the topic the events of the given type are published on
+func (s *Sink) Topic(eventType string) string {
+	t := strings.ReplaceAll(eventType, ".", "/")
+	if s.prefix == "" {
+		return t
+	}
+	return s.prefix + "/" + t
+}
+
+// Run publishes the events until the context is done
+func (s *Sink) Run(ctx context.Context) {
+	defer s.publisher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-s.events:
+			dat, err := json.Marshal(ev)
+			if err != nil {
+				s.logger.Warnf("could not encode event: %s", err.Error())
+				continue
+			}
+			tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err = s.publisher.Publish(tctx, s.Topic(ev.Type), dat)
+			cancel()
+			if err != nil {
+				atomic.AddUint64(&s.dropped, 1)
+				s.logger.Debugf("could not publish event: %s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types
+const (
+	mqttConnect    = 0x10
+	mqttConnAck    = 0x20
+	mqttPublish    = 0x30
+	mqttDisconnect = 0xE0
+)
+
+// MQTT is a Publisher to an MQTT 3.1.1 broker. Messages are published
+// with QoS 0, and the connection is established again on failures.
+type MQTT struct {
+	address            string
+	username, password string
+	hasPassword        bool
+	clientID           string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewMQTT returns a publisher to the broker at u (mqtt://[user:password@]host:port).
+// MQTT sends a password only along a username: without one, it is ignored.
+func NewMQTT(u *url.URL) *MQTT {
+	m := &MQTT{
+		address:  u.Host,
+		clientID: fmt.Sprintf("edgevpn-%08x", rand.Uint32()),
+	}
+	if u.Port() == "" {
+		m.address = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	if u.User != nil && u.User.Username() != "" {
+		m.username = u.User.Username()
+		m.password, m.hasPassword = u.User.Password()
+	}
+	return m
+}
+
+// Publish publishes the payload on the topic
+func (m *MQTT) Publish(ctx context.Context, topic string, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		conn, err := m.connect(ctx)
+		if err != nil {
+			return err
+		}
+		m.conn = conn
+	}
+
+	var body bytes.Buffer
+	writeString(&body, topic)
+	body.Write(payload)
+
+	if d, ok := ctx.Deadline(); ok {
+		m.conn.SetWriteDeadline(d)
+	}
+	if _, err := m.conn.Write(packet(mqttPublish, body.Bytes())); err != nil {
+		m.conn.Close()
+		m.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close disconnects from the broker
+func (m *MQTT) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return nil
+	}
+	m.conn.Write(packet(mqttDisconnect, nil))
+	err := m.conn.Close()
+	m.conn = nil
+	return err
+}
+
+func (m *MQTT) connect(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.address)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// Clean session, no keepalive: the node only publishes
+	flags := byte(0x02)
+	if m.username != "" {
+		flags |= 0x80
+	}
+	if m.hasPassword {
+		flags |= 0x40
+	}
+	var body bytes.Buffer
+	writeString(&body, "MQTT")
+	body.Write([]byte{4, flags, 0, 0})
+	writeString(&body, m.clientID)
+	if m.username != "" {
+		writeString(&body, m.username)
+	}
+	if m.hasPassword {
+		writeString(&body, m.password)
+	}
+
+	if _, err := conn.Write(packet(mqttConnect, body.Bytes())); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(bufio.NewReader(conn), ack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack[0] != mqttConnAck || ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt broker refused the connection (code %d)", ack[3])
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// packet returns the control packet of the given type with the body
+func packet(t byte, body []byte) []byte {
+	p := []byte{t}
+	// Remaining length, as variable length integer
+	l := len(body)
+	for {
+		b := byte(l % 128)
+		l /= 128
+		if l > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if l == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// DefaultRecentSize is the number of events kept by the node
+const DefaultRecentSize = 100
+
+// Recent keeps the last events of the node in memory, for the API
+type Recent struct {
+	sync.Mutex
+	events []types.Event
+	next   int
+	full   bool
+}
+
+// NewRecent returns a buffer keeping the last size events
+func NewRecent(size int) *Recent {
+	if size <= 0 {
+		size = DefaultRecentSize
+	}
+	return &Recent{events: make([]types.Event, size)}
+}
+
+// Add records an event, replacing the oldest one when the buffer is full
+func (r *Recent) Add(ev types.Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.events[r.next] = ev
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// List returns the recorded events, oldest first
+func (r *Recent) List() []types.Event {
+	r.Lock()
+	defer r.Unlock()
+	if !r.full {
+		return append([]types.Event{}, r.events[:r.next]...)
+	}
+	return append(append([]types.Event{}, r.events[r.next:]...), r.events[:r.next]...)
+}
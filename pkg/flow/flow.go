@@ -0,0 +1,234 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/utils"
+)
+
+// Schema is the JSON schema of the flow log records
+//
+//go:embed schema.json
+var Schema []byte
+
+// NewFlow returns a flow record for a stream opened by src towards dst at start
+func NewFlow(protocol, service, src, dst string, in, out uint64, start time.Time) types.Flow {
+	end := time.Now()
+	return types.Flow{
+		Version:    types.FlowVersion,
+		Protocol:   protocol,
+		Service:    service,
+		SrcPeer:    src,
+		DstPeer:    dst,
+		BytesIn:    in,
+		BytesOut:   out,
+		Start:      start.UTC(),
+		End:        end.UTC(),
+		DurationMs: end.Sub(start).Milliseconds(),
+	}
+}
+
+// Encode returns the flow as a JSON line
+func Encode(f types.Flow) ([]byte, error) {
+	dat, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return append(dat, '\n'), nil
+}
+
+// Exporter ships flow records to a collector as JSON lines.
+// Supported collectors are udp://host:port and tcp://host:port (one record
+// per line), http(s):// URLs (one POST per record) and file:// paths
+// (one record per line, rotated according to the exporter rotation).
+// Records exceeding the rate limit, or while the collector is lagging behind, are dropped.
+type Exporter struct {
+	collector *url.URL
+	rate      int
+	logger    log.StandardLogger
+	flows     chan types.Flow
+	rotation  utils.Rotation
+
+	mu     sync.Mutex
+	window time.Time
+	sent   int
+
+	dropped uint64
+}
+
+// NewExporter returns an exporter to the given collector, shipping
+// at most maxPerSecond records per second (0 for no limit)
+func NewExporter(collector string, maxPerSecond int, l log.StandardLogger) (*Exporter, error) {
+	u, err := url.Parse(collector)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "http", "https":
+	case "file":
+		if filePath(u) == "" {
+			return nil, fmt.Errorf("missing path of flow collector '%s'", collector)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported flow collector '%s'", collector)
+	}
+	return &Exporter{
+		collector: u,
+		rate:      maxPerSecond,
+		logger:    l,
+		flows:     make(chan types.Flow, 1000),
+	}, nil
+}
+
+// filePath returns the path of a file:// collector, either absolute
+// (file:///var/log/flows.log) or relative (file:flows.log)
+func filePath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+// SetRotation sets the size and age limits of the files written by a
+// file:// collector, and the number of rotated files retained
+func (e *Exporter) SetRotation(r utils.Rotation) {
+	e.rotation = r
+}
+
+// Export enqueues a flow record. It never blocks, and returns
+// false if the record was dropped.
+func (e *Exporter) Export(f types.Flow) bool {
+	if !e.allow() {
+		atomic.AddUint64(&e.dropped, 1)
+		return false
+	}
+	select {
+	case e.flows <- f:
+		return true
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+		return false
+	}
+}
+
+// Dropped returns the number of records dropped so far
+func (e *Exporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+func (e *Exporter) allow() bool {
+	if e.rate <= 0 {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if now.Sub(e.window) >= time.Second {
+		e.window = now
+		e.sent = 0
+	}
+	if e.sent >= e.rate {
+		return false
+	}
+	e.sent++
+	return true
+}
+
+// Run ships the records to the collector until the context is done
+func (e *Exporter) Run(ctx context.Context) {
+	var conn net.Conn
+	var file *utils.RotatingWriter
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case f := <-e.flows:
+			dat, err := Encode(f)
+			if err != nil {
+				e.logger.Warnf("could not encode flow: %s", err.Error())
+				continue
+			}
+
+			switch e.collector.Scheme {
+			case "http", "https":
+				err = e.post(ctx, dat)
+			case "file":
+				if file == nil {
+					file, err = utils.NewRotatingWriter(filePath(e.collector), e.rotation)
+					if err != nil {
+						break
+					}
+				}
+				_, err = file.Write(dat)
+			default:
+				if conn == nil {
+					conn, err = net.DialTimeout(e.collector.Scheme, e.collector.Host, 10*time.Second)
+					if err != nil {
+						break
+					}
+				}
+				if _, err = conn.Write(dat); err != nil {
+					conn.Close()
+					conn = nil
+				}
+			}
+			if err != nil {
+				atomic.AddUint64(&e.dropped, 1)
+				e.logger.Debugf("could not ship flow to '%s': %s", e.collector, err.Error())
+			}
+		}
+	}
+}
+
+func (e *Exporter) post(ctx context.Context, dat []byte) error {
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(tctx, http.MethodPost, e.collector.String(), bytes.NewReader(dat))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector replied with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flow_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/flow"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/utils"
+)
+
+var _ = Describe("Flow logs", func() {
+	l := logger.New(log.LevelFatal)
+	start := time.Now().Add(-2 * time.Second)
+	f := NewFlow("service", "web", "peerA", "peerB", 100, 200, start)
+
+	Context("serialization", func() {
+		It("encodes flows as JSON lines following the schema", func() {
+			dat, err := Encode(f)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dat[len(dat)-1]).To(Equal(byte('\n')))
+
+			record := map[string]interface{}{}
+			Expect(json.Unmarshal(dat, &record)).To(Succeed())
+
+			schema := struct {
+				Properties map[string]interface{}
+				Required   []string
+			}{}
+			Expect(json.Unmarshal(Schema, &schema)).To(Succeed())
+
+			for _, r := range schema.Required {
+				Expect(record).To(HaveKey(r))
+			}
+			for k := range record {
+				Expect(schema.Properties).To(HaveKey(k))
+			}
+
+			Expect(record["version"]).To(BeEquivalentTo(types.FlowVersion))
+			Expect(record["protocol"]).To(Equal("service"))
+			Expect(record["service"]).To(Equal("web"))
+			Expect(record["src_peer"]).To(Equal("peerA"))
+			Expect(record["dst_peer"]).To(Equal("peerB"))
+			Expect(record["bytes_in"]).To(BeEquivalentTo(100))
+			Expect(record["bytes_out"]).To(BeEquivalentTo(200))
+			Expect(record["duration_ms"]).To(BeNumerically(">=", 2000))
+		})
+
+		It("omits the service name for VPN flows", func() {
+			dat, err := Encode(NewFlow("vpn", "", "peerA", "peerB", 1, 0, start))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dat)).ToNot(ContainSubstring("service"))
+		})
+	})
+
+	Context("exporter", func() {
+		It("rejects unsupported collectors", func() {
+			_, err := NewExporter("ftp://foo", 0, l)
+			Expect(err).To(HaveOccurred())
+			_, err = NewExporter("file://", 0, l)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("writes records to a rotated file", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The records have the same size with the same end
+			flow := func(service string) types.Flow {
+				f := NewFlow("service", service, "peerA", "peerB", 100, 200, start)
+				f.End = start.Add(time.Second).UTC()
+				return f
+			}
+			dat, err := Encode(flow("1"))
+			Expect(err).ToNot(HaveOccurred())
+			path := filepath.Join(GinkgoT().TempDir(), "flows.log")
+			e, err := NewExporter("file://"+path, 0, l)
+			Expect(err).ToNot(HaveOccurred())
+			// Two records per file
+			e.SetRotation(utils.Rotation{MaxSize: int64(2 * len(dat)), MaxFiles: 1})
+			go e.Run(ctx)
+
+			services := func(p string) (res []string) {
+				dat, _ := os.ReadFile(p)
+				for _, line := range strings.Split(strings.TrimSpace(string(dat)), "\n") {
+					got := types.Flow{}
+					json.Unmarshal([]byte(line), &got)
+					res = append(res, got.Service)
+				}
+				return
+			}
+			for _, s := range []string{"1", "2", "3", "4", "5"} {
+				Expect(e.Export(flow(s))).To(BeTrue())
+			}
+			Eventually(func() []string { return services(path) }, 5*time.Second).Should(Equal([]string{"5"}))
+			Expect(services(path + ".1")).To(Equal([]string{"3", "4"}))
+			_, err = os.Stat(path + ".2")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("rate limits the records", func() {
+			e, err := NewExporter("udp://127.0.0.1:1", 2, l)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.Export(f)).To(BeTrue())
+			Expect(e.Export(f)).To(BeTrue())
+			Expect(e.Export(f)).To(BeFalse())
+			Expect(e.Dropped()).To(Equal(uint64(1)))
+		})
+
+		It("ships records to a tcp collector", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			lines := make(chan string, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				lines <- line
+			}()
+
+			e, err := NewExporter("tcp://"+ln.Addr().String(), 0, l)
+			Expect(err).ToNot(HaveOccurred())
+			go e.Run(ctx)
+			Expect(e.Export(f)).To(BeTrue())
+
+			var line string
+			Eventually(lines, 5*time.Second).Should(Receive(&line))
+			got := types.Flow{}
+			Expect(json.Unmarshal([]byte(line), &got)).To(Succeed())
+			Expect(got.SrcPeer).To(Equal("peerA"))
+			Expect(got.BytesOut).To(Equal(uint64(200)))
+		})
+	})
+})
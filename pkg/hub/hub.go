@@ -40,14 +40,24 @@ type MessageHub struct {
 	keyLength          int
 	interval           int
 	joinPublic         bool
+	scopes             map[string]*scope
 
 	ctxCancel                context.CancelFunc
 	Messages, PublicMessages chan *Message
+
+	// PeerFilter, when set, keeps out of the gossip the peers it refuses
+	PeerFilter func(peer.ID) bool
 }
 
 // roomBufSize is the number of incoming messages to buffer for each topic.
 const roomBufSize = 128
 
+// scope is the topic of the ledger buckets gossiped apart from the others
+type scope struct {
+	room     *room
+	messages chan *Message
+}
+
 func NewHub(otp string, maxsize, keyLength, interval int, joinPublic bool) *MessageHub {
 	return &MessageHub{otpKey: otp, maxsize: maxsize, keyLength: keyLength, interval: interval,
 		Messages: make(chan *Message, roomBufSize), PublicMessages: make(chan *Message, roomBufSize), joinPublic: joinPublic}
@@ -72,8 +82,28 @@ func (m *MessageHub) joinRoom(host host.Host) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	m.ctxCancel = cancel
 
+	// Rooms of the previous key are closed now, they are
+	// set again only if joining the new ones succeeds
+	m.blockchain, m.public = nil, nil
+	for _, s := range m.scopes {
+		s.room = nil
+	}
+
 	// create a new PubSub service using the GossipSub router
-	ps, err := pubsub.NewGossipSub(ctx, host, pubsub.WithMaxMessageSize(m.maxsize))
+	opts := []pubsub.Option{pubsub.WithMaxMessageSize(m.maxsize)}
+	if m.PeerFilter != nil {
+		opts = append(opts,
+			pubsub.WithPeerFilter(func(p peer.ID, _ string) bool { return m.PeerFilter(p) }),
+			// Only the subscriptions are taken from the peers filtered out
+			pubsub.WithAppSpecificRpcInspector(func(p peer.ID, rpc *pubsub.RPC) error {
+				if !m.PeerFilter(p) && (len(rpc.GetPublish()) > 0 || rpc.GetControl() != nil) {
+					return errors.New("peer filtered out")
+				}
+				return nil
+			}),
+		)
+	}
+	ps, err := pubsub.NewGossipSub(ctx, host, opts...)
 	if err != nil {
 		return err
 	}
@@ -84,8 +114,6 @@ func (m *MessageHub) joinRoom(host host.Host) error {
 		return err
 	}
 
-	m.blockchain = cr
-
 	if m.joinPublic {
 		cr2, err := connect(ctx, ps, host.ID(), m.topicKey("public"), m.PublicMessages)
 		if err != nil {
@@ -94,11 +122,23 @@ func (m *MessageHub) joinRoom(host host.Host) error {
 		m.public = cr2
 	}
 
+	for name, s := range m.scopes {
+		r, err := connect(ctx, ps, host.ID(), m.topicKey("scope", name), s.messages)
+		if err != nil {
+			return err
+		}
+		s.room = r
+	}
+
+	m.blockchain = cr
+
 	m.ps = ps
 
 	return nil
 }
 
+// Start joins the rooms, and joins them again when the key rotates.
+// If joining fails, it is retried until it succeeds.
 func (m *MessageHub) Start(ctx context.Context, host host.Host) error {
 	c := make(chan interface{})
 	go func(c context.Context, cc chan interface{}) {
@@ -107,7 +147,7 @@ func (m *MessageHub) Start(ctx context.Context, host host.Host) error {
 			select {
 			default:
 				currentKey := m.topicKey()
-				if currentKey != k {
+				if currentKey != k || !m.Ready() {
 					k = currentKey
 					cc <- nil
 				}
@@ -130,6 +170,13 @@ func (m *MessageHub) Start(ctx context.Context, host host.Host) error {
 	return nil
 }
 
+// Ready returns true when the ledger room is joined
+func (m *MessageHub) Ready() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.blockchain != nil
+}
+
 func (m *MessageHub) PublishMessage(mess *Message) error {
 	m.Lock()
 	defer m.Unlock()
@@ -139,6 +186,33 @@ func (m *MessageHub) PublishMessage(mess *Message) error {
 	return errors.New("no message room available")
 }
 
+// Scope registers the topic of the scope, joined along with the ledger one,
+// and returns the channel its messages are delivered to.
+// Scopes are registered before Start.
+func (m *MessageHub) Scope(name string) chan *Message {
+	m.Lock()
+	defer m.Unlock()
+	if m.scopes == nil {
+		m.scopes = make(map[string]*scope)
+	}
+	s, exists := m.scopes[name]
+	if !exists {
+		s = &scope{messages: make(chan *Message, roomBufSize)}
+		m.scopes[name] = s
+	}
+	return s.messages
+}
+
+// PublishScopeMessage publishes the message on the topic of the scope
+func (m *MessageHub) PublishScopeMessage(name string, mess *Message) error {
+	m.Lock()
+	defer m.Unlock()
+	if s, exists := m.scopes[name]; exists && s.room != nil {
+		return s.room.publishMessage(mess)
+	}
+	return errors.New("no message room available")
+}
+
 func (m *MessageHub) PublishPublicMessage(mess *Message) error {
 	m.Lock()
 	defer m.Unlock()
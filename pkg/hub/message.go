@@ -13,12 +13,22 @@ limitations under the License.
 
 package hub
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrMalformedMessage is wrapped by the errors of the handlers which can't
+// decode a message, as the peer which published it is to blame
+var ErrMalformedMessage = errors.New("malformed message")
 
 // Message gets converted to/from JSON and sent in the body of pubsub messages.
 type Message struct {
 	Message  string
 	SenderID string
+	// AuthorID is the peer which published the message, while
+	// SenderID is the one which delivered it to us
+	AuthorID string `json:"-"`
 
 	Annotations map[string]interface{}
 }
@@ -93,6 +93,7 @@ func (cr *room) readLoop(messageChan chan *Message) {
 		}
 
 		cm.SenderID = msg.ReceivedFrom.String()
+		cm.AuthorID = msg.GetFrom().String()
 
 		// send valid messages onto the Messages channel
 		messageChan <- cm
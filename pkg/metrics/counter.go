@@ -0,0 +1,216 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var (
+	// DHTBytesSent counts the bytes sent on the DHT streams
+	DHTBytesSent = RegisterCounter(NewCounter("edgevpn_dht_sent_bytes_total", "Bytes sent on the DHT streams"))
+	// DHTBytesReceived counts the bytes received on the DHT streams
+	DHTBytesReceived = RegisterCounter(NewCounter("edgevpn_dht_received_bytes_total", "Bytes received on the DHT streams"))
+	// DHTThrottled counts the discovery cycles skipped over the DHT bandwidth budget
+	DHTThrottled = RegisterCounter(NewCounter("edgevpn_dht_throttled_total", "Discovery cycles skipped over the DHT bandwidth budget"))
+	// InboundIPRejected counts the inbound connections refused over the limit of their IP
+	InboundIPRejected = RegisterCounter(NewCounter("edgevpn_inbound_ip_rejected_total", "Inbound connections refused over the limit of their IP"))
+	// PrivateRejected counts the peers refused for failing to prove the membership of the private network
+	PrivateRejected = RegisterCounter(NewCounter("edgevpn_private_rejected_total", "Peers refused for failing to prove the membership of the private network"))
+	// BootstrapFailures counts the failed dials to the bootstrap peers
+	BootstrapFailures = RegisterCounter(NewCounter("edgevpn_bootstrap_failures_total", "Failed dials to the bootstrap peers"))
+
+	// VPNPacketsSent counts the packets sent to each peer over the VPN
+	VPNPacketsSent = RegisterCounterVec(NewCounterVec("edgevpn_vpn_sent_packets_total", "Packets sent to each peer over the VPN", "peer"))
+	// VPNPacketsReceived counts the packets received from each peer over the VPN
+	VPNPacketsReceived = RegisterCounterVec(NewCounterVec("edgevpn_vpn_received_packets_total", "Packets received from each peer over the VPN", "peer"))
+	// VPNBytesSent counts the bytes sent to each peer over the VPN
+	VPNBytesSent = RegisterCounterVec(NewCounterVec("edgevpn_vpn_sent_bytes_total", "Bytes sent to each peer over the VPN", "peer"))
+	// VPNBytesReceived counts the bytes received from each peer over the VPN
+	VPNBytesReceived = RegisterCounterVec(NewCounterVec("edgevpn_vpn_received_bytes_total", "Bytes received from each peer over the VPN", "peer"))
+	// VPNBatchesSent counts the batches of frames sent over the VPN
+	VPNBatchesSent = RegisterCounter(NewCounter("edgevpn_vpn_sent_batches_total", "Batches of frames sent over the VPN"))
+	// VPNBatchBytesSent counts the bytes of the batches sent over the VPN, once compressed
+	VPNBatchBytesSent = RegisterCounter(NewCounter("edgevpn_vpn_sent_batch_bytes_total", "Bytes of the batches sent over the VPN, once compressed"))
+	// FirewallDropped counts the packets received from each peer and dropped by the VPN firewall
+	FirewallDropped = RegisterCounterVec(NewCounterVec("edgevpn_firewall_dropped_packets_total", "Packets received from each peer and dropped by the VPN firewall", "peer"))
+)
+
+var counters struct {
+	sync.Mutex
+	counters []*Counter
+	vecs     []*CounterVec
+}
+
+// RegisterCounter adds the counter to the ones returned by Counters, and returns it
+func RegisterCounter(c *Counter) *Counter {
+	counters.Lock()
+	defer counters.Unlock()
+	counters.counters = append(counters.counters, c)
+	return c
+}
+
+// RegisterCounterVec adds the counters of the family to the ones returned by Counters, and returns it
+func RegisterCounterVec(v *CounterVec) *CounterVec {
+	counters.Lock()
+	defer counters.Unlock()
+	counters.vecs = append(counters.vecs, v)
+	return v
+}
+
+// DeletePeer drops the counters of the peer from the registered families
+// labelled by peer, once it disconnected, so that they don't grow with the
+// peers ever seen. They start again from 0 if the peer connects again.
+func DeletePeer(p string) {
+	counters.Lock()
+	defer counters.Unlock()
+	for _, v := range counters.vecs {
+		if v.label == "peer" {
+			v.Delete(p)
+		}
+	}
+}
+
+// Counters returns the current values of the registered counters,
+// followed by the ones of the registered families
+func Counters() []types.Counter {
+	counters.Lock()
+	defer counters.Unlock()
+	res := []types.Counter{}
+	for _, c := range counters.counters {
+		res = append(res, types.Counter{Name: c.name, Help: c.help, Value: c.Value()})
+	}
+	for _, v := range counters.vecs {
+		res = append(res, v.snapshot()...)
+	}
+	return res
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the labels in the Prometheus text format, sorted by name
+func formatLabels(l map[string]string) string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := []string{}
+	for n := range l {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	pairs := []string{}
+	for _, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", n, labelEscaper.Replace(l[n])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeCounters(w io.Writer) error {
+	last := ""
+	for _, c := range Counters() {
+		if c.Name != last {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name); err != nil {
+				return err
+			}
+			last = c.Name
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %d\n", c.Name, formatLabels(c.Labels), c.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counter is a monotonic counter. Adding is lock free.
+type Counter struct {
+	name, help string
+	value      uint64
+}
+
+// NewCounter returns a counter starting from 0
+func NewCounter(name, help string) *Counter {
+	return &Counter{name: name, help: help}
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a family of counters, one for each value of a label
+// (e.g. the peer ID). The counters are created on first use.
+type CounterVec struct {
+	sync.RWMutex
+	name, help, label string
+	counters          map[string]*Counter
+}
+
+// NewCounterVec returns an empty family of counters
+func NewCounterVec(name, help, label string) *CounterVec {
+	return &CounterVec{name: name, help: help, label: label, counters: make(map[string]*Counter)}
+}
+
+// With returns the counter of the label value
+func (v *CounterVec) With(value string) *Counter {
+	v.RLock()
+	c, ok := v.counters[value]
+	v.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if c, ok := v.counters[value]; ok {
+		return c
+	}
+	c = NewCounter(v.name, v.help)
+	v.counters[value] = c
+	return c
+}
+
+// Delete drops the counter of the label value
+func (v *CounterVec) Delete(value string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.counters, value)
+}
+
+// snapshot returns the values of the counters, sorted by label value
+func (v *CounterVec) snapshot() []types.Counter {
+	v.RLock()
+	defer v.RUnlock()
+	values := []string{}
+	for l := range v.counters {
+		values = append(values, l)
+	}
+	sort.Strings(values)
+	res := []types.Counter{}
+	for _, l := range values {
+		res = append(res, types.Counter{Name: v.name, Help: v.help, Labels: map[string]string{v.label: l}, Value: v.counters[l].Value()})
+	}
+	return res
+}
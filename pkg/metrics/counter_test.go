@@ -0,0 +1,80 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics_test
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/metrics"
+)
+
+var _ = Describe("Counter", func() {
+	It("exports the registered counters", func() {
+		c := RegisterCounter(NewCounter("edgevpn_test_total", "A test counter"))
+		c.Add(3)
+		c.Add(4)
+		Expect(c.Value()).To(Equal(uint64(7)))
+
+		names := []string{}
+		for _, c := range Counters() {
+			names = append(names, c.Name)
+		}
+		Expect(names).To(ContainElements("edgevpn_dht_sent_bytes_total", "edgevpn_dht_received_bytes_total", "edgevpn_test_total"))
+
+		b := &bytes.Buffer{}
+		Expect(WriteText(b)).To(Succeed())
+		Expect(b.String()).To(ContainSubstring("# TYPE edgevpn_test_total counter\nedgevpn_test_total 7\n"))
+	})
+
+	It("exports labelled counters and gauges", func() {
+		v := RegisterCounterVec(NewCounterVec("edgevpn_test_vec_total", "A test vector", "peer"))
+		v.With("a").Add(2)
+		v.With(`b"c`).Add(1)
+		v.With("a").Add(1)
+
+		g := RegisterGauge(NewGauge("edgevpn_test_gauge", "A test gauge"))
+		g.Set(5)
+		Expect(g.Value()).To(Equal(int64(5)))
+
+		gv := RegisterGaugeVec(NewGaugeVec("edgevpn_test_gauge_vec", "A test gauge vector", "network"))
+		gv.With("").Set(1)
+		gv.With("lab").Set(2)
+		gv.With("office").Set(3)
+
+		b := &bytes.Buffer{}
+		Expect(WriteText(b)).To(Succeed())
+		Expect(b.String()).To(ContainSubstring("# TYPE edgevpn_test_vec_total counter\nedgevpn_test_vec_total{peer=\"a\"} 3\nedgevpn_test_vec_total{peer=\"b\\\"c\"} 1\n"))
+		Expect(b.String()).To(ContainSubstring("# TYPE edgevpn_test_gauge gauge\nedgevpn_test_gauge 5\n"))
+		Expect(b.String()).To(ContainSubstring("# TYPE edgevpn_test_gauge_vec gauge\nedgevpn_test_gauge_vec 1\nedgevpn_test_gauge_vec{network=\"lab\"} 2\nedgevpn_test_gauge_vec{network=\"office\"} 3\n"))
+	})
+
+	It("drops the counters of the disconnected peers", func() {
+		v := RegisterCounterVec(NewCounterVec("edgevpn_test_peer_total", "A test peer vector", "peer"))
+		other := RegisterCounterVec(NewCounterVec("edgevpn_test_network_total", "A test network vector", "network"))
+		v.With("a").Add(1)
+		v.With("b").Add(2)
+		other.With("a").Add(3)
+
+		DeletePeer("a")
+
+		b := &bytes.Buffer{}
+		Expect(WriteText(b)).To(Succeed())
+		Expect(b.String()).To(ContainSubstring("# TYPE edgevpn_test_peer_total counter\nedgevpn_test_peer_total{peer=\"b\"} 2\n# HELP"))
+		Expect(b.String()).To(ContainSubstring("edgevpn_test_network_total{network=\"a\"} 3\n"))
+		Expect(v.With("a").Value()).To(BeZero())
+	})
+})
@@ -0,0 +1,156 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var (
+	// ConnectedPeers is the number of peers the node of each network is connected to
+	ConnectedPeers = RegisterGaugeVec(NewGaugeVec("edgevpn_connected_peers", "Peers the node is connected to", "network"))
+)
+
+var gauges struct {
+	sync.Mutex
+	gauges []*Gauge
+	vecs   []*GaugeVec
+}
+
+// RegisterGauge adds the gauge to the ones returned by Gauges, and returns it
+func RegisterGauge(g *Gauge) *Gauge {
+	gauges.Lock()
+	defer gauges.Unlock()
+	gauges.gauges = append(gauges.gauges, g)
+	return g
+}
+
+// RegisterGaugeVec adds the gauges of the family to the ones returned by Gauges, and returns it
+func RegisterGaugeVec(v *GaugeVec) *GaugeVec {
+	gauges.Lock()
+	defer gauges.Unlock()
+	gauges.vecs = append(gauges.vecs, v)
+	return v
+}
+
+// Gauges returns the current values of the registered gauges,
+// followed by the ones of the registered families
+func Gauges() []types.Gauge {
+	gauges.Lock()
+	defer gauges.Unlock()
+	res := []types.Gauge{}
+	for _, g := range gauges.gauges {
+		res = append(res, types.Gauge{Name: g.name, Help: g.help, Value: g.Value()})
+	}
+	for _, v := range gauges.vecs {
+		res = append(res, v.snapshot()...)
+	}
+	return res
+}
+
+func writeGauges(w io.Writer) error {
+	last := ""
+	for _, g := range Gauges() {
+		if g.Name != last {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.Name, g.Help, g.Name); err != nil {
+				return err
+			}
+			last = g.Name
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %d\n", g.Name, formatLabels(g.Labels), g.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gauge is a value which can go up and down. Setting is lock free.
+type Gauge struct {
+	name, help string
+	value      int64
+}
+
+// NewGauge returns a gauge starting from 0
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{name: name, help: help}
+}
+
+// Set sets the value of the gauge
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// GaugeVec is a family of gauges, one for each value of a label (e.g. the
+// network). The gauges are created on first use. The gauge of the empty
+// value is exported without the label.
+type GaugeVec struct {
+	sync.RWMutex
+	name, help, label string
+	gauges            map[string]*Gauge
+}
+
+// NewGaugeVec returns an empty family of gauges
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	return &GaugeVec{name: name, help: help, label: label, gauges: make(map[string]*Gauge)}
+}
+
+// With returns the gauge of the label value
+func (v *GaugeVec) With(value string) *Gauge {
+	v.RLock()
+	g, ok := v.gauges[value]
+	v.RUnlock()
+	if ok {
+		return g
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if g, ok := v.gauges[value]; ok {
+		return g
+	}
+	g = NewGauge(v.name, v.help)
+	v.gauges[value] = g
+	return g
+}
+
+// snapshot returns the values of the gauges, sorted by label value
+func (v *GaugeVec) snapshot() []types.Gauge {
+	v.RLock()
+	defer v.RUnlock()
+	values := []string{}
+	for l := range v.gauges {
+		values = append(values, l)
+	}
+	sort.Strings(values)
+	res := []types.Gauge{}
+	for _, l := range values {
+		g := types.Gauge{Name: v.name, Help: v.help, Value: v.gauges[l].Value()}
+		if l != "" {
+			g.Labels = map[string]string{v.label: l}
+		}
+		res = append(res, g)
+	}
+	return res
+}
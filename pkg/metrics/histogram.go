@@ -0,0 +1,146 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// DefaultLatencyBuckets are the upper bounds of the latency histograms
+var DefaultLatencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+var (
+	// DialLatency observes the connections to the peers found by the discovery
+	DialLatency = Register(NewHistogram("edgevpn_discovery_dial_seconds", "Time to connect to the peers found by the discovery", DefaultLatencyBuckets...))
+	// DHTQueryLatency observes the searches of peers on the DHT
+	DHTQueryLatency = Register(NewHistogram("edgevpn_dht_query_seconds", "Time to search the peers of a rendezvous on the DHT", DefaultLatencyBuckets...))
+	// StreamOpenLatency observes the streams opened to the peers
+	StreamOpenLatency = Register(NewHistogram("edgevpn_stream_open_seconds", "Time to open a stream to a peer", DefaultLatencyBuckets...))
+	// BlockPropagation observes the time the ledger blocks of the other nodes take to be received
+	BlockPropagation = Register(NewHistogram("edgevpn_ledger_block_propagation_seconds", "Time from the creation of the ledger blocks of the other nodes to their receipt", DefaultLatencyBuckets...))
+)
+
+var registry struct {
+	sync.Mutex
+	histograms []*Histogram
+}
+
+// Register adds the histogram to the ones returned by Histograms, and returns it
+func Register(h *Histogram) *Histogram {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.histograms = append(registry.histograms, h)
+	return h
+}
+
+// Histograms returns a snapshot of the registered histograms
+func Histograms() []types.LatencyHistogram {
+	registry.Lock()
+	defer registry.Unlock()
+	res := []types.LatencyHistogram{}
+	for _, h := range registry.histograms {
+		res = append(res, types.LatencyHistogram{Name: h.name, Help: h.help, Histogram: h.Snapshot()})
+	}
+	return res
+}
+
+// WriteText writes the registered histograms, counters and gauges
+// in the Prometheus text format
+func WriteText(w io.Writer) error {
+	for _, h := range Histograms() {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name); err != nil {
+			return err
+		}
+		for _, b := range h.Histogram.Buckets {
+			le := "+Inf"
+			if b.UpperBound != 0 {
+				le = strconv.FormatFloat(b.UpperBound.Seconds(), 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.Name, le, b.Count)
+		}
+		fmt.Fprintf(w, "%s_sum %s\n", h.Name, strconv.FormatFloat(h.Histogram.Sum.Seconds(), 'g', -1, 64))
+		if _, err := fmt.Fprintf(w, "%s_count %d\n", h.Name, h.Histogram.Count); err != nil {
+			return err
+		}
+	}
+	if err := writeCounters(w); err != nil {
+		return err
+	}
+	return writeGauges(w)
+}
+
+// Histogram is a latency distribution. Observing is lock free, so it can be
+// done on hot paths.
+type Histogram struct {
+	name, help string
+	bounds     []time.Duration
+	// counts has one counter for each bound, plus the one of +Inf
+	counts []uint64
+	count  uint64
+	sum    uint64
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds
+func NewHistogram(name, help string, bounds ...time.Duration) *Histogram {
+	b := append([]time.Duration{}, bounds...)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return &Histogram{name: name, help: help, bounds: b, counts: make([]uint64, len(b)+1)}
+}
+
+// Observe records the duration
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	if d > 0 {
+		atomic.AddUint64(&h.sum, uint64(d))
+	}
+}
+
+// Since records the time elapsed since start
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// Snapshot returns the current state of the histogram. The last
+// bucket has no upper bound, and counts all the observations.
+func (h *Histogram) Snapshot() types.Histogram {
+	s := types.Histogram{
+		Count: atomic.LoadUint64(&h.count),
+		Sum:   time.Duration(atomic.LoadUint64(&h.sum)),
+	}
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		b := types.HistogramBucket{Count: cumulative}
+		if i < len(h.bounds) {
+			b.UpperBound = h.bounds[i]
+		}
+		s.Buckets = append(s.Buckets, b)
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics_test
+
+import (
+	"bytes"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/metrics"
+)
+
+var _ = Describe("Histogram", func() {
+	It("counts the observations in cumulative buckets", func() {
+		h := NewHistogram("test", "", time.Second, 10*time.Millisecond, 100*time.Millisecond)
+		h.Observe(5 * time.Millisecond)
+		h.Observe(10 * time.Millisecond)
+		h.Observe(50 * time.Millisecond)
+		h.Observe(2 * time.Second)
+
+		s := h.Snapshot()
+		Expect(s.Count).To(Equal(uint64(4)))
+		Expect(s.Sum).To(Equal(2065 * time.Millisecond))
+		Expect(s.Buckets).To(HaveLen(4))
+		counts := []uint64{}
+		bounds := []time.Duration{}
+		for _, b := range s.Buckets {
+			counts = append(counts, b.Count)
+			bounds = append(bounds, b.UpperBound)
+		}
+		Expect(bounds).To(Equal([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second, 0}))
+		Expect(counts).To(Equal([]uint64{2, 3, 3, 4}))
+	})
+
+	It("measures the time since the start of an operation", func() {
+		h := NewHistogram("test", "", DefaultLatencyBuckets...)
+		start := time.Now()
+		time.Sleep(20 * time.Millisecond)
+		h.Since(start)
+		s := h.Snapshot()
+		Expect(s.Count).To(Equal(uint64(1)))
+		Expect(s.Sum).To(BeNumerically(">=", 20*time.Millisecond))
+		Expect(s.Buckets[0].Count).To(BeZero())
+	})
+
+	It("exports the registered histograms in the Prometheus format", func() {
+		h := Register(NewHistogram("edgevpn_test_seconds", "A test histogram", time.Second))
+		h.Observe(500 * time.Millisecond)
+
+		names := []string{}
+		for _, l := range Histograms() {
+			names = append(names, l.Name)
+		}
+		Expect(names).To(ContainElements("edgevpn_discovery_dial_seconds", "edgevpn_dht_query_seconds", "edgevpn_stream_open_seconds", "edgevpn_test_seconds"))
+
+		b := &bytes.Buffer{}
+		Expect(WriteText(b)).To(Succeed())
+		Expect(b.String()).To(ContainSubstring("# TYPE edgevpn_test_seconds histogram\n"))
+		Expect(b.String()).To(ContainSubstring("edgevpn_test_seconds_bucket{le=\"1\"} 1\n"))
+		Expect(b.String()).To(ContainSubstring("edgevpn_test_seconds_bucket{le=\"+Inf\"} 1\n"))
+		Expect(b.String()).To(ContainSubstring("edgevpn_test_seconds_sum 0.5\n"))
+		Expect(b.String()).To(ContainSubstring("edgevpn_test_seconds_count 1\n"))
+	})
+})
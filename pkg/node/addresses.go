@@ -0,0 +1,106 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/mudler/edgevpn/pkg/types"
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+// transports are the multiaddr protocols naming a transport,
+// the last one found in an address wins (e.g. quic-v1 over udp)
+var transports = map[string]bool{
+	"tcp":           true,
+	"udp":           true,
+	"quic":          true,
+	"quic-v1":       true,
+	"webtransport":  true,
+	"ws":            true,
+	"wss":           true,
+	"webrtc-direct": true,
+	"p2p-circuit":   true,
+	"onion3":        true,
+}
+
+// Transport returns the transport of the address
+func Transport(a multiaddr.Multiaddr) (t string) {
+	for _, p := range a.Protocols() {
+		if transports[p.Name] {
+			t = p.Name
+		}
+	}
+	return
+}
+
+// ListenAddresses returns the addresses the node is bound to,
+// with the actual ports when binding to ephemeral ones
+func (e *Node) ListenAddresses() []multiaddr.Multiaddr {
+	if e.host == nil {
+		return nil
+	}
+	return e.host.Network().ListenAddresses()
+}
+
+// Addresses returns both the bound and the external addresses of the node
+func (e *Node) Addresses() (addrs []types.ListenAddress) {
+	if e.host == nil {
+		return
+	}
+
+	bound := map[string]bool{}
+	for _, a := range e.ListenAddresses() {
+		bound[a.String()] = true
+		addrs = append(addrs, types.ListenAddress{Address: a.String(), Transport: Transport(a), Kind: types.AddressBound})
+	}
+	for _, a := range e.host.Addrs() {
+		if bound[a.String()] {
+			continue
+		}
+		addrs = append(addrs, types.ListenAddress{Address: a.String(), Transport: Transport(a), Kind: types.AddressExternal})
+	}
+	return
+}
+
+func (e *Node) logAddresses() {
+	for _, a := range e.Addresses() {
+		e.config.Logger.Infof("Node Address (%s, %s): %s", a.Kind, a.Transport, a.Address)
+	}
+}
+
+// watchAddresses logs the node addresses whenever they change,
+// and protects the connections to the relays in use
+func (e *Node) watchAddresses(ctx context.Context) {
+	sub, err := e.host.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		e.config.Logger.Warn(err.Error())
+		return
+	}
+	defer sub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			e.config.Logger.Info("Node addresses changed")
+			e.logAddresses()
+			e.protectRelays()
+		}
+	}
+}
@@ -19,14 +19,20 @@ import (
 
 	"github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	basichost "github.com/libp2p/go-libp2p/p2p/host/basic"
 
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	discovery "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/events"
+	"github.com/mudler/edgevpn/pkg/flow"
 	hub "github.com/mudler/edgevpn/pkg/hub"
 	protocol "github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/store"
+	multiaddr "github.com/multiformats/go-multiaddr"
 )
 
 // Config is the node configuration
@@ -59,15 +65,65 @@ type Config struct {
 	Store blockchain.Store
 
 	// Handle is a handle consumed by HumanInterfaces to handle received messages
-	Handle                     func(bool, *hub.Message)
-	StreamHandlers             map[protocol.Protocol]StreamHandler
+	Handle         func(bool, *hub.Message)
+	StreamHandlers map[protocol.Protocol]StreamHandler
+
+	// Options replace the base libp2p options of the host (see WithLibp2pOptions).
+	// AdditionalOptions are applied after the ones set by EdgeVPN, and before the
+	// fallback defaults: they can set what EdgeVPN leaves unset (e.g. transports,
+	// muxers, resource manager) but options which can be set only once (e.g.
+	// identity or connection gater) conflict with the ones of EdgeVPN and fail.
 	AdditionalOptions, Options []libp2p.Option
 
 	DiscoveryInterval, LedgerSyncronizationTime, LedgerAnnounceTime time.Duration
 	DiscoveryBootstrapPeers                                         discovery.AddrList
+	DiscoveryRendezvousServers                                      discovery.AddrList
+	DiscoveryMaxPeers                                               int
+	DiscoveryMaxConnections                                         int
+	DiscoveryDialConcurrency                                        int
+	DiscoveryCanaryTimeout                                          time.Duration
+	DiscoveryDialBackoff                                            time.Duration
+	DiscoveryMaxQueries                                             int
+	// DiscoveryLocalPeers is the number of peers found with mDNS above which
+	// the DHT discovery slows down by DiscoveryLocalScaleFactor
+	DiscoveryLocalPeers, DiscoveryLocalScaleFactor int
+	// DiscoveryProtocolPrefix makes the nodes run a private DHT
+	// (see discovery.DHT.ProtocolPrefix)
+	DiscoveryProtocolPrefix string
+	// DiscoveryBandwidthBudget caps the bytes of the DHT streams within
+	// DiscoveryBandwidthWindow (see discovery.DHT.BandwidthBudget)
+	DiscoveryBandwidthBudget int64
+	DiscoveryBandwidthWindow time.Duration
+	// DiscoveryBootstrapPolicy is applied when no bootstrap peer is reachable
+	// (see discovery.DHT.BootstrapPolicy)
+	DiscoveryBootstrapPolicy      string
+	DiscoveryBootstrapTimeout     time.Duration
+	DiscoveryBootstrapFallbackURL string
+	// DiscoveryProviders supply more bootstrap peers to the DHT discovery
+	// on every cycle (see discovery.Provider)
+	DiscoveryProviders []discovery.Provider
+	// DiscoveryMinInterval enables the adaptive discovery interval, which
+	// varies between DiscoveryMinInterval and DiscoveryInterval depending on the peer churn
+	DiscoveryMinInterval time.Duration
+	// DiscoveryDiagnoseAfter is the number of discovery rounds finding no peer
+	// after which the node warns of misconfigured OTP parameters
+	DiscoveryDiagnoseAfter int
+	// DiscoveryOTPWindowTolerance is the number of OTP intervals before and
+	// after the current one the rendezvous is also announced on
+	DiscoveryOTPWindowTolerance int
+	// DiscoveryDHTMode is the mode of the DHT (see discovery.DHT.DHTMode)
+	DiscoveryDHTMode string
+	// DiscoveryFixedRendezvous replaces the OTP rendezvous, for tests only
+	DiscoveryFixedRendezvous string
+	// DiscoveryPeerCache persists the peers met in the StateStore, to dial
+	// them on start (see discovery.DHT.PeerCache)
+	DiscoveryPeerCache bool
 
 	Whitelist, Blacklist []string
 
+	// HolePunch enables upgrading relayed connections to direct ones
+	HolePunch bool
+
 	// GenericHub enables generic hub
 	GenericHub bool
 
@@ -76,6 +132,91 @@ type Config struct {
 
 	Sealer    Sealer
 	PeerGater Gater
+
+	// Quarantine, when set, disconnects and blocks peers sending malformed data
+	Quarantine *Quarantine
+
+	// LedgerAuthorizer, when set, authorizes the blocks received from other peers
+	LedgerAuthorizer blockchain.WriteAuthorizer
+
+	// LedgerValidators validate the values written to their bucket
+	LedgerValidators map[string]blockchain.Validator
+
+	// LedgerHistory is the number of versions retained for the keys of each bucket
+	LedgerHistory map[string]int
+
+	// LedgerScopes maps the buckets to the scope they are gossiped in
+	LedgerScopes map[string]string
+
+	// FlowExporter, when set, ships the flow logs of VPN and service streams
+	FlowExporter *flow.Exporter
+
+	// AddrsFactory rewrites the set of addresses advertised by the host.
+	// It is applied last: it receives the full list of the addresses the host
+	// is listening on (including private ones), and whatever it returns is what
+	// gets announced to other peers.
+	AddrsFactory basichost.AddrsFactory
+
+	// Uplinks are the local source addresses the outbound TCP connections
+	// are distributed across, by weight
+	Uplinks []Uplink
+
+	// SourcePorts is the range of local ports the outbound TCP
+	// connections originate from
+	SourcePorts *PortRange
+
+	// TorProxy is the address of the SOCKS proxy of a Tor daemon
+	// the onion addresses are dialed through
+	TorProxy string
+
+	// TorOnly dials all the connections through the Tor proxy
+	TorOnly bool
+
+	// OnionAddresses are the addresses of the hidden services
+	// forwarding to the node, announced to the other peers
+	OnionAddresses []multiaddr.Multiaddr
+
+	// StateStore persists the node state across restarts,
+	// like the time to first peer histogram
+	StateStore store.Store
+
+	// Connection is the network configuration the node was set up with
+	Connection *YAMLConnectionConfig
+
+	// EventSink, when set, exports the node events to an external broker
+	EventSink *events.Sink
+
+	// PinnedKeys are the public keys the peers must present to connect
+	PinnedKeys map[peer.ID]crypto.PubKey
+
+	// PrivateNetwork makes the nodes run a private DHT, with a protocol
+	// prefix derived from the token, and refuse the peers not proving the
+	// knowledge of the current OTP rendezvous
+	PrivateNetwork bool
+
+	// MaxInboundPerIP caps the concurrent inbound connections
+	// from each remote IP, 0 means no limit
+	MaxInboundPerIP int
+
+	// LedgerClearKeys seals only the values of the ledger blocks exchanged
+	// with the other nodes, leaving the buckets and keys in cleartext
+	LedgerClearKeys bool
+
+	// LedgerBatchWindow coalesces the ledger blocks written within the window
+	// into a single message
+	LedgerBatchWindow time.Duration
+	// LedgerCompressionLevel is the gzip level of the ledger messages,
+	// the default one is used when 0
+	LedgerCompressionLevel int
+
+	// ShutdownTimeout bounds the time the node takes to shut down
+	ShutdownTimeout time.Duration
+	// ShutdownPhaseTimeouts overrides the budget of single shutdown phases
+	ShutdownPhaseTimeouts map[string]time.Duration
+
+	// NetworkName is a local label for the network the node joins,
+	// used to scope the service lookups
+	NetworkName string
 }
 
 type Gater interface {
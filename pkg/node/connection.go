@@ -17,6 +17,8 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	mrand "math/rand"
 	"net"
@@ -29,7 +31,14 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	conngater "github.com/libp2p/go-libp2p/p2p/net/conngater"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	libp2pwebrtc "github.com/libp2p/go-libp2p/p2p/transport/webrtc"
+	ws "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
 	hub "github.com/mudler/edgevpn/pkg/hub"
+	"github.com/mudler/edgevpn/pkg/store"
 	multiaddr "github.com/multiformats/go-multiaddr"
 )
 
@@ -65,6 +74,32 @@ func GenPrivKey(seed int64) (crypto.PrivKey, error) {
 	return prvKey, err
 }
 
+// PrivKeyName is the key of the node identity in the store. It is kept
+// at the root of the store, where older versions saved it.
+const PrivKeyName = "privkey"
+
+// CachedPrivKey returns the private key persisted in the store,
+// generating and persisting a new one if there is none
+func CachedPrivKey(s store.Store) ([]byte, error) {
+	dat, err := s.Get("", PrivKeyName)
+	if err == nil && len(dat) > 0 {
+		return dat, nil
+	}
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+
+	privkey, err := GenPrivKey(0)
+	if err != nil {
+		return nil, err
+	}
+	r, err := crypto.MarshalPrivateKey(privkey)
+	if err != nil {
+		return nil, err
+	}
+	return r, s.Put("", PrivKeyName, r)
+}
+
 func (e *Node) genHost(ctx context.Context) (host.Host, error) {
 	var prvKey crypto.PrivKey
 
@@ -103,7 +138,7 @@ func (e *Node) genHost(ctx context.Context) (host.Host, error) {
 		return nil, err
 	}
 
-	opts = append(opts, libp2p.ConnectionGater(cg), libp2p.Identity(prvKey))
+	opts = append(opts, libp2p.ConnectionGater(nodeGater{cg, e}), libp2p.Identity(prvKey))
 	// Do not enable metrics for now
 	opts = append(opts, libp2p.DisableMetrics())
 
@@ -111,12 +146,95 @@ func (e *Node) genHost(ctx context.Context) (host.Host, error) {
 	for _, l := range e.config.ListenAddresses {
 		addrs = append(addrs, []multiaddr.Multiaddr(l)...)
 	}
+	tor := e.config.TorProxy != ""
+	// Listen where the hidden services forward the connections to
+	opts = append(opts, libp2p.ListenAddrs(onionListenAddrs(e.config.OnionAddresses)...))
 	opts = append(opts, libp2p.ListenAddrs(addrs...))
 
 	for _, d := range e.config.ServiceDiscovery {
 		opts = append(opts, d.Option(ctx))
 	}
 
+	addrsFactory := e.config.AddrsFactory
+	if e.config.TorOnly || len(e.config.OnionAddresses) > 0 {
+		addrsFactory = torAddrsFactory(e.config.OnionAddresses, e.config.TorOnly)
+		if f := e.config.AddrsFactory; f != nil {
+			addrsFactory = func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+				return f(torAddrsFactory(e.config.OnionAddresses, e.config.TorOnly)(addrs))
+			}
+		}
+	}
+	if addrsFactory != nil {
+		opts = append(opts, libp2p.AddrsFactory(addrsFactory))
+	}
+
+	custom := len(e.config.Uplinks) > 0 || e.config.SourcePorts != nil || tor
+	switch {
+	case e.config.TorOnly:
+		if len(e.config.Uplinks) > 0 || e.config.SourcePorts != nil {
+			return nil, errors.New("uplinks and source ports can't be used when all the connections go through Tor")
+		}
+		// Only TCP can go through the proxy
+		e.config.Logger.Warn("All the connections go through Tor: QUIC, WebSocket, WebTransport and WebRTC are disabled, and DNS addresses are still resolved locally")
+		opts = append(opts, libp2p.Transport(newTorTransport(e.config.TorProxy, true)))
+		if len(addrs) == 0 && len(e.config.OnionAddresses) == 0 {
+			opts = append(opts, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		}
+	case custom:
+		tcpTransport := libp2p.Transport(tcp.NewTCPTransport)
+		others := []libp2p.Option{
+			libp2p.Transport(quic.NewTransport),
+			libp2p.Transport(ws.New),
+			libp2p.Transport(webtransport.New),
+			libp2p.Transport(libp2pwebrtc.New),
+		}
+		if len(e.config.Uplinks) > 0 {
+			// Dial all the outbound connections from the uplinks
+			e.config.Logger.Warn("The outbound connections are dialed with TCP from the uplinks: QUIC, WebSocket, WebTransport and WebRTC accept the inbound connections only")
+			others = []libp2p.Option{
+				libp2p.Transport(newUplinkQUICTransport),
+				libp2p.Transport(newUplinkWebsocketTransport),
+				libp2p.Transport(newUplinkWebTransport),
+				libp2p.Transport(newUplinkWebRTCTransport),
+			}
+		}
+		if len(e.config.Uplinks) > 0 || e.config.SourcePorts != nil {
+			// Replace the default TCP transport with one binding to the uplinks
+			// and the source ports
+			b := NewUplinkBalancer(e.config.Uplinks, uplinkMaxFailures, uplinkCooldown)
+			if e.config.SourcePorts != nil {
+				e.config.Logger.Warnf("Only the TCP dials originate from the source ports %s: QUIC, WebTransport and WebRTC dial from their listen port, WebSocket from any port", e.config.SourcePorts)
+			}
+			tcpTransport = libp2p.Transport(newUplinkTransport(b, e.config.SourcePorts))
+		}
+		opts = append(opts, tcpTransport)
+		opts = append(opts, others...)
+		if tor {
+			opts = append(opts, libp2p.Transport(newTorTransport(e.config.TorProxy, false)))
+		}
+	}
+
+	// The default listen addresses are not set when setting the transports
+	// or other listen addresses
+	if len(addrs) == 0 && !e.config.TorOnly && (custom || len(e.config.OnionAddresses) > 0) {
+		opts = append(opts, libp2p.DefaultListenAddrs)
+	}
+
+	if tor {
+		opts = append(opts, libp2p.WithDialTimeout(torDialTimeout))
+	}
+
+	if e.config.HolePunch {
+		if e.config.TorOnly {
+			e.config.Logger.Warn("Hole punching is disabled when all the connections go through Tor")
+		} else {
+			opts = append(opts, libp2p.EnableHolePunching(holepunch.WithTracer(e.holePunch)))
+		}
+	}
+
+	if err := checkAdditionalOptions(opts, e.config.AdditionalOptions); err != nil {
+		return nil, err
+	}
 	opts = append(opts, e.config.AdditionalOptions...)
 
 	if e.config.Insecure {
@@ -129,6 +247,22 @@ func (e *Node) genHost(ctx context.Context) (host.Host, error) {
 	return libp2p.NewWithoutDefaults(opts...)
 }
 
+// checkAdditionalOptions applies the additional options on top of the ones set
+// by the node to a scratch config, to report which one conflicts with them
+// (e.g. a second identity or connection gater) instead of a bare libp2p error
+func checkAdditionalOptions(opts, additional []libp2p.Option) error {
+	cfg := &libp2p.Config{}
+	if err := cfg.Apply(opts...); err != nil {
+		return err
+	}
+	for i, o := range additional {
+		if err := cfg.Apply(o); err != nil {
+			return fmt.Errorf("additional libp2p option #%d conflicts with the options set by edgevpn: %w", i, err)
+		}
+	}
+	return nil
+}
+
 // FallbackDefaults applies default options to the libp2p node if and only if no
 // other relevant options have been applied. will be appended to the options
 // passed into New.
@@ -254,6 +388,8 @@ func (e *Node) handleEvents(ctx context.Context, inputChannel chan *hub.Message,
 			str, err := e.config.Sealer.Unseal(c.Message, e.sealkey())
 			if err != nil {
 				e.config.Logger.Warnf("%w from %s", err.Error(), c.SenderID)
+				e.reportAuthor(c, "undecryptable message")
+				continue
 			}
 			c.Message = str
 			e.handleReceivedMessage(c, handlers, inputChannel)
@@ -264,9 +400,15 @@ func (e *Node) handleEvents(ctx context.Context, inputChannel chan *hub.Message,
 }
 
 func (e *Node) handleReceivedMessage(m *hub.Message, handlers []Handler, c chan *hub.Message) {
+	malformed := false
 	for _, h := range handlers {
 		if err := h(e.ledger, m, c); err != nil {
 			e.config.Logger.Warnf("handler error: %s", err)
+			malformed = malformed || errors.Is(err, hub.ErrMalformedMessage)
 		}
 	}
+	// Only the messages which can't be decoded are violations, once
+	if malformed {
+		e.reportAuthor(m, "malformed message")
+	}
 }
@@ -0,0 +1,86 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// exportEvents hooks the peer connections, the discovery cycles
+// and the ledger changes to the recent events and the event sink
+func (e *Node) exportEvents(ctx context.Context, h host.Host, ledger *blockchain.Ledger) {
+	emit := func(t string, data map[string]string) {
+		e.emit(types.Event{Type: t, Node: h.ID().String(), Data: data})
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, c network.Conn) {
+			metrics.ConnectedPeers.With(e.config.NetworkName).Set(int64(len(n.Peers())))
+			emit(types.EventPeerConnected, map[string]string{"peer": c.RemotePeer().String(), "address": c.RemoteMultiaddr().String()})
+		},
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			metrics.ConnectedPeers.With(e.config.NetworkName).Set(int64(len(n.Peers())))
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				metrics.DeletePeer(c.RemotePeer().String())
+			}
+			emit(types.EventPeerDisconnected, map[string]string{"peer": c.RemotePeer().String(), "address": c.RemoteMultiaddr().String()})
+		},
+	})
+
+	for _, sd := range e.config.ServiceDiscovery {
+		if d, ok := sd.(*discovery.DHT); ok {
+			d.OnCycle = func(rv string, found, connected int) {
+				emit(types.EventDiscoveryCycle, map[string]string{"rendezvous": rv, "found": strconv.Itoa(found), "connected": strconv.Itoa(connected)})
+			}
+		}
+	}
+
+	ledger.OnChange(func(author string, b blockchain.Block) {
+		emit(types.EventLedgerChanged, map[string]string{"author": author, "index": strconv.Itoa(b.Index), "hash": b.Hash})
+	})
+
+	if e.config.EventSink != nil {
+		go e.config.EventSink.Run(ctx)
+	}
+}
+
+func (e *Node) emit(ev types.Event) {
+	ev.Time = time.Now().UTC()
+	e.recent.Add(ev)
+	if e.config.EventSink != nil {
+		e.config.EventSink.Emit(ev)
+	}
+}
+
+// Emit records an event of the node, and exports it to the event sink, if any
+func (e *Node) Emit(t string, data map[string]string) {
+	if e.host == nil {
+		return
+	}
+	e.emit(types.Event{Type: t, Node: e.host.ID().String(), Data: data})
+}
+
+// RecentEvents returns the last events of the node, oldest first
+func (e *Node) RecentEvents() []types.Event {
+	return e.recent.List()
+}
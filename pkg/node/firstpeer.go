@@ -0,0 +1,144 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/store"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// Where the time to first peer histogram is persisted in the state store
+const (
+	metricsNamespace   = "metrics"
+	firstPeerMetricKey = "time_to_first_peer"
+)
+
+// firstPeerBuckets are the upper bounds of the time to first peer histogram
+var firstPeerBuckets = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 0,
+}
+
+// firstPeer tracks the time from the start of the node
+// until the first peer found by discovery connects
+type firstPeer struct {
+	sync.Mutex
+	started, connected time.Time
+	ready              chan struct{}
+}
+
+// Ready returns a channel which is closed once the
+// first peer found by discovery connects
+func (e *Node) Ready() <-chan struct{} {
+	return e.firstPeer.ready
+}
+
+// TimeToFirstPeer returns how long it took from the start of the node until
+// the first peer found by discovery connected, and false if none did yet
+func (e *Node) TimeToFirstPeer() (time.Duration, bool) {
+	e.firstPeer.Lock()
+	defer e.firstPeer.Unlock()
+	if e.firstPeer.connected.IsZero() {
+		return 0, false
+	}
+	return e.firstPeer.connected.Sub(e.firstPeer.started), true
+}
+
+// TimeToFirstPeerHistogram returns the histogram of the time to first peer
+// across the runs of the node sharing the state store (see WithStateStore)
+func (e *Node) TimeToFirstPeerHistogram() types.Histogram {
+	h, err := e.loadFirstPeerHistogram()
+	if err != nil {
+		e.config.Logger.Warnf("Failed loading the time to first peer histogram: %s", err.Error())
+	}
+	return h
+}
+
+func (e *Node) firstPeerStats() types.FirstPeerStats {
+	d, _ := e.TimeToFirstPeer()
+	return types.FirstPeerStats{TimeToFirstPeer: d, Histogram: e.TimeToFirstPeerHistogram()}
+}
+
+func (e *Node) startFirstPeerTimer() {
+	e.firstPeer.Lock()
+	defer e.firstPeer.Unlock()
+	e.firstPeer.started = time.Now()
+}
+
+// discoveryConnected is called by the discovery services
+// with the peers they find and connect to
+func (e *Node) discoveryConnected(p peer.ID) {
+	e.firstPeer.Lock()
+	if !e.firstPeer.connected.IsZero() || e.firstPeer.started.IsZero() {
+		e.firstPeer.Unlock()
+		return
+	}
+	e.firstPeer.connected = time.Now()
+	d := e.firstPeer.connected.Sub(e.firstPeer.started)
+	close(e.firstPeer.ready)
+	e.firstPeer.Unlock()
+
+	e.config.Logger.Infof("Connected to the first peer '%s' in %s", p, d)
+	if err := e.observeFirstPeer(d); err != nil {
+		e.config.Logger.Warnf("Failed persisting the time to first peer: %s", err.Error())
+	}
+}
+
+func (e *Node) loadFirstPeerHistogram() (types.Histogram, error) {
+	h := types.Histogram{}
+	for _, b := range firstPeerBuckets {
+		h.Buckets = append(h.Buckets, types.HistogramBucket{UpperBound: b})
+	}
+	dat, err := e.config.StateStore.Get(metricsNamespace, firstPeerMetricKey)
+	if errors.Is(err, store.ErrNotFound) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+	stored := types.Histogram{}
+	if err := json.Unmarshal(dat, &stored); err != nil {
+		return h, err
+	}
+	// Ignore histograms persisted with different buckets
+	if len(stored.Buckets) != len(h.Buckets) {
+		return h, nil
+	}
+	return stored, nil
+}
+
+func (e *Node) observeFirstPeer(d time.Duration) error {
+	h, err := e.loadFirstPeerHistogram()
+	if err != nil {
+		return err
+	}
+	h.Count++
+	h.Sum += d
+	for i, b := range h.Buckets {
+		if b.UpperBound == 0 || d <= b.UpperBound {
+			h.Buckets[i].Count++
+		}
+	}
+	dat, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return e.config.StateStore.Put(metricsNamespace, firstPeerMetricKey, dat)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/store"
+)
+
+var _ = Describe("Time to first peer", func() {
+	l := Logger(logger.New(log.LevelFatal))
+	token := GenerateNewConnectionData(25).Base64()
+
+	// start starts a node, and simulates the discovery of a peer
+	start := func(ctx context.Context, s store.Store) *Node {
+		d := discovery.NewDHT()
+		e, err := New(FromBase64(false, true, token, d, nil), WithStore(&blockchain.MemoryStore{}), WithStateStore(s), l)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+
+		_, ok := e.TimeToFirstPeer()
+		Expect(ok).To(BeFalse())
+		Expect(e.Ready()).ToNot(BeClosed())
+
+		time.Sleep(10 * time.Millisecond)
+		d.OnConnect(peer.ID("foo"))
+		return e
+	}
+
+	It("is populated once a peer connects, and kept across restarts", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := store.NewMemory()
+
+		e := start(ctx, s)
+		Expect(e.Ready()).To(BeClosed())
+		d, ok := e.TimeToFirstPeer()
+		Expect(ok).To(BeTrue())
+		Expect(d).To(BeNumerically(">=", 10*time.Millisecond))
+		Expect(e.Status().FirstPeer.TimeToFirstPeer).To(Equal(d))
+
+		h := e.TimeToFirstPeerHistogram()
+		Expect(h.Count).To(Equal(uint64(1)))
+		Expect(h.Sum).To(Equal(d))
+		Expect(h.Buckets[0].Count).To(Equal(uint64(1)))
+		Expect(h.Buckets[len(h.Buckets)-1].Count).To(Equal(uint64(1)))
+
+		// The histogram adds up the runs sharing the state store
+		e2 := start(ctx, s)
+		Expect(e2.TimeToFirstPeerHistogram().Count).To(Equal(uint64(2)))
+		Expect(e.Status().FirstPeer.TimeToFirstPeer).To(Equal(d))
+	})
+})
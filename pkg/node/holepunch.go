@@ -0,0 +1,65 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// HolePunchMetadataKey is the peerstore key holding the outcome of
+// the last attempt to upgrade the relayed connection with a peer
+const HolePunchMetadataKey = "edgevpn/holepunch"
+
+// holePunchTracer follows the attempts to upgrade relayed connections
+// to direct ones, logging and counting their outcome
+type holePunchTracer struct {
+	n                             *Node
+	attempts, successes, failures uint64
+}
+
+func (t *holePunchTracer) Trace(evt *holepunch.Event) {
+	switch e := evt.Evt.(type) {
+	case *holepunch.StartHolePunchEvt:
+		atomic.AddUint64(&t.attempts, 1)
+		t.n.config.Logger.Debugf("Upgrading relayed connection with '%s' (rtt: %s)", evt.Remote, e.RTT)
+	case *holepunch.EndHolePunchEvt:
+		if e.Success {
+			atomic.AddUint64(&t.successes, 1)
+			t.n.Host().Peerstore().Put(evt.Remote, HolePunchMetadataKey, "direct")
+			t.n.config.Logger.Infof("Relayed connection with '%s' upgraded to direct in %s", evt.Remote, e.EllapsedTime)
+		} else {
+			atomic.AddUint64(&t.failures, 1)
+			t.n.Host().Peerstore().Put(evt.Remote, HolePunchMetadataKey, "relayed")
+			t.n.config.Logger.Debugf("Failed upgrading relayed connection with '%s': %s", evt.Remote, e.Error)
+		}
+	}
+}
+
+// HolePunchTracer returns the tracer of the attempts to upgrade the relayed
+// connections, as given to libp2p with EnableHolePunching
+func (e *Node) HolePunchTracer() holepunch.EventTracer {
+	return e.holePunch
+}
+
+// Stats returns the counters of the hole punching attempts
+func (t *holePunchTracer) Stats() types.HolePunchStats {
+	return types.HolePunchStats{
+		Attempts:  atomic.LoadUint64(&t.attempts),
+		Successes: atomic.LoadUint64(&t.successes),
+		Failures:  atomic.LoadUint64(&t.failures),
+	}
+}
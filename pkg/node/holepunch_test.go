@@ -0,0 +1,71 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Hole punching", func() {
+	newPeer := func() peer.ID {
+		key, _, err := crypto.GenerateEd25519Key(nil)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		return id
+	}
+
+	It("counts the upgrades of the relayed connections and records their outcome", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		e, err := New(
+			FromBase64(false, false, GenerateNewConnectionData().Base64(), nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			Logger(logger.New(log.LevelFatal)),
+			EnableHolePunching,
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		Expect(e.Status().HolePunch).To(Equal(types.HolePunchStats{}))
+
+		direct, relayed := newPeer(), newPeer()
+		tracer := e.HolePunchTracer()
+		for _, p := range []peer.ID{direct, relayed} {
+			tracer.Trace(&holepunch.Event{Remote: p, Evt: &holepunch.StartHolePunchEvt{RTT: time.Millisecond}})
+		}
+		tracer.Trace(&holepunch.Event{Remote: direct, Evt: &holepunch.EndHolePunchEvt{Success: true, EllapsedTime: time.Second}})
+		tracer.Trace(&holepunch.Event{Remote: relayed, Evt: &holepunch.EndHolePunchEvt{Error: "timeout"}})
+		// The single attempts of an upgrade are not counted
+		tracer.Trace(&holepunch.Event{Remote: relayed, Evt: &holepunch.HolePunchAttemptEvt{Attempt: 1}})
+
+		Expect(e.Status().HolePunch).To(Equal(types.HolePunchStats{Attempts: 2, Successes: 1, Failures: 1}))
+		Expect(e.Host().Peerstore().Get(direct, HolePunchMetadataKey)).To(Equal("direct"))
+		Expect(e.Host().Peerstore().Get(relayed, HolePunchMetadataKey)).To(Equal("relayed"))
+	})
+})
@@ -0,0 +1,65 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/ipfs/go-log"
+)
+
+// Policies applied when the identity key file is accessible by other users
+const (
+	KeyPermissionsRefuse = "refuse"
+	KeyPermissionsFix    = "fix"
+	KeyPermissionsWarn   = "warn"
+)
+
+// CheckKeyPermissions checks that the identity key file at path is accessible only by
+// its owner. Otherwise, depending on the policy, it returns an error (refuse), restricts
+// the permissions (fix) or just logs a warning (warn).
+// Missing files are not checked.
+func CheckKeyPermissions(path, policy string, l log.StandardLogger) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	mode := info.Mode().Perm()
+	if mode&0077 == 0 {
+		return nil
+	}
+
+	switch policy {
+	case KeyPermissionsFix:
+		l.Warnf("identity key file '%s' is accessible by other users (%04o), restricting it to 0600", path, mode)
+		return os.Chmod(path, 0600)
+	case KeyPermissionsWarn:
+		l.Warnf("identity key file '%s' is accessible by other users (%04o): restrict it with 'chmod 600 %s'", path, mode, path)
+		return nil
+	case KeyPermissionsRefuse, "":
+		return fmt.Errorf("identity key file '%s' is accessible by other users (%04o): restrict it with 'chmod 600 %s', or set the key permissions policy to '%s' or '%s'", path, mode, path, KeyPermissionsFix, KeyPermissionsWarn)
+	default:
+		return fmt.Errorf("invalid key permissions policy '%s'", policy)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+)
+
+var _ = Describe("Identity key permissions", func() {
+	l := logger.New(log.LevelFatal)
+	var keyFile string
+
+	writeKey := func(mode os.FileMode) {
+		Expect(os.WriteFile(keyFile, []byte("key"), mode)).To(Succeed())
+		Expect(os.Chmod(keyFile, mode)).To(Succeed())
+	}
+
+	perm := func() os.FileMode {
+		info, err := os.Stat(keyFile)
+		Expect(err).ToNot(HaveOccurred())
+		return info.Mode().Perm()
+	}
+
+	BeforeEach(func() {
+		dir, err := os.MkdirTemp("", "identity")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		keyFile = filepath.Join(dir, PrivKeyName)
+	})
+
+	It("accepts keys accessible only by the owner, or missing", func() {
+		Expect(CheckKeyPermissions(keyFile, KeyPermissionsRefuse, l)).To(Succeed())
+		writeKey(0600)
+		Expect(CheckKeyPermissions(keyFile, KeyPermissionsRefuse, l)).To(Succeed())
+	})
+
+	It("refuses loose permissions", func() {
+		writeKey(0644)
+		err := CheckKeyPermissions(keyFile, KeyPermissionsRefuse, l)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("chmod 600"))
+		Expect(perm()).To(Equal(os.FileMode(0644)))
+	})
+
+	It("refuses loose permissions by default", func() {
+		writeKey(0640)
+		Expect(CheckKeyPermissions(keyFile, "", l)).ToNot(Succeed())
+	})
+
+	It("fixes loose permissions", func() {
+		writeKey(0666)
+		Expect(CheckKeyPermissions(keyFile, KeyPermissionsFix, l)).To(Succeed())
+		Expect(perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("warns on loose permissions", func() {
+		writeKey(0644)
+		Expect(CheckKeyPermissions(keyFile, KeyPermissionsWarn, l)).To(Succeed())
+		Expect(perm()).To(Equal(os.FileMode(0644)))
+	})
+
+	It("fails on unknown policies", func() {
+		writeKey(0644)
+		Expect(CheckKeyPermissions(keyFile, "ignore", l)).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,151 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// DefaultHandshakeTimeout is the time an accepted connection
+// counts towards the limit of its IP before completing the upgrade
+const DefaultHandshakeTimeout = time.Minute
+
+// IPLimiter caps the concurrent inbound connections from each remote IP.
+// A connection counts from when it is accepted, before the security
+// handshake, until it is closed. The accepted connections which don't
+// complete the upgrade are released after HandshakeTimeout.
+// Relayed connections and the ones from non-IP addresses are not limited.
+type IPLimiter struct {
+	// Max is the limit of each IP, 0 means no limit
+	Max              int
+	HandshakeTimeout time.Duration
+
+	sync.Mutex
+	conns map[string]*ipConn
+	perIP map[string]int
+}
+
+type ipConn struct {
+	ip          string
+	accepted    time.Time
+	established bool
+}
+
+// NewIPLimiter returns an IPLimiter allowing max connections from each IP
+func NewIPLimiter(max int) *IPLimiter {
+	return &IPLimiter{
+		Max:              max,
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		conns:            make(map[string]*ipConn),
+		perIP:            make(map[string]int),
+	}
+}
+
+// remoteIP returns the IP the connection comes from, if it can be limited
+func remoteIP(a ma.Multiaddr) (string, bool) {
+	if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return "", false
+	}
+	ip, err := manet.ToIP(a)
+	if err != nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+func connKey(c network.ConnMultiaddrs) string {
+	return c.RemoteMultiaddr().String() + " " + c.LocalMultiaddr().String()
+}
+
+// Accept returns true if the connection is within the limit of its IP, and counts it
+func (l *IPLimiter) Accept(c network.ConnMultiaddrs) bool {
+	ip, ok := remoteIP(c.RemoteMultiaddr())
+	if !ok || l.Max <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.expire()
+	if l.perIP[ip] >= l.Max {
+		return false
+	}
+	l.conns[connKey(c)] = &ipConn{ip: ip, accepted: time.Now()}
+	l.perIP[ip]++
+	return true
+}
+
+// Connections returns the connections counted for the IP
+func (l *IPLimiter) Connections(ip string) int {
+	l.Lock()
+	defer l.Unlock()
+	l.expire()
+	return l.perIP[ip]
+}
+
+// expire releases the accepted connections which didn't complete the upgrade in time
+func (l *IPLimiter) expire() {
+	for k, c := range l.conns {
+		if !c.established && time.Since(c.accepted) > l.HandshakeTimeout {
+			l.release(k)
+		}
+	}
+}
+
+func (l *IPLimiter) release(key string) {
+	c, ok := l.conns[key]
+	if !ok {
+		return
+	}
+	delete(l.conns, key)
+	if l.perIP[c.ip]--; l.perIP[c.ip] <= 0 {
+		delete(l.perIP, c.ip)
+	}
+}
+
+// Notifiee tracks the accepted connections until they are closed
+func (l *IPLimiter) Notifiee() network.Notifiee {
+	return &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			l.Lock()
+			defer l.Unlock()
+			if ic, ok := l.conns[connKey(c)]; ok {
+				ic.established = true
+			}
+		},
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			l.Lock()
+			defer l.Unlock()
+			l.release(connKey(c))
+		},
+	}
+}
+
+func (g nodeGater) InterceptAccept(c network.ConnMultiaddrs) bool {
+	if !g.BasicConnectionGater.InterceptAccept(c) {
+		return false
+	}
+	if !g.n.ipLimit.Accept(c) {
+		metrics.InboundIPRejected.Add(1)
+		g.n.config.Logger.Debugf("Refusing connection from %s: over the limit of %d connections per IP", c.RemoteMultiaddr(), g.n.ipLimit.Max)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	. "github.com/mudler/edgevpn/pkg/node"
+)
+
+type connAddrs struct{ local, remote ma.Multiaddr }
+
+func (c connAddrs) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c connAddrs) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+
+var _ = Describe("Inbound connections per IP", func() {
+	l := Logger(logger.New(log.LevelFatal))
+
+	It("releases the connections which don't complete the handshake", func() {
+		local := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+		conn := func(a string) connAddrs { return connAddrs{local, ma.StringCast(a)} }
+
+		i := NewIPLimiter(1)
+		i.HandshakeTimeout = 500 * time.Millisecond
+		Expect(i.Accept(conn("/ip4/10.1.0.1/tcp/1000"))).To(BeTrue())
+		Expect(i.Accept(conn("/ip4/10.1.0.1/tcp/1001"))).To(BeFalse())
+		Expect(i.Accept(conn("/ip4/10.1.0.2/tcp/1000"))).To(BeTrue())
+		Expect(i.Connections("10.1.0.1")).To(Equal(1))
+
+		Eventually(func() int { return i.Connections("10.1.0.1") }, 5*time.Second).Should(Equal(0))
+		Expect(i.Accept(conn("/ip4/10.1.0.1/tcp/1001"))).To(BeTrue())
+
+		Expect(NewIPLimiter(0).Accept(conn("/ip4/10.1.0.1/tcp/1000"))).To(BeTrue())
+	})
+
+	It("refuses the connections over the limit of an IP", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		e, err := New(
+			FromBase64(false, false, GenerateNewConnectionData(25).Base64(), nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			WithMaxInboundPerIP(2),
+			l,
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		target := peer.AddrInfo{ID: e.Host().ID(), Addrs: e.Host().Addrs()}
+
+		rejected := metrics.InboundIPRejected.Value()
+		hosts, connected := []host.Host{}, []host.Host{}
+		for i := 0; i < 5; i++ {
+			h, err := libp2p.New(libp2p.NoListenAddrs)
+			Expect(err).ToNot(HaveOccurred())
+			defer h.Close()
+			hosts = append(hosts, h)
+			if h.Connect(ctx, target) == nil {
+				connected = append(connected, h)
+			}
+		}
+		Expect(connected).To(HaveLen(2))
+		Expect(metrics.InboundIPRejected.Value()).To(BeNumerically(">=", rejected+3))
+
+		// Closing a connection makes room for a new one
+		Expect(connected[0].Network().ClosePeer(e.Host().ID())).To(Succeed())
+		Eventually(func() error {
+			return hosts[4].Connect(ctx, target)
+		}, 10*time.Second, 200*time.Millisecond).Should(Succeed())
+		Expect(hosts[4].Network().Connectedness(e.Host().ID())).To(Equal(network.Connected))
+
+		_, err = New(WithMaxInboundPerIP(-1))
+		Expect(err).To(HaveOccurred())
+	})
+})
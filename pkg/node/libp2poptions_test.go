@@ -0,0 +1,73 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+)
+
+var _ = Describe("Additional libp2p options", func() {
+	l := Logger(logger.New(log.LevelFatal))
+	token := GenerateNewConnectionData(25).Base64()
+
+	newNode := func(opts ...libp2p.Option) (*Node, error) {
+		return New(
+			FromBase64(false, false, token, discovery.NewDHT(), nil),
+			WithStore(&blockchain.MemoryStore{}),
+			WithLibp2pAdditionalOptions(opts...),
+			l,
+		)
+	}
+
+	It("are applied to the host, after the options of EdgeVPN", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		applied, identity := false, false
+		custom := func(cfg *libp2p.Config) error {
+			applied = true
+			identity = cfg.PeerKey != nil
+			return nil
+		}
+
+		e, err := newNode(custom, libp2p.UserAgent("custom-agent"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		defer e.Host().Close()
+
+		Expect(applied).To(BeTrue())
+		Expect(identity).To(BeTrue())
+	})
+
+	It("report the options conflicting with the ones of EdgeVPN", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		e, err := newNode(libp2p.RandomIdentity)
+		Expect(err).ToNot(HaveOccurred())
+		err = e.Start(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("additional libp2p option #0 conflicts"))
+	})
+})
@@ -23,10 +23,15 @@ import (
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/net/conngater"
 
 	"github.com/mudler/edgevpn/pkg/crypto"
+	"github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/events"
 	protocol "github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/store"
+	"github.com/mudler/edgevpn/pkg/types"
 
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	hub "github.com/mudler/edgevpn/pkg/hub"
@@ -45,9 +50,32 @@ type Node struct {
 	host   host.Host
 	cg     *conngater.BasicConnectionGater
 	ledger *blockchain.Ledger
+	scopes map[string]*ledgerScope
+	phase  string
+
+	safeMode types.SafeMode
+	iface    types.InterfaceStatus
+
+	holePunch *holePunchTracer
+	protected protections
+	firstPeer firstPeer
+	pins      *PinSet
+	recent    *events.Recent
+	ipLimit   *IPLimiter
+	private   *privateAuth
+
+	cancel         context.CancelFunc
+	shutdownPhases []ShutdownPhase
 	sync.Mutex
 }
 
+// Startup phases of the node
+const (
+	PhaseStarting = "starting"
+	PhaseCanary   = "canary"
+	PhaseRunning  = "running"
+)
+
 const defaultChanSize = 3000
 
 var defaultLibp2pOptions = []libp2p.Option{
@@ -66,18 +94,47 @@ func New(p ...Option) (*Node, error) {
 		Logger:                   logger.New(log.LevelDebug),
 		Sealer:                   &crypto.AESSealer{},
 		Store:                    &blockchain.MemoryStore{},
+		StateStore:               store.NewMemory(),
+		ShutdownTimeout:          30 * time.Second,
 	}
 
 	if err := c.Apply(p...); err != nil {
 		return nil, err
 	}
+	if c.LedgerClearKeys {
+		c.Sealer = &ValuesSealer{Sealer: c.Sealer}
+	}
 
-	return &Node{
+	n := &Node{
 		config:       *c,
 		inputCh:      make(chan *hub.Message, defaultChanSize),
 		genericHubCh: make(chan *hub.Message, defaultChanSize),
 		seed:         0,
-	}, nil
+		phase:        PhaseStarting,
+		firstPeer:    firstPeer{ready: make(chan struct{})},
+		scopes:       make(map[string]*ledgerScope),
+		recent:       events.NewRecent(events.DefaultRecentSize),
+	}
+	n.holePunch = &holePunchTracer{n: n}
+	n.pins = NewPinSet()
+	n.ipLimit = NewIPLimiter(c.MaxInboundPerIP)
+	if c.PrivateNetwork {
+		a, err := newPrivateAuth(c.ServiceDiscovery)
+		if err != nil {
+			return nil, err
+		}
+		n.private = a
+		setPrivateProtocolPrefix(c)
+	}
+	for p, k := range c.PinnedKeys {
+		n.pins.Pin(p, k)
+	}
+	return n, nil
+}
+
+// NetworkName returns the local label of the network the node joins
+func (e *Node) NetworkName() string {
+	return e.config.NetworkName
 }
 
 // Ledger return the ledger which uses the node
@@ -94,10 +151,51 @@ func (e *Node) Ledger() (*blockchain.Ledger, error) {
 		return nil, err
 	}
 
-	e.ledger = blockchain.New(mw, e.config.Store)
+	l := blockchain.New(mw, e.config.Store)
+	if err := e.configureLedger(l); err != nil {
+		return nil, err
+	}
+	e.ledger = l
+	if err := e.scopeLedger(); err != nil {
+		e.ledger = nil
+		return nil, err
+	}
 	return e.ledger, nil
 }
 
+// configureLedger applies the ledger settings of the node to l
+func (e *Node) configureLedger(l *blockchain.Ledger) error {
+	l.SetLogger(e.config.Logger)
+	if e.config.LedgerAuthorizer != nil {
+		l.SetWriteAuthorizer(e.config.LedgerAuthorizer)
+	}
+	for b, v := range e.config.LedgerValidators {
+		l.SetValidator(b, v)
+	}
+	for b, d := range e.config.LedgerHistory {
+		l.SetHistoryDepth(b, d)
+	}
+	l.SetBatchWindow(e.config.LedgerBatchWindow)
+	if e.config.LedgerCompressionLevel != 0 {
+		return l.SetCompressionLevel(e.config.LedgerCompressionLevel)
+	}
+	return nil
+}
+
+// signEntries signs the ledger entries written by the node with the host key
+func (e *Node) signEntries(dat []byte) ([]byte, error) {
+	k := e.host.Peerstore().PrivKey(e.host.ID())
+	if k == nil {
+		return nil, fmt.Errorf("no private key for %s", e.host.ID())
+	}
+	return k.Sign(dat)
+}
+
+// Logger returns the logger of the node
+func (e *Node) Logger() log.StandardLogger {
+	return e.config.Logger
+}
+
 // PeerGater returns the node peergater
 func (e *Node) PeerGater() Gater {
 	return e.config.PeerGater
@@ -105,6 +203,10 @@ func (e *Node) PeerGater() Gater {
 
 // Start joins the node over the p2p network
 func (e *Node) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	e.Lock()
+	e.cancel = cancel
+	e.Unlock()
 
 	ledger, err := e.Ledger()
 	if err != nil {
@@ -116,6 +218,7 @@ func (e *Node) Start(ctx context.Context) error {
 	e.config.Handlers = append(e.config.Handlers, ledger.Update)
 
 	e.config.Logger.Info("Starting EdgeVPN network")
+	e.startFirstPeerTimer()
 
 	// Startup libp2p network
 	err = e.startNetwork(ctx)
@@ -126,6 +229,9 @@ func (e *Node) Start(ctx context.Context) error {
 	// Send periodically messages to the channel with our blockchain content
 	ledger.Syncronizer(ctx, e.config.LedgerSyncronizationTime)
 
+	// Hold the announces until the discovery canary is done
+	e.waitCanary(ctx)
+
 	// Start eventual declared NetworkServices
 	for _, s := range e.config.NetworkServices {
 		err := s(ctx, e.config, e, ledger)
@@ -137,6 +243,73 @@ func (e *Node) Start(ctx context.Context) error {
 	return nil
 }
 
+func (e *Node) waitCanary(ctx context.Context) {
+	for _, sd := range e.config.ServiceDiscovery {
+		d, ok := sd.(*discovery.DHT)
+		if !ok || d.CanaryTimeout == 0 {
+			continue
+		}
+		e.setPhase(PhaseCanary)
+		select {
+		case <-d.CanaryDone():
+		case <-ctx.Done():
+		}
+	}
+	e.setPhase(PhaseRunning)
+}
+
+func (e *Node) setPhase(p string) {
+	e.Lock()
+	defer e.Unlock()
+	e.phase = p
+}
+
+// Status returns the local status of the node
+func (e *Node) Status() types.NodeStatus {
+	e.Lock()
+	defer e.Unlock()
+	return types.NodeStatus{
+		Phase:       e.phase,
+		HolePunch:   e.holePunch.Stats(),
+		Addresses:   e.Addresses(),
+		SafeMode:    e.safeMode,
+		Ledger:      e.ledgerStatus(),
+		FirstPeer:   e.firstPeerStats(),
+		Interface:   e.iface,
+		DHT:         e.dhtStatus(),
+		Diagnostics: e.diagnostics(),
+	}
+}
+
+// dhtStatus returns the mode of the DHT, if the DHT discovery is enabled
+func (e *Node) dhtStatus() types.DHTStatus {
+	for _, sd := range e.config.ServiceDiscovery {
+		if d, ok := sd.(*discovery.DHT); ok {
+			return d.ModeStatus()
+		}
+	}
+	return types.DHTStatus{}
+}
+
+// diagnostics collects the warnings of the discovery services
+func (e *Node) diagnostics() (res []string) {
+	for _, sd := range e.config.ServiceDiscovery {
+		if d, ok := sd.(interface{ Diagnosis() string }); ok {
+			if w := d.Diagnosis(); w != "" {
+				res = append(res, w)
+			}
+		}
+	}
+	return
+}
+
+// ExportFlow ships the flow log record, if a flow exporter is set
+func (e *Node) ExportFlow(f types.Flow) {
+	if e.config.FlowExporter != nil {
+		e.config.FlowExporter.Export(f)
+	}
+}
+
 // messageWriter returns a new MessageWriter bound to the edgevpn instance
 // with the given options
 func (e *Node) messageWriter(opts ...hub.MessageOption) (*messageWriter, error) {
@@ -159,23 +332,75 @@ func (e *Node) startNetwork(ctx context.Context) error {
 		return err
 	}
 	e.host = host
+	host.Network().Notify(e.ipLimit.Notifiee())
+	if e.private != nil {
+		host.SetStreamHandler(protocol.PrivateAuthProtocol.ID(), e.handlePrivateAuth)
+		host.Network().Notify(e.privateNotifiee())
+	}
 
 	ledger, err := e.Ledger()
 	if err != nil {
 		return err
 	}
+	ledger.SetAuthor(host.ID().String())
+	ledger.SetSigner(e.signEntries)
 
 	for pid, strh := range e.config.StreamHandlers {
-		host.SetStreamHandler(pid.ID(), network.StreamHandler(strh(e, ledger)))
+		e.SetStreamHandler(pid.ID(), network.StreamHandler(strh(e, ledger)))
 	}
 
 	e.config.Logger.Info("Node ID:", host.ID())
-	e.config.Logger.Info("Node Addresses:", host.Addrs())
+	e.logAddresses()
+	go e.watchAddresses(ctx)
 
 	// Hub rotates within sealkey interval.
 	// this time length should be enough to make room for few block exchanges. This is ideally on minutes (10, 20, etc. )
 	// it makes sure that if a bruteforce is attempted over the encrypted messages, the real key is not exposed.
 	e.MessageHub = hub.NewHub(e.config.RoomName, e.config.MaxMessageSize, e.config.SealKeyLength, e.config.SealKeyInterval, e.config.GenericHub)
+	if e.private != nil {
+		e.MessageHub.PeerFilter = e.Authenticated
+	}
+
+	e.exportEvents(ctx, host, ledger)
+
+	var (
+		dht  *discovery.DHT
+		mdns *discovery.MDNS
+		pex  *discovery.PeerExchange
+	)
+	for _, sd := range e.config.ServiceDiscovery {
+		switch d := sd.(type) {
+		case *discovery.DHT:
+			d.OnConnect = e.discoveryConnected
+			d.Providers = append(d.Providers, e.config.DiscoveryProviders...)
+			if e.config.DiscoveryPeerCache && d.PeerCache == nil {
+				d.PeerCache = discovery.NewPeerCache(e.config.StateStore)
+			}
+			dht = d
+		case *discovery.MDNS:
+			d.OnConnect = e.discoveryConnected
+			mdns = d
+		case *discovery.PeerExchange:
+			if d.Network == "" {
+				d.Network = pexNetwork(e.config.RoomName)
+			}
+			if d.Members == nil {
+				d.Members = func(p peer.ID) bool { return ledgerMember(ledger, p) }
+			}
+			pex = d
+		}
+	}
+	// Prefer the peers found on the local network over the DHT
+	if dht != nil && mdns != nil && dht.LocalPeers == nil {
+		dht.LocalPeers = mdns.LocalPeers
+	}
+	// Share the bootstrap peers the DHT reaches, and dial the learned ones
+	if dht != nil && pex != nil && pex.Bootstrap != nil {
+		dht.LearnedBootstrap = pex.Bootstrap
+		if pex.Bootstrap.Shared == nil {
+			pex.Bootstrap.Shared = func() discovery.AddrList { return dht.ReachableBootstrapPeers(host) }
+		}
+	}
 
 	for _, sd := range e.config.ServiceDiscovery {
 		if err := sd.Run(e.config.Logger, ctx, host); err != nil {
@@ -183,7 +408,18 @@ func (e *Node) startNetwork(ctx context.Context) error {
 		}
 	}
 
+	go e.watchLedgerTransport(ctx)
+
+	if e.config.Quarantine != nil {
+		go e.releaseQuarantine(ctx)
+	}
+
+	if e.config.FlowExporter != nil {
+		go e.config.FlowExporter.Run(ctx)
+	}
+
 	go e.handleEvents(ctx, e.inputCh, e.MessageHub.Messages, e.MessageHub.PublishMessage, e.config.Handlers, true)
+	e.startScopes(ctx)
 	go e.MessageHub.Start(ctx, host)
 
 	// If generic hub is enabled one is created separately with a set of generic channel handlers associated with.
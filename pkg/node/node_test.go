@@ -19,12 +19,16 @@ import (
 
 	"github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/discovery"
 	"github.com/mudler/edgevpn/pkg/logger"
 	. "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/store"
+	"github.com/mudler/edgevpn/pkg/types"
 )
 
 var _ = Describe("Node", func() {
@@ -40,6 +44,31 @@ var _ = Describe("Node", func() {
 			_, err = New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), l)
 			Expect(err).ToNot(HaveOccurred())
 		})
+
+		It("sets the fixed rendezvous only when asked explicitly", func() {
+			d := discovery.NewDHT()
+			_, err := New(FromBase64(false, true, token, d, nil), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Rendezvous()).ToNot(Equal("fixture"))
+			Expect(d.Diagnosis()).To(BeEmpty())
+
+			d = discovery.NewDHT()
+			_, err = New(WithInsecureFixedRendezvous("fixture"), FromBase64(false, true, token, d, nil), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(d.Rendezvous()).To(Equal("fixture"))
+			Expect(d.Diagnosis()).To(ContainSubstring("INSECURE"))
+		})
+
+		It("caches the private key in the store", func() {
+			s := store.NewMemory()
+			key, err := CachedPrivKey(s)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(key).ToNot(BeEmpty())
+
+			cached, err := CachedPrivKey(s)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cached).To(Equal(key))
+		})
 	})
 
 	Context("Connection", func() {
@@ -84,6 +113,45 @@ var _ = Describe("Node", func() {
 				return s
 			}, 240*time.Second, 1*time.Second).Should(Equal("baz"))
 		})
+
+		It("serves the local ledger while the transport is degraded", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			token := GenerateNewConnectionData(25).Base64()
+			e, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), WithDiscoveryInterval(10*time.Second), l)
+			e.Start(ctx)
+
+			Expect(e.Status().Ledger.Degraded).To(BeTrue())
+
+			ledger, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			ledger.Announce(ctx, 2*time.Second, func() { ledger.Add("foo", map[string]interface{}{"bar": "baz"}) })
+
+			Eventually(func() bool {
+				_, exists := ledger.GetKey("foo", "bar")
+				return exists
+			}, 10*time.Second, 1*time.Second).Should(BeTrue())
+
+			// The transport becomes available once another peer shows up
+			e2, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), WithDiscoveryInterval(10*time.Second), l)
+			e2.Start(ctx)
+			l2, err := e2.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(func() bool {
+				return e.Status().Ledger.Degraded
+			}, 240*time.Second, 1*time.Second).Should(BeFalse())
+
+			Eventually(func() string {
+				var s string
+				v, exists := l2.GetKey("foo", "bar")
+				if exists {
+					v.Unmarshal(&s)
+				}
+				return s
+			}, 240*time.Second, 1*time.Second).Should(Equal("baz"))
+		})
 	})
 
 	Context("connection gater", func() {
@@ -112,4 +180,93 @@ var _ = Describe("Node", func() {
 			Expect(ips).To(ContainElements("1.1.1.1/32", "1.1.1.0/24"))
 		})
 	})
+
+	Context("address factory", func() {
+		It("rewrites the announced addresses", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			lb := multiaddr.StringCast("/ip4/203.0.113.10/tcp/4001")
+			e, _ := New(
+				WithAddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+					return []multiaddr.Multiaddr{lb}
+				}),
+				FromBase64(true, true, token, nil, nil),
+				WithStore(&blockchain.MemoryStore{}),
+				l,
+			)
+
+			e.Start(ctx)
+			Expect(e.Host().Addrs()).To(Equal([]multiaddr.Multiaddr{lb}))
+		})
+	})
+	Context("listen addresses", func() {
+		It("reports the bound and the external addresses", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			lb := multiaddr.StringCast("/ip4/203.0.113.10/tcp/4001")
+			e, _ := New(
+				WithAddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+					return append(addrs, lb)
+				}),
+				FromBase64(true, true, token, nil, nil),
+				WithStore(&blockchain.MemoryStore{}),
+				l,
+			)
+
+			e.Start(ctx)
+			Expect(e.ListenAddresses()).ToNot(BeEmpty())
+			for _, a := range e.ListenAddresses() {
+				Expect(a.String()).ToNot(HaveSuffix("/tcp/0"))
+			}
+
+			Expect(e.Status().Addresses).To(ContainElement(types.ListenAddress{
+				Address: lb.String(), Transport: "tcp", Kind: types.AddressExternal,
+			}))
+			Expect(e.Status().Addresses).To(ContainElement(HaveField("Kind", types.AddressBound)))
+		})
+	})
+	Context("safe mode", func() {
+		It("lifts only the safe mode entered automatically", func() {
+			e, _ := New(FromBase64(false, false, token, nil, nil), l)
+			Expect(e.SafeMode()).To(BeFalse())
+
+			e.EnterSafeMode("conflict")
+			Expect(e.SafeMode()).To(BeTrue())
+			Expect(e.Status().SafeMode.Reason).To(Equal("conflict"))
+			e.ExitSafeMode()
+			Expect(e.SafeMode()).To(BeFalse())
+
+			e.SetSafeMode(true)
+			e.ExitSafeMode()
+			Expect(e.SafeMode()).To(BeTrue())
+			Expect(e.Status().SafeMode.Manual).To(BeTrue())
+			e.SetSafeMode(false)
+			Expect(e.SafeMode()).To(BeFalse())
+		})
+	})
+	Context("discovery canary", func() {
+		It("holds the node in the canary phase until it is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, _ := New(
+				WithDiscoveryCanary(5*time.Second),
+				FromBase64(false, true, token, nil, nil),
+				WithStore(&blockchain.MemoryStore{}),
+				l,
+			)
+			Expect(e.Status().Phase).To(Equal(PhaseStarting))
+
+			go e.Start(ctx)
+
+			Eventually(func() string {
+				return e.Status().Phase
+			}, 5*time.Second, 100*time.Millisecond).Should(Equal(PhaseCanary))
+			Eventually(func() string {
+				return e.Status().Phase
+			}, 30*time.Second, 1*time.Second).Should(Equal(PhaseRunning))
+		})
+	})
 })
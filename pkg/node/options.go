@@ -14,16 +14,25 @@ limitations under the License.
 package node
 
 import (
+	"compress/gzip"
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
+	basichost "github.com/libp2p/go-libp2p/p2p/host/basic"
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	discovery "github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/events"
+	"github.com/mudler/edgevpn/pkg/flow"
 	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/store"
 	"github.com/mudler/edgevpn/pkg/utils"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
@@ -44,6 +53,9 @@ func WithSealer(i Sealer) Option {
 	}
 }
 
+// WithLibp2pAdditionalOptions appends custom libp2p options to the ones
+// set by EdgeVPN when creating the host. See Config.AdditionalOptions
+// for the ordering and override semantics.
 func WithLibp2pAdditionalOptions(i ...libp2p.Option) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.AdditionalOptions = append(cfg.AdditionalOptions, i...)
@@ -126,6 +138,14 @@ var EnableGenericHub = func(cfg *Config) error {
 	return nil
 }
 
+// EnableHolePunching enables hole punching (DCUtR): peers connected
+// through a relay try to upgrade to a direct connection.
+// The outcome of the upgrades is reported in the node Status.
+var EnableHolePunching = func(cfg *Config) error {
+	cfg.HolePunch = true
+	return nil
+}
+
 func ListenAddresses(ss ...string) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		for _, s := range ss {
@@ -196,6 +216,254 @@ func WithPeerGater(d Gater) Option {
 	}
 }
 
+// WithQuarantine sets the quarantine used to block peers
+// which keep sending malformed data
+func WithQuarantine(q *Quarantine) Option {
+	return func(cfg *Config) error {
+		cfg.Quarantine = q
+		return nil
+	}
+}
+
+// WithLedgerAuthorizer sets the authorizer of the ledger
+// blocks received from other peers
+func WithLedgerAuthorizer(a blockchain.WriteAuthorizer) Option {
+	return func(cfg *Config) error {
+		cfg.LedgerAuthorizer = a
+		return nil
+	}
+}
+
+// WithLedgerValidator sets the validator of the values written to the
+// bucket of the ledger: the invalid local writes are rejected, and the
+// invalid values of the blocks received from other peers are dropped
+func WithLedgerValidator(bucket string, v blockchain.Validator) Option {
+	return func(cfg *Config) error {
+		if cfg.LedgerValidators == nil {
+			cfg.LedgerValidators = make(map[string]blockchain.Validator)
+		}
+		cfg.LedgerValidators[bucket] = v
+		return nil
+	}
+}
+
+// WithLedgerHistory sets how many versions of the keys
+// are retained for each bucket of the ledger
+func WithLedgerHistory(depths map[string]int) Option {
+	return func(cfg *Config) error {
+		if cfg.LedgerHistory == nil {
+			cfg.LedgerHistory = make(map[string]int)
+		}
+		for b, d := range depths {
+			cfg.LedgerHistory[b] = d
+		}
+		return nil
+	}
+}
+
+// WithLedgerScope gossips the buckets on the topic of the scope instead of the
+// one joined by all the nodes, so their updates only reach the nodes scoping
+// them the same way. DefaultLedgerScope leaves them on the default topic.
+func WithLedgerScope(scope string, buckets ...string) Option {
+	return func(cfg *Config) error {
+		if scope == "" {
+			return errors.New("the ledger scope can't be empty")
+		}
+		if cfg.LedgerScopes == nil {
+			cfg.LedgerScopes = make(map[string]string)
+		}
+		for _, b := range buckets {
+			if scope == DefaultLedgerScope {
+				delete(cfg.LedgerScopes, b)
+				continue
+			}
+			cfg.LedgerScopes[b] = scope
+		}
+		return nil
+	}
+}
+
+// WithUplinks distributes the outbound TCP connections across the given
+// source addresses, according to their weight
+func WithUplinks(uplinks ...Uplink) Option {
+	return func(cfg *Config) error {
+		cfg.Uplinks = append(cfg.Uplinks, uplinks...)
+		return nil
+	}
+}
+
+// WithSourcePorts makes the outbound TCP connections originate from a local
+// port between min and max included, for egress firewall rules.
+// The other transports don't support it.
+func WithSourcePorts(min, max int) Option {
+	return func(cfg *Config) error {
+		r := PortRange{Min: min, Max: max}
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		cfg.SourcePorts = &r
+		return nil
+	}
+}
+
+// WithTorProxy dials the onion addresses through the SOCKS proxy of a Tor daemon,
+// e.g. 127.0.0.1:9050. When only is set, all the connections go through it,
+// and the transports which can't are disabled.
+func WithTorProxy(addr string, only bool) Option {
+	return func(cfg *Config) error {
+		if addr == "" {
+			if only {
+				return errors.New("a Tor proxy is required to dial only through Tor")
+			}
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.Wrapf(err, "invalid Tor proxy address '%s'", addr)
+		}
+		cfg.TorProxy = addr
+		cfg.TorOnly = only
+		return nil
+	}
+}
+
+// WithOnionAddresses announces the onion addresses of the hidden services
+// forwarding to the node, in the form /onion3/<service id>:<port>. The node
+// listens on the loopback on the port of each, for the services to forward to.
+func WithOnionAddresses(addrs ...string) Option {
+	return func(cfg *Config) error {
+		for _, s := range addrs {
+			a, err := ParseOnionAddress(s)
+			if err != nil {
+				return err
+			}
+			cfg.OnionAddresses = append(cfg.OnionAddresses, a)
+		}
+		return nil
+	}
+}
+
+// WithPinnedKeys pins the public keys the peers must present to connect,
+// each in the form <peer ID>=<base64 public key>
+func WithPinnedKeys(pins ...string) Option {
+	return func(cfg *Config) error {
+		if cfg.PinnedKeys == nil {
+			cfg.PinnedKeys = make(map[peer.ID]crypto.PubKey)
+		}
+		for _, s := range pins {
+			p, k, err := ParsePin(s)
+			if err != nil {
+				return err
+			}
+			cfg.PinnedKeys[p] = k
+		}
+		return nil
+	}
+}
+
+// WithPrivateNetwork makes the DHT discovery run a private DHT, with a
+// protocol prefix derived from the token unless set with
+// WithDiscoveryProtocolPrefix, and refuses the connections of the peers
+// not proving the knowledge of the current OTP rendezvous.
+func WithPrivateNetwork(b bool) Option {
+	return func(cfg *Config) error {
+		cfg.PrivateNetwork = b
+		return nil
+	}
+}
+
+// WithMaxInboundPerIP caps the concurrent inbound connections from each
+// remote IP. The connections over the limit are refused before the security
+// handshake. 0 means no limit.
+func WithMaxInboundPerIP(i int) Option {
+	return func(cfg *Config) error {
+		if i < 0 {
+			return fmt.Errorf("invalid limit of inbound connections per IP: %d", i)
+		}
+		cfg.MaxInboundPerIP = i
+		return nil
+	}
+}
+
+// WithLedgerClearKeys leaves the ledger buckets and keys in cleartext
+// in the exchanged blocks, sealing only the values. All the nodes
+// of the network must agree on it.
+func WithLedgerClearKeys(b bool) Option {
+	return func(cfg *Config) error {
+		cfg.LedgerClearKeys = b
+		return nil
+	}
+}
+
+// WithLedgerBatchWindow coalesces the ledger blocks written within
+// the window into a single message to the other nodes
+func WithLedgerBatchWindow(d time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.LedgerBatchWindow = d
+		return nil
+	}
+}
+
+// WithLedgerCompressionLevel sets the gzip level of the ledger messages,
+// from gzip.HuffmanOnly to gzip.BestCompression
+func WithLedgerCompressionLevel(level int) Option {
+	return func(cfg *Config) error {
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return fmt.Errorf("invalid ledger compression level %d", level)
+		}
+		cfg.LedgerCompressionLevel = level
+		return nil
+	}
+}
+
+// WithShutdownTimeout sets the time budget of the node shutdown,
+// and overrides the budget of single phases
+func WithShutdownTimeout(d time.Duration, phases map[string]time.Duration) Option {
+	return func(cfg *Config) error {
+		if d > 0 {
+			cfg.ShutdownTimeout = d
+		}
+		if cfg.ShutdownPhaseTimeouts == nil {
+			cfg.ShutdownPhaseTimeouts = make(map[string]time.Duration)
+		}
+		for p, t := range phases {
+			cfg.ShutdownPhaseTimeouts[p] = t
+		}
+		return nil
+	}
+}
+
+// WithNetworkName sets the local label of the network the node joins
+func WithNetworkName(name string) Option {
+	return func(cfg *Config) error {
+		cfg.NetworkName = name
+		return nil
+	}
+}
+
+// WithStateStore sets the store persisting the node state across restarts
+func WithStateStore(s store.Store) Option {
+	return func(cfg *Config) error {
+		cfg.StateStore = s
+		return nil
+	}
+}
+
+// WithEventSink sets the sink exporting the node events
+func WithEventSink(s *events.Sink) Option {
+	return func(cfg *Config) error {
+		cfg.EventSink = s
+		return nil
+	}
+}
+
+// WithFlowExporter sets the exporter of the flow logs
+func WithFlowExporter(fe *flow.Exporter) Option {
+	return func(cfg *Config) error {
+		cfg.FlowExporter = fe
+		return nil
+	}
+}
+
 func WithLedgerAnnounceTime(t time.Duration) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.LedgerAnnounceTime = t
@@ -217,6 +485,208 @@ func WithDiscoveryInterval(t time.Duration) func(cfg *Config) error {
 	}
 }
 
+// WithAdaptiveDiscoveryInterval makes the DHT discovery interval adapt to the
+// peer churn: it shrinks down to min while peers connect and disconnect often,
+// and grows up to the discovery interval while the network is stable.
+func WithAdaptiveDiscoveryInterval(min time.Duration) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryMinInterval = min
+		return nil
+	}
+}
+
+// WithDiscoveryMaxPeers caps the peers dialed for each rendezvous on every
+// DHT discovery cycle, picking a random sample when more are found.
+func WithDiscoveryMaxPeers(i int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryMaxPeers = i
+		return nil
+	}
+}
+
+// WithDiscoveryMaxConnections caps the new connections established on
+// every DHT discovery cycle. 0 means no limit.
+func WithDiscoveryMaxConnections(i int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryMaxConnections = i
+		return nil
+	}
+}
+
+// WithDiscoveryDialConcurrency bounds the peers dialed at once by the DHT
+// discovery. 0 keeps dialing the discovered peers one at a time.
+func WithDiscoveryDialConcurrency(i int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryDialConcurrency = i
+		return nil
+	}
+}
+
+// WithDiscoveryLocalPeers makes the DHT discovery stretch its interval by
+// factor while at least threshold peers found with mDNS are connected, and
+// go back to the normal interval when the local mesh shrinks. It requires
+// both the mDNS and the DHT discovery. 0 disables it.
+func WithDiscoveryLocalPeers(threshold, factor int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if threshold < 0 || factor < 0 {
+			return fmt.Errorf("invalid local peers threshold %d or scale factor %d", threshold, factor)
+		}
+		cfg.DiscoveryLocalPeers = threshold
+		cfg.DiscoveryLocalScaleFactor = factor
+		return nil
+	}
+}
+
+// WithDiscoveryProtocolPrefix makes the nodes run a private DHT, with the
+// given protocol prefix instead of the /ipfs one. The public IPFS bootstrap
+// peers are then not used: set them with WithBootstrapPeers.
+func WithDiscoveryProtocolPrefix(prefix string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid DHT protocol prefix '%s', it must start with /", prefix)
+		}
+		cfg.DiscoveryProtocolPrefix = prefix
+		return nil
+	}
+}
+
+// WithDiscoveryBandwidthBudget caps the bytes sent and received on the DHT
+// streams within the window: the DHT discovery cycles are skipped while the
+// budget is exceeded. 0 disables the cap, the bytes are accounted anyway.
+func WithDiscoveryBandwidthBudget(bytes int64, window time.Duration) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if bytes < 0 || window < 0 {
+			return fmt.Errorf("invalid DHT bandwidth budget %d bytes in %s", bytes, window)
+		}
+		cfg.DiscoveryBandwidthBudget = bytes
+		cfg.DiscoveryBandwidthWindow = window
+		return nil
+	}
+}
+
+// WithDiscoveryDiagnoseAfter makes the node warn that the OTP parameters
+// may be misconfigured, after the given number of DHT discovery rounds in
+// a row finding no peer while the DHT is healthy. 0 disables it.
+func WithDiscoveryDiagnoseAfter(rounds int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryDiagnoseAfter = rounds
+		return nil
+	}
+}
+
+// WithDiscoveryOTPWindowTolerance makes the DHT discovery announce and search
+// also on the rendezvous of the n OTP intervals before and after the current
+// one, so nodes whose clocks drift apart still meet. It costs n*2 more
+// announces for each OTP key on every discovery cycle.
+func WithDiscoveryOTPWindowTolerance(n int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if n < 0 {
+			return fmt.Errorf("invalid OTP window tolerance %d", n)
+		}
+		cfg.DiscoveryOTPWindowTolerance = n
+		return nil
+	}
+}
+
+// WithDiscoveryDHTMode sets the mode of the DHT: server, client, or auto to
+// switch between the two as the public reachability of the node changes.
+// Empty keeps the mode of the DHT options.
+func WithDiscoveryDHTMode(mode string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if mode != "" {
+			if _, err := discovery.ParseDHTMode(mode); err != nil {
+				return err
+			}
+		}
+		cfg.DiscoveryDHTMode = mode
+		return nil
+	}
+}
+
+// WithInsecureFixedRendezvous makes the DHT discovery use the given rendezvous
+// instead of the one derived from the OTP keys, so the nodes of multi-node
+// tests meet deterministically. Anyone knowing the rendezvous can find the
+// nodes: it must never be used in production.
+func WithInsecureFixedRendezvous(rv string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryFixedRendezvous = rv
+		return nil
+	}
+}
+
+// WithDiscoveryPeerCache makes the DHT discovery persist the peers met in the
+// state store (see WithStateStore), and dial them on start while bootstrapping
+func WithDiscoveryPeerCache(enabled bool) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryPeerCache = enabled
+		return nil
+	}
+}
+
+// WithDiscoveryDialBackoff sets the initial time the DHT discovery skips
+// peers failing to dial, when the libp2p dial backoff can't be queried
+func WithDiscoveryDialBackoff(t time.Duration) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryDialBackoff = t
+		return nil
+	}
+}
+
+// WithDiscoveryMaxQueries limits the concurrent peer searches on the DHT,
+// across all the rendezvous and the networks joined by the process
+func WithDiscoveryMaxQueries(n int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryMaxQueries = n
+		return nil
+	}
+}
+
+// WithDiscoveryBootstrapPolicy sets what to do when no bootstrap peer is
+// reachable: warn, retry (up to timeout), fallback (to the peers listed at
+// fallbackURL and the rendezvous servers) or fail (after timeout)
+func WithDiscoveryBootstrapPolicy(policy string, timeout time.Duration, fallbackURL string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		switch policy {
+		case "", discovery.BootstrapWarn, discovery.BootstrapRetry, discovery.BootstrapFallback, discovery.BootstrapFail:
+		default:
+			return fmt.Errorf("invalid bootstrap policy '%s'", policy)
+		}
+		cfg.DiscoveryBootstrapPolicy = policy
+		cfg.DiscoveryBootstrapTimeout = timeout
+		cfg.DiscoveryBootstrapFallbackURL = fallbackURL
+		return nil
+	}
+}
+
+// WithDiscoveryCanary makes the node search for at least one peer on the DHT,
+// waiting up to the given timeout, before announcing itself and starting
+// the network services.
+func WithDiscoveryCanary(timeout time.Duration) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryCanaryTimeout = timeout
+		return nil
+	}
+}
+
+// WithDiscoveryRendezvousServers sets the rendezvous servers used by the
+// DHT discovery as fallback, when no peer is found on the DHT
+func WithDiscoveryRendezvousServers(a discovery.AddrList) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryRendezvousServers = a
+		return nil
+	}
+}
+
+// WithDiscoveryProviders adds providers of bootstrap peers to the DHT
+// discovery, e.g. a discovery.DNSProvider. They are asked for the peers
+// on every discovery cycle, along with the configured bootstrap peers.
+func WithDiscoveryProviders(p ...discovery.Provider) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DiscoveryProviders = append(cfg.DiscoveryProviders, p...)
+		return nil
+	}
+}
+
 func WithDiscoveryBootstrapPeers(a discovery.AddrList) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.DiscoveryBootstrapPeers = a
@@ -231,6 +701,16 @@ func WithPrivKey(b []byte) func(cfg *Config) error {
 	}
 }
 
+// WithAddrsFactory sets a function to transform the addresses advertised by the host,
+// e.g. to substitute a load-balancer address or strip private ones.
+// By default addresses are announced unchanged.
+func WithAddrsFactory(f basichost.AddrsFactory) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.AddrsFactory = f
+		return nil
+	}
+}
+
 func WithStaticPeer(ip string, p peer.ID) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		if cfg.PeerTable == nil {
@@ -245,6 +725,8 @@ type OTPConfig struct {
 	Interval int    `yaml:"interval"`
 	Key      string `yaml:"key"`
 	Length   int    `yaml:"length"`
+	// Keys are additional keys accepted during token rotation
+	Keys []string `yaml:"keys,omitempty"`
 }
 
 type OTP struct {
@@ -282,11 +764,37 @@ func (y YAMLConnectionConfig) copy(mdns, dht bool, cfg *Config, d *discovery.DHT
 	}
 
 	d.RefreshDiscoveryTime = cfg.DiscoveryInterval
+	d.AdaptiveRefresh = cfg.DiscoveryMinInterval > 0
+	d.RefreshDiscoveryMinTime = cfg.DiscoveryMinInterval
+	d.MaxPeersPerCycle = cfg.DiscoveryMaxPeers
+	d.MaxConnectionsPerDiscovery = cfg.DiscoveryMaxConnections
+	d.DialConcurrency = cfg.DiscoveryDialConcurrency
+	d.LocalPeersThreshold = cfg.DiscoveryLocalPeers
+	d.LocalScaleFactor = cfg.DiscoveryLocalScaleFactor
+	d.ProtocolPrefix = cfg.DiscoveryProtocolPrefix
+	d.BandwidthBudget = cfg.DiscoveryBandwidthBudget
+	d.BandwidthWindow = cfg.DiscoveryBandwidthWindow
+	d.DiagnoseAfter = cfg.DiscoveryDiagnoseAfter
+	d.OTPWindowTolerance = cfg.DiscoveryOTPWindowTolerance
+	d.DHTMode = cfg.DiscoveryDHTMode
+	d.FixedRendezvous = cfg.DiscoveryFixedRendezvous
+	d.CanaryTimeout = cfg.DiscoveryCanaryTimeout
+	if cfg.DiscoveryDialBackoff > 0 {
+		d.DialBackoff = cfg.DiscoveryDialBackoff
+	}
 	d.OTPInterval = y.OTP.DHT.Interval
 	d.OTPKey = y.OTP.DHT.Key
+	d.OTPKeys = y.OTP.DHT.Keys
 	d.KeyLength = y.OTP.DHT.Length
 	d.RendezvousString = y.Rendezvous
 	d.BootstrapPeers = cfg.DiscoveryBootstrapPeers
+	d.RendezvousServers = cfg.DiscoveryRendezvousServers
+	d.BootstrapPolicy = cfg.DiscoveryBootstrapPolicy
+	d.BootstrapTimeout = cfg.DiscoveryBootstrapTimeout
+	d.BootstrapFallbackURL = cfg.DiscoveryBootstrapFallbackURL
+	if cfg.DiscoveryMaxQueries > 0 {
+		discovery.DefaultFindPeersLimiter.SetLimit(cfg.DiscoveryMaxQueries)
+	}
 
 	m.DiscoveryServiceTag = y.MDNS
 	cfg.ExchangeKey = y.OTP.Crypto.Key
@@ -301,6 +809,7 @@ func (y YAMLConnectionConfig) copy(mdns, dht bool, cfg *Config, d *discovery.DHT
 	}
 	cfg.SealKeyLength = y.OTP.Crypto.Length
 	cfg.MaxMessageSize = y.MaxMessageSize
+	cfg.Connection = &y
 }
 
 const defaultKeyLength = 43
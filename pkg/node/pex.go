@@ -0,0 +1,42 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+// pexNetwork namespaces the peer exchange protocols by network, without
+// disclosing the room
+func pexNetwork(room string) string {
+	h := sha256.Sum256([]byte("edgevpn-pex:" + room))
+	return hex.EncodeToString(h[:8])
+}
+
+// ledgerMember returns true if the peer announced itself in the ledger, as
+// alive or as a user of the services
+func ledgerMember(l *blockchain.Ledger, p peer.ID) bool {
+	for _, bucket := range []string{protocol.HealthCheckKey, protocol.UsersLedgerKey} {
+		if _, found := l.GetKey(bucket, p.String()); found {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/conngater"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// ErrPinMismatch is returned when a peer presents a key different from the pinned one
+var ErrPinMismatch = errors.New("public key does not match the pinned one")
+
+// PinSet maps peers to the public keys they are expected to present
+type PinSet struct {
+	sync.Mutex
+	pins map[peer.ID]crypto.PubKey
+}
+
+// NewPinSet returns an empty PinSet
+func NewPinSet() *PinSet {
+	return &PinSet{pins: make(map[peer.ID]crypto.PubKey)}
+}
+
+// Pin pins the key of the peer, replacing the previous one
+func (s *PinSet) Pin(p peer.ID, key crypto.PubKey) {
+	s.Lock()
+	defer s.Unlock()
+	s.pins[p] = key
+}
+
+// Unpin removes the pin of the peer. It returns false if it was not pinned
+func (s *PinSet) Unpin(p peer.ID) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.pins[p]
+	delete(s.pins, p)
+	return ok
+}
+
+// Check returns ErrPinMismatch if the peer is pinned to a different key.
+// Peers which are not pinned always pass.
+func (s *PinSet) Check(p peer.ID, key crypto.PubKey) error {
+	s.Lock()
+	defer s.Unlock()
+	pinned, ok := s.pins[p]
+	if !ok {
+		return nil
+	}
+	if key == nil || !pinned.Equals(key) {
+		return ErrPinMismatch
+	}
+	return nil
+}
+
+// List returns the pinned keys, sorted by peer
+func (s *PinSet) List() []types.PinnedKey {
+	s.Lock()
+	defer s.Unlock()
+	res := []types.PinnedKey{}
+	for p, k := range s.pins {
+		b, err := crypto.MarshalPublicKey(k)
+		if err != nil {
+			continue
+		}
+		res = append(res, types.PinnedKey{PeerID: p.String(), PublicKey: crypto.ConfigEncodeKey(b)})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].PeerID < res[j].PeerID })
+	return res
+}
+
+// ParsePin parses a pin in the form <peer ID>=<base64 public key>
+func ParsePin(s string) (peer.ID, crypto.PubKey, error) {
+	id, k, found := strings.Cut(s, "=")
+	if !found {
+		return "", nil, fmt.Errorf("invalid pin '%s': expected <peer ID>=<public key>", s)
+	}
+	return DecodePin(id, k)
+}
+
+// DecodePin decodes a peer ID and its base64 encoded public key. The key
+// must be the one the peer ID is derived from.
+func DecodePin(id, key string) (peer.ID, crypto.PubKey, error) {
+	p, err := peer.Decode(id)
+	if err != nil {
+		return "", nil, err
+	}
+	b, err := crypto.ConfigDecodeKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	k, err := crypto.UnmarshalPublicKey(b)
+	if err != nil {
+		return "", nil, err
+	}
+	if keyID, err := peer.IDFromPublicKey(k); err != nil || keyID != p {
+		return "", nil, fmt.Errorf("the public key of the pin is not the one of peer '%s'", p)
+	}
+	return p, k, nil
+}
+
+// nodeGater is the connection gater of the node. Besides the rules of the
+// BasicConnectionGater, it refuses the inbound connections over the limit
+// of their IP when accepted, and the peers presenting a key different
+// from the pinned one once secured.
+type nodeGater struct {
+	*conngater.BasicConnectionGater
+	n *Node
+}
+
+func (g nodeGater) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	if err := g.n.pins.Check(c.RemotePeer(), c.RemotePublicKey()); err != nil {
+		g.n.config.Logger.Warnf("Refusing connection from '%s' (%s): %s", c.RemotePeer(), c.RemoteMultiaddr(), err)
+		return false, 0
+	}
+	return g.BasicConnectionGater.InterceptUpgraded(c)
+}
+
+// Pin pins the key of the peer, closing its connections presenting a different one
+func (e *Node) Pin(p peer.ID, key crypto.PubKey) {
+	e.pins.Pin(p, key)
+	if e.host == nil {
+		return
+	}
+	for _, c := range e.host.Network().ConnsToPeer(p) {
+		if err := e.pins.Check(p, c.RemotePublicKey()); err != nil {
+			e.config.Logger.Warnf("Closing connection to '%s': %s", p, err)
+			c.Close()
+		}
+	}
+}
+
+// Unpin removes the pin of the peer
+func (e *Node) Unpin(p peer.ID) bool {
+	return e.pins.Unpin(p)
+}
+
+// Pinned returns the pinned keys
+func (e *Node) Pinned() []types.PinnedKey {
+	return e.pins.List()
+}
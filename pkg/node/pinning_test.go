@@ -0,0 +1,106 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+)
+
+var _ = Describe("Key pinning", func() {
+	l := Logger(logger.New(log.LevelFatal))
+
+	pin := func(id peer.ID, k crypto.PubKey) string {
+		b, err := crypto.MarshalPublicKey(k)
+		Expect(err).ToNot(HaveOccurred())
+		return id.String() + "=" + crypto.ConfigEncodeKey(b)
+	}
+
+	It("checks the pinned keys", func() {
+		_, pub, err := crypto.GenerateEd25519Key(nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, other, err := crypto.GenerateEd25519Key(nil)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPublicKey(pub)
+		Expect(err).ToNot(HaveOccurred())
+
+		p, k, err := ParsePin(pin(id, pub))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(p).To(Equal(id))
+
+		s := NewPinSet()
+		Expect(s.Check(id, other)).To(Succeed())
+		s.Pin(p, k)
+		Expect(s.Check(id, pub)).To(Succeed())
+		Expect(s.Check(id, other)).To(MatchError(ErrPinMismatch))
+		Expect(s.List()).To(HaveLen(1))
+		Expect(s.Unpin(id)).To(BeTrue())
+		Expect(s.Check(id, other)).To(Succeed())
+
+		_, _, err = ParsePin("foo")
+		Expect(err).To(HaveOccurred())
+
+		// A pin can't bind the peer to a key which is not its own
+		_, _, err = ParsePin(pin(id, other))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("refuses peers presenting a different key", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		matching, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		defer matching.Close()
+		mismatching, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		defer mismatching.Close()
+
+		_, other, err := crypto.GenerateEd25519Key(nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		e, err := New(
+			FromBase64(true, true, GenerateNewConnectionData(25).Base64(), nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			WithPinnedKeys(pin(matching.ID(), matching.Peerstore().PubKey(matching.ID()))),
+			l,
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		e.Pin(mismatching.ID(), other)
+		Expect(e.Pinned()).To(HaveLen(2))
+
+		Expect(e.Host().Connect(ctx, peer.AddrInfo{ID: matching.ID(), Addrs: matching.Addrs()})).To(Succeed())
+		Expect(e.Host().Connect(ctx, peer.AddrInfo{ID: mismatching.ID(), Addrs: mismatching.Addrs()})).ToNot(Succeed())
+		Expect(e.Host().Network().Connectedness(mismatching.ID())).ToNot(Equal(network.Connected))
+
+		// Pinning a different key drops the open connections
+		e.Pin(matching.ID(), other)
+		Eventually(func() network.Connectedness {
+			return e.Host().Network().Connectedness(matching.ID())
+		}, 10*time.Second, 100*time.Millisecond).ShouldNot(Equal(network.Connected))
+	})
+})
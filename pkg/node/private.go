@@ -0,0 +1,339 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	p2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// privateAuthTimeout is the time a peer has to prove
+	// the membership of the private network once connected
+	privateAuthTimeout = 10 * time.Second
+	// privateRefuseTime is the time the connections of
+	// a peer failing to prove the membership are refused for
+	privateRefuseTime = time.Minute
+	// privateRefuseStrikes is the number of peers failing to prove the
+	// membership from the same IP within privateRefuseTime after which
+	// the connections from the IP are refused too, as new peer IDs cost
+	// nothing
+	privateRefuseStrikes = 3
+)
+
+// privateProtocolPrefix derives the protocol prefix of the private DHT from the token
+func privateProtocolPrefix(room, rendezvous string) string {
+	h := sha256.Sum256([]byte("edgevpn-private:" + room + ":" + rendezvous))
+	return "/edgevpn-" + hex.EncodeToString(h[:8])
+}
+
+// setPrivateProtocolPrefix sets the prefix of the private DHT, once all the
+// options are applied, unless one is set
+func setPrivateProtocolPrefix(c *Config) {
+	for _, sd := range c.ServiceDiscovery {
+		if d, ok := sd.(*discovery.DHT); ok && d.ProtocolPrefix == "" && c.DiscoveryProtocolPrefix == "" {
+			d.ProtocolPrefix = privateProtocolPrefix(c.RoomName, d.RendezvousString)
+		}
+	}
+}
+
+// privateAuth tracks the peers which proved the knowledge of the current
+// OTP rendezvous of the DHT, and the ones refused for failing to
+type privateAuth struct {
+	sync.Mutex
+	secrets  func() []string
+	verified map[peer.ID]bool
+	refused  map[peer.ID]time.Time
+	strikes  map[string]*ipStrikes
+	// waiting are closed when the peer is verified or refused
+	waiting map[peer.ID]chan struct{}
+}
+
+// ipStrikes counts the peers refused from an IP until the time set
+type ipStrikes struct {
+	count int
+	until time.Time
+}
+
+func newPrivateAuth(sd []ServiceDiscovery) (*privateAuth, error) {
+	for _, s := range sd {
+		if d, ok := s.(*discovery.DHT); ok {
+			return &privateAuth{
+				secrets:  d.Rendezvouses,
+				verified: make(map[peer.ID]bool),
+				refused:  make(map[peer.ID]time.Time),
+				strikes:  make(map[string]*ipStrikes),
+				waiting:  make(map[peer.ID]chan struct{}),
+			}, nil
+		}
+	}
+	return nil, errors.New("the private network mode requires the DHT discovery")
+}
+
+// privateProof returns the proof of the prover knowing the secret, bound to the verifier
+func privateProof(secret string, prover, verifier peer.ID) []byte {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(prover))
+	m.Write([]byte(verifier))
+	return m.Sum(nil)
+}
+
+func (a *privateAuth) proof(prover, verifier peer.ID) []byte {
+	return privateProof(a.secrets()[0], prover, verifier)
+}
+
+func (a *privateAuth) verify(proof []byte, prover, verifier peer.ID) bool {
+	for _, s := range a.secrets() {
+		if hmac.Equal(proof, privateProof(s, prover, verifier)) {
+			a.Lock()
+			a.verified[prover] = true
+			a.wake(prover)
+			a.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+func (a *privateAuth) isVerified(p peer.ID) bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.verified[p]
+}
+
+// wait returns true once the peer is verified, false if it is refused
+// or the context is done first
+func (a *privateAuth) wait(ctx context.Context, p peer.ID) bool {
+	a.Lock()
+	if a.verified[p] {
+		a.Unlock()
+		return true
+	}
+	w, ok := a.waiting[p]
+	if !ok {
+		w = make(chan struct{})
+		a.waiting[p] = w
+	}
+	a.Unlock()
+
+	select {
+	case <-w:
+		return a.isVerified(p)
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// wake releases the waits on the peer, with the lock held
+func (a *privateAuth) wake(p peer.ID) {
+	if w, ok := a.waiting[p]; ok {
+		close(w)
+		delete(a.waiting, p)
+	}
+}
+
+// refuse refuses the peer, and counts a strike for the IP it connects from
+func (a *privateAuth) refuse(p peer.ID, addr ma.Multiaddr) {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	delete(a.verified, p)
+	a.refused[p] = now.Add(privateRefuseTime)
+	a.wake(p)
+
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return
+	}
+	s, ok := a.strikes[ip]
+	if !ok || now.After(s.until) {
+		s = &ipStrikes{}
+		a.strikes[ip] = s
+	}
+	s.count++
+	s.until = now.Add(privateRefuseTime)
+}
+
+// isRefusedIP returns true if too many peers were refused from the IP
+func (a *privateAuth) isRefusedIP(addr ma.Multiaddr) bool {
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return false
+	}
+	a.Lock()
+	defer a.Unlock()
+	s, ok := a.strikes[ip]
+	if ok && time.Now().After(s.until) {
+		delete(a.strikes, ip)
+		return false
+	}
+	return ok && s.count >= privateRefuseStrikes
+}
+
+func (a *privateAuth) isRefused(p peer.ID) bool {
+	a.Lock()
+	defer a.Unlock()
+	until, ok := a.refused[p]
+	if ok && time.Now().After(until) {
+		delete(a.refused, p)
+		return false
+	}
+	return ok
+}
+
+func (a *privateAuth) forget(p peer.ID) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.verified, p)
+}
+
+// Authenticated returns true if the peer proved the membership
+// of the network, in private network mode
+func (e *Node) Authenticated(p peer.ID) bool {
+	return e.private != nil && e.private.isVerified(p)
+}
+
+// SetStreamHandler sets the handler of the protocol on the host. In private
+// network mode, the streams of a peer are handled only once it proved the
+// membership of the network, and reset if it doesn't within privateAuthTimeout.
+func (e *Node) SetStreamHandler(pid p2pprotocol.ID, h network.StreamHandler) {
+	e.host.SetStreamHandler(pid, e.gated(h))
+}
+
+// gated wraps the handler to wait for the authentication of the peers
+func (e *Node) gated(h network.StreamHandler) network.StreamHandler {
+	if e.private == nil {
+		return h
+	}
+	return func(s network.Stream) {
+		ctx, cancel := context.WithTimeout(context.Background(), privateAuthTimeout)
+		defer cancel()
+		if !e.private.wait(ctx, s.Conn().RemotePeer()) {
+			s.Reset()
+			return
+		}
+		h(s)
+	}
+}
+
+// refusePrivate disconnects a peer failing to prove the membership of the network
+func (e *Node) refusePrivate(c network.Conn, reason string) {
+	p := c.RemotePeer()
+	e.private.refuse(p, c.RemoteMultiaddr())
+	metrics.PrivateRejected.Add(1)
+	e.config.Logger.Debugf("Refusing '%s', not a member of the private network: %s", p, reason)
+	e.host.Network().ClosePeer(p)
+}
+
+// authenticate proves the membership of the network to the peer of a new
+// connection and verifies the one of the peer. The node dialing opens the
+// stream, the other one refuses the peer if it doesn't within privateAuthTimeout.
+func (e *Node) authenticate(c network.Conn) {
+	p := c.RemotePeer()
+	if e.private.isVerified(p) {
+		return
+	}
+
+	if c.Stat().Direction != network.DirOutbound {
+		time.AfterFunc(privateAuthTimeout, func() {
+			if !e.private.isVerified(p) && e.host.Network().Connectedness(p) == network.Connected {
+				e.refusePrivate(c, "no proof received")
+			}
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), privateAuthTimeout)
+	defer cancel()
+	s, err := e.host.NewStream(ctx, p, protocol.PrivateAuthProtocol.ID())
+	if err != nil {
+		e.refusePrivate(c, err.Error())
+		return
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(privateAuthTimeout))
+
+	if _, err := s.Write(e.private.proof(e.host.ID(), p)); err != nil {
+		e.refusePrivate(c, err.Error())
+		return
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(s, proof); err != nil {
+		e.refusePrivate(c, err.Error())
+		return
+	}
+	if !e.private.verify(proof, p, e.host.ID()) {
+		e.refusePrivate(c, "invalid proof")
+	}
+}
+
+// handlePrivateAuth verifies the proof of the peer which dialed the node, and answers with its own
+func (e *Node) handlePrivateAuth(s network.Stream) {
+	defer s.Close()
+	p := s.Conn().RemotePeer()
+	s.SetDeadline(time.Now().Add(privateAuthTimeout))
+
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(s, proof); err != nil {
+		e.refusePrivate(s.Conn(), err.Error())
+		return
+	}
+	if !e.private.verify(proof, p, e.host.ID()) {
+		e.refusePrivate(s.Conn(), "invalid proof")
+		return
+	}
+	s.Write(e.private.proof(e.host.ID(), p))
+}
+
+// privateNotifiee authenticates the peers of the new connections
+func (e *Node) privateNotifiee() network.Notifiee {
+	return &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			go e.authenticate(c)
+		},
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				e.private.forget(c.RemotePeer())
+			}
+		},
+	}
+}
+
+func (g nodeGater) InterceptPeerDial(p peer.ID) bool {
+	if g.n.private != nil && g.n.private.isRefused(p) {
+		return false
+	}
+	return g.BasicConnectionGater.InterceptPeerDial(p)
+}
+
+func (g nodeGater) InterceptSecured(dir network.Direction, p peer.ID, c network.ConnMultiaddrs) bool {
+	if g.n.private != nil && (g.n.private.isRefused(p) || g.n.private.isRefusedIP(c.RemoteMultiaddr())) {
+		return false
+	}
+	return g.BasicConnectionGater.InterceptSecured(dir, p, c)
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	. "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+var _ = Describe("Private network", func() {
+	l := Logger(logger.New(log.LevelFatal))
+
+	start := func(ctx context.Context, token string, d *discovery.DHT, opts ...Option) *Node {
+		e, err := New(append(opts,
+			WithPrivateNetwork(true),
+			FromBase64(false, true, token, d, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			l,
+		)...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		return e
+	}
+
+	connect := func(ctx context.Context, from, to *Node) error {
+		return from.Host().Connect(ctx, peer.AddrInfo{ID: to.Host().ID(), Addrs: to.Host().Addrs()})
+	}
+
+	It("derives the DHT protocol prefix from the token", func() {
+		token := GenerateNewConnectionData(25).Base64()
+		d, other := discovery.NewDHT(), discovery.NewDHT()
+		_, err := New(WithPrivateNetwork(true), FromBase64(false, true, token, d, nil), l)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = New(WithPrivateNetwork(true), FromBase64(false, true, GenerateNewConnectionData(25).Base64(), other, nil), l)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.HasPrefix(d.ProtocolPrefix, "/edgevpn-")).To(BeTrue())
+		Expect(d.ProtocolPrefix).ToNot(Equal(other.ProtocolPrefix))
+
+		_, err = New(WithPrivateNetwork(true), FromBase64(true, false, token, nil, nil), l)
+		Expect(err).To(HaveOccurred())
+
+		// The prefix doesn't depend on the order of the options
+		after := discovery.NewDHT()
+		_, err = New(FromBase64(false, true, token, after, nil), WithPrivateNetwork(true), l)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(after.ProtocolPrefix).To(Equal(d.ProtocolPrefix))
+	})
+
+	It("authenticates the members of the network", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		token := GenerateNewConnectionData(25).Base64()
+		a := start(ctx, token, nil)
+		b := start(ctx, token, nil)
+
+		Expect(connect(ctx, a, b)).To(Succeed())
+		Eventually(func() bool {
+			return a.Authenticated(b.Host().ID()) && b.Authenticated(a.Host().ID())
+		}, 10*time.Second, 100*time.Millisecond).Should(BeTrue())
+		Consistently(func() network.Connectedness {
+			return a.Host().Network().Connectedness(b.Host().ID())
+		}, 2*time.Second, 200*time.Millisecond).Should(Equal(network.Connected))
+	})
+
+	It("refuses the peers of other networks", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a := start(ctx, GenerateNewConnectionData(25).Base64(), nil)
+		other := start(ctx, GenerateNewConnectionData(25).Base64(), nil)
+		rejected := metrics.PrivateRejected.Value()
+
+		Expect(connect(ctx, other, a)).To(Succeed())
+		Eventually(func() network.Connectedness {
+			return a.Host().Network().Connectedness(other.Host().ID())
+		}, 10*time.Second, 100*time.Millisecond).ShouldNot(Equal(network.Connected))
+		Expect(a.Authenticated(other.Host().ID())).To(BeFalse())
+		Expect(metrics.PrivateRejected.Value()).To(BeNumerically(">", rejected))
+
+		// The connections of the refused peer are gated
+		Expect(connect(ctx, other, a)).ToNot(Succeed())
+	})
+
+	It("refuses the peers not speaking the protocol", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a := start(ctx, GenerateNewConnectionData(25).Base64(), nil)
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		defer h.Close()
+
+		Expect(a.Host().Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})).To(Succeed())
+		Eventually(func() network.Connectedness {
+			return a.Host().Network().Connectedness(h.ID())
+		}, 10*time.Second, 100*time.Millisecond).ShouldNot(Equal(network.Connected))
+		Expect(a.Host().Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})).ToNot(Succeed())
+	})
+
+	It("handles the streams of the authenticated peers only", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		echo := protocol.Protocol("/edgevpn/test/echo/0.1")
+		handled := make(chan peer.ID, 10)
+		handler := WithStreamHandler(echo, func(*Node, *blockchain.Ledger) func(network.Stream) {
+			return func(s network.Stream) {
+				handled <- s.Conn().RemotePeer()
+				go io.Copy(s, s)
+			}
+		})
+		token := GenerateNewConnectionData(25).Base64()
+		a := start(ctx, token, nil, handler)
+		b := start(ctx, token, nil)
+
+		Expect(connect(ctx, b, a)).To(Succeed())
+		s, err := b.Host().NewStream(ctx, a.Host().ID(), echo.ID())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = s.Write([]byte("ping"))
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(handled, 10*time.Second).Should(Receive(Equal(b.Host().ID())))
+
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		defer h.Close()
+		Expect(h.Connect(ctx, peer.AddrInfo{ID: a.Host().ID(), Addrs: a.Host().Addrs()})).To(Succeed())
+		s, err = h.NewStream(ctx, a.Host().ID(), echo.ID())
+		Expect(err).ToNot(HaveOccurred())
+		s.Write([]byte("ping"))
+		Consistently(handled, 2*time.Second).ShouldNot(Receive())
+		_, err = io.ReadAll(s)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("refuses the IPs of the peers failing repeatedly", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a := start(ctx, GenerateNewConnectionData(25).Base64(), nil)
+		for i := 0; i < 3; i++ {
+			h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+			Expect(err).ToNot(HaveOccurred())
+			defer h.Close()
+			Expect(a.Host().Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})).To(Succeed())
+			Eventually(func() network.Connectedness {
+				return a.Host().Network().Connectedness(h.ID())
+			}, 10*time.Second, 100*time.Millisecond).ShouldNot(Equal(network.Connected))
+		}
+
+		// A new identity from the same IP is refused as well
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		defer h.Close()
+		h.Connect(ctx, peer.AddrInfo{ID: a.Host().ID(), Addrs: a.Host().Addrs()})
+		Consistently(func() network.Connectedness {
+			return a.Host().Network().Connectedness(h.ID())
+		}, 2*time.Second, 100*time.Millisecond).ShouldNot(Equal(network.Connected))
+	})
+})
@@ -0,0 +1,139 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/types"
+	multiaddr "github.com/multiformats/go-multiaddr"
+)
+
+// Tags used to protect peer connections
+const (
+	ProtectRelay   = "relay"
+	ProtectService = "service"
+	ProtectAPI     = "api"
+)
+
+// protections keeps track of the protected peers. Tags are reference
+// counted, so the same tag can be held by several flows at once
+// (e.g. multiple connections to a service).
+type protections struct {
+	sync.Mutex
+	peers  map[peer.ID]map[string]int
+	relays map[peer.ID]bool
+}
+
+// Protect protects the connections to the peer from being trimmed by the
+// connection manager, until Unprotect is called with the same tag
+func (e *Node) Protect(p peer.ID, tag string) {
+	e.protected.Lock()
+	defer e.protected.Unlock()
+
+	if e.protected.peers == nil {
+		e.protected.peers = make(map[peer.ID]map[string]int)
+	}
+	tags, exists := e.protected.peers[p]
+	if !exists {
+		tags = make(map[string]int)
+		e.protected.peers[p] = tags
+	}
+	tags[tag]++
+	if tags[tag] == 1 && e.host != nil {
+		e.host.ConnManager().Protect(p, tag)
+	}
+}
+
+// Unprotect releases a protection of the peer taken with Protect.
+// It returns true if the peer is still protected by other tags.
+func (e *Node) Unprotect(p peer.ID, tag string) bool {
+	e.protected.Lock()
+	defer e.protected.Unlock()
+
+	tags, exists := e.protected.peers[p]
+	if !exists || tags[tag] == 0 {
+		return exists
+	}
+	tags[tag]--
+	if tags[tag] == 0 {
+		delete(tags, tag)
+		if e.host != nil {
+			e.host.ConnManager().Unprotect(p, tag)
+		}
+	}
+	if len(tags) == 0 {
+		delete(e.protected.peers, p)
+		return false
+	}
+	return true
+}
+
+// Protected returns the peers protected from the connection manager
+func (e *Node) Protected() (list []types.ProtectedPeer) {
+	e.protected.Lock()
+	defer e.protected.Unlock()
+
+	for p, tags := range e.protected.peers {
+		pp := types.ProtectedPeer{PeerID: p.String()}
+		for t := range tags {
+			pp.Tags = append(pp.Tags, t)
+		}
+		sort.Strings(pp.Tags)
+		list = append(list, pp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].PeerID < list[j].PeerID })
+	return
+}
+
+// relayPeers returns the relays the addresses are reachable through
+func relayPeers(addrs []multiaddr.Multiaddr) map[peer.ID]bool {
+	relays := map[peer.ID]bool{}
+	for _, a := range addrs {
+		relay, _ := multiaddr.SplitFunc(a, func(c multiaddr.Component) bool {
+			return c.Protocol().Code == multiaddr.P_CIRCUIT
+		})
+		if relay == nil || relay.Equal(a) {
+			continue
+		}
+		if info, err := peer.AddrInfoFromP2pAddr(relay); err == nil {
+			relays[info.ID] = true
+		}
+	}
+	return relays
+}
+
+// protectRelays protects the relays the node holds reservations with
+// and releases the ones not used anymore
+func (e *Node) protectRelays() {
+	relays := relayPeers(e.host.Addrs())
+
+	e.protected.Lock()
+	previous := e.protected.relays
+	e.protected.relays = relays
+	e.protected.Unlock()
+
+	for p := range relays {
+		if !previous[p] {
+			e.Protect(p, ProtectRelay)
+		}
+	}
+	for p := range previous {
+		if !relays[p] {
+			e.Unprotect(p, ProtectRelay)
+		}
+	}
+}
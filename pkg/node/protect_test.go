@@ -0,0 +1,87 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Connection protection", func() {
+	l := Logger(logger.New(log.LevelFatal))
+
+	newHost := func() host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		return h
+	}
+
+	It("keeps protected peers connected on trim", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		cm, err := connmgr.NewConnManager(1, 2, connmgr.WithGracePeriod(0))
+		Expect(err).ToNot(HaveOccurred())
+
+		e, err := New(
+			FromBase64(true, true, GenerateNewConnectionData(25).Base64(), nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			WithLibp2pAdditionalOptions(libp2p.ConnectionManager(cm)),
+			l,
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+
+		protected, unprotected, other := newHost(), newHost(), newHost()
+		defer protected.Close()
+		defer unprotected.Close()
+		defer other.Close()
+
+		for _, h := range []host.Host{protected, unprotected, other} {
+			Expect(e.Host().Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})).To(Succeed())
+		}
+
+		e.Protect(protected.ID(), ProtectService)
+		e.Protect(protected.ID(), ProtectService)
+		Expect(e.Protected()).To(Equal([]types.ProtectedPeer{{PeerID: protected.ID().String(), Tags: []string{ProtectService}}}))
+
+		Eventually(func() bool {
+			cm.TrimOpenConns(ctx)
+			n := e.Host().Network()
+			// The connection manager keeps low water unprotected connections,
+			// at least one of the unprotected peers gets trimmed
+			return n.Connectedness(unprotected.ID()) != network.Connected || n.Connectedness(other.ID()) != network.Connected
+		}, 10*time.Second, 100*time.Millisecond).Should(BeTrue())
+		Expect(e.Host().Network().Connectedness(protected.ID())).To(Equal(network.Connected))
+
+		// The tag is held twice, the first release keeps the peer protected
+		Expect(e.Unprotect(protected.ID(), ProtectService)).To(BeTrue())
+		Expect(e.Unprotect(protected.ID(), ProtectService)).To(BeFalse())
+		Expect(e.Protected()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,169 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	hub "github.com/mudler/edgevpn/pkg/hub"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// Quarantine keeps track of the protocol violations of peers (e.g. undecryptable
+// or malformed ledger messages) and quarantines the ones exceeding a threshold
+// for a cooldown period.
+// Violations only count within a sliding window, so sporadic errors (for instance
+// messages sealed with a key which just rotated) don't trigger the quarantine,
+// only persistent ones do.
+type Quarantine struct {
+	sync.Mutex
+	threshold        int
+	window, cooldown time.Duration
+
+	violations  map[peer.ID][]time.Time
+	quarantined map[peer.ID]time.Time
+}
+
+// NewQuarantine returns a Quarantine which quarantines peers for cooldown
+// after threshold violations within window.
+func NewQuarantine(threshold int, window, cooldown time.Duration) *Quarantine {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Quarantine{
+		threshold:   threshold,
+		window:      window,
+		cooldown:    cooldown,
+		violations:  make(map[peer.ID][]time.Time),
+		quarantined: make(map[peer.ID]time.Time),
+	}
+}
+
+// Violation records a protocol violation of the peer.
+// It returns true if the peer has just been quarantined.
+func (q *Quarantine) Violation(p peer.ID) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if _, exists := q.quarantined[p]; exists {
+		return false
+	}
+
+	now := time.Now()
+	recent := []time.Time{}
+	for _, t := range q.violations[p] {
+		if now.Sub(t) < q.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) >= q.threshold {
+		delete(q.violations, p)
+		q.quarantined[p] = now.Add(q.cooldown)
+		return true
+	}
+	q.violations[p] = recent
+	return false
+}
+
+// IsQuarantined returns true if the peer is in quarantine
+func (q *Quarantine) IsQuarantined(p peer.ID) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, exists := q.quarantined[p]
+	return exists
+}
+
+// Release removes from the quarantine the peers whose cooldown is over,
+// and returns them.
+func (q *Quarantine) Release() (released []peer.ID) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	for p, until := range q.quarantined {
+		if !now.Before(until) {
+			delete(q.quarantined, p)
+			released = append(released, p)
+		}
+	}
+	return
+}
+
+// List returns the peers currently in quarantine
+func (q *Quarantine) List() []types.QuarantinedPeer {
+	q.Lock()
+	defer q.Unlock()
+	res := []types.QuarantinedPeer{}
+	for p, until := range q.quarantined {
+		res = append(res, types.QuarantinedPeer{
+			PeerID: p.String(),
+			Until:  until.UTC().Format(time.RFC3339),
+		})
+	}
+	return res
+}
+
+// Quarantine returns the node quarantine, if any
+func (e *Node) Quarantine() *Quarantine {
+	return e.config.Quarantine
+}
+
+// ReportViolation records a protocol violation of the peer (e.g. malformed data).
+// If the peer exceeds the quarantine threshold, it is disconnected and
+// blocked by the connection gater until the cooldown is over.
+func (e *Node) ReportViolation(p peer.ID, reason string) {
+	q := e.config.Quarantine
+	if q == nil || e.host == nil || p == e.host.ID() {
+		return
+	}
+
+	e.config.Logger.Debugf("Protocol violation from '%s': %s", p, reason)
+	if !q.Violation(p) {
+		return
+	}
+
+	e.config.Logger.Warnf("Quarantining '%s': too many protocol violations (%s)", p, reason)
+	if err := e.cg.BlockPeer(p); err != nil {
+		e.config.Logger.Warnf("Failed blocking '%s': %s", p, err.Error())
+	}
+	e.host.Network().ClosePeer(p)
+}
+
+// reportAuthor reports a violation of the peer which published the message.
+// Messages are relayed by the other peers, so the sender is not to blame.
+func (e *Node) reportAuthor(m *hub.Message, reason string) {
+	if p, err := peer.Decode(m.AuthorID); err == nil {
+		e.ReportViolation(p, reason)
+	}
+}
+
+func (e *Node) releaseQuarantine(ctx context.Context) {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, p := range e.config.Quarantine.Release() {
+				e.config.Logger.Infof("Releasing '%s' from quarantine", p)
+				e.cg.UnblockPeer(p)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/node"
+)
+
+var _ = Describe("Quarantine", func() {
+	p := peer.ID("foo")
+
+	It("quarantines peers exceeding the threshold", func() {
+		q := NewQuarantine(3, time.Minute, time.Minute)
+		Expect(q.Violation(p)).To(BeFalse())
+		Expect(q.Violation(p)).To(BeFalse())
+		Expect(q.IsQuarantined(p)).To(BeFalse())
+		Expect(q.Violation(p)).To(BeTrue())
+		Expect(q.IsQuarantined(p)).To(BeTrue())
+		Expect(q.List()).To(HaveLen(1))
+		Expect(q.List()[0].PeerID).To(Equal(p.String()))
+	})
+
+	It("ignores transient violations outside the window", func() {
+		q := NewQuarantine(2, 100*time.Millisecond, time.Minute)
+		Expect(q.Violation(p)).To(BeFalse())
+		time.Sleep(200 * time.Millisecond)
+		Expect(q.Violation(p)).To(BeFalse())
+		Expect(q.IsQuarantined(p)).To(BeFalse())
+	})
+
+	It("releases peers after the cooldown", func() {
+		q := NewQuarantine(1, time.Minute, 100*time.Millisecond)
+		Expect(q.Violation(p)).To(BeTrue())
+		Expect(q.Release()).To(BeEmpty())
+		Eventually(q.Release, time.Second, 50*time.Millisecond).Should(ConsistOf(p))
+		Expect(q.IsQuarantined(p)).To(BeFalse())
+		Expect(q.List()).To(BeEmpty())
+	})
+})
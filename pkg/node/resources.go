@@ -0,0 +1,71 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// ResourceUsage returns the usage of the system and transient scopes of the
+// host resource manager, along with their limits
+func (e *Node) ResourceUsage() []types.ResourceUsage {
+	if e.host == nil {
+		return []types.ResourceUsage{}
+	}
+	rm := e.host.Network().ResourceManager()
+
+	res := []types.ResourceUsage{}
+	add := func(name string) func(network.ResourceScope) error {
+		return func(s network.ResourceScope) error {
+			res = append(res, scopeUsage(name, s))
+			return nil
+		}
+	}
+	rm.ViewSystem(add("system"))
+	rm.ViewTransient(add("transient"))
+	return res
+}
+
+func scopeUsage(name string, s network.ResourceScope) types.ResourceUsage {
+	st := s.Stat()
+	u := types.ResourceUsage{
+		Scope: name,
+		Usage: types.Resources{
+			Streams:         st.NumStreamsInbound + st.NumStreamsOutbound,
+			StreamsInbound:  st.NumStreamsInbound,
+			StreamsOutbound: st.NumStreamsOutbound,
+			Conns:           st.NumConnsInbound + st.NumConnsOutbound,
+			ConnsInbound:    st.NumConnsInbound,
+			ConnsOutbound:   st.NumConnsOutbound,
+			FD:              st.NumFD,
+			Memory:          st.Memory,
+		},
+	}
+	if l, ok := s.(rcmgr.ResourceScopeLimiter); ok {
+		limit := l.Limit()
+		u.Limit = &types.Resources{
+			Streams:         limit.GetStreamTotalLimit(),
+			StreamsInbound:  limit.GetStreamLimit(network.DirInbound),
+			StreamsOutbound: limit.GetStreamLimit(network.DirOutbound),
+			Conns:           limit.GetConnTotalLimit(),
+			ConnsInbound:    limit.GetConnLimit(network.DirInbound),
+			ConnsOutbound:   limit.GetConnLimit(network.DirOutbound),
+			FD:              limit.GetFDLimit(),
+			Memory:          limit.GetMemoryLimit(),
+		}
+	}
+	return u
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// EnterSafeMode stops the node from forwarding VPN traffic, while keeping
+// the control plane (ledger, discovery) running. It is used when the node
+// detects a misconfiguration which could cause routing loops or leaks.
+// It does not override a safe mode set manually.
+func (e *Node) EnterSafeMode(reason string) {
+	e.Lock()
+	defer e.Unlock()
+	if e.safeMode.Enabled {
+		return
+	}
+	e.config.Logger.Warnf("Entering safe mode, VPN traffic won't be forwarded: %s", reason)
+	e.safeMode = types.SafeMode{Enabled: true, Reason: reason, Since: time.Now().UTC().Format(time.RFC3339)}
+}
+
+// ExitSafeMode lifts a safe mode entered automatically
+func (e *Node) ExitSafeMode() {
+	e.Lock()
+	defer e.Unlock()
+	if !e.safeMode.Enabled || e.safeMode.Manual {
+		return
+	}
+	e.config.Logger.Info("Exiting safe mode:", e.safeMode.Reason, "was resolved")
+	e.safeMode = types.SafeMode{}
+}
+
+// SetSafeMode toggles safe mode manually. A manual safe mode
+// is lifted only manually.
+func (e *Node) SetSafeMode(enabled bool) {
+	e.Lock()
+	defer e.Unlock()
+	if !enabled {
+		e.safeMode = types.SafeMode{}
+		return
+	}
+	e.safeMode = types.SafeMode{Enabled: true, Manual: true, Reason: "enabled manually", Since: time.Now().UTC().Format(time.RFC3339)}
+}
+
+// SetInterfaceStatus records the state of the VPN interface
+func (e *Node) SetInterfaceStatus(s types.InterfaceStatus) {
+	e.Lock()
+	defer e.Unlock()
+	s.Since = time.Now().UTC().Format(time.RFC3339)
+	e.iface = s
+}
+
+// InterfaceStatus returns the status of the VPN interface of the node
+func (e *Node) InterfaceStatus() types.InterfaceStatus {
+	e.Lock()
+	defer e.Unlock()
+	return e.iface
+}
+
+// SafeMode returns true if the node must not forward VPN traffic
+func (e *Node) SafeMode() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.safeMode.Enabled
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	hub "github.com/mudler/edgevpn/pkg/hub"
+)
+
+// DefaultLedgerScope is the scope of the buckets which are not scoped,
+// gossiped on the ledger topic joined by all the nodes
+const DefaultLedgerScope = "everyone"
+
+// ledgerScope is the ledger of the buckets gossiped on the topic of a scope
+type ledgerScope struct {
+	ledger *blockchain.Ledger
+	input  chan *hub.Message
+}
+
+// scopeLedger moves the scoped buckets to the ledgers of their scope,
+// with the node locked
+func (e *Node) scopeLedger() error {
+	for bucket, name := range e.config.LedgerScopes {
+		s, exists := e.scopes[name]
+		if !exists {
+			input := make(chan *hub.Message, defaultChanSize)
+			l := blockchain.New(&messageWriter{c: e.config, input: input, mess: &hub.Message{}}, &blockchain.MemoryStore{})
+			if err := e.configureLedger(l); err != nil {
+				return err
+			}
+			s = &ledgerScope{ledger: l, input: input}
+			e.scopes[name] = s
+		}
+		e.ledger.SetScope(bucket, s.ledger)
+	}
+	return nil
+}
+
+// startScopes joins the topics of the scopes, and syncronizes their ledgers
+func (e *Node) startScopes(ctx context.Context) {
+	for name, s := range e.scopes {
+		name := name
+		s.ledger.SetAuthor(e.host.ID().String())
+		s.ledger.SetSigner(e.signEntries)
+		publish := func(m *hub.Message) error {
+			return e.MessageHub.PublishScopeMessage(name, m)
+		}
+		go e.handleEvents(ctx, s.input, e.MessageHub.Scope(name), publish, []Handler{s.ledger.Update}, true)
+		s.ledger.Syncronizer(ctx, e.config.LedgerSyncronizationTime)
+	}
+}
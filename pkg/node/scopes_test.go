@@ -0,0 +1,88 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+)
+
+var _ = Describe("Ledger scopes", func() {
+	l := Logger(logger.New(log.LevelFatal))
+
+	It("validates the scopes", func() {
+		_, err := New(WithLedgerScope("", "jobs"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("gossips the scoped buckets only to the nodes in the scope", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		token := GenerateNewConnectionData(25).Base64()
+		start := func(o ...Option) (*Node, *blockchain.Ledger) {
+			e, err := New(append([]Option{
+				FromBase64(false, false, token, nil, nil),
+				WithStore(&blockchain.MemoryStore{}),
+				ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+				l,
+			}, o...)...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.Start(ctx)).To(Succeed())
+			ledger, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			return e, ledger
+		}
+
+		worker, workerLedger := start(WithLedgerScope("workers", "jobs"))
+		other, otherLedger := start(WithLedgerScope("workers", "jobs"), WithLedgerScope(DefaultLedgerScope, "services"))
+		outsider, outsiderLedger := start()
+		for _, p := range [][]*Node{{worker, other}, {worker, outsider}, {other, outsider}} {
+			Expect(p[0].Host().Connect(ctx, peer.AddrInfo{ID: p[1].Host().ID(), Addrs: p[1].Host().Addrs()})).To(Succeed())
+		}
+
+		workerLedger.Announce(ctx, time.Second, func() {
+			workerLedger.Add("jobs", map[string]interface{}{"build": "queued"})
+			workerLedger.Add("services", map[string]interface{}{"web": "up"})
+		})
+
+		get := func(ledger *blockchain.Ledger, bucket, key string) func() string {
+			return func() string {
+				var s string
+				if v, exists := ledger.GetKey(bucket, key); exists {
+					v.Unmarshal(&s)
+				}
+				return s
+			}
+		}
+
+		Eventually(get(otherLedger, "jobs", "build"), 60*time.Second, time.Second).Should(Equal("queued"))
+		Eventually(get(outsiderLedger, "services", "web"), 60*time.Second, time.Second).Should(Equal("up"))
+		Eventually(get(otherLedger, "services", "web"), 60*time.Second, time.Second).Should(Equal("up"))
+		Expect(otherLedger.CurrentData()).To(HaveKey("jobs"))
+
+		Consistently(func() map[string]map[string]blockchain.Data {
+			return outsiderLedger.CurrentData()
+		}, 5*time.Second, time.Second).ShouldNot(HaveKey("jobs"))
+	})
+})
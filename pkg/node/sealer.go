@@ -0,0 +1,99 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+)
+
+// ValuesSealer seals only the values of the ledger blocks, leaving the
+// buckets and keys in cleartext so the exchanged blocks stay readable.
+// Any other message is sealed as a whole by the wrapped Sealer.
+// All the nodes of the network must agree on it: the nodes sealing the
+// whole blocks can't read the blocks sealed by a ValuesSealer.
+type ValuesSealer struct {
+	Sealer Sealer
+}
+
+// sealedBlock marks a block whose values only are sealed
+type sealedBlock struct {
+	SealedValues *blockchain.Block `json:"sealed_values"`
+	// Compressed is set if the block was gzip compressed, as the ledger
+	// sends them, so it is compressed again once unsealed
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+func (s *ValuesSealer) Seal(message, key string) (string, error) {
+	dat, compressed := []byte(message), false
+	if gz, err := gzip.NewReader(bytes.NewReader(dat)); err == nil {
+		if dat, err = io.ReadAll(gz); err != nil {
+			return s.Sealer.Seal(message, key)
+		}
+		compressed = true
+	}
+
+	b := &blockchain.Block{}
+	if err := json.Unmarshal(dat, b); err != nil || b.Hash == "" || b.Storage == nil {
+		return s.Sealer.Seal(message, key)
+	}
+
+	if err := s.apply(b, key, s.Sealer.Seal); err != nil {
+		return "", err
+	}
+	dat, err := json.Marshal(sealedBlock{SealedValues: b, Compressed: compressed})
+	return string(dat), err
+}
+
+func (s *ValuesSealer) Unseal(message, key string) (string, error) {
+	sb := sealedBlock{}
+	if err := json.Unmarshal([]byte(message), &sb); err != nil || sb.SealedValues == nil {
+		return s.Sealer.Unseal(message, key)
+	}
+
+	if err := s.apply(sb.SealedValues, key, s.Sealer.Unseal); err != nil {
+		return "", err
+	}
+	dat, err := json.Marshal(sb.SealedValues)
+	if err != nil || !sb.Compressed {
+		return string(dat), err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(dat); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (s *ValuesSealer) apply(b *blockchain.Block, key string, f func(string, string) (string, error)) error {
+	for bucket, data := range b.Storage {
+		for k, v := range data {
+			res, err := f(string(v), key)
+			if err != nil {
+				return err
+			}
+			b.Storage[bucket][k] = blockchain.Data(res)
+		}
+	}
+	return nil
+}
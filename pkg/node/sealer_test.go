@@ -0,0 +1,115 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/crypto"
+	"github.com/mudler/edgevpn/pkg/hub"
+	. "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/utils"
+)
+
+var _ = Describe("Ledger sealing", func() {
+	key := utils.RandStringRunes(32)
+
+	block := func() string {
+		b := blockchain.Block{}.NewBlock(map[string]map[string]blockchain.Data{
+			"services": {"secret-service": blockchain.Data(`{"PeerID":"sensitive-peer"}`)},
+		})
+		dat, err := json.Marshal(b)
+		Expect(err).ToNot(HaveOccurred())
+		return string(dat)
+	}
+
+	It("seals the whole blocks by default", func() {
+		s := &crypto.AESSealer{}
+		msg := block()
+
+		sealed, err := s.Seal(msg, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sealed).ToNot(ContainSubstring("secret-service"))
+		Expect(sealed).ToNot(ContainSubstring("sensitive-peer"))
+
+		unsealed, err := s.Unseal(sealed, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unsealed).To(Equal(msg))
+	})
+
+	It("seals only the values of the blocks with clear keys", func() {
+		s := &ValuesSealer{Sealer: &crypto.AESSealer{}}
+		msg := block()
+
+		sealed, err := s.Seal(msg, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sealed).To(ContainSubstring("services"))
+		Expect(sealed).To(ContainSubstring("secret-service"))
+		Expect(sealed).ToNot(ContainSubstring("sensitive-peer"))
+
+		unsealed, err := s.Unseal(sealed, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unsealed).To(MatchJSON(msg))
+
+		b := blockchain.Block{}
+		Expect(json.Unmarshal([]byte(unsealed), &b)).To(Succeed())
+		Expect(b.Checksum()).To(Equal(b.Hash))
+
+		_, err = s.Unseal(sealed, utils.RandStringRunes(32))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("seals the other messages as a whole with clear keys", func() {
+		s := &ValuesSealer{Sealer: &crypto.AESSealer{}}
+
+		sealed, err := s.Seal("sensitive-message", key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sealed).ToNot(ContainSubstring("sensitive-message"))
+
+		unsealed, err := s.Unseal(sealed, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unsealed).To(Equal("sensitive-message"))
+	})
+
+	It("seals the values of the blocks sent by the ledger", func() {
+		s := &ValuesSealer{Sealer: &crypto.AESSealer{}}
+
+		// The messages of the ledger are gzip compressed
+		var w bytes.Buffer
+		l := blockchain.New(&w, &blockchain.MemoryStore{})
+		l.Add("services", map[string]interface{}{"secret-service": "sensitive-peer"})
+
+		sealed, err := s.Seal(w.String(), key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sealed).To(ContainSubstring("sealed_values"))
+		Expect(sealed).To(ContainSubstring("secret-service"))
+		Expect(sealed).ToNot(ContainSubstring("sensitive-peer"))
+
+		unsealed, err := s.Unseal(sealed, key)
+		Expect(err).ToNot(HaveOccurred())
+
+		other := blockchain.New(&bytes.Buffer{}, &blockchain.MemoryStore{})
+		Expect(other.Update(other, &hub.Message{Message: unsealed}, nil)).To(Succeed())
+		v, exists := other.GetKey("services", "secret-service")
+		Expect(exists).To(BeTrue())
+		var peer string
+		Expect(v.Unmarshal(&peer)).To(Succeed())
+		Expect(peer).To(Equal("sensitive-peer"))
+	})
+})
@@ -0,0 +1,249 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/network"
+	p2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Shutdown phases of the node. ShutdownVPN is registered by the VPN, the
+// others run after the ones registered with OnShutdown.
+const (
+	ShutdownVPN       = "vpn"
+	ShutdownServices  = "services"
+	ShutdownDiscovery = "discovery"
+	ShutdownHost      = "host"
+)
+
+// drainInterval is the time between the checks of the streams left open
+const drainInterval = 100 * time.Millisecond
+
+// ShutdownPhase is a step of the shutdown of the node. Run must return
+// when the context is done; Force, when set, is called if it doesn't
+// complete within the phase budget.
+type ShutdownPhase struct {
+	Name  string
+	Run   func(ctx context.Context) error
+	Force func()
+}
+
+// RunShutdown runs the phases in order within the timeout budget. Phases with
+// an override get that time, the others share what is left of the budget.
+// It returns the names of the phases which exceeded their budget: the ones
+// with a Force action are force-closed, the others are left running.
+func RunShutdown(l log.StandardLogger, timeout time.Duration, overrides map[string]time.Duration, phases ...ShutdownPhase) []string {
+	deadline := time.Now().Add(timeout)
+	forced := []string{}
+	for i, p := range phases {
+		budget, ok := overrides[p.Name]
+		if !ok {
+			budget = phaseBudget(deadline, overrides, phases[i:])
+		}
+
+		err := runPhase(p, budget)
+		switch {
+		case err == context.DeadlineExceeded && p.Force != nil:
+			p.Force()
+			l.Warnf("Force-closed shutdown phase '%s' after %s", p.Name, budget)
+			forced = append(forced, p.Name)
+		case err == context.DeadlineExceeded:
+			l.Warnf("Shutdown phase '%s' exceeded %s, leaving it running", p.Name, budget)
+			forced = append(forced, p.Name)
+		case err != nil:
+			l.Warnf("Shutdown phase '%s': %s", p.Name, err.Error())
+		}
+	}
+	return forced
+}
+
+// phaseBudget shares the budget left among the phases without override
+func phaseBudget(deadline time.Time, overrides map[string]time.Duration, phases []ShutdownPhase) time.Duration {
+	left := time.Until(deadline)
+	shared := 0
+	for _, p := range phases {
+		if d, ok := overrides[p.Name]; ok {
+			left -= d
+		} else {
+			shared++
+		}
+	}
+	if left <= 0 || shared == 0 {
+		return 0
+	}
+	return left / time.Duration(shared)
+}
+
+func runPhase(p ShutdownPhase, budget time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- p.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return context.DeadlineExceeded
+	}
+}
+
+// OnShutdown registers a phase run when the node is shut down,
+// before stopping the network services
+func (e *Node) OnShutdown(name string, run func(ctx context.Context) error) {
+	e.AddShutdownPhase(ShutdownPhase{Name: name, Run: run})
+}
+
+// AddShutdownPhase registers a phase run when the node is shut down,
+// before stopping the network services
+func (e *Node) AddShutdownPhase(p ShutdownPhase) {
+	e.Lock()
+	defer e.Unlock()
+	e.shutdownPhases = append(e.shutdownPhases, p)
+}
+
+// DrainStreams waits until the streams of the protocols are closed,
+// or the context is done
+func (e *Node) DrainStreams(ctx context.Context, protocols ...p2pprotocol.ID) error {
+	t := time.NewTicker(drainInterval)
+	defer t.Stop()
+	for len(e.streams(protocols...)) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// ResetStreams resets the streams of the protocols
+func (e *Node) ResetStreams(protocols ...p2pprotocol.ID) {
+	for _, s := range e.streams(protocols...) {
+		s.Reset()
+	}
+}
+
+// streams returns the open streams of the protocols
+func (e *Node) streams(protocols ...p2pprotocol.ID) []network.Stream {
+	if e.host == nil {
+		return nil
+	}
+	res := []network.Stream{}
+	for _, c := range e.host.Network().Conns() {
+		for _, s := range c.GetStreams() {
+			if slices.Contains(protocols, s.Protocol()) {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+// closeConns closes the connections of the host
+func (e *Node) closeConns() {
+	if e.host == nil {
+		return
+	}
+	for _, c := range e.host.Network().Conns() {
+		c.Close()
+	}
+}
+
+// Shutdown stops the node within the configured shutdown timeout, running the
+// phases registered with OnShutdown, then stopping the network services,
+// the discovery and the host. It returns the phases which exceeded their budget.
+func (e *Node) Shutdown() []string {
+	e.Lock()
+	phases := append([]ShutdownPhase{}, e.shutdownPhases...)
+	cancel := e.cancel
+	e.Unlock()
+	if cancel == nil {
+		cancel = func() {}
+	}
+
+	// The streams of the services are drained before they are stopped
+	served := []p2pprotocol.ID{}
+	for p := range e.config.StreamHandlers {
+		served = append(served, p.ID())
+	}
+
+	phases = append(phases,
+		ShutdownPhase{
+			Name: ShutdownServices,
+			Run: func(ctx context.Context) error {
+				defer cancel()
+				if e.host != nil {
+					for _, p := range served {
+						e.host.RemoveStreamHandler(p)
+					}
+				}
+				return e.DrainStreams(ctx, served...)
+			},
+			Force: func() {
+				e.ResetStreams(served...)
+				cancel()
+			},
+		},
+		ShutdownPhase{
+			Name: ShutdownDiscovery,
+			Run: func(ctx context.Context) error {
+				for _, sd := range e.config.ServiceDiscovery {
+					if c, ok := sd.(io.Closer); ok {
+						if err := c.Close(); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			},
+			// The queries of the discovery in flight fail once disconnected
+			Force: e.closeConns,
+		},
+		ShutdownPhase{
+			Name: ShutdownHost,
+			Run: func(ctx context.Context) error {
+				if e.host == nil {
+					return nil
+				}
+				return e.host.Close()
+			},
+			// Release the listeners and the connections even if
+			// the other services of the host don't stop
+			Force: func() {
+				if e.host != nil {
+					e.host.Network().Close()
+				}
+			},
+		},
+	)
+
+	e.config.Logger.Infof("Shutting down (timeout %s)", e.config.ShutdownTimeout)
+	return RunShutdown(e.config.Logger, e.config.ShutdownTimeout, e.config.ShutdownPhaseTimeouts, phases...)
+}
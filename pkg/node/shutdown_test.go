@@ -0,0 +1,130 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/discovery"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+var _ = Describe("Shutdown", func() {
+	l := logger.New(log.LevelFatal)
+
+	stuck := func(ctx context.Context) error {
+		select {}
+	}
+	quick := func(ctx context.Context) error { return nil }
+
+	It("force-closes the phases exceeding their budget", func() {
+		forced := false
+		ran, deadline := false, false
+		start := time.Now()
+
+		res := RunShutdown(l, 300*time.Millisecond, nil,
+			ShutdownPhase{Name: "stuck", Run: stuck, Force: func() { forced = true }},
+			ShutdownPhase{Name: "last", Run: func(ctx context.Context) error {
+				ran = true
+				_, deadline = ctx.Deadline()
+				return nil
+			}},
+		)
+
+		Expect(res).To(Equal([]string{"stuck"}))
+		Expect(forced).To(BeTrue())
+		Expect(ran).To(BeTrue())
+		Expect(deadline).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", 300*time.Millisecond))
+	})
+
+	It("leaves running the phases without a force action", func() {
+		res := RunShutdown(l, 100*time.Millisecond, nil, ShutdownPhase{Name: "stuck", Run: stuck})
+		Expect(res).To(Equal([]string{"stuck"}))
+	})
+
+	It("applies the per-phase overrides", func() {
+		start := time.Now()
+		res := RunShutdown(l, time.Minute, map[string]time.Duration{"stuck": 50 * time.Millisecond},
+			ShutdownPhase{Name: "quick", Run: quick},
+			ShutdownPhase{Name: "stuck", Run: stuck},
+		)
+		Expect(res).To(Equal([]string{"stuck"}))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("shuts down the node within the timeout", func() {
+		token := GenerateNewConnectionData(25).Base64()
+		e, err := New(
+			FromBase64(false, false, token, discovery.NewDHT(), nil),
+			WithStore(&blockchain.MemoryStore{}),
+			WithShutdownTimeout(time.Second, map[string]time.Duration{"stuck": 100 * time.Millisecond}),
+			Logger(l),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(context.Background())).To(Succeed())
+
+		e.OnShutdown("stuck", stuck)
+		Expect(e.Shutdown()).To(Equal([]string{"stuck"}))
+		Expect(e.Host().Network().ListenAddresses()).To(BeEmpty())
+	})
+
+	It("drains the streams of the services", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		echo := protocol.Protocol("/edgevpn/test/echo/0.1")
+		token := GenerateNewConnectionData(25).Base64()
+		e, err := New(
+			FromBase64(false, false, token, nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			WithStreamHandler(echo, func(*Node, *blockchain.Ledger) func(network.Stream) {
+				return func(s network.Stream) { go io.Copy(s, s) }
+			}),
+			WithShutdownTimeout(time.Minute, map[string]time.Duration{ShutdownServices: 300 * time.Millisecond}),
+			Logger(l),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		e2, err := New(FromBase64(false, false, token, nil, nil), WithStore(&blockchain.MemoryStore{}), ListenAddresses("/ip4/127.0.0.1/tcp/0"), Logger(l))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e2.Start(ctx)).To(Succeed())
+
+		Expect(e2.Host().Connect(ctx, peer.AddrInfo{ID: e.Host().ID(), Addrs: e.Host().Addrs()})).To(Succeed())
+		s, err := e2.Host().NewStream(ctx, e.Host().ID(), echo.ID())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = s.Write([]byte("ping"))
+		Expect(err).ToNot(HaveOccurred())
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(s, buf)
+		Expect(err).ToNot(HaveOccurred())
+
+		// The open stream holds the services phase until it is reset
+		Expect(e.Shutdown()).To(Equal([]string{ShutdownServices}))
+		_, err = io.ReadAll(s)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,288 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/store"
+	"gopkg.in/yaml.v2"
+)
+
+// Entries of the snapshot archive
+const (
+	snapshotNetwork  = "network.yaml"
+	snapshotLedger   = "ledger.json"
+	snapshotIdentity = "identity"
+	// snapshotState is the directory of the state store, with a
+	// directory per namespace and the root namespace at its root
+	snapshotState = "state"
+)
+
+// Snapshot is the portable state of a node
+type Snapshot struct {
+	// Connection is the network configuration (token) of the node
+	Connection *YAMLConnectionConfig
+	// Ledger is the last block of the ledger
+	Ledger *blockchain.Block
+	// PrivateKey is the identity of the node, empty unless it was requested
+	PrivateKey []byte
+	// State is the content of the state store (see WithStateStore),
+	// by namespace and key
+	State map[string]map[string][]byte
+}
+
+// SnapshotOption is an option of Node.Snapshot
+type SnapshotOption func(*snapshotOptions)
+
+type snapshotOptions struct {
+	identity bool
+}
+
+// WithSnapshotIdentity includes the identity of the node in the snapshot.
+// Nodes restored from a snapshot with the identity share the same peer ID,
+// so it must be restored on a single device.
+func WithSnapshotIdentity(o *snapshotOptions) {
+	o.identity = true
+}
+
+// Snapshot writes the state of the node to w, as a gzipped tar archive
+// with the network configuration, the ledger and the content of the state
+// store, such as the peer cache and the persisted metrics. The identity
+// is left out, unless WithSnapshotIdentity is given.
+func (e *Node) Snapshot(w io.Writer, opts ...SnapshotOption) error {
+	o := &snapshotOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ledger, err := e.Ledger()
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	add := func(name string, dat []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(dat)),
+			ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(dat)
+		return err
+	}
+
+	if e.config.Connection != nil {
+		if err := add(snapshotNetwork, []byte(e.config.Connection.YAML())); err != nil {
+			return err
+		}
+	}
+
+	block, err := json.Marshal(ledger.LastBlock())
+	if err != nil {
+		return err
+	}
+	if err := add(snapshotLedger, block); err != nil {
+		return err
+	}
+
+	if err := e.snapshotState(add); err != nil {
+		return err
+	}
+
+	if o.identity {
+		key, err := e.privKey()
+		if err != nil {
+			return err
+		}
+		if err := add(snapshotIdentity, key); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// snapshotState adds the keys of the state store to the archive, but
+// the cached identity
+func (e *Node) snapshotState(add func(string, []byte) error) error {
+	s := e.config.StateStore
+	if s == nil {
+		return nil
+	}
+	namespaces, err := s.Namespaces()
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		keys, err := s.List(ns)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if ns == "" && k == PrivKeyName {
+				continue
+			}
+			dat, err := s.Get(ns, k)
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := add(path.Join(snapshotState, ns, k), dat); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// privKey returns the marshalled private key of the node
+func (e *Node) privKey() ([]byte, error) {
+	if e.host != nil {
+		if k := e.host.Peerstore().PrivKey(e.host.ID()); k != nil {
+			return crypto.MarshalPrivateKey(k)
+		}
+	}
+	if len(e.config.PrivateKey) > 0 {
+		return e.config.PrivateKey, nil
+	}
+	return nil, fmt.Errorf("the node has no identity yet")
+}
+
+// ReadSnapshot reads a snapshot written by Node.Snapshot
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	s := &Snapshot{}
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		dat, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case strings.HasPrefix(h.Name, snapshotState+"/"):
+			ns, k := path.Split(strings.TrimPrefix(h.Name, snapshotState+"/"))
+			ns = strings.TrimSuffix(ns, "/")
+			if s.State == nil {
+				s.State = map[string]map[string][]byte{}
+			}
+			if _, exists := s.State[ns]; !exists {
+				s.State[ns] = map[string][]byte{}
+			}
+			s.State[ns][k] = dat
+		case h.Name == snapshotNetwork:
+			s.Connection = &YAMLConnectionConfig{}
+			if err := yaml.Unmarshal(dat, s.Connection); err != nil {
+				return nil, fmt.Errorf("invalid network configuration in snapshot: %w", err)
+			}
+		case h.Name == snapshotLedger:
+			s.Ledger = &blockchain.Block{}
+			if err := json.Unmarshal(dat, s.Ledger); err != nil {
+				return nil, fmt.Errorf("invalid ledger in snapshot: %w", err)
+			}
+		case h.Name == snapshotIdentity:
+			if _, err := crypto.UnmarshalPrivateKey(dat); err != nil {
+				return nil, fmt.Errorf("invalid identity in snapshot: %w", err)
+			}
+			s.PrivateKey = dat
+		}
+	}
+	return s, nil
+}
+
+// RestoreNode returns a new node with the state of the snapshot read from r.
+// The keys of the state store are restored in the state store of the node
+// (see WithStateStore), keeping the ones it already holds, and the ledger
+// is restored in the store of the node (see WithStore) unless it already
+// holds a newer one. Without the identity in the snapshot, a new one is
+// generated as usual (or taken from opts). The network configuration of
+// the snapshot is applied after opts, with both mDNS and DHT discovery.
+func RestoreNode(r io.Reader, opts ...Option) (*Node, error) {
+	s, err := ReadSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(s.PrivateKey) > 0 {
+		opts = append([]Option{WithPrivKey(s.PrivateKey)}, opts...)
+	}
+	if s.Connection != nil {
+		opts = append(opts, FromBase64(true, true, s.Connection.Base64(), nil, nil))
+	}
+
+	n, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.restoreState(s.State); err != nil {
+		return nil, err
+	}
+	if s.Ledger != nil && n.config.Store.Len() < s.Ledger.Index {
+		n.config.Store.Add(*s.Ledger)
+	}
+	return n, nil
+}
+
+// restoreState puts the keys in the state store, but the ones it already holds
+func (e *Node) restoreState(state map[string]map[string][]byte) error {
+	for ns, keys := range state {
+		for k, v := range keys {
+			_, err := e.config.StateStore.Get(ns, k)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, store.ErrNotFound) {
+				return err
+			}
+			if err := e.config.StateStore.Put(ns, k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"bytes"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/store"
+)
+
+var _ = Describe("Snapshot", func() {
+	l := Logger(logger.New(log.LevelFatal))
+
+	newNode := func(conn *YAMLConnectionConfig, opts ...Option) *Node {
+		k, err := GenPrivKey(0)
+		Expect(err).ToNot(HaveOccurred())
+		key, err := crypto.MarshalPrivateKey(k)
+		Expect(err).ToNot(HaveOccurred())
+
+		e, err := New(append([]Option{FromBase64(true, true, conn.Base64(), nil, nil), WithStore(&blockchain.MemoryStore{}), WithPrivKey(key), l}, opts...)...)
+		Expect(err).ToNot(HaveOccurred())
+		ledger, err := e.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+		ledger.Add("foo", map[string]interface{}{"bar": "baz"})
+		return e
+	}
+
+	It("restores the ledger and the network without the identity", func() {
+		conn := GenerateNewConnectionData(25)
+		e := newNode(conn)
+
+		var b bytes.Buffer
+		Expect(e.Snapshot(&b)).To(Succeed())
+
+		s, err := ReadSnapshot(bytes.NewReader(b.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.PrivateKey).To(BeEmpty())
+		Expect(*s.Connection).To(Equal(*conn))
+
+		restored, err := RestoreNode(bytes.NewReader(b.Bytes()), WithStore(&blockchain.MemoryStore{}), l)
+		Expect(err).ToNot(HaveOccurred())
+		ledger, err := restored.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+
+		var v string
+		d, exists := ledger.GetKey("foo", "bar")
+		Expect(exists).To(BeTrue())
+		Expect(d.Unmarshal(&v)).To(Succeed())
+		Expect(v).To(Equal("baz"))
+		original, _ := e.Ledger()
+		Expect(ledger.LastBlock()).To(Equal(original.LastBlock()))
+	})
+
+	It("restores the identity when requested", func() {
+		e := newNode(GenerateNewConnectionData(25))
+
+		var b bytes.Buffer
+		Expect(e.Snapshot(&b, WithSnapshotIdentity)).To(Succeed())
+
+		s, err := ReadSnapshot(bytes.NewReader(b.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.PrivateKey).ToNot(BeEmpty())
+
+		restored, err := RestoreNode(bytes.NewReader(b.Bytes()), l)
+		Expect(err).ToNot(HaveOccurred())
+
+		var rb bytes.Buffer
+		Expect(restored.Snapshot(&rb, WithSnapshotIdentity)).To(Succeed())
+		rs, err := ReadSnapshot(&rb)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rs.PrivateKey).To(Equal(s.PrivateKey))
+	})
+
+	It("restores the state store, but the identity and the keys already there", func() {
+		state := store.NewMemory()
+		Expect(state.Put("peers", "12D3KooWA", []byte("addrs"))).To(Succeed())
+		Expect(state.Put("metrics", "first-peer", []byte("1s"))).To(Succeed())
+		Expect(state.Put("", "lease", []byte("10.1.0.2"))).To(Succeed())
+		Expect(state.Put("", PrivKeyName, []byte("key"))).To(Succeed())
+		e := newNode(GenerateNewConnectionData(25), WithStateStore(state))
+
+		var b bytes.Buffer
+		Expect(e.Snapshot(&b)).To(Succeed())
+
+		s, err := ReadSnapshot(bytes.NewReader(b.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.State).To(Equal(map[string]map[string][]byte{
+			"peers":   {"12D3KooWA": []byte("addrs")},
+			"metrics": {"first-peer": []byte("1s")},
+			"":        {"lease": []byte("10.1.0.2")},
+		}))
+
+		restored := store.NewMemory()
+		Expect(restored.Put("metrics", "first-peer", []byte("2s"))).To(Succeed())
+		_, err = RestoreNode(bytes.NewReader(b.Bytes()), WithStateStore(restored), l)
+		Expect(err).ToNot(HaveOccurred())
+
+		for ns, keys := range map[string]map[string]string{
+			"peers":   {"12D3KooWA": "addrs"},
+			"metrics": {"first-peer": "2s"},
+			"":        {"lease": "10.1.0.2"},
+		} {
+			for k, v := range keys {
+				dat, err := restored.Get(ns, k)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(dat)).To(Equal(v))
+			}
+		}
+		_, err = restored.Get("", PrivKeyName)
+		Expect(err).To(Equal(store.ErrNotFound))
+	})
+
+	It("restores the ledger persisted in the state store", func() {
+		state := store.NewMemory()
+		e := newNode(GenerateNewConnectionData(25), WithStateStore(state), WithStore(blockchain.NewPersistentStore(state)))
+
+		var b bytes.Buffer
+		Expect(e.Snapshot(&b)).To(Succeed())
+
+		restored := store.NewMemory()
+		n, err := RestoreNode(bytes.NewReader(b.Bytes()), WithStateStore(restored), WithStore(blockchain.NewPersistentStore(restored)), l)
+		Expect(err).ToNot(HaveOccurred())
+		ledger, err := n.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+		original, _ := e.Ledger()
+		Expect(ledger.LastBlock()).To(Equal(original.LastBlock()))
+		Expect(ledger.Index()).To(Equal(original.Index()))
+	})
+
+	It("rejects invalid archives", func() {
+		_, err := RestoreNode(bytes.NewReader([]byte("foo")), l)
+		Expect(err).To(HaveOccurred())
+	})
+})
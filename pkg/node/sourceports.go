@@ -0,0 +1,83 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// maxSourcePortAttempts caps the source ports tried for a dial when
+// they are already in use
+const maxSourcePortAttempts = 16
+
+// PortRange is the range of local ports the outbound TCP connections
+// originate from, Min and Max included
+type PortRange struct {
+	Min, Max int
+}
+
+// ParsePortRange parses a port range in the form min-max, or a single port
+func ParsePortRange(s string) (PortRange, error) {
+	min, max, found := strings.Cut(s, "-")
+	if !found {
+		max = min
+	}
+	r := PortRange{}
+	var err error
+	if r.Min, err = strconv.Atoi(strings.TrimSpace(min)); err != nil {
+		return r, fmt.Errorf("invalid port range '%s'", s)
+	}
+	if r.Max, err = strconv.Atoi(strings.TrimSpace(max)); err != nil {
+		return r, fmt.Errorf("invalid port range '%s'", s)
+	}
+	return r, r.Validate()
+}
+
+// Validate checks the range is within the valid ports
+func (r PortRange) Validate() error {
+	if r.Min < 1 || r.Max > 65535 || r.Min > r.Max {
+		return fmt.Errorf("invalid port range %d-%d", r.Min, r.Max)
+	}
+	return nil
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// ports returns the ports to try for a dial, starting from a random one
+// so the concurrent dials don't contend for the same port
+func (r PortRange) ports() []int {
+	size := r.Max - r.Min + 1
+	n := size
+	if n > maxSourcePortAttempts {
+		n = maxSourcePortAttempts
+	}
+	start := rand.Intn(size)
+	ports := make([]int, n)
+	for i := range ports {
+		ports[i] = r.Min + (start+i)%size
+	}
+	return ports
+}
+
+// portInUse returns true if the dial failed binding the source port
+func portInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
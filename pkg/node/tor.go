@@ -0,0 +1,204 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/transport"
+	basichost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"golang.org/x/net/proxy"
+)
+
+// torDialTimeout is the timeout of the dials when using Tor,
+// as building a circuit to a hidden service takes several seconds
+const torDialTimeout = time.Minute
+
+// isOnion returns true if the address is an onion address
+func isOnion(a ma.Multiaddr) bool {
+	p := a.Protocols()
+	return len(p) == 1 && p[0].Code == ma.P_ONION3
+}
+
+// ParseOnionAddress parses an onion address in the form /onion3/<service id>:<port>
+func ParseOnionAddress(s string) (ma.Multiaddr, error) {
+	a, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid onion address '%s': %w", s, err)
+	}
+	if !isOnion(a) {
+		return nil, fmt.Errorf("invalid onion address '%s': expected /onion3/<service id>:<port>", s)
+	}
+	return a, nil
+}
+
+// onionListenAddrs returns the local addresses the hidden services forward
+// the connections to: the loopback, on the port of the onion address
+func onionListenAddrs(onions []ma.Multiaddr) (addrs []ma.Multiaddr) {
+	for _, o := range onions {
+		v, _ := o.ValueForProtocol(ma.P_ONION3)
+		_, port, _ := strings.Cut(v, ":")
+		if a, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/" + port); err == nil {
+			addrs = append(addrs, a)
+		}
+	}
+	return
+}
+
+// torAddrsFactory announces the onion addresses, in place of the addresses
+// the host listens on when all the connections go through Tor
+func torAddrsFactory(onions []ma.Multiaddr, only bool) basichost.AddrsFactory {
+	return func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		if only {
+			return append([]ma.Multiaddr{}, onions...)
+		}
+		return append(append([]ma.Multiaddr{}, addrs...), onions...)
+	}
+}
+
+// socksAddr returns the address to ask the proxy to connect to
+func socksAddr(a ma.Multiaddr) (string, error) {
+	if isOnion(a) {
+		v, _ := a.ValueForProtocol(ma.P_ONION3)
+		id, port, _ := strings.Cut(v, ":")
+		return net.JoinHostPort(id+".onion", port), nil
+	}
+
+	first, rest := ma.SplitFirst(a)
+	if first == nil || rest == nil {
+		return "", fmt.Errorf("can't dial %s through Tor", a)
+	}
+	second, _ := ma.SplitFirst(rest)
+	if second == nil || second.Protocol().Code != ma.P_TCP {
+		return "", fmt.Errorf("can't dial %s through Tor", a)
+	}
+	return net.JoinHostPort(first.Value(), second.Value()), nil
+}
+
+// torConn is a connection through the proxy, reporting the address
+// which was dialed as the remote one
+type torConn struct {
+	net.Conn
+	laddr, raddr ma.Multiaddr
+}
+
+func (c *torConn) LocalMultiaddr() ma.Multiaddr  { return c.laddr }
+func (c *torConn) RemoteMultiaddr() ma.Multiaddr { return c.raddr }
+
+// torTransport dials the onion addresses through the SOCKS proxy of a Tor daemon.
+// When only is set, it dials the TCP addresses through the proxy too, and
+// listens on TCP for the hidden services to forward the connections to.
+type torTransport struct {
+	*tcp.TcpTransport
+	upgrader transport.Upgrader
+	rcmgr    network.ResourceManager
+	dialer   proxy.ContextDialer
+	only     bool
+}
+
+func newTorTransport(addr string, only bool) func(transport.Upgrader, network.ResourceManager) (*torTransport, error) {
+	return func(upgrader transport.Upgrader, rcmgr network.ResourceManager) (*torTransport, error) {
+		if rcmgr == nil {
+			rcmgr = &network.NullResourceManager{}
+		}
+		t, err := tcp.NewTCPTransport(upgrader, rcmgr)
+		if err != nil {
+			return nil, err
+		}
+		d, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, errors.New("the SOCKS dialer doesn't support contexts")
+		}
+		return &torTransport{TcpTransport: t, upgrader: upgrader, rcmgr: rcmgr, dialer: cd, only: only}, nil
+	}
+}
+
+func (t *torTransport) Protocols() []int {
+	if t.only {
+		return []int{ma.P_ONION3, ma.P_TCP}
+	}
+	return []int{ma.P_ONION3}
+}
+
+func (t *torTransport) CanDial(a ma.Multiaddr) bool {
+	if isOnion(a) {
+		return true
+	}
+	return t.only && t.TcpTransport.CanDial(a)
+}
+
+func (t *torTransport) Listen(laddr ma.Multiaddr) (transport.Listener, error) {
+	if isOnion(laddr) {
+		return nil, fmt.Errorf("can't listen on %s: the hidden service must forward to a local address", laddr)
+	}
+	return t.TcpTransport.Listen(laddr)
+}
+
+func (t *torTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if !t.CanDial(raddr) {
+		return nil, fmt.Errorf("can't dial %s through Tor", raddr)
+	}
+	connScope, err := t.rcmgr.OpenConnection(network.DirOutbound, true, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.dialWithScope(ctx, raddr, p, connScope)
+	if err != nil {
+		connScope.Done()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *torTransport) DialWithUpdates(ctx context.Context, raddr ma.Multiaddr, p peer.ID, _ chan<- transport.DialUpdate) (transport.CapableConn, error) {
+	return t.Dial(ctx, raddr, p)
+}
+
+func (t *torTransport) dialWithScope(ctx context.Context, raddr ma.Multiaddr, p peer.ID, connScope network.ConnManagementScope) (transport.CapableConn, error) {
+	if err := connScope.SetPeer(p); err != nil {
+		return nil, err
+	}
+	addr, err := socksAddr(raddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	laddr, err := manet.FromNetAddr(conn.LocalAddr())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t.upgrader.Upgrade(ctx, t, &torConn{Conn: conn, laddr: laddr, raddr: raddr}, network.DirOutbound, p, connScope)
+}
+
+func (t *torTransport) String() string {
+	return "Tor"
+}
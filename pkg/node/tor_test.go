@@ -0,0 +1,221 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+)
+
+// socksProxy is a minimal SOCKS5 proxy standing for a Tor daemon: it connects
+// the onion addresses to the local ones in the routes, and the others directly
+type socksProxy struct {
+	sync.Mutex
+	ln        net.Listener
+	routes    map[string]string
+	requested []string
+}
+
+func newSocksProxy(routes map[string]string) *socksProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	p := &socksProxy{ln: ln, routes: routes}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	DeferCleanup(ln.Close)
+	return p
+}
+
+func (p *socksProxy) Requested() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.requested...)
+}
+
+func (p *socksProxy) serve(c net.Conn) {
+	defer c.Close()
+
+	// Greeting: no authentication
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, make([]byte, hdr[1])); err != nil {
+		return
+	}
+	c.Write([]byte{5, 0})
+
+	// Connect request
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(c, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, map[byte]int{1: 4, 4: 16}[req[3]])
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return
+		}
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(c, port); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	p.Lock()
+	p.requested = append(p.requested, addr)
+	if r, ok := p.routes[addr]; ok {
+		addr = r
+	}
+	p.Unlock()
+
+	remote, err := net.Dial("tcp", addr)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer remote.Close()
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(remote, c)
+	io.Copy(c, remote)
+}
+
+var _ = Describe("Tor", func() {
+	l := Logger(logger.New(log.LevelFatal))
+	serviceID := strings.ToLower(base32.StdEncoding.EncodeToString(make([]byte, 35)))
+
+	freePort := func() int {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+		return ln.Addr().(*net.TCPAddr).Port
+	}
+
+	start := func(ctx context.Context, token string, o ...Option) *Node {
+		e, err := New(append([]Option{
+			FromBase64(false, false, token, nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			l,
+		}, o...)...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		return e
+	}
+
+	It("validates the configuration", func() {
+		a, err := ParseOnionAddress(fmt.Sprintf("/onion3/%s:4001", serviceID))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(Transport(a)).To(Equal("onion3"))
+
+		for _, s := range []string{"", "/ip4/127.0.0.1/tcp/4001", "/onion3/foo:4001", fmt.Sprintf("/onion3/%s:4001/tcp/1", serviceID)} {
+			_, err := ParseOnionAddress(s)
+			Expect(err).To(HaveOccurred(), s)
+		}
+
+		_, err = New(WithTorProxy("", true))
+		Expect(err).To(HaveOccurred())
+		_, err = New(WithTorProxy("127.0.0.1", false))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("dials the onion addresses through the proxy", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		port := freePort()
+		onion := fmt.Sprintf("/onion3/%s:%d", serviceID, port)
+		proxy := newSocksProxy(map[string]string{
+			fmt.Sprintf("%s.onion:%d", serviceID, port): fmt.Sprintf("127.0.0.1:%d", port),
+		})
+
+		token := GenerateNewConnectionData(25).Base64()
+		service := start(ctx, token, WithOnionAddresses(onion))
+		e := start(ctx, token, WithTorProxy(proxy.ln.Addr().String(), false))
+
+		a := multiaddr.StringCast(onion)
+		Expect(service.Host().Addrs()).To(ContainElement(a))
+
+		Expect(e.Host().Connect(ctx, peer.AddrInfo{ID: service.Host().ID(), Addrs: []multiaddr.Multiaddr{a}})).To(Succeed())
+		Expect(e.Host().Network().Connectedness(service.Host().ID())).To(Equal(network.Connected))
+		Expect(e.Host().Network().ConnsToPeer(service.Host().ID())[0].RemoteMultiaddr()).To(Equal(a))
+		Expect(proxy.Requested()).To(Equal([]string{fmt.Sprintf("%s.onion:%d", serviceID, port)}))
+	})
+
+	It("dials all the connections through the proxy", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		proxy := newSocksProxy(nil)
+		token := GenerateNewConnectionData(25).Base64()
+		e2 := start(ctx, token, ListenAddresses("/ip4/127.0.0.1/tcp/0"))
+		e := start(ctx, token, WithTorProxy(proxy.ln.Addr().String(), true))
+
+		// Nothing but the onion addresses is announced
+		Expect(e.Host().Addrs()).To(BeEmpty())
+		for _, a := range e.ListenAddresses() {
+			Expect(Transport(a)).To(BeElementOf("tcp", "p2p-circuit"))
+		}
+
+		tcpAddrs := []multiaddr.Multiaddr{}
+		for _, a := range e2.Host().Addrs() {
+			if Transport(a) == "tcp" {
+				tcpAddrs = append(tcpAddrs, a)
+			}
+		}
+		Expect(e.Host().Connect(ctx, peer.AddrInfo{ID: e2.Host().ID(), Addrs: tcpAddrs})).To(Succeed())
+
+		port, err := tcpAddrs[0].ValueForProtocol(multiaddr.P_TCP)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxy.Requested()).To(ContainElement("127.0.0.1:" + port))
+	})
+})
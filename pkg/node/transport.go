@@ -0,0 +1,59 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// ledgerStatus reports whether the ledger can exchange blocks with other
+// peers, or it is running only on the local state
+func (e *Node) ledgerStatus() types.LedgerStatus {
+	if e.MessageHub == nil || !e.MessageHub.Ready() {
+		return types.LedgerStatus{Degraded: true, Reason: "ledger transport not started"}
+	}
+	peers, err := e.MessageHub.ListPeers()
+	if err != nil {
+		return types.LedgerStatus{Degraded: true, Reason: err.Error()}
+	}
+	if len(peers) == 0 {
+		return types.LedgerStatus{Degraded: true, Reason: "no peers on the ledger"}
+	}
+	return types.LedgerStatus{Peers: len(peers)}
+}
+
+// watchLedgerTransport logs when the ledger enters or leaves the degraded state
+func (e *Node) watchLedgerTransport(ctx context.Context) {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	degraded := false
+	for {
+		select {
+		case <-t.C:
+			s := e.ledgerStatus()
+			switch {
+			case s.Degraded && !degraded:
+				e.config.Logger.Warnf("Ledger degraded, serving local state: %s", s.Reason)
+			case !s.Degraded && degraded:
+				e.config.Logger.Infof("Ledger transport up, %d peers", s.Peers)
+			}
+			degraded = s.Degraded
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/transport"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	libp2pwebrtc "github.com/libp2p/go-libp2p/p2p/transport/webrtc"
+	ws "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const (
+	uplinkMaxFailures = 3
+	uplinkCooldown    = time.Minute
+)
+
+// Uplink is a local source address outbound connections can be bound to,
+// with its share of the connections
+type Uplink struct {
+	Address net.IP
+	Weight  int
+}
+
+type uplinkState struct {
+	Uplink
+	current   int
+	failures  int
+	downUntil time.Time
+}
+
+// UplinkBalancer distributes outbound connections across the uplinks
+// with a smooth weighted round-robin. Uplinks failing consecutively
+// are skipped for a cooldown, and their share goes to the remaining ones.
+type UplinkBalancer struct {
+	sync.Mutex
+	uplinks     []*uplinkState
+	maxFailures int
+	cooldown    time.Duration
+}
+
+// NewUplinkBalancer returns a balancer over the uplinks. An uplink is considered down
+// after maxFailures consecutive failed dials, and it is tried again after the cooldown.
+func NewUplinkBalancer(uplinks []Uplink, maxFailures int, cooldown time.Duration) *UplinkBalancer {
+	b := &UplinkBalancer{maxFailures: maxFailures, cooldown: cooldown}
+	for _, u := range uplinks {
+		if u.Weight <= 0 {
+			u.Weight = 1
+		}
+		b.uplinks = append(b.uplinks, &uplinkState{Uplink: u})
+	}
+	return b
+}
+
+// Next returns the source address to dial the remote with, among the uplinks
+// of the same address family. It returns nil if none can be used.
+// When all the uplinks are down, they are all tried again.
+func (b *UplinkBalancer) Next(remote net.IP) net.IP {
+	b.Lock()
+	defer b.Unlock()
+
+	v4 := remote.To4() != nil
+	candidates := []*uplinkState{}
+	healthy := []*uplinkState{}
+	for _, u := range b.uplinks {
+		if (u.Address.To4() != nil) != v4 {
+			continue
+		}
+		candidates = append(candidates, u)
+		if time.Now().After(u.downUntil) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = candidates
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	total := 0
+	var best *uplinkState
+	for _, u := range healthy {
+		u.current += u.Weight
+		total += u.Weight
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+	best.current -= total
+	return best.Address
+}
+
+func (b *UplinkBalancer) get(ip net.IP) *uplinkState {
+	for _, u := range b.uplinks {
+		if u.Address.Equal(ip) {
+			return u
+		}
+	}
+	return nil
+}
+
+// Failure records a failed dial from the uplink
+func (b *UplinkBalancer) Failure(ip net.IP) {
+	b.Lock()
+	defer b.Unlock()
+	u := b.get(ip)
+	if u == nil {
+		return
+	}
+	u.failures++
+	if u.failures >= b.maxFailures {
+		u.failures = 0
+		u.downUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// Success resets the failures of the uplink
+func (b *UplinkBalancer) Success(ip net.IP) {
+	b.Lock()
+	defer b.Unlock()
+	if u := b.get(ip); u != nil {
+		u.failures = 0
+		u.downUntil = time.Time{}
+	}
+}
+
+// Dialed records the outcome of a dial from the uplink. Only the
+// failures of the uplink count, not the ones of the remote peer.
+func (b *UplinkBalancer) Dialed(ip net.IP, err error) {
+	switch {
+	case err == nil:
+		b.Success(ip)
+	case uplinkError(err):
+		b.Failure(ip)
+	}
+}
+
+// uplinkError returns true if the dial failed locally: the address of the
+// uplink is gone, or its network or the next hop can't be reached
+func uplinkError(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(err, syscall.ENETDOWN) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH)
+}
+
+// uplinkTransport is a TCP transport which binds the outbound
+// connections to the source address picked by the balancer,
+// and to a source port within the range, if any
+type uplinkTransport struct {
+	*tcp.TcpTransport
+	upgrader transport.Upgrader
+	rcmgr    network.ResourceManager
+	balancer *UplinkBalancer
+	ports    *PortRange
+}
+
+func newUplinkTransport(b *UplinkBalancer, ports *PortRange) func(transport.Upgrader, network.ResourceManager) (*uplinkTransport, error) {
+	return func(upgrader transport.Upgrader, rcmgr network.ResourceManager) (*uplinkTransport, error) {
+		if rcmgr == nil {
+			rcmgr = &network.NullResourceManager{}
+		}
+		// Reuseport would bind the outbound connections to the listen address
+		t, err := tcp.NewTCPTransport(upgrader, rcmgr, tcp.DisableReuseport())
+		if err != nil {
+			return nil, err
+		}
+		return &uplinkTransport{TcpTransport: t, upgrader: upgrader, rcmgr: rcmgr, balancer: b, ports: ports}, nil
+	}
+}
+
+func (t *uplinkTransport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	connScope, err := t.rcmgr.OpenConnection(network.DirOutbound, true, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.dialWithScope(ctx, raddr, p, connScope)
+	if err != nil {
+		connScope.Done()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *uplinkTransport) DialWithUpdates(ctx context.Context, raddr ma.Multiaddr, p peer.ID, _ chan<- transport.DialUpdate) (transport.CapableConn, error) {
+	return t.Dial(ctx, raddr, p)
+}
+
+func (t *uplinkTransport) dialWithScope(ctx context.Context, raddr ma.Multiaddr, p peer.ID, connScope network.ConnManagementScope) (transport.CapableConn, error) {
+	if err := connScope.SetPeer(p); err != nil {
+		return nil, err
+	}
+
+	var src net.IP
+	if remote, err := manet.ToIP(raddr); err == nil {
+		src = t.balancer.Next(remote)
+	}
+
+	conn, err := t.dial(ctx, raddr, src)
+	if src != nil {
+		t.balancer.Dialed(src, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	direction := network.DirOutbound
+	if ok, isClient, _ := network.GetSimultaneousConnect(ctx); ok && !isClient {
+		direction = network.DirInbound
+	}
+	return t.upgrader.Upgrade(ctx, t, conn, direction, p, connScope)
+}
+
+// dial dials from the source address, and from the first free port of the
+// source port range
+// listenOnlyTransport accepts the connections of a transport without
+// dialing with it, as its dials can't be bound to the uplinks
+type listenOnlyTransport struct {
+	transport.Transport
+}
+
+func (t *listenOnlyTransport) CanDial(ma.Multiaddr) bool { return false }
+
+func (t *listenOnlyTransport) Dial(context.Context, ma.Multiaddr, peer.ID) (transport.CapableConn, error) {
+	return nil, errors.New("the dials go through the uplinks")
+}
+
+// listenOnly wraps the transport returned by a constructor
+func listenOnly(t transport.Transport, err error) (transport.Transport, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &listenOnlyTransport{Transport: t}, nil
+}
+
+// The transports other than TCP are used for the inbound connections only
+// along with the uplinks: QUIC, WebTransport and WebRTC dial from the UDP
+// socket of their listener, and WebSocket isn't bound to the uplinks
+
+func newUplinkQUICTransport(key ic.PrivKey, cm *quicreuse.ConnManager, psk pnet.PSK, gater connmgr.ConnectionGater, rcmgr network.ResourceManager) (transport.Transport, error) {
+	return listenOnly(quic.NewTransport(key, cm, psk, gater, rcmgr))
+}
+
+func newUplinkWebTransport(key ic.PrivKey, psk pnet.PSK, cm *quicreuse.ConnManager, gater connmgr.ConnectionGater, rcmgr network.ResourceManager) (transport.Transport, error) {
+	return listenOnly(webtransport.New(key, psk, cm, gater, rcmgr))
+}
+
+func newUplinkWebRTCTransport(key ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater, rcmgr network.ResourceManager, listenUDP libp2pwebrtc.ListenUDPFn) (transport.Transport, error) {
+	return listenOnly(libp2pwebrtc.New(key, psk, gater, rcmgr, listenUDP))
+}
+
+func newUplinkWebsocketTransport(u transport.Upgrader, rcmgr network.ResourceManager) (transport.Transport, error) {
+	return listenOnly(ws.New(u, rcmgr))
+}
+
+func (t *uplinkTransport) dial(ctx context.Context, raddr ma.Multiaddr, src net.IP) (manet.Conn, error) {
+	if t.ports == nil {
+		d := manet.Dialer{}
+		if src != nil {
+			d.Dialer.LocalAddr = &net.TCPAddr{IP: src}
+		}
+		return d.DialContext(ctx, raddr)
+	}
+
+	var err error
+	for _, port := range t.ports.ports() {
+		d := manet.Dialer{}
+		d.Dialer.LocalAddr = &net.TCPAddr{IP: src, Port: port}
+		var conn manet.Conn
+		conn, err = d.DialContext(ctx, raddr)
+		if err == nil || !portInUse(err) {
+			return conn, err
+		}
+	}
+	return nil, fmt.Errorf("no free source port in %s: %w", t.ports, err)
+}
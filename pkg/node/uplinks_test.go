@@ -0,0 +1,230 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	. "github.com/mudler/edgevpn/pkg/node"
+)
+
+var _ = Describe("Uplinks", func() {
+	a := net.ParseIP("192.168.1.10")
+	b := net.ParseIP("10.0.0.10")
+	v6 := net.ParseIP("fd00::10")
+	remote := net.ParseIP("203.0.113.1")
+	l := Logger(logger.New(log.LevelFatal))
+
+	count := func(ub *UplinkBalancer, n int) map[string]int {
+		res := map[string]int{}
+		for i := 0; i < n; i++ {
+			res[ub.Next(remote).String()]++
+		}
+		return res
+	}
+
+	It("distributes connections by weight", func() {
+		ub := NewUplinkBalancer([]Uplink{{Address: a, Weight: 3}, {Address: b, Weight: 1}, {Address: v6, Weight: 5}}, 3, time.Minute)
+		Expect(count(ub, 400)).To(Equal(map[string]int{a.String(): 300, b.String(): 100}))
+
+		// Smooth: the heavier uplink does not get all its share in a row
+		seq := []string{}
+		for i := 0; i < 4; i++ {
+			seq = append(seq, ub.Next(remote).String())
+		}
+		Expect(seq).To(ContainElement(b.String()))
+	})
+
+	It("picks uplinks of the same address family", func() {
+		ub := NewUplinkBalancer([]Uplink{{Address: a, Weight: 1}, {Address: v6, Weight: 1}}, 3, time.Minute)
+		Expect(ub.Next(net.ParseIP("2001:db8::1"))).To(Equal(v6))
+		Expect(ub.Next(remote)).To(Equal(a))
+
+		ub = NewUplinkBalancer([]Uplink{{Address: a, Weight: 1}}, 3, time.Minute)
+		Expect(ub.Next(net.ParseIP("2001:db8::1"))).To(BeNil())
+	})
+
+	It("redistributes to the remaining uplinks on failures", func() {
+		ub := NewUplinkBalancer([]Uplink{{Address: a, Weight: 3}, {Address: b, Weight: 1}}, 2, 100*time.Millisecond)
+		ub.Failure(a)
+		Expect(count(ub, 40)[a.String()]).To(Equal(30))
+
+		ub.Failure(a)
+		Expect(count(ub, 40)).To(Equal(map[string]int{b.String(): 40}))
+
+		// All down: try them all again
+		ub.Failure(b)
+		ub.Failure(b)
+		Expect(count(ub, 40)).To(HaveLen(2))
+
+		// Back after the cooldown
+		ub.Success(b)
+		Eventually(func() int { return count(ub, 40)[a.String()] }, time.Second, 20*time.Millisecond).Should(BeNumerically("~", 30, 2))
+	})
+
+	It("marks an uplink down only on local failures", func() {
+		ub := NewUplinkBalancer([]Uplink{{Address: a, Weight: 1}, {Address: b, Weight: 1}}, 2, time.Minute)
+		refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		ub.Dialed(a, refused)
+		ub.Dialed(a, context.DeadlineExceeded)
+		Expect(count(ub, 40)).To(Equal(map[string]int{a.String(): 20, b.String(): 20}))
+
+		unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}
+		ub.Dialed(a, unreachable)
+		ub.Dialed(a, unreachable)
+		Expect(count(ub, 40)).To(Equal(map[string]int{b.String(): 40}))
+
+		ub.Dialed(a, nil)
+		Expect(count(ub, 40)).To(Equal(map[string]int{a.String(): 20, b.String(): 20}))
+	})
+
+	It("binds outbound connections to the uplinks", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		token := GenerateNewConnectionData(25).Base64()
+		lo := net.ParseIP("127.0.0.1")
+		e, _ := New(
+			WithUplinks(Uplink{Address: lo, Weight: 1}),
+			FromBase64(false, false, token, nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			l,
+		)
+		e2, _ := New(
+			ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			FromBase64(false, false, token, nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			l,
+		)
+		Expect(e.Start(ctx)).To(Succeed())
+		Expect(e2.Start(ctx)).To(Succeed())
+
+		tcpAddrs := []multiaddr.Multiaddr{}
+		for _, a := range e2.Host().Addrs() {
+			if _, err := a.ValueForProtocol(multiaddr.P_TCP); err == nil {
+				tcpAddrs = append(tcpAddrs, a)
+			}
+		}
+		Expect(e.Host().Connect(ctx, peer.AddrInfo{ID: e2.Host().ID(), Addrs: tcpAddrs})).To(Succeed())
+
+		conns := e.Host().Network().ConnsToPeer(e2.Host().ID())
+		Expect(conns).ToNot(BeEmpty())
+		local, err := manet.ToIP(conns[0].LocalMultiaddr())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(local.Equal(lo)).To(BeTrue())
+	})
+
+	It("dials the other transports from the uplinks too", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		token := GenerateNewConnectionData(25).Base64()
+		e, _ := New(
+			WithUplinks(Uplink{Address: net.ParseIP("127.0.0.1"), Weight: 1}),
+			ListenAddresses("/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1"),
+			FromBase64(false, false, token, nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			l,
+		)
+		e2, _ := New(
+			ListenAddresses("/ip4/127.0.0.1/udp/0/quic-v1"),
+			FromBase64(false, false, token, nil, nil),
+			WithStore(&blockchain.MemoryStore{}),
+			l,
+		)
+		Expect(e.Start(ctx)).To(Succeed())
+		Expect(e2.Start(ctx)).To(Succeed())
+
+		// QUIC can't be dialed from the uplinks
+		Expect(e.Host().Connect(ctx, peer.AddrInfo{ID: e2.Host().ID(), Addrs: e2.Host().Addrs()})).ToNot(Succeed())
+
+		// but its inbound connections are accepted
+		quicAddrs := []multiaddr.Multiaddr{}
+		for _, a := range e.Host().Addrs() {
+			if _, err := a.ValueForProtocol(multiaddr.P_QUIC_V1); err == nil {
+				quicAddrs = append(quicAddrs, a)
+			}
+		}
+		Expect(quicAddrs).ToNot(BeEmpty())
+		Expect(e2.Host().Connect(ctx, peer.AddrInfo{ID: e.Host().ID(), Addrs: quicAddrs})).To(Succeed())
+	})
+
+	Context("source ports", func() {
+		It("parses and validates the range", func() {
+			Expect(ParsePortRange("40000-40100")).To(Equal(PortRange{Min: 40000, Max: 40100}))
+			Expect(ParsePortRange("40000")).To(Equal(PortRange{Min: 40000, Max: 40000}))
+			for _, r := range []string{"", "a-b", "40100-40000", "0-10", "65000-70000"} {
+				_, err := ParsePortRange(r)
+				Expect(err).To(HaveOccurred(), r)
+			}
+			_, err := New(WithSourcePorts(20, 10))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("binds outbound connections to the source ports", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			min := ln.Addr().(*net.TCPAddr).Port
+			ln.Close()
+
+			token := GenerateNewConnectionData(25).Base64()
+			e, _ := New(
+				WithSourcePorts(min, min+4),
+				FromBase64(false, false, token, nil, nil),
+				WithStore(&blockchain.MemoryStore{}),
+				l,
+			)
+			e2, _ := New(
+				ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+				FromBase64(false, false, token, nil, nil),
+				WithStore(&blockchain.MemoryStore{}),
+				l,
+			)
+			Expect(e.Start(ctx)).To(Succeed())
+			Expect(e2.Start(ctx)).To(Succeed())
+
+			tcpAddrs := []multiaddr.Multiaddr{}
+			for _, a := range e2.Host().Addrs() {
+				if _, err := a.ValueForProtocol(multiaddr.P_TCP); err == nil {
+					tcpAddrs = append(tcpAddrs, a)
+				}
+			}
+			Expect(e.Host().Connect(ctx, peer.AddrInfo{ID: e2.Host().ID(), Addrs: tcpAddrs})).To(Succeed())
+
+			conns := e.Host().Network().ConnsToPeer(e2.Host().ID())
+			Expect(conns).ToNot(BeEmpty())
+			port, err := conns[0].LocalMultiaddr().ValueForProtocol(multiaddr.P_TCP)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strconv.Atoi(port)).To(BeNumerically(">=", min))
+			Expect(strconv.Atoi(port)).To(BeNumerically("<=", min+4))
+		})
+	})
+})
@@ -0,0 +1,130 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operations
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// Kinds of the operations tracked by the node
+const (
+	Dial     = "dial"
+	Query    = "dht-query"
+	Transfer = "transfer"
+)
+
+// DefaultRegistry is the registry the operations of the node are tracked in
+var DefaultRegistry = NewRegistry()
+
+// Start tracks the operation in the default registry
+func Start(ctx context.Context, kind, target string) (context.Context, *Operation) {
+	return DefaultRegistry.Start(ctx, kind, target)
+}
+
+// List returns the operations in flight in the default registry
+func List() []types.Operation {
+	return DefaultRegistry.List()
+}
+
+// Cancel cancels the operation of the default registry
+func Cancel(id uint64) bool {
+	return DefaultRegistry.Cancel(id)
+}
+
+// Registry tracks the operations in flight, so they can be listed and cancelled
+type Registry struct {
+	sync.Mutex
+	next uint64
+	ops  map[uint64]*Operation
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{ops: make(map[uint64]*Operation)}
+}
+
+// Operation is an operation tracked by the registry
+type Operation struct {
+	id           uint64
+	kind, target string
+	started      time.Time
+	cancelled    bool
+	cancel       context.CancelFunc
+	r            *Registry
+}
+
+// Start tracks an operation of the given kind on the target (e.g. a peer).
+// It returns a context derived from ctx, which is done when the operation
+// is cancelled, and the operation, which must be marked Done when it returns.
+func (r *Registry) Start(ctx context.Context, kind, target string) (context.Context, *Operation) {
+	ctx, cancel := context.WithCancel(ctx)
+	o := &Operation{kind: kind, target: target, started: time.Now(), cancel: cancel, r: r}
+	r.Lock()
+	r.next++
+	o.id = r.next
+	r.ops[o.id] = o
+	r.Unlock()
+	return ctx, o
+}
+
+// ID returns the ID of the operation in the registry
+func (o *Operation) ID() uint64 {
+	return o.id
+}
+
+// Done stops tracking the operation, and releases its context
+func (o *Operation) Done() {
+	o.r.Lock()
+	delete(o.r.ops, o.id)
+	o.r.Unlock()
+	o.cancel()
+}
+
+// List returns the operations in flight, the oldest first
+func (r *Registry) List() []types.Operation {
+	r.Lock()
+	res := make([]types.Operation, 0, len(r.ops))
+	for _, o := range r.ops {
+		res = append(res, types.Operation{
+			ID:        o.id,
+			Kind:      o.kind,
+			Target:    o.target,
+			Started:   o.started.UTC().Format(time.RFC3339),
+			Cancelled: o.cancelled,
+		})
+	}
+	r.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Cancel cancels the context of the operation.
+// It returns false if the operation is not in flight.
+func (r *Registry) Cancel(id uint64) bool {
+	r.Lock()
+	o, ok := r.ops[id]
+	if ok {
+		o.cancelled = true
+	}
+	r.Unlock()
+	if ok {
+		o.cancel()
+	}
+	return ok
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operations_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/operations"
+)
+
+var _ = Describe("Registry", func() {
+	It("lists the operations in flight", func() {
+		r := NewRegistry()
+		_, dial := r.Start(context.Background(), Dial, "peer")
+		_, query := r.Start(context.Background(), Query, "providers")
+
+		list := r.List()
+		Expect(list).To(HaveLen(2))
+		Expect(list[0].ID).To(Equal(dial.ID()))
+		Expect(list[0].Kind).To(Equal(Dial))
+		Expect(list[0].Target).To(Equal("peer"))
+		Expect(list[0].Started).ToNot(BeEmpty())
+		Expect(list[1].ID).To(Equal(query.ID()))
+
+		dial.Done()
+		Expect(r.List()).To(HaveLen(1))
+		query.Done()
+		Expect(r.List()).To(BeEmpty())
+	})
+
+	It("cancels an operation", func() {
+		r := NewRegistry()
+		ctx, op := r.Start(context.Background(), Transfer, "file")
+		other, op2 := r.Start(context.Background(), Transfer, "other")
+		defer op2.Done()
+
+		Expect(r.Cancel(op.ID())).To(BeTrue())
+		Eventually(ctx.Done()).Should(BeClosed())
+		Expect(ctx.Err()).To(Equal(context.Canceled))
+		Expect(other.Err()).ToNot(HaveOccurred())
+		Expect(r.List()[0].Cancelled).To(BeTrue())
+
+		op.Done()
+		Expect(r.Cancel(op.ID())).To(BeFalse())
+		Expect(r.Cancel(1000)).To(BeFalse())
+	})
+
+	It("releases the context when done", func() {
+		r := NewRegistry()
+		parent, cancel := context.WithCancel(context.Background())
+		ctx, op := r.Start(parent, Dial, "peer")
+		cancel()
+		Expect(ctx.Err()).To(HaveOccurred())
+		op.Done()
+		Expect(r.List()).To(BeEmpty())
+	})
+})
@@ -18,10 +18,32 @@ import (
 )
 
 const (
-	EdgeVPN         Protocol = "/edgevpn/0.1"
-	ServiceProtocol Protocol = "/edgevpn/service/0.1"
-	FileProtocol    Protocol = "/edgevpn/file/0.1"
-	EgressProtocol  Protocol = "/edgevpn/egress/0.1"
+	EdgeVPN Protocol = "/edgevpn/0.1"
+	// EdgeVPNBatch carries the VPN frames in length-prefixed batches
+	EdgeVPNBatch Protocol = "/edgevpn/batch/0.1"
+	// EdgeVPNBatchS2 and EdgeVPNBatchZstd are negotiated by the nodes
+	// compressing the batches, with S2 or zstd
+	EdgeVPNBatchS2   Protocol = "/edgevpn/batch/s2/0.1"
+	EdgeVPNBatchZstd Protocol = "/edgevpn/batch/zstd/0.1"
+	ServiceProtocol  Protocol = "/edgevpn/service/0.1"
+	// ServiceDeflateProtocol is negotiated by the services with compression enabled
+	ServiceDeflateProtocol Protocol = "/edgevpn/service/deflate/0.1"
+	// ServiceUDPProtocol carries the datagrams of a UDP service session
+	ServiceUDPProtocol Protocol = "/edgevpn/service/udp/0.1"
+	// ServiceQueryProtocol is used to ask a peer which services it exposes
+	ServiceQueryProtocol Protocol = "/edgevpn/service/query/0.1"
+	FileProtocol         Protocol = "/edgevpn/file/0.1"
+	// FileChunkProtocol is used to fetch a range of a file shared in chunks
+	FileChunkProtocol Protocol = "/edgevpn/file/chunk/0.1"
+	EgressProtocol    Protocol = "/edgevpn/egress/0.1"
+	// RendezvousProtocol is served by the rendezvous servers used as discovery fallback
+	RendezvousProtocol Protocol = "/edgevpn/rendezvous/0.1"
+	// PeerExchangeProtocol is used by the nodes to share the peers they are connected to
+	PeerExchangeProtocol Protocol = "/edgevpn/pex/0.1"
+	// PeerExchangeBootstrapProtocol is used by the nodes to share their bootstrap peers
+	PeerExchangeBootstrapProtocol Protocol = "/edgevpn/pex/bootstrap/0.1"
+	// PrivateAuthProtocol is used by the nodes of a private network to prove their membership
+	PrivateAuthProtocol Protocol = "/edgevpn/private/auth/0.1"
 )
 
 const (
@@ -34,6 +56,14 @@ const (
 	EgressService     = "egress"
 	TrustZoneKey      = "trustzone"
 	TrustZoneAuthKey  = "trustzoneAuth"
+	FleetLedgerKey    = "fleet"
+	ACLLedgerKey      = "acl"
+	UpgradeLedgerKey  = "upgrade"
+	ProfileLedgerKey  = "profile"
+	RoutesLedgerKey   = "routes"
+	FirewallLedgerKey = "firewall"
+	// FileSeedersLedgerKey lists the peers serving a file, as <file>@<peer>
+	FileSeedersLedgerKey = "fileseeders"
 )
 
 type Protocol string
@@ -0,0 +1,390 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/operations"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/pkg/errors"
+)
+
+// DefaultChunkSize is the size of the chunks the shared files are hashed and transferred in
+var DefaultChunkSize int64 = 4 << 20
+
+// DefaultParallelChunks is the number of chunks a receiver fetches at once
+var DefaultParallelChunks = 4
+
+// chunkAttempts is the number of times a chunk is requested to each seeder
+const chunkAttempts = 3
+
+// chunkMaxRequestSize bounds the request line read from a peer
+const chunkMaxRequestSize = 4 << 10
+
+// chunkRequest asks a seeder for Length bytes of a file from Offset
+type chunkRequest struct {
+	File   string
+	Offset int64
+	Length int64
+}
+
+// chunkResponse precedes the Length bytes sent by the seeder
+type chunkResponse struct {
+	Length int64
+	Error  string `json:",omitempty"`
+}
+
+// chunkFiles are the paths of the files served in chunks, by file ID
+var chunkFiles sync.Map
+
+// hashChunks returns the size of the file at path and the SHA256 hashes of its chunks
+func hashChunks(path string, chunkSize int64) (int64, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	var size int64
+	chunks := []string{}
+	for {
+		h := sha256.New()
+		n, err := io.CopyN(h, f, chunkSize)
+		size += n
+		if n > 0 {
+			chunks = append(chunks, hex.EncodeToString(h.Sum(nil)))
+		}
+		if err == io.EOF {
+			return size, chunks, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// chunkStreamHandler serves the ranges of the files shared in chunks
+// to the peers in the ledger
+func chunkStreamHandler(ll log.StandardLogger) func(n *node.Node, l *blockchain.Ledger) func(stream network.Stream) {
+	return func(n *node.Node, l *blockchain.Ledger) func(stream network.Stream) {
+		return func(stream network.Stream) {
+			go func() {
+				defer stream.Close()
+				remote := stream.Conn().RemotePeer().String()
+				if _, found := l.GetKey(protocol.UsersLedgerKey, remote); !found {
+					ll.Info("Reset", remote, "Not found in the ledger")
+					stream.Reset()
+					return
+				}
+
+				r := bufio.NewReader(io.LimitReader(stream, chunkMaxRequestSize))
+				line, err := r.ReadBytes('\n')
+				if err != nil {
+					stream.Reset()
+					return
+				}
+				req := chunkRequest{}
+				if err := json.Unmarshal(line, &req); err != nil {
+					stream.Reset()
+					return
+				}
+
+				reply := func(res chunkResponse) error {
+					return json.NewEncoder(stream).Encode(res)
+				}
+				path, ok := chunkFiles.Load(req.File)
+				if !ok {
+					reply(chunkResponse{Error: fmt.Sprintf("file %s not served", req.File)})
+					return
+				}
+				f, err := os.Open(path.(string))
+				if err != nil {
+					reply(chunkResponse{Error: err.Error()})
+					return
+				}
+				defer f.Close()
+				st, err := f.Stat()
+				if err != nil {
+					reply(chunkResponse{Error: err.Error()})
+					return
+				}
+				if req.Offset < 0 || req.Length < 0 || req.Offset > st.Size() {
+					reply(chunkResponse{Error: fmt.Sprintf("range %d+%d out of file %s", req.Offset, req.Length, req.File)})
+					return
+				}
+				// The range is clamped to the end of the file
+				length := min(req.Length, st.Size()-req.Offset)
+
+				// Wait for a slot among the transfers served at once,
+				// giving up if the peer goes away meanwhile
+				sctx, cancel := streamContext(stream)
+				defer cancel()
+				if err := DefaultTransferLimiter.Outbound.Acquire(sctx); err != nil {
+					stream.Reset()
+					return
+				}
+				defer DefaultTransferLimiter.Outbound.Release()
+
+				if err := reply(chunkResponse{Length: length}); err != nil {
+					stream.Reset()
+					return
+				}
+				ctx, op := operations.Start(sctx, operations.Transfer, req.File)
+				stop := context.AfterFunc(ctx, func() { stream.Reset() })
+				DefaultTransferLimiter.Copy(stream, io.NewSectionReader(f, req.Offset, length))
+				stop()
+				op.Done()
+			}()
+		}
+	}
+}
+
+// streamContext returns a context canceled once the stream is reset or
+// closed by the peer, which sends nothing more after its request
+func streamContext(stream network.Stream) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		io.Copy(io.Discard, stream)
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// fileSeeders returns the peers serving the same content as fi, fi.PeerID first
+func fileSeeders(ledger *blockchain.Ledger, fi *types.File, self peer.ID) []peer.ID {
+	ids := []string{fi.PeerID}
+	for _, v := range ledger.CurrentData()[protocol.FileSeedersLedgerKey] {
+		s := &types.File{}
+		if err := v.Unmarshal(s); err != nil || s.Name != fi.Name || !slices.Equal(s.Chunks, fi.Chunks) {
+			continue
+		}
+		if !slices.Contains(ids, s.PeerID) {
+			ids = append(ids, s.PeerID)
+		}
+	}
+	seeders := []peer.ID{}
+	for _, id := range ids {
+		if d, err := peer.Decode(id); err == nil && d != self {
+			seeders = append(seeders, d)
+		}
+	}
+	return seeders
+}
+
+// receiveChunks receives the file announced in chunks to path. The chunks are
+// written to path.part, and the ones found there already verified are kept,
+// so an interrupted transfer resumes where it stopped. The chunks are fetched
+// in parallel from the seeders of the file.
+func receiveChunks(ctx context.Context, ledger *blockchain.Ledger, n *node.Node, fi *types.File, path string, tp *transferProgress) error {
+	seeders := fileSeeders(ledger, fi, n.Host().ID())
+	tp.update(func(p *types.FileProgress) {
+		p.Size = fi.Size
+		p.Chunks = len(fi.Chunks)
+		p.Seeders = []string{}
+		for _, s := range seeders {
+			p.Seeders = append(p.Seeders, s.String())
+		}
+	})
+	if len(seeders) == 0 {
+		return fmt.Errorf("no seeders for file %s", fi.Name)
+	}
+
+	part := path + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(fi.Size); err != nil {
+		return err
+	}
+
+	// Keep the chunks already received
+	pending := []int{}
+	for i := range fi.Chunks {
+		offset, length := chunkRange(fi, i)
+		if ok, err := verifyChunk(f, offset, length, fi.Chunks[i]); err != nil {
+			return err
+		} else if ok {
+			tp.update(func(p *types.FileProgress) {
+				p.Received += length
+				p.Resumed += length
+				p.ChunksDone++
+			})
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	if len(pending) > 0 {
+		// Wait for a slot among the transfers received at once
+		if err := DefaultTransferLimiter.Inbound.Acquire(ctx); err != nil {
+			return errors.Wrapf(err, "waiting to receive file %s", fi.Name)
+		}
+		tCtx, op := operations.Start(ctx, operations.Transfer, fi.Name)
+		tCtx, cancel := context.WithCancel(tCtx)
+		pace := DefaultTransferLimiter.newPace()
+
+		work := make(chan int)
+		errs := make(chan error, len(pending))
+		wg := sync.WaitGroup{}
+		for w := 0; w < min(DefaultParallelChunks, len(pending)); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					if err := fetchChunk(tCtx, n, f, fi, i, seeders, pace, tp); err != nil {
+						errs <- err
+						cancel()
+						return
+					}
+				}
+			}()
+		}
+	feed:
+		for _, i := range pending {
+			select {
+			case work <- i:
+			case <-tCtx.Done():
+				break feed
+			}
+		}
+		close(work)
+		wg.Wait()
+		cancel()
+		op.Done()
+		DefaultTransferLimiter.Inbound.Release()
+		close(errs)
+		if err := <-errs; err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := tCtx.Err(); err != nil && err != context.Canceled {
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Rename(part, path)
+}
+
+// chunkRange returns the offset and the length of the chunk i of the file
+func chunkRange(fi *types.File, i int) (int64, int64) {
+	offset := int64(i) * fi.ChunkSize
+	return offset, min(fi.ChunkSize, fi.Size-offset)
+}
+
+// verifyChunk returns true if the range of f matches the hash
+func verifyChunk(f *os.File, offset, length int64, hash string) (bool, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, offset, length)); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == hash, nil
+}
+
+// fetchChunk fetches the chunk i of the file into f, starting from the seeder
+// i points to. An interrupted chunk is resumed from the bytes received, and a
+// chunk not matching its hash is fetched again from the next seeder.
+func fetchChunk(ctx context.Context, n *node.Node, f *os.File, fi *types.File, i int, seeders []peer.ID, pace *pace, tp *transferProgress) error {
+	offset, length := chunkRange(fi, i)
+	var received int64
+	var err error
+	for attempt := 0; attempt < chunkAttempts*len(seeders); attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		seeder := seeders[(i+attempt)%len(seeders)]
+		var c int64
+		c, err = fetchRange(ctx, n, seeder, f, fi.Name, offset+received, length-received, pace, tp)
+		received += c
+		if received < length {
+			continue
+		}
+		var ok bool
+		if ok, err = verifyChunk(f, offset, length, fi.Chunks[i]); err != nil {
+			return err
+		}
+		if ok {
+			tp.update(func(p *types.FileProgress) { p.ChunksDone++ })
+			return nil
+		}
+		err = fmt.Errorf("chunk %d from %s does not match its hash", i, seeder)
+		tp.update(func(p *types.FileProgress) { p.Received -= received })
+		received = 0
+	}
+	return errors.Wrapf(err, "receiving chunk %d of file %s", i, fi.Name)
+}
+
+// fetchRange asks the seeder for length bytes of the file from offset and
+// writes them at the same offset in f, returning the bytes written
+func fetchRange(ctx context.Context, n *node.Node, seeder peer.ID, f *os.File, file string, offset, length int64, pace *pace, tp *transferProgress) (int64, error) {
+	stream, err := n.Host().NewStream(ctx, seeder, protocol.FileChunkProtocol.ID())
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+	defer stop()
+
+	if err := json.NewEncoder(stream).Encode(chunkRequest{File: file, Offset: offset, Length: length}); err != nil {
+		stream.Reset()
+		return 0, err
+	}
+	r := bufio.NewReader(stream)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return 0, err
+	}
+	res := chunkResponse{}
+	if err := json.Unmarshal(line, &res); err != nil {
+		return 0, err
+	}
+	if res.Error != "" {
+		return 0, errors.New(res.Error)
+	}
+	if res.Length != length {
+		stream.Reset()
+		return 0, fmt.Errorf("%s sent %d bytes out of %d", seeder, res.Length, length)
+	}
+
+	c, err := pace.copy(io.MultiWriter(io.NewOffsetWriter(f, offset), tp), io.LimitReader(r, length))
+	if err == nil && c < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return c, err
+}
@@ -0,0 +1,220 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	p2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// ServiceConfig is the configuration of an exposed or a connected service
+type ServiceConfig struct {
+	// Compression enables compressing the service streams. It is negotiated
+	// at stream setup: streams are compressed only if both ends enable it.
+	Compression bool
+
+	// Network scopes the lookup of a connected service to the named network
+	Network string
+
+	// Ambiguity is the policy (AmbiguousError or AmbiguousFirst) applied to
+	// a connected service announced on more than one network
+	Ambiguity string
+
+	// Condition, when set, exposes the service only while it returns true
+	Condition func() bool
+
+	// Timeouts are applied to the connections proxied to the service
+	Timeouts types.ServiceTimeouts
+
+	// UDP forwards the datagrams of the service instead of TCP connections
+	UDP bool
+}
+
+type ServiceOption func(cfg *ServiceConfig) error
+
+// Apply applies the given options to the config, returning the first error
+// encountered (if any).
+func (cfg *ServiceConfig) Apply(opts ...ServiceOption) error {
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err := opt(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compression enables the compression of the service streams
+var Compression ServiceOption = func(cfg *ServiceConfig) error {
+	cfg.Compression = true
+	return nil
+}
+
+// WithNetwork scopes the lookup of a connected service to the named network
+func WithNetwork(name string) ServiceOption {
+	return func(cfg *ServiceConfig) error {
+		cfg.Network = name
+		return nil
+	}
+}
+
+// WithTimeouts sets the timeouts of the connections proxied to the service
+func WithTimeouts(t types.ServiceTimeouts) ServiceOption {
+	return func(cfg *ServiceConfig) error {
+		if t.Read < 0 || t.Write < 0 || t.Idle < 0 {
+			return fmt.Errorf("invalid service timeouts %+v: they can't be negative", t)
+		}
+		cfg.Timeouts = t
+		return nil
+	}
+}
+
+// WithAmbiguityPolicy sets how a connected service announced on more
+// than one network is resolved
+func WithAmbiguityPolicy(policy string) ServiceOption {
+	return func(cfg *ServiceConfig) error {
+		switch policy {
+		case "", AmbiguousError, AmbiguousFirst:
+			cfg.Ambiguity = policy
+			return nil
+		}
+		return fmt.Errorf("invalid ambiguity policy '%s'", policy)
+	}
+}
+
+// serviceCompression accounts the compression of the service streams of this node
+var serviceCompression = NewCompressionStats()
+
+// CompressionRatios returns the compression stats of the services
+// exposed or connected by this node
+func CompressionRatios() []types.CompressionStat {
+	return serviceCompression.List()
+}
+
+// ServiceProtocols returns the protocols to open a service stream with, the preferred first
+func ServiceProtocols(cfg ServiceConfig) []p2pprotocol.ID {
+	if cfg.Compression {
+		return []p2pprotocol.ID{protocol.ServiceDeflateProtocol.ID(), protocol.ServiceProtocol.ID()}
+	}
+	return []p2pprotocol.ID{protocol.ServiceProtocol.ID()}
+}
+
+// ServiceStream returns the stream to proxy the service traffic with, compressing
+// it if that was negotiated. The compression is accounted to the service.
+func ServiceStream(s network.Stream, service string) io.ReadWriter {
+	if s.Protocol() != protocol.ServiceDeflateProtocol.ID() {
+		return s
+	}
+	return newCompressedStream(s, serviceCompression.Track(service))
+}
+
+// CompressionStats keeps the per-service compression counters
+type CompressionStats struct {
+	sync.Mutex
+	services map[string]*CompressionCounter
+}
+
+// NewCompressionStats returns a new CompressionStats
+func NewCompressionStats() *CompressionStats {
+	return &CompressionStats{services: make(map[string]*CompressionCounter)}
+}
+
+// CompressionCounter counts the bytes of a service before and after compression
+type CompressionCounter struct {
+	payload, wire uint64
+}
+
+// Track returns the counter of the service
+func (s *CompressionStats) Track(service string) *CompressionCounter {
+	s.Lock()
+	defer s.Unlock()
+	c, exists := s.services[service]
+	if !exists {
+		c = &CompressionCounter{}
+		s.services[service] = c
+	}
+	return c
+}
+
+// List returns the compression stats of the services
+func (s *CompressionStats) List() []types.CompressionStat {
+	s.Lock()
+	defer s.Unlock()
+	res := []types.CompressionStat{}
+	for service, c := range s.services {
+		payload, wire := atomic.LoadUint64(&c.payload), atomic.LoadUint64(&c.wire)
+		stat := types.CompressionStat{Service: service, Payload: payload, Wire: wire}
+		if wire > 0 {
+			stat.Ratio = float64(payload) / float64(wire)
+		}
+		res = append(res, stat)
+	}
+	return res
+}
+
+// compressedStream deflates the data written to the stream, and inflates the one read
+type compressedStream struct {
+	r io.Reader
+	w *flate.Writer
+	c *CompressionCounter
+}
+
+func newCompressedStream(rw io.ReadWriter, c *CompressionCounter) *compressedStream {
+	// BestSpeed: the CPU cost matters more than squeezing the last bytes
+	w, _ := flate.NewWriter(&countingWriter{w: rw, n: &c.wire}, flate.BestSpeed)
+	return &compressedStream{
+		r: flate.NewReader(&countingReader{r: rw, n: &c.wire}),
+		w: w,
+		c: c,
+	}
+}
+
+func (s *compressedStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	atomic.AddUint64(&s.c.payload, uint64(n))
+	return n, err
+}
+
+func (s *compressedStream) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	atomic.AddUint64(&s.c.payload, uint64(n))
+	if err != nil {
+		return n, err
+	}
+	// Flush on each write, so interactive protocols are not held back
+	return n, s.w.Flush()
+}
+
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
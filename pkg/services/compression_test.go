@@ -0,0 +1,122 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services_test
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+)
+
+var _ = Describe("Service compression", func() {
+	newHost := func() host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+		return h
+	}
+
+	// expose sets an echo service on the host, with the protocols of the config
+	expose := func(h host.Host, service string, cfg ServiceConfig) {
+		echo := func(s network.Stream) {
+			defer s.Close()
+			rw := ServiceStream(s, service)
+			buf := make([]byte, 1024)
+			for {
+				n, err := rw.Read(buf)
+				if n > 0 {
+					rw.Write(buf[:n])
+				}
+				if err != nil {
+					return
+				}
+			}
+		}
+		for _, p := range ServiceProtocols(cfg) {
+			h.SetStreamHandler(p, echo)
+		}
+	}
+
+	connect := func(service string, exposed, connecting ServiceConfig) network.Stream {
+		server, client := newHost(), newHost()
+		expose(server, service, exposed)
+		Expect(client.Connect(context.Background(), peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()})).To(Succeed())
+
+		s, err := client.NewStream(context.Background(), server.ID(), ServiceProtocols(connecting)...)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(s.Close)
+		return s
+	}
+
+	roundTrip := func(s network.Stream, service, payload string) {
+		rw := ServiceStream(s, service)
+		_, err := rw.Write([]byte(payload))
+		Expect(err).ToNot(HaveOccurred())
+		got := make([]byte, len(payload))
+		_, err = io.ReadFull(rw, got)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(got)).To(Equal(payload))
+	}
+
+	It("compresses when both ends enable it", func() {
+		s := connect("logs", ServiceConfig{Compression: true}, ServiceConfig{Compression: true})
+		Expect(s.Protocol()).To(Equal(protocol.ServiceDeflateProtocol.ID()))
+
+		roundTrip(s, "logs", strings.Repeat("a log line which compresses well\n", 100))
+
+		var stat bool
+		for _, c := range CompressionRatios() {
+			if c.Service == "logs" {
+				stat = true
+				Expect(c.Wire).To(BeNumerically("<", c.Payload))
+				Expect(c.Ratio).To(BeNumerically(">", 1))
+			}
+		}
+		Expect(stat).To(BeTrue())
+	})
+
+	It("falls back to plain streams when one end does not enable it", func() {
+		s := connect("media", ServiceConfig{}, ServiceConfig{Compression: true})
+		Expect(s.Protocol()).To(Equal(protocol.ServiceProtocol.ID()))
+		roundTrip(s, "media", "payload")
+
+		s = connect("media", ServiceConfig{Compression: true}, ServiceConfig{})
+		Expect(s.Protocol()).To(Equal(protocol.ServiceProtocol.ID()))
+		roundTrip(s, "media", "payload")
+
+		for _, c := range CompressionRatios() {
+			Expect(c.Service).ToNot(Equal("media"))
+		}
+	})
+
+	It("accounts payload and wire bytes", func() {
+		c := NewCompressionStats()
+		Expect(c.List()).To(BeEmpty())
+		c.Track("foo")
+		Expect(c.List()).To(HaveLen(1))
+		Expect(c.List()[0].Ratio).To(BeZero())
+	})
+})
@@ -0,0 +1,90 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+)
+
+// WithCondition exposes the service only while the condition returns true.
+// The condition is evaluated at each announce, and the service is retracted
+// from the ledger as soon as it doesn't hold.
+func WithCondition(f func() bool) ServiceOption {
+	return func(cfg *ServiceConfig) error {
+		cfg.Condition = f
+		return nil
+	}
+}
+
+// ExposeConditionalService announces a group of services while the condition holds
+func ExposeConditionalService(ll log.StandardLogger, announcetime time.Duration, condition func() bool, serviceIDs ...string) node.NetworkService {
+	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		AnnounceServicesWhile(ctx, ll, b, n.Host().ID().String(), announcetime, condition, serviceIDs...)
+		return nil
+	}
+}
+
+// AnnounceServicesWhile announces the group of services of the peer at each interval
+// while the condition holds, and retracts them while it doesn't. It returns
+// immediately, and stops once the context is done.
+func AnnounceServicesWhile(ctx context.Context, ll log.StandardLogger, b *blockchain.Ledger, peerID string, interval time.Duration, condition func() bool, serviceIDs ...string) {
+	active := false
+	b.Announce(ctx, interval, func() {
+		if condition() {
+			if !active {
+				ll.Infof("Condition holds, announcing services %v", serviceIDs)
+				active = true
+			}
+			announceServices(b, peerID, serviceIDs...)
+			return
+		}
+		if active {
+			ll.Infof("Condition doesn't hold, retracting services %v", serviceIDs)
+			active = false
+		}
+		if batch := retraction(b, peerID, serviceIDs...); batch.Len() > 0 {
+			b.Commit(batch)
+		}
+	})
+}
+
+// FileCondition holds while the file at path exists
+func FileCondition(path string) func() bool {
+	return func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+}
+
+// HTTPCondition holds while a GET to the url succeeds with a 2xx status
+func HTTPCondition(url string, timeout time.Duration) func() bool {
+	client := &http.Client{Timeout: timeout}
+	return func() bool {
+		resp, err := client.Get(url)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode >= 200 && resp.StatusCode < 300
+	}
+}
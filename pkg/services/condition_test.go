@@ -0,0 +1,99 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Conditional services", func() {
+	It("announces the services only while the condition holds", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		var holds atomic.Bool
+		AnnounceServicesWhile(ctx, logger.New(log.LevelFatal), l, "me", 10*time.Millisecond, holds.Load, "a", "b")
+
+		services := func() map[string]blockchain.Data {
+			return l.CurrentData()[protocol.ServicesLedgerKey]
+		}
+		Consistently(services, 200*time.Millisecond).Should(BeEmpty())
+
+		// The announce backoff waits up to the initial interval after the first tick
+		holds.Store(true)
+		Eventually(services, 10*time.Second).Should(HaveLen(2))
+		s := types.Service{}
+		services()["a"].Unmarshal(&s)
+		Expect(s.PeerID).To(Equal("me"))
+
+		holds.Store(false)
+		Eventually(services, 5*time.Second).Should(BeEmpty())
+
+		holds.Store(true)
+		Eventually(services, 5*time.Second).Should(HaveLen(2))
+	})
+
+	It("doesn't retract the services taken over by other peers", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		l.Add(protocol.ServicesLedgerKey, map[string]interface{}{"a": types.Service{PeerID: "other", Name: "a"}})
+		AnnounceServicesWhile(ctx, logger.New(log.LevelFatal), l, "me", 10*time.Millisecond, func() bool { return false }, "a")
+
+		Consistently(func() map[string]blockchain.Data {
+			return l.CurrentData()[protocol.ServicesLedgerKey]
+		}, 200*time.Millisecond).Should(HaveKey("a"))
+	})
+
+	It("checks files and health endpoints", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "leader")
+		file := FileCondition(path)
+		Expect(file()).To(BeFalse())
+		Expect(os.WriteFile(path, []byte{}, 0644)).To(Succeed())
+		Expect(file()).To(BeTrue())
+
+		var healthy atomic.Bool
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+		url := HTTPCondition(srv.URL, time.Second)
+		Expect(url()).To(BeFalse())
+		healthy.Store(true)
+		Expect(url()).To(BeTrue())
+		srv.Close()
+		Expect(url()).To(BeFalse())
+	})
+})
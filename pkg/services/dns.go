@@ -19,6 +19,7 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -87,21 +88,11 @@ func (d dnsHandler) parseQuery(m *dns.Msg, forward bool) *dns.Msg {
 	d.ll.Debug("Received DNS request", m)
 	if len(m.Question) > 0 {
 		q := m.Question[0]
-		// Resolve the entry to an IP from the blockchain data
-		for k, v := range d.b.CurrentData()[protocol.DNSKey] {
-			r, err := regexp.Compile(k)
-			if err == nil && r.MatchString(q.Name) {
-				var res types.DNS
-				v.Unmarshal(&res)
-				if val, exists := res[dns.Type(q.Qtype)]; exists {
-					rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", q.Name, dns.TypeToString[q.Qtype], val))
-					if err == nil {
-						response.Answer = append(m.Answer, rr)
-						d.ll.Debug("Response from blockchain", response)
-						return response
-					}
-				}
-			}
+		// Resolve the entry from the blockchain data
+		if rr := ResolveDNS(d.b, q.Name, q.Qtype); len(rr) > 0 {
+			response.Answer = append(m.Answer, rr...)
+			d.ll.Debug("Response from blockchain", response)
+			return response
 		}
 		if forward {
 			d.ll.Debug("Forwarding DNS request", m)
@@ -115,6 +106,60 @@ func (d dnsHandler) parseQuery(m *dns.Msg, forward bool) *dns.Msg {
 	return response
 }
 
+// maxCNAMEDepth bounds the CNAME chains followed in the ledger
+const maxCNAMEDepth = 8
+
+// ResolveDNS returns the records of type qtype for name stored in the ledger.
+// A/AAAA/CNAME are answered by the first matching entry, while TXT and SRV
+// records are collected from all the matching entries.
+// If there is no record of the requested type but a CNAME matches,
+// the CNAME is returned along with the resolution of its target.
+func ResolveDNS(b *blockchain.Ledger, name string, qtype uint16) []dns.RR {
+	return resolveDNS(b.CurrentData()[protocol.DNSKey], name, qtype, 0)
+}
+
+func resolveDNS(records map[string]blockchain.Data, name string, qtype uint16, depth int) (answer []dns.RR) {
+	multi := qtype == dns.TypeTXT || qtype == dns.TypeSRV
+	cname := ""
+	for k, v := range records {
+		r, err := regexp.Compile(k)
+		if err != nil || !r.MatchString(name) {
+			continue
+		}
+		var res types.DNS
+		v.Unmarshal(&res)
+		if val, exists := res[dns.Type(qtype)]; exists {
+			for _, data := range strings.Split(val, "\n") {
+				if strings.TrimSpace(data) == "" {
+					continue
+				}
+				rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", name, dns.TypeToString[qtype], data))
+				if err == nil {
+					answer = append(answer, rr)
+				}
+				if !multi {
+					break
+				}
+			}
+			if len(answer) > 0 && !multi {
+				return
+			}
+		} else if val, exists := res[dns.Type(dns.TypeCNAME)]; exists && cname == "" {
+			cname = val
+		}
+	}
+
+	if len(answer) == 0 && cname != "" && depth < maxCNAMEDepth {
+		rr, err := dns.NewRR(fmt.Sprintf("%s CNAME %s", name, cname))
+		if err != nil {
+			return
+		}
+		answer = append(answer, rr)
+		answer = append(answer, resolveDNS(records, rr.(*dns.CNAME).Target, qtype, depth+1)...)
+	}
+	return
+}
+
 func (d dnsHandler) handleDNSRequest() func(w dns.ResponseWriter, r *dns.Msg) {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
 		var resp *dns.Msg
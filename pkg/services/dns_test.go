@@ -14,6 +14,7 @@ limitations under the License.
 package services_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"time"
@@ -26,6 +27,7 @@ import (
 	"github.com/mudler/edgevpn/pkg/blockchain"
 	"github.com/mudler/edgevpn/pkg/logger"
 	node "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
 	. "github.com/mudler/edgevpn/pkg/services"
 	"github.com/mudler/edgevpn/pkg/types"
 )
@@ -85,4 +87,62 @@ var _ = Describe("DNS service", func() {
 			Eventually(searchDomain("test.foo"), 230*time.Second, 1*time.Second).Should(ContainSubstring("2.2.2.2"))
 		})
 	})
+	Context("Ledger records", func() {
+		ledger := blockchain.New(&bytes.Buffer{}, &blockchain.MemoryStore{})
+		ledger.Add(protocol.DNSKey, map[string]interface{}{
+			`web\.mesh\.`: types.DNS{
+				dns.Type(dns.TypeA):   "10.1.0.2",
+				dns.Type(dns.TypeTXT): types.TXTRecord("version=1", "env=prod"),
+				dns.Type(dns.TypeSRV): types.SRVRecord(10, 5, 8080, "web.mesh") + "\n" + types.SRVRecord(20, 1, 8080, "backup.mesh"),
+			},
+			`www\.mesh\.`: types.DNS{
+				dns.Type(dns.TypeCNAME): types.CNAMERecord("web.mesh"),
+			},
+			`_http\._tcp\.mesh\.`: types.DNS{
+				dns.Type(dns.TypeSRV): types.SRVRecord(10, 1, 80, "other.mesh"),
+			},
+		})
+
+		It("resolves A records", func() {
+			rr := ResolveDNS(ledger, "web.mesh.", dns.TypeA)
+			Expect(rr).To(HaveLen(1))
+			Expect(rr[0].(*dns.A).A.String()).To(Equal("10.1.0.2"))
+		})
+
+		It("resolves TXT records", func() {
+			rr := ResolveDNS(ledger, "web.mesh.", dns.TypeTXT)
+			Expect(rr).To(HaveLen(1))
+			Expect(rr[0].(*dns.TXT).Txt).To(Equal([]string{"version=1", "env=prod"}))
+		})
+
+		It("resolves SRV records", func() {
+			rr := ResolveDNS(ledger, "web.mesh.", dns.TypeSRV)
+			Expect(rr).To(HaveLen(2))
+			srv := rr[0].(*dns.SRV)
+			Expect(srv.Priority).To(Equal(uint16(10)))
+			Expect(srv.Weight).To(Equal(uint16(5)))
+			Expect(srv.Port).To(Equal(uint16(8080)))
+			Expect(srv.Target).To(Equal("web.mesh."))
+			Expect(rr[1].(*dns.SRV).Target).To(Equal("backup.mesh."))
+
+			rr = ResolveDNS(ledger, "_http._tcp.mesh.", dns.TypeSRV)
+			Expect(rr).To(HaveLen(1))
+			Expect(rr[0].(*dns.SRV).Target).To(Equal("other.mesh."))
+		})
+
+		It("resolves CNAME records", func() {
+			rr := ResolveDNS(ledger, "www.mesh.", dns.TypeCNAME)
+			Expect(rr).To(HaveLen(1))
+			Expect(rr[0].(*dns.CNAME).Target).To(Equal("web.mesh."))
+
+			rr = ResolveDNS(ledger, "www.mesh.", dns.TypeA)
+			Expect(rr).To(HaveLen(2))
+			Expect(rr[0].(*dns.CNAME).Target).To(Equal("web.mesh."))
+			Expect(rr[1].(*dns.A).A.String()).To(Equal("10.1.0.2"))
+		})
+
+		It("returns nothing for unknown names", func() {
+			Expect(ResolveDNS(ledger, "unknown.mesh.", dns.TypeA)).To(BeEmpty())
+		})
+	})
 })
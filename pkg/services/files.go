@@ -17,37 +17,56 @@ package services
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/ipfs/go-log"
 	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/protocol"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mudler/edgevpn/pkg/blockchain"
+	internalCrypto "github.com/mudler/edgevpn/pkg/crypto"
+	"github.com/mudler/edgevpn/pkg/operations"
 	"github.com/mudler/edgevpn/pkg/types"
 	"github.com/pkg/errors"
 )
 
 func SharefileNetworkService(announcetime time.Duration, fileID string) node.NetworkService {
+	return sharefileNetworkService(announcetime, types.File{Name: fileID})
+}
+
+// sharefileNetworkService announces the file, and ourselves as a seeder of
+// it if it is shared in chunks. Another seeder of the same chunks is left as
+// the announced peer.
+func sharefileNetworkService(announcetime time.Duration, file types.File) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		file.PeerID = n.Host().ID().String()
+		seederKey := fmt.Sprintf("%s@%s", file.Name, file.PeerID)
 		// By announcing periodically our service to the blockchain
 		b.Announce(
 			ctx,
 			announcetime,
 			func() {
 				// Retrieve current ID for ip in the blockchain
-				existingValue, found := b.GetKey(protocol.FilesLedgerKey, fileID)
-				service := &types.Service{}
-				existingValue.Unmarshal(service)
+				existingValue, found := b.GetKey(protocol.FilesLedgerKey, file.Name)
+				existing := &types.File{}
+				existingValue.Unmarshal(existing)
+				seeder := len(file.Chunks) > 0 && slices.Equal(existing.Chunks, file.Chunks)
 				// If mismatch, update the blockchain
-				if !found || service.PeerID != n.Host().ID().String() {
-					updatedMap := map[string]interface{}{}
-					updatedMap[fileID] = types.File{PeerID: n.Host().ID().String(), Name: fileID}
-					b.Add(protocol.FilesLedgerKey, updatedMap)
+				if !found || (existing.PeerID != file.PeerID && !seeder) {
+					b.Add(protocol.FilesLedgerKey, map[string]interface{}{file.Name: file})
+				}
+				if len(file.Chunks) == 0 {
+					return
+				}
+				if _, found := b.GetKey(protocol.FileSeedersLedgerKey, seederKey); !found {
+					b.Add(protocol.FileSeedersLedgerKey, map[string]interface{}{seederKey: file})
 				}
 			},
 		)
@@ -58,16 +77,41 @@ func SharefileNetworkService(announcetime time.Duration, fileID string) node.Net
 // ShareFile shares a file to the p2p network.
 // meant to be called before a node is started with Start()
 func ShareFile(ll log.StandardLogger, announcetime time.Duration, fileID, filepath string) ([]node.Option, error) {
+	return ShareFileTo(ll, announcetime, fileID, filepath, "")
+}
+
+// ShareFileTo shares a file encrypted to the public key of the recipient,
+// so that only the recipient can decrypt it, whatever it goes through.
+// It is served only to the recipient. An empty recipient shares it in clear,
+// in chunks announced with their hashes, which the receivers can fetch from
+// all the peers sharing the same file.
+func ShareFileTo(ll log.StandardLogger, announcetime time.Duration, fileID, filepath string, recipient peer.ID) ([]node.Option, error) {
 	_, err := os.Stat(filepath)
 	if err != nil {
 		return nil, err
 	}
 
-	ll.Infof("Serving '%s' as '%s'", filepath, fileID)
+	file := types.File{Name: fileID}
+	var recipientKey crypto.PubKey
+	if recipient != "" {
+		if recipientKey, err = recipient.ExtractPublicKey(); err != nil {
+			return nil, errors.Wrapf(err, "public key of the recipient %s", recipient)
+		}
+		file.Recipient = recipient.String()
+		ll.Infof("Serving '%s' as '%s', encrypted to %s", filepath, fileID, recipient)
+	} else {
+		if file.Size, file.Chunks, err = hashChunks(filepath, DefaultChunkSize); err != nil {
+			return nil, errors.Wrapf(err, "hashing %s", filepath)
+		}
+		file.ChunkSize = DefaultChunkSize
+		chunkFiles.Store(fileID, filepath)
+		ll.Infof("Serving '%s' as '%s' in %d chunks", filepath, fileID, len(file.Chunks))
+	}
 	return []node.Option{
 		node.WithNetworkService(
-			SharefileNetworkService(announcetime, fileID),
+			sharefileNetworkService(announcetime, file),
 		),
+		node.WithStreamHandler(protocol.FileChunkProtocol, chunkStreamHandler(ll)),
 		node.WithStreamHandler(protocol.FileProtocol,
 			func(n *node.Node, l *blockchain.Ledger) func(stream network.Stream) {
 				return func(stream network.Stream) {
@@ -82,11 +126,40 @@ func ShareFile(ll log.StandardLogger, announcetime time.Duration, fileID, filepa
 							stream.Reset()
 							return
 						}
+						if recipient != "" && stream.Conn().RemotePeer() != recipient {
+							ll.Info("Reset", stream.Conn().RemotePeer().String(), "Not the recipient of the file")
+							stream.Reset()
+							return
+						}
+						// Wait for a slot among the transfers served at once,
+						// giving up if the peer goes away meanwhile
+						sctx, cancel := streamContext(stream)
+						defer cancel()
+						if err := DefaultTransferLimiter.Outbound.Acquire(sctx); err != nil {
+							ll.Infof("(file %s) Reset %s: %s", fileID, stream.Conn().RemotePeer().String(), err.Error())
+							stream.Reset()
+							return
+						}
+						defer DefaultTransferLimiter.Outbound.Release()
+
 						f, err := os.Open(filepath)
 						if err != nil {
+							stream.Reset()
 							return
 						}
-						io.Copy(stream, f)
+						ctx, op := operations.Start(sctx, operations.Transfer, fileID)
+						stop := context.AfterFunc(ctx, func() { stream.Reset() })
+						if recipientKey == nil {
+							DefaultTransferLimiter.Copy(stream, f)
+						} else if w, err := internalCrypto.EncryptTo(stream, recipientKey); err != nil {
+							ll.Errorf("(file %s) %s", fileID, err.Error())
+							stream.Reset()
+						} else {
+							DefaultTransferLimiter.Copy(w, f)
+							w.Close()
+						}
+						stop()
+						op.Done()
 						f.Close()
 						stream.Close()
 
@@ -97,7 +170,36 @@ func ShareFile(ll log.StandardLogger, announcetime time.Duration, fileID, filepa
 
 }
 
+// ErrReceiving is returned when a file is already being received to the path
+var ErrReceiving = errors.New("a file is already being received to this path")
+
+// ReceiveFile receives the file shared on the network to path.
+// Only one file at a time can be received to the same path.
 func ReceiveFile(ctx context.Context, ledger *blockchain.Ledger, n *node.Node, l log.StandardLogger, announcetime time.Duration, fileID string, path string) error {
+	if !fileProgress.claim(path) {
+		return ErrReceiving
+	}
+	defer fileProgress.release(path)
+	return receiveFile(ctx, ledger, n, l, announcetime, fileID, path)
+}
+
+// StartReceiveFile receives the file shared on the network to path in the
+// background, logging the failures. It returns ErrReceiving if a file is
+// already being received to the path.
+func StartReceiveFile(ctx context.Context, ledger *blockchain.Ledger, n *node.Node, l log.StandardLogger, announcetime time.Duration, fileID string, path string) error {
+	if !fileProgress.claim(path) {
+		return ErrReceiving
+	}
+	go func() {
+		defer fileProgress.release(path)
+		if err := receiveFile(ctx, ledger, n, l, announcetime, fileID, path); err != nil {
+			l.Warnf("receiving file %s: %s", fileID, err.Error())
+		}
+	}()
+	return nil
+}
+
+func receiveFile(ctx context.Context, ledger *blockchain.Ledger, n *node.Node, l log.StandardLogger, announcetime time.Duration, fileID string, path string) error {
 	// Announce ourselves so nodes accepts our connection
 	ledger.Announce(
 		ctx,
@@ -151,11 +253,46 @@ func ReceiveFile(ctx context.Context, ledger *blockchain.Ledger, n *node.Node, l
 					return err
 				}
 
+				var key crypto.PrivKey
+				if fi.Recipient != "" {
+					if fi.Recipient != n.Host().ID().String() {
+						return fmt.Errorf("file %s is encrypted to %s", fileID, fi.Recipient)
+					}
+					if key = n.Host().Peerstore().PrivKey(n.Host().ID()); key == nil {
+						return errors.New("no private key to decrypt the file")
+					}
+				}
+
+				tp := fileProgress.Track(fileID, path)
+				if fi.Recipient == "" && len(fi.Chunks) > 0 {
+					l.Infof("Saving file %s to %s", fileID, path)
+					err := receiveChunks(ctx, ledger, n, fi, path, tp)
+					tp.done(err)
+					if ctx.Err() != nil {
+						return errors.Wrapf(ctx.Err(), "receiving file %s", fileID)
+					}
+					if err != nil {
+						// The chunks received are kept for the next attempt
+						l.Warnf("receiving file %s: %s, retrying in 5 seconds", fileID, err.Error())
+						continue
+					}
+					l.Infof("Received file %s to %s", fileID, path)
+					return nil
+				}
+
 				l.Debug("file found on blockchain, opening stream to", d)
 
+				// Wait for a slot among the transfers received at once
+				if err := DefaultTransferLimiter.Inbound.Acquire(ctx); err != nil {
+					tp.done(err)
+					return errors.Wrapf(err, "waiting to receive file %s", fileID)
+				}
+
 				// Open a stream
 				stream, err := n.Host().NewStream(ctx, d, protocol.FileProtocol.ID())
 				if err != nil {
+					DefaultTransferLimiter.Inbound.Release()
+					tp.done(err)
 					l.Debugf("failed to dial %s, retrying in 5 seconds", d)
 					continue
 				}
@@ -164,11 +301,35 @@ func ReceiveFile(ctx context.Context, ledger *blockchain.Ledger, n *node.Node, l
 
 				f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 				if err != nil {
+					DefaultTransferLimiter.Inbound.Release()
+					stream.Reset()
+					tp.done(err)
 					return err
 				}
 
-				io.Copy(f, stream)
+				tCtx, op := operations.Start(ctx, operations.Transfer, fileID)
+				stop := context.AfterFunc(tCtx, func() { stream.Reset() })
+				w := io.MultiWriter(f, tp)
+				if key == nil {
+					DefaultTransferLimiter.Copy(w, stream)
+				} else {
+					// The encrypted stream fails if it is not complete
+					var r io.Reader
+					if r, err = internalCrypto.DecryptFor(stream, key); err == nil {
+						_, err = DefaultTransferLimiter.Copy(w, r)
+					}
+				}
+				stop()
+				DefaultTransferLimiter.Inbound.Release()
+				if tCtx.Err() != nil {
+					err = tCtx.Err()
+				}
+				op.Done()
 				f.Close()
+				tp.done(err)
+				if err != nil {
+					return errors.Wrapf(err, "receiving file %s", fileID)
+				}
 
 				l.Infof("Received file %s to %s", fileID, path)
 				return nil
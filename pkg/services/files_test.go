@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/ipfs/go-log"
@@ -28,6 +29,7 @@ import (
 	"github.com/mudler/edgevpn/pkg/logger"
 	node "github.com/mudler/edgevpn/pkg/node"
 	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
 )
 
 var _ = Describe("File services", func() {
@@ -82,5 +84,82 @@ var _ = Describe("File services", func() {
 				return string(b)
 			}, 190*time.Second, 1*time.Second).Should(Equal("testfile"))
 		})
+
+		It("resumes a file received in chunks", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			defaultChunkSize := DefaultChunkSize
+			DefaultChunkSize = 4
+			defer func() { DefaultChunkSize = defaultChunkSize }()
+
+			token := node.GenerateNewConnectionData(25).Base64()
+			content := "a file in many chunks"
+
+			src, err := ioutil.TempFile("", "test")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(src.Name())
+			ioutil.WriteFile(src.Name(), []byte(content), os.ModePerm)
+
+			dst, err := ioutil.TempFile("", "test")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dst.Name())
+			defer os.RemoveAll(dst.Name() + ".part")
+			// The first chunk was received by a previous attempt
+			ioutil.WriteFile(dst.Name()+".part", []byte("a fiXXXXXXXX"), os.ModePerm)
+
+			opts, err := ShareFile(logg, 10*time.Second, "chunked", src.Name())
+			Expect(err).ToNot(HaveOccurred())
+			opts = append(opts, node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+			e, _ := node.New(opts...)
+			e3, _ := node.New(
+				node.WithDiscoveryInterval(10*time.Second),
+				node.FromBase64(true, true, token, nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+
+			e.Start(ctx)
+			e3.Start(ctx)
+
+			Eventually(func() string {
+				ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+				defer cancel()
+
+				ll, _ := e3.Ledger()
+				ReceiveFile(ctx, ll, e3, logg, 2*time.Second, "chunked", dst.Name())
+				b, _ := ioutil.ReadFile(dst.Name())
+				return string(b)
+			}, 190*time.Second, 1*time.Second).Should(Equal(content))
+
+			Expect(dst.Name() + ".part").ToNot(BeAnExistingFile())
+			Expect(FileProgress()).To(ContainElement(And(
+				HaveField("Path", dst.Name()),
+				HaveField("State", types.FileTransferDone),
+				HaveField("Size", int64(len(content))),
+				HaveField("Received", int64(len(content))),
+				HaveField("Resumed", int64(4)),
+				HaveField("Chunks", 6),
+				HaveField("ChunksDone", 6),
+			)))
+		})
+
+		It("refuses a second receiver for the same path", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, _ := node.New(node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil), node.WithStore(&blockchain.MemoryStore{}), l)
+			e.Start(ctx)
+			ll, _ := e.Ledger()
+
+			dst := filepath.Join(os.TempDir(), "edgevpn-receive-test")
+			Expect(StartReceiveFile(ctx, ll, e, logg, 2*time.Second, "missing", dst)).To(Succeed())
+			Expect(ReceiveFile(ctx, ll, e, logg, 2*time.Second, "missing", dst)).To(MatchError(ErrReceiving))
+
+			// The path is free again once the receiver stops
+			cancel()
+			again, stop := context.WithCancel(context.Background())
+			defer stop()
+			Eventually(func() error {
+				return StartReceiveFile(again, ll, e, logg, 2*time.Second, "missing", dst)
+			}, 15*time.Second, 500*time.Millisecond).Should(Succeed())
+		})
 	})
 })
@@ -0,0 +1,119 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/mudler/edgevpn/internal"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// minFleetAnnounceTime is the lower bound for health summary announces,
+// to prevent nodes from flooding the ledger with summaries
+const minFleetAnnounceTime = 30 * time.Second
+
+// FleetNetworkService publishes periodically a compact health summary of the node
+// into the fleet bucket of the ledger.
+func FleetNetworkService(announcetime time.Duration) node.NetworkService {
+	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		if announcetime < minFleetAnnounceTime {
+			announcetime = minFleetAnnounceTime
+		}
+
+		started := time.Now()
+
+		var mu sync.Mutex
+		reachability := network.ReachabilityUnknown.String()
+
+		sub, err := n.Host().EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer sub.Close()
+			for {
+				select {
+				case e, ok := <-sub.Out():
+					if !ok {
+						return
+					}
+					mu.Lock()
+					reachability = e.(event.EvtLocalReachabilityChanged).Reachability.String()
+					mu.Unlock()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		last := time.Time{}
+		b.Announce(
+			ctx,
+			announcetime,
+			func() {
+				// Rate limit: the announce ticker backs off, so guard against
+				// announcing more often than requested
+				if time.Since(last) < announcetime {
+					return
+				}
+				last = time.Now()
+
+				mu.Lock()
+				r := reachability
+				mu.Unlock()
+
+				b.Add(protocol.FleetLedgerKey, map[string]interface{}{
+					n.Host().ID().String(): types.NodeHealth{
+						PeerID:       n.Host().ID().String(),
+						Peers:        len(n.Host().Network().Peers()),
+						Uptime:       int64(time.Since(started).Seconds()),
+						Version:      internal.Version,
+						Reachability: r,
+						Timestamp:    time.Now().UTC().Format(time.RFC3339),
+					},
+				})
+			},
+		)
+		return nil
+	}
+}
+
+// Fleet publishes the node health summary to the ledger every announcetime
+func Fleet(announcetime time.Duration) []node.Option {
+	return []node.Option{
+		node.WithNetworkService(FleetNetworkService(announcetime)),
+	}
+}
+
+// FleetStatus returns the health summaries published by the nodes in the ledger
+func FleetStatus(b *blockchain.Ledger) (fleet []types.NodeHealth) {
+	for _, v := range b.CurrentData()[protocol.FleetLedgerKey] {
+		h := types.NodeHealth{}
+		if err := v.Unmarshal(&h); err == nil {
+			fleet = append(fleet, h)
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services_test
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/ipfs/go-log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/internal"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Fleet", func() {
+	It("publishes the health summary of the node", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		l := logger.New(log.LevelFatal)
+		e, err := node.New(append(Fleet(time.Second),
+			node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil),
+			node.WithStore(&blockchain.MemoryStore{}),
+			node.ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			node.Logger(l),
+		)...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+
+		ledger, err := e.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(func() []types.NodeHealth { return FleetStatus(ledger) }, 20*time.Second, 500*time.Millisecond).Should(HaveLen(1))
+
+		h := FleetStatus(ledger)[0]
+		Expect(h.PeerID).To(Equal(e.Host().ID().String()))
+		Expect(h.Version).To(Equal(internal.Version))
+		Expect(h.Peers).To(Equal(0))
+		Expect(h.Reachability).ToNot(BeEmpty())
+		_, err = time.Parse(time.RFC3339, h.Timestamp)
+		Expect(err).ToNot(HaveOccurred())
+
+		// The summaries are published at most every 30 seconds
+		Consistently(func() []types.NodeHealth { return FleetStatus(ledger) }, 3*time.Second, 500*time.Millisecond).Should(Equal([]types.NodeHealth{h}))
+	})
+
+	It("rolls up the summaries of the nodes", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		Expect(FleetStatus(b)).To(BeEmpty())
+
+		fleet := []types.NodeHealth{
+			{PeerID: "a", Peers: 2, Uptime: 10, Version: "v1", Reachability: "Public"},
+			{PeerID: "b", Peers: 1, Uptime: 20, Version: "v2", Reachability: "Private"},
+		}
+		for _, h := range fleet {
+			b.Add(protocol.FleetLedgerKey, map[string]interface{}{h.PeerID: h})
+		}
+		Expect(FleetStatus(b)).To(ConsistOf(fleet))
+	})
+})
@@ -0,0 +1,220 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/internal"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// MaxProfileSize is the maximum size of a signed profile in the ledger:
+// profiles are meant for small metadata, larger ones are neither
+// published nor accepted
+const MaxProfileSize = 4096
+
+// MaxProfileAge is how long a signed profile is accepted, so an old one
+// can't be replayed: the nodes sign theirs again before it expires
+const MaxProfileAge = time.Hour
+
+// profileClockSkew is how far in the future a profile can be signed,
+// as the clocks of the peers drift
+const profileClockSkew = 5 * time.Minute
+
+// NewProfile returns the profile of the node running it
+func NewProfile(peerID string, capabilities, services []string) types.Profile {
+	return types.Profile{
+		PeerID:       peerID,
+		Version:      internal.Version,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Capabilities: capabilities,
+		Services:     services,
+	}
+}
+
+// SignProfile signs the profile with the key of the node it describes,
+// stamping it with the current time
+func SignProfile(p types.Profile, key crypto.PrivKey) (*types.SignedProfile, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if id.String() != p.PeerID {
+		return nil, fmt.Errorf("the key doesn't belong to the peer of the profile '%s'", p.PeerID)
+	}
+	p.Signed = time.Now().UTC().Truncate(time.Second)
+	dat, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(dat)
+	if err != nil {
+		return nil, err
+	}
+	sp := &types.SignedProfile{Profile: p, Signature: sig}
+	if err := checkProfileSize(*sp); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+func checkProfileSize(sp types.SignedProfile) error {
+	dat, err := json.Marshal(sp)
+	if err != nil {
+		return err
+	}
+	if len(dat) > MaxProfileSize {
+		return fmt.Errorf("profile of '%s' is %d bytes, over the maximum of %d", sp.Profile.PeerID, len(dat), MaxProfileSize)
+	}
+	return nil
+}
+
+// VerifyProfile checks that the profile is signed by the peer it describes
+func VerifyProfile(sp types.SignedProfile) error {
+	if err := checkProfileSize(sp); err != nil {
+		return err
+	}
+	id, err := peer.Decode(sp.Profile.PeerID)
+	if err != nil {
+		return err
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	dat, err := json.Marshal(sp.Profile)
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(dat, sp.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid signature of the profile of '%s'", sp.Profile.PeerID)
+	}
+	return nil
+}
+
+// PublishProfile adds the signed profile to the ledger
+func PublishProfile(b *blockchain.Ledger, sp *types.SignedProfile) {
+	b.Add(protocol.ProfileLedgerKey, map[string]interface{}{sp.Profile.PeerID: sp})
+}
+
+// PeerProfile returns the profile the peer published to the ledger,
+// failing if there is none, its signature doesn't verify or it is stale
+func PeerProfile(b *blockchain.Ledger, peerID string) (types.Profile, error) {
+	v, exists := b.GetKey(protocol.ProfileLedgerKey, peerID)
+	if !exists {
+		return types.Profile{}, fmt.Errorf("no profile published by '%s'", peerID)
+	}
+	sp := types.SignedProfile{}
+	if err := v.Unmarshal(&sp); err != nil {
+		return types.Profile{}, err
+	}
+	if sp.Profile.PeerID != peerID {
+		return types.Profile{}, fmt.Errorf("profile of '%s' published as '%s'", sp.Profile.PeerID, peerID)
+	}
+	if err := VerifyProfile(sp); err != nil {
+		return types.Profile{}, err
+	}
+	if age := time.Since(sp.Profile.Signed); age > MaxProfileAge || age < -profileClockSkew {
+		return types.Profile{}, fmt.Errorf("profile of '%s' signed at %s is stale", peerID, sp.Profile.Signed)
+	}
+	return sp.Profile, nil
+}
+
+// Profiles returns the profiles published to the ledger, skipping the ones
+// whose signature doesn't verify and the stale ones
+func Profiles(b *blockchain.Ledger) (profiles []types.Profile) {
+	for k := range b.CurrentData()[protocol.ProfileLedgerKey] {
+		if p, err := PeerProfile(b, k); err == nil {
+			profiles = append(profiles, p)
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].PeerID < profiles[j].PeerID })
+	return
+}
+
+// ProfileNetworkService publishes periodically the signed profile of the node
+// to the ledger, with the given capabilities and the services it exposes
+func ProfileNetworkService(announcetime time.Duration, capabilities ...string) node.NetworkService {
+	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		id := n.Host().ID()
+		key := n.Host().Peerstore().PrivKey(id)
+		if key == nil {
+			return fmt.Errorf("no private key for '%s'", id)
+		}
+
+		b.Announce(
+			ctx,
+			announcetime,
+			func() {
+				services := []string{}
+				for _, v := range b.CurrentData()[protocol.ServicesLedgerKey] {
+					s := &types.Service{}
+					if err := v.Unmarshal(s); err == nil && s.PeerID == id.String() {
+						services = append(services, s.Name)
+					}
+				}
+				sort.Strings(services)
+
+				p := NewProfile(id.String(), capabilities, services)
+				// Don't update the ledger until something changes,
+				// or the profile is about to expire
+				if current, err := PeerProfile(b, id.String()); err == nil && equalProfiles(current, p) &&
+					time.Since(current.Signed) < MaxProfileAge/2 {
+					return
+				}
+
+				sp, err := SignProfile(p, key)
+				if err != nil {
+					c.Logger.Error(err.Error())
+					return
+				}
+				PublishProfile(b, sp)
+			},
+		)
+		return nil
+	}
+}
+
+// equalProfiles compares the profiles, regardless of when they were signed
+func equalProfiles(a, b types.Profile) bool {
+	a.Signed, b.Signed = time.Time{}, time.Time{}
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+	return string(da) == string(db)
+}
+
+// Profile publishes the signed profile of the node to the ledger every announcetime
+func Profile(announcetime time.Duration, capabilities ...string) []node.Option {
+	return []node.Option{
+		node.WithNetworkService(ProfileNetworkService(announcetime, capabilities...)),
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Profiles", func() {
+	newKey := func() (crypto.PrivKey, string) {
+		key, _, err := crypto.GenerateEd25519Key(nil)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		return key, id.String()
+	}
+
+	It("publishes and retrieves a signed profile", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		key, id := newKey()
+
+		p := NewProfile(id, []string{"egress"}, []string{"web"})
+		Expect(p.OS).To(Equal(runtime.GOOS))
+		Expect(p.Arch).To(Equal(runtime.GOARCH))
+		sp, err := SignProfile(p, key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(VerifyProfile(*sp)).To(Succeed())
+
+		_, err = PeerProfile(b, id)
+		Expect(err).To(HaveOccurred())
+
+		Expect(sp.Profile.Signed).To(BeTemporally("~", time.Now(), 2*time.Second))
+		p.Signed = sp.Profile.Signed
+		Expect(sp.Profile).To(Equal(p))
+
+		PublishProfile(b, sp)
+		Expect(PeerProfile(b, id)).To(Equal(p))
+		Expect(Profiles(b)).To(Equal([]types.Profile{p}))
+	})
+
+	It("rejects the stale profiles", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		key, id := newKey()
+
+		// An old profile replayed, with a valid signature
+		sign := func(signed time.Time) *types.SignedProfile {
+			p := NewProfile(id, []string{"egress"}, nil)
+			p.Signed = signed.UTC().Truncate(time.Second)
+			dat, err := json.Marshal(p)
+			Expect(err).ToNot(HaveOccurred())
+			sig, err := key.Sign(dat)
+			Expect(err).ToNot(HaveOccurred())
+			return &types.SignedProfile{Profile: p, Signature: sig}
+		}
+		for _, signed := range []time.Time{{}, time.Now().Add(-2 * MaxProfileAge), time.Now().Add(time.Hour)} {
+			sp := sign(signed)
+			Expect(VerifyProfile(*sp)).To(Succeed())
+			PublishProfile(b, sp)
+			_, err := PeerProfile(b, id)
+			Expect(err).To(MatchError(ContainSubstring("stale")))
+			Expect(Profiles(b)).To(BeEmpty())
+		}
+
+		PublishProfile(b, sign(time.Now().Add(-MaxProfileAge/2)))
+		Expect(PeerProfile(b, id)).To(HaveField("Capabilities", []string{"egress"}))
+	})
+
+	It("rejects the profiles not signed by the peer they describe", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		key, id := newKey()
+		other, otherID := newKey()
+
+		_, err := SignProfile(NewProfile(id, nil, nil), other)
+		Expect(err).To(HaveOccurred())
+
+		// Tampered after signing
+		sp, err := SignProfile(NewProfile(id, []string{"egress"}, nil), key)
+		Expect(err).ToNot(HaveOccurred())
+		sp.Profile.Capabilities = []string{"egress", "relay"}
+		Expect(VerifyProfile(*sp)).ToNot(Succeed())
+		PublishProfile(b, sp)
+		_, err = PeerProfile(b, id)
+		Expect(err).To(HaveOccurred())
+
+		// A valid profile stored under another peer
+		sp, err = SignProfile(NewProfile(otherID, nil, nil), other)
+		Expect(err).ToNot(HaveOccurred())
+		b.Add(protocol.ProfileLedgerKey, map[string]interface{}{id: sp})
+		_, err = PeerProfile(b, id)
+		Expect(err).To(HaveOccurred())
+		Expect(Profiles(b)).To(BeEmpty())
+	})
+
+	It("keeps the profiles small", func() {
+		key, id := newKey()
+		_, err := SignProfile(NewProfile(id, []string{strings.Repeat("x", MaxProfileSize)}, nil), key)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("publishes the profile of the node with its services", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		l := logger.New(log.LevelFatal)
+		opts := append(RegisterService(l, 5*time.Second, "web", "127.0.0.1:80"), Profile(time.Second, "egress")...)
+		e, err := node.New(append(opts,
+			node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil),
+			node.WithStore(&blockchain.MemoryStore{}),
+			node.ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			node.Logger(l),
+		)...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+
+		ledger, err := e.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(func() []string {
+			p, _ := PeerProfile(ledger, e.Host().ID().String())
+			return p.Services
+		}, 20*time.Second, 500*time.Millisecond).Should(Equal([]string{"web"}))
+
+		p, err := PeerProfile(ledger, e.Host().ID().String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(p.Capabilities).To(Equal([]string{"egress"}))
+	})
+})
@@ -0,0 +1,151 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+const (
+	// maxQueryResponse bounds the size of a reply to a service query
+	maxQueryResponse = 1 << 20
+	// queryTimeout bounds the time spent replying to a service query
+	queryTimeout = 10 * time.Second
+)
+
+// exposedServices are the services currently exposed by the nodes of this process,
+// by node ID
+var exposedServices = struct {
+	sync.Mutex
+	nodes map[string]map[string]exposedService
+}{nodes: make(map[string]map[string]exposedService)}
+
+// exposedService is a service exposed by a node. The condition
+// is nil if the service is always exposed.
+type exposedService struct {
+	condition func() bool
+	timeouts  types.ServiceTimeouts
+}
+
+// trackExposed records the service as exposed by the node until the context is done
+func trackExposed(ctx context.Context, nodeID, serviceID string, condition func() bool, timeouts types.ServiceTimeouts) {
+	exposedServices.Lock()
+	if _, ok := exposedServices.nodes[nodeID]; !ok {
+		exposedServices.nodes[nodeID] = make(map[string]exposedService)
+	}
+	exposedServices.nodes[nodeID][serviceID] = exposedService{condition: condition, timeouts: timeouts}
+	exposedServices.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		exposedServices.Lock()
+		defer exposedServices.Unlock()
+		delete(exposedServices.nodes[nodeID], serviceID)
+		if len(exposedServices.nodes[nodeID]) == 0 {
+			delete(exposedServices.nodes, nodeID)
+		}
+	}()
+}
+
+// ExposedServices returns the services exposed by the node with the given ID
+func ExposedServices(nodeID string) []types.ExposedService {
+	exposedServices.Lock()
+	defer exposedServices.Unlock()
+	res := []types.ExposedService{}
+	for name, s := range exposedServices.nodes[nodeID] {
+		res = append(res, types.ExposedService{Name: name, Exposed: s.condition == nil || s.condition(), Timeouts: s.timeouts})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// ServiceQuery answers the peers asking which services are exposed by the node.
+// Only the peers in allowed get an answer, or, if none is given, the peers of
+// the network (with a healthcheck or a user in the ledger).
+func ServiceQuery(allowed ...string) []node.Option {
+	return []node.Option{
+		node.WithStreamHandler(protocol.ServiceQueryProtocol, queryHandler(allowed...)),
+	}
+}
+
+func queryHandler(allowed ...string) node.StreamHandler {
+	return func(n *node.Node, l *blockchain.Ledger) func(stream network.Stream) {
+		return func(stream network.Stream) {
+			remote := stream.Conn().RemotePeer().String()
+			if !queryAllowed(l, remote, allowed) {
+				stream.Reset()
+				return
+			}
+			stream.SetDeadline(time.Now().Add(queryTimeout))
+			if err := json.NewEncoder(stream).Encode(ExposedServices(n.Host().ID().String())); err != nil {
+				stream.Reset()
+				return
+			}
+			stream.Close()
+		}
+	}
+}
+
+func queryAllowed(l *blockchain.Ledger, remote string, allowed []string) bool {
+	if len(allowed) == 0 {
+		for _, bucket := range []string{protocol.HealthCheckKey, protocol.UsersLedgerKey} {
+			if _, found := l.GetKey(bucket, remote); found {
+				return true
+			}
+		}
+		return false
+	}
+	for _, a := range allowed {
+		if a == remote {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryServices asks the peer which services it exposes
+func QueryServices(ctx context.Context, h host.Host, p peer.ID) ([]types.ExposedService, error) {
+	start := time.Now()
+	stream, err := h.NewStream(ctx, p, protocol.ServiceQueryProtocol.ID())
+	metrics.StreamOpenLatency.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	res := []types.ExposedService{}
+	if err := json.NewDecoder(io.LimitReader(stream, maxQueryResponse)).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Service query", func() {
+	logg := logger.New(log.LevelFatal)
+
+	// start starts a node exposing the services, answering the queries of allowed
+	start := func(ctx context.Context, allowed []string, opts ...node.Option) *node.Node {
+		opts = append(opts,
+			node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil),
+			node.WithStore(&blockchain.MemoryStore{}),
+			node.ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			node.Logger(logg),
+		)
+		opts = append(opts, ServiceQuery(allowed...)...)
+		e, err := node.New(opts...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+		return e
+	}
+
+	client := func() host.Host {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+		return h
+	}
+
+	query := func(h host.Host, e *node.Node) ([]types.ExposedService, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		h.Peerstore().AddAddrs(e.Host().ID(), e.Host().Addrs(), time.Minute)
+		return QueryServices(ctx, h, e.Host().ID())
+	}
+
+	It("replies with the services exposed by the peer to the network members", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		opts := RegisterService(logg, 5*time.Second, "web", "127.0.0.1:80", WithTimeouts(types.ServiceTimeouts{Read: time.Second, Idle: time.Minute}))
+		opts = append(opts, RegisterService(logg, 5*time.Second, "db", "127.0.0.1:5432", WithCondition(func() bool { return false }))...)
+		e := start(ctx, nil, opts...)
+		h := client()
+
+		_, err := query(h, e)
+		Expect(err).To(HaveOccurred())
+
+		ledger, err := e.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+		ledger.Add(protocol.HealthCheckKey, map[string]interface{}{h.ID().String(): time.Now().UTC().Format(time.RFC3339)})
+
+		Eventually(func() []types.ExposedService {
+			list, _ := query(h, e)
+			return list
+		}, 10*time.Second, 100*time.Millisecond).Should(Equal([]types.ExposedService{
+			{Name: "db", Exposed: false},
+			{Name: "web", Exposed: true, Timeouts: types.ServiceTimeouts{Read: time.Second, Idle: time.Minute}},
+		}))
+	})
+
+	It("replies only to the allowed peers", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		e := start(ctx, []string{"someone-else"}, RegisterService(logg, 5*time.Second, "web", "127.0.0.1:80")...)
+		h := client()
+		ledger, err := e.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+		ledger.Add(protocol.HealthCheckKey, map[string]interface{}{h.ID().String(): time.Now().UTC().Format(time.RFC3339)})
+		Eventually(func() bool {
+			_, found := ledger.GetKey(protocol.HealthCheckKey, h.ID().String())
+			return found
+		}, 5*time.Second).Should(BeTrue())
+
+		_, err = query(h, e)
+		Expect(err).To(HaveOccurred())
+
+		allowed := start(ctx, []string{h.ID().String()})
+		opened := metrics.StreamOpenLatency.Snapshot().Count
+		list, err := query(h, allowed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(list).To(BeEmpty())
+		Expect(metrics.StreamOpenLatency.Snapshot().Count).To(Equal(opened + 1))
+	})
+})
@@ -0,0 +1,177 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// DefaultReapedBuckets are the buckets whose entries belong to a peer,
+// and are removed once the peer went away
+var DefaultReapedBuckets = []string{
+	protocol.HealthCheckKey,
+	protocol.MachinesLedgerKey,
+	protocol.UsersLedgerKey,
+	protocol.ServicesLedgerKey,
+	protocol.UpgradeLedgerKey,
+	protocol.ProfileLedgerKey,
+	protocol.FileSeedersLedgerKey,
+}
+
+// Reaper removes from the ledger the entries of the peers gone away, such
+// as the VPN addresses leased to them, instead of leaving them around until
+// someone overwrites them. A peer is gone when it sent no healthcheck for
+// MaxAge. As the healthchecks are scrubbed periodically, the reaper
+// remembers when it last saw each peer, and nothing is removed before it
+// has been running for MaxAge.
+type Reaper struct {
+	// Interval is the time between the scans of the ledger
+	Interval time.Duration
+	// MaxAge is how long a peer can go without a healthcheck
+	MaxAge time.Duration
+	// Buckets are scanned for the entries of the peers gone away
+	Buckets []string
+	// Pinned are the entries ("bucket/key") which are never removed
+	Pinned []string
+
+	sync.Mutex
+	start    time.Time
+	lastSeen map[string]time.Time
+}
+
+// NewReaper returns a Reaper scanning DefaultReapedBuckets
+func NewReaper(interval, maxAge time.Duration, pinned ...string) *Reaper {
+	return &Reaper{
+		Interval: interval,
+		MaxAge:   maxAge,
+		Buckets:  DefaultReapedBuckets,
+		Pinned:   pinned,
+		start:    time.Now(),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// Reap returns the node options to remove the entries of the peers gone away
+// at each interval, emitting an event for each removed entry
+func Reap(interval, maxAge time.Duration, pinned ...string) []node.Option {
+	r := NewReaper(interval, maxAge, pinned...)
+	return []node.Option{
+		node.WithNetworkService(func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+			go r.Run(ctx, b, n.Host().ID().String(), func(bucket, key string) {
+				c.Logger.Debugf("Reaped '%s' from bucket '%s'", key, bucket)
+				n.Emit(types.EventLedgerReaped, map[string]string{"bucket": bucket, "key": key})
+			})
+			return nil
+		}),
+	}
+}
+
+// Run scans the ledger at each interval until the context is done, and
+// calls reaped for each entry removed. self is never considered gone.
+func (r *Reaper) Run(ctx context.Context, b *blockchain.Ledger, self string, reaped func(bucket, key string)) {
+	t := time.NewTicker(r.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			batch, removed := r.Expired(b, self, time.Now())
+			if batch.Len() == 0 {
+				continue
+			}
+			b.Commit(batch)
+			if reaped != nil {
+				for _, e := range removed {
+					reaped(e[0], e[1])
+				}
+			}
+		}
+	}
+}
+
+// Expired returns the batch removing the entries of the peers gone away at
+// now, along with the bucket and key of each of them
+func (r *Reaper) Expired(b *blockchain.Ledger, self string, now time.Time) (*blockchain.Batch, [][2]string) {
+	r.Lock()
+	defer r.Unlock()
+
+	data := b.CurrentData()
+	for p, d := range data[protocol.HealthCheckKey] {
+		var s string
+		d.Unmarshal(&s)
+		if t, err := time.Parse(time.RFC3339, s); err == nil && t.After(r.lastSeen[p]) {
+			r.lastSeen[p] = t
+		}
+	}
+
+	gone := func(p string) bool {
+		if p == self {
+			return false
+		}
+		seen := r.start
+		if r.lastSeen[p].After(seen) {
+			seen = r.lastSeen[p]
+		}
+		return now.Sub(seen) >= r.MaxAge
+	}
+
+	batch := blockchain.NewBatch()
+	removed := [][2]string{}
+	for _, bucket := range r.Buckets {
+		for k, d := range data[bucket] {
+			if r.pinned(bucket, k) {
+				continue
+			}
+			p := k
+			if bucket != protocol.HealthCheckKey {
+				owner := struct{ PeerID string }{}
+				if err := d.Unmarshal(&owner); err != nil || owner.PeerID == "" {
+					continue
+				}
+				p = owner.PeerID
+			}
+			if gone(p) {
+				batch.Delete(bucket, k)
+				removed = append(removed, [2]string{bucket, k})
+			}
+		}
+	}
+
+	// Forget the peers gone away, they are judged from the start again
+	for p, t := range r.lastSeen {
+		if now.Sub(t) >= r.MaxAge {
+			delete(r.lastSeen, p)
+		}
+	}
+	return batch, removed
+}
+
+func (r *Reaper) pinned(bucket, key string) bool {
+	for _, p := range r.Pinned {
+		if p == bucket+"/"+key {
+			return true
+		}
+	}
+	return false
+}
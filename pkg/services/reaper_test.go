@@ -0,0 +1,112 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Ledger reaper", func() {
+	healthcheck := func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	It("removes the entries of the peers gone away after the deadline", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		l.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+			"10.1.0.1": types.Machine{PeerID: "gone", Address: "10.1.0.1"},
+			"10.1.0.2": types.Machine{PeerID: "alive", Address: "10.1.0.2"},
+			"10.1.0.3": types.Machine{PeerID: "pinned", Address: "10.1.0.3"},
+			"10.1.0.4": types.Machine{PeerID: "me", Address: "10.1.0.4"},
+		})
+		l.Add(protocol.ServicesLedgerKey, map[string]interface{}{
+			"web": types.Service{PeerID: "gone", Name: "web"},
+		})
+		l.Add(protocol.HealthCheckKey, map[string]interface{}{
+			"gone": healthcheck(time.Now().Add(-time.Hour)),
+		})
+
+		r := NewReaper(50*time.Millisecond, time.Second, "machines/10.1.0.3")
+		var m sync.Mutex
+		reaped := [][2]string{}
+		go r.Run(ctx, l, "me", func(bucket, key string) {
+			m.Lock()
+			defer m.Unlock()
+			reaped = append(reaped, [2]string{bucket, key})
+		})
+
+		// The alive peer keeps sending healthchecks
+		go func() {
+			for ctx.Err() == nil {
+				l.Add(protocol.HealthCheckKey, map[string]interface{}{"alive": healthcheck(time.Now())})
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+
+		// Nothing is removed before the reaper has been running for the deadline
+		machines := func() map[string]blockchain.Data { return l.CurrentData()[protocol.MachinesLedgerKey] }
+		Consistently(machines, 500*time.Millisecond, 50*time.Millisecond).Should(HaveLen(4))
+
+		Eventually(machines, 5*time.Second, 50*time.Millisecond).Should(HaveLen(3))
+		Expect(machines()).To(HaveKey("10.1.0.2"))
+		Expect(machines()).To(HaveKey("10.1.0.3"))
+		Expect(machines()).To(HaveKey("10.1.0.4"))
+		Expect(l.CurrentData()[protocol.ServicesLedgerKey]).To(BeEmpty())
+		Expect(l.CurrentData()[protocol.HealthCheckKey]).ToNot(HaveKey("gone"))
+		Expect(l.CurrentData()[protocol.HealthCheckKey]).To(HaveKey("alive"))
+
+		m.Lock()
+		defer m.Unlock()
+		Expect(reaped).To(ConsistOf(
+			[2]string{protocol.MachinesLedgerKey, "10.1.0.1"},
+			[2]string{protocol.ServicesLedgerKey, "web"},
+			[2]string{protocol.HealthCheckKey, "gone"},
+		))
+	})
+
+	It("keeps the peers whose healthchecks were scrubbed meanwhile", func() {
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		l.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+			"10.1.0.2": types.Machine{PeerID: "alive", Address: "10.1.0.2"},
+		})
+		r := NewReaper(time.Minute, time.Minute)
+		now := time.Now()
+
+		l.Add(protocol.HealthCheckKey, map[string]interface{}{"alive": healthcheck(now.Add(2 * time.Minute))})
+		batch, _ := r.Expired(l, "me", now.Add(2*time.Minute))
+		Expect(batch.Len()).To(BeZero())
+
+		l.DeleteBucket(protocol.HealthCheckKey)
+		batch, _ = r.Expired(l, "me", now.Add(2*time.Minute+30*time.Second))
+		Expect(batch.Len()).To(BeZero())
+
+		batch, removed := r.Expired(l, "me", now.Add(3*time.Minute+30*time.Second))
+		Expect(batch.Len()).To(Equal(1))
+		Expect(removed).To(Equal([][2]string{{protocol.MachinesLedgerKey, "10.1.0.2"}}))
+	})
+})
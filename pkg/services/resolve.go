@@ -0,0 +1,118 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+const (
+	// AmbiguousError fails the lookup of a service announced on more than one network
+	AmbiguousError = "error"
+	// AmbiguousFirst picks the first network (by name) announcing the service
+	AmbiguousFirst = "first"
+)
+
+var (
+	ErrServiceNotFound  = errors.New("service not found")
+	ErrAmbiguousService = errors.New("service found in more than one network")
+)
+
+// Network is a network the services are looked up in, and the node joined
+// to it the services are dialed from
+type Network struct {
+	Name   string
+	Ledger *blockchain.Ledger
+	Node   *node.Node
+}
+
+func (n Network) service(name string) (types.Service, bool) {
+	v, found := n.Ledger.GetKey(protocol.ServicesLedgerKey, name)
+	if !found {
+		return types.Service{}, false
+	}
+	s := types.Service{}
+	v.Unmarshal(&s)
+	s.Network = n.Name
+	return s, true
+}
+
+// ResolveService looks up the service by name. If network is set, only that
+// network is searched, otherwise all of them are, and a service announced
+// on more than one network is resolved according to the policy.
+func ResolveService(networks []Network, network, name, policy string) (Network, types.Service, error) {
+	candidates := []Network{}
+	for _, n := range networks {
+		if network == "" || n.Name == network {
+			candidates = append(candidates, n)
+		}
+	}
+	if network != "" && len(candidates) == 0 {
+		return Network{}, types.Service{}, fmt.Errorf("network '%s' not found", network)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+
+	var (
+		match   Network
+		service types.Service
+		found   []string
+	)
+	for _, n := range candidates {
+		s, ok := n.service(name)
+		if !ok {
+			continue
+		}
+		if len(found) == 0 {
+			match, service = n, s
+		}
+		found = append(found, n.Name)
+	}
+
+	switch {
+	case len(found) == 0:
+		return Network{}, types.Service{}, fmt.Errorf("%w: '%s'", ErrServiceNotFound, name)
+	case len(found) > 1 && policy != AmbiguousFirst:
+		return Network{}, types.Service{}, fmt.Errorf("%w: '%s' is announced on %v, select one of them", ErrAmbiguousService, name, found)
+	}
+	return match, service, nil
+}
+
+// ListServices returns the services announced on the networks,
+// each annotated with the network it was found in
+func ListServices(networks ...Network) []types.Service {
+	list := []types.Service{}
+	for _, n := range networks {
+		for k := range n.Ledger.CurrentData()[protocol.ServicesLedgerKey] {
+			if s, ok := n.service(k); ok {
+				list = append(list, s)
+			}
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Network != list[j].Network {
+			return list[i].Network < list[j].Network
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Service resolution", func() {
+	network := func(name string, services ...types.Service) Network {
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		m := map[string]interface{}{}
+		for _, s := range services {
+			m[s.Name] = s
+		}
+		l.Add(protocol.ServicesLedgerKey, m)
+		return Network{Name: name, Ledger: l}
+	}
+
+	var networks []Network
+
+	BeforeEach(func() {
+		networks = []Network{
+			network("office", types.Service{PeerID: "b", Name: "ssh"}, types.Service{PeerID: "b", Name: "web"}),
+			network("home", types.Service{PeerID: "a", Name: "ssh"}),
+		}
+	})
+
+	It("fails on a service found on more than one network", func() {
+		_, _, err := ResolveService(networks, "", "ssh", AmbiguousError)
+		Expect(err).To(MatchError(ErrAmbiguousService))
+		Expect(err.Error()).To(ContainSubstring("home"))
+		Expect(err.Error()).To(ContainSubstring("office"))
+	})
+
+	It("picks the first network by name with the first policy", func() {
+		n, s, err := ResolveService(networks, "", "ssh", AmbiguousFirst)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n.Name).To(Equal("home"))
+		Expect(s.PeerID).To(Equal("a"))
+		Expect(s.Network).To(Equal("home"))
+	})
+
+	It("scopes the lookup to the network", func() {
+		_, s, err := ResolveService(networks, "office", "ssh", AmbiguousError)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.PeerID).To(Equal("b"))
+
+		_, s, err = ResolveService(networks, "", "web", AmbiguousError)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Network).To(Equal("office"))
+	})
+
+	It("fails on unknown services and networks", func() {
+		_, _, err := ResolveService(networks, "home", "web", AmbiguousError)
+		Expect(err).To(MatchError(ErrServiceNotFound))
+
+		_, _, err = ResolveService(networks, "lab", "ssh", AmbiguousError)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("connects through the node of the network the service is found in", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		logg := logger.New(log.LevelFatal)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer c.Close()
+					io.Copy(c, c)
+				}()
+			}
+		}()
+
+		start := func(opts ...node.Option) (*node.Node, *blockchain.Ledger) {
+			e, err := node.New(append(opts,
+				node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil),
+				node.WithStore(&blockchain.MemoryStore{}),
+				node.ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+				node.Logger(logg),
+			)...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.Start(ctx)).To(Succeed())
+			l, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			return e, l
+		}
+
+		// The service is exposed on the office network, and announced on the lab one too
+		server, serverLedger := start(RegisterService(logg, 5*time.Second, "db", ln.Addr().String())...)
+		office, officeLedger := start()
+		lab, labLedger := start()
+		Expect(office.Host().Connect(ctx, peer.AddrInfo{ID: server.Host().ID(), Addrs: server.Host().Addrs()})).To(Succeed())
+		serverLedger.Add(protocol.UsersLedgerKey, map[string]interface{}{office.Host().ID().String(): types.User{PeerID: office.Host().ID().String()}})
+		officeLedger.Add(protocol.ServicesLedgerKey, map[string]interface{}{"db": types.Service{PeerID: server.Host().ID().String(), Name: "db"}})
+		labLedger.Add(protocol.ServicesLedgerKey, map[string]interface{}{"db": types.Service{PeerID: lab.Host().ID().String(), Name: "db"}})
+		Eventually(func() bool {
+			_, found := serverLedger.GetKey(protocol.UsersLedgerKey, office.Host().ID().String())
+			return found
+		}, 5*time.Second).Should(BeTrue())
+
+		local, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		address := local.Addr().String()
+		local.Close()
+
+		joined := []Network{{Name: "office", Ledger: officeLedger, Node: office}, {Name: "lab", Ledger: labLedger, Node: lab}}
+		Expect(ConnectNetworks(ctx, 5*time.Second, "db", address, joined, WithNetwork("home"))).ToNot(Succeed())
+		go ConnectNetworks(ctx, 5*time.Second, "db", address, joined, WithNetwork("office"))
+
+		Eventually(func() (string, error) {
+			c, err := net.Dial("tcp", address)
+			if err != nil {
+				return "", err
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := c.Write([]byte("ping")); err != nil {
+				return "", err
+			}
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(c, buf)
+			return string(buf), err
+		}, 15*time.Second, 500*time.Millisecond).Should(Equal("ping"))
+	})
+
+	It("lists the services with their network", func() {
+		Expect(ListServices(networks...)).To(Equal([]types.Service{
+			{PeerID: "a", Name: "ssh", Network: "home"},
+			{PeerID: "b", Name: "ssh", Network: "office"},
+			{PeerID: "b", Name: "web", Network: "office"},
+		}))
+	})
+})
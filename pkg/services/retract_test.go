@@ -0,0 +1,46 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services_test
+
+import (
+	"context"
+	"io"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Retract services", func() {
+	It("removes the services of the peer as a group", func() {
+		l := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		l.Add(protocol.ServicesLedgerKey, map[string]interface{}{
+			"a": types.Service{PeerID: "me", Name: "a"},
+			"b": types.Service{PeerID: "me", Name: "b"},
+			"c": types.Service{PeerID: "other", Name: "c"},
+		})
+		index := l.Index()
+
+		RetractServices(context.Background(), l, "me", 10*time.Millisecond, 5*time.Second, "a", "b", "c")
+
+		Expect(l.CurrentData()[protocol.ServicesLedgerKey]).To(HaveLen(1))
+		Expect(l.CurrentData()[protocol.ServicesLedgerKey]).To(HaveKey("c"))
+		Expect(l.Index()).To(Equal(index + 1))
+	})
+})
@@ -19,12 +19,16 @@ import (
 	"context"
 	"io"
 	"net"
+	"slices"
 	"time"
 
 	"github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	p2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/flow"
+	"github.com/mudler/edgevpn/pkg/metrics"
 	"github.com/mudler/edgevpn/pkg/node"
 	protocol "github.com/mudler/edgevpn/pkg/protocol"
 	"github.com/pkg/errors"
@@ -33,152 +37,315 @@ import (
 )
 
 func ExposeNetworkService(announcetime time.Duration, serviceID string) node.NetworkService {
+	return ExposeNetworkServices(announcetime, serviceID)
+}
+
+// ExposeNetworkServices announces a group of services. They are written to the
+// ledger with a single block, so peers see either all of them or none.
+func ExposeNetworkServices(announcetime time.Duration, serviceIDs ...string) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
 		b.Announce(
 			ctx,
 			announcetime,
 			func() {
-				// Retrieve current ID for ip in the blockchain
-				existingValue, found := b.GetKey(protocol.ServicesLedgerKey, serviceID)
-				service := &types.Service{}
-				existingValue.Unmarshal(service)
-				// If mismatch, update the blockchain
-				if !found || service.PeerID != n.Host().ID().String() {
-					updatedMap := map[string]interface{}{}
-					updatedMap[serviceID] = types.Service{PeerID: n.Host().ID().String(), Name: serviceID}
-					b.Add(protocol.ServicesLedgerKey, updatedMap)
-				}
+				announceServices(b, n.Host().ID().String(), serviceIDs...)
 			},
 		)
 		return nil
 	}
 }
 
+// announceServices writes the group of services to the ledger
+// if any is missing or mismatching
+func announceServices(b *blockchain.Ledger, self string, serviceIDs ...string) {
+	for _, serviceID := range serviceIDs {
+		existingValue, found := b.GetKey(protocol.ServicesLedgerKey, serviceID)
+		service := &types.Service{}
+		existingValue.Unmarshal(service)
+		if !found || service.PeerID != self {
+			batch := blockchain.NewBatch()
+			for _, id := range serviceIDs {
+				batch.Put(protocol.ServicesLedgerKey, id, types.Service{PeerID: self, Name: id})
+			}
+			b.Commit(batch)
+			return
+		}
+	}
+}
+
+// RetractServices removes a group of services announced by the peer from the ledger
+// with a single block. It keeps announcing the removal until the services are
+// gone from the ledger or timeout expires, and it blocks meanwhile.
+func RetractServices(ctx context.Context, b *blockchain.Ledger, peerID string, interval, timeout time.Duration, serviceIDs ...string) {
+	retract, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	b.Announce(retract, interval, func() {
+		if batch := retraction(b, peerID, serviceIDs...); batch.Len() > 0 {
+			b.Commit(batch)
+		}
+		if retraction(b, peerID, serviceIDs...).Len() == 0 {
+			cancel()
+		}
+	})
+	<-retract.Done()
+}
+
+// retraction returns the batch removing the services of the group
+// still announced by the peer
+func retraction(b *blockchain.Ledger, peerID string, serviceIDs ...string) *blockchain.Batch {
+	batch := blockchain.NewBatch()
+	for _, serviceID := range serviceIDs {
+		existingValue, found := b.GetKey(protocol.ServicesLedgerKey, serviceID)
+		service := &types.Service{}
+		existingValue.Unmarshal(service)
+		// Don't retract services taken over by other peers
+		if found && service.PeerID == peerID {
+			batch.Delete(protocol.ServicesLedgerKey, serviceID)
+		}
+	}
+	return batch
+}
+
 // ExposeService exposes a service to the p2p network.
 // meant to be called before a node is started with Start()
-func RegisterService(ll log.StandardLogger, announcetime time.Duration, serviceID, dstaddress string) []node.Option {
+func RegisterService(ll log.StandardLogger, announcetime time.Duration, serviceID, dstaddress string, opts ...ServiceOption) []node.Option {
+	cfg := &ServiceConfig{}
+	if err := cfg.Apply(opts...); err != nil {
+		return []node.Option{func(*node.Config) error { return err }}
+	}
+
 	ll.Infof("Exposing service '%s' (%s)", serviceID, dstaddress)
-	return []node.Option{
-		node.WithStreamHandler(protocol.ServiceProtocol, func(n *node.Node, l *blockchain.Ledger) func(stream network.Stream) {
-			return func(stream network.Stream) {
-				go func() {
-					ll.Infof("(service %s) Received connection from %s", serviceID, stream.Conn().RemotePeer().String())
-
-					// Retrieve current ID for ip in the blockchain
-					_, found := l.GetKey(protocol.UsersLedgerKey, stream.Conn().RemotePeer().String())
-					// If mismatch, update the blockchain
-					if !found {
-						ll.Debugf("Reset '%s': not found in the ledger", stream.Conn().RemotePeer().String())
-						stream.Reset()
-						return
-					}
+	expose := ExposeNetworkService(announcetime, serviceID)
+	if cfg.Condition != nil {
+		expose = ExposeConditionalService(ll, announcetime, cfg.Condition, serviceID)
+	}
+	o := []node.Option{
+		node.WithNetworkService(func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+			trackExposed(ctx, n.Host().ID().String(), serviceID, cfg.Condition, cfg.Timeouts)
+			return expose(ctx, c, n, b)
+		}),
+	}
+	if cfg.UDP {
+		return append(o, node.WithStreamHandler(protocol.ServiceUDPProtocol, udpServiceHandler(ll, serviceID, dstaddress, cfg.Condition, cfg.Timeouts)))
+	}
+	handler := serviceHandler(ll, serviceID, dstaddress, cfg.Condition, cfg.Timeouts)
+	o = append(o, node.WithStreamHandler(protocol.ServiceProtocol, handler))
+	if cfg.Compression {
+		o = append(o, node.WithStreamHandler(protocol.ServiceDeflateProtocol, handler))
+	}
+	return o
+}
 
-					ll.Infof("Connecting to '%s'", dstaddress)
-					c, err := net.Dial("tcp", dstaddress)
-					if err != nil {
-						ll.Debugf("Reset %s: %s", stream.Conn().RemotePeer().String(), err.Error())
-						stream.Reset()
-						return
-					}
-					closer := make(chan struct{}, 2)
-					go copyStream(closer, stream, c)
-					go copyStream(closer, c, stream)
-					<-closer
+// admitted returns true if the peer of the stream can use the service,
+// resetting the stream otherwise
+func admitted(ll log.StandardLogger, l *blockchain.Ledger, stream network.Stream, condition func() bool) bool {
+	// A conditional service takes no connection while retracted
+	if condition != nil && !condition() {
+		ll.Debugf("Reset '%s': service condition doesn't hold", stream.Conn().RemotePeer().String())
+		stream.Reset()
+		return false
+	}
+
+	// Retrieve current ID for ip in the blockchain
+	_, found := l.GetKey(protocol.UsersLedgerKey, stream.Conn().RemotePeer().String())
+	// If mismatch, update the blockchain
+	if !found {
+		ll.Debugf("Reset '%s': not found in the ledger", stream.Conn().RemotePeer().String())
+		stream.Reset()
+		return false
+	}
+	return true
+}
+
+func serviceHandler(ll log.StandardLogger, serviceID, dstaddress string, condition func() bool, timeouts types.ServiceTimeouts) node.StreamHandler {
+	return func(n *node.Node, l *blockchain.Ledger) func(stream network.Stream) {
+		return func(stream network.Stream) {
+			go func() {
+				ll.Infof("(service %s) Received connection from %s", serviceID, stream.Conn().RemotePeer().String())
+				if !admitted(ll, l, stream, condition) {
+					return
+				}
 
-					stream.Close()
+				ll.Infof("Connecting to '%s'", dstaddress)
+				c, err := net.Dial("tcp", dstaddress)
+				if err != nil {
+					ll.Debugf("Reset %s: %s", stream.Conn().RemotePeer().String(), err.Error())
+					stream.Reset()
+					return
+				}
+				start := time.Now()
+				counter := serviceStreams.Track(stream.ID(), serviceID, stream.Conn().RemotePeer().String())
+				defer counter.Close()
+
+				tp := newTimeoutProxy(timeouts, func() {
+					ll.Debugf("(service %s) Closing idle connection from '%s'", serviceID, stream.Conn().RemotePeer().String())
+					stream.Reset()
 					c.Close()
-					ll.Infof("(service %s) Handled correctly '%s'", serviceID, stream.Conn().RemotePeer().String())
-				}()
-			}
-		}),
-		node.WithNetworkService(ExposeNetworkService(announcetime, serviceID))}
+				})
+				s := tp.wrap(ServiceStream(stream, serviceID), stream)
+				tc := tp.wrap(c, c)
+				closer := make(chan struct{}, 2)
+				go copyStream(closer, counter.Out(s), tc)
+				go copyStream(closer, counter.In(tc), s)
+				<-closer
+
+				tp.stop()
+				stream.Close()
+				c.Close()
+				in, out := counter.Bytes()
+				n.ExportFlow(flow.NewFlow("service", serviceID, stream.Conn().RemotePeer().String(), n.Host().ID().String(), in, out, start))
+				ll.Infof("(service %s) Handled correctly '%s' (in: %d bytes, out: %d bytes)", serviceID, stream.Conn().RemotePeer().String(), in, out)
+			}()
+		}
+	}
 }
 
 // ConnectNetworkService returns a network service that binds to a service
-func ConnectNetworkService(announcetime time.Duration, serviceID string, srcaddr string) node.NetworkService {
+func ConnectNetworkService(announcetime time.Duration, serviceID string, srcaddr string, opts ...ServiceOption) node.NetworkService {
 	return func(ctx context.Context, c node.Config, node *node.Node, ledger *blockchain.Ledger) error {
-		// Open local port for listening
-		l, err := net.Listen("tcp", srcaddr)
-		if err != nil {
-			return err
-		}
-		//	ll.Info("Binding local port on", srcaddr)
+		return ConnectNetworks(ctx, announcetime, serviceID, srcaddr, []Network{{Name: node.NetworkName(), Ledger: ledger, Node: node}}, opts...)
+	}
+}
+
+// ConnectNetworks binds to a service looked up in the networks joined by the
+// nodes, and proxies the local connections to it through the node of the
+// network it is found in. A service announced on more networks is resolved
+// by the ambiguity policy, unless scoped to one of them with WithNetwork.
+func ConnectNetworks(ctx context.Context, announcetime time.Duration, serviceID string, srcaddr string, networks []Network, opts ...ServiceOption) error {
+	protectTag := node.ProtectService
+	cfg := &ServiceConfig{}
+	if err := cfg.Apply(opts...); err != nil {
+		return err
+	}
+	if len(networks) == 0 {
+		return errors.New("no networks to look up the service in")
+	}
+	names := []string{}
+	for _, n := range networks {
+		names = append(names, n.Name)
+	}
+	if cfg.Network != "" && !slices.Contains(names, cfg.Network) {
+		return errors.Errorf("service '%s' is scoped to network '%s', but the node joined %v", serviceID, cfg.Network, names)
+	}
+	ll := networks[0].Node.Logger()
+
+	// Open local port for listening
+	var l net.Listener
+	var pc net.PacketConn
+	var err error
+	if cfg.UDP {
+		pc, err = net.ListenPacket("udp", srcaddr)
+	} else {
+		l, err = net.Listen("tcp", srcaddr)
+	}
+	if err != nil {
+		return err
+	}
+	//	ll.Info("Binding local port on", srcaddr)
 
-		// Announce ourselves so nodes accepts our connection
+	// Announce ourselves so nodes accepts our connection
+	for _, n := range networks {
+		ledger, self := n.Ledger, n.Node.Host().ID().String()
 		ledger.Announce(
 			ctx,
 			announcetime,
 			func() {
 				// Retrieve current ID for ip in the blockchain
-				_, found := ledger.GetKey(protocol.UsersLedgerKey, node.Host().ID().String())
+				_, found := ledger.GetKey(protocol.UsersLedgerKey, self)
 				// If mismatch, update the blockchain
 				if !found {
 					updatedMap := map[string]interface{}{}
-					updatedMap[node.Host().ID().String()] = &types.User{
-						PeerID:    node.Host().ID().String(),
+					updatedMap[self] = &types.User{
+						PeerID:    self,
 						Timestamp: time.Now().String(),
 					}
 					ledger.Add(protocol.UsersLedgerKey, updatedMap)
 				}
 			},
 		)
+	}
 
-		defer l.Close()
-		for {
-			select {
-			case <-ctx.Done():
-				return errors.New("context canceled")
-			default:
-				// Listen for an incoming connection.
-				conn, err := l.Accept()
-				if err != nil {
-					//	ll.Error("Error accepting: ", err.Error())
-					continue
-				}
+	// dial opens a stream to the peer exposing the service, and protects
+	// the connection from the connection manager until release is called
+	dial := func(protocols ...p2pprotocol.ID) (stream network.Stream, release func(), err error) {
+		// Retrieve current ID for ip in the blockchain
+		match, service, err := ResolveService(networks, cfg.Network, serviceID, cfg.Ambiguity)
+		if err != nil {
+			ll.Warnf("could not resolve service '%s': %s", serviceID, err.Error())
+			return nil, nil, err
+		}
+		node := match.Node
 
-				//	ll.Info("New connection from", l.Addr().String())
-				// Handle connections in a new goroutine, forwarding to the p2p service
-				go func() {
-					// Retrieve current ID for ip in the blockchain
-					existingValue, found := ledger.GetKey(protocol.ServicesLedgerKey, serviceID)
-					service := &types.Service{}
-					existingValue.Unmarshal(service)
-					// If mismatch, update the blockchain
-					if !found {
-						conn.Close()
-						//	ll.Debugf("service '%s' not found on blockchain", serviceID)
-						return
-					}
+		// Decode the Peer
+		d, err := peer.Decode(service.PeerID)
+		if err != nil {
+			//	ll.Debugf("could not decode peer '%s'", service.PeerID)
+			return nil, nil, err
+		}
 
-					// Decode the Peer
-					d, err := peer.Decode(service.PeerID)
-					if err != nil {
-						conn.Close()
-						//	ll.Debugf("could not decode peer '%s'", service.PeerID)
-						return
-					}
+		// Open a stream
+		start := time.Now()
+		stream, err = node.Host().NewStream(ctx, d, protocols...)
+		metrics.StreamOpenLatency.Since(start)
+		if err != nil {
+			//	ll.Debugf("could not open stream '%s'", err.Error())
+			return nil, nil, err
+		}
 
-					// Open a stream
-					stream, err := node.Host().NewStream(ctx, d, protocol.ServiceProtocol.ID())
-					if err != nil {
-						conn.Close()
-						//	ll.Debugf("could not open stream '%s'", err.Error())
-						return
-					}
-					//	ll.Debugf("(service %s) Redirecting", serviceID, l.Addr().String())
+		// Don't let the connection manager trim the connection while in use
+		node.Protect(d, protectTag)
+		return stream, func() { node.Unprotect(d, protectTag) }, nil
+	}
 
-					closer := make(chan struct{}, 2)
-					go copyStream(closer, stream, conn)
-					go copyStream(closer, conn, stream)
-					<-closer
+	if cfg.UDP {
+		defer pc.Close()
+		return proxyUDP(ctx, pc, udpIdleTimeout(cfg.Timeouts), func() (network.Stream, func(), error) {
+			return dial(protocol.ServiceUDPProtocol.ID())
+		})
+	}
 
-					stream.Close()
-					conn.Close()
-					//	ll.Infof("(service %s) Done handling %s", serviceID, l.Addr().String())
-				}()
+	defer l.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.New("context canceled")
+		default:
+			// Listen for an incoming connection.
+			conn, err := l.Accept()
+			if err != nil {
+				//	ll.Error("Error accepting: ", err.Error())
+				continue
 			}
-		}
 
+			//	ll.Info("New connection from", l.Addr().String())
+			// Handle connections in a new goroutine, forwarding to the p2p service
+			go func() {
+				stream, release, err := dial(ServiceProtocols(*cfg)...)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				defer release()
+				//	ll.Debugf("(service %s) Redirecting", serviceID, l.Addr().String())
+
+				tp := newTimeoutProxy(cfg.Timeouts, func() {
+					stream.Reset()
+					conn.Close()
+				})
+				s := tp.wrap(ServiceStream(stream, serviceID), stream)
+				tc := tp.wrap(conn, conn)
+				closer := make(chan struct{}, 2)
+				go copyStream(closer, s, tc)
+				go copyStream(closer, tc, s)
+				<-closer
+
+				tp.stop()
+				stream.Close()
+				conn.Close()
+				//	ll.Infof("(service %s) Done handling %s", serviceID, l.Addr().String())
+			}()
+		}
 	}
 }
 
@@ -0,0 +1,130 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// serviceStreams accounts the streams handled by the services exposed by this node
+var serviceStreams = NewStreamStats()
+
+// ServiceStreams returns the stats of the streams currently open
+// towards the services exposed by this node
+func ServiceStreams() []types.StreamStat {
+	return serviceStreams.List()
+}
+
+// StreamStats keeps per-stream byte counters of proxied connections
+type StreamStats struct {
+	sync.Mutex
+	streams map[string]*StreamCounter
+}
+
+// NewStreamStats returns a new StreamStats
+func NewStreamStats() *StreamStats {
+	return &StreamStats{streams: make(map[string]*StreamCounter)}
+}
+
+// StreamCounter counts the bytes transferred over a single stream.
+// Counters are updated atomically, so writes don't contend on locks.
+type StreamCounter struct {
+	in, out uint64
+
+	id, service, peer string
+	started           time.Time
+	stats             *StreamStats
+
+	// sampling state for the throughput, guarded by the StreamStats lock
+	lastBytes  uint64
+	lastSample time.Time
+	rate       float64
+}
+
+// Track starts accounting for the stream id, opened by peer towards service
+func (s *StreamStats) Track(id, service, peer string) *StreamCounter {
+	now := time.Now()
+	c := &StreamCounter{id: id, service: service, peer: peer, started: now, lastSample: now, stats: s}
+	s.Lock()
+	s.streams[id] = c
+	s.Unlock()
+	return c
+}
+
+// List returns the stats of the tracked streams.
+// The throughput is sampled over the time elapsed since the previous call (at least a second).
+func (s *StreamStats) List() []types.StreamStat {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	res := []types.StreamStat{}
+	for _, c := range s.streams {
+		in, out := atomic.LoadUint64(&c.in), atomic.LoadUint64(&c.out)
+		if elapsed := now.Sub(c.lastSample); elapsed >= time.Second {
+			c.rate = float64(in+out-c.lastBytes) / elapsed.Seconds()
+			c.lastBytes = in + out
+			c.lastSample = now
+		}
+		res = append(res, types.StreamStat{
+			ID:         c.id,
+			Service:    c.service,
+			PeerID:     c.peer,
+			BytesIn:    in,
+			BytesOut:   out,
+			Throughput: c.rate,
+			Started:    c.started.UTC().Format(time.RFC3339),
+		})
+	}
+	return res
+}
+
+// In wraps w counting the bytes received from the peer
+func (c *StreamCounter) In(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: &c.in}
+}
+
+// Out wraps w counting the bytes sent to the peer
+func (c *StreamCounter) Out(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: &c.out}
+}
+
+// Bytes returns the bytes received from and sent to the peer
+func (c *StreamCounter) Bytes() (in, out uint64) {
+	return atomic.LoadUint64(&c.in), atomic.LoadUint64(&c.out)
+}
+
+// Close stops tracking the stream
+func (c *StreamCounter) Close() {
+	c.stats.Lock()
+	delete(c.stats.streams, c.id)
+	c.stats.Unlock()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
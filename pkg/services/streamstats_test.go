@@ -0,0 +1,49 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services_test
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/services"
+)
+
+var _ = Describe("Stream stats", func() {
+	It("accounts bytes per stream and drops closed streams", func() {
+		s := NewStreamStats()
+		c := s.Track("1", "web", "peer1")
+		s.Track("2", "db", "peer2")
+
+		buf := &bytes.Buffer{}
+		c.In(buf).Write([]byte("hello"))
+		c.Out(buf).Write([]byte("hi"))
+
+		Expect(s.List()).To(HaveLen(2))
+		for _, st := range s.List() {
+			if st.ID == "1" {
+				Expect(st.Service).To(Equal("web"))
+				Expect(st.PeerID).To(Equal("peer1"))
+				Expect(st.BytesIn).To(Equal(uint64(5)))
+				Expect(st.BytesOut).To(Equal(uint64(2)))
+			}
+		}
+
+		c.Close()
+		Expect(s.List()).To(HaveLen(1))
+		Expect(s.List()[0].ID).To(Equal("2"))
+	})
+})
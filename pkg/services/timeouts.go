@@ -0,0 +1,116 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// deadliner is an end of a proxied connection supporting deadlines,
+// as the TCP connections and the libp2p streams
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+// timeoutProxy enforces the timeouts of a service on the ends of a proxied
+// connection: a read fails, ending the copy, once no data went through the
+// connection in either direction for longer than the read timeout, a write
+// exceeding its timeout fails, and the connection is closed once idle for
+// longer than the idle timeout.
+type timeoutProxy struct {
+	timeouts types.ServiceTimeouts
+	idle     *time.Timer
+	once     sync.Once
+
+	sync.Mutex
+	ends []deadliner
+}
+
+// newTimeoutProxy returns a timeoutProxy calling onIdle when the connection goes idle
+func newTimeoutProxy(t types.ServiceTimeouts, onIdle func()) *timeoutProxy {
+	p := &timeoutProxy{timeouts: t}
+	if t.Idle > 0 {
+		p.idle = time.AfterFunc(t.Idle, func() { p.once.Do(onIdle) })
+	}
+	return p
+}
+
+// wrap returns rw enforcing the timeouts, with the deadlines set on d
+func (p *timeoutProxy) wrap(rw io.ReadWriter, d deadliner) io.ReadWriter {
+	if p.timeouts == (types.ServiceTimeouts{}) {
+		return rw
+	}
+	p.Lock()
+	p.ends = append(p.ends, d)
+	p.Unlock()
+	return &timeoutEnd{p: p, rw: rw, d: d}
+}
+
+// touch postpones the idle timeout, and the read deadlines of all the ends,
+// so that a transfer in one direction keeps the other one waiting
+func (p *timeoutProxy) touch() {
+	if p.idle != nil {
+		p.idle.Reset(p.timeouts.Idle)
+	}
+	if p.timeouts.Read > 0 {
+		deadline := time.Now().Add(p.timeouts.Read)
+		p.Lock()
+		for _, d := range p.ends {
+			d.SetReadDeadline(deadline)
+		}
+		p.Unlock()
+	}
+}
+
+// stop stops the idle timer, once the connection is closed
+func (p *timeoutProxy) stop() {
+	if p.idle != nil {
+		p.idle.Stop()
+	}
+}
+
+type timeoutEnd struct {
+	p  *timeoutProxy
+	rw io.ReadWriter
+	d  deadliner
+}
+
+func (e *timeoutEnd) Read(b []byte) (int, error) {
+	if e.p.timeouts.Read > 0 {
+		e.d.SetReadDeadline(time.Now().Add(e.p.timeouts.Read))
+	}
+	n, err := e.rw.Read(b)
+	if n > 0 {
+		e.p.touch()
+	}
+	return n, err
+}
+
+func (e *timeoutEnd) Write(b []byte) (int, error) {
+	if e.p.timeouts.Write > 0 {
+		e.d.SetWriteDeadline(time.Now().Add(e.p.timeouts.Write))
+	}
+	n, err := e.rw.Write(b)
+	if n > 0 {
+		e.p.touch()
+	}
+	return n, err
+}
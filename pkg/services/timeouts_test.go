@@ -0,0 +1,166 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Service timeouts", func() {
+	logg := logger.New(log.LevelFatal)
+
+	// backend listens for the service connections, and echoes the data if echo is set
+	backend := func(echo bool) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(ln.Close)
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer c.Close()
+					if echo {
+						io.Copy(c, c)
+					} else {
+						io.Copy(io.Discard, c)
+					}
+				}()
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	// open exposes the service and opens a service stream to it from another host
+	open := func(ctx context.Context, address string, opts ...ServiceOption) network.Stream {
+		e, err := node.New(append(RegisterService(logg, 5*time.Second, "db", address, opts...),
+			node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil),
+			node.WithStore(&blockchain.MemoryStore{}),
+			node.ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			node.Logger(logg),
+		)...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+
+		// Only the users in the ledger can connect to the services
+		ledger, err := e.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+		ledger.Add(protocol.UsersLedgerKey, map[string]interface{}{h.ID().String(): types.User{PeerID: h.ID().String()}})
+		Eventually(func() bool {
+			_, found := ledger.GetKey(protocol.UsersLedgerKey, h.ID().String())
+			return found
+		}, 5*time.Second).Should(BeTrue())
+
+		Expect(h.Connect(ctx, peer.AddrInfo{ID: e.Host().ID(), Addrs: e.Host().Addrs()})).To(Succeed())
+		s, err := h.NewStream(ctx, e.Host().ID(), protocol.ServiceProtocol.ID())
+		Expect(err).ToNot(HaveOccurred())
+		// The stream may have been reset by the timeouts
+		DeferCleanup(func() { s.Close() })
+		return s
+	}
+
+	// closedWithin returns true if the stream is closed within d
+	closedWithin := func(s network.Stream, d time.Duration) bool {
+		s.SetReadDeadline(time.Now().Add(d))
+		_, err := io.Copy(io.Discard, s)
+		return err == nil || !isTimeout(err)
+	}
+
+	It("closes the connections waiting on the service for longer than the read timeout", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := open(ctx, backend(false), WithTimeouts(types.ServiceTimeouts{Read: 500 * time.Millisecond}))
+		_, err := s.Write([]byte("SELECT SLEEP(60)"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(closedWithin(s, 5*time.Second)).To(BeTrue())
+	})
+
+	It("keeps the connections transferring in one direction past the read timeout", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := open(ctx, backend(false), WithTimeouts(types.ServiceTimeouts{Read: 500 * time.Millisecond}))
+		// The service never answers, but the upload keeps the connection open
+		for i := 0; i < 15; i++ {
+			_, err := s.Write([]byte("INSERT"))
+			Expect(err).ToNot(HaveOccurred())
+			time.Sleep(100 * time.Millisecond)
+		}
+		Expect(closedWithin(s, 200*time.Millisecond)).To(BeFalse())
+		Expect(closedWithin(s, 5*time.Second)).To(BeTrue())
+	})
+
+	It("keeps the connections of the services without timeouts", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := open(ctx, backend(false))
+		_, err := s.Write([]byte("SELECT SLEEP(60)"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(closedWithin(s, 2*time.Second)).To(BeFalse())
+	})
+
+	It("closes the idle connections", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := open(ctx, backend(true), WithTimeouts(types.ServiceTimeouts{Idle: time.Second}))
+
+		// The traffic keeps the connection open past the idle timeout
+		buf := make([]byte, 4)
+		for i := 0; i < 4; i++ {
+			_, err := s.Write([]byte("ping"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = io.ReadFull(s, buf)
+			Expect(err).ToNot(HaveOccurred())
+			time.Sleep(500 * time.Millisecond)
+		}
+		Expect(closedWithin(s, 5*time.Second)).To(BeTrue())
+	})
+
+	It("rejects negative timeouts", func() {
+		Expect((&ServiceConfig{}).Apply(WithTimeouts(types.ServiceTimeouts{Read: -time.Second}))).ToNot(Succeed())
+	})
+})
+
+func isTimeout(err error) bool {
+	t, ok := err.(interface{ Timeout() bool })
+	return ok && t.Timeout()
+}
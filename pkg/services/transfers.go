@@ -0,0 +1,348 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// DefaultTransferLimiter bounds the file transfers of the process
+var DefaultTransferLimiter = NewTransferLimiter(0, 0, 0)
+
+// TransferLimiter caps the file transfers running at once, the ones received
+// and the ones served separately: the others are queued, up to a bound, and
+// start in arrival order. It also caps the bandwidth of each transfer.
+type TransferLimiter struct {
+	Inbound, Outbound *TransferSlots
+	bytesPerSecond    atomic.Int64
+}
+
+// NewTransferLimiter returns a TransferLimiter allowing inbound received and
+// outbound served transfers at once, each up to bytesPerSecond.
+// 0 means no limit.
+func NewTransferLimiter(inbound, outbound int, bytesPerSecond int64) *TransferLimiter {
+	t := &TransferLimiter{
+		Inbound:  NewTransferSlots(inbound),
+		Outbound: NewTransferSlots(outbound),
+	}
+	t.bytesPerSecond.Store(bytesPerSecond)
+	return t
+}
+
+// SetLimits changes the transfers allowed at once and their bandwidth
+func (t *TransferLimiter) SetLimits(inbound, outbound int, bytesPerSecond int64) {
+	t.Inbound.SetLimit(inbound)
+	t.Outbound.SetLimit(outbound)
+	t.bytesPerSecond.Store(bytesPerSecond)
+}
+
+// Stats returns the transfers running and queued
+func (t *TransferLimiter) Stats() types.FileTransfers {
+	queue := func(q *TransferSlots) types.TransferQueue {
+		return types.TransferQueue{Active: q.Active(), Queued: q.Queued(), Limit: q.Limit()}
+	}
+	return types.FileTransfers{
+		Inbound:        queue(t.Inbound),
+		Outbound:       queue(t.Outbound),
+		BytesPerSecond: t.bytesPerSecond.Load(),
+	}
+}
+
+// DefaultMaxQueuedTransfers bounds the transfers waiting for a slot
+const DefaultMaxQueuedTransfers = 64
+
+// ErrTransferQueueFull is returned when too many transfers wait for a slot
+var ErrTransferQueueFull = errors.New("too many file transfers queued")
+
+// TransferSlots caps the transfers running at once. The ones exceeding the
+// limit are queued, up to DefaultMaxQueuedTransfers, and start in arrival order.
+type TransferSlots struct {
+	sync.Mutex
+	limit, active, maxQueued int
+	queue                    []chan struct{}
+}
+
+// NewTransferSlots returns TransferSlots allowing limit transfers at once.
+// 0 means no limit.
+func NewTransferSlots(limit int) *TransferSlots {
+	return &TransferSlots{limit: limit, maxQueued: DefaultMaxQueuedTransfers}
+}
+
+// SetLimit changes the transfers allowed at once, 0 means no limit
+func (q *TransferSlots) SetLimit(limit int) {
+	q.Lock()
+	q.limit = limit
+	q.Unlock()
+	q.wake()
+}
+
+// SetMaxQueued changes the transfers allowed to wait for a slot,
+// 0 means no limit
+func (q *TransferSlots) SetMaxQueued(max int) {
+	q.Lock()
+	q.maxQueued = max
+	q.Unlock()
+}
+
+// Active returns the transfers currently running
+func (q *TransferSlots) Active() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.active
+}
+
+// Queued returns the transfers waiting for a slot
+func (q *TransferSlots) Queued() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.queue)
+}
+
+// Limit returns the transfers allowed at once, 0 means no limit
+func (q *TransferSlots) Limit() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.limit
+}
+
+// Acquire waits for a free slot, or for ctx to be done.
+// It fails with ErrTransferQueueFull if the queue is full already.
+func (q *TransferSlots) Acquire(ctx context.Context) error {
+	q.Lock()
+	if len(q.queue) == 0 && (q.limit <= 0 || q.active < q.limit) {
+		q.active++
+		q.Unlock()
+		return nil
+	}
+	if q.maxQueued > 0 && len(q.queue) >= q.maxQueued {
+		q.Unlock()
+		return ErrTransferQueueFull
+	}
+	ready := make(chan struct{})
+	q.queue = append(q.queue, ready)
+	q.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		q.Lock()
+		for i, c := range q.queue {
+			if c == ready {
+				q.queue = append(q.queue[:i], q.queue[i+1:]...)
+				q.Unlock()
+				return ctx.Err()
+			}
+		}
+		q.Unlock()
+		// The slot was handed over meanwhile, give it back
+		q.Release()
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken with Acquire
+func (q *TransferSlots) Release() {
+	q.Lock()
+	q.active--
+	q.Unlock()
+	q.wake()
+}
+
+// wake hands the free slots over to the queued transfers, in order
+func (q *TransferSlots) wake() {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.queue) > 0 && (q.limit <= 0 || q.active < q.limit) {
+		q.active++
+		close(q.queue[0])
+		q.queue = q.queue[1:]
+	}
+}
+
+// Copy copies src to dst within the bandwidth limit of a transfer
+func (t *TransferLimiter) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return t.newPace().copy(dst, src)
+}
+
+// newPace returns the pace of a transfer, nil if there is no bandwidth limit
+func (t *TransferLimiter) newPace() *pace {
+	bps := t.bytesPerSecond.Load()
+	if bps <= 0 {
+		return nil
+	}
+	return &pace{bytesPerSecond: bps, start: time.Now()}
+}
+
+// pace keeps the bytes written by the copies of a transfer at most
+// bytesPerSecond on average since start. The copies can run concurrently,
+// sharing the bandwidth of the transfer.
+type pace struct {
+	sync.Mutex
+	bytesPerSecond int64
+	start          time.Time
+	written        int64
+}
+
+// copy copies src to dst at the pace, or as fast as possible with a nil pace
+func (p *pace) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if p == nil {
+		return io.Copy(dst, src)
+	}
+	return io.Copy(&throttledWriter{w: dst, pace: p}, src)
+}
+
+// wait accounts the bytes written, and waits until they are due
+func (p *pace) wait(n int) {
+	p.Lock()
+	p.written += int64(n)
+	due := time.Duration(float64(p.written) / float64(p.bytesPerSecond) * float64(time.Second))
+	p.Unlock()
+	if wait := due - time.Since(p.start); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// throttledWriter writes at the pace of its transfer
+type throttledWriter struct {
+	w    io.Writer
+	pace *pace
+}
+
+func (t *throttledWriter) Write(p []byte) (n int, err error) {
+	// Write in slices of a tenth of a second, so the rate stays smooth
+	slice := int(t.pace.bytesPerSecond / 10)
+	if slice < 1 {
+		slice = 1
+	}
+	for len(p) > 0 {
+		c := min(slice, len(p))
+		w, err := t.w.Write(p[:c])
+		n += w
+		if err != nil {
+			return n, err
+		}
+		p = p[c:]
+		t.pace.wait(w)
+	}
+	return n, nil
+}
+
+// fileProgress tracks the files received by this node
+var fileProgress = &progressTracker{transfers: map[string]*transferProgress{}}
+
+// FileProgress returns the progress of the files received by this node,
+// the running ones and the last ones completed or failed
+func FileProgress() []types.FileProgress {
+	return fileProgress.List()
+}
+
+// progressTracker keeps the progress of the received files, by path
+type progressTracker struct {
+	sync.Mutex
+	transfers map[string]*transferProgress
+	// receiving are the paths claimed by the running receivers
+	receiving map[string]bool
+}
+
+// transferProgress is the progress of a file being received
+type transferProgress struct {
+	sync.Mutex
+	p types.FileProgress
+}
+
+// Track starts tracking the transfer of the file to path,
+// replacing the previous transfer to the same path
+func (t *progressTracker) Track(file, path string) *transferProgress {
+	tp := &transferProgress{p: types.FileProgress{File: file, Path: path, State: types.FileTransferRunning, Started: time.Now()}}
+	t.Lock()
+	t.transfers[path] = tp
+	t.Unlock()
+	return tp
+}
+
+// claim reserves the path for a receiver, false if another one is running
+func (t *progressTracker) claim(path string) bool {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.receiving == nil {
+		t.receiving = map[string]bool{}
+	}
+	if t.receiving[path] {
+		return false
+	}
+	t.receiving[path] = true
+	return true
+}
+
+// release frees the path claimed by a receiver
+func (t *progressTracker) release(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	t.Lock()
+	delete(t.receiving, path)
+	t.Unlock()
+}
+
+// List returns the progress of the tracked transfers, sorted by path
+func (t *progressTracker) List() []types.FileProgress {
+	t.Lock()
+	defer t.Unlock()
+	res := []types.FileProgress{}
+	for _, tp := range t.transfers {
+		tp.Lock()
+		res = append(res, tp.p)
+		tp.Unlock()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+	return res
+}
+
+func (tp *transferProgress) update(f func(p *types.FileProgress)) {
+	tp.Lock()
+	f(&tp.p)
+	tp.Unlock()
+}
+
+// Write counts the bytes received
+func (tp *transferProgress) Write(b []byte) (int, error) {
+	tp.update(func(p *types.FileProgress) { p.Received += int64(len(b)) })
+	return len(b), nil
+}
+
+// done sets the outcome of the transfer
+func (tp *transferProgress) done(err error) {
+	tp.update(func(p *types.FileProgress) {
+		p.State = types.FileTransferDone
+		if err != nil {
+			p.State = types.FileTransferFailed
+			p.Error = err.Error()
+		}
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("File transfer limits", func() {
+	It("caps the transfers running at once and queues the others", func() {
+		t := NewTransferLimiter(2, 1, 0)
+
+		var running, peak int32
+		release := make(chan struct{})
+		wg := sync.WaitGroup{}
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(t.Inbound.Acquire(context.Background())).To(Succeed())
+				defer t.Inbound.Release()
+				r := atomic.AddInt32(&running, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if r <= p || atomic.CompareAndSwapInt32(&peak, p, r) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&running, -1)
+			}()
+		}
+
+		Eventually(t.Stats).Should(Equal(types.FileTransfers{
+			Inbound:  types.TransferQueue{Active: 2, Queued: 3, Limit: 2},
+			Outbound: types.TransferQueue{Limit: 1},
+		}))
+		close(release)
+		wg.Wait()
+
+		Expect(atomic.LoadInt32(&peak)).To(Equal(int32(2)))
+		Expect(t.Stats().Inbound).To(Equal(types.TransferQueue{Limit: 2}))
+	})
+
+	It("gives up waiting when the context is done", func() {
+		t := NewTransferLimiter(0, 1, 0)
+		Expect(t.Outbound.Acquire(context.Background())).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		Expect(t.Outbound.Acquire(ctx)).To(MatchError(context.DeadlineExceeded))
+		Expect(t.Stats().Outbound).To(Equal(types.TransferQueue{Active: 1, Limit: 1}))
+
+		// Raising the limit lets the queued transfers start
+		done := make(chan error)
+		go func() { done <- t.Outbound.Acquire(context.Background()) }()
+		Eventually(func() int { return t.Stats().Outbound.Queued }).Should(Equal(1))
+		t.SetLimits(0, 2, 0)
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("refuses the transfers once the queue is full", func() {
+		t := NewTransferLimiter(0, 1, 0)
+		t.Outbound.SetMaxQueued(1)
+		Expect(t.Outbound.Acquire(context.Background())).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		done := make(chan error)
+		go func() { done <- t.Outbound.Acquire(ctx) }()
+		Eventually(func() int { return t.Stats().Outbound.Queued }).Should(Equal(1))
+
+		Expect(t.Outbound.Acquire(context.Background())).To(MatchError(ErrTransferQueueFull))
+		Expect(t.Stats().Outbound).To(Equal(types.TransferQueue{Active: 1, Queued: 1, Limit: 1}))
+
+		t.Outbound.Release()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("limits the bandwidth of each transfer", func() {
+		t := NewTransferLimiter(0, 0, 10000)
+		data := bytes.Repeat([]byte("x"), 5000)
+
+		dst := &bytes.Buffer{}
+		start := time.Now()
+		n, err := t.Copy(dst, bytes.NewReader(data))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(int64(len(data))))
+		Expect(dst.Bytes()).To(Equal(data))
+		Expect(time.Since(start)).To(BeNumerically("~", 500*time.Millisecond, 150*time.Millisecond))
+
+		t.SetLimits(0, 0, 0)
+		start = time.Now()
+		_, err = t.Copy(&bytes.Buffer{}, bytes.NewReader(data))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 50*time.Millisecond))
+	})
+})
@@ -0,0 +1,274 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/flow"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/pkg/errors"
+)
+
+// DefaultUDPIdleTimeout closes the UDP sessions with no datagrams flowing
+// either way for longer than this, unless an idle timeout is set
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+// udpShortIdleTimeout closes sooner the UDP sessions of the clients which
+// did not send again after a reply, as the one-off queries of the DNS stub
+// resolvers, each sent from its own port
+const udpShortIdleTimeout = 5 * time.Second
+
+// maxDatagramSize is the largest datagram forwarded, as its length is sent on 16 bits
+const maxDatagramSize = 65535
+
+// udpSessionQueue is how many datagrams of a client are queued while its session is busy
+const udpSessionQueue = 64
+
+// UDP forwards the datagrams of the service instead of TCP connections.
+// Each client of a connected service gets its own session, carried over
+// a stream to the peer exposing the service, which is closed when idle.
+// The sessions of the clients not sending again after a reply are closed
+// after a short idle timeout.
+var UDP ServiceOption = func(cfg *ServiceConfig) error {
+	cfg.UDP = true
+	return nil
+}
+
+// udpIdleTimeout returns the idle timeout of the UDP sessions
+func udpIdleTimeout(t types.ServiceTimeouts) time.Duration {
+	if t.Idle > 0 {
+		return t.Idle
+	}
+	return DefaultUDPIdleTimeout
+}
+
+// writeDatagram writes the datagram to the stream, prefixed by its length
+func writeDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes exceeds the maximum size", len(p))
+	}
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads a datagram written with writeDatagram into buf,
+// which must fit maxDatagramSize bytes
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// streamToDatagrams writes each datagram read from the stream to dst
+func streamToDatagrams(closer chan struct{}, dst io.Writer, src io.Reader) {
+	defer func() { closer <- struct{}{} }()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := readDatagram(src, buf)
+		if err != nil {
+			return
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// datagramsToStream writes each datagram read from src to the stream
+func datagramsToStream(closer chan struct{}, dst io.Writer, src io.Reader) {
+	defer func() { closer <- struct{}{} }()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if err := writeDatagram(dst, buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// udpServiceHandler forwards each UDP session to the service from its own
+// socket, so the replies of the service reach back the session
+func udpServiceHandler(ll log.StandardLogger, serviceID, dstaddress string, condition func() bool, timeouts types.ServiceTimeouts) node.StreamHandler {
+	return func(n *node.Node, l *blockchain.Ledger) func(stream network.Stream) {
+		return func(stream network.Stream) {
+			go func() {
+				remote := stream.Conn().RemotePeer().String()
+				ll.Infof("(service %s) Received UDP session from %s", serviceID, remote)
+				if !admitted(ll, l, stream, condition) {
+					return
+				}
+
+				c, err := net.Dial("udp", dstaddress)
+				if err != nil {
+					ll.Debugf("Reset %s: %s", remote, err.Error())
+					stream.Reset()
+					return
+				}
+				start := time.Now()
+				counter := serviceStreams.Track(stream.ID(), serviceID, remote)
+				defer counter.Close()
+
+				tp := newTimeoutProxy(types.ServiceTimeouts{Idle: udpIdleTimeout(timeouts)}, func() {
+					ll.Debugf("(service %s) Closing idle UDP session from '%s'", serviceID, remote)
+					stream.Reset()
+					c.Close()
+				})
+				s := tp.wrap(stream, stream)
+				tc := tp.wrap(c, c)
+				closer := make(chan struct{}, 2)
+				go datagramsToStream(closer, counter.Out(s), tc)
+				go streamToDatagrams(closer, counter.In(tc), s)
+				<-closer
+
+				tp.stop()
+				stream.Close()
+				c.Close()
+				in, out := counter.Bytes()
+				n.ExportFlow(flow.NewFlow("service", serviceID, remote, n.Host().ID().String(), in, out, start))
+				ll.Infof("(service %s) Handled UDP session of '%s' (in: %d bytes, out: %d bytes)", serviceID, remote, in, out)
+			}()
+		}
+	}
+}
+
+// proxyUDP forwards the datagrams of each client of the local socket over
+// its own stream, opened with open, and the datagrams received on the
+// stream back to the client. The sessions are closed once idle, after
+// udpShortIdleTimeout until the client sends again after a reply.
+func proxyUDP(ctx context.Context, pc net.PacketConn, idle time.Duration, open func() (network.Stream, func(), error)) error {
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	var mu sync.Mutex
+	sessions := map[string]chan []byte{}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.New("context canceled")
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+
+		mu.Lock()
+		datagrams, exists := sessions[client.String()]
+		if !exists {
+			datagrams = make(chan []byte, udpSessionQueue)
+			sessions[client.String()] = datagrams
+			go func() {
+				udpSession(ctx, pc, client, datagrams, idle, open)
+				mu.Lock()
+				delete(sessions, client.String())
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		select {
+		case datagrams <- append([]byte{}, buf[:n]...):
+		default:
+			// The session is lagging behind, drop the datagram as the network would
+		}
+	}
+}
+
+// udpSession forwards the datagrams of a client over a new stream, and
+// the ones received on the stream back to the client, until idle
+func udpSession(ctx context.Context, pc net.PacketConn, client net.Addr, datagrams chan []byte, idle time.Duration, open func() (network.Stream, func(), error)) {
+	stream, release, err := open()
+	if err != nil {
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The session is kept for the idle timeout once the client sends again
+	// after a reply, as conntrack does, so one-off queries don't hold a stream
+	var mu sync.Mutex
+	replied, assured := false, false
+	timeout := min(idle, udpShortIdleTimeout)
+	timer := time.AfterFunc(timeout, cancel)
+	defer timer.Stop()
+	touch := func(reply bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case reply:
+			replied = true
+		case replied && !assured:
+			assured, timeout = true, idle
+		}
+		timer.Reset(timeout)
+	}
+
+	go func() {
+		defer cancel()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := readDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			touch(true)
+			pc.WriteTo(buf[:n], client)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			stream.Reset()
+			return
+		case d := <-datagrams:
+			if err := writeDatagram(stream, d); err != nil {
+				stream.Reset()
+				return
+			}
+			touch(false)
+		}
+	}
+}
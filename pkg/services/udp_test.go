@@ -0,0 +1,214 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("UDP services", func() {
+	logg := logger.New(log.LevelFatal)
+
+	// echo is a UDP server echoing the datagrams
+	echo := func() string {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(pc.Close)
+		go func() {
+			buf := make([]byte, 65535)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				pc.WriteTo(buf[:n], addr)
+			}
+		}()
+		return pc.LocalAddr().String()
+	}
+
+	// session exposes the UDP service and opens a session to it from another host
+	session := func(ctx context.Context, address string, opts ...ServiceOption) network.Stream {
+		e, err := node.New(append(RegisterService(logg, 5*time.Second, "dns", address, append(opts, UDP)...),
+			node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil),
+			node.WithStore(&blockchain.MemoryStore{}),
+			node.ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+			node.Logger(logg),
+		)...)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(h.Close)
+
+		ledger, err := e.Ledger()
+		Expect(err).ToNot(HaveOccurred())
+		ledger.Add(protocol.UsersLedgerKey, map[string]interface{}{h.ID().String(): types.User{PeerID: h.ID().String()}})
+		Eventually(func() bool {
+			_, found := ledger.GetKey(protocol.UsersLedgerKey, h.ID().String())
+			return found
+		}, 5*time.Second).Should(BeTrue())
+
+		Expect(h.Connect(ctx, peer.AddrInfo{ID: e.Host().ID(), Addrs: e.Host().Addrs()})).To(Succeed())
+		// TCP sessions are refused by UDP services
+		_, err = h.NewStream(ctx, e.Host().ID(), protocol.ServiceProtocol.ID())
+		Expect(err).To(HaveOccurred())
+
+		s, err := h.NewStream(ctx, e.Host().ID(), protocol.ServiceUDPProtocol.ID())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(func() { s.Close() })
+		return s
+	}
+
+	// The datagrams are framed on the stream by their length, on 16 bits
+	send := func(s network.Stream, datagram string) {
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(datagram)))
+		_, err := s.Write(append(frame, datagram...))
+		Expect(err).ToNot(HaveOccurred())
+	}
+	receive := func(s network.Stream) string {
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		size := make([]byte, 2)
+		_, err := io.ReadFull(s, size)
+		Expect(err).ToNot(HaveOccurred())
+		datagram := make([]byte, binary.BigEndian.Uint16(size))
+		_, err = io.ReadFull(s, datagram)
+		Expect(err).ToNot(HaveOccurred())
+		return string(datagram)
+	}
+
+	It("forwards the datagrams of a session and their replies", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := session(ctx, echo())
+		send(s, "query")
+		send(s, "")
+		send(s, "another query")
+		Expect(receive(s)).To(Equal("query"))
+		Expect(receive(s)).To(Equal(""))
+		Expect(receive(s)).To(Equal("another query"))
+	})
+
+	It("closes the idle sessions", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s := session(ctx, echo(), WithTimeouts(types.ServiceTimeouts{Idle: time.Second}))
+		for i := 0; i < 3; i++ {
+			send(s, "ping")
+			Expect(receive(s)).To(Equal("ping"))
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.Copy(io.Discard, s)
+		Expect(err == nil || !isTimeout(err)).To(BeTrue())
+	})
+
+	It("connects to UDP services, closing the one-off sessions sooner", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		start := func(opts ...node.Option) (*node.Node, *blockchain.Ledger) {
+			e, err := node.New(append(opts,
+				node.FromBase64(true, true, node.GenerateNewConnectionData().Base64(), nil, nil),
+				node.WithStore(&blockchain.MemoryStore{}),
+				node.ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+				node.Logger(logg),
+			)...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.Start(ctx)).To(Succeed())
+			l, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			return e, l
+		}
+		server, serverLedger := start(RegisterService(logg, 5*time.Second, "dns", echo(), UDP)...)
+		client, clientLedger := start()
+		Expect(client.Host().Connect(ctx, peer.AddrInfo{ID: server.Host().ID(), Addrs: server.Host().Addrs()})).To(Succeed())
+		serverLedger.Add(protocol.UsersLedgerKey, map[string]interface{}{client.Host().ID().String(): types.User{PeerID: client.Host().ID().String()}})
+		clientLedger.Add(protocol.ServicesLedgerKey, map[string]interface{}{"dns": types.Service{PeerID: server.Host().ID().String(), Name: "dns"}})
+
+		local, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		address := local.LocalAddr().String()
+		local.Close()
+		go ConnectNetworkService(5*time.Second, "dns", address, UDP)(ctx, node.Config{}, client, clientLedger)
+		Eventually(func() bool {
+			_, found := serverLedger.GetKey(protocol.UsersLedgerKey, client.Host().ID().String())
+			return found
+		}, 10*time.Second).Should(BeTrue())
+
+		exchange := func(c net.Conn, datagram string) (string, error) {
+			c.SetDeadline(time.Now().Add(time.Second))
+			if _, err := c.Write([]byte(datagram)); err != nil {
+				return "", err
+			}
+			buf := make([]byte, 65535)
+			n, err := c.Read(buf)
+			return string(buf[:n]), err
+		}
+		dial := func() net.Conn {
+			c, err := net.Dial("udp", address)
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(c.Close)
+			return c
+		}
+		sessions := func() (n int) {
+			for _, c := range client.Host().Network().ConnsToPeer(server.Host().ID()) {
+				for _, s := range c.GetStreams() {
+					if s.Protocol() == protocol.ServiceUDPProtocol.ID() {
+						n++
+					}
+				}
+			}
+			return
+		}
+
+		// A client sending again after a reply keeps its session
+		conversation := dial()
+		Eventually(func() (string, error) { return exchange(conversation, "hello") }, 10*time.Second, 100*time.Millisecond).Should(Equal("hello"))
+		Expect(exchange(conversation, "again")).To(Equal("again"))
+
+		// Each query is sent from its own port, as resolvers do
+		for i := 0; i < 10; i++ {
+			Expect(exchange(dial(), "query")).To(Equal("query"))
+		}
+		Expect(sessions()).To(Equal(11))
+
+		Eventually(sessions, 10*time.Second, 100*time.Millisecond).Should(Equal(1))
+		Expect(exchange(conversation, "still there")).To(Equal("still there"))
+	})
+})
@@ -0,0 +1,219 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/utils"
+)
+
+// UpgradeCoordinator coordinates rolling upgrades across the network.
+// Nodes announce their intent to upgrade in the ledger, and at most
+// maxConcurrent of them are allowed in the upgrading state at the same time,
+// the others wait for a slot to be released.
+type UpgradeCoordinator struct {
+	// PollInterval is how often the ledger is checked while waiting for a slot
+	PollInterval time.Duration
+
+	ledger        *blockchain.Ledger
+	id            string
+	maxConcurrent int
+	ttl           time.Duration
+
+	sync.Mutex
+	cancel context.CancelFunc
+}
+
+// NewUpgradeCoordinator returns a coordinator for the node id which allows maxConcurrent
+// nodes to upgrade at the same time. Intents which are not refreshed within ttl are
+// considered stale, so slots held by nodes which went away are freed up.
+func NewUpgradeCoordinator(b *blockchain.Ledger, id string, maxConcurrent int, ttl time.Duration) *UpgradeCoordinator {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &UpgradeCoordinator{
+		PollInterval:  5 * time.Second,
+		ledger:        b,
+		id:            id,
+		maxConcurrent: maxConcurrent,
+		ttl:           ttl,
+	}
+}
+
+// UpgradeIntents returns the upgrade intents in the ledger which were refreshed in the last ttl
+func UpgradeIntents(b *blockchain.Ledger, ttl time.Duration) (intents []types.UpgradeIntent) {
+	for _, v := range b.CurrentData()[protocol.UpgradeLedgerKey] {
+		i := types.UpgradeIntent{}
+		if err := v.Unmarshal(&i); err != nil {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, i.Timestamp)
+		if err != nil || t.Add(ttl).Before(time.Now()) {
+			continue
+		}
+		intents = append(intents, i)
+	}
+	return
+}
+
+// queue returns the intents in the given state, the oldest first.
+// Ties are broken by leader election so all the nodes agree on the order.
+func queue(intents []types.UpgradeIntent, state string) (q []types.UpgradeIntent) {
+	for _, i := range intents {
+		if i.State == state {
+			q = append(q, i)
+		}
+	}
+	sort.Slice(q, func(a, b int) bool {
+		if q[a].Since != q[b].Since {
+			ta, _ := time.Parse(time.RFC3339Nano, q[a].Since)
+			tb, _ := time.Parse(time.RFC3339Nano, q[b].Since)
+			return ta.Before(tb)
+		}
+		return utils.Leader([]string{q[a].PeerID, q[b].PeerID}) == q[a].PeerID
+	})
+	return
+}
+
+func position(q []types.UpgradeIntent, id string) int {
+	for i, e := range q {
+		if e.PeerID == id {
+			return i
+		}
+	}
+	return len(q)
+}
+
+func (u *UpgradeCoordinator) announce(state string, since time.Time) {
+	u.ledger.Add(protocol.UpgradeLedgerKey, map[string]interface{}{
+		u.id: types.UpgradeIntent{
+			PeerID:    u.id,
+			State:     state,
+			Since:     since.Format(time.RFC3339Nano),
+			Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	})
+}
+
+// refresh re-announces the intent if it was lost, or if it is about to become stale
+func (u *UpgradeCoordinator) refresh(state string, since time.Time) bool {
+	v, exists := u.ledger.CurrentData()[protocol.UpgradeLedgerKey][u.id]
+	i := types.UpgradeIntent{}
+	if exists && v.Unmarshal(&i) == nil && i.State == state && i.Since == since.Format(time.RFC3339Nano) {
+		t, err := time.Parse(time.RFC3339Nano, i.Timestamp)
+		if err == nil && time.Since(t) < u.ttl/2 {
+			return false
+		}
+	}
+	u.announce(state, since)
+	return true
+}
+
+// RequestUpgradeSlot announces the intent to upgrade and blocks until a slot is free
+// or the context is cancelled. The slot is held until ReleaseUpgradeSlot is called,
+// or until the intent expires if the node goes away.
+func (u *UpgradeCoordinator) RequestUpgradeSlot(ctx context.Context) error {
+	state := types.UpgradeWaiting
+	since := time.Now().UTC()
+	u.announce(state, since)
+
+	// A node must keep its slot for a while before it is granted,
+	// so concurrent claims from nodes with a different view of the ledger are settled
+	settle := 2 * u.PollInterval
+
+	t := time.NewTicker(u.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			u.ReleaseUpgradeSlot(context.Background())
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		if u.refresh(state, since) {
+			continue
+		}
+
+		intents := UpgradeIntents(u.ledger, u.ttl)
+		upgrading := queue(intents, types.UpgradeUpgrading)
+
+		switch state {
+		case types.UpgradeUpgrading:
+			if position(upgrading, u.id) >= u.maxConcurrent {
+				// Somebody claimed the slot before us, back in the queue
+				state, since = types.UpgradeWaiting, time.Now().UTC()
+				u.announce(state, since)
+				continue
+			}
+			if time.Since(since) >= settle {
+				u.hold(since)
+				return nil
+			}
+		case types.UpgradeWaiting:
+			free := u.maxConcurrent - len(upgrading)
+			if free > 0 && position(queue(intents, types.UpgradeWaiting), u.id) < free {
+				state, since = types.UpgradeUpgrading, time.Now().UTC()
+				u.announce(state, since)
+			}
+		}
+	}
+}
+
+// hold keeps the upgrading intent alive until the slot is released
+func (u *UpgradeCoordinator) hold(since time.Time) {
+	ctx, cancel := context.WithCancel(context.Background())
+	u.Lock()
+	u.cancel = cancel
+	u.Unlock()
+
+	go func() {
+		t := time.NewTicker(u.PollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				u.refresh(types.UpgradeUpgrading, since)
+			}
+		}
+	}()
+}
+
+// ReleaseUpgradeSlot withdraws the upgrade intent of the node, freeing up its slot.
+// It is safe to call it on startup to clear an intent left over by a previous run.
+func (u *UpgradeCoordinator) ReleaseUpgradeSlot(ctx context.Context) {
+	u.Lock()
+	if u.cancel != nil {
+		u.cancel()
+		u.cancel = nil
+	}
+	u.Unlock()
+
+	if _, exists := u.ledger.CurrentData()[protocol.UpgradeLedgerKey][u.id]; !exists {
+		return
+	}
+	u.ledger.Delete(protocol.UpgradeLedgerKey, u.id)
+	u.ledger.AnnounceDeleteBucketKey(ctx, u.PollInterval, u.ttl, protocol.UpgradeLedgerKey, u.id)
+}
@@ -0,0 +1,102 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package services_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Upgrade coordination", func() {
+	newCoordinator := func(b *blockchain.Ledger, id string, max int) *UpgradeCoordinator {
+		u := NewUpgradeCoordinator(b, id, max, time.Second)
+		u.PollInterval = 20 * time.Millisecond
+		return u
+	}
+
+	It("limits the nodes upgrading at the same time", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+
+		var current, peak, done int32
+		wg := sync.WaitGroup{}
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			u := newCoordinator(b, fmt.Sprintf("node%d", i), 2)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				Expect(u.RequestUpgradeSlot(context.Background())).To(Succeed())
+				c := atomic.AddInt32(&current, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if c <= p || atomic.CompareAndSwapInt32(&peak, p, c) {
+						break
+					}
+				}
+				time.Sleep(200 * time.Millisecond)
+				atomic.AddInt32(&current, -1)
+				atomic.AddInt32(&done, 1)
+				u.ReleaseUpgradeSlot(context.Background())
+			}()
+		}
+		wg.Wait()
+
+		Expect(atomic.LoadInt32(&done)).To(Equal(int32(5)))
+		Expect(atomic.LoadInt32(&peak)).To(BeNumerically("<=", 2))
+		Expect(atomic.LoadInt32(&peak)).To(BeNumerically(">", 0))
+	})
+
+	It("waits until a slot is released", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		first := newCoordinator(b, "first", 1)
+		second := newCoordinator(b, "second", 1)
+
+		Expect(first.RequestUpgradeSlot(context.Background())).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		Expect(second.RequestUpgradeSlot(ctx)).To(MatchError(context.DeadlineExceeded))
+		Expect(UpgradeIntents(b, time.Minute)).To(HaveLen(1))
+
+		first.ReleaseUpgradeSlot(context.Background())
+		Expect(second.RequestUpgradeSlot(context.Background())).To(Succeed())
+	})
+
+	It("ignores stale intents", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		// A node which went away without releasing its slot
+		old := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+		b.Add(protocol.UpgradeLedgerKey, map[string]interface{}{
+			"gone": types.UpgradeIntent{PeerID: "gone", State: types.UpgradeUpgrading, Since: old, Timestamp: old},
+		})
+
+		Expect(UpgradeIntents(b, time.Minute)).To(BeEmpty())
+		Expect(newCoordinator(b, "other", 1).RequestUpgradeSlot(context.Background())).To(Succeed())
+	})
+})
@@ -0,0 +1,154 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Filesystem is a Store keeping each key in a file, inside a directory
+// per namespace. Keys of the empty namespace are stored in the root directory.
+type Filesystem struct {
+	dir string
+}
+
+// NewFilesystem returns a Store persisting in dir, which is created on the first write
+func NewFilesystem(dir string) *Filesystem {
+	return &Filesystem{dir: dir}
+}
+
+func validName(s string) error {
+	if strings.HasPrefix(s, ".") || strings.ContainsAny(s, `/\`) {
+		return fmt.Errorf("invalid name '%s'", s)
+	}
+	return nil
+}
+
+func (f *Filesystem) path(namespace, key string) (string, error) {
+	if err := validName(namespace); err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", errors.New("empty key")
+	}
+	if err := validName(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.dir, namespace, key), nil
+}
+
+func (f *Filesystem) Get(namespace, key string) ([]byte, error) {
+	p, err := f.path(namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	dat, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return dat, err
+}
+
+// Put writes the value to a temporary file first, so a crash
+// never leaves a partially written value behind
+func (f *Filesystem) Put(namespace, key string, value []byte) error {
+	p, err := f.path(namespace, key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (f *Filesystem) Delete(namespace, key string) error {
+	p, err := f.path(namespace, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *Filesystem) List(namespace string) ([]string, error) {
+	if err := validName(namespace); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(f.dir, namespace))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		keys = append(keys, e.Name())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *Filesystem) Namespaces() ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	namespaces := []string{}
+	for _, e := range append([]os.DirEntry{nil}, entries...) {
+		ns := ""
+		if e != nil {
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			ns = e.Name()
+		}
+		keys, err := f.List(ns)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// Memory is an in-memory Store, useful in tests or
+// for nodes which don't need to persist their state
+type Memory struct {
+	sync.Mutex
+	data map[string]map[string][]byte
+}
+
+// NewMemory returns an empty in-memory Store
+func NewMemory() *Memory {
+	return &Memory{data: make(map[string]map[string][]byte)}
+}
+
+func (m *Memory) Get(namespace, key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	v, exists := m.data[namespace][key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (m *Memory) Put(namespace, key string, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, exists := m.data[namespace]; !exists {
+		m.data[namespace] = make(map[string][]byte)
+	}
+	m.data[namespace][key] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *Memory) Delete(namespace, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.data[namespace], key)
+	return nil
+}
+
+func (m *Memory) List(namespace string) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	keys := []string{}
+	for k := range m.data[namespace] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *Memory) Namespaces() ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	namespaces := []string{}
+	for ns, keys := range m.data {
+		if len(keys) > 0 {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
@@ -0,0 +1,37 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package store provides a key/value persistence layer, for the node state
+// which needs to survive restarts (identity, DHCP leases, ledger state).
+package store
+
+import "errors"
+
+// ErrNotFound is returned when a key doesn't exist in the store
+var ErrNotFound = errors.New("key not found")
+
+// Store persists values by namespace and key.
+// Implementations must be safe for concurrent use. The empty namespace
+// is the root of the store.
+type Store interface {
+	// Get returns the value of the key, or ErrNotFound
+	Get(namespace, key string) ([]byte, error)
+	// Put sets the value of the key
+	Put(namespace, key string, value []byte) error
+	// Delete removes the key. Deleting a missing key is not an error
+	Delete(namespace, key string) error
+	// List returns the keys in the namespace, sorted
+	List(namespace string) ([]string, error)
+	// Namespaces returns the namespaces holding keys, sorted
+	Namespaces() ([]string, error)
+}
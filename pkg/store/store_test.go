@@ -0,0 +1,126 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/store"
+)
+
+var _ = Describe("Store", func() {
+	behaves := func(newStore func() Store) {
+		It("puts, gets and deletes keys by namespace", func() {
+			s := newStore()
+
+			_, err := s.Get("ns", "foo")
+			Expect(err).To(Equal(ErrNotFound))
+
+			Expect(s.Put("ns", "foo", []byte("bar"))).To(Succeed())
+			Expect(s.Put("other", "foo", []byte("baz"))).To(Succeed())
+
+			v, err := s.Get("ns", "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(v)).To(Equal("bar"))
+
+			v, err = s.Get("other", "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(v)).To(Equal("baz"))
+
+			Expect(s.Delete("ns", "foo")).To(Succeed())
+			Expect(s.Delete("ns", "foo")).To(Succeed())
+			_, err = s.Get("ns", "foo")
+			Expect(err).To(Equal(ErrNotFound))
+		})
+
+		It("lists the keys of a namespace", func() {
+			s := newStore()
+
+			keys, err := s.List("ns")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(BeEmpty())
+
+			Expect(s.Put("ns", "b", []byte("1"))).To(Succeed())
+			Expect(s.Put("ns", "a", []byte("2"))).To(Succeed())
+			Expect(s.Put("", "root", []byte("3"))).To(Succeed())
+
+			keys, err = s.List("ns")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(Equal([]string{"a", "b"}))
+
+			keys, err = s.List("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(keys).To(Equal([]string{"root"}))
+		})
+
+		It("lists the namespaces holding keys", func() {
+			s := newStore()
+
+			namespaces, err := s.Namespaces()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(namespaces).To(BeEmpty())
+
+			Expect(s.Put("ns", "a", []byte("1"))).To(Succeed())
+			Expect(s.Put("", "root", []byte("2"))).To(Succeed())
+			Expect(s.Put("empty", "a", []byte("3"))).To(Succeed())
+			Expect(s.Delete("empty", "a")).To(Succeed())
+
+			namespaces, err = s.Namespaces()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(namespaces).To(Equal([]string{"", "ns"}))
+		})
+	}
+
+	Context("Memory", func() {
+		behaves(func() Store { return NewMemory() })
+	})
+
+	Context("Filesystem", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "store")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(os.RemoveAll, dir)
+		})
+
+		behaves(func() Store { return NewFilesystem(dir) })
+
+		It("persists keys in files", func() {
+			s := NewFilesystem(dir)
+			Expect(s.Put("", "privkey", []byte("key"))).To(Succeed())
+			Expect(s.Put("ns", "foo", []byte("bar"))).To(Succeed())
+
+			dat, err := os.ReadFile(filepath.Join(dir, "privkey"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dat)).To(Equal("key"))
+
+			v, err := NewFilesystem(dir).Get("ns", "foo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(v)).To(Equal("bar"))
+		})
+
+		It("refuses keys escaping the store", func() {
+			s := NewFilesystem(dir)
+			Expect(s.Put("..", "foo", []byte("bar"))).ToNot(Succeed())
+			Expect(s.Put("ns", "../foo", []byte("bar"))).ToNot(Succeed())
+			Expect(s.Put("ns", "", []byte("bar"))).ToNot(Succeed())
+		})
+	})
+})
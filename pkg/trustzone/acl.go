@@ -0,0 +1,320 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trustzone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+)
+
+// ACLPolicyKey is the key of the policy inside the ACL bucket
+const ACLPolicyKey = "policy"
+
+// AnyBucket matches all the buckets in a Policy
+const AnyBucket = "*"
+
+// Policy lists the ledger buckets peers are allowed to write
+type Policy struct {
+	// Serial orders the policies: a policy replaces the current one only
+	// with a greater serial, so the older policies can't be replayed
+	Serial uint64 `yaml:"serial"`
+	// Peers maps peer IDs to the buckets they can write
+	Peers map[string][]string `yaml:"peers"`
+	// Groups maps group names to the buckets their members can write
+	Groups map[string][]string `yaml:"groups"`
+	// Members maps peer IDs to the groups they belong to
+	Members map[string][]string `yaml:"members"`
+	// Default are the buckets that any peer can write
+	Default []string `yaml:"default"`
+	// Broadcast maps the broadcast topics to the peer IDs and the groups
+	// allowed to publish on them. Topics not listed are open to any peer.
+	Broadcast map[string][]string `yaml:"broadcast" json:",omitempty"`
+}
+
+// Allowed returns true if the peer can write the bucket
+func (p Policy) Allowed(peerID, bucket string) bool {
+	match := func(buckets []string) bool {
+		for _, b := range buckets {
+			if b == bucket || b == AnyBucket {
+				return true
+			}
+		}
+		return false
+	}
+
+	if match(p.Default) || match(p.Peers[peerID]) {
+		return true
+	}
+	for _, g := range p.Members[peerID] {
+		if match(p.Groups[g]) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignedPolicy is a Policy signed by an admin, as stored in the ledger
+type SignedPolicy struct {
+	Policy    Policy
+	Signer    string
+	Signature []byte
+}
+
+// SignPolicy signs the policy with the given (admin) key
+func SignPolicy(p Policy, key crypto.PrivKey) (*SignedPolicy, error) {
+	signer, sig, err := sign(p, key)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedPolicy{Policy: p, Signer: signer, Signature: sig}, nil
+}
+
+// Verify checks that the policy is signed by one of the admins
+func (s SignedPolicy) Verify(admins []peer.ID) error {
+	return verify("policy", s.Policy, s.Signer, s.Signature, admins)
+}
+
+// sign signs the JSON encoding of v with the key, returning the signer peer ID
+func sign(v interface{}, key crypto.PrivKey) (string, []byte, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return "", nil, err
+	}
+	sig, err := key.Sign(dat)
+	if err != nil {
+		return "", nil, err
+	}
+	return id.String(), sig, nil
+}
+
+// verify checks that the JSON encoding of v is signed by the signer, and
+// that the signer is one of the admins
+func verify(kind string, v interface{}, signer string, signature []byte, admins []peer.ID) error {
+	id, err := peer.Decode(signer)
+	if err != nil {
+		return err
+	}
+
+	trusted := false
+	for _, a := range admins {
+		if a == id {
+			trusted = true
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("%s signed by '%s' which is not an admin", kind, signer)
+	}
+
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(dat, signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid %s signature", kind)
+	}
+	return nil
+}
+
+// ACL authorizes the writes to the ledger buckets according to the
+// policy signed by the admins and stored in the ledger.
+// Until a policy is published, all the writes are allowed. Once a policy
+// is seen, it can only be replaced by a policy with a greater serial.
+type ACL struct {
+	admins []peer.ID
+
+	sync.Mutex
+	// seen is the serial of the last policy seen, if any
+	seen *uint64
+}
+
+// NewACL returns a new ACL trusting the policies signed by the given admins
+func NewACL(admins ...peer.ID) *ACL {
+	return &ACL{admins: admins}
+}
+
+// Authorize is a blockchain.WriteAuthorizer checking that the writer
+// of each changed entry is allowed to write its bucket. The writer is the
+// author of the entry signature, so the blocks can be relayed by any peer:
+// the changes without a valid signature are attributed to the relayer.
+// The ACL bucket can be changed only with a policy signed by an admin.
+func (a *ACL) Authorize(relayer string, current, incoming blockchain.Block) error {
+	changed := changedKeys(current.Storage, incoming.Storage)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	policy, err := a.policy(current.Storage)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if policy != nil {
+		a.see(policy.Serial)
+	}
+
+	if _, exists := changed[protocol.ACLLedgerKey]; exists {
+		p, err := a.policy(incoming.Storage)
+		if err != nil {
+			return err
+		}
+		if err := a.replaces(policy, p); err != nil {
+			return err
+		}
+		policy = p
+	}
+
+	if policy == nil {
+		if a.seen != nil {
+			return fmt.Errorf("the ACL policy can't be removed")
+		}
+		return nil
+	}
+
+	for b, keys := range changed {
+		if b == protocol.ACLLedgerKey {
+			continue
+		}
+		for _, k := range keys {
+			if w := writer(relayer, current, incoming, b, k); !policy.Allowed(w, b) {
+				return fmt.Errorf("peer '%s' is not allowed to write bucket '%s'", w, b)
+			}
+		}
+	}
+	a.see(policy.Serial)
+	return nil
+}
+
+// writer returns the peer which wrote the change of the key: the author
+// of its signature, if valid and not older than the current one, or else
+// the relayer of the block
+func writer(relayer string, current, incoming blockchain.Block, b, k string) string {
+	s, signed := incoming.Signatures[b][k]
+	if !signed {
+		return relayer
+	}
+	v, exists := incoming.Storage[b][k]
+	if s.Deleted == exists {
+		return relayer
+	}
+	if c, signed := current.Signatures[b][k]; signed && s.Timestamp < c.Timestamp {
+		return relayer
+	}
+	id, err := peer.Decode(s.Author)
+	if err != nil {
+		return relayer
+	}
+	pk, err := id.ExtractPublicKey()
+	if err != nil {
+		return relayer
+	}
+	if ok, err := pk.Verify(s.Digest(b, k, v), s.Signature); err != nil || !ok {
+		return relayer
+	}
+	return s.Author
+}
+
+// see records the serial of a verified policy
+func (a *ACL) see(serial uint64) {
+	if a.seen == nil || serial > *a.seen {
+		a.seen = &serial
+	}
+}
+
+// replaces checks that the incoming policy can replace the current one:
+// a policy older than the ones seen is refused, and a different policy
+// needs a greater serial
+func (a *ACL) replaces(current, incoming *Policy) error {
+	switch {
+	case incoming == nil:
+		return nil
+	case a.seen != nil && incoming.Serial < *a.seen:
+		return fmt.Errorf("ACL policy serial %d is older than %d", incoming.Serial, *a.seen)
+	case current != nil && incoming.Serial <= current.Serial && !reflect.DeepEqual(*current, *incoming):
+		return fmt.Errorf("ACL policy serial %d is not greater than %d", incoming.Serial, current.Serial)
+	}
+	return nil
+}
+
+// policy returns the verified policy in the data, if any
+func (a *ACL) policy(data map[string]map[string]blockchain.Data) (*Policy, error) {
+	d, exists := data[protocol.ACLLedgerKey][ACLPolicyKey]
+	if !exists {
+		return nil, nil
+	}
+	sp := &SignedPolicy{}
+	if err := d.Unmarshal(sp); err != nil {
+		return nil, err
+	}
+	if err := sp.Verify(a.admins); err != nil {
+		return nil, err
+	}
+	return &sp.Policy, nil
+}
+
+// changedKeys returns the keys added, changed or removed, by bucket
+func changedKeys(current, incoming map[string]map[string]blockchain.Data) map[string][]string {
+	changed := map[string][]string{}
+	for b, keys := range incoming {
+		for k, v := range keys {
+			if cv, exists := current[b][k]; !exists || cv != v {
+				changed[b] = append(changed[b], k)
+			}
+		}
+	}
+	for b, keys := range current {
+		for k := range keys {
+			if _, exists := incoming[b][k]; !exists {
+				changed[b] = append(changed[b], k)
+			}
+		}
+	}
+	return changed
+}
+
+// ACLPolicyNetworkService signs the policy with the node key and keeps it
+// announced to the ledger. Meant to be run by admin nodes.
+func ACLPolicyNetworkService(announcetime time.Duration, p Policy) node.NetworkService {
+	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		sp, err := SignPolicy(p, n.Host().Peerstore().PrivKey(n.Host().ID()))
+		if err != nil {
+			return err
+		}
+		b.AnnounceUpdate(ctx, announcetime, protocol.ACLLedgerKey, ACLPolicyKey, sp)
+		return nil
+	}
+}
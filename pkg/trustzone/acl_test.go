@@ -0,0 +1,222 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trustzone_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+	node "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/trustzone"
+)
+
+func data(v interface{}) blockchain.Data {
+	dat, _ := json.Marshal(v)
+	return blockchain.Data(dat)
+}
+
+// relay returns the block as gossiped by the ledgers
+func relay(b blockchain.Block) string {
+	dat, _ := json.Marshal(b)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(dat)
+	gz.Close()
+	return buf.String()
+}
+
+var _ = Describe("ACL", func() {
+	adminKey, _ := node.GenPrivKey(0)
+	admin, _ := peer.IDFromPrivateKey(adminKey)
+	otherKey, _ := node.GenPrivKey(0)
+
+	policy := Policy{
+		Serial:  1,
+		Peers:   map[string][]string{"peerA": {"services"}},
+		Groups:  map[string][]string{"routers": {"routes"}},
+		Members: map[string][]string{"peerB": {"routers"}},
+		Default: []string{"users"},
+	}
+
+	var signed *SignedPolicy
+	var current blockchain.Block
+	var acl *ACL
+
+	BeforeEach(func() {
+		var err error
+		signed, err = SignPolicy(policy, adminKey)
+		Expect(err).ToNot(HaveOccurred())
+
+		current = blockchain.Block{Storage: map[string]map[string]blockchain.Data{
+			protocol.ACLLedgerKey: {ACLPolicyKey: data(signed)},
+			"services":            {"web": data("peerA")},
+		}}
+		acl = NewACL(admin)
+	})
+
+	with := func(bucket, key string, v interface{}) blockchain.Block {
+		res := map[string]map[string]blockchain.Data{}
+		for b, kv := range current.Storage {
+			res[b] = map[string]blockchain.Data{}
+			for k, v := range kv {
+				res[b][k] = v
+			}
+		}
+		if _, exists := res[bucket]; !exists {
+			res[bucket] = map[string]blockchain.Data{}
+		}
+		res[bucket][key] = data(v)
+		return blockchain.Block{Storage: res}
+	}
+
+	It("allows writes permitted by the policy", func() {
+		Expect(acl.Authorize("peerA", current, with("services", "db", "peerA"))).To(Succeed())
+		Expect(acl.Authorize("peerB", current, with("routes", "10.0.0.0/24", "peerB"))).To(Succeed())
+		Expect(acl.Authorize("peerC", current, with("users", "peerC", "peerC"))).To(Succeed())
+		// unchanged buckets are not checked
+		Expect(acl.Authorize("peerC", current, current)).To(Succeed())
+	})
+
+	It("denies writes not permitted by the policy", func() {
+		Expect(acl.Authorize("peerA", current, with("routes", "10.0.0.0/24", "peerA"))).ToNot(Succeed())
+		Expect(acl.Authorize("peerB", current, with("services", "db", "peerB"))).ToNot(Succeed())
+		Expect(acl.Authorize("", current, with("services", "db", "peerB"))).ToNot(Succeed())
+
+		deleted := with("users", "peerC", "peerC")
+		delete(deleted.Storage, "services")
+		Expect(acl.Authorize("peerC", current, deleted)).ToNot(Succeed())
+	})
+
+	It("allows everything until a policy is published", func() {
+		Expect(acl.Authorize("peerC",
+			blockchain.Block{},
+			blockchain.Block{Storage: map[string]map[string]blockchain.Data{"routes": {"foo": data("bar")}}},
+		)).To(Succeed())
+	})
+
+	It("accepts only policies signed by admins", func() {
+		updated := policy
+		updated.Serial = 2
+		updated.Default = []string{AnyBucket}
+
+		forged, err := SignPolicy(updated, otherKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acl.Authorize("peerC", current, with(protocol.ACLLedgerKey, ACLPolicyKey, forged))).ToNot(Succeed())
+
+		tampered := *signed
+		tampered.Policy = updated
+		Expect(acl.Authorize("peerC", current, with(protocol.ACLLedgerKey, ACLPolicyKey, tampered))).ToNot(Succeed())
+
+		valid, err := SignPolicy(updated, adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acl.Authorize("peerC", current, with(protocol.ACLLedgerKey, ACLPolicyKey, valid))).To(Succeed())
+	})
+
+	It("refuses the blocks removing the policy once seen", func() {
+		removed := with("users", "peerC", "peerC")
+		delete(removed.Storage[protocol.ACLLedgerKey], ACLPolicyKey)
+		Expect(acl.Authorize("peerC", current, removed)).ToNot(Succeed())
+
+		delete(removed.Storage, protocol.ACLLedgerKey)
+		Expect(acl.Authorize("peerC", current, removed)).ToNot(Succeed())
+
+		// Also from a ledger which lost the policy meanwhile
+		empty := blockchain.Block{}
+		Expect(acl.Authorize("peerC", empty, blockchain.Block{Storage: map[string]map[string]blockchain.Data{"routes": {"foo": data("bar")}}})).ToNot(Succeed())
+	})
+
+	It("refuses the policies not newer than the current one", func() {
+		older := policy
+		older.Serial = 0
+		older.Default = []string{AnyBucket}
+		replayed, err := SignPolicy(older, adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acl.Authorize("peerC", current, with(protocol.ACLLedgerKey, ACLPolicyKey, replayed))).ToNot(Succeed())
+
+		same := policy
+		same.Default = []string{AnyBucket}
+		sameSerial, err := SignPolicy(same, adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acl.Authorize("peerC", current, with(protocol.ACLLedgerKey, ACLPolicyKey, sameSerial))).ToNot(Succeed())
+
+		newer := policy
+		newer.Serial = 5
+		signedNewer, err := SignPolicy(newer, adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		next := with(protocol.ACLLedgerKey, ACLPolicyKey, signedNewer)
+		Expect(acl.Authorize("peerC", current, next)).To(Succeed())
+
+		// The policy seen can't be rolled back, not even from a stale ledger
+		next2 := policy
+		next2.Serial = 3
+		signedNext2, err := SignPolicy(next2, adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(acl.Authorize("peerC", current, with(protocol.ACLLedgerKey, ACLPolicyKey, signedNext2))).ToNot(Succeed())
+	})
+
+	It("authorizes the writers of the entries relayed by other peers", func() {
+		routers := policy
+		routers.Peers = map[string][]string{admin.String(): {"routes"}}
+		sp, err := SignPolicy(routers, adminKey)
+		Expect(err).ToNot(HaveOccurred())
+
+		written := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		written.SetAuthor(admin.String())
+		written.SetSigner(adminKey.Sign)
+		written.Add(protocol.ACLLedgerKey, map[string]interface{}{ACLPolicyKey: sp})
+		written.Add("routes", map[string]interface{}{"10.0.0.0/24": "peerB"})
+
+		// A non-admin peer relays the state it synced from the admin
+		relayer := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		Expect(relayer.Update(nil, &hub.Message{Message: relay(written.LastBlock()), AuthorID: admin.String()}, nil)).To(Succeed())
+
+		fresh := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		fresh.SetWriteAuthorizer(NewACL(admin).Authorize)
+		Expect(fresh.Update(nil, &hub.Message{Message: relay(relayer.LastBlock()), AuthorID: "peerC"}, nil)).To(Succeed())
+		v, exists := fresh.GetKey("routes", "10.0.0.0/24")
+		Expect(exists).To(BeTrue())
+		Expect(v).To(Equal(data("peerB")))
+
+		// The entries changed by the relayer are attributed to it
+		forged := relayer.LastBlock()
+		forged.Storage["routes"]["10.0.0.0/24"] = data("peerC")
+		forged.Hash = forged.Checksum()
+		other := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		other.SetWriteAuthorizer(NewACL(admin).Authorize)
+		Expect(other.Update(nil, &hub.Message{Message: relay(forged), AuthorID: "peerC"}, nil)).ToNot(Succeed())
+
+		// And so are the signatures replayed over newer ones
+		written.Add("routes", map[string]interface{}{"10.0.0.0/24": "peerA"})
+		Expect(fresh.Update(nil, &hub.Message{Message: relay(written.LastBlock()), AuthorID: "peerC"}, nil)).To(Succeed())
+		replayed := relayer.LastBlock()
+		replayed.Index = fresh.Index() + 1
+		replayed.Hash = replayed.Checksum()
+		Expect(fresh.Update(nil, &hub.Message{Message: relay(replayed), AuthorID: "peerC"}, nil)).ToNot(Succeed())
+
+		// Removals are authorized on their tombstones
+		written.Delete("routes", "10.0.0.0/24")
+		Expect(fresh.Update(nil, &hub.Message{Message: relay(written.LastBlock()), AuthorID: "peerC"}, nil)).To(Succeed())
+		_, exists = fresh.GetKey("routes", "10.0.0.0/24")
+		Expect(exists).To(BeFalse())
+	})
+})
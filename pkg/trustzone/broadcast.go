@@ -0,0 +1,200 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trustzone
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+	"github.com/mudler/edgevpn/pkg/node"
+)
+
+// Annotations of the broadcast messages
+const (
+	BroadcastTopicAnnotation     = "broadcast_topic"
+	BroadcastAuthorAnnotation    = "broadcast_author"
+	BroadcastSignatureAnnotation = "broadcast_sig"
+	BroadcastTimeAnnotation      = "broadcast_time"
+)
+
+// BroadcastMaxAge is how old, or ahead of the local clock, a broadcast can be.
+// The older broadcasts are rejected, so they can't be replayed later.
+const BroadcastMaxAge = time.Minute
+
+// AllowedBroadcast returns true if the peer can publish on the broadcast topic
+func (p Policy) AllowedBroadcast(peerID, topic string) bool {
+	allowed, restricted := p.Broadcast[topic]
+	if !restricted {
+		return true
+	}
+	for _, a := range allowed {
+		if a == peerID || a == AnyBucket {
+			return true
+		}
+		for _, g := range p.Members[peerID] {
+			if a == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func broadcastPayload(topic, timestamp, message string) []byte {
+	return []byte(topic + "\x00" + timestamp + "\x00" + message)
+}
+
+// SignBroadcast returns a message for the topic, signed with the given key
+func SignBroadcast(topic, message string, key crypto.PrivKey) (*hub.Message, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
+	sig, err := key.Sign(broadcastPayload(topic, timestamp, message))
+	if err != nil {
+		return nil, err
+	}
+	return &hub.Message{
+		Message: message,
+		Annotations: map[string]interface{}{
+			BroadcastTopicAnnotation:     topic,
+			BroadcastAuthorAnnotation:    id.String(),
+			BroadcastTimeAnnotation:      timestamp,
+			BroadcastSignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+		},
+	}, nil
+}
+
+// VerifyBroadcast checks the signature and the age of a broadcast message,
+// and returns its author and topic
+func VerifyBroadcast(m *hub.Message) (peer.ID, string, error) {
+	topic, _ := m.Annotations[BroadcastTopicAnnotation].(string)
+	author, _ := m.Annotations[BroadcastAuthorAnnotation].(string)
+	if topic == "" || author == "" {
+		return "", "", fmt.Errorf("not a broadcast message")
+	}
+
+	timestamp, _ := m.Annotations[BroadcastTimeAnnotation].(string)
+	ns, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("broadcast message from '%s' without a valid time", author)
+	}
+	if age := time.Since(time.Unix(0, ns)); age > BroadcastMaxAge || age < -BroadcastMaxAge {
+		return "", "", fmt.Errorf("stale broadcast message from '%s', sent %s ago", author, age.Round(time.Second))
+	}
+
+	encoded, _ := m.Annotations[BroadcastSignatureAnnotation].(string)
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sig) == 0 {
+		return "", "", fmt.Errorf("broadcast message from '%s' without a valid signature", author)
+	}
+
+	id, err := peer.Decode(author)
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return "", "", err
+	}
+	ok, err := pub.Verify(broadcastPayload(topic, timestamp, m.Message), sig)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return "", "", fmt.Errorf("invalid signature of broadcast from '%s'", author)
+	}
+	return id, topic, nil
+}
+
+// Broadcast signs the message with the node key and publishes it
+// on the topic, over the generic channel (see node.EnableGenericHub)
+func Broadcast(n *node.Node, topic, message string) error {
+	m, err := SignBroadcast(topic, message, n.Host().Peerstore().PrivKey(n.Host().ID()))
+	if err != nil {
+		return err
+	}
+	return n.PublishMessage(m)
+}
+
+// BroadcastHandler returns a generic channel handler calling h with the
+// messages broadcasted on the topic, once their signature is verified and
+// their author is allowed to publish on the topic by the policy in the
+// ledger. Unauthorized, stale and already seen broadcasts are rejected
+// with an error.
+func (a *ACL) BroadcastHandler(topic string, h func(author peer.ID, message string)) node.Handler {
+	var mu sync.Mutex
+	// seen are the digests of the broadcasts received, until they are stale.
+	// They don't include the signature, which can be altered and still verify.
+	seen := map[[sha256.Size]byte]time.Time{}
+	return func(l *blockchain.Ledger, m *hub.Message, c chan *hub.Message) error {
+		if t, _ := m.Annotations[BroadcastTopicAnnotation].(string); t != topic {
+			return nil
+		}
+		author, _, err := VerifyBroadcast(m)
+		if err != nil {
+			return err
+		}
+		if err := a.AuthorizeBroadcast(l, author, topic); err != nil {
+			return err
+		}
+
+		timestamp, _ := m.Annotations[BroadcastTimeAnnotation].(string)
+		digest := sha256.Sum256(append([]byte(author.String()+"\x00"), broadcastPayload(topic, timestamp, m.Message)...))
+		mu.Lock()
+		for s, t := range seen {
+			if time.Since(t) > 2*BroadcastMaxAge {
+				delete(seen, s)
+			}
+		}
+		_, replayed := seen[digest]
+		seen[digest] = time.Now()
+		mu.Unlock()
+		if replayed {
+			return fmt.Errorf("broadcast from '%s' on '%s' already received", author, topic)
+		}
+
+		h(author, m.Message)
+		return nil
+	}
+}
+
+// AuthorizeBroadcast returns an error if the peer is not allowed to publish
+// on the topic by the policy in the ledger. Until a policy is published,
+// all the broadcasts are refused.
+func (a *ACL) AuthorizeBroadcast(l *blockchain.Ledger, author peer.ID, topic string) error {
+	if l == nil {
+		return fmt.Errorf("no ledger to authorize the broadcast from '%s'", author)
+	}
+	policy, err := a.policy(l.CurrentData())
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return fmt.Errorf("no ACL policy to authorize the broadcast from '%s'", author)
+	}
+	if !policy.AllowedBroadcast(author.String(), topic) {
+		return fmt.Errorf("peer '%s' is not allowed to broadcast on '%s'", author, topic)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trustzone_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/hub"
+	node "github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	. "github.com/mudler/edgevpn/pkg/trustzone"
+)
+
+var _ = Describe("Broadcast ACL", func() {
+	adminKey, _ := node.GenPrivKey(0)
+	admin, _ := peer.IDFromPrivateKey(adminKey)
+	memberKey, _ := node.GenPrivKey(0)
+	member, _ := peer.IDFromPrivateKey(memberKey)
+
+	policy := Policy{
+		Broadcast: map[string][]string{"reconfigure": {"admins"}},
+		Members:   map[string][]string{admin.String(): {"admins"}},
+	}
+
+	var ledger *blockchain.Ledger
+	var received []string
+	var handler node.Handler
+
+	BeforeEach(func() {
+		signed, err := SignPolicy(policy, adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		ledger = blockchain.New(&bytes.Buffer{}, &blockchain.MemoryStore{})
+		ledger.Add(protocol.ACLLedgerKey, map[string]interface{}{ACLPolicyKey: signed})
+
+		received = []string{}
+		handler = NewACL(admin).BroadcastHandler("reconfigure", func(author peer.ID, message string) {
+			received = append(received, author.String()+":"+message)
+		})
+	})
+
+	It("authorizes the publishers of restricted topics", func() {
+		Expect(policy.AllowedBroadcast(admin.String(), "reconfigure")).To(BeTrue())
+		Expect(policy.AllowedBroadcast(member.String(), "reconfigure")).To(BeFalse())
+		Expect(policy.AllowedBroadcast(member.String(), "hello")).To(BeTrue())
+	})
+
+	It("acts on authorized broadcasts", func() {
+		m, err := SignBroadcast("reconfigure", "foo", adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		author, topic, err := VerifyBroadcast(m)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(author).To(Equal(admin))
+		Expect(topic).To(Equal("reconfigure"))
+
+		Expect(handler(ledger, m, nil)).To(Succeed())
+		Expect(received).To(Equal([]string{admin.String() + ":foo"}))
+	})
+
+	It("rejects unauthorized broadcasts", func() {
+		m, err := SignBroadcast("reconfigure", "foo", memberKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler(ledger, m, nil)).ToNot(Succeed())
+		Expect(received).To(BeEmpty())
+	})
+
+	It("rejects tampered broadcasts", func() {
+		m, err := SignBroadcast("reconfigure", "foo", adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler(ledger, m.WithMessage("bar"), nil)).ToNot(Succeed())
+
+		// A member can't impersonate the admin
+		forged, err := SignBroadcast("reconfigure", "foo", memberKey)
+		Expect(err).ToNot(HaveOccurred())
+		forged.Annotations[BroadcastAuthorAnnotation] = admin.String()
+		Expect(handler(ledger, forged, nil)).ToNot(Succeed())
+		Expect(received).To(BeEmpty())
+	})
+
+	It("ignores the other topics and messages", func() {
+		m, err := SignBroadcast("hello", "foo", memberKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler(ledger, m, nil)).To(Succeed())
+		Expect(handler(ledger, &hub.Message{Message: "foo"}, nil)).To(Succeed())
+		Expect(received).To(BeEmpty())
+	})
+
+	It("rejects replayed and stale broadcasts", func() {
+		m, err := SignBroadcast("reconfigure", "foo", adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler(ledger, m, nil)).To(Succeed())
+		Expect(handler(ledger, m, nil)).ToNot(Succeed())
+
+		stale, err := SignBroadcast("reconfigure", "bar", adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		stale.Annotations[BroadcastTimeAnnotation] = fmt.Sprint(time.Now().Add(-2 * BroadcastMaxAge).UnixNano())
+		Expect(handler(ledger, stale, nil)).ToNot(Succeed())
+		Expect(received).To(Equal([]string{admin.String() + ":foo"}))
+	})
+
+	It("rejects the broadcasts replayed with an altered signature", func() {
+		key, _, err := crypto.GenerateSecp256k1Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		handler := NewACL(admin).BroadcastHandler("hello", func(peer.ID, string) {})
+
+		m, err := SignBroadcast("hello", "foo", key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler(ledger, m, nil)).To(Succeed())
+
+		// (r, N-s) is a valid signature of the same message, N the order of secp256k1
+		sig, err := base64.StdEncoding.DecodeString(m.Annotations[BroadcastSignatureAnnotation].(string))
+		Expect(err).ToNot(HaveOccurred())
+		var rs struct{ R, S *big.Int }
+		_, err = asn1.Unmarshal(sig, &rs)
+		Expect(err).ToNot(HaveOccurred())
+		n, _ := new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+		rs.S.Sub(n, rs.S)
+		altered, err := asn1.Marshal(rs)
+		Expect(err).ToNot(HaveOccurred())
+
+		replayed := &hub.Message{Message: m.Message, Annotations: map[string]interface{}{}}
+		for k, v := range m.Annotations {
+			replayed.Annotations[k] = v
+		}
+		replayed.Annotations[BroadcastSignatureAnnotation] = base64.StdEncoding.EncodeToString(altered)
+		_, _, err = VerifyBroadcast(replayed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(handler(ledger, replayed, nil)).ToNot(Succeed())
+	})
+
+	It("rejects the broadcasts until a policy is published", func() {
+		m, err := SignBroadcast("hello", "foo", adminKey)
+		Expect(err).ToNot(HaveOccurred())
+		empty := blockchain.New(&bytes.Buffer{}, &blockchain.MemoryStore{})
+		Expect(NewACL(admin).BroadcastHandler("hello", func(peer.ID, string) {})(empty, m, nil)).ToNot(Succeed())
+	})
+})
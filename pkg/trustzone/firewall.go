@@ -0,0 +1,133 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trustzone
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// SignedFirewallRule is a firewall rule signed by an admin, as stored in
+// the ledger firewall bucket under the rule ID
+type SignedFirewallRule struct {
+	Rule      types.FirewallRule
+	Signer    string
+	Signature []byte
+}
+
+// SignFirewallRule signs the rule with the given (admin) key
+func SignFirewallRule(r types.FirewallRule, key crypto.PrivKey) (*SignedFirewallRule, error) {
+	r.Signer = ""
+	signer, sig, err := sign(r, key)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedFirewallRule{Rule: r, Signer: signer, Signature: sig}, nil
+}
+
+// Verify checks that the rule is signed by one of the admins
+func (s SignedFirewallRule) Verify(admins []peer.ID) error {
+	return verify("firewall rule", s.Rule, s.Signer, s.Signature, admins)
+}
+
+// FirewallRules returns the rules of the ledger firewall bucket signed by
+// the admins and not revoked, sorted by ID
+func FirewallRules(bucket map[string]blockchain.Data, admins []peer.ID) []types.FirewallRule {
+	return active(firewallRules(bucket, func(s *SignedFirewallRule) bool { return s.Verify(admins) == nil }))
+}
+
+// PublishedFirewallRules returns all the rules of the ledger firewall
+// bucket not revoked, sorted by ID, without verifying who signed them
+func PublishedFirewallRules(bucket map[string]blockchain.Data) []types.FirewallRule {
+	return active(firewallRules(bucket, func(*SignedFirewallRule) bool { return true }))
+}
+
+// NextFirewallSerial returns the serial of the next version of the rule
+// in the ledger firewall bucket
+func NextFirewallSerial(bucket map[string]blockchain.Data, id string) uint64 {
+	s := &SignedFirewallRule{}
+	if d, exists := bucket[id]; exists && d.Unmarshal(s) == nil {
+		return s.Rule.Serial + 1
+	}
+	return 1
+}
+
+// FirewallRuleSet keeps the last version of the rules signed by the admins.
+// The rules removed from the ledger, or replaced by an older version of
+// them, are kept: only a signed tombstone with a greater serial revokes a
+// rule.
+type FirewallRuleSet struct {
+	admins []peer.ID
+
+	sync.Mutex
+	rules map[string]types.FirewallRule
+}
+
+// NewFirewallRuleSet returns a FirewallRuleSet of the rules signed by the admins
+func NewFirewallRuleSet(admins ...peer.ID) *FirewallRuleSet {
+	return &FirewallRuleSet{admins: admins, rules: map[string]types.FirewallRule{}}
+}
+
+// Update merges the rules of the ledger firewall bucket, and returns the
+// rules not revoked, sorted by ID
+func (f *FirewallRuleSet) Update(bucket map[string]blockchain.Data) []types.FirewallRule {
+	f.Lock()
+	defer f.Unlock()
+	for _, r := range firewallRules(bucket, func(s *SignedFirewallRule) bool { return s.Verify(f.admins) == nil }) {
+		if old, exists := f.rules[r.ID]; !exists || r.Serial > old.Serial {
+			f.rules[r.ID] = r
+		}
+	}
+	rules := []types.FirewallRule{}
+	for _, r := range f.rules {
+		rules = append(rules, r)
+	}
+	sortRules(rules)
+	return active(rules)
+}
+
+func firewallRules(bucket map[string]blockchain.Data, valid func(*SignedFirewallRule) bool) []types.FirewallRule {
+	rules := []types.FirewallRule{}
+	for id, d := range bucket {
+		s := &SignedFirewallRule{}
+		if err := d.Unmarshal(s); err != nil || s.Rule.ID != id || !valid(s) {
+			continue
+		}
+		r := s.Rule
+		r.Signer = s.Signer
+		rules = append(rules, r)
+	}
+	sortRules(rules)
+	return rules
+}
+
+func sortRules(rules []types.FirewallRule) {
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+}
+
+// active returns the rules not revoked
+func active(rules []types.FirewallRule) []types.FirewallRule {
+	res := []types.FirewallRule{}
+	for _, r := range rules {
+		if !r.Revoked {
+			res = append(res, r)
+		}
+	}
+	return res
+}
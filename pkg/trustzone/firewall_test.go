@@ -0,0 +1,94 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trustzone_test
+
+import (
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	node "github.com/mudler/edgevpn/pkg/node"
+	. "github.com/mudler/edgevpn/pkg/trustzone"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+var _ = Describe("Firewall rules", func() {
+	adminKey, _ := node.GenPrivKey(0)
+	admin, _ := peer.IDFromPrivateKey(adminKey)
+	otherKey, _ := node.GenPrivKey(0)
+	other, _ := peer.IDFromPrivateKey(otherKey)
+
+	rule := func(id string) types.FirewallRule {
+		return types.FirewallRule{ID: id, Peer: types.FirewallAnyPeer, Action: types.FirewallDeny}
+	}
+	sign := func(r types.FirewallRule, key crypto.PrivKey) *SignedFirewallRule {
+		s, err := SignFirewallRule(r, key)
+		Expect(err).ToNot(HaveOccurred())
+		return s
+	}
+
+	It("returns the rules signed by the admins", func() {
+		tampered := sign(rule("tampered"), adminKey)
+		tampered.Rule.Action = types.FirewallAllow
+
+		bucket := map[string]blockchain.Data{
+			"b":        data(sign(rule("b"), adminKey)),
+			"a":        data(sign(rule("a"), adminKey)),
+			"other":    data(sign(rule("other"), otherKey)),
+			"tampered": data(tampered),
+			"moved":    data(sign(rule("elsewhere"), adminKey)),
+		}
+
+		rules := FirewallRules(bucket, []peer.ID{admin})
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[0].ID).To(Equal("a"))
+		Expect(rules[0].Signer).To(Equal(admin.String()))
+		Expect(rules[1].ID).To(Equal("b"))
+
+		Expect(FirewallRules(bucket, nil)).To(BeEmpty())
+
+		published := PublishedFirewallRules(bucket)
+		Expect(published).To(HaveLen(4))
+		Expect(published[2].ID).To(Equal("other"))
+		Expect(published[2].Signer).To(Equal(other.String()))
+	})
+
+	It("revokes the rules only with a newer signed tombstone", func() {
+		set := NewFirewallRuleSet(admin)
+		deny := sign(rule("a"), adminKey)
+		bucket := map[string]blockchain.Data{"a": data(deny)}
+		Expect(set.Update(bucket)).To(HaveLen(1))
+
+		// Deleting the rule from the ledger doesn't revoke it
+		Expect(set.Update(map[string]blockchain.Data{})).To(HaveLen(1))
+
+		revoked := rule("a")
+		revoked.Serial = NextFirewallSerial(bucket, "a")
+		revoked.Revoked = true
+		tombstone := data(sign(revoked, adminKey))
+		Expect(FirewallRules(map[string]blockchain.Data{"a": tombstone}, []peer.ID{admin})).To(BeEmpty())
+		Expect(PublishedFirewallRules(map[string]blockchain.Data{"a": tombstone})).To(BeEmpty())
+		Expect(set.Update(map[string]blockchain.Data{"a": tombstone})).To(BeEmpty())
+
+		// The revoked rule can't be replayed
+		Expect(set.Update(bucket)).To(BeEmpty())
+
+		// A forged tombstone doesn't revoke a rule
+		set = NewFirewallRuleSet(admin)
+		Expect(set.Update(bucket)).To(HaveLen(1))
+		Expect(set.Update(map[string]blockchain.Data{"a": data(sign(revoked, otherKey))})).To(HaveLen(1))
+	})
+})
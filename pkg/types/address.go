@@ -0,0 +1,29 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+const (
+	// AddressBound is an address the node is listening on
+	AddressBound = "bound"
+	// AddressExternal is an address the node is reachable at from the outside,
+	// as observed by other peers, mapped via NAT or relayed
+	AddressExternal = "external"
+)
+
+// ListenAddress is an address of the node along with its transport
+type ListenAddress struct {
+	Address   string
+	Transport string
+	Kind      string
+}
@@ -13,6 +13,41 @@ limitations under the License.
 
 package types
 
-import "github.com/miekg/dns"
+import (
+	"fmt"
+	"strings"
 
+	"github.com/miekg/dns"
+)
+
+// DNS is the ledger schema of DNS records. It maps a record type
+// to its data, in the zone file format:
+//
+//	A:     "10.1.0.1"
+//	AAAA:  "fd00::1"
+//	CNAME: "target.example."
+//	TXT:   "\"key=value\" \"other\""
+//	SRV:   "priority weight port target." (e.g. "10 5 8080 web.example.")
+//
+// TXT and SRV can hold more than one record, one per line.
 type DNS map[dns.Type]string
+
+// TXTRecord returns the data of a TXT record holding the given strings
+func TXTRecord(txt ...string) string {
+	quoted := []string{}
+	for _, t := range txt {
+		quoted = append(quoted, fmt.Sprintf("%q", t))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// SRVRecord returns the data of a SRV record. Clients pick the targets with the
+// lowest priority first, and balance between those with the same priority by weight.
+func SRVRecord(priority, weight, port uint16, target string) string {
+	return fmt.Sprintf("%d %d %d %s", priority, weight, port, dns.Fqdn(target))
+}
+
+// CNAMERecord returns the data of a CNAME record pointing to target
+func CNAMERecord(target string) string {
+	return dns.Fqdn(target)
+}
@@ -0,0 +1,36 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import "time"
+
+// Types of the node events
+const (
+	EventPeerConnected    = "peer.connected"
+	EventPeerDisconnected = "peer.disconnected"
+	EventDiscoveryCycle   = "discovery.cycle"
+	EventLedgerChanged    = "ledger.changed"
+	EventAddressConflict  = "vpn.address_conflict"
+	EventInterfaceDown    = "vpn.interface_down"
+	EventInterfaceUp      = "vpn.interface_up"
+	EventLedgerReaped     = "ledger.reaped"
+)
+
+// Event is a node event exported to an external broker
+type Event struct {
+	Type string            `json:"type"`
+	Node string            `json:"node"`
+	Time time.Time         `json:"time"`
+	Data map[string]string `json:"data,omitempty"`
+}
@@ -13,7 +13,59 @@ limitations under the License.
 
 package types
 
+import "time"
+
 type File struct {
 	PeerID string
 	Name   string
+	// Recipient is the peer the file is encrypted to, empty if in clear
+	Recipient string `json:",omitempty"`
+	// Size is the size of the file in bytes
+	Size int64 `json:",omitempty"`
+	// ChunkSize is the size of the chunks the file is transferred in.
+	// The files without chunks (e.g. encrypted) are transferred whole.
+	ChunkSize int64 `json:",omitempty"`
+	// Chunks are the hex encoded SHA256 hashes of the chunks
+	Chunks []string `json:",omitempty"`
+}
+
+// File transfer states
+const (
+	FileTransferRunning = "running"
+	FileTransferDone    = "done"
+	FileTransferFailed  = "failed"
+)
+
+// FileProgress is the progress of a file received by the node
+type FileProgress struct {
+	File string
+	Path string
+	// State is FileTransferRunning, FileTransferDone or FileTransferFailed.
+	// A failed chunked transfer is resumed at the next attempt.
+	State string
+	Error string `json:",omitempty"`
+	// Size is 0 for the files transferred whole
+	Size     int64
+	Received int64
+	// Resumed are the bytes found already received at the start
+	Resumed    int64 `json:",omitempty"`
+	Chunks     int   `json:",omitempty"`
+	ChunksDone int   `json:",omitempty"`
+	// Seeders are the peers serving the file
+	Seeders []string
+	Started time.Time
+}
+
+// FileTransfers are the file transfers running and waiting for a slot,
+// the ones received (Inbound) and the ones served to the peers (Outbound)
+type FileTransfers struct {
+	Inbound, Outbound TransferQueue
+	// BytesPerSecond is the bandwidth limit of each transfer, 0 means no limit
+	BytesPerSecond int64
+}
+
+// TransferQueue counts the transfers running and queued, up to Limit
+// running at once (0 means no limit)
+type TransferQueue struct {
+	Active, Queued, Limit int
 }
@@ -0,0 +1,46 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// Firewall rule actions
+const (
+	FirewallAllow = "allow"
+	FirewallDeny  = "deny"
+)
+
+// FirewallAnyPeer matches all the peers in a FirewallRule
+const FirewallAnyPeer = "*"
+
+// FirewallRule filters the VPN packets the nodes accept from a peer,
+// as published in the ledger by the ACL admins.
+type FirewallRule struct {
+	ID string
+	// Peer is the peer ID the rule applies to, or FirewallAnyPeer
+	Peer string
+	// Action is either FirewallAllow or FirewallDeny
+	Action string
+	// Destination is the network in CIDR notation, empty for any address
+	Destination string `json:",omitempty"`
+	// Port is the destination port, 0 for any port
+	Port int `json:",omitempty"`
+	// Protocol is tcp, udp or icmp, empty for any protocol
+	Protocol string `json:",omitempty"`
+	// Signer is the peer ID which signed the rule
+	Signer string `json:",omitempty"`
+	// Serial orders the versions of the rule: a rule replaces the one
+	// with the same ID only with a greater serial
+	Serial uint64 `json:",omitempty"`
+	// Revoked marks the signed tombstone of a revoked rule
+	Revoked bool `json:",omitempty"`
+}
@@ -0,0 +1,37 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import "time"
+
+// FlowVersion is the version of the flow log schema
+const FlowVersion = 1
+
+// Flow is a flow log record: the accounting of a VPN or service
+// stream between two peers, emitted when the stream is closed.
+// The JSON schema is defined in pkg/flow/schema.json
+type Flow struct {
+	Version int `json:"version"`
+	// Protocol is either "vpn" or "service"
+	Protocol string `json:"protocol"`
+	Service  string `json:"service,omitempty"`
+	SrcPeer  string `json:"src_peer"`
+	DstPeer  string `json:"dst_peer"`
+	// BytesIn are the bytes sent from SrcPeer to DstPeer, BytesOut the other way round
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMs int64     `json:"duration_ms"`
+}
@@ -20,4 +20,6 @@ type Machine struct {
 	Arch     string
 	Address  string
 	Version  string
+	// Address6 is the IPv6 address of the machine, if dual-stack
+	Address6 string `json:",omitempty"`
 }
@@ -0,0 +1,25 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// Operation is an operation in flight, like a dial or a DHT query
+type Operation struct {
+	ID     uint64
+	Kind   string
+	Target string
+	// Started is the time the operation started, in RFC3339
+	Started string
+	// Cancelled is set once the operation is cancelled, until it returns
+	Cancelled bool
+}
@@ -0,0 +1,41 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// PipelineStat are the counters of the queue between the VPN interface
+// read loop and the workers forwarding the frames to the peers
+type PipelineStat struct {
+	// Frames is the number of frames read from the interface
+	Frames uint64
+	// Backpressured counts the frames that found the queue full, and
+	// slowed down the reads from the interface until the workers caught up
+	Backpressured uint64
+	// Dropped counts the frames discarded after waiting for too long
+	Dropped uint64
+	// Queued and Capacity are the current length and the size of the queue
+	Queued, Capacity int
+}
+
+// DeviceWriteStat are the counters of the frames received from the peers
+// and written to the VPN interface
+type DeviceWriteStat struct {
+	// Frames is the number of frames written to the interface
+	Frames uint64
+	// Retried counts the transient write errors which were retried
+	Retried uint64
+	// Errors counts the frames which could not be written, and were dropped
+	Errors uint64
+	// Down is true while the writes to the interface keep failing
+	Down bool
+}
@@ -0,0 +1,36 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import "time"
+
+// Profile is the public metadata document a node publishes to the ledger,
+// so the others can check what it supports before connecting to it
+type Profile struct {
+	PeerID       string
+	Version      string
+	OS           string
+	Arch         string
+	Capabilities []string `json:",omitempty"`
+	Services     []string `json:",omitempty"`
+	// Signed is when the profile was signed, so the stale ones can be told apart
+	Signed time.Time
+}
+
+// SignedProfile is a Profile signed by the key of the node it describes,
+// as stored in the ledger
+type SignedProfile struct {
+	Profile   Profile
+	Signature []byte
+}
@@ -0,0 +1,27 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// ProtectedPeer is a peer whose connections are protected
+// from being trimmed by the connection manager
+type ProtectedPeer struct {
+	PeerID string
+	Tags   []string
+}
+
+// PinnedKey is the public key a peer is expected to present
+type PinnedKey struct {
+	PeerID    string
+	PublicKey string
+}
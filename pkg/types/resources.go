@@ -0,0 +1,34 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// Resources are the amounts of the resources accounted by the resource manager
+type Resources struct {
+	Streams         int
+	StreamsInbound  int
+	StreamsOutbound int
+	Conns           int
+	ConnsInbound    int
+	ConnsOutbound   int
+	FD              int
+	Memory          int64
+}
+
+// ResourceUsage is the usage of the resources of a resource manager scope,
+// with its limits. Limits are omitted when the resource manager doesn't expose them.
+type ResourceUsage struct {
+	Scope string
+	Usage Resources
+	Limit *Resources `json:",omitempty"`
+}
@@ -0,0 +1,23 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// Routes are the networks a node forwards the traffic of the other nodes
+// to, as announced in the ledger. 0.0.0.0/0 or ::/0 make it an exit node.
+type Routes struct {
+	PeerID string
+	// Address is the VPN address of the node
+	Address string
+	CIDRs   []string
+}
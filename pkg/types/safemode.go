@@ -0,0 +1,25 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// SafeMode reports whether the node refuses to forward VPN traffic
+type SafeMode struct {
+	Enabled bool
+	// Reason is why the node entered safe mode
+	Reason string
+	// Manual is true if safe mode was toggled by the operator,
+	// in that case it is not lifted automatically
+	Manual bool
+	Since  string
+}
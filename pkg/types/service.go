@@ -13,7 +13,32 @@ limitations under the License.
 
 package types
 
+import "time"
+
 type Service struct {
 	PeerID string
 	Name   string
+	// Network is the name of the network the service was found in.
+	// It is set when listing the services, and it is not stored in the ledger.
+	Network string `json:",omitempty"`
+}
+
+// ExposedService is a service exposed by a peer, as reported by the peer itself
+type ExposedService struct {
+	Name string
+	// Exposed is false while the condition of a conditional service doesn't hold
+	Exposed bool
+	// Timeouts are the timeouts the peer applies to the connections to the service
+	Timeouts ServiceTimeouts
+}
+
+// ServiceTimeouts are the timeouts of the connections proxied to a service.
+// A timeout of 0 is disabled.
+type ServiceTimeouts struct {
+	// Read is the longest wait for data from either end of a connection
+	Read time.Duration `json:",omitempty"`
+	// Write is the longest wait for either end of a connection to take data
+	Write time.Duration `json:",omitempty"`
+	// Idle closes a connection once no data flowed either way for this long
+	Idle time.Duration `json:",omitempty"`
 }
@@ -0,0 +1,124 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import "time"
+
+// NodeStatus is the local status of a node
+type NodeStatus struct {
+	// Phase is the startup phase the node is in
+	Phase string
+
+	// HolePunch reports the attempts to upgrade relayed connections to direct ones
+	HolePunch HolePunchStats
+
+	// Addresses are the bound and the external addresses of the node
+	Addresses []ListenAddress
+
+	// SafeMode tells if the node stopped forwarding VPN traffic, and why
+	SafeMode SafeMode
+
+	// Ledger tells if the ledger runs degraded, on the local state only
+	Ledger LedgerStatus
+
+	// FirstPeer is how long the node took to connect to the first peer
+	FirstPeer FirstPeerStats
+
+	// Interface is the state of the VPN interface
+	Interface InterfaceStatus
+
+	// DHT is the mode of the DHT
+	DHT DHTStatus
+
+	// Diagnostics are the warnings of the self-diagnosis of the node
+	Diagnostics []string
+}
+
+// InterfaceStatus tells if the VPN interface is usable, and with which address
+type InterfaceStatus struct {
+	Up      bool
+	Name    string
+	Address string
+	// Address6 is the IPv6 address of the interface, if dual-stack
+	Address6 string `json:",omitempty"`
+	// Since is when the interface went up or down
+	Since string
+}
+
+// FirstPeerStats is the time from the start of the node until the first
+// peer found by discovery connects, for this run and the previous ones
+type FirstPeerStats struct {
+	// TimeToFirstPeer is 0 until a peer connects
+	TimeToFirstPeer time.Duration
+	Histogram       Histogram
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	Buckets []HistogramBucket
+	Count   uint64
+	Sum     time.Duration
+}
+
+// LatencyHistogram is a named latency histogram of the node
+type LatencyHistogram struct {
+	Name, Help string
+	Histogram  Histogram
+}
+
+// Counter is a named counter of the node
+type Counter struct {
+	Name, Help string
+	Labels     map[string]string `json:",omitempty"`
+	Value      uint64
+}
+
+// Gauge is the current value of a metric which can go up and down
+type Gauge struct {
+	Name, Help string
+	Labels     map[string]string `json:",omitempty"`
+	Value      int64
+}
+
+// HistogramBucket counts the observations lower than or equal to UpperBound.
+// The last bucket has no UpperBound, and counts all the observations.
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// LedgerStatus is the state of the ledger transport. While degraded, the
+// node serves the ledger from its local state and local writes are
+// propagated once the transport is up.
+type LedgerStatus struct {
+	Degraded bool
+	Reason   string
+	Peers    int
+}
+
+// HolePunchStats counts the outcomes of hole punching (DCUtR) attempts
+type HolePunchStats struct {
+	Attempts, Successes, Failures uint64
+}
+
+// DHTStatus is the mode the DHT runs in
+type DHTStatus struct {
+	// Setting is the configured mode: auto, server or client
+	// (empty when left to the DHT options)
+	Setting string
+	// Mode is the current mode, server or client. In auto mode it follows
+	// the Reachability of the node, empty until the DHT starts
+	Mode         string
+	Reachability string
+}
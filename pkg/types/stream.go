@@ -0,0 +1,37 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// StreamStat is the traffic accounting of a stream
+// handled by an exposed service
+type StreamStat struct {
+	ID       string
+	Service  string
+	PeerID   string
+	BytesIn  uint64
+	BytesOut uint64
+	// Throughput is the current rate (bytes/s) in both directions
+	Throughput float64
+	Started    string
+}
+
+// CompressionStat reports how much the traffic of a service
+// was reduced by compression
+type CompressionStat struct {
+	Service string
+	// Payload are the bytes transferred before compression,
+	// Wire the ones actually sent and received
+	Payload, Wire uint64
+	Ratio         float64
+}
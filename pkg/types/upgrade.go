@@ -0,0 +1,30 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+const (
+	UpgradeWaiting   = "waiting"
+	UpgradeUpgrading = "upgrading"
+)
+
+// UpgradeIntent is the entry a node publishes to the ledger
+// when it wants to perform an upgrade
+type UpgradeIntent struct {
+	PeerID string
+	State  string
+	// Since is when the node entered the current state
+	Since string
+	// Timestamp is the last refresh of the intent, stale intents are ignored
+	Timestamp string
+}
@@ -0,0 +1,133 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Rotation sets when a RotatingWriter moves to a new file
+type Rotation struct {
+	// MaxSize is the size in bytes a file can reach, 0 for no limit
+	MaxSize int64
+	// MaxAge is how long a file is written to, 0 for no limit
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files retained besides the current one
+	MaxFiles int
+}
+
+// RotatingWriter appends to a file, and rotates it when it exceeds the size
+// or age limits. The rotated files are named after the file with a numeric
+// suffix, from the most recent (path.1) to the oldest (path.MaxFiles).
+type RotatingWriter struct {
+	sync.Mutex
+	path     string
+	rotation Rotation
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotatingWriter opens the file at path, appending to it if it exists
+func NewRotatingWriter(path string, r Rotation) (*RotatingWriter, error) {
+	w := &RotatingWriter{path: path, rotation: r}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would exceed the limits.
+// A single write is never split across files.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	full := w.rotation.MaxSize > 0 && w.size+int64(len(p)) > w.rotation.MaxSize
+	old := w.rotation.MaxAge > 0 && time.Since(w.opened) >= w.rotation.MaxAge
+	if w.size > 0 && (full || old) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files by one, dropping the oldest ones
+func (w *RotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	if w.rotation.MaxFiles <= 0 {
+		if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return w.open()
+	}
+
+	os.Remove(w.rotated(w.rotation.MaxFiles))
+	for i := w.rotation.MaxFiles - 1; i > 0; i-- {
+		if err := os.Rename(w.rotated(i), w.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(w.path, w.rotated(1)); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *RotatingWriter) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+// Close closes the current file
+func (w *RotatingWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
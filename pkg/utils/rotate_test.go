@@ -0,0 +1,111 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/utils"
+)
+
+var _ = Describe("RotatingWriter", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		path = filepath.Join(dir, "flows.log")
+	})
+
+	content := func(p string) string {
+		dat, err := os.ReadFile(p)
+		Expect(err).ToNot(HaveOccurred())
+		return string(dat)
+	}
+
+	It("rotates the file at the size threshold", func() {
+		w, err := NewRotatingWriter(path, Rotation{MaxSize: 10, MaxFiles: 2})
+		Expect(err).ToNot(HaveOccurred())
+		defer w.Close()
+
+		for _, s := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggg\n"} {
+			_, err := w.Write([]byte(s))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		// Each file holds two writes of 5 bytes, the oldest ones are dropped
+		Expect(content(path)).To(Equal("gggg\n"))
+		Expect(content(path + ".1")).To(Equal("eeee\nffff\n"))
+		Expect(content(path + ".2")).To(Equal("cccc\ndddd\n"))
+		_, err = os.Stat(path + ".3")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("never splits a write, even above the threshold", func() {
+		w, err := NewRotatingWriter(path, Rotation{MaxSize: 4, MaxFiles: 1})
+		Expect(err).ToNot(HaveOccurred())
+		defer w.Close()
+
+		w.Write([]byte(strings.Repeat("a", 8)))
+		w.Write([]byte(strings.Repeat("b", 8)))
+		Expect(content(path)).To(Equal(strings.Repeat("b", 8)))
+		Expect(content(path + ".1")).To(Equal(strings.Repeat("a", 8)))
+	})
+
+	It("appends to an existing file", func() {
+		Expect(os.WriteFile(path, []byte("old\n"), 0644)).To(Succeed())
+		w, err := NewRotatingWriter(path, Rotation{MaxSize: 10, MaxFiles: 1})
+		Expect(err).ToNot(HaveOccurred())
+		defer w.Close()
+
+		w.Write([]byte("new\n"))
+		Expect(content(path)).To(Equal("old\nnew\n"))
+		w.Write([]byte("next\n"))
+		Expect(content(path)).To(Equal("next\n"))
+		Expect(content(path + ".1")).To(Equal("old\nnew\n"))
+	})
+
+	It("rotates the file by age", func() {
+		w, err := NewRotatingWriter(path, Rotation{MaxAge: 100 * time.Millisecond, MaxFiles: 1})
+		Expect(err).ToNot(HaveOccurred())
+		defer w.Close()
+
+		w.Write([]byte("first\n"))
+		w.Write([]byte("second\n"))
+		Expect(content(path)).To(Equal("first\nsecond\n"))
+
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte("third\n"))
+		Expect(content(path)).To(Equal("third\n"))
+		Expect(content(path + ".1")).To(Equal("first\nsecond\n"))
+	})
+
+	It("retains no rotated file when MaxFiles is 0", func() {
+		w, err := NewRotatingWriter(path, Rotation{MaxSize: 4})
+		Expect(err).ToNot(HaveOccurred())
+		defer w.Close()
+
+		w.Write([]byte("aaaa"))
+		w.Write([]byte("bbbb"))
+		Expect(content(path)).To(Equal("bbbb"))
+		entries, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+})
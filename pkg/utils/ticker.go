@@ -53,6 +53,11 @@ func newExpBackoff(o ...expBackoffOpt) backoff.BackOff {
 	return b
 }
 
+// NewBackoff returns an exponential backoff.BackOff with the given options
+func NewBackoff(o ...expBackoffOpt) backoff.BackOff {
+	return newExpBackoff(o...)
+}
+
 func NewBackoffTicker(o ...expBackoffOpt) *backoff.Ticker {
 	return backoff.NewTicker(newExpBackoff(o...))
 }
@@ -0,0 +1,247 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	p2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/songgao/packets/ethernet"
+)
+
+// Compressions of the VPN batches
+const (
+	CompressionNone = ""
+	CompressionS2   = "s2"
+	CompressionZstd = "zstd"
+)
+
+// DefaultBatchSize is the default maximum number of frames in a batch
+const DefaultBatchSize = 64
+
+const (
+	// batchHeaderSize is the size of the header of a batch: the codec of
+	// its payload and the length of the payload on the wire
+	batchHeaderSize = 5
+	// maxBatchPayload bounds the payload of a batch, once decompressed
+	maxBatchPayload = 1 << 20
+)
+
+// Codecs of the batch payloads, as in the batch header
+const (
+	codecRaw byte = iota
+	codecS2
+	codecZstd
+)
+
+// ErrMalformedBatch is returned reading a batch which can't be decoded
+var ErrMalformedBatch = errors.New("malformed batch")
+
+var zstdCodec = struct {
+	sync.Once
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}{}
+
+func zstdInit() {
+	zstdCodec.Do(func() {
+		// The fastest level: the CPU cost matters more than the last bytes
+		zstdCodec.enc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		zstdCodec.dec, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxBatchPayload), zstd.WithDecoderConcurrency(0))
+	})
+}
+
+// compressionCodec returns the codec of the compression
+func compressionCodec(compression string) (byte, error) {
+	switch compression {
+	case CompressionNone:
+		return codecRaw, nil
+	case CompressionS2:
+		return codecS2, nil
+	case CompressionZstd:
+		return codecZstd, nil
+	}
+	return 0, fmt.Errorf("invalid compression '%s', use %s or %s", compression, CompressionS2, CompressionZstd)
+}
+
+// acceptedProtocols are the protocols the VPN streams are accepted with:
+// the frames in batches, compressed or not, and one at a time
+var acceptedProtocols = []p2pprotocol.ID{
+	protocol.EdgeVPN.ID(),
+	protocol.EdgeVPNBatch.ID(),
+	protocol.EdgeVPNBatchS2.ID(),
+	protocol.EdgeVPNBatchZstd.ID(),
+}
+
+// vpnProtocols returns the protocols to open a VPN stream with, the preferred first
+func vpnProtocols(c *Config) []p2pprotocol.ID {
+	if c.BatchSize <= 1 {
+		return []p2pprotocol.ID{protocol.EdgeVPN.ID()}
+	}
+	switch c.Compression {
+	case CompressionS2:
+		return []p2pprotocol.ID{protocol.EdgeVPNBatchS2.ID(), protocol.EdgeVPNBatch.ID(), protocol.EdgeVPN.ID()}
+	case CompressionZstd:
+		return []p2pprotocol.ID{protocol.EdgeVPNBatchZstd.ID(), protocol.EdgeVPNBatch.ID(), protocol.EdgeVPN.ID()}
+	}
+	return []p2pprotocol.ID{protocol.EdgeVPNBatch.ID(), protocol.EdgeVPN.ID()}
+}
+
+// streamCompression returns the compression of the batches of the VPN stream
+// protocol, and false if the protocol sends the frames one at a time
+func streamCompression(p p2pprotocol.ID) (string, bool) {
+	switch p {
+	case protocol.EdgeVPNBatch.ID():
+		return CompressionNone, true
+	case protocol.EdgeVPNBatchS2.ID():
+		return CompressionS2, true
+	case protocol.EdgeVPNBatchZstd.ID():
+		return CompressionZstd, true
+	}
+	return "", false
+}
+
+// EncodeBatch appends to dst the frames encoded in batches, each frame
+// prefixed by its length. The frames are split in more batches if they
+// exceed the maximum payload of a batch. The payload of each batch is
+// compressed if the compression shrinks it.
+func EncodeBatch(dst []byte, frames []ethernet.Frame, compression string) ([]byte, error) {
+	codec, err := compressionCodec(compression)
+	if err != nil {
+		return dst, err
+	}
+	payload := make([]byte, 0, min(batchLen(frames), maxBatchPayload))
+	for i := 0; i < len(frames); {
+		payload = payload[:0]
+		for ; i < len(frames); i++ {
+			f := frames[i]
+			if len(f) > 0xffff {
+				return dst, fmt.Errorf("frame of %d bytes too large to batch", len(f))
+			}
+			if len(payload) > 0 && len(payload)+2+len(f) > maxBatchPayload {
+				break
+			}
+			payload = binary.BigEndian.AppendUint16(payload, uint16(len(f)))
+			payload = append(payload, f...)
+		}
+		dst = appendBatch(dst, payload, codec)
+	}
+	return dst, nil
+}
+
+func batchLen(frames []ethernet.Frame) (n int) {
+	for _, f := range frames {
+		n += 2 + len(f)
+	}
+	return
+}
+
+// appendBatch appends to dst the batch of the payload, compressed with the codec if it shrinks
+func appendBatch(dst, payload []byte, codec byte) []byte {
+	header := len(dst)
+	dst = append(dst, make([]byte, batchHeaderSize)...)
+	switch codec {
+	case codecS2:
+		dst = append(dst, s2.Encode(nil, payload)...)
+	case codecZstd:
+		zstdInit()
+		dst = zstdCodec.enc.EncodeAll(payload, dst)
+	}
+	if codec == codecRaw || len(dst)-header-batchHeaderSize >= len(payload) {
+		codec = codecRaw
+		dst = append(dst[:header+batchHeaderSize], payload...)
+	}
+	dst[header] = codec
+	binary.BigEndian.PutUint32(dst[header+1:], uint32(len(dst)-header-batchHeaderSize))
+	return dst
+}
+
+// ReadBatches reads the batches from r until EOF, and writes their frames
+// to w one at a time. It returns the bytes of the frames written. The
+// batches which can't be decoded fail with ErrMalformedBatch.
+func ReadBatches(w io.Writer, r io.Reader) (int64, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	header := make([]byte, batchHeaderSize)
+	var wire, payload []byte
+	var written int64
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+		size := binary.BigEndian.Uint32(header[1:])
+		if size > maxBatchPayload {
+			return written, fmt.Errorf("%w: batch of %d bytes", ErrMalformedBatch, size)
+		}
+		if cap(wire) < int(size) {
+			wire = make([]byte, size)
+		}
+		wire = wire[:size]
+		if _, err := io.ReadFull(br, wire); err != nil {
+			return written, err
+		}
+
+		var err error
+		switch header[0] {
+		case codecRaw:
+			payload = wire
+		case codecS2:
+			var n int
+			if n, err = s2.DecodedLen(wire); err == nil && n > maxBatchPayload {
+				err = fmt.Errorf("decoded batch of %d bytes", n)
+			}
+			if err == nil {
+				payload, err = s2.Decode(payload[:cap(payload)], wire)
+			}
+		case codecZstd:
+			zstdInit()
+			payload, err = zstdCodec.dec.DecodeAll(wire, payload[:0])
+		default:
+			err = fmt.Errorf("unknown codec %d", header[0])
+		}
+		if err != nil {
+			return written, fmt.Errorf("%w: %s", ErrMalformedBatch, err.Error())
+		}
+
+		for p := payload; len(p) > 0; {
+			if len(p) < 2 {
+				return written, fmt.Errorf("%w: truncated frame length", ErrMalformedBatch)
+			}
+			l := int(binary.BigEndian.Uint16(p))
+			if len(p) < 2+l {
+				return written, fmt.Errorf("%w: truncated frame", ErrMalformedBatch)
+			}
+			n, err := w.Write(p[2 : 2+l])
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			p = p[2+l:]
+		}
+		// The payload buffer is reused by the next batch
+		if header[0] == codecRaw {
+			payload = nil
+		}
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/songgao/packets/ethernet"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/mudler/edgevpn/pkg/vpn"
+	"github.com/mudler/water"
+)
+
+// frameWriter collects the frames written one at a time
+type frameWriter struct {
+	frames []ethernet.Frame
+}
+
+func (w *frameWriter) Write(b []byte) (int, error) {
+	w.frames = append(w.frames, append(ethernet.Frame{}, b...))
+	return len(b), nil
+}
+
+// testFrames returns n frames of size bytes, compressible as the
+// headers of similar packets are
+func testFrames(n, size int) []ethernet.Frame {
+	frames := []ethernet.Frame{}
+	for i := 0; i < n; i++ {
+		f := make(ethernet.Frame, size)
+		f[0] = 0x45
+		f[size-1] = byte(i)
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+var _ = Describe("Batches", func() {
+	for _, compression := range []string{CompressionNone, CompressionS2, CompressionZstd} {
+		compression := compression
+		It("round trips the frames with compression '"+compression+"'", func() {
+			frames := testFrames(64, 1400)
+			b, err := EncodeBatch(nil, frames, compression)
+			Expect(err).ToNot(HaveOccurred())
+			if compression != CompressionNone {
+				Expect(len(b)).To(BeNumerically("<", 64*1400))
+			}
+
+			w := &frameWriter{}
+			n, err := ReadBatches(w, bytes.NewReader(b))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(int64(64 * 1400)))
+			Expect(w.frames).To(Equal(frames))
+		})
+	}
+
+	It("splits the frames exceeding a batch", func() {
+		frames := testFrames(40, 60000)
+		b, err := EncodeBatch(nil, frames, CompressionNone)
+		Expect(err).ToNot(HaveOccurred())
+
+		w := &frameWriter{}
+		_, err = ReadBatches(w, bytes.NewReader(b))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.frames).To(Equal(frames))
+	})
+
+	It("sends the incompressible batches as they are", func() {
+		frame := make(ethernet.Frame, 1024)
+		for i := range frame {
+			frame[i] = byte(i * 7919 >> 3)
+		}
+		raw, err := EncodeBatch(nil, []ethernet.Frame{frame}, CompressionNone)
+		Expect(err).ToNot(HaveOccurred())
+		compressed, err := EncodeBatch(nil, []ethernet.Frame{frame}, CompressionS2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(compressed)).To(BeNumerically("<=", len(raw)))
+	})
+
+	It("fails on the malformed batches", func() {
+		b, err := EncodeBatch(nil, testFrames(2, 100), CompressionNone)
+		Expect(err).ToNot(HaveOccurred())
+
+		// A frame longer than its batch
+		truncated := append([]byte{}, b...)
+		truncated[5] = 0xff
+		_, err = ReadBatches(io.Discard, bytes.NewReader(truncated))
+		Expect(err).To(MatchError(ErrMalformedBatch))
+
+		// An unknown codec
+		unknown := append([]byte{}, b...)
+		unknown[0] = 0x7f
+		_, err = ReadBatches(io.Discard, bytes.NewReader(unknown))
+		Expect(err).To(MatchError(ErrMalformedBatch))
+
+		// Garbage announced as compressed
+		garbage := append([]byte{}, b...)
+		garbage[0] = 2
+		_, err = ReadBatches(io.Discard, bytes.NewReader(garbage))
+		Expect(err).To(MatchError(ErrMalformedBatch))
+
+		// A batch over the limit
+		_, err = ReadBatches(io.Discard, bytes.NewReader([]byte{0, 0xff, 0xff, 0xff, 0xff}))
+		Expect(err).To(MatchError(ErrMalformedBatch))
+	})
+
+	It("refuses the unknown compressions", func() {
+		_, err := EncodeBatch(nil, testFrames(1, 10), "lz5")
+		Expect(err).To(HaveOccurred())
+		c := &Config{}
+		Expect(c.Apply(WithCompression("lz5"))).ToNot(Succeed())
+		Expect(c.Apply(WithCompression("none"))).To(Succeed())
+		Expect(c.Compression).To(Equal(CompressionNone))
+	})
+})
+
+// benchInterface is a device returning the frames queued on in, one per
+// read, and counting the bytes written
+type benchInterface struct {
+	in      chan []ethernet.Frame
+	pending []ethernet.Frame
+	written atomic.Int64
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newBenchInterface() *benchInterface {
+	return &benchInterface{in: make(chan []ethernet.Frame, 16), closed: make(chan struct{})}
+}
+
+func (d *benchInterface) Read(p []byte) (int, error) {
+	if len(d.pending) == 0 {
+		select {
+		case d.pending = <-d.in:
+		case <-d.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, d.pending[0])
+	d.pending = d.pending[1:]
+	return n, nil
+}
+
+func (d *benchInterface) Write(p []byte) (int, error) {
+	d.written.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (d *benchInterface) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+// offloadInterface returns the frames queued at once, as the TUN devices
+// with the offloads return the segments of a packet
+type offloadInterface struct {
+	*benchInterface
+}
+
+func (d offloadInterface) ReadFrames() ([]ethernet.Frame, error) {
+	select {
+	case frames := <-d.in:
+		return frames, nil
+	case <-d.closed:
+		return nil, io.EOF
+	}
+}
+
+// BenchmarkVPNDataPath sends the frames read from the interface of a node
+// to the interface of another node on the loopback, one at a time as the
+// nodes without batches do, in batches, compressed or not, and read at
+// once from the interface as with the offloads of the TUN devices
+func BenchmarkVPNDataPath(b *testing.B) {
+	const frameSize, framesPerRead = 1400, 64
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.1.0.1"), DstIP: net.ParseIP("10.1.0.2")}
+	udp := &layers.UDP{SrcPort: 4000, DstPort: 4000}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, udp, gopacket.Payload(make([]byte, frameSize-28))); err != nil {
+		b.Fatal(err)
+	}
+	frames := []ethernet.Frame{}
+	for i := 0; i < framesPerRead; i++ {
+		frames = append(frames, buf.Bytes())
+	}
+	l := logger.New(log.LevelFatal)
+
+	for _, bm := range []struct {
+		name    string
+		opts    []Option
+		offload bool
+	}{
+		{"frames", []Option{WithBatchSize(1)}, false},
+		{"batch", nil, false},
+		{"batch-s2", []Option{WithCompression(CompressionS2)}, false},
+		{"batch-zstd", []Option{WithCompression(CompressionZstd)}, false},
+		{"batch-offload", nil, true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			token := node.GenerateNewConnectionData().Base64()
+
+			start := func(address string, ifce io.ReadWriteCloser) *node.Node {
+				e, err := node.New(
+					node.FromBase64(false, false, token, nil, nil),
+					node.WithStore(&blockchain.MemoryStore{}),
+					node.ListenAddresses("/ip4/127.0.0.1/tcp/0"),
+					node.Logger(l),
+					node.WithNetworkService(VPNNetworkService(append([]Option{
+						WithInterface(&water.Interface{ReadWriteCloser: ifce}),
+						WithInterfaceAddress(address),
+						WithPacketMTU(1420),
+						WithLedgerAnnounceTime(time.Second),
+						Logger(l),
+					}, bm.opts...)...)),
+				)
+				if err != nil {
+					b.Fatal(err)
+				}
+				go e.Start(ctx)
+				for e.Host() == nil {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return e
+			}
+			srcIfce, dstIfce := newBenchInterface(), newBenchInterface()
+			var in io.ReadWriteCloser = srcIfce
+			if bm.offload {
+				in = offloadInterface{srcIfce}
+			}
+			src, dst := start("10.1.0.1/24", in), start("10.1.0.2/24", dstIfce)
+			if err := src.Host().Connect(ctx, peer.AddrInfo{ID: dst.Host().ID(), Addrs: dst.Host().Addrs()}); err != nil {
+				b.Fatal(err)
+			}
+			for _, n := range []*node.Node{src, dst} {
+				ledger, err := n.Ledger()
+				if err != nil {
+					b.Fatal(err)
+				}
+				ledger.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+					"10.1.0.1": types.Machine{PeerID: src.Host().ID().String(), Address: "10.1.0.1"},
+					"10.1.0.2": types.Machine{PeerID: dst.Host().ID().String(), Address: "10.1.0.2"},
+				})
+			}
+
+			// Wait for the services to handle the frames
+			deadline := time.Now().Add(30 * time.Second)
+			for dstIfce.written.Load() == 0 {
+				if time.Now().After(deadline) {
+					b.Fatal("the frames don't reach the other node")
+				}
+				srcIfce.in <- frames[:1]
+				time.Sleep(100 * time.Millisecond)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			b.SetBytes(frameSize * framesPerRead)
+			written := dstIfce.written.Load()
+			expected := written + int64(b.N)*frameSize*framesPerRead
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				srcIfce.in <- frames
+			}
+			// Wait for the frames in flight, unless dropped
+			for last, idle := dstIfce.written.Load(), 0; last < expected && idle < 50; idle++ {
+				time.Sleep(10 * time.Millisecond)
+				if n := dstIfce.written.Load(); n > last {
+					last, idle = n, 0
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(100*float64(dstIfce.written.Load()-written)/float64(expected-written), "%delivered")
+		})
+	}
+}
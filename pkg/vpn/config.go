@@ -14,9 +14,12 @@ limitations under the License.
 package vpn
 
 import (
+	"fmt"
+	"net"
 	"time"
 
 	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mudler/water"
 )
 
@@ -29,6 +32,15 @@ type Config struct {
 	MTU              int
 	DeviceType       water.DeviceType
 
+	// IPv6 assigns an IPv6 address to the interface alongside the IPv4 one.
+	// The address is InterfaceAddress6 if set, or else the one derived from
+	// the peer ID in IPv6Prefix, by default the unique local prefix of the
+	// network.
+	IPv6              bool
+	IPv6Prefix        string
+	InterfaceAddress6 string
+	machines6         *MachineTable6
+
 	LedgerAnnounceTime time.Duration
 	Logger             log.StandardLogger
 
@@ -37,12 +49,79 @@ type Config struct {
 	// Frame timeout
 	Timeout time.Duration
 
+	// BackpressureTimeout is how long the interface read loop waits for the
+	// workers when ChannelBufferSize frames are already queued, before
+	// dropping the frame
+	BackpressureTimeout time.Duration
+
+	// WriteRetries is how many times the transient errors writing a frame
+	// to the interface are retried, WriteRetryInterval apart. After
+	// WriteMaxFailures frames in a row fail, the interface is marked down
+	// until a frame is written again. 0 never marks it down.
+	WriteRetries       int
+	WriteRetryInterval time.Duration
+	WriteMaxFailures   int
+
 	Concurrency       int
 	ChannelBufferSize int
 	MaxStreams        int
 	lowProfile        bool
+
+	// BatchSize is the maximum number of frames queued for the same peer
+	// sent in one batch. 1 sends the frames one at a time, as the nodes
+	// not supporting the batches.
+	BatchSize int
+	// Compression compresses the batches, if the peer supports it
+	// (CompressionS2 or CompressionZstd). Empty disables it.
+	Compression string
+	// Offload enables the checksum and TCP segmentation offloads of the
+	// TUN device (Linux only), reading up to 64KiB of a TCP flow per read
+	Offload bool
+
+	// Stream reopen backoff. When a stream towards a peer can't be opened,
+	// further attempts are delayed by an exponential backoff. After StreamReopenMaxAttempts
+	// consecutive failures the peer connection is dropped, and discovery takes care
+	// of reconnecting.
+	StreamReopenInterval, StreamReopenMaxInterval time.Duration
+	StreamReopenMaxAttempts                       int
+
+	// SafeModeDetection enables the automatic safe mode: when a misconfiguration
+	// is detected (e.g. network conflicts or duplicate addresses) the node stops
+	// forwarding VPN traffic until it is resolved.
+	SafeModeDetection bool
+
+	// AddressConflictHandler, when set, moves the node to a new address when
+	// it loses the conflict over its address with another peer. Without it,
+	// the node enters safe mode (if enabled) until the conflict is resolved.
+	AddressConflictHandler AddressConflictHandler
+
+	// AdvertisedRoutes are the networks the node forwards the traffic of
+	// the other nodes to, masquerading it. 0.0.0.0/0 makes it an exit node.
+	AdvertisedRoutes []*net.IPNet
+	// AcceptedRoutes are the networks the node routes through the nodes
+	// advertising them, or networks inside them
+	AcceptedRoutes []*net.IPNet
+	// ExitNodes are the peers whose routes are accepted by the default
+	// networks of AcceptedRoutes
+	ExitNodes []string
+	routes    *RouteTable
+
+	// Firewall, when set, filters the packets received from the peers
+	Firewall *Firewall
+
+	// InterfaceUpHandlers are called when the interface is usable
+	InterfaceUpHandlers []InterfaceUpHandler
+	// InterfaceDownHandlers are called when the interface is removed
+	InterfaceDownHandlers []InterfaceDownHandler
 }
 
+// InterfaceUpHandler is called with the name and the address of the interface
+// when it is created, and again each time its address changes
+type InterfaceUpHandler func(name, address string)
+
+// InterfaceDownHandler is called with the name of the interface when it is removed
+type InterfaceDownHandler func(name string)
+
 type Option func(cfg *Config) error
 
 // Apply applies the given options to the config, returning the first error
@@ -72,6 +151,37 @@ var LowProfile Option = func(cfg *Config) error {
 	return nil
 }
 
+var SafeModeDetection Option = func(cfg *Config) error {
+	cfg.SafeModeDetection = true
+
+	return nil
+}
+
+// WithAddressConflictHandler sets the handler remediating the address conflicts
+func WithAddressConflictHandler(h AddressConflictHandler) Option {
+	return func(cfg *Config) error {
+		cfg.AddressConflictHandler = h
+		return nil
+	}
+}
+
+// OnInterfaceUp adds a handler called when the interface is usable
+func OnInterfaceUp(h InterfaceUpHandler) Option {
+	return func(cfg *Config) error {
+		cfg.InterfaceUpHandlers = append(cfg.InterfaceUpHandlers, h)
+		return nil
+	}
+}
+
+// OnInterfaceDown adds a handler called when the interface is removed
+func OnInterfaceDown(h InterfaceDownHandler) Option {
+	return func(cfg *Config) error {
+		cfg.InterfaceDownHandlers = append(cfg.InterfaceDownHandlers, h)
+		return nil
+	}
+}
+
+// WithInterface uses the given interface instead of creating one
 func WithInterface(i *water.Interface) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.Interface = i
@@ -107,6 +217,55 @@ func WithRouterAddress(i string) func(cfg *Config) error {
 	}
 }
 
+// WithAdvertisedRoutes makes the node forward the traffic of the other
+// nodes to the networks, in CIDR notation. 0.0.0.0/0 or ::/0 make it an
+// exit node. The forwarding and masquerading are set up only when the
+// interface is managed by EdgeVPN (see NetLinkBootstrap).
+func WithAdvertisedRoutes(cidrs ...string) Option {
+	return func(cfg *Config) error {
+		nets, err := ParseRoutes(cidrs)
+		if err != nil {
+			return err
+		}
+		cfg.AdvertisedRoutes = append(cfg.AdvertisedRoutes, nets...)
+		return nil
+	}
+}
+
+// WithFirewall filters the packets received from the peers according to
+// the firewall rules signed by the admins. With denyByDefault, the packets
+// matching no rule are dropped.
+func WithFirewall(denyByDefault bool, admins ...peer.ID) Option {
+	return func(cfg *Config) error {
+		cfg.Firewall = NewFirewall(denyByDefault, admins...)
+		return nil
+	}
+}
+
+// WithAcceptedRoutes makes the node route the traffic to the networks
+// advertised by the other nodes through them, when inside one of the
+// given ones. 0.0.0.0/0 accepts all the routes of the exit nodes (see
+// WithExitNodes).
+func WithAcceptedRoutes(cidrs ...string) Option {
+	return func(cfg *Config) error {
+		nets, err := ParseRoutes(cidrs)
+		if err != nil {
+			return err
+		}
+		cfg.AcceptedRoutes = append(cfg.AcceptedRoutes, nets...)
+		return nil
+	}
+}
+
+// WithExitNodes sets the peers, by ID, whose routes are accepted by the
+// default networks of the accepted routes
+func WithExitNodes(peers ...string) Option {
+	return func(cfg *Config) error {
+		cfg.ExitNodes = append(cfg.ExitNodes, peers...)
+		return nil
+	}
+}
+
 func WithLedgerAnnounceTime(t time.Duration) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.LedgerAnnounceTime = t
@@ -114,6 +273,25 @@ func WithLedgerAnnounceTime(t time.Duration) func(cfg *Config) error {
 	}
 }
 
+// WithStreamReopenBackoff sets the initial and max interval between attempts of opening
+// a stream to a peer which previously failed
+func WithStreamReopenBackoff(initial, max time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.StreamReopenInterval = initial
+		cfg.StreamReopenMaxInterval = max
+		return nil
+	}
+}
+
+// WithStreamReopenMaxAttempts sets the number of consecutive failures opening a stream
+// before giving up the peer route. 0 means unlimited
+func WithStreamReopenMaxAttempts(i int) Option {
+	return func(cfg *Config) error {
+		cfg.StreamReopenMaxAttempts = i
+		return nil
+	}
+}
+
 func WithConcurrency(i int) Option {
 	return func(cfg *Config) error {
 		cfg.Concurrency = i
@@ -121,6 +299,43 @@ func WithConcurrency(i int) Option {
 	}
 }
 
+// WithBatchSize sets the maximum number of frames sent in one batch.
+// 0 keeps the default, 1 disables the batches.
+func WithBatchSize(i int) Option {
+	return func(cfg *Config) error {
+		if i < 0 {
+			return fmt.Errorf("invalid batch size %d", i)
+		}
+		if i > 0 {
+			cfg.BatchSize = i
+		}
+		return nil
+	}
+}
+
+// WithCompression compresses the batches with s2 or zstd, if the peers
+// support it. Empty or "none" disables it.
+func WithCompression(compression string) Option {
+	return func(cfg *Config) error {
+		if compression == "none" {
+			compression = CompressionNone
+		}
+		if _, err := compressionCodec(compression); err != nil {
+			return err
+		}
+		cfg.Compression = compression
+		return nil
+	}
+}
+
+// WithOffload enables the offloads of the TUN device, on Linux
+func WithOffload(b bool) Option {
+	return func(cfg *Config) error {
+		cfg.Offload = b
+		return nil
+	}
+}
+
 func WithChannelBufferSize(i int) Option {
 	return func(cfg *Config) error {
 		cfg.ChannelBufferSize = i
@@ -128,6 +343,42 @@ func WithChannelBufferSize(i int) Option {
 	}
 }
 
+// WithBackpressureTimeout sets how long reading from the interface is held
+// back while the peers are congested, before dropping frames.
+// An empty string keeps the default.
+func WithBackpressureTimeout(s string) Option {
+	return func(cfg *Config) error {
+		if s == "" {
+			return nil
+		}
+		d, err := time.ParseDuration(s)
+		cfg.BackpressureTimeout = d
+		return err
+	}
+}
+
+// WithWriteRetries sets how many times the transient errors writing a
+// frame to the interface are retried, and the interval between attempts
+func WithWriteRetries(retries int, interval time.Duration) Option {
+	return func(cfg *Config) error {
+		if retries < 0 || interval < 0 {
+			return fmt.Errorf("invalid write retries %d every %s", retries, interval)
+		}
+		cfg.WriteRetries = retries
+		cfg.WriteRetryInterval = interval
+		return nil
+	}
+}
+
+// WithWriteMaxFailures sets after how many frames in a row failing to be
+// written the interface is marked down. 0 never marks it down.
+func WithWriteMaxFailures(i int) Option {
+	return func(cfg *Config) error {
+		cfg.WriteMaxFailures = i
+		return nil
+	}
+}
+
 func WithInterfaceMTU(i int) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.InterfaceMTU = i
@@ -162,3 +413,53 @@ func WithInterfaceAddress(i string) func(cfg *Config) error {
 		return nil
 	}
 }
+
+// WithIPv6 assigns an IPv6 address to the interface alongside the IPv4 one,
+// derived from the peer ID in the unique local prefix of the network
+func WithIPv6(b bool) Option {
+	return func(cfg *Config) error {
+		cfg.IPv6 = cfg.IPv6 || b
+		return nil
+	}
+}
+
+// WithIPv6Prefix derives the IPv6 address of the interface in the prefix
+// (at most a /64) instead of the unique local prefix of the network.
+// It enables IPv6.
+func WithIPv6Prefix(cidr string) Option {
+	return func(cfg *Config) error {
+		if cidr == "" {
+			return nil
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid IPv6 prefix '%s': %w", cidr, err)
+		}
+		if _, err := PeerAddress6(n, ""); err != nil {
+			return err
+		}
+		cfg.IPv6Prefix = cidr
+		cfg.IPv6 = true
+		return nil
+	}
+}
+
+// WithInterfaceAddress6 sets a static IPv6 address (in CIDR notation) of the
+// interface, instead of the one derived from the peer ID. It enables IPv6.
+func WithInterfaceAddress6(cidr string) Option {
+	return func(cfg *Config) error {
+		if cidr == "" {
+			return nil
+		}
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid IPv6 address '%s': %w", cidr, err)
+		}
+		if ip.To4() != nil {
+			return fmt.Errorf("'%s' is not an IPv6 address", cidr)
+		}
+		cfg.InterfaceAddress6 = cidr
+		cfg.IPv6 = true
+		return nil
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/utils"
+)
+
+// AddressConflictHandler is called when the node loses the conflict over its
+// VPN address with another peer. It releases the address, and returns the new
+// one (in CIDR notation) the node moves to.
+type AddressConflictHandler func(ctx context.Context, b *blockchain.Ledger, address string) (string, error)
+
+// ClaimingPeer returns the peer other than self claiming the address in the
+// ledger, if it is alive, or an empty string otherwise
+func ClaimingPeer(b *blockchain.Ledger, ip, self string, alive func(peer string) bool) string {
+	v, found := b.GetKey(protocol.MachinesLedgerKey, ip)
+	if !found {
+		return ""
+	}
+	machine := &types.Machine{}
+	v.Unmarshal(machine)
+	if machine.PeerID != "" && machine.PeerID != self && alive(machine.PeerID) {
+		return machine.PeerID
+	}
+	return ""
+}
+
+// ConflictWinner returns which one of two peers claiming the same address keeps it.
+// The rule is deterministic, so that both the peers agree on it without coordination.
+func ConflictWinner(a, b string) string {
+	peers := []string{a, b}
+	sort.Strings(peers)
+	return utils.Leader(peers)
+}
+
+// ResolveAddressConflict looks for other alive peers claiming the address
+// (in CIDR notation). If the node loses the conflict, it moves to the address
+// returned by the handler, if any. It returns the peer in conflict, the new
+// address, and the reason if the conflict is left unresolved.
+func ResolveAddressConflict(ctx context.Context, b *blockchain.Ledger, address, self string, alive func(peer string) bool, h AddressConflictHandler) (p, newAddress, reason string) {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return "", "", fmt.Sprintf("invalid interface address '%s'", address)
+	}
+	p = ClaimingPeer(b, ip.String(), self, alive)
+	if p == "" || ConflictWinner(self, p) == self {
+		return p, "", ""
+	}
+
+	reason = fmt.Sprintf("address '%s' is already in use by '%s'", ip, p)
+	if h == nil {
+		return p, "", reason
+	}
+	newAddress, err = h(ctx, b, address)
+	if err != nil {
+		return p, "", fmt.Sprintf("%s, and could not move to another address: %s", reason, err.Error())
+	}
+	return p, newAddress, ""
+}
+
+// overlayAddress is the VPN address of the node, which changes
+// when an address conflict is remediated
+type overlayAddress struct {
+	sync.RWMutex
+	cidr string
+	ip   net.IP
+	// ip6 is the IPv6 address of the node, if dual-stack
+	ip6 net.IP
+}
+
+func newOverlayAddress(cidr string) (*overlayAddress, error) {
+	a := &overlayAddress{}
+	return a, a.Set(cidr)
+}
+
+func (a *overlayAddress) Set(cidr string) error {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.cidr, a.ip = cidr, ip
+	return nil
+}
+
+func (a *overlayAddress) IP() net.IP {
+	a.RLock()
+	defer a.RUnlock()
+	return a.ip
+}
+
+// SetIP6 sets the IPv6 address of the node, in CIDR notation
+func (a *overlayAddress) SetIP6(cidr string) error {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.ip6 = ip
+	return nil
+}
+
+// IP6 returns the IPv6 address of the node, nil if not dual-stack
+func (a *overlayAddress) IP6() net.IP {
+	a.RLock()
+	defer a.RUnlock()
+	return a.ip6
+}
+
+func (a *overlayAddress) CIDR() string {
+	a.RLock()
+	defer a.RUnlock()
+	return a.cidr
+}
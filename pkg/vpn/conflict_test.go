@@ -0,0 +1,105 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/store"
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+var _ = Describe("Address conflicts", func() {
+	var b *blockchain.Ledger
+	alive := func(string) bool { return true }
+
+	winner := ConflictWinner("a", "b")
+	loser := "a"
+	if winner == "a" {
+		loser = "b"
+	}
+
+	BeforeEach(func() {
+		b = blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		b.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+			"10.1.0.1": types.Machine{PeerID: winner, Address: "10.1.0.1"},
+			"10.1.0.2": types.Machine{PeerID: "c", Address: "10.1.0.2"},
+		})
+	})
+
+	It("agrees on the winner regardless of the order", func() {
+		Expect(ConflictWinner("a", "b")).To(Equal(ConflictWinner("b", "a")))
+		Expect(ConflictWinner("a", "b")).To(BeElementOf("a", "b"))
+	})
+
+	It("keeps the address when winning the conflict", func() {
+		b.Add(protocol.MachinesLedgerKey, map[string]interface{}{"10.1.0.1": types.Machine{PeerID: loser, Address: "10.1.0.1"}})
+
+		p, newAddress, reason := ResolveAddressConflict(context.Background(), b, "10.1.0.1/24", winner, alive, nil)
+		Expect(p).To(Equal(loser))
+		Expect(newAddress).To(BeEmpty())
+		Expect(reason).To(BeEmpty())
+	})
+
+	It("reports the conflict when losing it without a handler", func() {
+		_, newAddress, reason := ResolveAddressConflict(context.Background(), b, "10.1.0.1/24", loser, alive, nil)
+		Expect(newAddress).To(BeEmpty())
+		Expect(reason).To(ContainSubstring("already in use by '%s'", winner))
+	})
+
+	It("ignores peers which are gone", func() {
+		p, _, reason := ResolveAddressConflict(context.Background(), b, "10.1.0.1/24", loser, func(string) bool { return false }, nil)
+		Expect(p).To(BeEmpty())
+		Expect(reason).To(BeEmpty())
+	})
+
+	It("moves to a new DHCP lease when losing the conflict", func() {
+		leases := store.NewMemory()
+		h := DHCPConflictHandler(node.Config{ExchangeKey: "key"}, leases, "10.1.0.1")
+
+		p, newAddress, reason := ResolveAddressConflict(context.Background(), b, "10.1.0.1/24", loser, alive, h)
+		Expect(p).To(Equal(winner))
+		Expect(reason).To(BeEmpty())
+		Expect(newAddress).To(Equal("10.1.0.3/24"))
+
+		keys, err := leases.List("")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(keys).To(HaveLen(1))
+		lease, err := leases.Get("", keys[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(lease)).To(Equal("10.1.0.3"))
+
+		// Once moved, there is no conflict anymore
+		_, newAddress, reason = ResolveAddressConflict(context.Background(), b, newAddress, loser, alive, h)
+		Expect(newAddress).To(BeEmpty())
+		Expect(reason).To(BeEmpty())
+	})
+
+	It("reports the conflict if the handler fails", func() {
+		h := func(context.Context, *blockchain.Ledger, string) (string, error) {
+			return "", errors.New("no addresses left")
+		}
+		_, _, reason := ResolveAddressConflict(context.Background(), b, "10.1.0.1/24", loser, alive, h)
+		Expect(reason).To(ContainSubstring("no addresses left"))
+	})
+})
@@ -0,0 +1,154 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// ErrMalformedFrame is returned when the interface refuses a frame
+var ErrMalformedFrame = errors.New("malformed frame")
+
+// deviceWriter is the writer of the interface started last, and
+// the writers of the interfaces handled by this process by name
+var deviceWriter = struct {
+	sync.Mutex
+	w          *DeviceWriter
+	interfaces map[string]*DeviceWriter
+}{interfaces: map[string]*DeviceWriter{}}
+
+// DeviceStats returns the counters of the writes to the VPN interface
+func DeviceStats() types.DeviceWriteStat {
+	deviceWriter.Lock()
+	defer deviceWriter.Unlock()
+	if deviceWriter.w == nil {
+		return types.DeviceWriteStat{}
+	}
+	return deviceWriter.w.Stats()
+}
+
+// InterfaceDeviceStats returns the counters of the writes to the interface
+func InterfaceDeviceStats(name string) types.DeviceWriteStat {
+	deviceWriter.Lock()
+	defer deviceWriter.Unlock()
+	w, ok := deviceWriter.interfaces[name]
+	if !ok {
+		return types.DeviceWriteStat{}
+	}
+	return w.Stats()
+}
+
+// DeviceWriter writes the frames received from the peers to the interface.
+// Transient errors are retried up to Retries times, and the frames which
+// still can't be written are dropped without failing the stream. After
+// MaxFailures frames in a row are dropped the device is considered down,
+// until a frame is written again. The frames refused by the interface
+// fail with ErrMalformedFrame instead, closing the stream of the peer.
+type DeviceWriter struct {
+	w             io.Writer
+	Retries       int
+	RetryInterval time.Duration
+	MaxFailures   int
+	// OnDown is called with the last error when the device goes down,
+	// and OnUp when a frame is written to it again
+	OnDown func(error)
+	OnUp   func()
+
+	sync.Mutex
+	failures int
+	down     bool
+
+	frames, retried, errors uint64
+}
+
+// NewDeviceWriter returns a DeviceWriter writing to w
+func NewDeviceWriter(w io.Writer, retries int, retryInterval time.Duration, maxFailures int) *DeviceWriter {
+	return &DeviceWriter{w: w, Retries: retries, RetryInterval: retryInterval, MaxFailures: maxFailures}
+}
+
+// Write writes the frame to the device. Device errors are not returned.
+func (d *DeviceWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	for i := 0; err != nil && transient(err) && i < d.Retries; i++ {
+		atomic.AddUint64(&d.retried, 1)
+		time.Sleep(d.RetryInterval)
+		n, err = d.w.Write(p)
+	}
+	switch {
+	case err == nil:
+		atomic.AddUint64(&d.frames, 1)
+		d.written()
+		return n, nil
+	case errors.Is(err, syscall.EINVAL):
+		return n, errors.Join(ErrMalformedFrame, err)
+	}
+	atomic.AddUint64(&d.errors, 1)
+	d.failed(err)
+	return len(p), nil
+}
+
+func (d *DeviceWriter) written() {
+	d.Lock()
+	d.failures = 0
+	up := d.down
+	d.down = false
+	d.Unlock()
+	if up && d.OnUp != nil {
+		d.OnUp()
+	}
+}
+
+func (d *DeviceWriter) failed(err error) {
+	d.Lock()
+	d.failures++
+	down := !d.down && d.MaxFailures > 0 && d.failures >= d.MaxFailures
+	if down {
+		d.down = true
+	}
+	d.Unlock()
+	if down && d.OnDown != nil {
+		d.OnDown(err)
+	}
+}
+
+// Stats returns the counters of the writer
+func (d *DeviceWriter) Stats() types.DeviceWriteStat {
+	d.Lock()
+	down := d.down
+	d.Unlock()
+	return types.DeviceWriteStat{
+		Frames:  atomic.LoadUint64(&d.frames),
+		Retried: atomic.LoadUint64(&d.retried),
+		Errors:  atomic.LoadUint64(&d.errors),
+		Down:    down,
+	}
+}
+
+// transient returns true for the errors of a device which is busy
+// rather than gone
+func transient(err error) bool {
+	for _, e := range []error{syscall.EAGAIN, syscall.EBUSY, syscall.EINTR, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
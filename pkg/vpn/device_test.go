@@ -0,0 +1,97 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+// faultyDevice fails the writes with the queued errors, then succeeds
+type faultyDevice struct {
+	bytes.Buffer
+	errs []error
+}
+
+func (d *faultyDevice) Write(p []byte) (int, error) {
+	if len(d.errs) > 0 {
+		err := d.errs[0]
+		d.errs = d.errs[1:]
+		return 0, err
+	}
+	return d.Buffer.Write(p)
+}
+
+var _ = Describe("Device writer", func() {
+	It("retries the transient errors", func() {
+		dev := &faultyDevice{errs: []error{syscall.EAGAIN, fmt.Errorf("write: %w", syscall.EBUSY)}}
+		w := NewDeviceWriter(dev, 3, time.Millisecond, 1)
+		Expect(w.Write([]byte("frame"))).To(Equal(5))
+		Expect(dev.String()).To(Equal("frame"))
+		Expect(w.Stats().Retried).To(Equal(uint64(2)))
+		Expect(w.Stats().Frames).To(Equal(uint64(1)))
+		Expect(w.Stats().Errors).To(BeZero())
+	})
+
+	It("drops the frames which can't be written without failing the stream", func() {
+		dev := &faultyDevice{errs: []error{syscall.EIO}}
+		w := NewDeviceWriter(dev, 3, time.Millisecond, 10)
+		n, err := io.Copy(w, bytes.NewBufferString("frame"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(int64(5)))
+		Expect(dev.Len()).To(BeZero())
+		Expect(w.Stats().Errors).To(Equal(uint64(1)))
+		Expect(w.Stats().Retried).To(BeZero())
+		Expect(w.Stats().Down).To(BeFalse())
+	})
+
+	It("marks the device down on persistent failures, and up once it recovers", func() {
+		dev := &faultyDevice{errs: []error{syscall.EIO, syscall.ENODEV, syscall.EIO}}
+		w := NewDeviceWriter(dev, 1, time.Millisecond, 3)
+		downs, ups := []error{}, 0
+		w.OnDown = func(err error) { downs = append(downs, err) }
+		w.OnUp = func() { ups++ }
+
+		for i := 0; i < 3; i++ {
+			_, err := w.Write([]byte("frame"))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(downs).To(HaveLen(1))
+		Expect(errors.Is(downs[0], syscall.EIO)).To(BeTrue())
+		Expect(w.Stats().Down).To(BeTrue())
+		Expect(ups).To(BeZero())
+
+		Expect(w.Write([]byte("frame"))).To(Equal(5))
+		Expect(w.Stats().Down).To(BeFalse())
+		Expect(ups).To(Equal(1))
+		Expect(w.Stats().Errors).To(Equal(uint64(3)))
+	})
+
+	It("fails on the frames refused by the interface", func() {
+		w := NewDeviceWriter(&faultyDevice{errs: []error{syscall.EINVAL}}, 3, time.Millisecond, 1)
+		_, err := w.Write([]byte("frame"))
+		Expect(errors.Is(err, ErrMalformedFrame)).To(BeTrue())
+		Expect(w.Stats().Errors).To(BeZero())
+		Expect(w.Stats().Down).To(BeFalse())
+	})
+})
@@ -18,9 +18,7 @@ package vpn
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"net"
 	"time"
 
 	"github.com/ipfs/go-log/v2"
@@ -28,22 +26,28 @@ import (
 	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/protocol"
 	"github.com/mudler/edgevpn/pkg/services"
+	"github.com/mudler/edgevpn/pkg/store"
 	"github.com/mudler/edgevpn/pkg/types"
 	"github.com/mudler/edgevpn/pkg/utils"
 
 	"github.com/mudler/edgevpn/pkg/blockchain"
 )
 
-func checkDHCPLease(c node.Config, leasedir string) string {
-	// retrieve lease if present
+// leaseNamespace is the namespace of the DHCP leases in the store. Leases
+// are kept at the root of the store, where older versions saved them.
+const leaseNamespace = ""
+
+func leaseKey(c node.Config) string {
+	return crypto.MD5(fmt.Sprintf("%s-ek", c.ExchangeKey))
+}
 
-	leaseFileName := crypto.MD5(fmt.Sprintf("%s-ek", c.ExchangeKey))
-	leaseFile := filepath.Join(leasedir, leaseFileName)
-	if _, err := os.Stat(leaseFile); err == nil {
-		b, _ := ioutil.ReadFile(leaseFile)
-		return string(b)
+func checkDHCPLease(c node.Config, leases store.Store) string {
+	// retrieve lease if present
+	b, err := leases.Get(leaseNamespace, leaseKey(c))
+	if err != nil {
+		return ""
 	}
-	return ""
+	return string(b)
 }
 func contains(slice []string, elem string) bool {
 	for _, s := range slice {
@@ -55,12 +59,10 @@ func contains(slice []string, elem string) bool {
 }
 
 // DHCPNetworkService returns a DHCP network service
-func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Duration, leasedir string, address string) node.NetworkService {
+func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Duration, leases store.Store, address string) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
-		os.MkdirAll(leasedir, 0600)
-
 		// retrieve lease if present
-		var wantedIP = checkDHCPLease(c, leasedir)
+		var wantedIP = checkDHCPLease(c, leases)
 
 		//  whoever wants a new IP:
 		//  1. Get available nodes. Filter from Machine those that do not have an IP.
@@ -133,11 +135,9 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 			wantedIP = utils.NextIP(address, ips)
 		}
 
-		// Save lease to disk
-		leaseFileName := crypto.MD5(fmt.Sprintf("%s-ek", c.ExchangeKey))
-		leaseFile := filepath.Join(leasedir, leaseFileName)
-		l.Debugf("Writing lease to '%s'", leaseFile)
-		if err := ioutil.WriteFile(leaseFile, []byte(wantedIP), 0600); err != nil {
+		// Save lease
+		l.Debugf("Writing lease '%s'", wantedIP)
+		if err := leases.Put(leaseNamespace, leaseKey(c), []byte(wantedIP)); err != nil {
 			l.Warn(err)
 		}
 
@@ -149,27 +149,57 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 	}
 }
 
+// DHCPConflictHandler releases the lease of an address in use by another peer,
+// and leases the next address free in the ledger
+func DHCPConflictHandler(c node.Config, leases store.Store, address string) AddressConflictHandler {
+	return func(ctx context.Context, b *blockchain.Ledger, current string) (string, error) {
+		ip, _, err := net.ParseCIDR(current)
+		if err != nil {
+			return "", err
+		}
+		if err := leases.Delete(leaseNamespace, leaseKey(c)); err != nil {
+			return "", err
+		}
+
+		ips := []string{ip.String()}
+		for k := range b.CurrentData()[protocol.MachinesLedgerKey] {
+			ips = append(ips, k)
+		}
+		wantedIP := utils.NextIP(address, ips)
+		if err := leases.Put(leaseNamespace, leaseKey(c), []byte(wantedIP)); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s/24", wantedIP), nil
+	}
+}
+
 // DHCP returns a DHCP network service. It requires the Alive Service in order to determine available nodes.
 // Nodes available are used to determine which needs an IP and when maxTime expires nodes are marked as offline and
 // not considered.
-func DHCP(l log.StandardLogger, maxTime time.Duration, leasedir string, address string) ([]node.Option, []Option) {
+func DHCP(l log.StandardLogger, maxTime time.Duration, leases store.Store, address string) ([]node.Option, []Option) {
 	ip := make(chan string, 1)
+	var nodeConfig node.Config
 	return []node.Option{
 			func(cfg *node.Config) error {
 				// retrieve lease if present. consumed by conngater when starting the node
-				lease := checkDHCPLease(*cfg, leasedir)
+				lease := checkDHCPLease(*cfg, leases)
 				if lease != "" {
 					cfg.InterfaceAddress = fmt.Sprintf("%s/24", lease)
 				}
 				return nil
 			},
-			node.WithNetworkService(DHCPNetworkService(ip, l, maxTime, leasedir, address)),
+			node.WithNetworkService(func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+				nodeConfig = c
+				return DHCPNetworkService(ip, l, maxTime, leases, address)(ctx, c, n, b)
+			}),
 		}, []Option{
 			func(cfg *Config) error {
 				// read back IP when starting vpn
 				cfg.InterfaceAddress = fmt.Sprintf("%s/24", <-ip)
 				close(ip)
 				l.Debug("IP Received", cfg.InterfaceAddress)
+				// move to a new lease when the address is in use by another peer
+				cfg.AddressConflictHandler = DHCPConflictHandler(nodeConfig, leases, address)
 				return nil
 			},
 		}
@@ -0,0 +1,299 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/metrics"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/trustzone"
+	"github.com/mudler/edgevpn/pkg/types"
+)
+
+// FlowTimeout is how long the replies to a connection opened by the node
+// are accepted after its last packet
+const FlowTimeout = 5 * time.Minute
+
+// Firewall filters the packets received from the peers according to the
+// rules signed by the admins and published in the ledger.
+//
+// The rules of a peer are applied first, and then the ones of any peer:
+// a matching deny rule drops the packet, a matching allow rule accepts it,
+// and when there are allow rules but none matches the packet is dropped,
+// as the peer can reach only their destinations. The packets matching no
+// rule are accepted, unless DenyByDefault is set. The replies to the
+// connections opened by the node are always accepted.
+type Firewall struct {
+	// Admins are the peers trusted to sign the rules
+	Admins []peer.ID
+	// DenyByDefault drops the packets matching no rule
+	DenyByDefault bool
+
+	sync.Mutex
+	rules map[string][]firewallRule
+	flows map[flowKey]time.Time
+}
+
+// NewFirewall returns a Firewall enforcing the rules signed by the admins
+func NewFirewall(denyByDefault bool, admins ...peer.ID) *Firewall {
+	return &Firewall{Admins: admins, DenyByDefault: denyByDefault}
+}
+
+type firewallRule struct {
+	allow    bool
+	network  *net.IPNet
+	port     uint16
+	protocol string
+}
+
+// compileRule parses the rule, failing if it can't be enforced
+func compileRule(r types.FirewallRule) (firewallRule, error) {
+	fr := firewallRule{protocol: strings.ToLower(r.Protocol)}
+	if r.ID == "" {
+		return fr, fmt.Errorf("the rule has no ID")
+	}
+	if r.Peer != types.FirewallAnyPeer {
+		if _, err := peer.Decode(r.Peer); err != nil {
+			return fr, fmt.Errorf("invalid peer '%s': %w", r.Peer, err)
+		}
+	}
+	switch r.Action {
+	case types.FirewallAllow:
+		fr.allow = true
+	case types.FirewallDeny:
+	default:
+		return fr, fmt.Errorf("invalid action '%s', either %s or %s", r.Action, types.FirewallAllow, types.FirewallDeny)
+	}
+	if r.Destination != "" {
+		dst := r.Destination
+		if !strings.Contains(dst, "/") {
+			if ip := net.ParseIP(dst); ip != nil && ip.To4() == nil {
+				dst += "/128"
+			} else {
+				dst += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(dst)
+		if err != nil {
+			return fr, fmt.Errorf("invalid destination '%s': %w", r.Destination, err)
+		}
+		fr.network = network
+	}
+	switch fr.protocol {
+	case "", "tcp", "udp", "icmp":
+	default:
+		return fr, fmt.Errorf("invalid protocol '%s', either tcp, udp or icmp", r.Protocol)
+	}
+	if r.Port < 0 || r.Port > 65535 || (r.Port > 0 && fr.protocol == "icmp") {
+		return fr, fmt.Errorf("invalid port %d", r.Port)
+	}
+	fr.port = uint16(r.Port)
+	return fr, nil
+}
+
+// ValidateFirewallRule returns an error if the rule can't be enforced
+func ValidateFirewallRule(r types.FirewallRule) error {
+	_, err := compileRule(r)
+	return err
+}
+
+func (r firewallRule) matches(p packet) bool {
+	return (r.network == nil || r.network.Contains(p.dst.Addr().AsSlice())) &&
+		(r.protocol == "" || r.protocol == p.protocol) &&
+		(r.port == 0 || (r.port == p.dst.Port() && p.protocol != "icmp"))
+}
+
+// Set replaces the rules enforced by the firewall. The invalid ones are skipped.
+func (f *Firewall) Set(rules []types.FirewallRule) {
+	compiled := map[string][]firewallRule{}
+	for _, r := range rules {
+		fr, err := compileRule(r)
+		if err != nil {
+			continue
+		}
+		compiled[r.Peer] = append(compiled[r.Peer], fr)
+	}
+	f.Lock()
+	f.rules = compiled
+	f.Unlock()
+}
+
+// Track records the connection opened by a packet the node sends to the
+// peer, so that its replies from the same peer are accepted
+func (f *Firewall) Track(to string, frame []byte) {
+	p, ok := parsePacket(frame)
+	if !ok {
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.flows == nil {
+		f.flows = map[flowKey]time.Time{}
+	}
+	f.flows[flowKey{peer: to, protocol: p.protocol, local: p.src, remote: p.dst}] = time.Now()
+}
+
+// Allowed returns true if the packet received from the peer is accepted
+func (f *Firewall) Allowed(from string, frame []byte) bool {
+	p, ok := parsePacket(frame)
+
+	f.Lock()
+	defer f.Unlock()
+	if !ok {
+		return !f.DenyByDefault && len(f.rules) == 0
+	}
+	if t, exists := f.flows[flowKey{peer: from, protocol: p.protocol, local: p.dst, remote: p.src}]; exists && time.Since(t) < FlowTimeout {
+		return true
+	}
+	for _, rules := range [][]firewallRule{f.rules[from], f.rules[types.FirewallAnyPeer]} {
+		if allowed, matched := evaluate(rules, p); matched {
+			return allowed
+		}
+	}
+	return !f.DenyByDefault
+}
+
+// evaluate applies the rules to the packet. matched is false when no
+// rule decides about it.
+func evaluate(rules []firewallRule, p packet) (allowed, matched bool) {
+	for _, r := range rules {
+		switch {
+		case !r.allow && r.matches(p):
+			return false, true
+		case r.allow:
+			matched = true
+			allowed = allowed || r.matches(p)
+		}
+	}
+	return
+}
+
+// expire forgets the connections idle for longer than FlowTimeout
+func (f *Firewall) expire() {
+	f.Lock()
+	defer f.Unlock()
+	for k, t := range f.flows {
+		if time.Since(t) >= FlowTimeout {
+			delete(f.flows, k)
+		}
+	}
+}
+
+type flowKey struct {
+	peer          string
+	protocol      string
+	local, remote netip.AddrPort
+}
+
+// packet is the protocol and the endpoints of an IP packet.
+// The ports are 0 for the protocols other than TCP and UDP.
+type packet struct {
+	protocol string
+	src, dst netip.AddrPort
+}
+
+func parsePacket(frame []byte) (packet, bool) {
+	var src, dst net.IP
+	var proto string
+	var payload []byte
+
+	var ip4 layers.IPv4
+	var ip6 layers.IPv6
+	switch {
+	case ip4.DecodeFromBytes(frame, gopacket.NilDecodeFeedback) == nil:
+		src, dst, payload = ip4.SrcIP, ip4.DstIP, ip4.Payload
+		proto = ipProtocol(ip4.Protocol)
+	case ip6.DecodeFromBytes(frame, gopacket.NilDecodeFeedback) == nil:
+		src, dst, payload = ip6.SrcIP, ip6.DstIP, ip6.Payload
+		proto = ipProtocol(ip6.NextHeader)
+	default:
+		return packet{}, false
+	}
+
+	srcAddr, ok := netip.AddrFromSlice(src)
+	if !ok {
+		return packet{}, false
+	}
+	dstAddr, ok := netip.AddrFromSlice(dst)
+	if !ok {
+		return packet{}, false
+	}
+	var srcPort, dstPort uint16
+	if (proto == "tcp" || proto == "udp") && len(payload) >= 4 {
+		srcPort = binary.BigEndian.Uint16(payload[0:2])
+		dstPort = binary.BigEndian.Uint16(payload[2:4])
+	}
+	return packet{
+		protocol: proto,
+		src:      netip.AddrPortFrom(srcAddr.Unmap(), srcPort),
+		dst:      netip.AddrPortFrom(dstAddr.Unmap(), dstPort),
+	}, true
+}
+
+func ipProtocol(p layers.IPProtocol) string {
+	switch p {
+	case layers.IPProtocolTCP:
+		return "tcp"
+	case layers.IPProtocolUDP:
+		return "udp"
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		return "icmp"
+	}
+	return p.String()
+}
+
+// firewallWriter drops the frames of the peer refused by the firewall
+type firewallWriter struct {
+	io.Writer
+	firewall *Firewall
+	peer     string
+}
+
+func (w *firewallWriter) Write(p []byte) (int, error) {
+	if !w.firewall.Allowed(w.peer, p) {
+		metrics.FirewallDropped.With(w.peer).Add(1)
+		return len(p), nil
+	}
+	return w.Writer.Write(p)
+}
+
+// syncFirewall keeps the firewall rules in sync with the ledger
+func syncFirewall(ctx context.Context, c *Config, b *blockchain.Ledger) {
+	rules := trustzone.NewFirewallRuleSet(c.Firewall.Admins...)
+	t := time.NewTicker(c.LedgerAnnounceTime)
+	defer t.Stop()
+	for {
+		c.Firewall.Set(rules.Update(b.CurrentData()[protocol.FirewallLedgerKey]))
+		c.Firewall.expire()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
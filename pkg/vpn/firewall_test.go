@@ -0,0 +1,106 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+func tcpPacket(src, dst string, srcPort, dstPort int) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), SYN: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	Expect(gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp)).To(Succeed())
+	return buf.Bytes()
+}
+
+var _ = Describe("Firewall", func() {
+	newPeer := func() string {
+		k, _ := node.GenPrivKey(0)
+		id, _ := peer.IDFromPrivateKey(k)
+		return id.String()
+	}
+	x, y := newPeer(), newPeer()
+
+	It("validates the rules", func() {
+		Expect(ValidateFirewallRule(types.FirewallRule{ID: "a", Peer: x, Action: types.FirewallAllow, Destination: "10.1.0.5", Port: 443, Protocol: "tcp"})).To(Succeed())
+		Expect(ValidateFirewallRule(types.FirewallRule{ID: "a", Peer: types.FirewallAnyPeer, Action: types.FirewallDeny})).To(Succeed())
+		Expect(ValidateFirewallRule(types.FirewallRule{Peer: x, Action: types.FirewallDeny})).ToNot(Succeed())
+		Expect(ValidateFirewallRule(types.FirewallRule{ID: "a", Peer: "nobody", Action: types.FirewallDeny})).ToNot(Succeed())
+		Expect(ValidateFirewallRule(types.FirewallRule{ID: "a", Peer: x, Action: "drop"})).ToNot(Succeed())
+		Expect(ValidateFirewallRule(types.FirewallRule{ID: "a", Peer: x, Action: types.FirewallDeny, Destination: "10.1.0"})).ToNot(Succeed())
+		Expect(ValidateFirewallRule(types.FirewallRule{ID: "a", Peer: x, Action: types.FirewallDeny, Port: 80, Protocol: "icmp"})).ToNot(Succeed())
+	})
+
+	It("accepts everything without rules, unless denying by default", func() {
+		Expect(NewFirewall(false).Allowed(x, tcpPacket("10.1.0.2", "10.1.0.1", 40000, 22))).To(BeTrue())
+		Expect(NewFirewall(true).Allowed(x, tcpPacket("10.1.0.2", "10.1.0.1", 40000, 22))).To(BeFalse())
+	})
+
+	It("restricts the peers to the destinations they are allowed to reach", func() {
+		f := NewFirewall(false)
+		f.Set([]types.FirewallRule{
+			{ID: "x-web", Peer: x, Action: types.FirewallAllow, Destination: "10.1.0.5", Port: 443, Protocol: "tcp"},
+			{ID: "no-ssh", Peer: types.FirewallAnyPeer, Action: types.FirewallDeny, Port: 22},
+			{ID: "invalid", Peer: y, Action: "drop"},
+		})
+
+		Expect(f.Allowed(x, tcpPacket("10.1.0.2", "10.1.0.5", 40000, 443))).To(BeTrue())
+		Expect(f.Allowed(x, tcpPacket("10.1.0.2", "10.1.0.5", 40000, 80))).To(BeFalse())
+		Expect(f.Allowed(x, tcpPacket("10.1.0.2", "10.1.0.6", 40000, 443))).To(BeFalse())
+
+		Expect(f.Allowed(y, tcpPacket("10.1.0.3", "10.1.0.5", 40000, 80))).To(BeTrue())
+		Expect(f.Allowed(y, tcpPacket("10.1.0.3", "10.1.0.5", 40000, 22))).To(BeFalse())
+	})
+
+	It("denies the peers without rules of their own", func() {
+		f := NewFirewall(false)
+		f.Set([]types.FirewallRule{
+			{ID: "x-any", Peer: x, Action: types.FirewallAllow},
+			{ID: "deny-new", Peer: types.FirewallAnyPeer, Action: types.FirewallDeny},
+		})
+		Expect(f.Allowed(x, tcpPacket("10.1.0.2", "10.1.0.1", 40000, 22))).To(BeTrue())
+		Expect(f.Allowed(y, tcpPacket("10.1.0.3", "10.1.0.1", 40000, 22))).To(BeFalse())
+		Expect(f.Allowed(y, []byte("garbage"))).To(BeFalse())
+	})
+
+	It("accepts the replies to the connections opened by the node", func() {
+		f := NewFirewall(true)
+		Expect(f.Allowed(y, tcpPacket("10.1.0.3", "10.1.0.1", 80, 40000))).To(BeFalse())
+
+		f.Track(y, tcpPacket("10.1.0.1", "10.1.0.3", 40000, 80))
+		Expect(f.Allowed(y, tcpPacket("10.1.0.3", "10.1.0.1", 80, 40000))).To(BeTrue())
+		Expect(f.Allowed(y, tcpPacket("10.1.0.3", "10.1.0.1", 80, 40001))).To(BeFalse())
+	})
+
+	It("accepts the replies only from the peer the connection was opened to", func() {
+		f := NewFirewall(true)
+		f.Track(y, tcpPacket("10.1.0.1", "10.1.0.3", 40000, 80))
+
+		// x spoofs a reply of y
+		Expect(f.Allowed(x, tcpPacket("10.1.0.3", "10.1.0.1", 80, 40000))).To(BeFalse())
+		Expect(f.Allowed(y, tcpPacket("10.1.0.3", "10.1.0.1", 80, 40000))).To(BeTrue())
+	})
+})
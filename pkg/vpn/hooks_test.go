@@ -0,0 +1,99 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/node"
+	. "github.com/mudler/edgevpn/pkg/vpn"
+	"github.com/mudler/water"
+)
+
+// mockInterface is a device which never receives packets
+type mockInterface struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (m *mockInterface) Read(p []byte) (int, error) {
+	select {
+	case <-m.closed:
+	case <-time.After(50 * time.Millisecond):
+	}
+	return 0, errors.New("no packets")
+}
+
+func (m *mockInterface) Write(p []byte) (int, error) { return len(p), nil }
+
+func (m *mockInterface) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
+
+var _ = Describe("Interface hooks", func() {
+	It("notifies when the interface goes up and down", func() {
+		var lock sync.Mutex
+		var events []string
+		record := func(s string) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, s)
+		}
+		recorded := func() []string {
+			lock.Lock()
+			defer lock.Unlock()
+			return append([]string{}, events...)
+		}
+
+		l := logger.New(log.LevelFatal)
+		token := node.GenerateNewConnectionData(25).Base64()
+		e, err := node.New(
+			node.FromBase64(false, false, token, nil, nil),
+			node.WithStore(&blockchain.MemoryStore{}),
+			node.Logger(l),
+			node.WithNetworkService(VPNNetworkService(
+				WithInterface(&water.Interface{ReadWriteCloser: &mockInterface{closed: make(chan struct{})}}),
+				WithInterfaceAddress("10.1.0.1/24"),
+				Logger(l),
+				OnInterfaceUp(func(name, address string) { record("up " + address) }),
+				OnInterfaceDown(func(name string) { record("down") }),
+			)),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		done := make(chan error)
+		go func() { done <- e.Start(ctx) }()
+
+		Eventually(recorded, 10*time.Second).Should(Equal([]string{"up 10.1.0.1/24"}))
+		Expect(e.Status().Interface.Up).To(BeTrue())
+		Expect(e.Status().Interface.Address).To(Equal("10.1.0.1/24"))
+
+		cancel()
+		Eventually(done, 10*time.Second).Should(Receive())
+		Expect(recorded()).To(Equal([]string{"up 10.1.0.1/24", "down"}))
+		Expect(e.Status().Interface.Up).To(BeFalse())
+	})
+})
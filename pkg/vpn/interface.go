@@ -22,9 +22,10 @@ import (
 )
 
 func createInterface(c *Config) (*water.Interface, error) {
+	// The device is persistent to be attached again enabling the offloads
 	config := water.Config{
 		DeviceType:             c.DeviceType,
-		PlatformSpecificParams: water.PlatformSpecificParams{Persist: !c.NetLinkBootstrap},
+		PlatformSpecificParams: water.PlatformSpecificParams{Persist: !c.NetLinkBootstrap || c.Offload},
 	}
 	config.Name = c.InterfaceName
 
@@ -52,9 +53,37 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 
+	if c.InterfaceAddress6 != "" {
+		addr6, err := netlink.ParseAddr(c.InterfaceAddress6)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(link, addr6); err != nil {
+			return err
+		}
+	}
+
 	err = netlink.LinkSetUp(link)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// changeInterfaceAddress replaces the old address of the interface with the new one
+func changeInterfaceAddress(c *Config, old, new string) error {
+	link, err := netlink.LinkByName(c.InterfaceName)
+	if err != nil {
+		return err
+	}
+
+	if addr, err := netlink.ParseAddr(old); err == nil {
+		netlink.AddrDel(link, addr)
+	}
+
+	addr, err := netlink.ParseAddr(new)
+	if err != nil {
+		return err
+	}
+	return netlink.AddrAdd(link, addr)
+}
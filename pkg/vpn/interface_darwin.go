@@ -66,6 +66,18 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 
+	if c.InterfaceAddress6 != "" {
+		ip6, ipNet6, err := net.ParseCIDR(c.InterfaceAddress6)
+		if err != nil {
+			return err
+		}
+		ones, _ := ipNet6.Mask.Size()
+		cmd = exec.Command("ifconfig", iface.Name, "inet6", ip6.String(), "prefixlen", strconv.Itoa(ones), "alias")
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	}
+
 	// Bring up the interface. This is not directly possible with the `net` package,
 	// so we use the `ifconfig` command.
 	cmd = exec.Command("ifconfig", iface.Name, "up")
@@ -83,3 +95,12 @@ func prepareInterface(c *Config) error {
 
 	return nil
 }
+
+// changeInterfaceAddress replaces the old address of the interface with the new one
+func changeInterfaceAddress(c *Config, old, new string) error {
+	if _, oldNet, err := net.ParseCIDR(old); err == nil {
+		exec.Command("route", "-n", "delete", "-net", oldNet.String()).Run()
+	}
+	c.InterfaceAddress = new
+	return prepareInterface(c)
+}
@@ -40,6 +40,12 @@ func prepareInterface(c *Config) error {
 	if err != nil {
 		return err
 	}
+	if c.InterfaceAddress6 != "" {
+		err = sh(fmt.Sprintf("ifconfig %s inet6 %s alias", c.InterfaceName, c.InterfaceAddress6))
+		if err != nil {
+			return err
+		}
+	}
 	return sh(fmt.Sprintf("ifconfig %s up", c.InterfaceName))
 }
 
@@ -47,3 +53,8 @@ func sh(c string) (err error) {
 	_, err = exec.Command("/bin/sh", "-c", c).CombinedOutput()
 	return
 }
+
+// changeInterfaceAddress replaces the old address of the interface with the new one
+func changeInterfaceAddress(c *Config, old, new string) error {
+	return sh(fmt.Sprintf("ifconfig %s inet %s %s netmask %s", c.InterfaceName, new, new, "255.255.255.0"))
+}
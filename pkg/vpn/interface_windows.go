@@ -40,17 +40,28 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 	addresses := append([]netip.Prefix{}, prefix)
+	families := []winipcfg.AddressFamily{windows.AF_INET}
+	if c.InterfaceAddress6 != "" {
+		prefix6, err := netip.ParsePrefix(c.InterfaceAddress6)
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, prefix6)
+		families = append(families, windows.AF_INET6)
+	}
 	if err := luid.SetIPAddresses(addresses); err != nil {
 		return err
 	}
 
-	iface, err := luid.IPInterface(windows.AF_INET)
-	if err != nil {
-		return err
-	}
-	iface.NLMTU = uint32(c.InterfaceMTU)
-	if err := iface.Set(); err != nil {
-		return err
+	for _, family := range families {
+		iface, err := luid.IPInterface(family)
+		if err != nil {
+			return err
+		}
+		iface.NLMTU = uint32(c.InterfaceMTU)
+		if err := iface.Set(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -62,3 +73,9 @@ func createInterface(c *Config) (*water.Interface, error) {
 	config.Name = c.InterfaceName
 	return water.New(config)
 }
+
+// changeInterfaceAddress replaces the old address of the interface with the new one
+func changeInterfaceAddress(c *Config, old, new string) error {
+	c.InterfaceAddress = new
+	return prepareInterface(c)
+}
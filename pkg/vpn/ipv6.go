@@ -0,0 +1,192 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/mudler/edgevpn/pkg/utils"
+)
+
+// minIPv6MTU is the minimum MTU of the links carrying IPv6 (RFC 8200)
+const minIPv6MTU = 1280
+
+// ULAPrefix returns the unique local /64 of the network (RFC 4193). Its
+// global ID is derived from the network key, so the nodes of the same
+// network share it without configuration.
+func ULAPrefix(networkKey string) *net.IPNet {
+	h := sha256.Sum256([]byte(networkKey + "-ula"))
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfd
+	copy(ip[1:6], h[:5])
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+}
+
+// PeerAddress6 returns the address of the peer in the IPv6 prefix, in CIDR
+// notation. The interface identifier (the last 64 bits) is derived from the
+// peer ID, so the address of a peer is stable across restarts.
+func PeerAddress6(prefix *net.IPNet, peerID string) (string, error) {
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len || prefix.IP.To4() != nil {
+		return "", fmt.Errorf("'%s' is not an IPv6 prefix", prefix)
+	}
+	if ones > 64 {
+		return "", fmt.Errorf("IPv6 prefix '%s' is longer than /64", prefix)
+	}
+	h := sha256.Sum256([]byte(peerID))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.Mask(prefix.Mask))
+	copy(ip[8:], h[:8])
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
+
+// MachineTable6 maps the IPv6 addresses of the machines in the ledger to
+// their peers. The machines are stored in the ledger by IPv4 address, so
+// the IPv6 destinations are looked up here.
+type MachineTable6 struct {
+	// Prefix is the IPv6 prefix the addresses of the peers are derived in.
+	// The addresses inside it are taken only from the peers they derive from.
+	Prefix *net.IPNet
+
+	sync.RWMutex
+	peers     map[string]string
+	conflicts map[string][]string
+}
+
+// valid returns true if the peer can claim the address: the addresses
+// inside the prefix must be the one derived from the peer ID
+func (t *MachineTable6) valid(ip, peerID string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil || peerID == "" {
+		return false
+	}
+	if t.Prefix == nil || !t.Prefix.Contains(addr) {
+		return true
+	}
+	derived, err := PeerAddress6(t.Prefix, peerID)
+	if err != nil {
+		return false
+	}
+	d, _, err := net.ParseCIDR(derived)
+	return err == nil && d.Equal(addr)
+}
+
+// claims returns the peers claiming each IPv6 address in the ledger, sorted
+func (t *MachineTable6) claims(b *blockchain.Ledger) map[string][]string {
+	res := map[string][]string{}
+	for _, d := range b.CurrentData()[protocol.MachinesLedgerKey] {
+		machine := &types.Machine{}
+		d.Unmarshal(machine)
+		if machine.Address6 == "" || !t.valid(machine.Address6, machine.PeerID) {
+			continue
+		}
+		res[machine.Address6] = append(res[machine.Address6], machine.PeerID)
+	}
+	for ip, peers := range res {
+		sort.Strings(peers)
+		res[ip] = peers
+	}
+	return res
+}
+
+// Sync replaces the table with the IPv6 addresses of the machines in the
+// ledger. An address claimed by more peers goes to the winner of the
+// conflict, as for the IPv4 addresses. The conflicts not reported by the
+// previous Sync are returned, as address and peers.
+func (t *MachineTable6) Sync(b *blockchain.Ledger) map[string][]string {
+	peers := map[string]string{}
+	conflicts := map[string][]string{}
+	for ip, claiming := range t.claims(b) {
+		peers[ip] = utils.Leader(claiming)
+		if len(claiming) > 1 {
+			conflicts[ip] = claiming
+		}
+	}
+	t.Lock()
+	defer t.Unlock()
+	reported := map[string][]string{}
+	for ip, claiming := range conflicts {
+		if !reflect.DeepEqual(t.conflicts[ip], claiming) {
+			reported[ip] = claiming
+		}
+	}
+	t.peers = peers
+	t.conflicts = conflicts
+	return reported
+}
+
+// Lookup returns the peer with the IPv6 address. The ledger is searched
+// for the addresses not in the table yet, as of machines announced since
+// the last Sync.
+func (t *MachineTable6) Lookup(b *blockchain.Ledger, ip string) (string, bool) {
+	t.RLock()
+	p, found := t.peers[ip]
+	t.RUnlock()
+	if found {
+		return p, true
+	}
+
+	claiming := []string{}
+	b.Exists(protocol.MachinesLedgerKey, func(d blockchain.Data) bool {
+		machine := &types.Machine{}
+		d.Unmarshal(machine)
+		if machine.Address6 == ip && t.valid(ip, machine.PeerID) {
+			claiming = append(claiming, machine.PeerID)
+		}
+		return false
+	})
+	if len(claiming) == 0 {
+		return "", false
+	}
+	sort.Strings(claiming)
+	p = utils.Leader(claiming)
+	t.Lock()
+	defer t.Unlock()
+	if t.peers == nil {
+		t.peers = map[string]string{}
+	}
+	t.peers[ip] = p
+	return p, true
+}
+
+// ipv6Prefix returns the IPv6 prefix of the network: the configured one,
+// or the unique local one derived from the network key
+func ipv6Prefix(c *Config, networkKey string) (*net.IPNet, error) {
+	if c.IPv6Prefix == "" {
+		return ULAPrefix(networkKey), nil
+	}
+	_, p, err := net.ParseCIDR(c.IPv6Prefix)
+	return p, err
+}
+
+// interfaceAddress6 returns the IPv6 address of the interface: the static
+// one if set, or the one of the peer in the IPv6 prefix of the network
+func interfaceAddress6(c *Config, networkKey, peerID string) (string, error) {
+	if c.InterfaceAddress6 != "" {
+		return c.InterfaceAddress6, nil
+	}
+	prefix, err := ipv6Prefix(c, networkKey)
+	if err != nil {
+		return "", err
+	}
+	return PeerAddress6(prefix, peerID)
+}
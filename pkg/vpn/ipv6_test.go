@@ -0,0 +1,140 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+var _ = Describe("IPv6", func() {
+	ula, _, _ := net.ParseCIDR("fd00::/8")
+	ulas := &net.IPNet{IP: ula, Mask: net.CIDRMask(8, 128)}
+
+	It("derives the same unique local prefix for the same network", func() {
+		p := ULAPrefix("key")
+		Expect(p.String()).To(Equal(ULAPrefix("key").String()))
+		Expect(p.String()).ToNot(Equal(ULAPrefix("other").String()))
+		Expect(ulas.Contains(p.IP)).To(BeTrue())
+		ones, _ := p.Mask.Size()
+		Expect(ones).To(Equal(64))
+	})
+
+	It("derives a stable address for each peer in the prefix", func() {
+		p := ULAPrefix("key")
+		a, err := PeerAddress6(p, "peer-a")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(PeerAddress6(p, "peer-a")).To(Equal(a))
+		Expect(PeerAddress6(p, "peer-b")).ToNot(Equal(a))
+
+		ip, n, err := net.ParseCIDR(a)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n.String()).To(Equal(p.String()))
+		Expect(ip.To4()).To(BeNil())
+	})
+
+	It("derives the address in a configured prefix", func() {
+		_, p, _ := net.ParseCIDR("2001:db8:1::/48")
+		a, err := PeerAddress6(p, "peer-a")
+		Expect(err).ToNot(HaveOccurred())
+		ip, _, _ := net.ParseCIDR(a)
+		Expect(p.Contains(ip)).To(BeTrue())
+
+		_, long, _ := net.ParseCIDR("2001:db8::/96")
+		_, err = PeerAddress6(long, "peer-a")
+		Expect(err).To(HaveOccurred())
+		_, v4, _ := net.ParseCIDR("10.1.0.0/24")
+		_, err = PeerAddress6(v4, "peer-a")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("validates the IPv6 options", func() {
+		c := &Config{}
+		Expect(c.Apply(WithInterfaceAddress6("10.1.0.1/24"))).ToNot(Succeed())
+		Expect(c.Apply(WithIPv6Prefix("2001:db8::/96"))).ToNot(Succeed())
+		Expect(c.IPv6).To(BeFalse())
+		Expect(c.Apply(WithIPv6Prefix("2001:db8::/64"))).To(Succeed())
+		Expect(c.IPv6).To(BeTrue())
+	})
+
+	It("looks up the peers by the IPv6 address of their machines", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		b.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+			"10.1.0.1": types.Machine{PeerID: "a", Address: "10.1.0.1", Address6: "fd00::a"},
+			"10.1.0.2": types.Machine{PeerID: "b", Address: "10.1.0.2"},
+		})
+		t := &MachineTable6{}
+		t.Sync(b)
+		p, found := t.Lookup(b, "fd00::a")
+		Expect(found).To(BeTrue())
+		Expect(p).To(Equal("a"))
+		_, found = t.Lookup(b, "fd00::b")
+		Expect(found).To(BeFalse())
+
+		// Machines announced since the last sync are found in the ledger
+		b.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+			"10.1.0.3": types.Machine{PeerID: "c", Address: "10.1.0.3", Address6: "fd00::c"},
+		})
+		p, found = t.Lookup(b, "fd00::c")
+		Expect(found).To(BeTrue())
+		Expect(p).To(Equal("c"))
+	})
+
+	It("takes the derived addresses only from the peers they derive from", func() {
+		_, prefix, _ := net.ParseCIDR("fd00::/64")
+		derived := func(p string) string {
+			a, err := PeerAddress6(prefix, p)
+			Expect(err).ToNot(HaveOccurred())
+			ip, _, _ := net.ParseCIDR(a)
+			return ip.String()
+		}
+
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		b.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+			"10.1.0.1": types.Machine{PeerID: "a", Address: "10.1.0.1", Address6: derived("a")},
+			// b claims the address of a
+			"10.1.0.2": types.Machine{PeerID: "b", Address: "10.1.0.2", Address6: derived("a")},
+			// Static addresses outside of the prefix are taken as they are
+			"10.1.0.3": types.Machine{PeerID: "c", Address: "10.1.0.3", Address6: "2001:db8::c"},
+			"10.1.0.4": types.Machine{PeerID: "d", Address: "10.1.0.4", Address6: "2001:db8::c"},
+		})
+		t := &MachineTable6{Prefix: prefix}
+		conflicts := t.Sync(b)
+		p, found := t.Lookup(b, derived("a"))
+		Expect(found).To(BeTrue())
+		Expect(p).To(Equal("a"))
+
+		// The conflicts are resolved as for IPv4, and reported once
+		Expect(conflicts).To(Equal(map[string][]string{"2001:db8::c": {"c", "d"}}))
+		p, found = t.Lookup(b, "2001:db8::c")
+		Expect(found).To(BeTrue())
+		Expect(p).To(Equal(ConflictWinner("c", "d")))
+		Expect(t.Sync(b)).To(BeEmpty())
+
+		// Nor the machines announced since the last sync can claim them
+		b.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+			"10.1.0.5": types.Machine{PeerID: "e", Address: "10.1.0.5", Address6: derived("f")},
+		})
+		_, found = t.Lookup(b, derived("f"))
+		Expect(found).To(BeFalse())
+	})
+})
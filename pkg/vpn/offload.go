@@ -0,0 +1,207 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/songgao/packets/ethernet"
+)
+
+// VirtioNetHdrSize is the size of the header prefixed to the packets
+// read from and written to the devices opened with IFF_VNET_HDR
+const VirtioNetHdrSize = 10
+
+// Flags and GSO types of the virtio-net header
+const (
+	VirtioNetHdrNeedsCsum = 1
+
+	VirtioNetHdrGSONone  = 0
+	VirtioNetHdrGSOTCPv4 = 1
+	VirtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+)
+
+// ErrMalformedOffload is returned for the packets whose offloads can't be completed
+var ErrMalformedOffload = errors.New("malformed offload packet")
+
+// VirtioNetHdr is the header of the packets of the devices with the
+// offloads enabled. It describes the work the kernel left to do on the
+// packet: completing its checksum, and splitting a TCP packet larger than
+// the MTU (segmentation offload) in segments of GSOSize bytes of payload.
+type VirtioNetHdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+// DecodeVirtioNetHdr decodes the header at the start of b, in the byte
+// order of the host as the kernel writes it
+func DecodeVirtioNetHdr(b []byte) (VirtioNetHdr, error) {
+	if len(b) < VirtioNetHdrSize {
+		return VirtioNetHdr{}, ErrMalformedOffload
+	}
+	return VirtioNetHdr{
+		Flags:      b[0],
+		GSOType:    b[1],
+		HdrLen:     binary.NativeEndian.Uint16(b[2:]),
+		GSOSize:    binary.NativeEndian.Uint16(b[4:]),
+		CsumStart:  binary.NativeEndian.Uint16(b[6:]),
+		CsumOffset: binary.NativeEndian.Uint16(b[8:]),
+	}, nil
+}
+
+// Encode writes the header at the start of b
+func (h VirtioNetHdr) Encode(b []byte) {
+	b[0], b[1] = h.Flags, h.GSOType
+	binary.NativeEndian.PutUint16(b[2:], h.HdrLen)
+	binary.NativeEndian.PutUint16(b[4:], h.GSOSize)
+	binary.NativeEndian.PutUint16(b[6:], h.CsumStart)
+	binary.NativeEndian.PutUint16(b[8:], h.CsumOffset)
+}
+
+// SegmentFrames completes the offloads described by the header on the
+// packet, and returns the frames to send: the segments of a TCP packet
+// with segmentation offload, or a copy of the packet, with its checksum
+// completed if needed.
+func SegmentFrames(h VirtioNetHdr, packet []byte) ([]ethernet.Frame, error) {
+	switch h.GSOType &^ virtioNetHdrGSOECN {
+	case VirtioNetHdrGSONone:
+		frame := ethernet.Frame(append([]byte{}, packet...))
+		if h.Flags&VirtioNetHdrNeedsCsum != 0 {
+			start, field := int(h.CsumStart), int(h.CsumStart)+int(h.CsumOffset)
+			if len(frame) < 20 || start >= len(frame) || field+2 > len(frame) {
+				return nil, ErrMalformedOffload
+			}
+			// The field holds the checksum of the pseudo header
+			csum := ^fold(checksum(frame[start:], 0))
+			if csum == 0 && frame[ipProtocolOffset(frame)] == udpProtocol {
+				csum = 0xffff
+			}
+			binary.BigEndian.PutUint16(frame[field:], csum)
+		}
+		return []ethernet.Frame{frame}, nil
+	case VirtioNetHdrGSOTCPv4, VirtioNetHdrGSOTCPv6:
+		return segmentTCP(h, packet)
+	default:
+		return nil, fmt.Errorf("%w: unsupported GSO type %d", ErrMalformedOffload, h.GSOType)
+	}
+}
+
+const (
+	tcpProtocol = 6
+	udpProtocol = 17
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagCWR = 0x80
+)
+
+// ipProtocolOffset returns the offset of the protocol of the packet
+// (the next header of IPv6)
+func ipProtocolOffset(packet []byte) int {
+	if packet[0]>>4 == 6 {
+		return 6
+	}
+	return 9
+}
+
+// segmentTCP splits the TCP packet in segments of h.GSOSize bytes of
+// payload, as the kernel would have before writing them to the device
+func segmentTCP(h VirtioNetHdr, packet []byte) ([]ethernet.Frame, error) {
+	ipLen := int(h.CsumStart)
+	if h.GSOSize == 0 || len(packet) < 40 || ipLen+20 > len(packet) {
+		return nil, ErrMalformedOffload
+	}
+	ipv6 := packet[0]>>4 == 6
+	switch {
+	case ipv6 && (ipLen != 40 || packet[6] != tcpProtocol):
+		return nil, ErrMalformedOffload
+	case !ipv6 && (ipLen != int(packet[0]&0x0f)*4 || packet[9] != tcpProtocol):
+		return nil, ErrMalformedOffload
+	}
+	hdrLen := ipLen + int(packet[ipLen+12]>>4)*4
+	if hdrLen > len(packet) {
+		return nil, ErrMalformedOffload
+	}
+
+	var addrs []byte
+	if ipv6 {
+		addrs = packet[8:40]
+	} else {
+		addrs = packet[12:20]
+	}
+	id := binary.BigEndian.Uint16(packet[4:])
+	seq := binary.BigEndian.Uint32(packet[ipLen+4:])
+	flags := packet[ipLen+13]
+
+	payload := packet[hdrLen:]
+	frames := make([]ethernet.Frame, 0, (len(payload)+int(h.GSOSize)-1)/int(h.GSOSize))
+	for i := 0; len(payload) > 0; i++ {
+		size := min(int(h.GSOSize), len(payload))
+		frame := make(ethernet.Frame, hdrLen+size)
+		copy(frame, packet[:hdrLen])
+		copy(frame[hdrLen:], payload[:size])
+		payload = payload[size:]
+
+		if ipv6 {
+			binary.BigEndian.PutUint16(frame[4:], uint16(len(frame)-ipLen))
+		} else {
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(frame)))
+			binary.BigEndian.PutUint16(frame[4:], id+uint16(i))
+			frame[10], frame[11] = 0, 0
+			binary.BigEndian.PutUint16(frame[10:], ^fold(checksum(frame[:ipLen], 0)))
+		}
+
+		tcp := frame[ipLen:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(i)*uint32(h.GSOSize))
+		tcp[13] = flags
+		if i > 0 {
+			tcp[13] &^= tcpFlagCWR
+		}
+		if len(payload) > 0 {
+			tcp[13] &^= tcpFlagFIN | tcpFlagPSH
+		}
+		tcp[16], tcp[17] = 0, 0
+		pseudo := checksum(addrs, uint32(tcpProtocol)+uint32(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], ^fold(checksum(tcp, pseudo)))
+
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// checksum adds the 16 bits words of b to sum, as the internet checksum
+func checksum(b []byte, sum uint32) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// fold folds the sum of the internet checksum on 16 bits
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
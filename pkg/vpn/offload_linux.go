@@ -0,0 +1,146 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/mudler/water"
+	"github.com/songgao/packets/ethernet"
+	"golang.org/x/sys/unix"
+)
+
+// Offloads of the TUN devices (linux/if_tun.h)
+const (
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+)
+
+// enableOffload opens the TUN device again with the virtio-net header, and
+// enables the checksum and TCP segmentation offloads: a read returns up to
+// 64KiB of a TCP flow, split in frames by SegmentFrames. The device must be
+// persistent, as it is detached to be attached again with the header.
+func enableOffload(ifce *water.Interface, c *Config) error {
+	if !ifce.IsTUN() {
+		return errors.New("the offloads need a TUN device")
+	}
+	if err := ifce.ReadWriteCloser.Close(); err != nil {
+		return err
+	}
+
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	ifr, err := unix.NewIfreq(ifce.Name())
+	if err != nil {
+		unix.Close(fd)
+		return err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	persist := 1
+	if c.NetLinkBootstrap {
+		persist = 0
+	}
+	if err := unix.IoctlSetInt(fd, unix.TUNSETPERSIST, persist); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	ifce.ReadWriteCloser = &offloadDevice{File: os.NewFile(uintptr(fd), "tun"), buf: make([]byte, VirtioNetHdrSize+65535)}
+	return nil
+}
+
+// offloadDevice is a TUN device with the virtio-net header, reading the
+// frames of a packet left to segment at once
+type offloadDevice struct {
+	*os.File
+
+	mu      sync.Mutex
+	buf     []byte
+	pending []ethernet.Frame
+}
+
+// ReadFrames reads a packet, and returns its frames
+func (d *offloadDevice) ReadFrames() ([]ethernet.Frame, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.pending) > 0 {
+		frames := d.pending
+		d.pending = nil
+		return frames, nil
+	}
+	return d.readFrames()
+}
+
+func (d *offloadDevice) readFrames() ([]ethernet.Frame, error) {
+	n, err := d.File.Read(d.buf)
+	if err != nil {
+		return nil, err
+	}
+	h, err := DecodeVirtioNetHdr(d.buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	return SegmentFrames(h, d.buf[VirtioNetHdrSize:n])
+}
+
+// Read reads a frame, keeping the others of the packet for the next reads
+func (d *offloadDevice) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.pending) == 0 {
+		frames, err := d.readFrames()
+		if err != nil {
+			return 0, err
+		}
+		d.pending = frames
+	}
+	n := copy(p, d.pending[0])
+	d.pending = d.pending[1:]
+	return n, nil
+}
+
+// Write writes the frame after an empty header, as it needs no offload
+func (d *offloadDevice) Write(p []byte) (int, error) {
+	rc, err := d.File.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var hdr [VirtioNetHdrSize]byte
+	var n int
+	var werr error
+	err = rc.Write(func(fd uintptr) bool {
+		n, werr = unix.Writev(int(fd), [][]byte{hdr[:], p})
+		return werr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if werr != nil {
+		return 0, werr
+	}
+	return max(n-VirtioNetHdrSize, 0), nil
+}
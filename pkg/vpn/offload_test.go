@@ -0,0 +1,114 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/songgao/packets/ethernet"
+
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+var _ = Describe("Offloads", func() {
+	payload := bytes.Repeat([]byte("0123456789"), 300)
+
+	serialize := func(l ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		Expect(gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...)).To(Succeed())
+		return buf.Bytes()
+	}
+
+	// tcpPacket returns a TCP packet with the payload, as the kernel would
+	// write it with the segment i of the packet, once segmented
+	tcpPacket := func(ipv6 bool, i, size int, payload []byte, last bool) []byte {
+		tcp := &layers.TCP{SrcPort: 4000, DstPort: 22, Seq: 1000 + uint32(i*size), Ack: 7, ACK: true, PSH: last, CWR: i == 0, Window: 512}
+		if ipv6 {
+			ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+			tcp.SetNetworkLayerForChecksum(ip)
+			return serialize(ip, tcp, gopacket.Payload(payload))
+		}
+		ip := &layers.IPv4{Version: 4, Id: 10 + uint16(i), Flags: layers.IPv4DontFragment, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.1.0.1"), DstIP: net.ParseIP("10.1.0.2")}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return serialize(ip, tcp, gopacket.Payload(payload))
+	}
+
+	for _, ipv6 := range []bool{false, true} {
+		ipv6 := ipv6
+		It("segments the TCP packets", func() {
+			h := VirtioNetHdr{Flags: VirtioNetHdrNeedsCsum, GSOType: VirtioNetHdrGSOTCPv4, GSOSize: 1400, CsumStart: 20, CsumOffset: 16}
+			if ipv6 {
+				h.GSOType, h.CsumStart = VirtioNetHdrGSOTCPv6, 40
+			}
+			packet := tcpPacket(ipv6, 0, 0, payload, true)
+
+			frames, err := SegmentFrames(h, packet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frames).To(Equal([]ethernet.Frame{
+				tcpPacket(ipv6, 0, 1400, payload[:1400], false),
+				tcpPacket(ipv6, 1, 1400, payload[1400:2800], false),
+				tcpPacket(ipv6, 2, 1400, payload[2800:], true),
+			}))
+		})
+	}
+
+	It("completes the checksum of the packets", func() {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.1.0.1"), DstIP: net.ParseIP("10.1.0.2")}
+		udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+		udp.SetNetworkLayerForChecksum(ip)
+		expected := serialize(ip, udp, gopacket.Payload(payload[:100]))
+
+		// The kernel leaves the checksum of the pseudo header
+		packet := append([]byte{}, expected...)
+		sum := uint32(17 + 108)
+		for _, b := range [][]byte{packet[12:14], packet[14:16], packet[16:18], packet[18:20]} {
+			sum += uint32(binary.BigEndian.Uint16(b))
+		}
+		sum = sum>>16 + sum&0xffff
+		binary.BigEndian.PutUint16(packet[26:], uint16(sum))
+
+		frames, err := SegmentFrames(VirtioNetHdr{Flags: VirtioNetHdrNeedsCsum, CsumStart: 20, CsumOffset: 6}, packet)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(frames).To(Equal([]ethernet.Frame{expected}))
+
+		frames, err = SegmentFrames(VirtioNetHdr{}, expected)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(frames).To(Equal([]ethernet.Frame{expected}))
+	})
+
+	It("refuses the packets it can't segment", func() {
+		packet := tcpPacket(false, 0, 0, payload, true)
+		_, err := SegmentFrames(VirtioNetHdr{GSOType: VirtioNetHdrGSOTCPv4, CsumStart: 20}, packet)
+		Expect(err).To(MatchError(ErrMalformedOffload))
+		_, err = SegmentFrames(VirtioNetHdr{GSOType: 5, GSOSize: 1400, CsumStart: 20}, packet)
+		Expect(err).To(MatchError(ErrMalformedOffload))
+		_, err = SegmentFrames(VirtioNetHdr{GSOType: VirtioNetHdrGSOTCPv6, GSOSize: 1400, CsumStart: 40}, packet)
+		Expect(err).To(MatchError(ErrMalformedOffload))
+	})
+
+	It("encodes the header", func() {
+		h := VirtioNetHdr{Flags: VirtioNetHdrNeedsCsum, GSOType: VirtioNetHdrGSOTCPv4, HdrLen: 52, GSOSize: 1400, CsumStart: 20, CsumOffset: 16}
+		b := make([]byte, VirtioNetHdrSize)
+		h.Encode(b)
+		Expect(DecodeVirtioNetHdr(b)).To(Equal(h))
+		_, err := DecodeVirtioNetHdr(b[:4])
+		Expect(err).To(MatchError(ErrMalformedOffload))
+	})
+})
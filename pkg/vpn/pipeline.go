@@ -0,0 +1,113 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/types"
+	"github.com/songgao/packets/ethernet"
+)
+
+// readPipeline is the pipeline of the interface started last, and
+// the pipelines of the interfaces handled by this process by name
+var readPipeline = struct {
+	sync.Mutex
+	p          *Pipeline
+	interfaces map[string]*Pipeline
+}{interfaces: map[string]*Pipeline{}}
+
+// PipelineStats returns the counters of the VPN read pipeline
+func PipelineStats() types.PipelineStat {
+	readPipeline.Lock()
+	defer readPipeline.Unlock()
+	if readPipeline.p == nil {
+		return types.PipelineStat{}
+	}
+	return readPipeline.p.Stats()
+}
+
+// InterfacePipelineStats returns the counters of the read pipeline of the interface
+func InterfacePipelineStats(name string) types.PipelineStat {
+	readPipeline.Lock()
+	defer readPipeline.Unlock()
+	p, ok := readPipeline.interfaces[name]
+	if !ok {
+		return types.PipelineStat{}
+	}
+	return p.Stats()
+}
+
+// Pipeline is the bounded queue between the interface read loop and the
+// workers writing the frames to the peer streams. When it is full, the
+// read loop waits for the workers to catch up instead of reading more
+// frames, and a frame is dropped only after waiting for longer than MaxWait.
+type Pipeline struct {
+	frames  chan ethernet.Frame
+	maxWait time.Duration
+
+	read, backpressured, dropped uint64
+}
+
+// NewPipeline returns a pipeline queueing up to size frames
+func NewPipeline(size int, maxWait time.Duration) *Pipeline {
+	return &Pipeline{frames: make(chan ethernet.Frame, size), maxWait: maxWait}
+}
+
+// Frames returns the queued frames
+func (p *Pipeline) Frames() <-chan ethernet.Frame {
+	return p.frames
+}
+
+// Push queues the frame, blocking while the queue is full. It returns
+// false if the frame was dropped.
+func (p *Pipeline) Push(ctx context.Context, f ethernet.Frame) bool {
+	atomic.AddUint64(&p.read, 1)
+	select {
+	case p.frames <- f:
+		return true
+	default:
+	}
+
+	atomic.AddUint64(&p.backpressured, 1)
+	t := time.NewTimer(p.maxWait)
+	defer t.Stop()
+	select {
+	case p.frames <- f:
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	atomic.AddUint64(&p.dropped, 1)
+	return false
+}
+
+// Close stops queueing frames. Push must not be called afterwards.
+func (p *Pipeline) Close() {
+	close(p.frames)
+}
+
+// Stats returns the counters of the pipeline
+func (p *Pipeline) Stats() types.PipelineStat {
+	return types.PipelineStat{
+		Frames:        atomic.LoadUint64(&p.read),
+		Backpressured: atomic.LoadUint64(&p.backpressured),
+		Dropped:       atomic.LoadUint64(&p.dropped),
+		Queued:        len(p.frames),
+		Capacity:      cap(p.frames),
+	}
+}
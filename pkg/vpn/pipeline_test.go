@@ -0,0 +1,98 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/songgao/packets/ethernet"
+
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+var _ = Describe("Read pipeline", func() {
+	// peer forwards the queued frames to a connection whose
+	// other end reads at most one frame per delay
+	peer := func(p *Pipeline, delay time.Duration) {
+		local, remote := net.Pipe()
+		go func() {
+			defer local.Close()
+			for f := range p.Frames() {
+				local.Write(f)
+			}
+		}()
+		go func() {
+			defer remote.Close()
+			buf := make([]byte, 16)
+			for {
+				time.Sleep(delay)
+				if _, err := remote.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	It("holds back the reads while the peer is congested", func() {
+		p := NewPipeline(2, 5*time.Second)
+		defer p.Close()
+		peer(p, 20*time.Millisecond)
+
+		start := time.Now()
+		for i := 0; i < 20; i++ {
+			Expect(p.Push(context.Background(), ethernet.Frame{byte(i)})).To(BeTrue())
+		}
+		Expect(time.Since(start)).To(BeNumerically(">", 200*time.Millisecond))
+
+		s := p.Stats()
+		Expect(s.Frames).To(Equal(uint64(20)))
+		Expect(s.Backpressured).To(BeNumerically(">", 0))
+		Expect(s.Dropped).To(BeZero())
+		Expect(s.Capacity).To(Equal(2))
+	})
+
+	It("drops frames the peer can't take in time", func() {
+		p := NewPipeline(2, 50*time.Millisecond)
+		defer p.Close()
+		peer(p, time.Hour)
+
+		dropped := 0
+		for i := 0; i < 5; i++ {
+			if !p.Push(context.Background(), ethernet.Frame{byte(i)}) {
+				dropped++
+			}
+		}
+		Expect(dropped).To(BeNumerically(">", 0))
+
+		s := p.Stats()
+		Expect(s.Frames).To(Equal(uint64(5)))
+		Expect(s.Dropped).To(Equal(uint64(dropped)))
+		Expect(s.Backpressured).To(BeNumerically(">=", s.Dropped))
+		Expect(s.Queued).To(Equal(2))
+	})
+
+	It("does not wait once the context is done", func() {
+		p := NewPipeline(0, time.Hour)
+		defer p.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		Expect(p.Push(ctx, ethernet.Frame{0})).To(BeFalse())
+		Expect(p.Stats().Dropped).To(Equal(uint64(1)))
+	})
+})
@@ -0,0 +1,98 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+type reopenState struct {
+	failures int
+	next     time.Time
+}
+
+// ReopenBackoff keeps track of the failed attempts to (re)open a stream
+// towards a peer, and tells when it is allowed to try again.
+// The wait time doubles on each failure, starting from the initial interval
+// and up to the max interval.
+type ReopenBackoff struct {
+	sync.Mutex
+	initial, max time.Duration
+	maxAttempts  int
+	peers        map[peer.ID]*reopenState
+}
+
+// NewReopenBackoff returns a new ReopenBackoff. maxAttempts is the number of consecutive
+// failures after which the peer route is dropped, 0 means unlimited.
+func NewReopenBackoff(initial, max time.Duration, maxAttempts int) *ReopenBackoff {
+	if max < initial {
+		max = initial
+	}
+	return &ReopenBackoff{
+		initial:     initial,
+		max:         max,
+		maxAttempts: maxAttempts,
+		peers:       make(map[peer.ID]*reopenState),
+	}
+}
+
+// Allow returns true if a stream to the peer can be opened now
+func (r *ReopenBackoff) Allow(p peer.ID) bool {
+	r.Lock()
+	defer r.Unlock()
+	s, exists := r.peers[p]
+	if !exists {
+		return true
+	}
+	return !time.Now().Before(s.next)
+}
+
+// Success resets the failure history of the peer
+func (r *ReopenBackoff) Success(p peer.ID) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.peers, p)
+}
+
+// Failure records a failed attempt to open a stream to the peer.
+// It returns true if the max attempts are exceeded and the peer should be given up.
+// When giving up, the history of the peer is reset.
+func (r *ReopenBackoff) Failure(p peer.ID) bool {
+	r.Lock()
+	defer r.Unlock()
+	s, exists := r.peers[p]
+	if !exists {
+		s = &reopenState{}
+		r.peers[p] = s
+	}
+	s.failures++
+
+	if r.maxAttempts > 0 && s.failures >= r.maxAttempts {
+		delete(r.peers, p)
+		return true
+	}
+
+	wait := r.initial
+	for i := 1; i < s.failures && wait < r.max; i++ {
+		wait *= 2
+	}
+	if wait > r.max {
+		wait = r.max
+	}
+	s.next = time.Now().Add(wait)
+	return false
+}
@@ -0,0 +1,50 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+var _ = Describe("Stream reopen backoff", func() {
+	p := peer.ID("foo")
+
+	It("allows reopening after the backoff and resets on success", func() {
+		rb := NewReopenBackoff(50*time.Millisecond, 100*time.Millisecond, 0)
+		Expect(rb.Allow(p)).To(BeTrue())
+
+		Expect(rb.Failure(p)).To(BeFalse())
+		Expect(rb.Allow(p)).To(BeFalse())
+		Eventually(func() bool { return rb.Allow(p) }, 1*time.Second, 10*time.Millisecond).Should(BeTrue())
+
+		rb.Success(p)
+		Expect(rb.Allow(p)).To(BeTrue())
+	})
+
+	It("gives up after max attempts", func() {
+		rb := NewReopenBackoff(time.Millisecond, time.Millisecond, 3)
+		Expect(rb.Failure(p)).To(BeFalse())
+		Expect(rb.Failure(p)).To(BeFalse())
+		Expect(rb.Failure(p)).To(BeTrue())
+		// History is reset after giving up
+		Expect(rb.Allow(p)).To(BeTrue())
+		Expect(rb.Failure(p)).To(BeFalse())
+	})
+})
@@ -0,0 +1,233 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/node"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Route is a network advertised by a node, reached through its VPN address
+type Route struct {
+	Network *net.IPNet
+	Via     string
+	PeerID  string
+}
+
+// ParseRoutes parses a list of networks in CIDR notation
+func ParseRoutes(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route '%s': %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// within returns true if the network n is inside the network a
+func within(n, a *net.IPNet) bool {
+	nOnes, nBits := n.Mask.Size()
+	aOnes, aBits := a.Mask.Size()
+	return nBits == aBits && aOnes <= nOnes && a.Contains(n.IP)
+}
+
+// AcceptedRoutes returns the routes advertised in the ledger by the alive
+// peers other than self, which are inside one of the accepted networks.
+// The accepted default networks (0.0.0.0/0, ::/0) take the routes of the
+// exit nodes only, so that a member can't become the exit node of the others
+// by advertising them. The routes are sorted from the most specific, then by peer.
+func AcceptedRoutes(b *blockchain.Ledger, accept []*net.IPNet, exitNodes []string, self string, alive func(peer string) bool) []Route {
+	exit := map[string]bool{}
+	for _, p := range exitNodes {
+		exit[p] = true
+	}
+	routes := []Route{}
+	for _, d := range b.CurrentData()[protocol.RoutesLedgerKey] {
+		r := &types.Routes{}
+		d.Unmarshal(r)
+		if r.PeerID == self || r.Address == "" || !alive(r.PeerID) {
+			continue
+		}
+		advertised, err := ParseRoutes(r.CIDRs)
+		if err != nil {
+			continue
+		}
+		for _, n := range advertised {
+			for _, a := range accept {
+				if within(n, a) && (!isDefault(a) || exit[r.PeerID]) {
+					routes = append(routes, Route{Network: n, Via: r.Address, PeerID: r.PeerID})
+					break
+				}
+			}
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		oi, _ := routes[i].Network.Mask.Size()
+		oj, _ := routes[j].Network.Mask.Size()
+		if oi != oj {
+			return oi > oj
+		}
+		return routes[i].PeerID < routes[j].PeerID
+	})
+	return routes
+}
+
+// RouteTable holds the accepted routes, looked up for every frame
+type RouteTable struct {
+	sync.RWMutex
+	routes []Route
+}
+
+// Set replaces the routes, sorted from the most specific
+func (t *RouteTable) Set(routes []Route) {
+	t.Lock()
+	defer t.Unlock()
+	t.routes = routes
+}
+
+// Routes returns the routes of the table
+func (t *RouteTable) Routes() []Route {
+	t.RLock()
+	defer t.RUnlock()
+	return append([]Route{}, t.routes...)
+}
+
+// Lookup returns the VPN address of the node forwarding the traffic
+// to ip, following the most specific route
+func (t *RouteTable) Lookup(ip net.IP) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	t.RLock()
+	defer t.RUnlock()
+	for _, r := range t.routes {
+		if r.Network.Contains(ip) {
+			return r.Via, true
+		}
+	}
+	return "", false
+}
+
+// Networks returns the distinct networks of the table
+func (t *RouteTable) Networks() []*net.IPNet {
+	t.RLock()
+	defer t.RUnlock()
+	seen := map[string]bool{}
+	nets := []*net.IPNet{}
+	for _, r := range t.routes {
+		if !seen[r.Network.String()] {
+			seen[r.Network.String()] = true
+			nets = append(nets, r.Network)
+		}
+	}
+	return nets
+}
+
+// isDefault returns true for the default routes, 0.0.0.0/0 and ::/0
+func isDefault(n *net.IPNet) bool {
+	ones, _ := n.Mask.Size()
+	return ones == 0
+}
+
+// splitDefault returns the two halves of a default route, which take
+// precedence over the default route of the host without replacing it
+func splitDefault(n *net.IPNet) []*net.IPNet {
+	bits := len(n.IP) * 8
+	low := &net.IPNet{IP: make(net.IP, len(n.IP)), Mask: net.CIDRMask(1, bits)}
+	high := &net.IPNet{IP: make(net.IP, len(n.IP)), Mask: net.CIDRMask(1, bits)}
+	high.IP[0] = 0x80
+	return []*net.IPNet{low, high}
+}
+
+// announceRoutes writes the advertised routes of the node to the ledger, if they changed
+func announceRoutes(b *blockchain.Ledger, self, address string, nets []*net.IPNet) {
+	routes := types.Routes{PeerID: self, Address: address}
+	for _, n := range nets {
+		routes.CIDRs = append(routes.CIDRs, n.String())
+	}
+
+	existing := types.Routes{}
+	v, found := b.GetKey(protocol.RoutesLedgerKey, self)
+	v.Unmarshal(&existing)
+	if found && reflect.DeepEqual(existing, routes) {
+		return
+	}
+	b.Add(protocol.RoutesLedgerKey, map[string]interface{}{self: routes})
+}
+
+// peerIPs returns the addresses the peers are directly connected from
+func peerIPs(n *node.Node) []net.IP {
+	seen := map[string]bool{}
+	ips := []net.IP{}
+	for _, c := range n.Host().Network().Conns() {
+		a := c.RemoteMultiaddr()
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			continue
+		}
+		ip, err := manet.ToIP(a)
+		if err != nil || ip.IsLoopback() || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// syncRoutes keeps the route table, and the routes of the interface when
+// managed by EdgeVPN, in sync with the routes advertised by the alive peers
+func syncRoutes(ctx context.Context, c *Config, n *node.Node, b *blockchain.Ledger, self string, alive func(peer string) bool) {
+	var installer *routeInstaller
+	if c.NetLinkBootstrap {
+		installer = newRouteInstaller(c)
+		defer installer.Close()
+	} else {
+		c.Logger.Warnf("The interface is not managed by EdgeVPN, route the accepted networks to it manually")
+	}
+
+	t := time.NewTicker(c.LedgerAnnounceTime)
+	defer t.Stop()
+	failing := false
+	for {
+		c.routes.Set(AcceptedRoutes(b, c.AcceptedRoutes, c.ExitNodes, self, alive))
+		if installer != nil {
+			err := installer.Sync(c.routes.Networks(), peerIPs(n))
+			if err != nil && !failing {
+				c.Logger.Warnf("Could not install the accepted routes: %s", err.Error())
+			}
+			failing = err != nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+var _ = Describe("Routes", func() {
+	routes := func(s ...string) []*net.IPNet {
+		nets, err := ParseRoutes(s)
+		Expect(err).ToNot(HaveOccurred())
+		return nets
+	}
+
+	b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+	b.Add(protocol.RoutesLedgerKey, map[string]interface{}{
+		"exit":   types.Routes{PeerID: "exit", Address: "10.1.0.2", CIDRs: []string{"0.0.0.0/0"}},
+		"office": types.Routes{PeerID: "office", Address: "10.1.0.3", CIDRs: []string{"192.168.1.0/24", "172.16.0.0/12"}},
+		"gone":   types.Routes{PeerID: "gone", Address: "10.1.0.4", CIDRs: []string{"192.168.1.0/25"}},
+		"me":     types.Routes{PeerID: "me", Address: "10.1.0.1", CIDRs: []string{"192.168.1.0/26"}},
+	})
+	alive := func(p string) bool { return p != "gone" }
+
+	It("parses the routes", func() {
+		Expect(routes("0.0.0.0/0", "192.168.1.10/24")[1].String()).To(Equal("192.168.1.0/24"))
+		_, err := ParseRoutes([]string{"192.168.1.1"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("accepts the routes inside the accepted networks", func() {
+		accepted := AcceptedRoutes(b, routes("192.168.0.0/16"), nil, "me", alive)
+		Expect(accepted).To(HaveLen(1))
+		Expect(accepted[0].Network.String()).To(Equal("192.168.1.0/24"))
+		Expect(accepted[0].Via).To(Equal("10.1.0.3"))
+
+		Expect(AcceptedRoutes(b, routes("10.0.0.0/8"), nil, "me", alive)).To(BeEmpty())
+		// IPv6 networks don't accept IPv4 routes
+		Expect(AcceptedRoutes(b, routes("::/0"), []string{"exit"}, "me", alive)).To(BeEmpty())
+	})
+
+	It("routes through the most specific route", func() {
+		t := &RouteTable{}
+		t.Set(AcceptedRoutes(b, routes("0.0.0.0/0"), []string{"exit", "office"}, "me", alive))
+		Expect(t.Routes()).To(HaveLen(3))
+		Expect(t.Networks()).To(HaveLen(3))
+
+		for ip, via := range map[string]string{
+			"192.168.1.20": "10.1.0.3",
+			"172.20.0.1":   "10.1.0.3",
+			"1.1.1.1":      "10.1.0.2",
+		} {
+			got, ok := t.Lookup(net.ParseIP(ip))
+			Expect(ok).To(BeTrue())
+			Expect(got).To(Equal(via), ip)
+		}
+
+		// Without routes, nothing is routed
+		_, ok := (&RouteTable{}).Lookup(net.ParseIP("1.1.1.1"))
+		Expect(ok).To(BeFalse())
+		var none *RouteTable
+		_, ok = none.Lookup(net.ParseIP("1.1.1.1"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("accepts the routes of the default networks from the exit nodes only", func() {
+		Expect(AcceptedRoutes(b, routes("0.0.0.0/0"), nil, "me", alive)).To(BeEmpty())
+
+		accepted := AcceptedRoutes(b, routes("0.0.0.0/0"), []string{"exit"}, "me", alive)
+		Expect(accepted).To(HaveLen(1))
+		Expect(accepted[0].PeerID).To(Equal("exit"))
+
+		// The routes inside the other accepted networks are taken from any peer
+		accepted = AcceptedRoutes(b, routes("0.0.0.0/0", "192.168.0.0/16"), []string{"exit"}, "me", alive)
+		Expect(accepted).To(HaveLen(2))
+		Expect(accepted[0].PeerID).To(Equal("office"))
+		Expect(accepted[1].PeerID).To(Equal("exit"))
+	})
+})
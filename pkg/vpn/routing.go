@@ -0,0 +1,174 @@
+//go:build !windows && !darwin && !freebsd
+// +build !windows,!darwin,!freebsd
+
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// routeInstaller installs the accepted routes on the interface. The default
+// routes are installed as their two halves, and the peers are kept reachable
+// through the previous default route of the host.
+type routeInstaller struct {
+	c         *Config
+	installed map[string]*netlink.Route
+	defaults  map[int]*netlink.Route
+}
+
+func newRouteInstaller(c *Config) *routeInstaller {
+	return &routeInstaller{c: c, installed: make(map[string]*netlink.Route), defaults: make(map[int]*netlink.Route)}
+}
+
+// hostDefault returns the default route of the host for the family, before the VPN ones
+func (r *routeInstaller) hostDefault(family, link int) *netlink.Route {
+	if d, ok := r.defaults[family]; ok {
+		return d
+	}
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return nil
+	}
+	for i, rt := range routes {
+		if (rt.Dst == nil || isDefault(rt.Dst)) && rt.LinkIndex != link {
+			r.defaults[family] = &routes[i]
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// Sync installs the routes to the networks, and the routes to the peers
+// bypassing the VPN while a default route goes through it. The routes
+// which are not needed anymore are removed.
+func (r *routeInstaller) Sync(nets []*net.IPNet, peers []net.IP) error {
+	link, err := netlink.LinkByName(r.c.InterfaceName)
+	if err != nil {
+		return err
+	}
+	idx := link.Attrs().Index
+
+	wanted := map[string]*netlink.Route{}
+	for _, n := range nets {
+		if !isDefault(n) {
+			wanted[n.String()] = &netlink.Route{LinkIndex: idx, Dst: n}
+			continue
+		}
+		family := netlink.FAMILY_V4
+		if n.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		def := r.hostDefault(family, idx)
+		for _, p := range peers {
+			if (p.To4() == nil) != (family == netlink.FAMILY_V6) || def == nil {
+				continue
+			}
+			dst := &net.IPNet{IP: p, Mask: net.CIDRMask(len(p)*8, len(p)*8)}
+			wanted[dst.String()] = &netlink.Route{LinkIndex: def.LinkIndex, Gw: def.Gw, Dst: dst}
+		}
+		for _, h := range splitDefault(n) {
+			wanted[h.String()] = &netlink.Route{LinkIndex: idx, Dst: h}
+		}
+	}
+
+	var errs []string
+	for k, rt := range r.installed {
+		if _, ok := wanted[k]; !ok {
+			if err := netlink.RouteDel(rt); err != nil {
+				errs = append(errs, err.Error())
+			}
+			delete(r.installed, k)
+		}
+	}
+	for k, rt := range wanted {
+		if _, ok := r.installed[k]; ok {
+			continue
+		}
+		if err := netlink.RouteReplace(rt); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", k, err.Error()))
+			continue
+		}
+		r.installed[k] = rt
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not sync the routes: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Close removes the installed routes
+func (r *routeInstaller) Close() {
+	for k, rt := range r.installed {
+		netlink.RouteDel(rt)
+		delete(r.installed, k)
+	}
+}
+
+// enableForwarding makes the node forward the traffic of the VPN network
+// to the advertised routes, masquerading it behind the host addresses.
+// It returns a function removing the firewall rules, and restoring the
+// forwarding setting of the host.
+func enableForwarding(c *Config, vpnNet *net.IPNet) (func(), error) {
+	sysctl, iptables := "/proc/sys/net/ipv4/ip_forward", "iptables"
+	if vpnNet.IP.To4() == nil {
+		sysctl, iptables = "/proc/sys/net/ipv6/conf/all/forwarding", "ip6tables"
+	}
+	previous, err := os.ReadFile(sysctl)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the forwarding setting: %w", err)
+	}
+	restore := func() {
+		if strings.TrimSpace(string(previous)) != "1" {
+			os.WriteFile(sysctl, previous, 0644)
+		}
+	}
+	if err := os.WriteFile(sysctl, []byte("1"), 0644); err != nil {
+		return nil, fmt.Errorf("could not enable the forwarding: %w", err)
+	}
+
+	rules := [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", vpnNet.String(), "!", "-o", c.InterfaceName, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", c.InterfaceName, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", c.InterfaceName, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+	rule := func(op string, r []string) []string {
+		return append([]string{r[0], r[1], op}, r[2:]...)
+	}
+	added := [][]string{}
+	remove := func() {
+		for _, r := range added {
+			exec.Command(iptables, rule("-D", r)...).Run()
+		}
+		restore()
+	}
+	for _, r := range rules {
+		if exec.Command(iptables, rule("-C", r)...).Run() == nil {
+			continue
+		}
+		if out, err := exec.Command(iptables, rule("-A", r)...).CombinedOutput(); err != nil {
+			remove()
+			return nil, fmt.Errorf("could not add the %s rule '%s': %s", iptables, strings.Join(r, " "), strings.TrimSpace(string(out)))
+		}
+		added = append(added, r)
+	}
+	return remove, nil
+}
@@ -0,0 +1,43 @@
+//go:build windows || darwin || freebsd
+// +build windows darwin freebsd
+
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"errors"
+	"net"
+)
+
+var errRoutingNotSupported = errors.New("routes are not supported on this platform, set them manually")
+
+type routeInstaller struct{}
+
+func newRouteInstaller(c *Config) *routeInstaller {
+	return &routeInstaller{}
+}
+
+func (r *routeInstaller) Sync(nets []*net.IPNet, peers []net.IP) error {
+	if len(nets) == 0 {
+		return nil
+	}
+	return errRoutingNotSupported
+}
+
+func (r *routeInstaller) Close() {}
+
+func enableForwarding(c *Config, vpnNet *net.IPNet) (func(), error) {
+	return nil, errRoutingNotSupported
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+)
+
+// CheckAddress looks for misconfigurations of the VPN address and router which
+// would cause routing loops or leaks. local are the networks of the other
+// interfaces of the host. It returns the reason, or an empty string if none is found.
+func CheckAddress(address, router string, local []*net.IPNet) string {
+	ip, cidr, err := net.ParseCIDR(address)
+	if err != nil {
+		return fmt.Sprintf("invalid interface address '%s'", address)
+	}
+
+	if router != "" {
+		r := net.ParseIP(router)
+		switch {
+		case r == nil:
+			return fmt.Sprintf("invalid router address '%s'", router)
+		case r.Equal(ip):
+			return fmt.Sprintf("router address '%s' is the node address, traffic would loop", router)
+		case !cidr.Contains(r):
+			return fmt.Sprintf("router address '%s' is outside of the VPN network '%s'", router, cidr)
+		}
+	}
+
+	for _, n := range local {
+		if n.Contains(cidr.IP) || cidr.Contains(n.IP) {
+			return fmt.Sprintf("VPN network '%s' conflicts with the local network '%s'", cidr, n)
+		}
+	}
+	return ""
+}
+
+// CheckAddressClaim returns the reason if the VPN address of the node is claimed in
+// the ledger by another peer which is alive, or an empty string otherwise
+func CheckAddressClaim(b *blockchain.Ledger, ip, self string, alive func(peer string) bool) string {
+	if p := ClaimingPeer(b, ip, self, alive); p != "" {
+		return fmt.Sprintf("address '%s' is already in use by '%s'", ip, p)
+	}
+	return ""
+}
+
+// localNetworks returns the networks of the host interfaces, except the given one
+func localNetworks(exclude string) (nets []*net.IPNet) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, i := range ifaces {
+		if i.Name == exclude || i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				nets = append(nets, n)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn_test
+
+import (
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/protocol"
+	"github.com/mudler/edgevpn/pkg/types"
+	. "github.com/mudler/edgevpn/pkg/vpn"
+)
+
+var _ = Describe("Safe mode detection", func() {
+	cidr := func(s string) *net.IPNet {
+		ip, n, err := net.ParseCIDR(s)
+		Expect(err).ToNot(HaveOccurred())
+		n.IP = ip
+		return n
+	}
+
+	Context("address", func() {
+		It("accepts a sane configuration", func() {
+			Expect(CheckAddress("10.1.0.1/24", "", []*net.IPNet{cidr("192.168.1.10/24")})).To(BeEmpty())
+			Expect(CheckAddress("10.1.0.1/24", "10.1.0.254", nil)).To(BeEmpty())
+		})
+
+		It("detects invalid addresses", func() {
+			Expect(CheckAddress("10.1.0.1", "", nil)).To(ContainSubstring("invalid interface address"))
+			Expect(CheckAddress("10.1.0.1/24", "foo", nil)).To(ContainSubstring("invalid router address"))
+		})
+
+		It("detects routing loops via the router", func() {
+			Expect(CheckAddress("10.1.0.1/24", "10.1.0.1", nil)).To(ContainSubstring("loop"))
+			Expect(CheckAddress("10.1.0.1/24", "10.2.0.1", nil)).To(ContainSubstring("outside of the VPN network"))
+		})
+
+		It("detects conflicts with the local networks", func() {
+			Expect(CheckAddress("10.1.0.1/24", "", []*net.IPNet{cidr("10.1.0.20/16")})).To(ContainSubstring("conflicts"))
+			Expect(CheckAddress("10.0.0.1/8", "", []*net.IPNet{cidr("10.1.0.20/24")})).To(ContainSubstring("conflicts"))
+		})
+	})
+
+	Context("address claim", func() {
+		b := blockchain.New(io.Discard, &blockchain.MemoryStore{})
+		b.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+			"10.1.0.1": types.Machine{PeerID: "other", Address: "10.1.0.1"},
+		})
+		alive := func(string) bool { return true }
+
+		It("detects addresses in use by other peers", func() {
+			Expect(CheckAddressClaim(b, "10.1.0.1", "me", alive)).To(ContainSubstring("already in use by 'other'"))
+		})
+
+		It("ignores claims of peers which are gone", func() {
+			Expect(CheckAddressClaim(b, "10.1.0.1", "me", func(string) bool { return false })).To(BeEmpty())
+		})
+
+		It("ignores own and unclaimed addresses", func() {
+			Expect(CheckAddressClaim(b, "10.1.0.1", "other", alive)).To(BeEmpty())
+			Expect(CheckAddressClaim(b, "10.1.0.2", "me", alive)).To(BeEmpty())
+		})
+	})
+})
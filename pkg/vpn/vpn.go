@@ -20,6 +20,7 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -31,7 +32,9 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/mudler/edgevpn/internal"
 	"github.com/mudler/edgevpn/pkg/blockchain"
+	"github.com/mudler/edgevpn/pkg/flow"
 	"github.com/mudler/edgevpn/pkg/logger"
+	"github.com/mudler/edgevpn/pkg/metrics"
 	"github.com/mudler/edgevpn/pkg/node"
 	"github.com/mudler/edgevpn/pkg/protocol"
 	"github.com/mudler/edgevpn/pkg/stream"
@@ -52,21 +55,52 @@ type streamManager interface {
 func VPNNetworkService(p ...Option) node.NetworkService {
 	return func(ctx context.Context, nc node.Config, n *node.Node, b *blockchain.Ledger) error {
 		c := &Config{
-			Concurrency:        1,
-			LedgerAnnounceTime: 5 * time.Second,
-			Timeout:            15 * time.Second,
-			Logger:             logger.New(log.LevelDebug),
-			MaxStreams:         30,
+			Concurrency:         1,
+			LedgerAnnounceTime:  5 * time.Second,
+			Timeout:             15 * time.Second,
+			BackpressureTimeout: time.Second,
+			WriteRetries:        3,
+			WriteRetryInterval:  10 * time.Millisecond,
+			WriteMaxFailures:    100,
+			Logger:              logger.New(log.LevelDebug),
+			MaxStreams:          30,
+			BatchSize:           DefaultBatchSize,
 		}
 		if err := c.Apply(p...); err != nil {
 			return err
 		}
 
-		ifce, err := createInterface(c)
-		if err != nil {
-			return err
+		var err error
+		ifce := c.Interface
+		if ifce == nil {
+			if ifce, err = createInterface(c); err != nil {
+				return err
+			}
+			if c.Offload {
+				if err := enableOffload(ifce, c); err != nil {
+					ifce.Close()
+					return errors.Wrap(err, "could not enable the offloads of the interface")
+				}
+			}
 		}
-		defer ifce.Close()
+
+		up := false
+		interfaceUp := func(address string) {
+			n.SetInterfaceStatus(types.InterfaceStatus{Up: true, Name: ifce.Name(), Address: address, Address6: c.InterfaceAddress6})
+			for _, h := range c.InterfaceUpHandlers {
+				h(ifce.Name(), address)
+			}
+		}
+		defer func() {
+			ifce.Close()
+			if !up {
+				return
+			}
+			n.SetInterfaceStatus(types.InterfaceStatus{Name: ifce.Name()})
+			for _, h := range c.InterfaceDownHandlers {
+				h(ifce.Name())
+			}
+		}()
 
 		var mgr streamManager
 
@@ -83,41 +117,232 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 			}()
 		}
 
-		// Set stream handler during runtime
-		n.Host().SetStreamHandler(protocol.EdgeVPN.ID(), streamHandler(b, ifce, c, nc))
+		var rb *ReopenBackoff
+		if c.StreamReopenInterval > 0 || c.StreamReopenMaxAttempts > 0 {
+			rb = NewReopenBackoff(c.StreamReopenInterval, c.StreamReopenMaxInterval, c.StreamReopenMaxAttempts)
+		}
+
+		dw := NewDeviceWriter(ifce.ReadWriteCloser, c.WriteRetries, c.WriteRetryInterval, c.WriteMaxFailures)
+		dw.OnDown = func(err error) {
+			c.Logger.Errorf("Writes to the interface keep failing, marking it down: %s", err.Error())
+			n.SetInterfaceStatus(types.InterfaceStatus{Name: ifce.Name()})
+			n.Emit(types.EventInterfaceDown, map[string]string{"interface": ifce.Name(), "error": err.Error()})
+			for _, h := range c.InterfaceDownHandlers {
+				h(ifce.Name())
+			}
+		}
+		deviceWriter.Lock()
+		deviceWriter.w = dw
+		deviceWriter.interfaces[ifce.Name()] = dw
+		deviceWriter.Unlock()
+
+		if c.IPv6 {
+			if ip, _, err := net.ParseCIDR(c.InterfaceAddress); err == nil && ip.To4() == nil {
+				return fmt.Errorf("the interface address '%s' is IPv6 already", c.InterfaceAddress)
+			}
+			if c.NetLinkBootstrap && c.InterfaceMTU < minIPv6MTU {
+				return fmt.Errorf("IPv6 requires an interface MTU of at least %d", minIPv6MTU)
+			}
+			if c.InterfaceAddress6, err = interfaceAddress6(c, nc.ExchangeKey, n.Host().ID().String()); err != nil {
+				return err
+			}
+			prefix, err := ipv6Prefix(c, nc.ExchangeKey)
+			if err != nil {
+				return err
+			}
+			c.machines6 = &MachineTable6{Prefix: prefix}
+			if ip, _, err := net.ParseCIDR(c.InterfaceAddress6); err == nil && !c.machines6.valid(ip.String(), n.Host().ID().String()) {
+				return fmt.Errorf("the IPv6 address '%s' is inside the prefix '%s', where the addresses are derived from the peer IDs", c.InterfaceAddress6, prefix)
+			}
+			// Avoid connecting to the peers through the VPN
+			if err := n.BlockSubnet(c.InterfaceAddress6); err != nil {
+				return err
+			}
+		}
+
+		if c.NetLinkBootstrap {
+			if err := prepareInterface(c); err != nil {
+				return err
+			}
+		}
 
 		// Announce our IP
-		ip, _, err := net.ParseCIDR(c.InterfaceAddress)
+		addr, err := newOverlayAddress(c.InterfaceAddress)
 		if err != nil {
 			return err
 		}
+		if c.InterfaceAddress6 != "" {
+			if err := addr.SetIP6(c.InterfaceAddress6); err != nil {
+				return err
+			}
+		}
+		interfaceUp(addr.CIDR())
+		up = true
+		dw.OnUp = func() {
+			c.Logger.Info("Writes to the interface succeed again, marking it up")
+			interfaceUp(addr.CIDR())
+			n.Emit(types.EventInterfaceUp, map[string]string{"interface": ifce.Name(), "address": addr.CIDR()})
+		}
+
+		// Set stream handler during runtime, once the device writer is
+		// ready. The frames are accepted in batches, compressed or not,
+		// and one at a time
+		for _, p := range acceptedProtocols {
+			n.SetStreamHandler(p, streamHandler(n, b, dw, c, nc))
+		}
+
+		self := n.Host().ID().String()
+		alive := func(p string) bool {
+			pid, err := peer.Decode(p)
+			return err == nil && n.Host().Network().Connectedness(pid) == network.Connected
+		}
+
+		// resolveConflict looks for other alive peers claiming our address. The loser
+		// of the conflict moves to a new address if it can, or the reason is returned.
+		resolveConflict := func() string {
+			old := addr.CIDR()
+			p, newAddress, reason := ResolveAddressConflict(ctx, b, old, self, alive, c.AddressConflictHandler)
+			switch {
+			case reason != "":
+				return reason
+			case p != "" && newAddress == "":
+				c.Logger.Warnf("Address '%s' is claimed also by '%s', keeping it", old, p)
+				return ""
+			case newAddress == "":
+				return ""
+			}
+
+			if c.NetLinkBootstrap {
+				if err := changeInterfaceAddress(c, old, newAddress); err != nil {
+					return fmt.Sprintf("could not move the interface to '%s': %s", newAddress, err.Error())
+				}
+			} else {
+				c.Logger.Warnf("The interface is not managed by EdgeVPN, set its address to '%s'", newAddress)
+			}
+			addr.Set(newAddress)
+			c.Logger.Warnf("Address '%s' is in use by '%s', moved to '%s'", old, p, newAddress)
+			interfaceUp(newAddress)
+			n.Emit(types.EventAddressConflict, map[string]string{"address": old, "peer": p, "new_address": newAddress})
+			return ""
+		}
+
+		// checkSafeMode puts the node in safe mode while a misconfiguration is detected
+		checkSafeMode := func() bool {
+			if !c.SafeModeDetection {
+				return false
+			}
+			reason := CheckAddress(addr.CIDR(), c.RouterAddress, localNetworks(ifce.Name()))
+			if reason == "" {
+				reason = resolveConflict()
+			}
+			if reason != "" {
+				n.EnterSafeMode(reason)
+				return true
+			}
+			n.ExitSafeMode()
+			return false
+		}
+		checkSafeMode()
+
+		if len(c.AdvertisedRoutes) > 0 && c.NetLinkBootstrap {
+			if _, vpnNet, err := net.ParseCIDR(addr.CIDR()); err == nil {
+				stop, err := enableForwarding(c, vpnNet)
+				if err != nil {
+					c.Logger.Warnf("Could not forward the traffic to the advertised routes: %s", err.Error())
+				} else {
+					defer stop()
+				}
+			}
+		}
+		if len(c.AcceptedRoutes) > 0 {
+			for _, a := range c.AcceptedRoutes {
+				if isDefault(a) && len(c.ExitNodes) == 0 {
+					c.Logger.Warnf("No exit node is set, the routes inside %s are not accepted", a.String())
+				}
+			}
+			c.routes = &RouteTable{}
+			go syncRoutes(ctx, c, n, b, self, alive)
+		}
+		if c.Firewall != nil {
+			go syncFirewall(ctx, c, b)
+		}
 
 		b.Announce(
 			ctx,
 			c.LedgerAnnounceTime,
 			func() {
+				// Do not claim the address while misconfigured
+				if checkSafeMode() {
+					return
+				}
+				if !c.SafeModeDetection && c.AddressConflictHandler != nil {
+					if reason := resolveConflict(); reason != "" {
+						c.Logger.Warnf("Address conflict: %s", reason)
+					}
+				}
+
+				ip := addr.IP().String()
+				ip6 := ""
+				if addr.IP6() != nil {
+					ip6 = addr.IP6().String()
+				}
 				machine := &types.Machine{}
 				// Retrieve current ID for ip in the blockchain
-				existingValue, found := b.GetKey(protocol.MachinesLedgerKey, ip.String())
+				existingValue, found := b.GetKey(protocol.MachinesLedgerKey, ip)
 				existingValue.Unmarshal(machine)
 
 				// If mismatch, update the blockchain
-				if !found || machine.PeerID != n.Host().ID().String() {
+				if !found || machine.PeerID != self || machine.Address6 != ip6 {
 					updatedMap := map[string]interface{}{}
-					updatedMap[ip.String()] = newBlockChainData(n, ip.String())
+					updatedMap[ip] = newBlockChainData(n, ip, ip6)
 					b.Add(protocol.MachinesLedgerKey, updatedMap)
 				}
+				if c.machines6 != nil {
+					for ip, peers := range c.machines6.Sync(b) {
+						winner, _ := c.machines6.Lookup(b, ip)
+						c.Logger.Warnf("IPv6 address '%s' is claimed by %s, routing it to '%s'", ip, strings.Join(peers, ", "), winner)
+					}
+				}
+
+				if len(c.AdvertisedRoutes) > 0 {
+					announceRoutes(b, self, ip, c.AdvertisedRoutes)
+				}
 			},
 		)
 
-		if c.NetLinkBootstrap {
-			if err := prepareInterface(c); err != nil {
-				return err
-			}
-		}
+		// On shutdown, stop taking new streams and reading the interface,
+		// and send the frames already read to the peers
+		reading, stopReading := context.WithCancel(ctx)
+		defer stopReading()
+		drained := make(chan struct{})
+		n.AddShutdownPhase(node.ShutdownPhase{
+			Name: node.ShutdownVPN,
+			Run: func(ctx context.Context) error {
+				for _, p := range acceptedProtocols {
+					n.Host().RemoveStreamHandler(p)
+				}
+				stopReading()
+				select {
+				case <-drained:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			},
+			Force: func() {
+				n.ResetStreams(acceptedProtocols...)
+			},
+		})
 
 		// read packets from the interface
-		return readPackets(ctx, mgr, c, n, b, ifce, nc)
+		err = readPackets(reading, mgr, rb, c, n, b, ifce, nc, addr)
+		close(drained)
+		if err != nil {
+			return err
+		}
+		// Keep the interface until the node stops
+		<-ctx.Done()
+		return nil
 	}
 }
 
@@ -127,8 +352,12 @@ func Register(p ...Option) ([]node.Option, error) {
 	return []node.Option{node.WithNetworkService(VPNNetworkService(p...))}, nil
 }
 
-func streamHandler(l *blockchain.Ledger, ifce *water.Interface, c *Config, nc node.Config) func(stream network.Stream) {
+func streamHandler(n *node.Node, l *blockchain.Ledger, dw *DeviceWriter, c *Config, nc node.Config) func(stream network.Stream) {
 	return func(stream network.Stream) {
+		if n.SafeMode() {
+			stream.Reset()
+			return
+		}
 		if len(nc.PeerTable) == 0 && !l.Exists(protocol.MachinesLedgerKey,
 			func(d blockchain.Data) bool {
 				machine := &types.Machine{}
@@ -150,15 +379,32 @@ func streamHandler(l *blockchain.Ledger, ifce *water.Interface, c *Config, nc no
 				return
 			}
 		}
-		_, err := io.Copy(ifce.ReadWriteCloser, stream)
+		var w io.Writer = dw
+		if c.Firewall != nil {
+			w = &firewallWriter{Writer: dw, firewall: c.Firewall, peer: stream.Conn().RemotePeer().String()}
+		}
+		start := time.Now()
+		var in int64
+		var err error
+		if _, batched := streamCompression(stream.Protocol()); batched {
+			in, err = ReadBatches(newPeerCounter(w, stream.Conn().RemotePeer()), stream)
+		} else {
+			in, err = io.Copy(newPeerCounter(w, stream.Conn().RemotePeer()), stream)
+		}
 		if err != nil {
+			// The peer sent batches which can't be decoded. The errors of
+			// the interface are local, so the peer is not to blame.
+			if errors.Is(err, ErrMalformedBatch) {
+				n.ReportViolation(stream.Conn().RemotePeer(), fmt.Sprintf("malformed packet: %s", err.Error()))
+			}
 			stream.Reset()
 		}
 		stream.Close()
+		n.ExportFlow(flow.NewFlow("vpn", "", stream.Conn().RemotePeer().String(), n.Host().ID().String(), uint64(in), 0, start))
 	}
 }
 
-func newBlockChainData(n *node.Node, address string) types.Machine {
+func newBlockChainData(n *node.Node, address, address6 string) types.Machine {
 	hostname, _ := os.Hostname()
 
 	return types.Machine{
@@ -168,6 +414,7 @@ func newBlockChainData(n *node.Node, address string) types.Machine {
 		Arch:     runtime.GOARCH,
 		Version:  internal.Version,
 		Address:  address,
+		Address6: address6,
 	}
 }
 
@@ -184,16 +431,64 @@ func getFrame(ifce *water.Interface, c *Config) (ethernet.Frame, error) {
 	return frame, nil
 }
 
-func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Node, ip net.IP, ledger *blockchain.Ledger, ifce *water.Interface, nc node.Config) error {
-	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
-	defer cancel()
+// frameReader is implemented by the interfaces reading several frames
+// at once, as the TUN devices with the offloads enabled
+type frameReader interface {
+	ReadFrames() ([]ethernet.Frame, error)
+}
 
+// getFrames reads the next frames from the interface
+func getFrames(ifce *water.Interface, c *Config) ([]ethernet.Frame, error) {
+	r, ok := ifce.ReadWriteCloser.(frameReader)
+	if !ok {
+		frame, err := getFrame(ifce, c)
+		if err != nil {
+			return nil, err
+		}
+		return []ethernet.Frame{frame}, nil
+	}
+	frames, err := r.ReadFrames()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read from interface")
+	}
+	return frames, nil
+}
+
+// handleFrames sends the frames to the peers they are routed to, the
+// frames to the same peer in one batch. The frames which can't be sent
+// are dropped, and the errors logged.
+func handleFrames(mgr streamManager, rb *ReopenBackoff, frames []ethernet.Frame, c *Config, n *node.Node, addr *overlayAddress, ledger *blockchain.Ledger, nc node.Config) {
+	peers := []peer.ID{}
+	routed := map[peer.ID][]ethernet.Frame{}
+	for _, f := range frames {
+		d, err := routeFrame(f, c, n, addr, ledger, nc)
+		if err != nil {
+			c.Logger.Debugf("could not handle frame: %s", err.Error())
+			continue
+		}
+		if _, ok := routed[d]; !ok {
+			peers = append(peers, d)
+		}
+		routed[d] = append(routed[d], f)
+	}
+	for _, d := range peers {
+		if err := sendFrames(mgr, rb, d, routed[d], c, n); err != nil {
+			c.Logger.Debugf("could not handle frame: %s", err.Error())
+		}
+	}
+}
+
+// routeFrame returns the peer the frame is routed to
+func routeFrame(frame ethernet.Frame, c *Config, n *node.Node, addr *overlayAddress, ledger *blockchain.Ledger, nc node.Config) (peer.ID, error) {
+	if n.SafeMode() {
+		return "", errors.New("safe mode enabled, dropping frame")
+	}
 	var dstIP, srcIP net.IP
 	var packet layers.IPv4
 	if err := packet.DecodeFromBytes(frame, gopacket.NilDecodeFeedback); err != nil {
 		var packet layers.IPv6
 		if err := packet.DecodeFromBytes(frame, gopacket.NilDecodeFeedback); err != nil {
-			return errors.Wrap(err, "could not parse header from frame")
+			return "", errors.Wrap(err, "could not parse header from frame")
 		} else {
 			dstIP = packet.DstIP
 			srcIP = packet.SrcIP
@@ -204,9 +499,13 @@ func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Nod
 	}
 
 	dst := dstIP.String()
-	if c.RouterAddress != "" && srcIP.Equal(ip) {
-		if _, found := ledger.GetKey(protocol.MachinesLedgerKey, dst); !found {
-			dst = c.RouterAddress
+	if (c.routes != nil || c.RouterAddress != "") && (srcIP.Equal(addr.IP()) || srcIP.Equal(addr.IP6())) {
+		if _, found := machinePeer(c, ledger, dst); !found {
+			if via, ok := c.routes.Lookup(dstIP); ok {
+				dst = via
+			} else if c.RouterAddress != "" {
+				dst = c.RouterAddress
+			}
 		}
 	}
 
@@ -222,103 +521,244 @@ func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Nod
 			}
 		}
 		if !found {
-			return notFoundErr
+			return "", notFoundErr
 		}
 	} else {
 		// Query the routing table
-		value, found := ledger.GetKey(protocol.MachinesLedgerKey, dst)
+		p, found := machinePeer(c, ledger, dst)
 		if !found {
-			return notFoundErr
+			return "", notFoundErr
 		}
-		machine := &types.Machine{}
-		value.Unmarshal(machine)
 
 		// Decode the Peer
-		d, err = peer.Decode(machine.PeerID)
+		d, err = peer.Decode(p)
 	}
 
 	if err != nil {
-		return errors.Wrap(err, "could not decode peer")
+		return "", errors.Wrap(err, "could not decode peer")
 	}
+	if c.Firewall != nil {
+		c.Firewall.Track(d.String(), frame)
+	}
+	return d, nil
+}
+
+// machinePeer returns the peer of the machine with the address in the ledger.
+// The machines are stored by their IPv4 address (or IPv6, if single-stack),
+// and the IPv6 addresses of the dual-stack machines are looked up apart.
+func machinePeer(c *Config, ledger *blockchain.Ledger, ip string) (string, bool) {
+	if value, found := ledger.GetKey(protocol.MachinesLedgerKey, ip); found {
+		machine := &types.Machine{}
+		value.Unmarshal(machine)
+		return machine.PeerID, true
+	}
+	if c.machines6 != nil && strings.Contains(ip, ":") {
+		return c.machines6.Lookup(ledger, ip)
+	}
+	return "", false
+}
+
+// sendFrames writes the frames to a stream to the peer
+func sendFrames(mgr streamManager, rb *ReopenBackoff, d peer.ID, frames []ethernet.Frame, c *Config, n *node.Node) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
 
 	var stream network.Stream
+	var err error
 	if mgr != nil {
 		// Open a stream if necessary
 		stream, err = mgr.HasStream(n.Host().Network(), d)
 		if err == nil {
-			_, err = stream.Write(frame)
+			err = writeFrames(stream, frames, c.Timeout)
 			if err == nil {
+				framesSent(d, frames)
 				return nil
 			}
 			mgr.Disconnected(n.Host().Network(), stream)
 		}
 	}
 
-	stream, err = n.Host().NewStream(ctx, d, protocol.EdgeVPN.ID())
+	if rb != nil && !rb.Allow(d) {
+		return fmt.Errorf("could not open stream to %s: waiting backoff", d.String())
+	}
+
+	start := time.Now()
+	stream, err = n.Host().NewStream(ctx, d, vpnProtocols(c)...)
+	metrics.StreamOpenLatency.Since(start)
 	if err != nil {
+		if rb != nil && rb.Failure(d) {
+			// Drop the route to the peer, discovery will reconnect it
+			c.Logger.Warnf("giving up opening streams to %s, closing connection", d.String())
+			n.Host().Network().ClosePeer(d)
+		}
 		return fmt.Errorf("could not open stream to %s: %w", d.String(), err)
 	}
 	defer stream.Close()
 
+	if rb != nil {
+		rb.Success(d)
+	}
+
 	if mgr != nil {
 		mgr.Connected(n.Host().Network(), stream)
 	}
 
-	_, err = stream.Write(frame)
-	return err
+	if err = writeFrames(stream, frames, c.Timeout); err != nil {
+		return err
+	}
+	framesSent(d, frames)
+	return nil
+}
+
+// framesSent counts the frames sent to the peer
+func framesSent(p peer.ID, frames []ethernet.Frame) {
+	bytes := 0
+	for _, f := range frames {
+		bytes += len(f)
+	}
+	metrics.VPNPacketsSent.With(p.String()).Add(uint64(len(frames)))
+	metrics.VPNBytesSent.With(p.String()).Add(uint64(bytes))
+}
+
+// peerCounter counts the frames written to the interface from a peer.
+// Each write carries a frame: the peers write them one at a time, and
+// the frames of the batches are written one at a time too.
+type peerCounter struct {
+	io.Writer
+	packets, bytes *metrics.Counter
+}
+
+func newPeerCounter(w io.Writer, p peer.ID) *peerCounter {
+	return &peerCounter{Writer: w, packets: metrics.VPNPacketsReceived.With(p.String()), bytes: metrics.VPNBytesReceived.With(p.String())}
+}
+
+func (c *peerCounter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	if err == nil {
+		c.packets.Add(1)
+		c.bytes.Add(uint64(n))
+	}
+	return n, err
+}
+
+// writeFrames writes the frames to the stream, in batches with one write if
+// the stream protocol is a batch one, giving up if the peer does not accept
+// them in time so a congested peer can't hold a worker forever
+func writeFrames(s network.Stream, frames []ethernet.Frame, timeout time.Duration) error {
+	if err := s.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	compression, batched := streamCompression(s.Protocol())
+	if !batched {
+		for _, f := range frames {
+			if _, err := s.Write(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	buf := batchBuffers.Get().(*[]byte)
+	defer batchBuffers.Put(buf)
+	b, err := EncodeBatch((*buf)[:0], frames, compression)
+	*buf = b
+	if err != nil {
+		return err
+	}
+	if _, err := s.Write(b); err != nil {
+		return err
+	}
+	metrics.VPNBatchesSent.Add(1)
+	metrics.VPNBatchBytesSent.Add(uint64(len(b)))
+	return nil
+}
+
+// batchBuffers are the buffers the batches are encoded in
+var batchBuffers = sync.Pool{New: func() any { return &[]byte{} }}
+
+// coalesce returns the frame along with the frames already queued after it,
+// up to max frames, without waiting for more
+func coalesce(frames <-chan ethernet.Frame, f ethernet.Frame, max int) []ethernet.Frame {
+	batch := []ethernet.Frame{f}
+	for len(batch) < max {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, f)
+		default:
+			return batch
+		}
+	}
+	return batch
 }
 
 func connectionWorker(
-	p chan ethernet.Frame,
+	ctx context.Context,
+	p <-chan ethernet.Frame,
 	mgr streamManager,
+	rb *ReopenBackoff,
 	c *Config,
 	n *node.Node,
-	ip net.IP,
+	addr *overlayAddress,
 	wg *sync.WaitGroup,
 	ledger *blockchain.Ledger,
-	ifce *water.Interface,
 	nc node.Config) {
 	defer wg.Done()
-	for f := range p {
-		if err := handleFrame(mgr, f, c, n, ip, ledger, ifce, nc); err != nil {
-			c.Logger.Debugf("could not handle frame: %s", err.Error())
+	for {
+		select {
+		case f := <-p:
+			handleFrames(mgr, rb, coalesce(p, f, c.BatchSize), c, n, addr, ledger, nc)
+		case <-ctx.Done():
+			// Send the frames queued before stopping
+			for {
+				select {
+				case f := <-p:
+					handleFrames(mgr, rb, coalesce(p, f, c.BatchSize), c, n, addr, ledger, nc)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
-// redirects packets from the interface to the node using the routing table in the blockchain
-func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node, ledger *blockchain.Ledger, ifce *water.Interface, nc node.Config) error {
-	ip, _, err := net.ParseCIDR(c.InterfaceAddress)
-	if err != nil {
-		return err
-	}
-
+// redirects packets from the interface to the node using the routing table in the blockchain,
+// until the context is done and the frames read are sent
+func readPackets(ctx context.Context, mgr streamManager, rb *ReopenBackoff, c *Config, n *node.Node, ledger *blockchain.Ledger, ifce *water.Interface, nc node.Config, addr *overlayAddress) error {
 	wg := new(sync.WaitGroup)
 
-	packets := make(chan ethernet.Frame, c.ChannelBufferSize)
-
-	defer func() {
-		close(packets)
-		wg.Wait()
-	}()
+	packets := NewPipeline(c.ChannelBufferSize, c.BackpressureTimeout)
+	readPipeline.Lock()
+	readPipeline.p = packets
+	readPipeline.interfaces[ifce.Name()] = packets
+	readPipeline.Unlock()
 
 	for i := 0; i < c.Concurrency; i++ {
 		wg.Add(1)
-		go connectionWorker(packets, mgr, c, n, ip, wg, ledger, ifce, nc)
+		go connectionWorker(ctx, packets.Frames(), mgr, rb, c, n, addr, wg, ledger, nc)
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			frame, err := getFrame(ifce, c)
+	// The reads block until a frame comes, or the interface is closed
+	go func() {
+		for ctx.Err() == nil {
+			frames, err := getFrames(ifce, c)
 			if err != nil {
-				c.Logger.Errorf("could not get frame '%s'", err.Error())
+				if ctx.Err() == nil {
+					c.Logger.Errorf("could not get frame '%s'", err.Error())
+				}
 				continue
 			}
 
-			packets <- frame
+			for _, frame := range frames {
+				if !packets.Push(ctx, frame) {
+					c.Logger.Debugf("peers are congested, dropping frame")
+				}
+			}
 		}
-	}
+	}()
+
+	<-ctx.Done()
+	wg.Wait()
+	return nil
 }